@@ -0,0 +1,103 @@
+package api
+
+import "time"
+
+// The kinds of prerequisites that an add-on can have.
+const (
+	// PrerequisitePlan is satisfied by a subscription to the required plan.
+	PrerequisitePlan = "plan"
+
+	// PrerequisiteAddon is satisfied by a subscription that already has the
+	// required add-on.
+	PrerequisiteAddon = "addon"
+)
+
+// BundledAddon identifies an add-on that belongs to a bundle.
+type BundledAddon struct {
+	ID           string       `json:"uuid"`
+	Name         string       `json:"name"`
+	ResourceType ResourceType `json:"resource_type"`
+}
+
+// AddonBundle is a named group of add-ons that are attached to a subscription
+// together.
+type AddonBundle struct {
+	ID          string          `json:"uuid"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Addons      []*BundledAddon `json:"addons"`
+	CreatedBy   string          `json:"created_by"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// AddAddonBundleRequest is used to add a bundle of existing add-ons.
+type AddAddonBundleRequest struct {
+	Request
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	AddonIDs    []string `json:"addon_uuids"`
+	CreatedBy   string   `json:"created_by,omitempty"`
+}
+
+// AddonBundleResponse contains a single add-on bundle.
+type AddonBundleResponse struct {
+	Response
+	Bundle *AddonBundle `json:"bundle,omitempty"`
+}
+
+// AddonBundleListResponse contains all of the add-on bundles.
+type AddonBundleListResponse struct {
+	Response
+	Bundles []*AddonBundle `json:"bundles"`
+}
+
+// AttachAddonBundleRequest is used to attach every add-on in a bundle to a
+// subscription.
+type AttachAddonBundleRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	BundleName     string `json:"bundle_name"`
+}
+
+// AttachAddonBundleResponse lists the add-ons that were attached to a
+// subscription along with a bundle.
+type AttachAddonBundleResponse struct {
+	Response
+	SubscriptionID string            `json:"subscription_uuid"`
+	BundleName     string            `json:"bundle_name"`
+	Addons         []*AddonEventData `json:"addons"`
+}
+
+// AddonPrerequisite is a plan or add-on that a subscription must have for an
+// add-on to be attached to it.
+type AddonPrerequisite struct {
+	Type string `json:"type"`
+	ID   string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// SetAddonPrerequisitesRequest replaces the prerequisites of an add-on. An
+// add-on with prerequisites can only be attached to a subscription to one of
+// the required plans or to a subscription that already has one of the
+// required add-ons. Leaving both lists empty removes the prerequisites.
+type SetAddonPrerequisitesRequest struct {
+	Request
+	AddonID          string   `json:"addon_uuid"`
+	RequiredPlans    []string `json:"required_plans"`
+	RequiredAddonIDs []string `json:"required_addon_uuids"`
+	RequestedBy      string   `json:"requested_by,omitempty"`
+}
+
+// GetAddonPrerequisitesRequest is used to look up the prerequisites of an
+// add-on.
+type GetAddonPrerequisitesRequest struct {
+	Request
+	AddonID string `json:"addon_uuid"`
+}
+
+// AddonPrerequisitesResponse lists the prerequisites of an add-on.
+type AddonPrerequisitesResponse struct {
+	Response
+	AddonID       string               `json:"addon_uuid"`
+	Prerequisites []*AddonPrerequisite `json:"prerequisites"`
+}
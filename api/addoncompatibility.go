@@ -0,0 +1,71 @@
+package api
+
+// CompatiblePlan identifies a plan that an add-on can be attached to.
+type CompatiblePlan struct {
+	ID   string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// SetAddonCompatibilityRequest replaces the plans that an add-on can be
+// attached to. Leaving the list empty makes the add-on compatible with every
+// plan.
+type SetAddonCompatibilityRequest struct {
+	Request
+	AddonID     string   `json:"addon_uuid"`
+	Plans       []string `json:"plans"`
+	RequestedBy string   `json:"requested_by,omitempty"`
+}
+
+// GetAddonCompatibilityRequest is used to look up the plans that an add-on can
+// be attached to.
+type GetAddonCompatibilityRequest struct {
+	Request
+	AddonID string `json:"addon_uuid"`
+}
+
+// AddonCompatibilityResponse lists the plans that an add-on can be attached
+// to. An empty list means that the add-on is compatible with every plan.
+type AddonCompatibilityResponse struct {
+	Response
+	AddonID string            `json:"addon_uuid"`
+	Plans   []*CompatiblePlan `json:"plans"`
+}
+
+// AvailableAddon describes an add-on that can be attached to subscriptions to
+// a plan, along with its current rate.
+type AvailableAddon struct {
+	ID            string       `json:"uuid"`
+	Name          string       `json:"name"`
+	Description   string       `json:"description"`
+	ResourceType  ResourceType `json:"resource_type"`
+	DefaultAmount float64      `json:"default_amount"`
+	DefaultPaid   *bool        `json:"default_paid,omitempty"`
+	Rate          *float64     `json:"rate,omitempty"`
+
+	// MaxPerSubscription is the maximum number of units of the add-on that can
+	// be attached to a single subscription, or zero if there's no maximum.
+	MaxPerSubscription int64 `json:"max_per_subscription,omitempty"`
+}
+
+// ListAddonsForPlanRequest is used to list the add-ons that can be attached to
+// subscriptions to a plan.
+type ListAddonsForPlanRequest struct {
+	Request
+	PlanID string `json:"plan_uuid"`
+}
+
+// AddonsForPlanResponse lists the add-ons that can be attached to
+// subscriptions to a plan.
+type AddonsForPlanResponse struct {
+	Response
+	PlanID string            `json:"plan_uuid"`
+	Addons []*AvailableAddon `json:"addons"`
+}
+
+// Redact removes the paid flags and rates from the add-ons.
+func (r *AddonsForPlanResponse) Redact() {
+	for _, addon := range r.Addons {
+		addon.DefaultPaid = nil
+		addon.Rate = nil
+	}
+}
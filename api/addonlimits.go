@@ -0,0 +1,17 @@
+package api
+
+// SetAddonLimitRequest sets the maximum number of units of an add-on that can
+// be attached to a single subscription. A maximum of zero removes the limit.
+type SetAddonLimitRequest struct {
+	Request
+	AddonID            string `json:"addon_uuid"`
+	MaxPerSubscription int64  `json:"max_per_subscription"`
+}
+
+// AddonLimitResponse contains the maximum number of units of an add-on that can
+// be attached to a single subscription, which is zero if there's no maximum.
+type AddonLimitResponse struct {
+	Response
+	AddonID            string `json:"addon_uuid"`
+	MaxPerSubscription int64  `json:"max_per_subscription"`
+}
@@ -0,0 +1,55 @@
+package api
+
+import "time"
+
+// ResourceType describes a type of resource that can be limited by a quota.
+type ResourceType struct {
+	ID   string `json:"uuid"`
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+}
+
+// SubscriptionAddonDetail describes a single add-on that was applied to a
+// subscription. The details are retained in summaries for billing purposes,
+// including the details of add-ons that have expired.
+type SubscriptionAddonDetail struct {
+	ID       string     `json:"uuid"`
+	Amount   float64    `json:"amount"`
+	Quantity int64      `json:"quantity"`
+	Paid     *bool      `json:"paid,omitempty"`
+	Rate     *float64   `json:"rate,omitempty"`
+	EndDate  *time.Time `json:"end_date,omitempty"`
+	Expired  bool       `json:"expired,omitempty"`
+}
+
+// SubscriptionAddonSummary rolls up all of the add-ons of the same type that
+// have been applied to a subscription. The quantity is the total number of
+// units attached, which can be more than the number of subscription add-ons.
+// Add-ons that have expired aren't counted in the quantity or the total.
+type SubscriptionAddonSummary struct {
+	AddonID      string                     `json:"addon_uuid"`
+	Name         string                     `json:"name"`
+	Description  string                     `json:"description"`
+	ResourceType ResourceType               `json:"resource_type"`
+	Quantity     int                        `json:"quantity"`
+	TotalAmount  float64                    `json:"total_amount"`
+	Details      []*SubscriptionAddonDetail `json:"subscription_addons"`
+}
+
+// SubscriptionAddonSummaryResponse lists the summarized add-ons that have been
+// applied to a subscription.
+type SubscriptionAddonSummaryResponse struct {
+	Response
+	SubscriptionID string                      `json:"subscription_uuid"`
+	Summaries      []*SubscriptionAddonSummary `json:"summaries"`
+}
+
+// Redact removes the paid flags and rates from the add-on details.
+func (r *SubscriptionAddonSummaryResponse) Redact() {
+	for _, summary := range r.Summaries {
+		for _, detail := range summary.Details {
+			detail.Paid = nil
+			detail.Rate = nil
+		}
+	}
+}
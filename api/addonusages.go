@@ -0,0 +1,39 @@
+package api
+
+// AddonUsage is the portion of a resource's usage that's attributed to one of
+// the add-ons applied to the subscription, along with the amount that the
+// add-on contributed to the quota.
+type AddonUsage struct {
+	SubscriptionAddonID string  `json:"subscription_addon_uuid"`
+	AddonID             string  `json:"addon_uuid"`
+	AddonName           string  `json:"addon_name"`
+	Amount              float64 `json:"amount"`
+	Usage               float64 `json:"usage"`
+}
+
+// ResourceUsageBreakdown shows how much of the usage of a resource is
+// attributed to each of the subscription's add-ons for that resource. The
+// unattributed usage is the rest of the usage.
+type ResourceUsageBreakdown struct {
+	ResourceType      ResourceType  `json:"resource_type"`
+	Quota             float64       `json:"quota"`
+	Usage             float64       `json:"usage"`
+	UnattributedUsage float64       `json:"unattributed_usage"`
+	Addons            []*AddonUsage `json:"addons"`
+}
+
+// UsageBreakdownRequest is used to look up the breakdown of a user's usages by
+// add-on.
+type UsageBreakdownRequest struct {
+	Request
+	Username string `json:"username"`
+}
+
+// UsageBreakdownResponse contains the breakdown of the usages of a user's
+// current subscription by add-on.
+type UsageBreakdownResponse struct {
+	Response
+	Username       string                    `json:"username"`
+	SubscriptionID string                    `json:"subscription_uuid,omitempty"`
+	Resources      []*ResourceUsageBreakdown `json:"resources"`
+}
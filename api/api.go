@@ -0,0 +1,96 @@
+// Package api contains the request and response messages for operations that
+// aren't covered by the protocol buffer definitions shared with the rest of the
+// Discovery Environment. The messages are encoded as plain JSON, both over NATS
+// and over HTTP.
+package api
+
+import (
+	"context"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/svcerror"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header contains message metadata, including the tracing information that is
+// propagated between services.
+type Header map[string]string
+
+// Request contains the fields common to every request message.
+type Request struct {
+	Header Header `json:"header,omitempty"`
+}
+
+// GetHeader returns the request header, which may be nil.
+func (r *Request) GetHeader() Header {
+	return r.Header
+}
+
+// Carrier returns a carrier that can be used to inject tracing information
+// into the header of a request sent to another service.
+func (r *Request) Carrier() propagation.MapCarrier {
+	if r.Header == nil {
+		r.Header = make(Header)
+	}
+	return propagation.MapCarrier(r.Header)
+}
+
+// DERequest is implemented by every request message in this package.
+type DERequest interface {
+	GetHeader() Header
+	Carrier() propagation.MapCarrier
+}
+
+// Response contains the fields common to every response message.
+type Response struct {
+	Header Header                 `json:"header,omitempty"`
+	Error  *svcerror.ServiceError `json:"error,omitempty"`
+}
+
+// GetError returns the error included in the response, if there is one.
+func (r *Response) GetError() *svcerror.ServiceError {
+	return r.Error
+}
+
+// Carrier returns a carrier that can be used to inject tracing information
+// into the response header.
+func (r *Response) Carrier() propagation.MapCarrier {
+	if r.Header == nil {
+		r.Header = make(Header)
+	}
+	return propagation.MapCarrier(r.Header)
+}
+
+// DEResponse is implemented by every response message in this package.
+type DEResponse interface {
+	GetError() *svcerror.ServiceError
+	Carrier() propagation.MapCarrier
+}
+
+// InitRequest starts a span for an incoming request, using the tracing
+// information in the request header if it's present. Callers must end the span.
+func InitRequest(header Header, subject string) (context.Context, trace.Span) {
+	if header == nil {
+		header = make(Header)
+	}
+	return gotelnats.StartSpan(propagation.MapCarrier(header), subject, gotelnats.Process)
+}
+
+// ByUUIDRequest is a request that refers to a single object by its UUID.
+type ByUUIDRequest struct {
+	Request
+	UUID string `json:"uuid"`
+}
+
+// ByUsernameRequest is a request that refers to a single user.
+type ByUsernameRequest struct {
+	Request
+	Username string `json:"username"`
+}
+
+// Redactor is implemented by response messages that contain fields that only
+// administrators are allowed to see.
+type Redactor interface {
+	Redact()
+}
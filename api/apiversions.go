@@ -0,0 +1,14 @@
+package api
+
+// APIVersionResponse describes the versions of the NATS API. Version 1 is
+// served on the original subjects, and later versions are served on subjects
+// with the version after the prefix, such as cyverse.qms.v2.user.summary.get.
+// RequestVersion is the version that the request was sent with, and is empty
+// for HTTP requests.
+type APIVersionResponse struct {
+	Response
+	Current        string   `json:"current"`
+	Supported      []string `json:"supported"`
+	Enabled        []string `json:"enabled"`
+	RequestVersion string   `json:"request_version,omitempty"`
+}
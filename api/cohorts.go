@@ -0,0 +1,39 @@
+package api
+
+// ExpireCohortRequest asks for the subscriptions of every user in a cohort to be
+// ended and/or for their add-ons to be removed. The users are processed in
+// batches so that no single transaction holds locks for very long.
+type ExpireCohortRequest struct {
+	Request
+
+	// Usernames lists the members of the cohort.
+	Usernames []string `json:"usernames"`
+
+	// EndSubscriptions indicates that the active subscriptions should end now.
+	EndSubscriptions bool `json:"end_subscriptions"`
+
+	// RemoveAddons indicates that add-ons should be removed from the active
+	// subscriptions.
+	RemoveAddons bool `json:"remove_addons"`
+
+	// BatchSize is the number of users to process in each transaction.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// RequestedBy is the username of the person making the request.
+	RequestedBy string `json:"requested_by,omitempty"`
+
+	// DryRun indicates that the outcome should be reported without changing
+	// any subscriptions. Dry runs are processed before the response is sent
+	// rather than in the background.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// CohortExpirationPreview describes what expiring a cohort would do. Users in
+// batches that couldn't be processed are counted as failed.
+type CohortExpirationPreview struct {
+	Users              int    `json:"users"`
+	EndedSubscriptions int    `json:"ended_subscriptions"`
+	RemovedAddons      int    `json:"removed_addons"`
+	Failed             int    `json:"failed"`
+	ErrorMessage       string `json:"error_message,omitempty"`
+}
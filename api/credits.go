@@ -0,0 +1,67 @@
+package api
+
+import "time"
+
+// CreditBalance is the amount of credit that a user has left for a resource
+// type. Usage of the resource type is drawn from the credits before it counts
+// against the quota.
+type CreditBalance struct {
+	ResourceType   ResourceType `json:"resource_type"`
+	Balance        float64      `json:"balance"`
+	LastModifiedAt time.Time    `json:"last_modified_at"`
+}
+
+// CreditEntry is a single deposit or draw in a user's credit ledger. Draws
+// refer to the usage update that they were made for.
+type CreditEntry struct {
+	ID           string       `json:"uuid"`
+	Username     string       `json:"username"`
+	ResourceType ResourceType `json:"resource_type"`
+	Kind         string       `json:"kind"`
+	Amount       float64      `json:"amount"`
+	UpdateID     string       `json:"update_uuid,omitempty"`
+	Description  string       `json:"description,omitempty"`
+	CreatedBy    string       `json:"created_by"`
+	CreatedAt    time.Time    `json:"created_at"`
+}
+
+// CreditsRequest is used to look up a user's credit balances or ledger entries.
+// The resource name is optional and limits the results to a single resource
+// type.
+type CreditsRequest struct {
+	Request
+	Username     string `json:"username"`
+	ResourceName string `json:"resource_name,omitempty"`
+}
+
+// DepositCreditsRequest is used to deposit credits for a resource type into a
+// user's balance.
+type DepositCreditsRequest struct {
+	Request
+	Username     string  `json:"username"`
+	ResourceName string  `json:"resource_name"`
+	Amount       float64 `json:"amount"`
+	Description  string  `json:"description,omitempty"`
+	RequestedBy  string  `json:"requested_by,omitempty"`
+}
+
+// CreditBalanceResponse contains a user's credit balances.
+type CreditBalanceResponse struct {
+	Response
+	Username string           `json:"username"`
+	Balances []*CreditBalance `json:"balances"`
+}
+
+// DepositCreditsResponse contains the ledger entry for a deposit along with the
+// resulting balance.
+type DepositCreditsResponse struct {
+	Response
+	Entry   *CreditEntry `json:"entry,omitempty"`
+	Balance float64      `json:"balance"`
+}
+
+// CreditLedgerResponse contains the entries in a user's credit ledger.
+type CreditLedgerResponse struct {
+	Response
+	Entries []*CreditEntry `json:"entries"`
+}
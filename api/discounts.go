@@ -0,0 +1,73 @@
+package api
+
+import "time"
+
+// DiscountCode is a code that can be redeemed for a discount on the rate of a
+// new or renewed subscription. The discount type is either percent or fixed.
+type DiscountCode struct {
+	ID              string     `json:"uuid"`
+	Code            string     `json:"code"`
+	Description     string     `json:"description,omitempty"`
+	DiscountType    string     `json:"discount_type"`
+	Amount          float64    `json:"amount"`
+	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
+	MaxRedemptions  int32      `json:"max_redemptions,omitempty"`
+	RedemptionCount int32      `json:"redemption_count"`
+	CreatedBy       string     `json:"created_by"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastModifiedAt  time.Time  `json:"last_modified_at"`
+}
+
+// DiscountRedemption is the discount applied to a subscription, including the
+// rates before and after the discount.
+type DiscountRedemption struct {
+	ID             string    `json:"uuid"`
+	Code           string    `json:"code"`
+	DiscountType   string    `json:"discount_type"`
+	Amount         float64   `json:"amount"`
+	SubscriptionID string    `json:"subscription_uuid"`
+	OriginalRate   float64   `json:"original_rate"`
+	DiscountedRate float64   `json:"discounted_rate"`
+	RedeemedBy     string    `json:"redeemed_by"`
+	RedeemedAt     time.Time `json:"redeemed_at"`
+}
+
+// AddDiscountCodeRequest is used to add a discount code. The amount is a
+// percentage for percent discounts. The expiration date and the maximum number
+// of redemptions are optional.
+type AddDiscountCodeRequest struct {
+	Request
+	Code           string     `json:"code"`
+	Description    string     `json:"description,omitempty"`
+	DiscountType   string     `json:"discount_type"`
+	Amount         float64    `json:"amount"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	MaxRedemptions int32      `json:"max_redemptions,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+}
+
+// GetDiscountCodeRequest is used to look up a discount code.
+type GetDiscountCodeRequest struct {
+	Request
+	Code string `json:"code"`
+}
+
+// DiscountCodeResponse contains a single discount code.
+type DiscountCodeResponse struct {
+	Response
+	DiscountCode *DiscountCode `json:"discount_code,omitempty"`
+}
+
+// DiscountCodeListResponse contains a list of discount codes.
+type DiscountCodeListResponse struct {
+	Response
+	DiscountCodes []*DiscountCode `json:"discount_codes"`
+}
+
+// SubscriptionDiscountResponse contains the discount applied to a
+// subscription, if there is one.
+type SubscriptionDiscountResponse struct {
+	Response
+	SubscriptionID string              `json:"subscription_uuid"`
+	Discount       *DiscountRedemption `json:"discount,omitempty"`
+}
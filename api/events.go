@@ -0,0 +1,120 @@
+package api
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The types of subscription lifecycle events.
+const (
+	EventSubscriptionCreated  = "subscription.created"
+	EventSubscriptionRenewed  = "subscription.renewed"
+	EventSubscriptionExpired  = "subscription.expired"
+	EventSubscriptionExpiring = "subscription.expiring"
+	EventAddonAttached        = "addon.attached"
+	EventAddonExpired         = "addon.expired"
+	EventQuotaExceeded        = "quota.exceeded"
+	EventTrialExpiring        = "trial.expiring"
+)
+
+// The event types that are only published as domain events.
+const (
+	EventUsageUpdated = "usage.updated"
+	EventQuotaUpdated = "quota.updated"
+)
+
+// EventSchemaVersion is the version of the event payload schema. It's
+// incremented whenever a change is made to an event payload that isn't
+// backwards compatible.
+const EventSchemaVersion = 1
+
+// EventTypes lists the event types that webhooks can be registered for.
+var EventTypes = []string{
+	EventSubscriptionCreated,
+	EventSubscriptionRenewed,
+	EventSubscriptionExpired,
+	EventSubscriptionExpiring,
+	EventAddonAttached,
+	EventAddonExpired,
+	EventQuotaExceeded,
+	EventTrialExpiring,
+}
+
+// Event is the payload that is sent to a webhook or published to JetStream
+// when an event occurs.
+type Event struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schema_version"`
+	OccurredAt    time.Time `json:"occurred_at"`
+	Data          any       `json:"data"`
+}
+
+// SubscriptionEventData describes the subscription that an event refers to.
+type SubscriptionEventData struct {
+	SubscriptionID string `json:"subscription_uuid"`
+	Username       string `json:"username"`
+	PlanName       string `json:"plan_name,omitempty"`
+}
+
+// AddonEventData describes an add-on that was applied to a subscription. The
+// amount is the total amount added to the quota by all of the units attached,
+// or removed from the quota when the add-on expires.
+type AddonEventData struct {
+	SubscriptionID      string  `json:"subscription_uuid"`
+	SubscriptionAddonID string  `json:"subscription_addon_uuid"`
+	AddonID             string  `json:"addon_uuid"`
+	AddonName           string  `json:"addon_name"`
+	Amount              float64 `json:"amount"`
+	Quantity            int64   `json:"quantity,omitempty"`
+}
+
+// NewEvent returns a new event of the given type with a new ID, the current
+// schema version and the current time.
+func NewEvent(eventType string, data any) *Event {
+	return &Event{
+		ID:            uuid.NewString(),
+		Type:          eventType,
+		SchemaVersion: EventSchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		Data:          data,
+	}
+}
+
+// UsageEventData describes a change to a user's usage of a resource.
+type UsageEventData struct {
+	SubscriptionID string  `json:"subscription_uuid"`
+	Username       string  `json:"username"`
+	ResourceName   string  `json:"resource_name"`
+	Usage          float64 `json:"usage"`
+}
+
+// QuotaEventData describes a change to a quota, or a quota that a user has
+// reached or exceeded.
+type QuotaEventData struct {
+	SubscriptionID string  `json:"subscription_uuid,omitempty"`
+	Username       string  `json:"username"`
+	ResourceName   string  `json:"resource_name"`
+	Quota          float64 `json:"quota"`
+	Usage          float64 `json:"usage"`
+}
+
+// TrialEventData describes a trial subscription.
+type TrialEventData struct {
+	SubscriptionID string    `json:"subscription_uuid"`
+	Username       string    `json:"username"`
+	PlanName       string    `json:"plan_name"`
+	EndsAt         time.Time `json:"ends_at"`
+}
+
+// ExpirationReminderEventData describes a subscription that ends within one of
+// the reminder windows. The window is the number of days before the end of the
+// subscription that the reminder is for.
+type ExpirationReminderEventData struct {
+	SubscriptionID string    `json:"subscription_uuid"`
+	Username       string    `json:"username"`
+	PlanName       string    `json:"plan_name"`
+	EndsAt         time.Time `json:"ends_at"`
+	WindowDays     int32     `json:"window_days"`
+}
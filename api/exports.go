@@ -0,0 +1,19 @@
+package api
+
+import "time"
+
+// ExportRequest is used to request an export of every subscription along with
+// its quotas and usages. Format is csv or parquet and defaults to csv.
+type ExportRequest struct {
+	Request
+	Format string `json:"format,omitempty" query:"format"`
+}
+
+// ExportResponse describes an export that was written to object storage.
+type ExportResponse struct {
+	Response
+	Key         string    `json:"key"`
+	Format      string    `json:"format"`
+	Rows        int64     `json:"rows"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
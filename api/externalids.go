@@ -0,0 +1,18 @@
+package api
+
+// ExternalIDRequest is used to look up a subscription or subscription add-on by
+// the identifier assigned to it by an external system.
+type ExternalIDRequest struct {
+	Request
+	Source     string `json:"source"`
+	ExternalID string `json:"external_id"`
+}
+
+// ExternalIDResponse contains the UUID of the subscription or subscription
+// add-on with an external ID.
+type ExternalIDResponse struct {
+	Response
+	Source     string `json:"source"`
+	ExternalID string `json:"external_id"`
+	UUID       string `json:"uuid,omitempty"`
+}
@@ -0,0 +1,50 @@
+package api
+
+import "time"
+
+// The models that can be used to forecast usage.
+const (
+	// ForecastModelLinear fits a straight line to the usage over the current
+	// subscription period.
+	ForecastModelLinear = "linear"
+
+	// ForecastModelEWMA uses an exponentially weighted moving average of the
+	// daily usage, so that recent days count for more than earlier ones.
+	ForecastModelEWMA = "ewma"
+)
+
+// UsageForecastRequest asks when a user will run out of a resource. The model
+// defaults to ForecastModelLinear.
+type UsageForecastRequest struct {
+	Request
+	Username     string `json:"username"`
+	ResourceName string `json:"resource_name"`
+	Model        string `json:"model,omitempty"`
+}
+
+// UsageForecast projects when a user's usage of a resource will reach the quota
+// at the rate the resource has been used during the current subscription. The
+// exhaustion date and the number of days remaining are omitted if the resource
+// has no quota or isn't being used up.
+type UsageForecast struct {
+	Username            string          `json:"username"`
+	ResourceType        ResourceType    `json:"resource_type"`
+	Model               string          `json:"model"`
+	Quota               float64         `json:"quota"`
+	Usage               float64         `json:"usage"`
+	Remaining           float64         `json:"remaining"`
+	DailyRate           float64         `json:"daily_rate"`
+	DataPoints          int             `json:"data_points"`
+	SubscriptionEndDate time.Time       `json:"subscription_end_date"`
+	Exhausted           bool            `json:"exhausted"`
+	ExhaustionDate      *time.Time      `json:"exhaustion_date,omitempty"`
+	DaysRemaining       *float64        `json:"days_remaining,omitempty"`
+	ExhaustedBeforeEnd  bool            `json:"exhausted_before_end"`
+	Display             *DisplayAmounts `json:"display,omitempty"`
+}
+
+// UsageForecastResponse contains a usage forecast.
+type UsageForecastResponse struct {
+	Response
+	Forecast *UsageForecast `json:"forecast,omitempty"`
+}
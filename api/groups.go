@@ -0,0 +1,73 @@
+package api
+
+import "time"
+
+// Group is a set of users who share the quotas of the group's subscription.
+// The account name is the username of the account that owns the group's
+// subscriptions.
+type Group struct {
+	ID             string    `json:"uuid"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description,omitempty"`
+	AccountName    string    `json:"account_name"`
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastModifiedAt time.Time `json:"last_modified_at"`
+}
+
+// GroupMember is a user who belongs to a group.
+type GroupMember struct {
+	Username string    `json:"username"`
+	AddedBy  string    `json:"added_by"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// AddGroupRequest is used to add a group.
+type AddGroupRequest struct {
+	Request
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	CreatedBy   string `json:"created_by,omitempty"`
+}
+
+// GetGroupRequest is used to look up a group and its members.
+type GetGroupRequest struct {
+	Request
+	Name string `json:"name"`
+}
+
+// GroupMemberRequest is used to add a user to a group or to remove one.
+type GroupMemberRequest struct {
+	Request
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	AddedBy  string `json:"added_by,omitempty"`
+}
+
+// GroupSubscriptionRequest is used to subscribe a group to a plan. The paid,
+// periods and end date fields have the same meanings as they do when a user is
+// subscribed to a plan.
+type GroupSubscriptionRequest struct {
+	Request
+	Name     string `json:"name"`
+	PlanName string `json:"plan_name"`
+	Paid     bool   `json:"paid"`
+	Periods  int32  `json:"periods,omitempty"`
+	EndDate  string `json:"end_date,omitempty"`
+}
+
+// GroupResponse contains a group and its members.
+type GroupResponse struct {
+	Response
+	Group   *Group         `json:"group,omitempty"`
+	Members []*GroupMember `json:"members,omitempty"`
+}
+
+// GroupSubscriptionResponse identifies the subscription that was created for a
+// group.
+type GroupSubscriptionResponse struct {
+	Response
+	Name           string `json:"name"`
+	SubscriptionID string `json:"subscription_uuid,omitempty"`
+	PlanName       string `json:"plan_name,omitempty"`
+}
@@ -0,0 +1,22 @@
+package api
+
+// The health check statuses.
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthResponse reports whether the service is able to handle requests.
+// Checks maps the name of each dependency that was checked, such as the
+// database or NATS, to ok or to the reason that the check failed.
+type HealthResponse struct {
+	Response
+	Service string            `json:"service"`
+	Status  string            `json:"status"`
+	Checks  map[string]string `json:"checks,omitempty"`
+}
+
+// PingRequest is used to check that the service is handling NATS requests.
+type PingRequest struct {
+	Request
+}
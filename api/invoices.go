@@ -0,0 +1,83 @@
+package api
+
+import "time"
+
+// ExternalInvoice is an invoice or checkout session created for a subscription
+// by the billing provider. The event type is the lifecycle event that caused
+// the invoice to be created.
+type ExternalInvoice struct {
+	ID             string    `json:"uuid"`
+	SubscriptionID string    `json:"subscription_uuid"`
+	Provider       string    `json:"provider"`
+	ExternalID     string    `json:"external_id"`
+	EventType      string    `json:"event_type"`
+	Status         string    `json:"status,omitempty"`
+	URL            string    `json:"url,omitempty"`
+	Amount         float64   `json:"amount"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SubscriptionInvoicesResponse lists the invoices created for a subscription
+// by the billing provider.
+type SubscriptionInvoicesResponse struct {
+	Response
+	SubscriptionID string             `json:"subscription_uuid"`
+	Invoices       []*ExternalInvoice `json:"invoices"`
+}
+
+// InvoiceLineItem is a single charge or credit on an invoice. The item type is
+// plan, addon or discount. Discounts have negative amounts. The subscription
+// add-on UUID is only included in add-on line items.
+type InvoiceLineItem struct {
+	ID                  string  `json:"uuid"`
+	ItemType            string  `json:"item_type"`
+	Description         string  `json:"description"`
+	SubscriptionAddonID string  `json:"subscription_addon_uuid,omitempty"`
+	Quantity            float64 `json:"quantity"`
+	UnitRate            float64 `json:"unit_rate"`
+	Amount              float64 `json:"amount"`
+}
+
+// Invoice is the amount owed for a subscription period, with the rates,
+// discounts and proration that were in effect when it was generated. The
+// proration fraction is the portion of the subscription that the period
+// covers.
+type Invoice struct {
+	ID                string             `json:"uuid"`
+	SubscriptionID    string             `json:"subscription_uuid"`
+	Username          string             `json:"username"`
+	PlanName          string             `json:"plan_name"`
+	PeriodStart       time.Time          `json:"period_start"`
+	PeriodEnd         time.Time          `json:"period_end"`
+	ProrationFraction float64            `json:"proration_fraction"`
+	Subtotal          float64            `json:"subtotal"`
+	DiscountTotal     float64            `json:"discount_total"`
+	Total             float64            `json:"total"`
+	CreatedBy         string             `json:"created_by"`
+	CreatedAt         time.Time          `json:"created_at"`
+	LineItems         []*InvoiceLineItem `json:"line_items"`
+}
+
+// GenerateInvoiceRequest is used to generate an invoice for a subscription.
+// The period defaults to the whole subscription, and is limited to the part
+// that overlaps the subscription.
+type GenerateInvoiceRequest struct {
+	Request
+	SubscriptionID string     `json:"subscription_uuid"`
+	PeriodStart    *time.Time `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time `json:"period_end,omitempty"`
+	RequestedBy    string     `json:"requested_by,omitempty"`
+}
+
+// InvoiceResponse contains a single generated invoice.
+type InvoiceResponse struct {
+	Response
+	Invoice *Invoice `json:"invoice,omitempty"`
+}
+
+// InvoiceListResponse lists the invoices generated for a subscription.
+type InvoiceListResponse struct {
+	Response
+	SubscriptionID string     `json:"subscription_uuid"`
+	Invoices       []*Invoice `json:"invoices"`
+}
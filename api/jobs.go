@@ -0,0 +1,33 @@
+package api
+
+import "time"
+
+// BulkJob describes the progress of an operation that is processed in batches.
+type BulkJob struct {
+	ID             string    `json:"id"`
+	Kind           string    `json:"kind"`
+	Status         string    `json:"status"`
+	Total          int       `json:"total"`
+	Processed      int       `json:"processed"`
+	Failed         int       `json:"failed"`
+	ErrorMessage   string    `json:"error_message,omitempty"`
+	CreatedBy      string    `json:"created_by"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastModifiedAt time.Time `json:"last_modified_at"`
+}
+
+// BulkJobRequest is used to look up a bulk job.
+type BulkJobRequest struct {
+	Request
+	ID string `json:"id"`
+}
+
+// BulkJobResponse contains information about a single bulk job. Dry runs don't
+// create jobs, so the response to a dry run contains a preview of the outcome
+// instead.
+type BulkJobResponse struct {
+	Response
+	Job     *BulkJob                 `json:"job,omitempty"`
+	DryRun  bool                     `json:"dry_run,omitempty"`
+	Preview *CohortExpirationPreview `json:"preview,omitempty"`
+}
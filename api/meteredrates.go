@@ -0,0 +1,55 @@
+package api
+
+import "time"
+
+// MeteredRate is the price of each unit of a resource that's used beyond the
+// user's quota.
+type MeteredRate struct {
+	ID            string    `json:"uuid"`
+	ResourceName  string    `json:"resource_name"`
+	Unit          string    `json:"unit"`
+	EffectiveDate time.Time `json:"effective_date"`
+	Rate          float64   `json:"rate"`
+	CreatedBy     string    `json:"created_by"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// MeteredRateRequest is used to set the metered rate for a resource type. The
+// effective date defaults to the current time.
+type MeteredRateRequest struct {
+	Request
+	ResourceName  string  `json:"resource_name"`
+	Rate          float64 `json:"rate"`
+	EffectiveDate string  `json:"effective_date,omitempty"`
+	RequestedBy   string  `json:"requested_by,omitempty"`
+}
+
+// MeteredRateResponse contains a single metered rate.
+type MeteredRateResponse struct {
+	Response
+	Rate *MeteredRate `json:"rate,omitempty"`
+}
+
+// OverageCharge is the amount that a user would be charged for the use of a
+// resource beyond the user's quota. Priced is false if no metered rate is in
+// effect for the resource type, in which case the amount is zero.
+type OverageCharge struct {
+	ResourceName string  `json:"resource_name"`
+	Unit         string  `json:"unit"`
+	Quota        float64 `json:"quota"`
+	Usage        float64 `json:"usage"`
+	Overage      float64 `json:"overage"`
+	Rate         float64 `json:"rate"`
+	Amount       float64 `json:"amount"`
+	Priced       bool    `json:"priced"`
+}
+
+// OverageBillingPreviewResponse lists what a user's current overages would cost
+// under the metered rates in effect at the time of the preview.
+type OverageBillingPreviewResponse struct {
+	Response
+	Username string           `json:"username"`
+	AsOf     time.Time        `json:"as_of"`
+	Charges  []*OverageCharge `json:"charges"`
+	Total    float64          `json:"total"`
+}
@@ -0,0 +1,66 @@
+package api
+
+import "time"
+
+// ResourceOverage describes a resource type for which a user has reached the
+// quota. The percentage used is omitted if the quota is zero.
+type ResourceOverage struct {
+	ResourceName string   `json:"resource_name"`
+	Quota        float64  `json:"quota"`
+	Usage        float64  `json:"usage"`
+	Remaining    float64  `json:"remaining"`
+	PercentUsed  *float64 `json:"percent_used,omitempty"`
+}
+
+// OverageStatus is the projection of a user's overage status that's published
+// to the overage key-value bucket.
+type OverageStatus struct {
+	Username          string             `json:"username"`
+	InOverage         bool               `json:"in_overage"`
+	Overages          []*ResourceOverage `json:"overages"`
+	SubscriptionState string             `json:"subscription_state,omitempty"`
+	UpdatedAt         time.Time          `json:"updated_at"`
+}
+
+// IsOverage returns true if the user has reached the quota for the named
+// resource type.
+func (s *OverageStatus) IsOverage(resourceName string) bool {
+	for _, overage := range s.Overages {
+		if overage.ResourceName == resourceName {
+			return true
+		}
+	}
+	return false
+}
+
+// OverageReportRequest is used to request the overage summary report. If
+// PlanName is empty, every plan is included. If Tag is set, only the
+// subscriptions with the tag are included; it's either a key or a key=value
+// pair.
+type OverageReportRequest struct {
+	Request
+	PlanName string `json:"plan_name,omitempty" query:"plan_name"`
+	Tag      string `json:"tag,omitempty" query:"tag"`
+}
+
+// OverageReportStats summarizes the overages for a plan and resource type.
+// Users is the number of users who have reached their quotas. The amounts are
+// the percentiles and maximum of the differences between usage and quota for
+// those users, in the resource type's unit.
+type OverageReportStats struct {
+	PlanName     string  `json:"plan_name"`
+	ResourceName string  `json:"resource_name"`
+	ResourceUnit string  `json:"resource_unit"`
+	Users        int64   `json:"users"`
+	P50Amount    float64 `json:"p50_amount"`
+	P95Amount    float64 `json:"p95_amount"`
+	MaxAmount    float64 `json:"max_amount"`
+}
+
+// OverageReportResponse contains the overage statistics for each plan and
+// resource type with at least one user over quota.
+type OverageReportResponse struct {
+	Response
+	GeneratedAt time.Time             `json:"generated_at"`
+	Overages    []*OverageReportStats `json:"overages"`
+}
@@ -0,0 +1,39 @@
+package api
+
+import "time"
+
+// PaymentStatusChange records a change to the payment status of a
+// subscription.
+type PaymentStatusChange struct {
+	ID         string    `json:"uuid"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	ChangedBy  string    `json:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// SetPaymentStatusRequest is used to change the payment status of a
+// subscription to pending, paid, failed, refunded or waived.
+type SetPaymentStatusRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	Status         string `json:"status"`
+	Reason         string `json:"reason,omitempty"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+// PaymentStatusResponse describes the payment status of a subscription. The
+// paid flag is true if the status is paid or waived, which matches the paid
+// flag of the subscription itself. The previous status is only included in
+// responses to status changes.
+type PaymentStatusResponse struct {
+	Response
+	SubscriptionID string                 `json:"subscription_uuid"`
+	Status         string                 `json:"status"`
+	Paid           bool                   `json:"paid"`
+	PreviousStatus string                 `json:"previous_status,omitempty"`
+	UpdatedBy      string                 `json:"updated_by,omitempty"`
+	UpdatedAt      *time.Time             `json:"updated_at,omitempty"`
+	History        []*PaymentStatusChange `json:"history"`
+}
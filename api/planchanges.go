@@ -0,0 +1,110 @@
+package api
+
+import "time"
+
+// PlanChange describes a change to a different subscription plan that takes
+// effect when the user's current subscription ends.
+type PlanChange struct {
+	ID                string     `json:"uuid"`
+	SubscriptionID    string     `json:"subscription_uuid"`
+	Username          string     `json:"username"`
+	PlanName          string     `json:"plan_name"`
+	Paid              bool       `json:"paid"`
+	Periods           int32      `json:"periods"`
+	EndDate           *time.Time `json:"end_date,omitempty"`
+	EffectiveDate     time.Time  `json:"effective_date"`
+	Status            string     `json:"status"`
+	NewSubscriptionID string     `json:"new_subscription_uuid,omitempty"`
+	ErrorMessage      string     `json:"error_message,omitempty"`
+	CreatedBy         string     `json:"created_by"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastModifiedAt    time.Time  `json:"last_modified_at"`
+}
+
+// PlanChangeRequest is used to schedule a plan change for a user. The end date
+// of the new subscription defaults to the end of the new plan's subscription
+// period. A plan change that would leave the user with less of a non-consumable
+// resource than they're already using is refused unless Force is true. If
+// DryRun is true, the plan change is validated and described in the response,
+// but it isn't scheduled.
+type PlanChangeRequest struct {
+	Request
+	Username    string `json:"username"`
+	PlanName    string `json:"plan_name"`
+	Paid        bool   `json:"paid"`
+	Periods     int32  `json:"periods"`
+	EndDate     string `json:"end_date,omitempty"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+}
+
+// PlanChangeResponse contains a single plan change. If the plan change was
+// refused because the user's usage exceeds the new plan's quotas, the quotas
+// that are exceeded are listed.
+type PlanChangeResponse struct {
+	Response
+	PlanChange     *PlanChange        `json:"plan_change,omitempty"`
+	ExceededQuotas []*QuotaComparison `json:"exceeded_quotas,omitempty"`
+	DryRun         bool               `json:"dry_run,omitempty"`
+}
+
+// PlanChangeListResponse contains a list of plan changes.
+type PlanChangeListResponse struct {
+	Response
+	PlanChanges []*PlanChange `json:"plan_changes"`
+}
+
+// ChangeSubscriptionPlanRequest is used to move a user to a different plan
+// immediately. The new subscription ends when the current one would have, and
+// it's perpetual if the current one is or if Perpetual is true. A plan change
+// that would leave the user with less of a non-consumable resource than they're
+// already using is refused unless Force is true. If DryRun is true, the plan
+// change and its proration are computed and described in the response, but the
+// subscriptions aren't changed.
+type ChangeSubscriptionPlanRequest struct {
+	Request
+	Username    string `json:"username"`
+	PlanName    string `json:"plan_name"`
+	Paid        bool   `json:"paid"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+	DryRun      bool   `json:"dry_run,omitempty"`
+	Perpetual   bool   `json:"perpetual,omitempty"`
+}
+
+// Proration describes the amounts owed when a user changes plans part of the
+// way through a subscription period. The fraction remaining is the portion of
+// the period that hadn't elapsed when the plan was changed. The credit is for
+// the unused portion of the previous subscription and the charge is for the
+// remainder of the period on the new plan. A positive net amount is owed by the
+// user, and a negative net amount is owed to the user.
+type Proration struct {
+	PreviousRate      float64 `json:"previous_rate"`
+	NewRate           float64 `json:"new_rate"`
+	FractionRemaining float64 `json:"fraction_remaining"`
+	Credit            float64 `json:"credit"`
+	Charge            float64 `json:"charge"`
+	Net               float64 `json:"net"`
+}
+
+// ChangeSubscriptionPlanResponse describes the outcome of a plan change. If the
+// plan change was refused because the user's usage exceeds the new plan's
+// quotas, the quotas that are exceeded are listed.
+type ChangeSubscriptionPlanResponse struct {
+	Response
+	Username               string             `json:"username"`
+	PlanName               string             `json:"plan_name"`
+	PreviousSubscriptionID string             `json:"previous_subscription_uuid"`
+	SubscriptionID         string             `json:"subscription_uuid"`
+	EffectiveEndDate       time.Time          `json:"effective_end_date"`
+	Perpetual              bool               `json:"perpetual,omitempty"`
+	Proration              *Proration         `json:"proration,omitempty"`
+	ExceededQuotas         []*QuotaComparison `json:"exceeded_quotas,omitempty"`
+	DryRun                 bool               `json:"dry_run,omitempty"`
+}
+
+// Redact removes the proration, which includes plan rates.
+func (r *ChangeSubscriptionPlanResponse) Redact() {
+	r.Proration = nil
+}
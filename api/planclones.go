@@ -0,0 +1,43 @@
+package api
+
+import "time"
+
+// ClonePlanRequest is used to create a plan with copies of the quota defaults
+// and rates of an existing plan. The description is copied as well unless a
+// new one is given. QuotaValues maps resource type names to quota values that
+// replace the copied ones; resource types that the existing plan doesn't have
+// quota defaults for are added. Rate replaces the copied rates if it's set.
+type ClonePlanRequest struct {
+	Request
+	PlanName    string             `json:"plan_name"`
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	QuotaValues map[string]float64 `json:"quota_values,omitempty"`
+	Rate        *float64           `json:"rate,omitempty"`
+}
+
+// PlanQuotaDefault is the quota that new subscriptions to a plan start with for
+// a resource type, starting on the effective date.
+type PlanQuotaDefault struct {
+	ResourceType  ResourceType `json:"resource_type"`
+	QuotaValue    float64      `json:"quota_value"`
+	EffectiveDate time.Time    `json:"effective_date"`
+}
+
+// PlanRate is the rate charged for a plan, starting on the effective date.
+type PlanRate struct {
+	Rate          float64   `json:"rate"`
+	EffectiveDate time.Time `json:"effective_date"`
+}
+
+// ClonePlanResponse describes a plan that was created from a copy of an
+// existing plan.
+type ClonePlanResponse struct {
+	Response
+	SourcePlanName string              `json:"source_plan_name"`
+	PlanID         string              `json:"plan_id,omitempty"`
+	PlanName       string              `json:"plan_name"`
+	Description    string              `json:"description,omitempty"`
+	QuotaDefaults  []*PlanQuotaDefault `json:"quota_defaults"`
+	Rates          []*PlanRate         `json:"rates"`
+}
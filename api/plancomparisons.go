@@ -0,0 +1,41 @@
+package api
+
+// ComparePlansRequest is used to compare a user's current subscription with a
+// subscription to a different plan.
+type ComparePlansRequest struct {
+	Request
+	Username string `json:"username"`
+	PlanName string `json:"plan_name" query:"plan_name"`
+}
+
+// QuotaComparison compares the current quota for a resource type with the
+// quota that a subscription to the target plan would start with. The change is
+// positive if the quota would go up and negative if it would go down. Exceeded
+// is true if the current usage is already more than the target quota.
+type QuotaComparison struct {
+	ResourceType ResourceType `json:"resource_type"`
+	CurrentQuota float64      `json:"current_quota"`
+	TargetQuota  float64      `json:"target_quota"`
+	Change       float64      `json:"change"`
+	Usage        float64      `json:"usage"`
+	Exceeded     bool         `json:"exceeded"`
+}
+
+// ComparePlansResponse describes what would change if a user moved from their
+// current plan to the target plan.
+type ComparePlansResponse struct {
+	Response
+	Username      string             `json:"username"`
+	CurrentPlan   string             `json:"current_plan"`
+	TargetPlan    string             `json:"target_plan"`
+	CurrentRate   *float64           `json:"current_rate,omitempty"`
+	TargetRate    *float64           `json:"target_rate,omitempty"`
+	Quotas        []*QuotaComparison `json:"quotas"`
+	ExceedsQuotas bool               `json:"exceeds_quotas"`
+}
+
+// Redact removes the plan rates.
+func (r *ComparePlansResponse) Redact() {
+	r.CurrentRate = nil
+	r.TargetRate = nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import "time"
+
+// PlanFeature is a feature that a plan gives its subscribers access to.
+type PlanFeature struct {
+	Feature   string    `json:"feature"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PlanFeatureRequest is used to add a feature to a plan or to remove one.
+type PlanFeatureRequest struct {
+	Request
+	PlanName    string `json:"plan_name"`
+	Feature     string `json:"feature"`
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// ListPlanFeaturesRequest is used to list the features of a plan.
+type ListPlanFeaturesRequest struct {
+	Request
+	PlanName string `json:"plan_name"`
+}
+
+// PlanFeaturesResponse lists the features of a plan, in order by name.
+type PlanFeaturesResponse struct {
+	Response
+	PlanName string         `json:"plan_name"`
+	Features []*PlanFeature `json:"features"`
+}
+
+// UserFeatureRequest is used to look up whether a user's plan gives them access
+// to a feature.
+type UserFeatureRequest struct {
+	Request
+	Username string `json:"username"`
+	Feature  string `json:"feature"`
+}
+
+// UserFeatureResponse says whether a user has access to a feature. The plan
+// name is empty if the user doesn't have an active subscription, in which case
+// they don't have access to any features.
+type UserFeatureResponse struct {
+	Response
+	Username   string `json:"username"`
+	Feature    string `json:"feature"`
+	PlanName   string `json:"plan_name,omitempty"`
+	HasFeature bool   `json:"has_feature"`
+}
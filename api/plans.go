@@ -0,0 +1,77 @@
+package api
+
+import "time"
+
+// DeletePlanRequest is used to delete a plan. Deleted plans are kept so that
+// the subscriptions that refer to them remain valid, but they're omitted from
+// plan listings and new subscriptions to them can't be created.
+type DeletePlanRequest struct {
+	Request
+	PlanName string `json:"plan_name"`
+}
+
+// DeletePlanResponse identifies the plan that was deleted.
+type DeletePlanResponse struct {
+	Response
+	PlanID   string `json:"plan_id,omitempty"`
+	PlanName string `json:"plan_name"`
+}
+
+// PlanPeriodRequest is used to change the subscription period of a plan. The
+// unit is one of monthly, quarterly, yearly or days. The number of days is only
+// used if the unit is days.
+type PlanPeriodRequest struct {
+	Request
+	PlanName   string `json:"plan_name"`
+	PeriodUnit string `json:"period_unit"`
+	PeriodDays int32  `json:"period_days,omitempty"`
+}
+
+// PlanPeriodResponse contains the subscription period of a plan.
+type PlanPeriodResponse struct {
+	Response
+	PlanName   string `json:"plan_name"`
+	PeriodUnit string `json:"period_unit"`
+	PeriodDays int32  `json:"period_days,omitempty"`
+}
+
+// SubscriptionsByPlanRequest is used to request the number of active
+// subscriptions to each plan. If PlanName is empty, every plan is included. The
+// users with active subscriptions are only listed if IncludeUsers is true. If
+// Tag is set, only the subscriptions with the tag are counted; it's either a key
+// or a key=value pair.
+type SubscriptionsByPlanRequest struct {
+	Request
+	PlanName     string `json:"plan_name,omitempty" query:"plan_name"`
+	IncludeUsers bool   `json:"include_users,omitempty" query:"include_users"`
+	Tag          string `json:"tag,omitempty" query:"tag"`
+}
+
+// PlanSubscriber is a user with an active subscription to a plan.
+type PlanSubscriber struct {
+	Username           string    `json:"username"`
+	SubscriptionID     string    `json:"subscription_id"`
+	Paid               bool      `json:"paid"`
+	EffectiveStartDate time.Time `json:"effective_start_date"`
+	EffectiveEndDate   time.Time `json:"effective_end_date"`
+	Perpetual          bool      `json:"perpetual,omitempty"`
+}
+
+// PlanSubscriptionStats contains the number of active subscriptions to a plan,
+// broken down by whether they were paid for, along with the number that never
+// end, and optionally the users who hold them.
+type PlanSubscriptionStats struct {
+	PlanName  string            `json:"plan_name"`
+	Total     int64             `json:"total"`
+	Paid      int64             `json:"paid"`
+	Unpaid    int64             `json:"unpaid"`
+	Perpetual int64             `json:"perpetual"`
+	Users     []*PlanSubscriber `json:"users,omitempty"`
+}
+
+// SubscriptionsByPlanResponse contains the active subscription statistics for
+// each plan.
+type SubscriptionsByPlanResponse struct {
+	Response
+	Plans []*PlanSubscriptionStats `json:"plans"`
+}
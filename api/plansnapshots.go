@@ -0,0 +1,23 @@
+package api
+
+import "time"
+
+// PlanSnapshotRequest is used to look up the quota defaults and rate that were
+// in effect for a plan at a point in time, which defaults to the current time.
+type PlanSnapshotRequest struct {
+	Request
+	PlanName string `json:"plan_name"`
+	AsOf     string `json:"as_of,omitempty" query:"as_of"`
+}
+
+// PlanSnapshotResponse contains the quota defaults and rate that were in effect
+// for a plan at a point in time. The rate is omitted if the plan didn't have
+// one yet.
+type PlanSnapshotResponse struct {
+	Response
+	PlanID        string              `json:"plan_id,omitempty"`
+	PlanName      string              `json:"plan_name"`
+	AsOf          time.Time           `json:"as_of"`
+	QuotaDefaults []*PlanQuotaDefault `json:"quota_defaults"`
+	Rate          *PlanRate           `json:"rate,omitempty"`
+}
@@ -0,0 +1,65 @@
+package api
+
+import "time"
+
+// Purchase is a subscription to a plan that a checkout has reserved for a user
+// while the user pays for it. The amount is the plan's current rate multiplied
+// by the number of periods.
+type Purchase struct {
+	ID                string    `json:"uuid"`
+	Username          string    `json:"username"`
+	PlanName          string    `json:"plan_name"`
+	Periods           int32     `json:"periods"`
+	Amount            *float64  `json:"amount,omitempty"`
+	Reference         string    `json:"reference,omitempty"`
+	PaymentReference  string    `json:"payment_reference,omitempty"`
+	Status            string    `json:"status"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	NewSubscriptionID string    `json:"new_subscription_uuid,omitempty"`
+	CreatedBy         string    `json:"created_by"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastModifiedAt    time.Time `json:"last_modified_at"`
+}
+
+// BeginPurchaseRequest is used to reserve a subscription purchase for a user.
+// The reference is an optional identifier for the checkout, such as a
+// storefront's session ID. The duration is the amount of time until the
+// purchase expires if it isn't committed, such as 15m, and defaults to thirty
+// minutes. A purchase that would leave the user with less of a non-consumable
+// resource than they're already using is refused unless Force is true.
+type BeginPurchaseRequest struct {
+	Request
+	Username    string `json:"username"`
+	PlanName    string `json:"plan_name"`
+	Periods     int32  `json:"periods"`
+	Reference   string `json:"reference,omitempty"`
+	Duration    string `json:"duration,omitempty"`
+	RequestedBy string `json:"requested_by,omitempty"`
+	Force       bool   `json:"force,omitempty"`
+}
+
+// CommitPurchaseRequest is used to commit a purchase once it's been paid for.
+// The payment reference is an optional identifier for the payment, such as a
+// charge ID.
+type CommitPurchaseRequest struct {
+	Request
+	UUID             string `json:"uuid"`
+	PaymentReference string `json:"payment_reference,omitempty"`
+	RequestedBy      string `json:"requested_by,omitempty"`
+}
+
+// PurchaseResponse contains a single purchase. If the purchase was refused
+// because the user's usage exceeds the plan's quotas, the quotas that are
+// exceeded are listed.
+type PurchaseResponse struct {
+	Response
+	Purchase       *Purchase          `json:"purchase,omitempty"`
+	ExceededQuotas []*QuotaComparison `json:"exceeded_quotas,omitempty"`
+}
+
+// Redact removes the amount, which is derived from the plan rate.
+func (r *PurchaseResponse) Redact() {
+	if r.Purchase != nil {
+		r.Purchase.Amount = nil
+	}
+}
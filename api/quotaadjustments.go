@@ -0,0 +1,76 @@
+package api
+
+// The ways that a bulk quota adjustment can change a quota.
+const (
+	QuotaAdjustmentAdd = "add"
+	QuotaAdjustmentSet = "set"
+)
+
+// AdjustQuotasRequest asks for the quota for a resource type to be adjusted in
+// the active subscriptions of several users at once. The users are either
+// listed by username or selected by the plan that they're subscribed to, but
+// not both. The add operation adds the value to each quota, and may be
+// negative, while the set operation replaces each quota with the value. The
+// users are processed in batches so that no single transaction holds locks for
+// very long.
+type AdjustQuotasRequest struct {
+	Request
+
+	// Usernames lists the users whose quotas should be adjusted.
+	Usernames []string `json:"usernames,omitempty"`
+
+	// PlanName selects every user with an active subscription to the plan.
+	PlanName string `json:"plan_name,omitempty"`
+
+	// ResourceName is the name of the resource type to adjust the quota for.
+	ResourceName string `json:"resource_name"`
+
+	// Operation is either add or set.
+	Operation string `json:"operation"`
+
+	// Value is the amount to add to each quota or the new value of each quota.
+	Value float64 `json:"value"`
+
+	// BatchSize is the number of users to process in each transaction.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// RequestedBy is the username of the person making the request.
+	RequestedBy string `json:"requested_by,omitempty"`
+
+	// DryRun indicates that the outcome should be reported without changing
+	// any quotas.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// The outcomes of a quota adjustment for a single user.
+const (
+	QuotaAdjustmentApplied = "applied"
+	QuotaAdjustmentSkipped = "skipped"
+	QuotaAdjustmentFailed  = "failed"
+)
+
+// QuotaAdjustmentResult describes the outcome of a bulk quota adjustment for a
+// single user. Users are skipped when they don't have an active subscription
+// or when the adjustment would make their quota negative, and they fail when
+// the batch that they're in couldn't be committed.
+type QuotaAdjustmentResult struct {
+	Username       string  `json:"username"`
+	SubscriptionID string  `json:"subscription_uuid,omitempty"`
+	Status         string  `json:"status"`
+	PreviousQuota  float64 `json:"previous_quota"`
+	Quota          float64 `json:"quota"`
+	Message        string  `json:"message,omitempty"`
+}
+
+// AdjustQuotasResponse reports the outcome of a bulk quota adjustment.
+type AdjustQuotasResponse struct {
+	Response
+	ResourceType ResourceType             `json:"resource_type"`
+	Operation    string                   `json:"operation"`
+	Value        float64                  `json:"value"`
+	Applied      int                      `json:"applied"`
+	Skipped      int                      `json:"skipped"`
+	Failed       int                      `json:"failed"`
+	Results      []*QuotaAdjustmentResult `json:"results"`
+	DryRun       bool                     `json:"dry_run,omitempty"`
+}
@@ -0,0 +1,40 @@
+package api
+
+import "time"
+
+// QuotaChange describes a change to a subscription's quota for a resource type
+// that takes effect on a future date.
+type QuotaChange struct {
+	ID             string       `json:"uuid"`
+	SubscriptionID string       `json:"subscription_uuid"`
+	Username       string       `json:"username"`
+	ResourceType   ResourceType `json:"resource_type"`
+	Quota          float64      `json:"quota"`
+	EffectiveDate  time.Time    `json:"effective_date"`
+	AppliedAt      *time.Time   `json:"applied_at,omitempty"`
+	CreatedBy      string       `json:"created_by"`
+	CreatedAt      time.Time    `json:"created_at"`
+}
+
+// QuotaChangeRequest is used to schedule a change to the quota for a resource
+// type in a user's current subscription.
+type QuotaChangeRequest struct {
+	Request
+	Username      string  `json:"username"`
+	ResourceName  string  `json:"resource_name"`
+	Quota         float64 `json:"quota"`
+	EffectiveDate string  `json:"effective_date"`
+	RequestedBy   string  `json:"requested_by,omitempty"`
+}
+
+// QuotaChangeResponse contains a single quota change.
+type QuotaChangeResponse struct {
+	Response
+	QuotaChange *QuotaChange `json:"quota_change,omitempty"`
+}
+
+// QuotaChangeListResponse contains a list of quota changes.
+type QuotaChangeListResponse struct {
+	Response
+	QuotaChanges []*QuotaChange `json:"quota_changes"`
+}
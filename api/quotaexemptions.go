@@ -0,0 +1,16 @@
+package api
+
+// QuotaExemptPlanRequest is used to change whether the subscriptions to a plan
+// are exempt from their quotas.
+type QuotaExemptPlanRequest struct {
+	Request
+	PlanName    string `json:"plan_name"`
+	QuotaExempt bool   `json:"quota_exempt"`
+}
+
+// QuotaExemptPlanResponse contains the quota exemption of a plan.
+type QuotaExemptPlanResponse struct {
+	Response
+	PlanName    string `json:"plan_name"`
+	QuotaExempt bool   `json:"quota_exempt"`
+}
@@ -0,0 +1,109 @@
+package api
+
+import "time"
+
+// The modes of the quota policies that determine what happens when consuming a
+// resource would take a user beyond the quota.
+const (
+	// QuotaPolicyHard denies consumption beyond the quota.
+	QuotaPolicyHard = "hard"
+
+	// QuotaPolicySoft allows consumption beyond the quota, but warns about it.
+	QuotaPolicySoft = "soft"
+)
+
+// The codes of the reasons given for quota enforcement decisions.
+const (
+	// EnforcementWithinQuota means that the requested amount fits in what's
+	// left of the quota.
+	EnforcementWithinQuota = "WITHIN_QUOTA"
+
+	// EnforcementQuotaExceeded means that the requested amount would take the
+	// user beyond the quota.
+	EnforcementQuotaExceeded = "QUOTA_EXCEEDED"
+
+	// EnforcementReserved means that part of the quota is held by active
+	// reservations.
+	EnforcementReserved = "RESERVED"
+
+	// EnforcementSoftLimit means that consumption beyond the quota was allowed
+	// because the resource type has a soft policy.
+	EnforcementSoftLimit = "SOFT_LIMIT"
+
+	// EnforcementGracePeriod means that consumption beyond the quota was
+	// allowed because the subscription is in its grace period.
+	EnforcementGracePeriod = "GRACE_PERIOD"
+
+	// EnforcementQuotaExempt means that consumption beyond the quota was
+	// allowed because the user's plan is exempt from quotas.
+	EnforcementQuotaExempt = "QUOTA_EXEMPT"
+)
+
+// QuotaPolicy determines what happens when consuming a resource would take a
+// user beyond the quota. Consumption is allowed during a subscription's grace
+// period unless EnforceInGrace is true.
+type QuotaPolicy struct {
+	ResourceType   ResourceType `json:"resource_type"`
+	Mode           string       `json:"mode"`
+	EnforceInGrace bool         `json:"enforce_in_grace"`
+	LastModifiedBy string       `json:"last_modified_by,omitempty"`
+	LastModifiedAt *time.Time   `json:"last_modified_at,omitempty"`
+}
+
+// QuotaPolicyRequest is used to set the quota policy for a resource type.
+type QuotaPolicyRequest struct {
+	Request
+	ResourceName   string `json:"resource_name"`
+	Mode           string `json:"mode"`
+	EnforceInGrace bool   `json:"enforce_in_grace"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+// QuotaPolicyResponse contains a single quota policy.
+type QuotaPolicyResponse struct {
+	Response
+	Policy *QuotaPolicy `json:"policy,omitempty"`
+}
+
+// QuotaPolicyListResponse contains the quota policy for each resource type.
+type QuotaPolicyListResponse struct {
+	Response
+	Policies []*QuotaPolicy `json:"policies"`
+}
+
+// EnforceQuotaRequest asks whether a user may consume an amount of a resource.
+type EnforceQuotaRequest struct {
+	Request
+	Username     string  `json:"username"`
+	ResourceName string  `json:"resource_name"`
+	Amount       float64 `json:"amount"`
+}
+
+// EnforcementReason explains part of a quota enforcement decision.
+type EnforcementReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// QuotaDecision is the answer to a quota enforcement request. The remaining
+// amount is what's left of the quota once the usage and the reserved amount
+// are taken out of it, and doesn't go below zero.
+type QuotaDecision struct {
+	Username          string               `json:"username"`
+	ResourceType      ResourceType         `json:"resource_type"`
+	Allowed           bool                 `json:"allowed"`
+	Policy            string               `json:"policy"`
+	SubscriptionState string               `json:"subscription_state"`
+	Requested         float64              `json:"requested"`
+	Quota             float64              `json:"quota"`
+	Usage             float64              `json:"usage"`
+	Reserved          float64              `json:"reserved"`
+	Remaining         float64              `json:"remaining"`
+	Reasons           []*EnforcementReason `json:"reasons"`
+}
+
+// EnforceQuotaResponse contains a quota enforcement decision.
+type EnforceQuotaResponse struct {
+	Response
+	Decision *QuotaDecision `json:"decision,omitempty"`
+}
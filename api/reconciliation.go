@@ -0,0 +1,66 @@
+package api
+
+// SourceTotalsRequest is sent to a source system, such as the data store or
+// the HTCondor accounting logs, to ask for its authoritative usage totals for a
+// resource type.
+type SourceTotalsRequest struct {
+	Request
+	ResourceType string `json:"resource_type"`
+}
+
+// SourceTotal is a user's authoritative usage total reported by a source
+// system.
+type SourceTotal struct {
+	Username string  `json:"username"`
+	Value    float64 `json:"value"`
+}
+
+// SourceTotalsResponse contains the usage totals reported by a source system.
+// The totals are in the resource type's unit unless a different unit is given.
+type SourceTotalsResponse struct {
+	Response
+	Unit   string         `json:"unit,omitempty"`
+	Totals []*SourceTotal `json:"totals"`
+}
+
+// UsageDrift describes a user whose usage in QMS differs from the total reported
+// by the source system by more than the tolerance. The drift is the source
+// value minus the QMS value. Corrected is true if a SET update was recorded to
+// bring the QMS usage in line with the source value.
+type UsageDrift struct {
+	Username    string  `json:"username"`
+	SourceValue float64 `json:"source_value"`
+	QMSValue    float64 `json:"qms_value"`
+	Drift       float64 `json:"drift"`
+	Corrected   bool    `json:"corrected"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// ReconciliationResult describes the outcome of reconciling the usages of a
+// single resource type. Users is the number of users whose totals were
+// compared. Error is set if the source system couldn't be queried.
+type ReconciliationResult struct {
+	ResourceType string        `json:"resource_type"`
+	Subject      string        `json:"subject"`
+	Users        int64         `json:"users"`
+	Drifts       []*UsageDrift `json:"drifts"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// ReconciliationRequest is used to run the usage reconciliation job on demand.
+// If ResourceType is set, only that resource type's source is queried. Drift is
+// only corrected if Correct is true.
+type ReconciliationRequest struct {
+	Request
+	ResourceType string `json:"resource_type,omitempty"`
+	Correct      bool   `json:"correct"`
+}
+
+// ReconciliationResponse describes the outcome of a run of the usage
+// reconciliation job.
+type ReconciliationResponse struct {
+	Response
+	Tolerance float64                 `json:"tolerance"`
+	Correct   bool                    `json:"correct"`
+	Results   []*ReconciliationResult `json:"results"`
+}
@@ -0,0 +1,49 @@
+package api
+
+import "time"
+
+// ReservedResource is the amount of a resource type that's reserved.
+type ReservedResource struct {
+	ResourceType ResourceType `json:"resource_type"`
+	Amount       float64      `json:"amount"`
+}
+
+// Reservation is planned consumption of one or more resources that counts
+// against the user's quotas until it's released or expires.
+type Reservation struct {
+	ID             string              `json:"uuid"`
+	SubscriptionID string              `json:"subscription_uuid"`
+	Username       string              `json:"username"`
+	Reference      string              `json:"reference,omitempty"`
+	Status         string              `json:"status"`
+	ExpiresAt      time.Time           `json:"expires_at"`
+	CreatedBy      string              `json:"created_by"`
+	CreatedAt      time.Time           `json:"created_at"`
+	LastModifiedAt time.Time           `json:"last_modified_at"`
+	Resources      []*ReservedResource `json:"resources"`
+}
+
+// ResourceAmount is the amount of a resource to reserve.
+type ResourceAmount struct {
+	ResourceName string  `json:"resource_name"`
+	Amount       float64 `json:"amount"`
+}
+
+// ReservationRequest is used to reserve resources for a user. The reference is
+// an optional identifier for the workload that the reservation is for, such as
+// an analysis ID. The duration is the amount of time until the reservation
+// expires, such as 2h, and defaults to one hour.
+type ReservationRequest struct {
+	Request
+	Username    string            `json:"username"`
+	Resources   []*ResourceAmount `json:"resources"`
+	Reference   string            `json:"reference,omitempty"`
+	Duration    string            `json:"duration,omitempty"`
+	RequestedBy string            `json:"requested_by,omitempty"`
+}
+
+// ReservationResponse contains a single reservation.
+type ReservationResponse struct {
+	Response
+	Reservation *Reservation `json:"reservation,omitempty"`
+}
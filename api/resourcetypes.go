@@ -0,0 +1,42 @@
+package api
+
+// ResourceTypeDefinition describes a resource type along with whether the
+// resource is consumed over time, like CPU hours, rather than occupied, like
+// storage. The unit is the canonical unit that amounts are stored in. The
+// dimension is only set if the unit is one that amounts can be converted
+// to and from, in which case amounts can be reported in any other unit of the
+// same dimension.
+type ResourceTypeDefinition struct {
+	ResourceType
+	Consumable bool   `json:"consumable"`
+	Dimension  string `json:"dimension,omitempty"`
+}
+
+// ResourceTypeRequest is used to add a resource type.
+type ResourceTypeRequest struct {
+	Request
+	Name       string `json:"name"`
+	Unit       string `json:"unit"`
+	Consumable bool   `json:"consumable"`
+}
+
+// UpdateResourceTypeRequest is used to change the unit or the consumable flag
+// of the named resource type. Fields that are omitted aren't changed.
+type UpdateResourceTypeRequest struct {
+	Request
+	Name       string `json:"name"`
+	Unit       string `json:"unit,omitempty"`
+	Consumable *bool  `json:"consumable,omitempty"`
+}
+
+// ResourceTypeResponse contains a single resource type.
+type ResourceTypeResponse struct {
+	Response
+	ResourceType *ResourceTypeDefinition `json:"resource_type,omitempty"`
+}
+
+// ResourceTypeListResponse contains a list of resource types.
+type ResourceTypeListResponse struct {
+	Response
+	ResourceTypes []*ResourceTypeDefinition `json:"resource_types"`
+}
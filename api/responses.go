@@ -0,0 +1,21 @@
+package api
+
+import "time"
+
+// RespondFailures summarizes the NATS responses for a subject that couldn't be
+// sent on the first attempt. A response that was never sent usually means that
+// the request was handled but the caller timed out waiting for the answer.
+type RespondFailures struct {
+	Subject      string    `json:"subject"`
+	Failures     int64     `json:"failures"`
+	Recovered    int64     `json:"recovered"`
+	LastError    string    `json:"last_error"`
+	LastFailedAt time.Time `json:"last_failed_at"`
+}
+
+// RespondFailuresResponse lists the response failures recorded for each subject
+// since the service started.
+type RespondFailuresResponse struct {
+	Response
+	Subjects []*RespondFailures `json:"subjects"`
+}
@@ -0,0 +1,20 @@
+package api
+
+import "time"
+
+// RetentionRequest is used to run the retention job on demand. In a dry run,
+// the updates that would be archived are counted, but nothing is changed.
+type RetentionRequest struct {
+	Request
+	DryRun bool `json:"dry_run"`
+}
+
+// RetentionResponse describes the outcome of a run of the retention job. The
+// number of updates is the number that were archived, or the number that would
+// have been archived in a dry run.
+type RetentionResponse struct {
+	Response
+	Cutoff  time.Time `json:"cutoff"`
+	DryRun  bool      `json:"dry_run"`
+	Updates int64     `json:"updates"`
+}
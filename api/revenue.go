@@ -0,0 +1,35 @@
+package api
+
+import "time"
+
+// RevenueReportRequest is used to request the subscription revenue report for
+// the window from StartDate up to EndDate, which is widened to whole months.
+// The window defaults to the 12 months before the end date, which defaults to
+// the current time. If PlanName is empty, every plan is included.
+type RevenueReportRequest struct {
+	Request
+	PlanName  string `json:"plan_name,omitempty" query:"plan_name"`
+	StartDate string `json:"start_date,omitempty" query:"start_date"`
+	EndDate   string `json:"end_date,omitempty" query:"end_date"`
+}
+
+// PlanRevenue contains the revenue from the subscriptions to a plan that are
+// attributed to a month. Only paid subscriptions contribute to the revenue.
+type PlanRevenue struct {
+	PlanName          string    `json:"plan_name"`
+	Month             time.Time `json:"month"`
+	Subscriptions     int64     `json:"subscriptions"`
+	PaidSubscriptions int64     `json:"paid_subscriptions"`
+	PlanRevenue       float64   `json:"plan_revenue"`
+	AddonRevenue      float64   `json:"addon_revenue"`
+	TotalRevenue      float64   `json:"total_revenue"`
+}
+
+// RevenueReportResponse contains the revenue for each plan and month in the
+// reporting window.
+type RevenueReportResponse struct {
+	Response
+	StartDate time.Time      `json:"start_date"`
+	EndDate   time.Time      `json:"end_date"`
+	Revenue   []*PlanRevenue `json:"revenue"`
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSONSchemaDialect is the JSON Schema dialect that event schemas are written in.
+const JSONSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// eventDataTypes maps every event type that the service emits to the type of
+// the data included in its payload.
+var eventDataTypes = map[string]reflect.Type{
+	EventSubscriptionCreated:  reflect.TypeOf(SubscriptionEventData{}),
+	EventSubscriptionRenewed:  reflect.TypeOf(SubscriptionEventData{}),
+	EventSubscriptionExpired:  reflect.TypeOf(SubscriptionEventData{}),
+	EventSubscriptionExpiring: reflect.TypeOf(ExpirationReminderEventData{}),
+	EventAddonAttached:        reflect.TypeOf(AddonEventData{}),
+	EventAddonExpired:         reflect.TypeOf(AddonEventData{}),
+	EventQuotaExceeded:        reflect.TypeOf(QuotaEventData{}),
+	EventUsageUpdated:         reflect.TypeOf(UsageEventData{}),
+	EventQuotaUpdated:         reflect.TypeOf(QuotaEventData{}),
+	EventTrialExpiring:        reflect.TypeOf(TrialEventData{}),
+}
+
+// Schema is a JSON Schema document.
+type Schema map[string]any
+
+// EmittedEventTypes returns every event type that the service emits, in sorted
+// order.
+func EmittedEventTypes() []string {
+	eventTypes := make([]string, 0, len(eventDataTypes))
+	for eventType := range eventDataTypes {
+		eventTypes = append(eventTypes, eventType)
+	}
+	sort.Strings(eventTypes)
+	return eventTypes
+}
+
+// EventSchemaID returns the identifier of the schema for the current version of
+// an event type.
+func EventSchemaID(eventType string) string {
+	return fmt.Sprintf("urn:cyverse:qms:events:%s:v%d", eventType, EventSchemaVersion)
+}
+
+// EventSchema returns the JSON Schema for the payload of an event type. The
+// second return value is false if the service doesn't emit events of that type.
+// The schema is generated from the Go types used to build the payload, so it
+// can't drift from what's actually sent.
+func EventSchema(eventType string) (Schema, bool) {
+	dataType, ok := eventDataTypes[eventType]
+	if !ok {
+		return nil, false
+	}
+
+	return Schema{
+		"$schema":     JSONSchemaDialect,
+		"$id":         EventSchemaID(eventType),
+		"title":       eventType,
+		"description": fmt.Sprintf("The payload of %s events, schema version %d.", eventType, EventSchemaVersion),
+		"type":        "object",
+		"properties": Schema{
+			"id":             Schema{"type": "string", "format": "uuid"},
+			"type":           Schema{"const": eventType},
+			"schema_version": Schema{"const": EventSchemaVersion},
+			"occurred_at":    Schema{"type": "string", "format": "date-time"},
+			"data":           schemaForType(dataType),
+		},
+		"required": []string{"id", "type", "schema_version", "occurred_at", "data"},
+	}, true
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaForType returns the JSON Schema for values of a Go type as they're
+// encoded by encoding/json.
+func schemaForType(t reflect.Type) Schema {
+	if t.Kind() == reflect.Pointer {
+		return schemaForType(t.Elem())
+	}
+	if t == timeType {
+		return Schema{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": schemaForType(t.Elem())}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaForType(t.Elem())}
+	case reflect.Struct:
+		return schemaForStruct(t)
+	default:
+		return Schema{}
+	}
+}
+
+// schemaForStruct returns the JSON Schema for a struct, using its JSON field
+// tags. Fields that are omitted when empty aren't required. Additional
+// properties are allowed because adding a field to a payload doesn't change the
+// schema version.
+func schemaForStruct(t reflect.Type) Schema {
+	properties := Schema{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = schemaForType(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	return Schema{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// EventSchemaRequest is used to look up event schemas. The schemas for every
+// event type are returned if the event type is empty.
+type EventSchemaRequest struct {
+	Request
+	EventType string `json:"event_type,omitempty"`
+}
+
+// EventSchemaResponse contains event schemas keyed by event type.
+type EventSchemaResponse struct {
+	Response
+	SchemaVersion int               `json:"schema_version"`
+	Schemas       map[string]Schema `json:"schemas"`
+}
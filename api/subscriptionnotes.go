@@ -0,0 +1,62 @@
+package api
+
+import "time"
+
+// SubscriptionNote is a free-form note that an administrator attached to a
+// subscription.
+type SubscriptionNote struct {
+	ID        string    `json:"uuid"`
+	Note      string    `json:"note"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SubscriptionTag is a key/value tag that an administrator attached to a
+// subscription.
+type SubscriptionTag struct {
+	Key            string    `json:"key"`
+	Value          string    `json:"value"`
+	LastModifiedBy string    `json:"last_modified_by"`
+	LastModifiedAt time.Time `json:"last_modified_at"`
+}
+
+// AddSubscriptionNoteRequest is used to attach a note to a subscription.
+type AddSubscriptionNoteRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	Note           string `json:"note"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+// DeleteSubscriptionNoteRequest is used to remove a note from a subscription.
+type DeleteSubscriptionNoteRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	NoteID         string `json:"note_uuid"`
+}
+
+// SetSubscriptionTagRequest is used to attach a tag to a subscription, or to
+// change the value of a tag that's already attached. The value may be empty.
+type SetSubscriptionTagRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	Key            string `json:"key"`
+	Value          string `json:"value,omitempty"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+// DeleteSubscriptionTagRequest is used to remove a tag from a subscription.
+type DeleteSubscriptionTagRequest struct {
+	Request
+	SubscriptionID string `json:"subscription_uuid"`
+	Key            string `json:"key"`
+}
+
+// SubscriptionAnnotationsResponse lists the notes attached to a subscription,
+// oldest first, and its tags, in order by key.
+type SubscriptionAnnotationsResponse struct {
+	Response
+	SubscriptionID string              `json:"subscription_uuid"`
+	Notes          []*SubscriptionNote `json:"notes"`
+	Tags           []*SubscriptionTag  `json:"tags"`
+}
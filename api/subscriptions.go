@@ -0,0 +1,40 @@
+package api
+
+import "time"
+
+// ResourceUsage is the amount of a resource that was used during a
+// subscription.
+type ResourceUsage struct {
+	ResourceType ResourceType `json:"resource_type"`
+	Usage        float64      `json:"usage"`
+}
+
+// UserSubscription describes one of a user's subscriptions. The usages of a
+// subscription that has ended are its final usages. The resources include the
+// quota, usage, remaining amount and percentage used of each resource type.
+type UserSubscription struct {
+	ID                 string            `json:"uuid"`
+	PlanName           string            `json:"plan_name"`
+	EffectiveStartDate time.Time         `json:"effective_start_date"`
+	EffectiveEndDate   time.Time         `json:"effective_end_date"`
+	Perpetual          bool              `json:"perpetual,omitempty"`
+	State              string            `json:"state"`
+	Paid               *bool             `json:"paid,omitempty"`
+	Usages             []*ResourceUsage  `json:"usages"`
+	Resources          []*ResourceStatus `json:"resources"`
+}
+
+// UserSubscriptionsResponse lists a user's past, current and future
+// subscriptions in order by start date.
+type UserSubscriptionsResponse struct {
+	Response
+	Username      string              `json:"username"`
+	Subscriptions []*UserSubscription `json:"subscriptions"`
+}
+
+// Redact removes the paid flags.
+func (r *UserSubscriptionsResponse) Redact() {
+	for _, subscription := range r.Subscriptions {
+		subscription.Paid = nil
+	}
+}
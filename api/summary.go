@@ -0,0 +1,66 @@
+package api
+
+import "time"
+
+// ResourceStatus is the quota and usage of a single resource type for a
+// subscription, along with the amount of the quota that remains and the
+// percentage of it that's been used. The values are computed by the database so
+// that every response agrees on them. The percentage used is omitted if the
+// quota is zero.
+type ResourceStatus struct {
+	ResourceType ResourceType `json:"resource_type"`
+	Quota        float64      `json:"quota"`
+	Usage        float64      `json:"usage"`
+	Remaining    float64      `json:"remaining"`
+	PercentUsed  *float64     `json:"percent_used,omitempty"`
+}
+
+// ResourceSummary rolls up the quota and usage of a single resource type for a
+// subscription. The quota is the plan's quota for the resource type plus the
+// amounts added by add-ons, unless it has been changed since. The percentage
+// used is omitted if the quota is zero. The display amounts are converted to
+// units that are easy to read.
+type ResourceSummary struct {
+	ResourceType ResourceType    `json:"resource_type"`
+	PlanQuota    float64         `json:"plan_quota"`
+	AddonAmount  float64         `json:"addon_amount"`
+	Quota        float64         `json:"quota"`
+	Usage        float64         `json:"usage"`
+	Remaining    float64         `json:"remaining"`
+	PercentUsed  *float64        `json:"percent_used,omitempty"`
+	Display      *DisplayAmounts `json:"display,omitempty"`
+}
+
+// SubscriptionSummary describes a user's current subscription.
+type SubscriptionSummary struct {
+	ID                 string    `json:"uuid"`
+	Username           string    `json:"username"`
+	PlanName           string    `json:"plan_name"`
+	EffectiveStartDate time.Time `json:"effective_start_date"`
+	EffectiveEndDate   time.Time `json:"effective_end_date"`
+	Perpetual          bool      `json:"perpetual,omitempty"`
+	State              string    `json:"state"`
+	Paid               *bool     `json:"paid,omitempty"`
+}
+
+// SubscriptionSummaryResponse combines a user's current subscription with the
+// quotas, usages and add-ons that apply to it.
+type SubscriptionSummaryResponse struct {
+	Response
+	Subscription *SubscriptionSummary        `json:"subscription,omitempty"`
+	Resources    []*ResourceSummary          `json:"resources"`
+	Addons       []*SubscriptionAddonSummary `json:"addons"`
+}
+
+// Redact removes the paid flags and the add-on rates.
+func (r *SubscriptionSummaryResponse) Redact() {
+	if r.Subscription != nil {
+		r.Subscription.Paid = nil
+	}
+	for _, summary := range r.Addons {
+		for _, detail := range summary.Details {
+			detail.Paid = nil
+			detail.Rate = nil
+		}
+	}
+}
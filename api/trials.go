@@ -0,0 +1,73 @@
+package api
+
+import "time"
+
+// TrialPlanRequest is used to change the trial settings of a plan.
+type TrialPlanRequest struct {
+	Request
+	PlanName  string `json:"plan_name"`
+	IsTrial   bool   `json:"is_trial"`
+	TrialDays int    `json:"trial_days"`
+}
+
+// TrialPlanResponse contains the trial settings of a plan.
+type TrialPlanResponse struct {
+	Response
+	PlanName  string `json:"plan_name"`
+	IsTrial   bool   `json:"is_trial"`
+	TrialDays int    `json:"trial_days"`
+}
+
+// StartTrialRequest is used to start a trial subscription for a user.
+type StartTrialRequest struct {
+	Request
+	Username string `json:"username"`
+	PlanName string `json:"plan_name"`
+}
+
+// Trial describes a user's trial subscription to a plan.
+type Trial struct {
+	ID             string    `json:"uuid"`
+	SubscriptionID string    `json:"subscription_uuid,omitempty"`
+	Username       string    `json:"username"`
+	PlanName       string    `json:"plan_name"`
+	StartedAt      time.Time `json:"started_at"`
+	EndsAt         time.Time `json:"ends_at"`
+}
+
+// TrialResponse contains a single trial.
+type TrialResponse struct {
+	Response
+	Trial *Trial `json:"trial,omitempty"`
+}
+
+// TrialConversionRequest is used to request trial conversion statistics. Only
+// trials started within the window from StartDate up to EndDate are included.
+// The window defaults to the 30 days before the end date, which defaults to
+// the current time. If PlanName is empty, every trial plan is included.
+type TrialConversionRequest struct {
+	Request
+	PlanName  string `json:"plan_name,omitempty" query:"plan_name"`
+	StartDate string `json:"start_date,omitempty" query:"start_date"`
+	EndDate   string `json:"end_date,omitempty" query:"end_date"`
+}
+
+// TrialConversionStats contains the outcomes of the trials of a plan. The
+// conversion rate is the fraction of the trials that were converted.
+type TrialConversionStats struct {
+	PlanName       string  `json:"plan_name"`
+	Started        int64   `json:"started"`
+	Converted      int64   `json:"converted"`
+	Expired        int64   `json:"expired"`
+	Active         int64   `json:"active"`
+	ConversionRate float64 `json:"conversion_rate"`
+}
+
+// TrialConversionResponse contains the trial conversion statistics for each
+// plan with trials in the reporting window.
+type TrialConversionResponse struct {
+	Response
+	StartDate time.Time               `json:"start_date"`
+	EndDate   time.Time               `json:"end_date"`
+	Plans     []*TrialConversionStats `json:"plans"`
+}
@@ -0,0 +1,18 @@
+package api
+
+// Quantity is an amount in a unit that's easy to read, such as 1.5 TB rather
+// than 1500000000000 bytes.
+type Quantity struct {
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit"`
+}
+
+// DisplayAmounts contains the quota, usage and remaining amount of a resource
+// in units that are easy to read. They're only included for the convenience of
+// user interfaces; the amounts in the resource type's own unit are the ones to
+// calculate with.
+type DisplayAmounts struct {
+	Quota     Quantity `json:"quota"`
+	Usage     Quantity `json:"usage"`
+	Remaining Quantity `json:"remaining"`
+}
@@ -0,0 +1,71 @@
+package api
+
+import "time"
+
+// The granularities of usage rollups.
+const (
+	RollupDaily   = "daily"
+	RollupMonthly = "monthly"
+)
+
+// UsageRollup is the usage of a resource type consumed during a single day or
+// month. The consumed amount is the total of the usage updates that added to
+// the usage, and the update count includes updates that set the usage.
+type UsageRollup struct {
+	ResourceType ResourceType `json:"resource_type"`
+	PeriodStart  time.Time    `json:"period_start"`
+	Consumed     float64      `json:"consumed"`
+	UpdateCount  int64        `json:"update_count"`
+}
+
+// UsageRollupsRequest is used to list the daily or monthly usage rollups for a
+// user. The window works the same way as it does for usage totals. If
+// ResourceName is empty, every resource type is included. The granularity
+// defaults to daily.
+type UsageRollupsRequest struct {
+	Request
+	Username     string `json:"username"`
+	ResourceName string `json:"resource_name,omitempty" query:"resource_name"`
+	Granularity  string `json:"granularity,omitempty" query:"granularity"`
+	StartDate    string `json:"start_date,omitempty" query:"start_date"`
+	EndDate      string `json:"end_date,omitempty" query:"end_date"`
+}
+
+// UsageRollupsResponse contains the usage rollups for a user.
+type UsageRollupsResponse struct {
+	Response
+	Username    string         `json:"username"`
+	Granularity string         `json:"granularity"`
+	StartDate   time.Time      `json:"start_date"`
+	EndDate     time.Time      `json:"end_date"`
+	Rollups     []*UsageRollup `json:"rollups"`
+}
+
+// UsageTotalsRequest is used to total the usage of a resource type consumed by
+// each user during a window. The window covers whole days in UTC from the start
+// date up to the end date, and defaults to the 30 days before the end date,
+// which defaults to the current time.
+type UsageTotalsRequest struct {
+	Request
+	ResourceName string `json:"resource_name" query:"resource_name"`
+	StartDate    string `json:"start_date,omitempty" query:"start_date"`
+	EndDate      string `json:"end_date,omitempty" query:"end_date"`
+}
+
+// UsageTotal is the usage of a resource type consumed by a user during a
+// window.
+type UsageTotal struct {
+	Username    string  `json:"username"`
+	Consumed    float64 `json:"consumed"`
+	UpdateCount int64   `json:"update_count"`
+}
+
+// UsageTotalsResponse contains the usage of a resource type consumed by each
+// user during a window, with the largest totals first.
+type UsageTotalsResponse struct {
+	Response
+	ResourceType ResourceType  `json:"resource_type"`
+	StartDate    time.Time     `json:"start_date"`
+	EndDate      time.Time     `json:"end_date"`
+	Users        []*UsageTotal `json:"users"`
+}
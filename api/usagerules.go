@@ -0,0 +1,153 @@
+package api
+
+import "time"
+
+// The actions taken on usage updates that break the validation rules of their
+// resource types.
+const (
+	// UsageRuleReject rejects the update. It's still recorded for review.
+	UsageRuleReject = "reject"
+
+	// UsageRuleFlag applies the update and records it for review.
+	UsageRuleFlag = "flag"
+
+	// UsageRuleQuarantine holds the update without applying it until an
+	// administrator approves or rejects it.
+	UsageRuleQuarantine = "quarantine"
+)
+
+// The statuses of quarantined usage updates.
+const (
+	QuarantinePending  = "pending"
+	QuarantineApproved = "approved"
+	QuarantineRejected = "rejected"
+)
+
+// UsageRule limits the usage updates that are accepted for a resource type.
+// The minimum and maximum apply to the value of each update, and the maximum
+// hourly delta applies to the total change in a subscription's usage during an
+// hour. Limits that aren't set aren't checked. Negative values are only
+// allowed if AllowNegative is true.
+type UsageRule struct {
+	ResourceType   ResourceType `json:"resource_type"`
+	MinValue       *float64     `json:"min_value,omitempty"`
+	MaxValue       *float64     `json:"max_value,omitempty"`
+	MaxHourlyDelta *float64     `json:"max_hourly_delta,omitempty"`
+	AllowNegative  bool         `json:"allow_negative"`
+	Action         string       `json:"action"`
+	LastModifiedBy string       `json:"last_modified_by,omitempty"`
+	LastModifiedAt *time.Time   `json:"last_modified_at,omitempty"`
+}
+
+// UsageRuleRequest is used to set the validation rule for a resource type. The
+// action defaults to reject.
+type UsageRuleRequest struct {
+	Request
+	ResourceName   string   `json:"resource_name"`
+	MinValue       *float64 `json:"min_value,omitempty"`
+	MaxValue       *float64 `json:"max_value,omitempty"`
+	MaxHourlyDelta *float64 `json:"max_hourly_delta,omitempty"`
+	AllowNegative  bool     `json:"allow_negative"`
+	Action         string   `json:"action,omitempty"`
+	RequestedBy    string   `json:"requested_by,omitempty"`
+}
+
+// UsageRuleResponse contains a single usage validation rule.
+type UsageRuleResponse struct {
+	Response
+	Rule *UsageRule `json:"rule,omitempty"`
+}
+
+// UsageRuleListResponse contains the usage validation rules of the resource
+// types that have them.
+type UsageRuleListResponse struct {
+	Response
+	Rules []*UsageRule `json:"rules"`
+}
+
+// FlaggedUsageUpdate is a usage update that broke the validation rule of its
+// resource type. Rejected updates weren't applied to the usage.
+type FlaggedUsageUpdate struct {
+	ID             string       `json:"uuid"`
+	Username       string       `json:"username"`
+	SubscriptionID string       `json:"subscription_id"`
+	ResourceType   ResourceType `json:"resource_type"`
+	UpdateType     string       `json:"update_type"`
+	Value          float64      `json:"value"`
+	Reason         string       `json:"reason"`
+	Rejected       bool         `json:"rejected"`
+	CreatedAt      time.Time    `json:"created_at"`
+	ReviewedBy     string       `json:"reviewed_by,omitempty"`
+	ReviewedAt     *time.Time   `json:"reviewed_at,omitempty"`
+}
+
+// FlaggedUsageUpdatesRequest is used to list flagged usage updates. Updates
+// that have been reviewed are only included if IncludeReviewed is true.
+type FlaggedUsageUpdatesRequest struct {
+	Request
+	IncludeReviewed bool `json:"include_reviewed,omitempty"`
+}
+
+// ReviewFlaggedUsageUpdateRequest is used to mark a flagged usage update as
+// reviewed.
+type ReviewFlaggedUsageUpdateRequest struct {
+	Request
+	ID          string `json:"uuid"`
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// FlaggedUsageUpdateResponse contains a single flagged usage update.
+type FlaggedUsageUpdateResponse struct {
+	Response
+	Update *FlaggedUsageUpdate `json:"update,omitempty"`
+}
+
+// FlaggedUsageUpdateListResponse contains a list of flagged usage updates.
+type FlaggedUsageUpdateListResponse struct {
+	Response
+	Updates []*FlaggedUsageUpdate `json:"updates"`
+}
+
+// QuarantinedUsageUpdate is a usage update that broke the validation rule of
+// its resource type and is held until an administrator approves or rejects it.
+// Approved updates are applied to the usage when they're approved.
+type QuarantinedUsageUpdate struct {
+	ID             string       `json:"uuid"`
+	Username       string       `json:"username"`
+	SubscriptionID string       `json:"subscription_id"`
+	ResourceType   ResourceType `json:"resource_type"`
+	UpdateType     string       `json:"update_type"`
+	Value          float64      `json:"value"`
+	Reason         string       `json:"reason"`
+	Status         string       `json:"status"`
+	CreatedAt      time.Time    `json:"created_at"`
+	ResolvedBy     string       `json:"resolved_by,omitempty"`
+	ResolvedAt     *time.Time   `json:"resolved_at,omitempty"`
+}
+
+// QuarantinedUpdatesRequest is used to list quarantined usage updates. The
+// status defaults to pending.
+type QuarantinedUpdatesRequest struct {
+	Request
+	Status string `json:"status,omitempty"`
+}
+
+// ResolveQuarantinedUpdateRequest is used to approve or reject a quarantined
+// usage update.
+type ResolveQuarantinedUpdateRequest struct {
+	Request
+	ID          string `json:"uuid"`
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// QuarantinedUpdateResponse contains a single quarantined usage update.
+type QuarantinedUpdateResponse struct {
+	Response
+	Update *QuarantinedUsageUpdate `json:"update,omitempty"`
+}
+
+// QuarantinedUpdateListResponse contains a list of quarantined usage updates.
+type QuarantinedUpdateListResponse struct {
+	Response
+	Updates []*QuarantinedUsageUpdate `json:"updates"`
+}
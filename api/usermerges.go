@@ -0,0 +1,59 @@
+package api
+
+import "time"
+
+// The policies for resolving overlapping active subscriptions when two users
+// are merged. The subscription that isn't kept is ended at the time of the
+// merge.
+const (
+	// MergePolicyKeepTarget keeps the surviving user's active subscription.
+	MergePolicyKeepTarget = "keep_target"
+
+	// MergePolicyKeepSource keeps the merged user's active subscription.
+	MergePolicyKeepSource = "keep_source"
+
+	// MergePolicyKeepLatest keeps the active subscription that ends last.
+	MergePolicyKeepLatest = "keep_latest"
+)
+
+// ValidMergePolicy returns true if the policy is one of the supported merge
+// policies.
+func ValidMergePolicy(policy string) bool {
+	switch policy {
+	case MergePolicyKeepTarget, MergePolicyKeepSource, MergePolicyKeepLatest:
+		return true
+	default:
+		return false
+	}
+}
+
+// UserMergeRequest is used to merge the source user into the target user. The
+// policy defaults to keep_target.
+type UserMergeRequest struct {
+	Request
+	SourceUsername string `json:"source_username"`
+	TargetUsername string `json:"target_username"`
+	Policy         string `json:"policy,omitempty"`
+	RequestedBy    string `json:"requested_by,omitempty"`
+}
+
+// UserMerge describes a merge of one user record into another.
+type UserMerge struct {
+	ID                  string    `json:"uuid"`
+	SourceUserID        string    `json:"source_user_uuid"`
+	SourceUsername      string    `json:"source_username"`
+	TargetUserID        string    `json:"target_user_uuid"`
+	TargetUsername      string    `json:"target_username"`
+	Policy              string    `json:"policy"`
+	EndedSubscriptionID string    `json:"ended_subscription_uuid,omitempty"`
+	MovedSubscriptions  int       `json:"moved_subscriptions"`
+	MovedUpdates        int       `json:"moved_updates"`
+	MergedBy            string    `json:"merged_by"`
+	MergedAt            time.Time `json:"merged_at"`
+}
+
+// UserMergeResponse contains a single user merge.
+type UserMergeResponse struct {
+	Response
+	Merge *UserMerge `json:"merge,omitempty"`
+}
@@ -0,0 +1,33 @@
+package api
+
+import "time"
+
+// PurgeUserRequest is used to purge all of a user's data in response to a
+// data-deletion request.
+type PurgeUserRequest struct {
+	Request
+	Username    string `json:"username"`
+	RequestedBy string `json:"requested_by,omitempty"`
+}
+
+// UserPurge summarizes the data that was removed when a user was purged. The
+// username isn't retained; only its SHA-256 hash is.
+type UserPurge struct {
+	ID                 string    `json:"uuid"`
+	UserID             string    `json:"user_uuid"`
+	UsernameSHA256     string    `json:"username_sha256"`
+	Subscriptions      int       `json:"subscriptions"`
+	SubscriptionAddons int       `json:"subscription_addons"`
+	Quotas             int       `json:"quotas"`
+	Usages             int       `json:"usages"`
+	Updates            int       `json:"updates"`
+	Trials             int       `json:"trials"`
+	PurgedBy           string    `json:"purged_by"`
+	PurgedAt           time.Time `json:"purged_at"`
+}
+
+// PurgeUserResponse contains the summary of a user purge.
+type PurgeUserResponse struct {
+	Response
+	Purge *UserPurge `json:"purge,omitempty"`
+}
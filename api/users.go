@@ -0,0 +1,66 @@
+package api
+
+// TestAccountRequest is used to look up or change whether a user's account is
+// a test account.
+type TestAccountRequest struct {
+	Request
+	Username string `json:"username"`
+	Test     bool   `json:"test"`
+}
+
+// TestAccountResponse indicates whether a user's account is a test account.
+type TestAccountResponse struct {
+	Response
+	Username string `json:"username"`
+	Test     bool   `json:"test"`
+}
+
+// User is a user known to the service.
+type User struct {
+	ID       string `json:"uuid"`
+	Username string `json:"username"`
+}
+
+// UserRequest is used to add a user or to look one up by username or UUID.
+type UserRequest struct {
+	Request
+	Username string `json:"username,omitempty"`
+	UUID     string `json:"uuid,omitempty"`
+}
+
+// UserResponse contains a single user.
+type UserResponse struct {
+	Response
+	User *User `json:"user,omitempty"`
+}
+
+// UserListRequest is used to list users. Only users whose usernames contain
+// the search string are listed if it's not empty.
+type UserListRequest struct {
+	Request
+	Search string `json:"search,omitempty" query:"search"`
+	Limit  uint   `json:"limit,omitempty" query:"limit"`
+	Offset uint   `json:"offset,omitempty" query:"offset"`
+}
+
+// UserListResponse contains a page of users along with the total number of
+// users that match the search.
+type UserListResponse struct {
+	Response
+	Users []*User `json:"users"`
+	Total int64   `json:"total"`
+}
+
+// NormalizeUsernameRequest is used to find out the canonical form of a
+// username.
+type NormalizeUsernameRequest struct {
+	Request
+	Username string `json:"username"`
+}
+
+// NormalizeUsernameResponse contains a username and its canonical form.
+type NormalizeUsernameResponse struct {
+	Response
+	Username   string `json:"username"`
+	Normalized string `json:"normalized,omitempty"`
+}
@@ -0,0 +1,406 @@
+package api
+
+import "github.com/cyverse-de/subscriptions/validate"
+
+// Validate checks that the UUID is set and valid.
+func (r *ByUUIDRequest) Validate() error {
+	return validate.UUID("uuid", r.UUID)
+}
+
+// Validate checks that the username is set.
+func (r *ByUsernameRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the user is identified by a username or a valid UUID.
+func (r *UserRequest) Validate() error {
+	if r.UUID != "" {
+		return validate.OptionalUUID("uuid", r.UUID)
+	}
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the job ID is set and valid.
+func (r *BulkJobRequest) Validate() error {
+	return validate.UUID("id", r.ID)
+}
+
+// Validate checks that the subscription UUID and the status are set.
+func (r *SetPaymentStatusRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.Required("status", r.Status),
+	)
+}
+
+// Validate checks that the subscription UUID is set and valid.
+func (r *GenerateInvoiceRequest) Validate() error {
+	return validate.UUID("subscription_uuid", r.SubscriptionID)
+}
+
+// Validate checks that the group name is set.
+func (r *GetGroupRequest) Validate() error {
+	return validate.Required("name", r.Name)
+}
+
+// Validate checks that the group name is set.
+func (r *AddGroupRequest) Validate() error {
+	return validate.Required("name", r.Name)
+}
+
+// Validate checks that the group name and the username are set.
+func (r *GroupMemberRequest) Validate() error {
+	return validate.First(
+		validate.Required("name", r.Name),
+		validate.Required("username", r.Username),
+	)
+}
+
+// Validate checks that the group name and the plan name are set.
+func (r *GroupSubscriptionRequest) Validate() error {
+	return validate.First(
+		validate.Required("name", r.Name),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that both usernames are set.
+func (r *UserMergeRequest) Validate() error {
+	return validate.First(
+		validate.Required("source_username", r.SourceUsername),
+		validate.Required("target_username", r.TargetUsername),
+	)
+}
+
+// Validate checks that the username is set.
+func (r *PurgeUserRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the username is set.
+func (r *TestAccountRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the username and the plan name are set.
+func (r *StartTrialRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that the username and the plan name are set.
+func (r *PlanChangeRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that the username and the plan name are set.
+func (r *ChangeSubscriptionPlanRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that the plan name is set.
+func (r *DeletePlanRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the plan name is set.
+func (r *PlanPeriodRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the plan name is set.
+func (r *TrialPlanRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the plan name is set.
+func (r *QuotaExemptPlanRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the resource type name and unit are set.
+func (r *ResourceTypeRequest) Validate() error {
+	return validate.First(
+		validate.Required("name", r.Name),
+		validate.Required("unit", r.Unit),
+	)
+}
+
+// Validate checks that the resource type name is set.
+func (r *UpdateResourceTypeRequest) Validate() error {
+	return validate.Required("name", r.Name)
+}
+
+// Validate checks that the resource name is set.
+func (r *MeteredRateRequest) Validate() error {
+	return validate.Required("resource_name", r.ResourceName)
+}
+
+// Validate checks that the username and the resource name are set.
+func (r *UsageForecastRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("resource_name", r.ResourceName),
+	)
+}
+
+// Validate checks that the username is set.
+func (r *UsageBreakdownRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the username is set.
+func (r *ReservationRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the source and the external ID are set.
+func (r *ExternalIDRequest) Validate() error {
+	return validate.First(
+		validate.Required("source", r.Source),
+		validate.Required("external_id", r.ExternalID),
+	)
+}
+
+// Validate checks that the discount code is set.
+func (r *GetDiscountCodeRequest) Validate() error {
+	return validate.Required("code", r.Code)
+}
+
+// Validate checks that the discount code and its type are set.
+func (r *AddDiscountCodeRequest) Validate() error {
+	return validate.First(
+		validate.Required("code", r.Code),
+		validate.Required("discount_type", r.DiscountType),
+	)
+}
+
+// Validate checks that the resource name and the mode are set.
+func (r *QuotaPolicyRequest) Validate() error {
+	return validate.First(
+		validate.Required("resource_name", r.ResourceName),
+		validate.Required("mode", r.Mode),
+	)
+}
+
+// Validate checks that the username and the resource name are set.
+func (r *EnforceQuotaRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("resource_name", r.ResourceName),
+	)
+}
+
+// Validate checks that the bundle name is set and that the add-on IDs are
+// UUIDs.
+func (r *AddAddonBundleRequest) Validate() error {
+	if err := validate.Required("name", r.Name); err != nil {
+		return err
+	}
+	for _, addonID := range r.AddonIDs {
+		if err := validate.UUID("addon_uuids", addonID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that the subscription ID is a UUID and that the bundle name
+// is set.
+func (r *AttachAddonBundleRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.Required("bundle_name", r.BundleName),
+	)
+}
+
+// Validate checks that the add-on ID and the IDs of the required add-ons are
+// UUIDs.
+func (r *SetAddonPrerequisitesRequest) Validate() error {
+	if err := validate.UUID("addon_uuid", r.AddonID); err != nil {
+		return err
+	}
+	for _, addonID := range r.RequiredAddonIDs {
+		if err := validate.UUID("required_addon_uuids", addonID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that the add-on ID is a UUID.
+func (r *GetAddonPrerequisitesRequest) Validate() error {
+	return validate.UUID("addon_uuid", r.AddonID)
+}
+
+// Validate checks that the add-on ID is a UUID.
+func (r *SetAddonCompatibilityRequest) Validate() error {
+	return validate.UUID("addon_uuid", r.AddonID)
+}
+
+// Validate checks that the add-on ID is a UUID.
+func (r *GetAddonCompatibilityRequest) Validate() error {
+	return validate.UUID("addon_uuid", r.AddonID)
+}
+
+// Validate checks that the plan ID is a UUID.
+func (r *ListAddonsForPlanRequest) Validate() error {
+	return validate.UUID("plan_uuid", r.PlanID)
+}
+
+// Validate checks that the add-on ID is a UUID.
+func (r *SetAddonLimitRequest) Validate() error {
+	return validate.UUID("addon_uuid", r.AddonID)
+}
+
+// Validate checks that the username, the resource name, and the effective date
+// are set.
+func (r *QuotaChangeRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("resource_name", r.ResourceName),
+		validate.Required("effective_date", r.EffectiveDate),
+	)
+}
+
+// Validate checks that the username is set.
+func (r *UsageRollupsRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the resource name is set.
+func (r *UsageTotalsRequest) Validate() error {
+	return validate.Required("resource_name", r.ResourceName)
+}
+
+// Validate checks that the username and the plan name are set.
+func (r *ComparePlansRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that the resource name and the operation are set.
+func (r *AdjustQuotasRequest) Validate() error {
+	return validate.First(
+		validate.Required("resource_name", r.ResourceName),
+		validate.Required("operation", r.Operation),
+	)
+}
+
+// Validate checks that the username is set.
+func (r *CreditsRequest) Validate() error {
+	return validate.Required("username", r.Username)
+}
+
+// Validate checks that the username and resource name are set.
+func (r *DepositCreditsRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("resource_name", r.ResourceName),
+	)
+}
+
+// Validate checks that the resource name is set.
+func (r *UsageRuleRequest) Validate() error {
+	return validate.Required("resource_name", r.ResourceName)
+}
+
+// Validate checks that the flagged usage update ID is a UUID.
+func (r *ReviewFlaggedUsageUpdateRequest) Validate() error {
+	return validate.UUID("uuid", r.ID)
+}
+
+// Validate checks that the quarantined usage update ID is a UUID.
+func (r *ResolveQuarantinedUpdateRequest) Validate() error {
+	return validate.UUID("uuid", r.ID)
+}
+
+// Validate checks that the subscription UUID and the note are set.
+func (r *AddSubscriptionNoteRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.Required("note", r.Note),
+	)
+}
+
+// Validate checks that the subscription UUID and the note UUID are set and
+// valid.
+func (r *DeleteSubscriptionNoteRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.UUID("note_uuid", r.NoteID),
+	)
+}
+
+// Validate checks that the subscription UUID and the tag key are set.
+func (r *SetSubscriptionTagRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.Required("key", r.Key),
+	)
+}
+
+// Validate checks that the subscription UUID and the tag key are set.
+func (r *DeleteSubscriptionTagRequest) Validate() error {
+	return validate.First(
+		validate.UUID("subscription_uuid", r.SubscriptionID),
+		validate.Required("key", r.Key),
+	)
+}
+
+// Validate checks that the plan name and the feature are set.
+func (r *PlanFeatureRequest) Validate() error {
+	return validate.First(
+		validate.Required("plan_name", r.PlanName),
+		validate.Required("feature", r.Feature),
+	)
+}
+
+// Validate checks that the plan name is set.
+func (r *ListPlanFeaturesRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the username and the feature are set.
+func (r *UserFeatureRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("feature", r.Feature),
+	)
+}
+
+// Validate checks that the names of the existing plan and the new plan are set.
+func (r *ClonePlanRequest) Validate() error {
+	return validate.First(
+		validate.Required("plan_name", r.PlanName),
+		validate.Required("name", r.Name),
+	)
+}
+
+// Validate checks that the plan name is set.
+func (r *PlanSnapshotRequest) Validate() error {
+	return validate.Required("plan_name", r.PlanName)
+}
+
+// Validate checks that the username and the plan name are set.
+func (r *BeginPurchaseRequest) Validate() error {
+	return validate.First(
+		validate.Required("username", r.Username),
+		validate.Required("plan_name", r.PlanName),
+	)
+}
+
+// Validate checks that the UUID is valid.
+func (r *CommitPurchaseRequest) Validate() error {
+	return validate.UUID("uuid", r.UUID)
+}
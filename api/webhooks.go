@@ -0,0 +1,37 @@
+package api
+
+import "time"
+
+// Webhook describes a URL that is notified when subscription lifecycle events
+// occur. The secret is used to sign the payloads that are sent to the URL. It's
+// accepted in requests, but never included in responses.
+type Webhook struct {
+	ID             string    `json:"uuid,omitempty"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"secret,omitempty"`
+	EventTypes     []string  `json:"event_types"`
+	Enabled        bool      `json:"enabled"`
+	CreatedBy      string    `json:"created_by,omitempty"`
+	CreatedAt      time.Time `json:"created_at,omitempty"`
+	LastModifiedBy string    `json:"last_modified_by,omitempty"`
+	LastModifiedAt time.Time `json:"last_modified_at,omitempty"`
+}
+
+// WebhookRequest is used to add or update a webhook.
+type WebhookRequest struct {
+	Request
+	Webhook     *Webhook `json:"webhook"`
+	RequestedBy string   `json:"requested_by,omitempty"`
+}
+
+// WebhookResponse contains a single webhook.
+type WebhookResponse struct {
+	Response
+	Webhook *Webhook `json:"webhook,omitempty"`
+}
+
+// WebhookListResponse contains a list of webhooks.
+type WebhookListResponse struct {
+	Response
+	Webhooks []*Webhook `json:"webhooks"`
+}
@@ -0,0 +1,542 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"slices"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// uniqueIDs returns the IDs in order with the duplicates removed.
+func uniqueIDs(ids []string) []string {
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !slices.Contains(result, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// lookUpAddonBundle returns the named add-on bundle, or ErrBundleNotFound if it
+// doesn't exist.
+func lookUpAddonBundle(ctx context.Context, d *db.Database, name string, opts ...db.QueryOption) (*db.AddonBundle, error) {
+	bundle, err := d.GetAddonBundleByName(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if bundle == nil {
+		return nil, serrors.ErrBundleNotFound
+	}
+	return bundle, nil
+}
+
+func (a *App) addAddonBundle(ctx context.Context, request *api.AddAddonBundleRequest) *api.AddonBundleResponse {
+	response := &api.AddonBundleResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	addonIDs := uniqueIDs(request.AddonIDs)
+	if len(addonIDs) == 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrEmptyBundle)
+		return response
+	}
+
+	createdBy, err := a.FixUsername(request.CreatedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if createdBy == "" {
+		createdBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	bundle := &db.AddonBundle{
+		Name:        request.Name,
+		Description: request.Description,
+		CreatedBy:   createdBy,
+	}
+	if _, err = d.AddAddonBundle(ctx, bundle, addonIDs, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if bundle, err = lookUpAddonBundle(ctx, d, request.Name, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Bundle = bundle.ToAPIType()
+	return response
+}
+
+// AddAddonBundleHandler adds a named bundle of existing add-ons that can be
+// attached to a subscription in a single operation.
+func (a *App) AddAddonBundleHandler(subject, reply string, request *api.AddAddonBundleRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding add-on bundle")
+
+	response := a.addAddonBundle(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddAddonBundleHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.AddAddonBundleRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.addAddonBundle(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listAddonBundles(ctx context.Context) *api.AddonBundleListResponse {
+	response := &api.AddonBundleListResponse{Bundles: make([]*api.AddonBundle, 0)}
+	d := a.readDatabase(ctx)
+
+	bundles, err := d.ListAddonBundles(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for i := range bundles {
+		response.Bundles = append(response.Bundles, bundles[i].ToAPIType())
+	}
+	return response
+}
+
+// ListAddonBundlesHandler lists the add-on bundles along with their add-ons.
+func (a *App) ListAddonBundlesHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing add-on bundles")
+
+	response := a.listAddonBundles(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListAddonBundlesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listAddonBundles(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) attachAddonBundle(ctx context.Context, request *api.AttachAddonBundleRequest) *api.AttachAddonBundleResponse {
+	response := &api.AttachAddonBundleResponse{
+		SubscriptionID: request.SubscriptionID,
+		BundleName:     request.BundleName,
+		Addons:         make([]*api.AddonEventData, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	subscription, err := d.GetSubscriptionByID(ctx, request.SubscriptionID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if subscription == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrSubscriptionNotFound)
+		return response
+	}
+
+	bundle, err := lookUpAddonBundle(ctx, d, request.BundleName, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Add-ons in the bundle can require other add-ons in the same bundle, so
+	// the add-ons are attached in passes, each of which attaches the add-ons
+	// whose prerequisites were met by the earlier passes. The whole bundle is
+	// rejected if any of its add-ons can't be attached.
+	pending := bundle.Addons
+	for len(pending) > 0 {
+		var deferred []db.Addon
+		for _, addon := range pending {
+			met, err := d.AddonPrerequisitesMet(ctx, subscription.ID, addon.ID, db.WithTX(tx))
+			if err != nil {
+				response.Error = serrors.NatsError(ctx, err)
+				return response
+			}
+			if !met {
+				deferred = append(deferred, addon)
+				continue
+			}
+
+			_, eventData, err := a.attachAddon(ctx, d, tx, subscription.ID, addon.ID, 1)
+			if err != nil {
+				response.Error = serrors.NatsError(ctx, err)
+				return response
+			}
+			response.Addons = append(response.Addons, eventData)
+		}
+
+		if len(deferred) == len(pending) {
+			response.Error = serrors.NatsError(ctx, serrors.ErrAddonPrerequisitesNotMet)
+			return response
+		}
+		pending = deferred
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, eventData := range response.Addons {
+		a.notify(ctx, api.EventAddonAttached, eventData)
+	}
+	a.projectSubscriptionOverages(ctx, subscription.ID)
+
+	return response
+}
+
+// AttachAddonBundleHandler attaches every add-on in a bundle to a subscription
+// in a single transaction.
+func (a *App) AttachAddonBundleHandler(subject, reply string, request *api.AttachAddonBundleRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "attaching add-on bundle")
+
+	response := a.attachAddonBundle(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AttachAddonBundleHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.AttachAddonBundleRequest{
+		SubscriptionID: c.Param("uuid"),
+		BundleName:     c.Param("name"),
+	}
+
+	response := a.attachAddonBundle(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// addonPrerequisites converts a list of prerequisites to the type used in
+// responses.
+func addonPrerequisites(prerequisites []db.AddonPrerequisite) []*api.AddonPrerequisite {
+	result := make([]*api.AddonPrerequisite, len(prerequisites))
+	for i := range prerequisites {
+		result[i] = prerequisites[i].ToAPIType()
+	}
+	return result
+}
+
+func (a *App) setAddonPrerequisites(
+	ctx context.Context,
+	request *api.SetAddonPrerequisitesRequest,
+) *api.AddonPrerequisitesResponse {
+	response := &api.AddonPrerequisitesResponse{AddonID: request.AddonID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requiredAddonIDs := uniqueIDs(request.RequiredAddonIDs)
+	if slices.Contains(requiredAddonIDs, request.AddonID) {
+		response.Error = serrors.NatsError(ctx, serrors.ErrSelfPrerequisite)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	exist, err := d.AddonsExist(ctx, append([]string{request.AddonID}, requiredAddonIDs...), db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !exist {
+		response.Error = serrors.NatsError(ctx, serrors.ErrAddonNotFound)
+		return response
+	}
+
+	planIDs := make([]string, 0, len(request.RequiredPlans))
+	for _, planName := range request.RequiredPlans {
+		plan, err := d.GetPlanByName(ctx, planName, db.WithTX(tx))
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+		planIDs = append(planIDs, plan.ID)
+	}
+
+	err = d.SetAddonPrerequisites(ctx, request.AddonID, uniqueIDs(planIDs), requiredAddonIDs, requestedBy, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	prerequisites, err := d.ListAddonPrerequisites(ctx, request.AddonID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Prerequisites = addonPrerequisites(prerequisites)
+	return response
+}
+
+// SetAddonPrerequisitesHandler replaces the plans and add-ons that a
+// subscription must have before an add-on can be attached to it.
+func (a *App) SetAddonPrerequisitesHandler(subject, reply string, request *api.SetAddonPrerequisitesRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting add-on prerequisites")
+
+	response := a.setAddonPrerequisites(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetAddonPrerequisitesHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SetAddonPrerequisitesRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.AddonID = c.Param("uuid")
+
+	response := a.setAddonPrerequisites(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getAddonPrerequisites(
+	ctx context.Context,
+	request *api.GetAddonPrerequisitesRequest,
+) *api.AddonPrerequisitesResponse {
+	response := &api.AddonPrerequisitesResponse{AddonID: request.AddonID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	exist, err := d.AddonsExist(ctx, []string{request.AddonID}, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !exist {
+		response.Error = serrors.NatsError(ctx, serrors.ErrAddonNotFound)
+		return response
+	}
+
+	prerequisites, err := d.ListAddonPrerequisites(ctx, request.AddonID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Prerequisites = addonPrerequisites(prerequisites)
+	return response
+}
+
+// GetAddonPrerequisitesHandler lists the plans and add-ons that a subscription
+// must have before an add-on can be attached to it.
+func (a *App) GetAddonPrerequisitesHandler(subject, reply string, request *api.GetAddonPrerequisitesRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting add-on prerequisites")
+
+	response := a.getAddonPrerequisites(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetAddonPrerequisitesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.GetAddonPrerequisitesRequest{
+		AddonID: c.Param("uuid"),
+	}
+
+	response := a.getAddonPrerequisites(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// compatiblePlans converts a list of compatible plans to the type used in
+// responses.
+func compatiblePlans(plans []db.CompatiblePlan) []*api.CompatiblePlan {
+	result := make([]*api.CompatiblePlan, len(plans))
+	for i := range plans {
+		result[i] = plans[i].ToAPIType()
+	}
+	return result
+}
+
+func (a *App) setAddonCompatibility(
+	ctx context.Context,
+	request *api.SetAddonCompatibilityRequest,
+) *api.AddonCompatibilityResponse {
+	response := &api.AddonCompatibilityResponse{AddonID: request.AddonID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	exist, err := d.AddonsExist(ctx, []string{request.AddonID}, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !exist {
+		response.Error = serrors.NatsError(ctx, serrors.ErrAddonNotFound)
+		return response
+	}
+
+	planIDs := make([]string, 0, len(request.Plans))
+	for _, planName := range request.Plans {
+		plan, err := d.GetPlanByName(ctx, planName, db.WithTX(tx))
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+		planIDs = append(planIDs, plan.ID)
+	}
+
+	if err = d.SetAddonCompatibility(ctx, request.AddonID, uniqueIDs(planIDs), requestedBy, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	plans, err := d.ListCompatiblePlans(ctx, request.AddonID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Plans = compatiblePlans(plans)
+	return response
+}
+
+// SetAddonCompatibilityHandler replaces the plans that an add-on can be
+// attached to.
+func (a *App) SetAddonCompatibilityHandler(subject, reply string, request *api.SetAddonCompatibilityRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting add-on compatibility")
+
+	response := a.setAddonCompatibility(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetAddonCompatibilityHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SetAddonCompatibilityRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.AddonID = c.Param("uuid")
+
+	response := a.setAddonCompatibility(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getAddonCompatibility(
+	ctx context.Context,
+	request *api.GetAddonCompatibilityRequest,
+) *api.AddonCompatibilityResponse {
+	response := &api.AddonCompatibilityResponse{AddonID: request.AddonID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	exist, err := d.AddonsExist(ctx, []string{request.AddonID}, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !exist {
+		response.Error = serrors.NatsError(ctx, serrors.ErrAddonNotFound)
+		return response
+	}
+
+	plans, err := d.ListCompatiblePlans(ctx, request.AddonID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Plans = compatiblePlans(plans)
+	return response
+}
+
+// GetAddonCompatibilityHandler lists the plans that an add-on can be attached
+// to.
+func (a *App) GetAddonCompatibilityHandler(subject, reply string, request *api.GetAddonCompatibilityRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting add-on compatibility")
+
+	response := a.getAddonCompatibility(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetAddonCompatibilityHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.GetAddonCompatibilityRequest{
+		AddonID: c.Param("uuid"),
+	}
+
+	response := a.getAddonCompatibility(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listAddonsForPlan(ctx context.Context, request *api.ListAddonsForPlanRequest) *api.AddonsForPlanResponse {
+	response := &api.AddonsForPlanResponse{
+		PlanID: request.PlanID,
+		Addons: make([]*api.AvailableAddon, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	plan, err := d.GetPlanByID(ctx, request.PlanID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	addons, err := d.ListAddonsForPlan(ctx, plan.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, addon := range addons {
+		available := &api.AvailableAddon{
+			ID:          addon.ID,
+			Name:        addon.Name,
+			Description: addon.Description,
+			ResourceType: api.ResourceType{
+				ID:   addon.ResourceType.ID,
+				Name: addon.ResourceType.Name,
+				Unit: addon.ResourceType.Unit,
+			},
+			DefaultAmount:      addon.DefaultAmount,
+			DefaultPaid:        &addon.DefaultPaid,
+			MaxPerSubscription: addon.MaxPerSubscription.Int64,
+		}
+		if rate := addon.GetCurrentRate(); rate != nil {
+			available.Rate = &rate.Rate
+		}
+		response.Addons = append(response.Addons, available)
+	}
+
+	return response
+}
+
+// ListAddonsForPlanHandler lists the add-ons that can be attached to
+// subscriptions to a plan, so that callers can offer only the add-ons that are
+// valid for a user's subscription.
+func (a *App) ListAddonsForPlanHandler(subject, reply string, request *api.ListAddonsForPlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing add-ons for plan")
+
+	response := a.listAddonsForPlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListAddonsForPlanHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ListAddonsForPlanRequest{
+		PlanID: c.Param("plan_id"),
+	}
+
+	response := a.listAddonsForPlan(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// AddonEndDateHeader is the name of the message header used to give an add-on
+// its own end date when it's attached to a subscription, for example a boost
+// that only lasts for part of an annual subscription. The QMS request doesn't
+// have a field for the end date, so it's passed in the header instead. HTTP
+// requests use the end_date query parameter.
+const AddonEndDateHeader = "x-qms-addon-end-date"
+
+// addonExpirationBatchSize is the maximum number of subscription add-ons that
+// are expired each time the worker runs.
+const addonExpirationBatchSize = 100
+
+// parseAddonEndDate returns the end date in the value of the end date header.
+// The zero time is returned if the value is empty, which means that the add-on
+// lasts as long as the subscription.
+func parseAddonEndDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	endDate, err := time.Parse(time.RFC3339, value)
+	if err != nil || !endDate.After(time.Now()) {
+		return time.Time{}, serrors.ErrInvalidAddonEndDate
+	}
+	return endDate, nil
+}
+
+// StartAddonExpirationWorker removes the amounts of subscription add-ons that
+// have ended from the quotas at regular intervals until the context is done.
+func (a *App) StartAddonExpirationWorker(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Quotas can't be changed while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			// Keep going until there's nothing left to expire.
+			for {
+				count, err := a.ExpireSubscriptionAddons(ctx)
+				if err != nil {
+					log.Errorf("unable to expire subscription add-ons: %s", err)
+				}
+				if err != nil || count < addonExpirationBatchSize {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// ExpireSubscriptionAddons removes the amounts of a single batch of ended
+// subscription add-ons from the quotas of their subscriptions and returns the
+// number of add-ons that were expired. The add-ons themselves are kept so that
+// they still appear in billing summaries.
+func (a *App) ExpireSubscriptionAddons(ctx context.Context) (int, error) {
+	d := a.database(ctx)
+
+	var events []*api.AddonEventData
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		subAddons, err := d.EndedSubscriptionAddons(ctx, addonExpirationBatchSize, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(subAddons))
+		for i, subAddon := range subAddons {
+			ids[i] = subAddon.ID
+
+			quotaValue, _, err := d.GetCurrentQuota(
+				ctx,
+				subAddon.Addon.ResourceType.ID,
+				subAddon.Subscription.ID,
+				db.WithTX(tx),
+				db.WithForUpdate(),
+			)
+			if err != nil {
+				return err
+			}
+
+			if err = d.UpsertQuota(
+				ctx,
+				quotaValue-subAddon.Amount,
+				subAddon.Addon.ResourceType.ID,
+				subAddon.Subscription.ID,
+				db.WithTX(tx),
+			); err != nil {
+				return err
+			}
+
+			eventData := &api.AddonEventData{
+				SubscriptionID:      subAddon.Subscription.ID,
+				SubscriptionAddonID: subAddon.ID,
+				AddonID:             subAddon.Addon.ID,
+				AddonName:           subAddon.Addon.Name,
+				Amount:              subAddon.Amount,
+				Quantity:            subAddon.Quantity,
+			}
+			if err = a.recordEvent(ctx, d, tx, api.EventAddonExpired, eventData); err != nil {
+				return err
+			}
+			events = append(events, eventData)
+		}
+
+		return d.MarkSubscriptionAddonsExpired(ctx, ids, db.WithTX(tx))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, eventData := range events {
+		log.Infof("the %s add-on attached to subscription %s has expired", eventData.AddonName, eventData.SubscriptionID)
+		a.notify(ctx, api.EventAddonExpired, eventData)
+		a.projectSubscriptionOverages(ctx, eventData.SubscriptionID)
+	}
+
+	return len(events), nil
+}
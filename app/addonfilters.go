@@ -0,0 +1,57 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// The names of the message headers used to search the add-on listing. The QMS
+// list request doesn't have fields for them, so they're passed in headers
+// instead. HTTP requests use the resource_type, name, default_paid and sort
+// query parameters.
+const (
+	AddonResourceTypeHeader = "x-qms-resource-type"
+	AddonNameHeader         = "x-qms-name"
+	AddonDefaultPaidHeader  = "x-qms-default-paid"
+	AddonSortHeader         = "x-qms-sort"
+)
+
+// addonListParams holds the unparsed options for listing add-ons, which come
+// from either message headers or query parameters.
+type addonListParams struct {
+	IncludeDeleted string
+	ResourceType   string
+	Name           string
+	DefaultPaid    string
+	Sort           string
+}
+
+// addonFilter parses the search and sorting options for listing add-ons. The
+// sort field may be prefixed with a minus sign to sort in descending order.
+func addonFilter(params *addonListParams) (*db.AddonFilter, error) {
+	filter := &db.AddonFilter{
+		ResourceType: strings.TrimSpace(params.ResourceType),
+		NameContains: strings.TrimSpace(params.Name),
+	}
+
+	if params.DefaultPaid != "" {
+		defaultPaid, err := strconv.ParseBool(params.DefaultPaid)
+		if err != nil {
+			return nil, serrors.ErrInvalidDefaultPaid
+		}
+		filter.DefaultPaid = &defaultPaid
+	}
+
+	if sortBy := strings.TrimSpace(params.Sort); sortBy != "" {
+		sortBy, filter.Descending = strings.CutPrefix(sortBy, "-")
+		if !db.ValidAddonSort(sortBy) {
+			return nil, serrors.ErrInvalidAddonSort
+		}
+		filter.SortBy = sortBy
+	}
+
+	return filter, nil
+}
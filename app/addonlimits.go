@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/cyverse-de/subscriptions/api"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// QuantityHeader is the name of the message header used to attach several
+// units of an add-on to a subscription at once. The QMS request doesn't have a
+// field for the quantity, so it's passed in the header instead. HTTP requests
+// use the quantity query parameter.
+const QuantityHeader = "x-qms-quantity"
+
+// parseQuantity returns the quantity in the value of the quantity header. An
+// empty value means a single unit.
+func parseQuantity(value string) (int64, error) {
+	if value == "" {
+		return 1, nil
+	}
+
+	quantity, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || quantity < 1 {
+		return 0, serrors.ErrInvalidQuantity
+	}
+	return quantity, nil
+}
+
+func (a *App) setAddonLimit(ctx context.Context, request *api.SetAddonLimitRequest) *api.AddonLimitResponse {
+	response := &api.AddonLimitResponse{AddonID: request.AddonID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.MaxPerSubscription < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuantity)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	maximum := sql.NullInt64{Int64: request.MaxPerSubscription, Valid: request.MaxPerSubscription > 0}
+	if err := d.SetAddonMaxPerSubscription(ctx, request.AddonID, maximum); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.MaxPerSubscription = request.MaxPerSubscription
+	return response
+}
+
+// SetAddonLimitHandler sets the maximum number of units of an add-on that can
+// be attached to a single subscription. Units that are already attached aren't
+// affected.
+func (a *App) SetAddonLimitHandler(subject, reply string, request *api.SetAddonLimitRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting add-on limit")
+
+	response := a.setAddonLimit(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetAddonLimitHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SetAddonLimitRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.AddonID = c.Param("uuid")
+
+	response := a.setAddonLimit(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
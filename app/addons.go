@@ -4,22 +4,27 @@ import (
 	"context"
 	"net/http"
 
-	"errors"
-
 	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
 	"github.com/labstack/echo/v4"
 
 	qmsinit "github.com/cyverse-de/go-mod/pbinit/qms"
 	reqinit "github.com/cyverse-de/go-mod/pbinit/requests"
 	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/p/go/requests"
+	"github.com/cyverse-de/subscriptions/api"
 	"github.com/cyverse-de/subscriptions/db"
 )
 
 func (a *App) addAddon(ctx context.Context, request *qms.AddAddonRequest) *qms.AddonResponse {
 	var newAddon *db.Addon
-	d := db.New(a.db)
+	d := a.database(ctx)
 	response := qmsinit.NewAddonResponse()
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
 
 	// Validate the incoming request.
 	requestedAddon := db.NewAddonFromQMS(request.Addon)
@@ -75,12 +80,15 @@ func (a *App) AddAddonHandler(subject, reply string, request *qms.AddAddonReques
 	ctx, span := qmsinit.InitAddAddonRequest(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "adding new available addon")
 
-	response := a.addAddon(ctx, request)
+	response, err := a.service.AddAddon(ctx, request)
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -108,15 +116,28 @@ func (a *App) AddAddonHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 
 }
 
-func (a *App) listAddons(ctx context.Context) *qms.AddonListResponse {
+func (a *App) listAddons(ctx context.Context, params *addonListParams) *qms.AddonListResponse {
 	response := qmsinit.NewAddonListResponse()
-	d := db.New(a.db)
+	d := a.readDatabase(ctx)
+
+	opts, err := includeDeletedOpts(params.IncludeDeleted, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	filter, err := addonFilter(params)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
 
-	results, err := d.ListAddons(ctx)
+	results, err := d.ListAddons(ctx, filter, opts...)
 	if err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
@@ -130,19 +151,24 @@ func (a *App) listAddons(ctx context.Context) *qms.AddonListResponse {
 
 // ListAddonsHandler lists all of the available add-ons in the system. These are
 // the ones that can be applied to a subscription, not the ones that have been
-// applied already.
+// applied already. Deleted add-ons are only listed if the include-deleted header
+// is set to true. The listing can be searched and sorted using the headers
+// listed in addonfilters.go.
 func (a *App) ListAddonsHandler(subject, reply string, request *qms.NoParamsRequest) {
 	var err error
 
 	ctx, span := qmsinit.InitNoParamsRequest(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "list addons")
 
-	response := a.listAddons(ctx)
+	response, err := a.service.ListAddons(ctx, request)
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -153,22 +179,48 @@ func (a *App) ListAddonsHandler(subject, reply string, request *qms.NoParamsRequ
 func (a *App) ListAddonsHTTPHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	response := a.listAddons(ctx)
+	response := a.listAddons(ctx, &addonListParams{
+		IncludeDeleted: c.QueryParam("include_deleted"),
+		ResourceType:   c.QueryParam("resource_type"),
+		Name:           c.QueryParam("name"),
+		DefaultPaid:    c.QueryParam("default_paid"),
+		Sort:           c.QueryParam("sort"),
+	})
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 
 }
 
-func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest) *qms.AddonResponse {
+func (a *App) updateAddon(
+	ctx context.Context, request *qms.UpdateAddonRequest, expectedVersion, updateMask string,
+) *qms.AddonResponse {
 	response := qmsinit.NewAddonResponse()
-	d := db.New(a.db)
 
-	if request.Addon.Uuid == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("uuid must be set in the request"))
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	opts, err := expectedVersionOpts(expectedVersion)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if err = validate.UUID("uuid", request.GetAddon().GetUuid()); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = applyAddonUpdateMask(request, updateMask); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
@@ -180,7 +232,17 @@ func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest)
 		return response
 	}
 	err = tx.Wrap(func() error {
-		err := d.UpdateAddon(ctx, updateAddon, db.WithTX(tx))
+		// Deleted add-ons are kept for historical subscriptions, but they can't
+		// be changed.
+		existing, err := d.GetAddonByID(ctx, updateAddon.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if existing.DeletedAt.Valid {
+			return serrors.ErrAddonNotFound
+		}
+
+		err = d.UpdateAddon(ctx, updateAddon, append(opts, db.WithTX(tx))...)
 		if err != nil {
 			return err
 		}
@@ -190,6 +252,7 @@ func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest)
 			return err
 		}
 		response.Addon = result.ToQMSType()
+		setVersionHeader(response.Header, result.Version)
 
 		return nil
 	})
@@ -207,10 +270,13 @@ func (a *App) UpdateAddonHandler(subject, reply string, request *qms.UpdateAddon
 	ctx, span := qmsinit.InitUpdateAddonRequest(request, subject)
 	defer span.End()
 
-	response := a.updateAddon(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.UpdateAddon(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -232,35 +298,40 @@ func (a *App) UpdateAddonHTTPHandler(c echo.Context) error {
 		})
 	}
 
+	if request.Addon == nil {
+		request.Addon = &qms.Addon{}
+	}
 	request.Addon.Uuid = c.Param("uuid")
 
-	response := a.updateAddon(ctx, &request)
+	response := a.updateAddon(
+		ctx, &request,
+		c.Request().Header.Get(ExpectedVersionHeader),
+		c.Request().Header.Get(UpdateMaskHeader),
+	)
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	setHTTPVersionHeader(c, response.Header)
+
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 
 }
 
 func (a *App) deleteAddon(ctx context.Context, request *requests.ByUUID) *qms.AddonResponse {
 	response := qmsinit.NewAddonResponse()
-
-	d := db.New(a.db)
-
-	subAddons, err := d.ListSubscriptionAddonsByAddonID(ctx, request.Uuid)
-	if err != nil {
+	if err := a.checkWritable(); err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
-	if len(subAddons) > 0 {
-		response.Error = serrors.NatsError(ctx, serrors.ErrSubscriptionAddonsExist)
-		return response
-	}
+	d := a.database(ctx)
 
-	if err = d.DeleteAddon(ctx, request.Uuid); err != nil {
+	// Add-ons are only marked as deleted, so add-ons that have been applied to
+	// subscriptions can be deleted without invalidating the subscriptions.
+	if err := d.DeleteAddon(ctx, request.Uuid); err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
@@ -280,10 +351,13 @@ func (a *App) DeleteAddonHandler(subject, reply string, request *requests.ByUUID
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
 
-	response := a.deleteAddon(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.DeleteAddon(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -304,13 +378,14 @@ func (a *App) DeleteAddonHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) listSubscriptionAddons(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonListResponse {
 	response := qmsinit.NewSubscriptionAddonListResponse()
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 	tx, err := d.Begin()
 	if err != nil {
 		response.Error = serrors.NatsError(ctx, err)
@@ -344,11 +419,14 @@ func (a *App) ListSubscriptionAddonsHandler(subject, reply string, request *requ
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "listing subscription add-ons")
 
-	response := a.listSubscriptionAddons(ctx, request)
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.ListSubscriptionAddons(ctx, request)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -369,13 +447,14 @@ func (a *App) ListSubscriptionAddonsHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) getSubscriptionAddon(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 
 	subAddon, err := d.GetSubscriptionAddonByID(ctx, request.Uuid)
 	if err != nil {
@@ -395,12 +474,15 @@ func (a *App) GetSubscriptionAddonHandler(subject, reply string, request *reques
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "getting subscription add-on")
 
-	response := a.getSubscriptionAddon(ctx, request)
+	response, err := a.service.GetSubscriptionAddon(ctx, request)
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -421,38 +503,56 @@ func (a *App) GetSubscriptionAddonHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
-func (a *App) addSubscriptionAddon(ctx context.Context, request *requests.AssociateByUUIDs) *qms.SubscriptionAddonResponse {
-	response := qmsinit.NewSubscriptionAddonResponse()
-	d := db.New(a.db)
-
-	subscriptionID := request.ParentUuid
-	if subscriptionID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("parent_uuid must be set to the subscription UUID"))
-		return response
+// attachAddon attaches the given quantity of an add-on to a subscription within
+// a transaction, adding the total amount to the subscription's quota and
+// recording the event. The subscription and its quota are locked until the
+// transaction ends. ErrAddonNotCompatible is returned if the add-on can't be
+// attached to subscriptions to the subscription's plan, and
+// ErrAddonPrerequisitesNotMet is returned if the subscription doesn't meet the
+// add-on's prerequisites. The caller is responsible for sending the
+// notification once the transaction has been committed.
+func (a *App) attachAddon(
+	ctx context.Context,
+	d *db.Database,
+	tx *goqu.TxDatabase,
+	subscriptionID, addonID string,
+	quantity int64,
+) (*db.SubscriptionAddon, *api.AddonEventData, error) {
+	// Lock the subscription so that other changes to it wait until this one is
+	// done.
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx), db.WithForUpdate())
+	if err != nil {
+		return nil, nil, err
+	}
+	if subscription == nil {
+		return nil, nil, serrors.ErrSubscriptionNotFound
 	}
 
-	addonID := request.ChildUuid
-	if addonID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("child_id must be set to the add-on UUID"))
-		return response
+	compatible, err := d.AddonCompatibleWithSubscription(ctx, subscriptionID, addonID, db.WithTX(tx))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !compatible {
+		return nil, nil, serrors.ErrAddonNotCompatible
 	}
 
-	tx, err := d.Begin()
+	met, err := d.AddonPrerequisitesMet(ctx, subscriptionID, addonID, db.WithTX(tx))
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
+		return nil, nil, err
+	}
+	if !met {
+		return nil, nil, serrors.ErrAddonPrerequisitesNotMet
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
 
-	subAddon, err := d.AddSubscriptionAddon(ctx, subscriptionID, addonID, db.WithTXRollbackCommit(tx, false, false))
+	subAddon, err := d.AddSubscriptionAddon(
+		ctx, subscriptionID, addonID, quantity, db.WithTXRollbackCommit(tx, false, false),
+	)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
+		return nil, nil, err
 	}
 
 	quotaValue, _, err := d.GetCurrentQuota(
@@ -460,10 +560,10 @@ func (a *App) addSubscriptionAddon(ctx context.Context, request *requests.Associ
 		subAddon.Addon.ResourceType.ID,
 		subscriptionID,
 		db.WithTXRollbackCommit(tx, false, false),
+		db.WithForUpdate(),
 	)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
+		return nil, nil, err
 	}
 
 	quotaValue = quotaValue + subAddon.Amount
@@ -474,15 +574,122 @@ func (a *App) addSubscriptionAddon(ctx context.Context, request *requests.Associ
 		subscriptionID,
 		db.WithTXRollbackCommit(tx, false, false),
 	); err != nil {
+		return nil, nil, err
+	}
+
+	eventData := &api.AddonEventData{
+		SubscriptionID:      subscriptionID,
+		SubscriptionAddonID: subAddon.ID,
+		AddonID:             subAddon.Addon.ID,
+		AddonName:           subAddon.Addon.Name,
+		Amount:              subAddon.Amount,
+		Quantity:            subAddon.Quantity,
+	}
+	if err = a.recordEvent(ctx, d, tx, api.EventAddonAttached, eventData); err != nil {
+		return nil, nil, err
+	}
+
+	return subAddon, eventData, nil
+}
+
+func (a *App) addSubscriptionAddon(
+	ctx context.Context,
+	request *requests.AssociateByUUIDs,
+	ref *db.ExternalRef,
+	quantityValue, endDateValue string,
+) *qms.SubscriptionAddonResponse {
+	response := qmsinit.NewSubscriptionAddonResponse()
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	subscriptionID := request.ParentUuid
+	addonID := request.ChildUuid
+	err := validate.First(
+		validate.UUID("parent_uuid", subscriptionID),
+		validate.UUID("child_uuid", addonID),
+	)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	quantity, err := parseQuantity(quantityValue)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	endDate, err := parseAddonEndDate(endDateValue)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// A request with an external ID that has already been used is treated as a
+	// retry of the request that used it first.
+	if ref != nil {
+		existingID, err := d.SubscriptionAddonIDForExternalRef(ctx, ref, db.WithTX(tx))
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if existingID != "" {
+			existing, err := d.GetSubscriptionAddonByID(ctx, existingID, db.WithTX(tx))
+			if err != nil {
+				response.Error = serrors.NatsError(ctx, err)
+				return response
+			}
+			if existing.Subscription.ID != subscriptionID || existing.Addon.ID != addonID {
+				response.Error = serrors.NatsError(ctx, serrors.ErrExternalIDExists)
+				return response
+			}
+			response.SubscriptionAddon = existing.ToQMSType()
+			return response
+		}
+	}
+
+	subAddon, eventData, err := a.attachAddon(ctx, d, tx, subscriptionID, addonID, quantity)
+	if err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
+	if !endDate.IsZero() {
+		if err = d.SetSubscriptionAddonEndDate(ctx, subAddon.ID, endDate, db.WithTX(tx)); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	if ref != nil {
+		if err = d.SetSubscriptionAddonExternalRef(ctx, subAddon.ID, ref, db.WithTX(tx)); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
+	a.notify(ctx, api.EventAddonAttached, eventData)
+	a.projectSubscriptionOverages(ctx, subscriptionID)
+
 	response.SubscriptionAddon = subAddon.ToQMSType()
 	return response
 }
@@ -493,12 +700,15 @@ func (a *App) AddSubscriptionAddonHandler(subject, reply string, request *reques
 	ctx, span := reqinit.InitAssociateByUUIDs(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "adding subscription add-on")
 
-	response := a.addSubscriptionAddon(ctx, request)
+	response, err := a.service.AddSubscriptionAddon(ctx, request)
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -514,23 +724,37 @@ func (a *App) AddSubscriptionAddonHTTPHandler(c echo.Context) error {
 		ChildUuid:  c.Param("addon_uuid"),
 	}
 
-	response := a.addSubscriptionAddon(ctx, request)
+	ref, err := httpExternalRef(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		})
+	}
+
+	response := a.addSubscriptionAddon(ctx, request, ref, c.QueryParam("quantity"), c.QueryParam("end_date"))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) deleteSubscriptionAddon(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
-	d := db.New(a.db)
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
 
 	// Get the subscription add-on ID out of the request.
 	subAddonID := request.Uuid
-	if subAddonID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("subscription addon-on UUID must be set"))
+	if err := validate.UUID("uuid", subAddonID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
@@ -552,32 +776,35 @@ func (a *App) deleteSubscriptionAddon(ctx context.Context, request *requests.ByU
 		return response
 	}
 
-	// Get the current quota value.
-	quotaValue, _, err := d.GetCurrentQuota(
-		ctx,
-		subAddon.Addon.ResourceType.ID,
-		subAddon.Subscription.ID,
-		db.WithTXRollbackCommit(tx, false, false),
-	)
-	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
-	}
+	// The amounts of expired add-ons have already been removed from the quota.
+	if !subAddon.Expired() {
+		// Get the current quota value.
+		quotaValue, _, err := d.GetCurrentQuota(
+			ctx,
+			subAddon.Addon.ResourceType.ID,
+			subAddon.Subscription.ID,
+			db.WithTXRollbackCommit(tx, false, false),
+		)
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
 
-	// Update the quota value by subtracting the amount configured in the
-	// subscription add-on. We don't want the available add-on value, we want
-	// the subscription add-on value, which may have been modified from the
-	// available add-on value.
-	quotaValue = quotaValue - subAddon.Amount
-	if err = d.UpsertQuota(
-		ctx,
-		quotaValue,
-		subAddon.Addon.ResourceType.ID,
-		subAddon.Subscription.ID,
-		db.WithTXRollbackCommit(tx, false, false),
-	); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
+		// Update the quota value by subtracting the amount configured in the
+		// subscription add-on. We don't want the available add-on value, we want
+		// the subscription add-on value, which may have been modified from the
+		// available add-on value.
+		quotaValue = quotaValue - subAddon.Amount
+		if err = d.UpsertQuota(
+			ctx,
+			quotaValue,
+			subAddon.Addon.ResourceType.ID,
+			subAddon.Subscription.ID,
+			db.WithTXRollbackCommit(tx, false, false),
+		); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
 	}
 
 	// Delete the subscription add-on.
@@ -592,6 +819,8 @@ func (a *App) deleteSubscriptionAddon(ctx context.Context, request *requests.ByU
 		return response
 	}
 
+	a.projectSubscriptionOverages(ctx, subAddon.Subscription.ID)
+
 	// Return the response.
 	response.SubscriptionAddon = subAddon.ToQMSType()
 
@@ -604,12 +833,15 @@ func (a *App) DeleteSubscriptionAddonHandler(subject, reply string, request *req
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "deleting subscription add-ons")
 
-	response := a.deleteSubscriptionAddon(ctx, request)
+	response, err := a.service.DeleteSubscriptionAddon(ctx, request)
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -630,16 +862,21 @@ func (a *App) DeleteSubscriptionAddonHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSubscriptionAddonRequest) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 
-	if request.SubscriptionAddon.Uuid == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("uuid must be set in the request"))
+	if err := validate.UUID("uuid", request.SubscriptionAddon.Uuid); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
@@ -665,35 +902,39 @@ func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSu
 			return response
 		}
 
-		// Get the current quota value.
-		quotaValue, _, err := d.GetCurrentQuota(
-			ctx,
-			preUpdateSubAddon.Addon.ResourceType.ID,
-			preUpdateSubAddon.Subscription.ID,
-			db.WithTXRollbackCommit(tx, false, false),
-		)
-		if err != nil {
-			response.Error = serrors.NatsError(ctx, err)
-			return response
-		}
-
-		// First, remove the pre-update subscription add-on value from the quota
-		// value.
-		quotaValue = quotaValue - preUpdateSubAddon.Amount
-
-		// Next, add the new value for the subscription add-on.
-		quotaValue = quotaValue + updateSubAddon.Amount
-
-		// Now update the quota value
-		if err = d.UpsertQuota(
-			ctx,
-			quotaValue,
-			preUpdateSubAddon.Addon.ResourceType.ID,
-			preUpdateSubAddon.Subscription.ID,
-			db.WithTXRollbackCommit(tx, false, false),
-		); err != nil {
-			response.Error = serrors.NatsError(ctx, err)
-			return response
+		// The amounts of expired add-ons have already been removed from the
+		// quota, so only the amount recorded for the add-on changes.
+		if !preUpdateSubAddon.Expired() {
+			// Get the current quota value.
+			quotaValue, _, err := d.GetCurrentQuota(
+				ctx,
+				preUpdateSubAddon.Addon.ResourceType.ID,
+				preUpdateSubAddon.Subscription.ID,
+				db.WithTXRollbackCommit(tx, false, false),
+			)
+			if err != nil {
+				response.Error = serrors.NatsError(ctx, err)
+				return response
+			}
+
+			// First, remove the pre-update subscription add-on value from the quota
+			// value.
+			quotaValue = quotaValue - preUpdateSubAddon.Amount
+
+			// Next, add the new value for the subscription add-on.
+			quotaValue = quotaValue + updateSubAddon.Amount
+
+			// Now update the quota value
+			if err = d.UpsertQuota(
+				ctx,
+				quotaValue,
+				preUpdateSubAddon.Addon.ResourceType.ID,
+				preUpdateSubAddon.Subscription.ID,
+				db.WithTXRollbackCommit(tx, false, false),
+			); err != nil {
+				response.Error = serrors.NatsError(ctx, err)
+				return response
+			}
 		}
 	}
 
@@ -708,6 +949,10 @@ func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSu
 		return response
 	}
 
+	if updateSubAddon.UpdateAmount {
+		a.projectSubscriptionOverages(ctx, result.Subscription.ID)
+	}
+
 	response.SubscriptionAddon = result.ToQMSType()
 
 	return response
@@ -719,12 +964,15 @@ func (a *App) UpdateSubscriptionAddonHandler(subject, reply string, request *qms
 	ctx, span := qmsinit.InitUpdateSubscriptionAddonRequest(request, subject)
 	defer span.End()
 
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
 	log := log.WithField("context", "update subscription addon")
 
-	response := a.updateSubscriptionAddon(ctx, request)
+	response, err := a.service.UpdateSubscriptionAddon(ctx, request)
 
-	if response.Error != nil {
-		log.Debug(response.Error.Message)
+	if err != nil {
+		log.Debug(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -752,5 +1000,6 @@ func (a *App) UpdateSubscriptionAddonHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
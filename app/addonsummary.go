@@ -0,0 +1,124 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// summarizeSubscriptionAddons rolls up subscription add-ons that refer to the
+// same add-on into a single summary containing the number of times the add-on
+// was applied and the total amount that it added. The individual records are
+// retained in each summary. Summaries are listed in the order in which their
+// add-ons first appear in the list of subscription add-ons.
+func summarizeSubscriptionAddons(subAddons []db.SubscriptionAddon) []*api.SubscriptionAddonSummary {
+	summaries := make([]*api.SubscriptionAddonSummary, 0)
+	summaryFor := make(map[string]*api.SubscriptionAddonSummary)
+
+	for _, subAddon := range subAddons {
+		summary, ok := summaryFor[subAddon.Addon.ID]
+		if !ok {
+			summary = &api.SubscriptionAddonSummary{
+				AddonID:     subAddon.Addon.ID,
+				Name:        subAddon.Addon.Name,
+				Description: subAddon.Addon.Description,
+				ResourceType: api.ResourceType{
+					ID:   subAddon.Addon.ResourceType.ID,
+					Name: subAddon.Addon.ResourceType.Name,
+					Unit: subAddon.Addon.ResourceType.Unit,
+				},
+				Details: make([]*api.SubscriptionAddonDetail, 0),
+			}
+			summaryFor[subAddon.Addon.ID] = summary
+			summaries = append(summaries, summary)
+		}
+
+		paid, rate := subAddon.Paid, subAddon.Rate.Rate
+		detail := &api.SubscriptionAddonDetail{
+			ID:       subAddon.ID,
+			Amount:   subAddon.Amount,
+			Quantity: subAddon.Quantity,
+			Paid:     &paid,
+			Rate:     &rate,
+			Expired:  subAddon.Expired(),
+		}
+		if subAddon.EffectiveEndDate.Valid {
+			endDate := subAddon.EffectiveEndDate.Time
+			detail.EndDate = &endDate
+		}
+		if !detail.Expired {
+			summary.Quantity += int(subAddon.Quantity)
+			summary.TotalAmount += subAddon.Amount
+		}
+		summary.Details = append(summary.Details, detail)
+	}
+
+	return summaries
+}
+
+func (a *App) summarizeSubscriptionAddons(ctx context.Context, request *api.ByUUIDRequest) *api.SubscriptionAddonSummaryResponse {
+	response := &api.SubscriptionAddonSummaryResponse{SubscriptionID: request.UUID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	subAddons, err := d.ListSubscriptionAddons(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Summaries = summarizeSubscriptionAddons(subAddons)
+	return response
+}
+
+// SummarizeSubscriptionAddonsHandler lists the add-ons that have been applied
+// to a subscription, with add-ons that were applied more than once rolled up
+// into a single entry.
+func (a *App) SummarizeSubscriptionAddonsHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "summarizing subscription add-ons")
+
+	response := a.summarizeSubscriptionAddons(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SummarizeSubscriptionAddonsHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{
+		UUID: c.Param("uuid"),
+	}
+
+	response := a.summarizeSubscriptionAddons(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
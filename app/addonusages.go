@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// SubscriptionAddonHeader is the name of the message header (and HTTP header)
+// used to attribute a usage update to one of the add-ons of the user's current
+// subscription. The QMS update message doesn't have a field for it, so it's
+// passed in the header instead.
+const SubscriptionAddonHeader = "x-qms-subscription-addon-id"
+
+// validateAddonAttribution checks that a usage update can be attributed to the
+// subscription add-on: the add-on must have been applied to the user's current
+// subscription and must be for the resource type that the update is for.
+func (a *App) validateAddonAttribution(
+	ctx context.Context, d *db.Database, username string, update *db.Update,
+) error {
+	if update.ValueType != db.UsagesTrackedMetric {
+		return serrors.ErrInvalidAddonAttribution
+	}
+
+	subAddon, err := d.GetSubscriptionAddonByID(ctx, update.SubscriptionAddonID)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, false)
+	if err == serrors.ErrSubscriptionNotFound {
+		return serrors.ErrInvalidAddonAttribution
+	}
+	if err != nil {
+		return err
+	}
+
+	if subAddon.Subscription.ID != subscription.ID ||
+		subAddon.Addon.ResourceType.ID != update.ResourceType.ID {
+		return serrors.ErrInvalidAddonAttribution
+	}
+
+	return nil
+}
+
+// usageBreakdown splits the usage of each resource type between the add-ons
+// that the usage is attributed to. Resource types without add-ons only have
+// unattributed usage. Resources are sorted by name.
+func usageBreakdown(
+	usages []db.Usage, quotas []db.Quota, subAddons []db.SubscriptionAddon, addonUsages []db.AddonUsage,
+) []*api.ResourceUsageBreakdown {
+	breakdownFor := make(map[string]*api.ResourceUsageBreakdown)
+	breakdown := func(rt db.ResourceType) *api.ResourceUsageBreakdown {
+		b, ok := breakdownFor[rt.ID]
+		if !ok {
+			b = &api.ResourceUsageBreakdown{
+				ResourceType: api.ResourceType{ID: rt.ID, Name: rt.Name, Unit: rt.Unit},
+				Addons:       make([]*api.AddonUsage, 0),
+			}
+			breakdownFor[rt.ID] = b
+		}
+		return b
+	}
+
+	for _, quota := range quotas {
+		breakdown(quota.ResourceType).Quota = quota.Quota
+	}
+	for _, usage := range usages {
+		breakdown(usage.ResourceType).Usage = usage.Usage
+	}
+
+	attributed := make(map[string]float64)
+	for _, addonUsage := range addonUsages {
+		attributed[addonUsage.SubscriptionAddonID] = addonUsage.Usage
+	}
+	for _, subAddon := range subAddons {
+		b := breakdown(subAddon.Addon.ResourceType)
+		b.Addons = append(b.Addons, &api.AddonUsage{
+			SubscriptionAddonID: subAddon.ID,
+			AddonID:             subAddon.Addon.ID,
+			AddonName:           subAddon.Addon.Name,
+			Amount:              subAddon.Amount,
+			Usage:               attributed[subAddon.ID],
+		})
+	}
+
+	result := make([]*api.ResourceUsageBreakdown, 0, len(breakdownFor))
+	for _, b := range breakdownFor {
+		b.UnattributedUsage = b.Usage
+		for _, addon := range b.Addons {
+			b.UnattributedUsage -= addon.Usage
+		}
+		result = append(result, b)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ResourceType.Name < result[j].ResourceType.Name
+	})
+
+	return result
+}
+
+func (a *App) getUsageBreakdown(ctx context.Context, request *api.UsageBreakdownRequest) *api.UsageBreakdownResponse {
+	response := &api.UsageBreakdownResponse{Resources: make([]*api.ResourceUsageBreakdown, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	d := a.readDatabase(ctx)
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	usages, err := d.SubscriptionUsages(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	quotas, err := d.SubscriptionQuotas(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	subAddons, err := d.ListSubscriptionAddons(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	addonUsages, err := d.SubscriptionAddonUsages(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.SubscriptionID = subscription.ID
+	response.Resources = usageBreakdown(usages, quotas, subAddons, addonUsages)
+	return response
+}
+
+// GetUsageBreakdownHandler returns the usages of a user's current subscription
+// broken down by the add-ons that the usage is attributed to.
+func (a *App) GetUsageBreakdownHandler(subject, reply string, request *api.UsageBreakdownRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting usage breakdown")
+
+	response := a.getUsageBreakdown(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetUsageBreakdownHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getUsageBreakdown(ctx, &api.UsageBreakdownRequest{Username: c.Param("username")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/labstack/echo/v4"
+)
+
+// apiVersions describes the versions of the NATS API that the service supports
+// and serves.
+func (a *App) apiVersions() *api.APIVersionResponse {
+	response := &api.APIVersionResponse{
+		Current:   natscl.CurrentAPIVersion,
+		Supported: natscl.SupportedAPIVersions,
+		Enabled:   natscl.SupportedAPIVersions,
+	}
+	if a.client != nil {
+		response.Enabled = a.client.EnabledVersions()
+	}
+	return response
+}
+
+// GetAPIVersionHandler advertises the versions of the NATS API, so that clients
+// can pick the latest version that both sides understand.
+func (a *App) GetAPIVersionHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting api version")
+
+	response := a.apiVersions()
+	response.RequestVersion = a.client.SubjectVersion(subject)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetAPIVersionHTTPHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.apiVersions())
+}
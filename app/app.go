@@ -4,15 +4,23 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"regexp"
+	"time"
 
 	"github.com/cyverse-de/go-mod/logging"
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/billing"
 	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/cyverse-de/subscriptions/overagekv"
+	"github.com/cyverse-de/subscriptions/service"
+	"github.com/cyverse-de/subscriptions/storage"
+	"github.com/cyverse-de/subscriptions/subcache"
+	"github.com/cyverse-de/subscriptions/usernames"
+	"github.com/cyverse-de/subscriptions/webhooks"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"github.com/samber/lo"
@@ -25,9 +33,42 @@ var log = logging.Log.WithFields(logrus.Fields{"package": "apps"})
 type App struct {
 	client         *natscl.Client
 	db             *sqlx.DB
+	replicaDB      *sqlx.DB
 	Router         *echo.Echo
+	AdminRouter    *echo.Echo
 	userSuffix     string
 	ReportOverages bool
+	webhooks       *webhooks.Dispatcher
+	readOnly       *db.ReadOnlyMonitor
+	outbox         bool
+	reservations   bool
+	groups         bool
+	timeouts       TimeoutSettings
+	limiter        *limiter
+	userShards     *userShards
+	overageStore   *overagekv.Store
+	usernames      usernames.Normalizer
+	objectStore    storage.Store
+	billing        billing.Provider
+	defaultPlan    string
+	autoSubscribe  bool
+	retention      RetentionSettings
+	reconciliation ReconciliationSettings
+
+	subscriptionCache subcache.Cache
+	service           service.QMS
+
+	// GracePeriod is the amount of time after a subscription ends during which
+	// it's still treated as the user's current subscription.
+	GracePeriod time.Duration
+
+	// adminToken is the token that callers present to be treated as
+	// administrators. No caller is an administrator if it's empty.
+	adminToken string
+
+	// DefaultCallerRole is the role assumed for callers that don't present the
+	// admin token.
+	DefaultCallerRole CallerRole
 }
 
 func New(client *natscl.Client, db *sqlx.DB, userSuffix string) *App {
@@ -37,7 +78,14 @@ func New(client *natscl.Client, db *sqlx.DB, userSuffix string) *App {
 		userSuffix:     userSuffix,
 		Router:         echo.New(),
 		ReportOverages: true,
+		timeouts:       DefaultTimeoutSettings(),
+		limiter:        newLimiter(DefaultConcurrencySettings()),
+		userShards:     newUserShards(DefaultUserShards),
+		usernames:      usernames.Default(),
+
+		DefaultCallerRole: RoleUser,
 	}
+	app.service = &Service{a: app}
 
 	app.Router.HTTPErrorHandler = func(err error, c echo.Context) {
 		code := http.StatusInternalServerError
@@ -61,61 +109,204 @@ func New(client *natscl.Client, db *sqlx.DB, userSuffix string) *App {
 		c.JSON(code, body) // nolint:errcheck
 	}
 
+	app.AdminRouter = app.newAdminRouter()
+
 	app.Router.GET("/", app.GreetingHTTPHandler).Name = "greeting"
+	app.Router.GET("/api/version", app.GetAPIVersionHTTPHandler)
 	app.Router.GET("/summary/:user", app.GetUserSummaryHTTPHandler)
 	app.Router.PUT("/addons", app.AddAddonHTTPHandler)
 	app.Router.GET("/addons", app.ListAddonsHTTPHandler)
 	app.Router.POST("/addons/:uuid", app.UpdateAddonHTTPHandler)
 	app.Router.DELETE("/addons/:uuid", app.DeleteAddonHTTPHandler)
 	app.Router.GET("/subscriptions/:uuid/addons", app.ListSubscriptionAddonsHTTPHandler)
+	app.Router.GET("/subscriptions/:uuid/addons/summary", app.SummarizeSubscriptionAddonsHTTPHandler)
+	app.Router.PUT("/subscriptions/:uuid/bundles/:name", app.AttachAddonBundleHTTPHandler)
+	app.Router.GET("/subscriptions/:uuid/discount", app.GetSubscriptionDiscountHTTPHandler)
+	app.Router.GET("/subscriptions/:uuid/invoices", app.GetSubscriptionInvoicesHTTPHandler)
+	app.Router.GET("/subscriptions/:uuid/payment", app.GetSubscriptionPaymentStatusHTTPHandler)
 	app.Router.GET("/subscriptions/:sub_uuid/addons/:addon_uuid", app.GetSubscriptionAddonHTTPHandler)
 	app.Router.PUT("/subscriptions/:sub_uuid/addons/:addon_uuid", app.AddSubscriptionAddonHTTPHandler)
 	app.Router.DELETE("/subscriptions/:sub_uuid/addons/:addon_uuid", app.DeleteSubscriptionAddonHTTPHandler)
 	app.Router.POST("/subscriptions/:sub_uuid/addons/:addon_uuid", app.UpdateSubscriptionAddonHTTPHandler)
 	app.Router.PUT("/users", app.AddUserHTTPHandler)
+	app.Router.POST("/users/:username/plan", app.ChangeSubscriptionPlanHTTPHandler)
+	app.Router.GET("/users/:username/plan/compare", app.ComparePlansHTTPHandler)
+	app.Router.GET("/users/:username/subscription/summary", app.GetSubscriptionSummaryHTTPHandler)
+	app.Router.GET("/users/:username/subscriptions", app.ListUserSubscriptionsHTTPHandler)
 	app.Router.GET("/users/:username/updates", app.GetUserUpdatesHTTPHandler)
 	app.Router.PUT("/user/:username/updates", app.AddUserUpdateHTTPHandler)
 	app.Router.GET("/users/:username/overages", app.GetUserOveragesHTTPHandler)
 	app.Router.GET("/users/:username/overages/:resource_name", app.CheckUserOveragesHTTPHandler)
+	app.Router.GET("/users/:username/overage-billing", app.PreviewOverageBillingHTTPHandler)
 	app.Router.GET("/users/:username/usages", app.GetUsagesHTTPHandler)
+	app.Router.GET("/users/:username/usages/addons", app.GetUsageBreakdownHTTPHandler)
+	app.Router.GET("/users/:username/usages/:resource_name/forecast", app.ForecastUsageHTTPHandler)
+	app.Router.GET("/users/:username/usage-rollups", app.UsageRollupsHTTPHandler)
+	app.Router.GET("/users/:username/credits", app.GetCreditBalanceHTTPHandler)
+	app.Router.GET("/users/:username/credits/ledger", app.ListCreditLedgerHTTPHandler)
+	app.Router.GET("/users/:username/features/:feature", app.UserHasFeatureHTTPHandler)
+	app.Router.PUT("/users/:username/reservations", app.ReserveResourceHTTPHandler)
+	app.Router.DELETE("/reservations/:id", app.ReleaseReservationHTTPHandler)
+	app.Router.POST("/users/:username/purchases", app.BeginPurchaseHTTPHandler)
+	app.Router.POST("/purchases/:id/commit", app.CommitPurchaseHTTPHandler)
+	app.Router.POST("/purchases/:id/abort", app.AbortPurchaseHTTPHandler)
 	app.Router.PUT("/users/:username/usages", app.AddUsageHTTPHandler)
 	app.Router.GET("/plans", app.ListPlansHTTPHandler)
 	app.Router.PUT("/plans", app.AddPlanHTTPHandler)
 	app.Router.GET("/plans/:plan_id", app.GetPlanHTTPHandler)
+	app.Router.GET("/plans/:plan_id/addons", app.ListAddonsForPlanHTTPHandler)
+	app.Router.GET("/resource-types", app.ListResourceTypesHTTPHandler)
+	app.Router.PUT("/resource-types", app.AddResourceTypeHTTPHandler)
+	app.Router.POST("/resource-types/:name", app.UpdateResourceTypeHTTPHandler)
 	app.Router.POST("/quotas/defaults", app.UpsertQuotaDefaultsHTTPHandler)
 	app.Router.PUT("/quotas", app.AddQuotaHTTPHandler)
 
+	// The admin routes are only served to administrators. See requireAdmin.
+	admin := app.Router.Group("/admin", app.requireAdmin)
+	admin.POST("/cohorts/expire", app.ExpireCohortHTTPHandler)
+	admin.GET("/jobs/:id", app.GetBulkJobHTTPHandler)
+	admin.GET("/responses/failures", app.RespondFailuresHTTPHandler)
+	admin.PUT("/webhooks", app.AddWebhookHTTPHandler)
+	admin.GET("/webhooks", app.ListWebhooksHTTPHandler)
+	admin.GET("/webhooks/:id", app.GetWebhookHTTPHandler)
+	admin.POST("/webhooks/:id", app.UpdateWebhookHTTPHandler)
+	admin.DELETE("/webhooks/:id", app.DeleteWebhookHTTPHandler)
+	app.Router.GET("/usernames/normalize", app.NormalizeUsernameHTTPHandler)
+	admin.GET("/users", app.ListUsersHTTPHandler)
+	admin.POST("/users", app.CreateUserHTTPHandler)
+	admin.POST("/users/merge", app.MergeUsersHTTPHandler)
+	admin.GET("/users/:username", app.GetUserHTTPHandler)
+	admin.PUT("/users/:username", app.EnsureUserHTTPHandler)
+	admin.DELETE("/users/:username", app.PurgeUserHTTPHandler)
+	admin.GET("/users/:username/test", app.GetTestAccountHTTPHandler)
+	admin.POST("/users/:username/test", app.SetTestAccountHTTPHandler)
+	admin.PUT("/plan-changes", app.SchedulePlanChangeHTTPHandler)
+	admin.GET("/users/:username/plan-changes", app.ListPlanChangesHTTPHandler)
+	admin.DELETE("/plan-changes/:id", app.CancelPlanChangeHTTPHandler)
+	admin.POST("/plans/:plan_name/trial", app.SetTrialPlanHTTPHandler)
+	admin.POST("/plans/:plan_name/quota-exempt", app.SetQuotaExemptPlanHTTPHandler)
+	admin.POST("/plans/:plan_name/period", app.SetPlanPeriodHTTPHandler)
+	admin.POST("/plans/:plan_name/clone", app.ClonePlanHTTPHandler)
+	admin.GET("/plans/:plan_name/snapshot", app.GetPlanSnapshotHTTPHandler)
+	admin.GET("/plans/:plan_name/features", app.ListPlanFeaturesHTTPHandler)
+	admin.PUT("/plans/:plan_name/features/:feature", app.AddPlanFeatureHTTPHandler)
+	admin.DELETE("/plans/:plan_name/features/:feature", app.RemovePlanFeatureHTTPHandler)
+
+	admin.PUT("/discounts", app.AddDiscountCodeHTTPHandler)
+	admin.GET("/discounts", app.ListDiscountCodesHTTPHandler)
+	admin.GET("/discounts/:code", app.GetDiscountCodeHTTPHandler)
+	admin.POST("/subscriptions/:uuid/invoices", app.GenerateInvoiceHTTPHandler)
+	admin.GET("/subscriptions/:uuid/invoices", app.ListInvoicesHTTPHandler)
+	admin.GET("/invoices/:id", app.GetInvoiceHTTPHandler)
+	admin.POST("/subscriptions/:uuid/payment", app.SetSubscriptionPaymentStatusHTTPHandler)
+	admin.GET("/subscriptions/:uuid/annotations", app.GetSubscriptionAnnotationsHTTPHandler)
+	admin.POST("/subscriptions/:uuid/notes", app.AddSubscriptionNoteHTTPHandler)
+	admin.DELETE("/subscriptions/:uuid/notes/:note_uuid", app.DeleteSubscriptionNoteHTTPHandler)
+	admin.PUT("/subscriptions/:uuid/tags/:key", app.SetSubscriptionTagHTTPHandler)
+	admin.DELETE("/subscriptions/:uuid/tags/:key", app.DeleteSubscriptionTagHTTPHandler)
+
+	admin.PUT("/groups", app.AddGroupHTTPHandler)
+	admin.GET("/groups/:name", app.GetGroupHTTPHandler)
+	admin.PUT("/groups/:name/members/:username", app.AddGroupMemberHTTPHandler)
+	admin.DELETE("/groups/:name/members/:username", app.RemoveGroupMemberHTTPHandler)
+	admin.POST("/groups/:name/subscription", app.SubscribeGroupHTTPHandler)
+	admin.DELETE("/plans/:plan_name", app.DeletePlanHTTPHandler)
+	admin.GET("/trials/conversions", app.TrialConversionsHTTPHandler)
+	admin.GET("/plans/subscriptions", app.SubscriptionsByPlanHTTPHandler)
+	admin.GET("/usage-totals", app.UsageTotalsHTTPHandler)
+	admin.POST("/retention/run", app.RunRetentionHTTPHandler)
+	admin.POST("/reconciliation/run", app.RunReconciliationHTTPHandler)
+	admin.GET("/reports/overages", app.GetOverageReportHTTPHandler)
+	admin.GET("/reports/revenue", app.GetRevenueReportHTTPHandler)
+	admin.GET("/exports/subscriptions", app.ExportSubscriptionsHTTPHandler)
+	admin.PUT("/metered-rates", app.SetMeteredRateHTTPHandler)
+	admin.PUT("/quota-policies", app.SetQuotaPolicyHTTPHandler)
+	admin.GET("/quota-policies", app.ListQuotaPoliciesHTTPHandler)
+	admin.PUT("/quota-changes", app.ScheduleQuotaChangeHTTPHandler)
+	admin.GET("/users/:username/quota-changes", app.ListQuotaChangesHTTPHandler)
+	admin.DELETE("/quota-changes/:id", app.CancelQuotaChangeHTTPHandler)
+	admin.POST("/quotas/adjust", app.AdjustQuotasBatchHTTPHandler)
+	admin.PUT("/users/:username/credits", app.DepositCreditsHTTPHandler)
+	admin.PUT("/usage-rules", app.SetUsageRuleHTTPHandler)
+	admin.GET("/usage-rules", app.ListUsageRulesHTTPHandler)
+	admin.GET("/flagged-usages", app.ListFlaggedUsageUpdatesHTTPHandler)
+	admin.POST("/flagged-usages/:id/review", app.ReviewFlaggedUsageUpdateHTTPHandler)
+	admin.GET("/quarantined-usages", app.ListQuarantinedUpdatesHTTPHandler)
+	admin.POST("/quarantined-usages/:id/approve", app.ApproveQuarantinedUpdateHTTPHandler)
+	admin.POST("/quarantined-usages/:id/reject", app.RejectQuarantinedUpdateHTTPHandler)
+	admin.PUT("/addon-bundles", app.AddAddonBundleHTTPHandler)
+	admin.GET("/addon-bundles", app.ListAddonBundlesHTTPHandler)
+	admin.PUT("/addons/:uuid/prerequisites", app.SetAddonPrerequisitesHTTPHandler)
+	admin.GET("/addons/:uuid/prerequisites", app.GetAddonPrerequisitesHTTPHandler)
+	admin.PUT("/addons/:uuid/compatibility", app.SetAddonCompatibilityHTTPHandler)
+	admin.GET("/addons/:uuid/compatibility", app.GetAddonCompatibilityHTTPHandler)
+	admin.PUT("/addons/:uuid/limit", app.SetAddonLimitHTTPHandler)
+	app.Router.POST("/users/:username/quotas/enforce", app.EnforceQuotaHTTPHandler)
+	app.Router.POST("/users/:username/trials", app.StartTrialHTTPHandler)
+	app.Router.GET("/events/schemas", app.GetEventSchemasHTTPHandler)
+	app.Router.GET("/events/schemas/:type", app.GetEventSchemasHTTPHandler)
+	app.Router.GET("/external/:source/subscriptions/:external_id", app.GetSubscriptionByExternalIDHTTPHandler)
+	app.Router.GET("/external/:source/addons/:external_id", app.GetSubscriptionAddonByExternalIDHTTPHandler)
+
+	// Requests can be limited to a tenant with the x-qms-tenant header.
+	app.Router.Use(tenantMiddleware)
+
 	return app
 }
 
-func (a *App) FixUsername(username string) (string, error) {
+// SetReadReplica configures a read replica connection that read-heavy handlers
+// can use to take load off of the primary database.
+func (a *App) SetReadReplica(replicaDB *sqlx.DB) {
+	a.replicaDB = replicaDB
+}
 
-	re, err := regexp.Compile(`@.*$`)
-	if err != nil {
-		return "", err
-	}
-	return re.ReplaceAllString(username, ""), nil
+// SetObjectStore configures the store used for exports and archives. Features
+// that need to store objects are unavailable if the store isn't set.
+func (a *App) SetObjectStore(store storage.Store) {
+	a.objectStore = store
+}
+
+// SetAdminToken sets the token that callers present in the x-qms-admin-token
+// header to be treated as administrators.
+func (a *App) SetAdminToken(token string) {
+	a.adminToken = token
 }
 
-func (a *App) validateUpdate(request *qms.AddUpdateRequest) (string, error) {
+// SetUsernameNormalizer changes how the usernames in requests are normalized.
+func (a *App) SetUsernameNormalizer(normalizer usernames.Normalizer) {
+	a.usernames = normalizer
+}
+
+// FixUsername returns the canonical form of a username.
+func (a *App) FixUsername(username string) (string, error) {
+	return a.usernames.Normalize(username)
+}
+
+func (a *App) validateUpdate(ctx context.Context, d *db.Database, request *qms.AddUpdateRequest) (string, error) {
 	username, err := a.FixUsername(request.Update.User.Username)
 	if err != nil {
 		return "", err
 	}
 
-	if request.Update.ResourceType.Name == "" || !lo.Contains[string](
-		db.ResourceTypeNames,
-		request.Update.ResourceType.Name,
-	) {
+	if request.Update.ResourceType.Name == "" {
+		return username, errors.ErrInvalidResourceName
+	}
+	resourceType, err := d.GetResourceTypeByName(ctx, request.Update.ResourceType.Name)
+	if err != nil {
+		return username, err
+	}
+	if resourceType.ID == "" {
 		return username, errors.ErrInvalidResourceName
 	}
 
-	if request.Update.ResourceType.Unit == "" || !lo.Contains[string](
-		db.ResourceTypeUnits,
-		request.Update.ResourceType.Unit,
-	) {
-		return username, errors.ErrInvalidResourceUnit
+	// Updates can be reported in any unit that converts to the resource type's
+	// unit. They're recorded in the resource type's unit.
+	value, err := convertToResourceUnit(request.Update.Value, request.Update.ResourceType.Unit, resourceType)
+	if err != nil {
+		return username, err
 	}
+	request.Update.Value = value
+	request.Update.ResourceType.Unit = resourceType.Unit
 
 	if request.Update.Operation.Name == "" || !lo.Contains[string](
 		db.UpdateOperationNames,
@@ -153,7 +344,7 @@ func (a *App) getUserUpdates(ctx context.Context, request *qms.UpdateListRequest
 
 	log = log.WithFields(logrus.Fields{"user": username})
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 
 	mUpdates, err := d.UserUpdates(ctx, username)
 	if err != nil {
@@ -194,10 +385,13 @@ func (a *App) GetUserUpdatesHandler(subject, reply string, request *qms.UpdateLi
 	ctx, span := pbinit.InitQMSUpdateListRequest(request, subject)
 	defer span.End()
 
-	response := a.getUserUpdates(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.GetUserUpdates(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -220,10 +414,14 @@ func (a *App) GetUserUpdatesHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
-func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest) *qms.AddUpdateResponse {
+// addUserUpdate records an update to a user's usage or quota. The usage can be
+// attributed to one of the add-ons of the user's current subscription by
+// passing the subscription add-on's ID.
+func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest, subAddonID string) *qms.AddUpdateResponse {
 	var (
 		err                                 error
 		userID, resourceTypeID, operationID string
@@ -231,14 +429,25 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 	)
 
 	response := pbinit.NewQMSAddUpdateResponse()
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
 
-	d := db.New(a.db)
+	username, err := a.validateUpdate(ctx, d, request)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
 
-	username, err := a.validateUpdate(request)
+	ctx, unlock, err := a.lockUser(ctx, username)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
+	defer unlock()
 
 	log = log.WithFields(logrus.Fields{"user": username})
 
@@ -311,28 +520,70 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 				ID:   operationID,
 				Name: request.Update.Operation.Name,
 			},
+			SubscriptionAddonID: subAddonID,
 		}
 
-		log.Info("adding update to the database")
-		_, err = d.AddUserUpdate(ctx, update)
-		if err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+		if subAddonID != "" {
+			if err = a.validateAddonAttribution(ctx, d, username, update); err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
 		}
-		log.Info("done adding update to the database")
 
 		switch update.ValueType {
 		case db.UsagesTrackedMetric:
+			// Determine whether the user was already over the quota so that
+			// webhooks are only notified when the quota is first exceeded.
+			var wasOver bool
+			if a.webhooks != nil {
+				overage, err := a.overageFor(ctx, d, username, update.ResourceType.Name)
+				if err != nil {
+					log.Errorf("unable to check for an existing overage: %s", err)
+				}
+				wasOver = overage != nil
+			}
+
+			// Usage updates are added to the database in the same transaction
+			// that they're checked against the validation rules and applied in.
+			// Quarantined updates are held rather than applied, so the ID of the
+			// quarantined update is returned instead of an error.
 			log.Info("processing update for usage")
-			if err = d.ProcessUpdateForUsage(ctx, update); err != nil {
+			err = d.ProcessUpdateForUsage(ctx, update, a.usageSubscriptionOpts(a.outboxOpts()...)...)
+			if quarantined, ok := errors.UsageQuarantine(err); ok {
+				setHeaderValue(response.Header, QuarantinedUpdateHeader, quarantined.ID)
+				err = nil
+			}
+			if err != nil {
 				response.Error = errors.NatsError(ctx, err)
 				return response
 			}
 			log.Info("after processing update for usage")
 
+			if a.webhooks != nil && !wasOver {
+				overage, err := a.overageFor(ctx, d, username, update.ResourceType.Name)
+				if err != nil {
+					log.Errorf("unable to check for a new overage: %s", err)
+				}
+				if overage != nil {
+					a.notify(ctx, api.EventQuotaExceeded, &api.QuotaEventData{
+						Username:     username,
+						ResourceName: overage.ResourceType.Name,
+						Quota:        overage.QuotaValue,
+						Usage:        overage.UsageValue,
+					})
+				}
+			}
+
 		case db.QuotasTrackedMetric:
+			log.Info("adding update to the database")
+			if _, err = d.AddUserUpdate(ctx, update); err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
+			log.Info("done adding update to the database")
+
 			log.Info("processing update for quota")
-			if err = d.ProcessUpdateForQuota(ctx, update); err != nil {
+			if err = d.ProcessUpdateForQuota(ctx, update, a.subscriptionOpts(a.outboxOpts()...)...); err != nil {
 				response.Error = errors.NatsError(ctx, err)
 				return response
 			}
@@ -343,6 +594,7 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 			response.Error = errors.NatsError(ctx, err)
 			return response
 		}
+		a.projectOverages(ctx, username)
 
 		// Set up the object for the response.
 		response.Update = &qms.Update{
@@ -378,10 +630,13 @@ func (a *App) AddUserUpdateHandler(subject, reply string, request *qms.AddUpdate
 	ctx, span := pbinit.InitQMSAddUpdateRequest(request, subject)
 	defer span.End()
 
-	response := a.addUserUpdate(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.AddUserUpdate(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	// Send the response to the caller
@@ -406,11 +661,13 @@ func (a *App) AddUserUpdateHTTPHandler(c echo.Context) error {
 
 	request.Update.User.Username = c.Param("username")
 
-	response := a.addUserUpdate(ctx, &request)
+	response := a.addUserUpdate(ctx, &request, c.Request().Header.Get(SubscriptionAddonHeader))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
+	setHTTPQuotaHeaders(c, response.Header)
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
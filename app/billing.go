@@ -0,0 +1,199 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/billing"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// SetBillingProvider sets the provider that new, renewed and canceled
+// subscriptions are handed to. Subscriptions aren't billed if the provider
+// isn't set. Billing requires the external_invoices table.
+func (a *App) SetBillingProvider(provider billing.Provider) {
+	a.billing = provider
+}
+
+// bill hands a subscription lifecycle event to the billing provider in the
+// background, so that a slow provider can't hold up the request that caused the
+// event. Expired subscriptions are treated as cancellations. Other events are
+// ignored.
+func (a *App) bill(ctx context.Context, eventType string, data any) {
+	event, ok := data.(*api.SubscriptionEventData)
+	if !ok {
+		return
+	}
+
+	switch eventType {
+	case api.EventSubscriptionCreated, api.EventSubscriptionRenewed, api.EventSubscriptionExpired:
+		go a.billSubscription(context.WithoutCancel(ctx), eventType, event)
+	}
+}
+
+// billSubscription calls the billing provider for a subscription lifecycle
+// event and records the invoice that it creates, if any. Only paid
+// subscriptions are billed, at their discounted rate if a discount code was
+// redeemed for them. Failures are only logged, since the request that caused
+// the event has already been answered.
+func (a *App) billSubscription(ctx context.Context, eventType string, event *api.SubscriptionEventData) {
+	log := log.WithFields(logrus.Fields{
+		"context":      "billing",
+		"provider":     a.billing.Name(),
+		"event":        eventType,
+		"subscription": event.SubscriptionID,
+	})
+
+	d := a.database(ctx)
+
+	subscription, err := d.GetSubscriptionByID(ctx, event.SubscriptionID)
+	if err != nil {
+		log.Errorf("unable to look up the subscription: %s", err)
+		return
+	}
+	if subscription == nil {
+		log.Error("the subscription no longer exists")
+		return
+	}
+
+	billed := &billing.Subscription{
+		ID:       subscription.ID,
+		Username: subscription.User.Username,
+		PlanName: subscription.Plan.Name,
+		Rate:     subscription.Rate.Rate,
+	}
+
+	if eventType == api.EventSubscriptionExpired {
+		invoices, err := d.ListExternalInvoices(ctx, subscription.ID)
+		if err != nil {
+			log.Errorf("unable to list the invoices: %s", err)
+			return
+		}
+		for _, invoice := range invoices {
+			if invoice.Provider == a.billing.Name() {
+				billed.InvoiceIDs = append(billed.InvoiceIDs, invoice.ExternalID)
+			}
+		}
+		if err = a.billing.SubscriptionCanceled(ctx, billed); err != nil {
+			log.Errorf("unable to cancel the subscription with the billing provider: %s", err)
+		}
+		return
+	}
+
+	if !subscription.Paid {
+		return
+	}
+
+	discount, err := d.GetSubscriptionDiscount(ctx, subscription.ID)
+	if err != nil {
+		log.Errorf("unable to look up the discount: %s", err)
+		return
+	}
+	if discount != nil {
+		billed.Rate = discount.DiscountedRate
+	}
+
+	var invoice *billing.Invoice
+	if eventType == api.EventSubscriptionRenewed {
+		invoice, err = a.billing.SubscriptionRenewed(ctx, billed)
+	} else {
+		invoice, err = a.billing.SubscriptionCreated(ctx, billed)
+	}
+	if err != nil {
+		log.Errorf("unable to bill the subscription: %s", err)
+		return
+	}
+	if invoice == nil {
+		return
+	}
+
+	if err = d.AddExternalInvoice(ctx, &db.ExternalInvoice{
+		SubscriptionID: subscription.ID,
+		Provider:       a.billing.Name(),
+		ExternalID:     invoice.ExternalID,
+		EventType:      eventType,
+		Status:         sql.NullString{String: invoice.Status, Valid: invoice.Status != ""},
+		URL:            sql.NullString{String: invoice.URL, Valid: invoice.URL != ""},
+		Amount:         invoice.Amount,
+	}); err != nil {
+		log.Errorf("unable to record invoice %s: %s", invoice.ExternalID, err)
+		return
+	}
+
+	log.Infof("recorded invoice %s", invoice.ExternalID)
+}
+
+func (a *App) getSubscriptionInvoices(ctx context.Context, request *api.ByUUIDRequest) *api.SubscriptionInvoicesResponse {
+	response := &api.SubscriptionInvoicesResponse{
+		SubscriptionID: request.UUID,
+		Invoices:       make([]*api.ExternalInvoice, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	subscription, err := d.GetSubscriptionByID(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if subscription == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrSubscriptionNotFound)
+		return response
+	}
+
+	invoices, err := d.ListExternalInvoices(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, invoice := range invoices {
+		response.Invoices = append(response.Invoices, invoice.ToAPIType())
+	}
+	return response
+}
+
+// GetSubscriptionInvoicesHandler lists the invoices that the billing provider
+// has created for a subscription.
+func (a *App) GetSubscriptionInvoicesHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting subscription invoices")
+
+	response := a.getSubscriptionInvoices(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetSubscriptionInvoicesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getSubscriptionInvoices(ctx, &api.ByUUIDRequest{UUID: c.Param("uuid")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,348 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// BulkJobKindExpireCohort identifies bulk jobs created to expire cohorts.
+	BulkJobKindExpireCohort = "expire-cohort"
+
+	// DefaultCohortBatchSize is the number of users processed in each
+	// transaction when the caller doesn't specify a batch size.
+	DefaultCohortBatchSize = 100
+
+	// MaxCohortBatchSize is the largest batch size that callers may request.
+	MaxCohortBatchSize = 1000
+)
+
+// cohortBatchSize returns the batch size to use for a cohort request.
+func cohortBatchSize(requested int) int {
+	switch {
+	case requested <= 0:
+		return DefaultCohortBatchSize
+	case requested > MaxCohortBatchSize:
+		return MaxCohortBatchSize
+	default:
+		return requested
+	}
+}
+
+// cohortUsernames normalizes the usernames in a cohort request, removing blank
+// entries and duplicates.
+func (a *App) cohortUsernames(usernames []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(usernames))
+	for _, username := range usernames {
+		fixed, err := a.FixUsername(strings.TrimSpace(username))
+		if err != nil {
+			return nil, err
+		}
+		if fixed == "" || seen[fixed] {
+			continue
+		}
+		seen[fixed] = true
+		result = append(result, fixed)
+	}
+	return result, nil
+}
+
+func (a *App) expireCohort(ctx context.Context, request *api.ExpireCohortRequest) *api.BulkJobResponse {
+	response := &api.BulkJobResponse{}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	// Validate the incoming request.
+	if !request.EndSubscriptions && !request.RemoveAddons {
+		response.Error = serrors.NatsError(ctx, serrors.ErrNoCohortAction)
+		return response
+	}
+	usernames, err := a.cohortUsernames(request.Usernames)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if len(usernames) == 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrEmptyCohort)
+		return response
+	}
+	if request.RequestedBy, err = a.FixUsername(request.RequestedBy); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Dry runs are quick enough to process before responding, since nothing
+	// has to wait for them to be applied.
+	if request.DryRun {
+		response.DryRun = true
+		response.Preview = a.previewCohortExpiration(ctx, d, usernames, request)
+		return response
+	}
+
+	// Record the job so that callers can track its progress.
+	jobID, err := d.AddBulkJob(ctx, BulkJobKindExpireCohort, len(usernames), request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	job, err := d.GetBulkJob(ctx, jobID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Process the cohort in the background. The request context is likely to be
+	// canceled before processing is complete, so it can't be used directly.
+	go a.runCohortExpiration(context.WithoutCancel(ctx), *job, usernames, request)
+
+	response.Job = job.ToAPIType()
+	return response
+}
+
+// runCohortExpiration processes the users in a cohort in batches, updating the
+// bulk job after each batch. A failed batch is rolled back and counted, but
+// doesn't prevent the remaining batches from being processed.
+func (a *App) runCohortExpiration(ctx context.Context, job db.BulkJob, usernames []string, request *api.ExpireCohortRequest) {
+	log := log.WithField("context", "expiring cohort").WithField("job", job.ID)
+	d := a.database(ctx)
+
+	job.Status = db.BulkJobStatusRunning
+	if err := d.UpdateBulkJob(ctx, &job); err != nil {
+		log.Error(err)
+	}
+
+	batchSize := cohortBatchSize(request.BatchSize)
+	for start := 0; start < len(usernames); start += batchSize {
+		end := min(start+batchSize, len(usernames))
+		batch := usernames[start:end]
+
+		expired, _, err := a.expireCohortBatch(ctx, d, batch, request)
+		if err != nil {
+			log.Errorf("unable to process users %d through %d: %s", start, end-1, err)
+			job.Failed += len(batch)
+			job.ErrorMessage = sql.NullString{String: err.Error(), Valid: true}
+		} else {
+			a.invalidateSubscriptions(ctx, batch...)
+			a.projectOverages(ctx, batch...)
+		}
+		for _, subscription := range expired {
+			a.notify(ctx, api.EventSubscriptionExpired, &api.SubscriptionEventData{
+				SubscriptionID: subscription.ID,
+				Username:       subscription.User.Username,
+				PlanName:       subscription.Plan.Name,
+			})
+		}
+		job.Processed += len(batch)
+
+		if err := d.UpdateBulkJob(ctx, &job); err != nil {
+			log.Error(err)
+		}
+	}
+
+	job.Status = db.BulkJobStatusCompleted
+	if job.Failed > 0 {
+		job.Status = db.BulkJobStatusFailed
+	}
+	if err := d.UpdateBulkJob(ctx, &job); err != nil {
+		log.Error(err)
+	}
+}
+
+// previewCohortExpiration processes the users in a cohort in batches inside of
+// transactions that are rolled back, and describes what expiring the cohort
+// would do.
+func (a *App) previewCohortExpiration(
+	ctx context.Context, d *db.Database, usernames []string, request *api.ExpireCohortRequest,
+) *api.CohortExpirationPreview {
+	log := log.WithField("context", "previewing cohort expiration")
+	preview := &api.CohortExpirationPreview{Users: len(usernames)}
+
+	batchSize := cohortBatchSize(request.BatchSize)
+	for start := 0; start < len(usernames); start += batchSize {
+		end := min(start+batchSize, len(usernames))
+
+		expired, removed, err := a.expireCohortBatch(ctx, d, usernames[start:end], request)
+		if err != nil {
+			log.Errorf("unable to process users %d through %d: %s", start, end-1, err)
+			preview.Failed += end - start
+			preview.ErrorMessage = err.Error()
+			continue
+		}
+		preview.EndedSubscriptions += len(expired)
+		preview.RemovedAddons += removed
+	}
+
+	return preview
+}
+
+// expireCohortBatch ends the subscriptions and removes the add-ons for a single
+// batch of users inside of a single transaction, which is rolled back in a dry
+// run. Returns the subscriptions that were ended, if any, and the number of
+// add-ons that were removed.
+func (a *App) expireCohortBatch(
+	ctx context.Context, d *db.Database, usernames []string, request *api.ExpireCohortRequest,
+) ([]db.Subscription, int, error) {
+	var (
+		expired []db.Subscription
+		removed int
+	)
+
+	err := d.InDryRunTx(ctx, request.DryRun, func(tx *goqu.TxDatabase) error {
+		expired, removed = nil, 0
+
+		subscriptions, err := d.ActiveSubscriptionsForUsers(ctx, usernames, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		for _, subscription := range subscriptions {
+			if request.RemoveAddons {
+				count, err := d.RemoveSubscriptionAddons(ctx, subscription.ID, db.WithTX(tx))
+				if err != nil {
+					return err
+				}
+				removed += count
+			}
+			if request.EndSubscriptions {
+				if err = d.EndSubscription(ctx, subscription.ID, request.RequestedBy, db.WithTX(tx)); err != nil {
+					return err
+				}
+				if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionExpired, &api.SubscriptionEventData{
+					SubscriptionID: subscription.ID,
+					Username:       subscription.User.Username,
+					PlanName:       subscription.Plan.Name,
+				}); err != nil {
+					return err
+				}
+				expired = append(expired, subscription)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return expired, removed, nil
+}
+
+// ExpireCohortHandler starts a bulk job that ends the subscriptions and/or
+// removes the add-ons of every user in a cohort.
+func (a *App) ExpireCohortHandler(subject, reply string, request *api.ExpireCohortRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "expiring cohort")
+
+	response := a.expireCohort(ctx, request)
+
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ExpireCohortHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ExpireCohortRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.expireCohort(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	if response.DryRun {
+		return c.JSON(http.StatusOK, response)
+	}
+	return c.JSON(http.StatusAccepted, response)
+}
+
+func (a *App) getBulkJob(ctx context.Context, request *api.BulkJobRequest) *api.BulkJobResponse {
+	response := &api.BulkJobResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.database(ctx)
+
+	job, err := d.GetBulkJob(ctx, request.ID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Job = job.ToAPIType()
+	return response
+}
+
+// GetBulkJobHandler returns the current status of a bulk job.
+func (a *App) GetBulkJobHandler(subject, reply string, request *api.BulkJobRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting bulk job")
+
+	response := a.getBulkJob(ctx, request)
+
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetBulkJobHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.BulkJobRequest{ID: c.Param("id")}
+	response := a.getBulkJob(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,291 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) depositCredits(ctx context.Context, request *api.DepositCreditsRequest) *api.DepositCreditsResponse {
+	response := &api.DepositCreditsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Amount <= 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidCreditAmount)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+	if !resourceType.Consumable {
+		response.Error = serrors.NatsError(ctx, serrors.ErrCreditsNotConsumable)
+		return response
+	}
+
+	var entry *db.CreditEntry
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		deposit := &db.CreditEntry{
+			ResourceType: *resourceType,
+			Amount:       request.Amount,
+			Description:  sql.NullString{String: request.Description, Valid: request.Description != ""},
+			CreatedBy:    requestedBy,
+		}
+		id, balance, err := d.DepositCredits(ctx, user.ID, deposit, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		response.Balance = balance
+
+		entry, err = d.GetCreditEntry(ctx, id, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	log.Infof("%s deposited %g %s credits for %s", requestedBy, request.Amount, resourceType.Name, username)
+
+	response.Entry = entry.ToAPIType()
+	return response
+}
+
+// DepositCreditsHandler adds credits for a consumable resource type to a
+// user's balance. Usage is drawn from the credits before it counts against
+// the user's quota.
+func (a *App) DepositCreditsHandler(subject, reply string, request *api.DepositCreditsRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "depositing credits")
+
+	response := a.depositCredits(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) DepositCreditsHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.DepositCreditsRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.depositCredits(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getCreditBalance(ctx context.Context, request *api.CreditsRequest) *api.CreditBalanceResponse {
+	response := &api.CreditBalanceResponse{Balances: make([]*api.CreditBalance, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	d := a.readDatabase(ctx)
+
+	balances, err := d.CreditBalances(ctx, username, request.ResourceName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, balance := range balances {
+		response.Balances = append(response.Balances, balance.ToAPIType())
+	}
+
+	return response
+}
+
+// GetCreditBalanceHandler returns a user's credit balances.
+func (a *App) GetCreditBalanceHandler(subject, reply string, request *api.CreditsRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting credit balance")
+
+	response := a.getCreditBalance(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetCreditBalanceHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.CreditsRequest{
+		Username:     c.Param("username"),
+		ResourceName: c.QueryParam("resource_name"),
+	}
+	response := a.getCreditBalance(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listCreditLedger(ctx context.Context, request *api.CreditsRequest) *api.CreditLedgerResponse {
+	response := &api.CreditLedgerResponse{Entries: make([]*api.CreditEntry, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	entries, err := d.ListCreditEntries(ctx, username, request.ResourceName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, entry.ToAPIType())
+	}
+
+	return response
+}
+
+// ListCreditLedgerHandler lists the deposits and draws in a user's credit
+// ledger, most recent first.
+func (a *App) ListCreditLedgerHandler(subject, reply string, request *api.CreditsRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing credit ledger")
+
+	response := a.listCreditLedger(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListCreditLedgerHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.CreditsRequest{
+		Username:     c.Param("username"),
+		ResourceName: c.QueryParam("resource_name"),
+	}
+	response := a.listCreditLedger(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
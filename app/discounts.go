@@ -0,0 +1,315 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// The names of the message headers (and HTTP headers) used to redeem a discount
+// code when a subscription is created or renewed, and to return the discounted
+// rate. The QMS messages don't have fields for discounts, so they're passed in
+// the headers instead.
+const (
+	DiscountCodeHeader   = "x-qms-discount-code"
+	DiscountedRateHeader = "x-qms-discounted-rate"
+)
+
+// normalizeDiscountCode trims the whitespace from a discount code and converts
+// it to upper case, so that codes aren't case sensitive.
+func normalizeDiscountCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// formatRate formats a rate for a message header.
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', 2, 64)
+}
+
+func (a *App) addDiscountCode(ctx context.Context, request *api.AddDiscountCodeRequest) *api.DiscountCodeResponse {
+	response := &api.DiscountCodeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	createdBy, err := a.FixUsername(request.CreatedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if createdBy == "" {
+		createdBy = "de"
+	}
+
+	code := &db.DiscountCode{
+		Code:         normalizeDiscountCode(request.Code),
+		Description:  sql.NullString{String: request.Description, Valid: request.Description != ""},
+		DiscountType: request.DiscountType,
+		Amount:       request.Amount,
+		CreatedBy:    createdBy,
+	}
+	if request.ExpiresAt != nil {
+		code.ExpiresAt = sql.NullTime{Time: *request.ExpiresAt, Valid: true}
+	}
+	if request.MaxRedemptions < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidDiscount)
+		return response
+	}
+	if request.MaxRedemptions > 0 {
+		code.MaxRedemptions = sql.NullInt32{Int32: request.MaxRedemptions, Valid: true}
+	}
+	if code.Code == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidDiscountCode)
+		return response
+	}
+	if err = code.Validate(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if _, err = d.AddDiscountCode(ctx, code); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	added, err := d.GetDiscountCode(ctx, code.Code)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if added == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrDiscountCodeNotFound)
+		return response
+	}
+
+	response.DiscountCode = added.ToAPIType()
+	return response
+}
+
+func (a *App) getDiscountCode(ctx context.Context, request *api.GetDiscountCodeRequest) *api.DiscountCodeResponse {
+	response := &api.DiscountCodeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	code, err := d.GetDiscountCode(ctx, normalizeDiscountCode(request.Code), db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if code == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrDiscountCodeNotFound)
+		return response
+	}
+
+	response.DiscountCode = code.ToAPIType()
+	return response
+}
+
+func (a *App) listDiscountCodes(ctx context.Context) *api.DiscountCodeListResponse {
+	response := &api.DiscountCodeListResponse{DiscountCodes: make([]*api.DiscountCode, 0)}
+	d := a.readDatabase(ctx)
+
+	codes, err := d.ListDiscountCodes(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, code := range codes {
+		response.DiscountCodes = append(response.DiscountCodes, code.ToAPIType())
+	}
+	return response
+}
+
+func (a *App) getSubscriptionDiscount(ctx context.Context, request *api.ByUUIDRequest) *api.SubscriptionDiscountResponse {
+	response := &api.SubscriptionDiscountResponse{SubscriptionID: request.UUID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	redemption, err := d.GetSubscriptionDiscount(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if redemption != nil {
+		response.Discount = redemption.ToAPIType()
+	}
+	return response
+}
+
+// AddDiscountCodeHandler adds a discount code that can be redeemed when a
+// subscription is created or renewed.
+func (a *App) AddDiscountCodeHandler(subject, reply string, request *api.AddDiscountCodeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding discount code")
+
+	response := a.addDiscountCode(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddDiscountCodeHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.AddDiscountCodeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.addDiscountCode(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetDiscountCodeHandler returns a discount code along with the number of
+// times that it has been redeemed.
+func (a *App) GetDiscountCodeHandler(subject, reply string, request *api.GetDiscountCodeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting discount code")
+
+	response := a.getDiscountCode(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetDiscountCodeHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getDiscountCode(ctx, &api.GetDiscountCodeRequest{Code: c.Param("code")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// ListDiscountCodesHandler lists all of the discount codes.
+func (a *App) ListDiscountCodesHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing discount codes")
+
+	response := a.listDiscountCodes(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListDiscountCodesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listDiscountCodes(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetSubscriptionDiscountHandler returns the discount applied to a
+// subscription, including the discounted rate that the subscription should be
+// billed at.
+func (a *App) GetSubscriptionDiscountHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting subscription discount")
+
+	response := a.getSubscriptionDiscount(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetSubscriptionDiscountHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getSubscriptionDiscount(ctx, &api.ByUUIDRequest{UUID: c.Param("uuid")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
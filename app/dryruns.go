@@ -0,0 +1,46 @@
+package app
+
+import (
+	"strconv"
+
+	"github.com/cyverse-de/p/go/header"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// DryRunHeader is the name of the message header used to request a dry run,
+// in which a change is validated and its results are computed inside of a
+// transaction that's always rolled back. The QMS messages don't have a field
+// for the flag, so it's passed in the header instead, and the header is set in
+// the response to confirm that nothing was changed. HTTP requests use the
+// dry_run query parameter.
+const DryRunHeader = "x-qms-dry-run"
+
+// parseDryRun returns the value of a dry_run flag. An empty value means that
+// the change should be applied.
+func parseDryRun(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, serrors.ErrInvalidDryRun
+	}
+	return dryRun, nil
+}
+
+// setDryRunHeader marks a response as the result of a dry run.
+func setDryRunHeader(h *header.Header, dryRun bool) {
+	if dryRun {
+		setHeaderValue(h, DryRunHeader, "true")
+	}
+}
+
+// setHTTPDryRunHeader copies the dry run marker from a response header to the
+// HTTP response headers.
+func setHTTPDryRunHeader(c echo.Context, h *header.Header) {
+	if value := headerValue(h, DryRunHeader); value != "" {
+		c.Response().Header().Set(DryRunHeader, value)
+	}
+}
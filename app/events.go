@@ -0,0 +1,33 @@
+package app
+
+import (
+	"context"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// EnableEventOutbox causes domain events to be added to the outbox table so that
+// they can be published to JetStream.
+func (a *App) EnableEventOutbox() {
+	a.outbox = true
+}
+
+// outboxOpts returns the query options that cause database functions that
+// support it to record domain events in the outbox.
+func (a *App) outboxOpts() []db.QueryOption {
+	if !a.outbox {
+		return nil
+	}
+	return []db.QueryOption{db.WithOutbox()}
+}
+
+// recordEvent adds a domain event to the outbox inside of the given transaction
+// if the outbox is enabled.
+func (a *App) recordEvent(ctx context.Context, d *db.Database, tx *goqu.TxDatabase, eventType string, data any) error {
+	if !a.outbox {
+		return nil
+	}
+	return d.AddOutboxEvent(ctx, api.NewEvent(eventType, data), db.WithTX(tx))
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/export"
+	"github.com/labstack/echo/v4"
+)
+
+// subscriptionExportColumns are the columns of a subscription export, which
+// has a row for each quota of each subscription.
+var subscriptionExportColumns = []export.Column{
+	{Name: "subscription_id", Type: export.String},
+	{Name: "username", Type: export.String},
+	{Name: "plan_name", Type: export.String},
+	{Name: "effective_start_date", Type: export.Timestamp},
+	{Name: "effective_end_date", Type: export.Timestamp},
+	{Name: "paid", Type: export.Bool},
+	{Name: "created_at", Type: export.Timestamp},
+	{Name: "resource_name", Type: export.String},
+	{Name: "resource_unit", Type: export.String},
+	{Name: "quota", Type: export.Double},
+	{Name: "usage", Type: export.Double},
+}
+
+// exportValues returns the values of a row of a subscription export.
+func exportValues(row *db.SubscriptionExportRow) []any {
+	nullString := func(s sql.NullString) any {
+		if !s.Valid {
+			return nil
+		}
+		return s.String
+	}
+	nullFloat := func(f sql.NullFloat64) any {
+		if !f.Valid {
+			return nil
+		}
+		return f.Float64
+	}
+	nullTime := func(t sql.NullTime) any {
+		if !t.Valid {
+			return nil
+		}
+		return t.Time
+	}
+
+	return []any{
+		row.SubscriptionID,
+		row.Username,
+		row.PlanName,
+		row.EffectiveStartDate,
+		nullTime(row.EffectiveEndDate),
+		row.Paid,
+		row.CreatedAt,
+		nullString(row.ResourceName),
+		nullString(row.ResourceUnit),
+		nullFloat(row.Quota),
+		nullFloat(row.Usage),
+	}
+}
+
+// exportFormat returns the requested export format, which defaults to CSV.
+// Returns ErrUnsupportedExportFormat if the format isn't supported.
+func exportFormat(format string) (string, error) {
+	if format == "" {
+		return export.FormatCSV, nil
+	}
+	if !export.ValidFormat(format) {
+		return "", serrors.ErrUnsupportedExportFormat
+	}
+	return format, nil
+}
+
+// exportSubscriptions writes every subscription along with its quotas and
+// usages to w in the given format, reading from the read replica if there is
+// one. Returns the number of rows written.
+func (a *App) exportSubscriptions(ctx context.Context, w io.Writer, format string) (int64, error) {
+	writer, err := export.NewWriter(format, w, subscriptionExportColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	d := a.readDatabase(ctx)
+	err = d.ExportSubscriptions(ctx, db.DefaultExportBatchSize, func(rows []db.SubscriptionExportRow) error {
+		for i := range rows {
+			if err := writer.Write(exportValues(&rows[i])); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	}, db.WithReadReplica())
+	if err != nil {
+		return count, err
+	}
+
+	return count, writer.Close()
+}
+
+// exportKey returns the object storage key for a subscription export.
+func exportKey(format string, generatedAt time.Time) string {
+	return fmt.Sprintf(
+		"exports/%s/subscriptions-%s.%s",
+		generatedAt.UTC().Format(time.DateOnly),
+		generatedAt.UTC().Format("20060102T150405Z"),
+		format,
+	)
+}
+
+func (a *App) storeSubscriptionExport(ctx context.Context, request *api.ExportRequest) *api.ExportResponse {
+	response := &api.ExportResponse{GeneratedAt: time.Now()}
+
+	format, err := exportFormat(request.Format)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if a.objectStore == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrObjectStorageDisabled)
+		return response
+	}
+
+	key := exportKey(format, response.GeneratedAt)
+
+	// The export is streamed to the store as it's written, so the store sees an
+	// error if the export fails part of the way through.
+	pr, pw := io.Pipe()
+	rows := make(chan int64, 1)
+	go func() {
+		count, err := a.exportSubscriptions(ctx, pw, format)
+		rows <- count
+		pw.CloseWithError(err) // nolint:errcheck
+	}()
+
+	if err = a.objectStore.Put(ctx, key, pr); err != nil {
+		pr.CloseWithError(err) // nolint:errcheck
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Key = key
+	response.Format = format
+	response.Rows = <-rows
+	return response
+}
+
+// ExportSubscriptionsHandler writes every subscription along with its quotas
+// and usages to object storage for offline analysis.
+func (a *App) ExportSubscriptionsHandler(subject, reply string, request *api.ExportRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "exporting subscriptions")
+
+	response := a.storeSubscriptionExport(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// ExportSubscriptionsHTTPHandler streams every subscription along with its
+// quotas and usages in the response body.
+func (a *App) ExportSubscriptionsHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ExportRequest
+	)
+
+	ctx := c.Request().Context()
+	log := log.WithField("context", "exporting subscriptions")
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	format, err := exportFormat(request.Format)
+	if err != nil {
+		return c.JSON(serrors.HTTPStatusCode(err), map[string]string{
+			"message": err.Error(),
+		})
+	}
+
+	filename := fmt.Sprintf("subscriptions-%s.%s", time.Now().UTC().Format(time.DateOnly), format)
+	c.Response().Header().Set(echo.HeaderContentType, export.ContentType(format))
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response().WriteHeader(http.StatusOK)
+
+	// The status has already been sent, so a failure part of the way through can
+	// only be logged. The truncated body won't parse as a complete export.
+	if _, err = a.exportSubscriptions(ctx, c.Response(), format); err != nil {
+		log.Errorf("unable to export the subscriptions: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// The names of the message headers (and HTTP headers) used to attach an
+// external identifier to a new subscription or subscription add-on. The QMS
+// request messages don't have fields for external identifiers, so they're
+// passed in the header instead.
+const (
+	ExternalSourceHeader = "x-qms-external-source"
+	ExternalIDHeader     = "x-qms-external-id"
+)
+
+// newExternalRef returns the external reference for a source and ID, or nil if
+// neither is set. An ID can't be used without a source.
+func newExternalRef(source, id string) (*db.ExternalRef, error) {
+	source = strings.TrimSpace(source)
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return nil, nil
+	}
+	if source == "" {
+		return nil, serrors.ErrInvalidExternalID
+	}
+	return &db.ExternalRef{Source: source, ID: id}, nil
+}
+
+// headerValue returns the first value of a NATS message header.
+func headerValue(h *header.Header, name string) string {
+	if h != nil {
+		if v, ok := h.Map[name]; ok && len(v.Value) > 0 {
+			return v.Value[0]
+		}
+	}
+	return ""
+}
+
+// setHeaderValue sets the value of a NATS message header.
+func setHeaderValue(h *header.Header, name, value string) {
+	if h == nil {
+		return
+	}
+	if h.Map == nil {
+		h.Map = make(map[string]*header.Header_Value)
+	}
+	h.Map[name] = &header.Header_Value{Value: []string{value}}
+}
+
+// externalRef extracts the external reference from a NATS message header.
+func externalRef(h *header.Header) (*db.ExternalRef, error) {
+	return newExternalRef(headerValue(h, ExternalSourceHeader), headerValue(h, ExternalIDHeader))
+}
+
+// httpExternalRef extracts the external reference from an HTTP request.
+func httpExternalRef(c echo.Context) (*db.ExternalRef, error) {
+	h := c.Request().Header
+	return newExternalRef(h.Get(ExternalSourceHeader), h.Get(ExternalIDHeader))
+}
+
+func (a *App) lookUpExternalID(
+	ctx context.Context,
+	request *api.ExternalIDRequest,
+	lookup func(context.Context, *db.ExternalRef, ...db.QueryOption) (string, error),
+) *api.ExternalIDResponse {
+	response := &api.ExternalIDResponse{Source: request.Source, ExternalID: request.ExternalID}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	ref, err := newExternalRef(request.Source, request.ExternalID)
+	if err == nil && ref == nil {
+		err = serrors.ErrExternalIDNotFound
+	}
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	id, err := lookup(ctx, ref, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if id == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrExternalIDNotFound)
+		return response
+	}
+
+	response.UUID = id
+	return response
+}
+
+func (a *App) getSubscriptionByExternalID(ctx context.Context, request *api.ExternalIDRequest) *api.ExternalIDResponse {
+	d := a.readDatabase(ctx)
+	return a.lookUpExternalID(ctx, request, d.SubscriptionIDForExternalRef)
+}
+
+func (a *App) getSubscriptionAddonByExternalID(ctx context.Context, request *api.ExternalIDRequest) *api.ExternalIDResponse {
+	d := a.readDatabase(ctx)
+	return a.lookUpExternalID(ctx, request, d.SubscriptionAddonIDForExternalRef)
+}
+
+// respondExternalID handles a NATS request to look up an external ID.
+func (a *App) respondExternalID(
+	subject, reply, description string,
+	request *api.ExternalIDRequest,
+	fn func(context.Context, *api.ExternalIDRequest) *api.ExternalIDResponse,
+) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", description)
+
+	response := fn(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// GetSubscriptionByExternalIDHandler returns the UUID of the subscription with
+// an external ID.
+func (a *App) GetSubscriptionByExternalIDHandler(subject, reply string, request *api.ExternalIDRequest) {
+	a.respondExternalID(subject, reply, "looking up subscription external ID", request, a.getSubscriptionByExternalID)
+}
+
+// GetSubscriptionAddonByExternalIDHandler returns the UUID of the subscription
+// add-on with an external ID.
+func (a *App) GetSubscriptionAddonByExternalIDHandler(subject, reply string, request *api.ExternalIDRequest) {
+	a.respondExternalID(subject, reply, "looking up subscription add-on external ID", request, a.getSubscriptionAddonByExternalID)
+}
+
+// externalIDHTTPHandler returns an HTTP handler that looks up an external ID.
+func externalIDHTTPHandler(fn func(context.Context, *api.ExternalIDRequest) *api.ExternalIDResponse) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+
+		request := &api.ExternalIDRequest{Source: c.Param("source"), ExternalID: c.Param("external_id")}
+		response := fn(ctx, request)
+
+		if response.Error != nil {
+			return c.JSON(int(response.Error.StatusCode), response)
+		}
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+func (a *App) GetSubscriptionByExternalIDHTTPHandler(c echo.Context) error {
+	return externalIDHTTPHandler(a.getSubscriptionByExternalID)(c)
+}
+
+func (a *App) GetSubscriptionAddonByExternalIDHTTPHandler(c echo.Context) error {
+	return externalIDHTTPHandler(a.getSubscriptionAddonByExternalID)(c)
+}
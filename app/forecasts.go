@@ -0,0 +1,275 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// ewmaSpan is the number of days that the exponentially weighted moving average
+// of the daily usage is weighted over.
+const ewmaSpan = 7
+
+const day = 24 * time.Hour
+
+// usagePoint is the usage of a resource at a point in time.
+type usagePoint struct {
+	at    time.Time
+	usage float64
+}
+
+// usageSeries replays the usage updates for a subscription to get the usage over
+// time, starting from zero at the start of the subscription and ending with the
+// current usage. The current usage is used as the last point even if it doesn't
+// match the replayed updates, since it's the authoritative value.
+func usageSeries(start, now time.Time, updates []db.Update, current float64) []usagePoint {
+	points := []usagePoint{{at: start, usage: 0}}
+
+	var usage float64
+	for _, update := range updates {
+		if update.EffectiveDate.After(now) {
+			break
+		}
+		switch update.UpdateOperation.Name {
+		case db.UpdateTypeSet:
+			usage = update.Value
+		case db.UpdateTypeAdd:
+			usage += update.Value
+		default:
+			continue
+		}
+		points = append(points, usagePoint{at: update.EffectiveDate, usage: usage})
+	}
+
+	return append(points, usagePoint{at: now, usage: current})
+}
+
+// linearRate returns the slope of the least squares line through the points in
+// units per day.
+func linearRate(points []usagePoint) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+
+	origin := points[0].at
+	n := float64(len(points))
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := p.at.Sub(origin).Hours() / 24
+		sumX += x
+		sumY += p.usage
+		sumXY += x * p.usage
+		sumXX += x * x
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0
+	}
+	return (n*sumXY - sumX*sumY) / denominator
+}
+
+// ewmaRate returns the exponentially weighted moving average of the usage on
+// each full day between the first and last points. Decreases in usage, such as
+// resets, don't count as negative usage. The linear rate is used if there isn't
+// a full day to average over yet.
+func ewmaRate(points []usagePoint) float64 {
+	if len(points) < 2 {
+		return 0
+	}
+
+	first := points[0].at.Truncate(day)
+	last := points[len(points)-1].at.Truncate(day)
+	days := int(last.Sub(first) / day)
+	if days < 1 {
+		return linearRate(points)
+	}
+
+	// Only full days are averaged, so the usage on the last day is left out.
+	daily := make([]float64, days)
+	for i := 1; i < len(points); i++ {
+		index := int(points[i].at.Truncate(day).Sub(first) / day)
+		if index >= days {
+			continue
+		}
+		daily[index] += math.Max(points[i].usage-points[i-1].usage, 0)
+	}
+
+	alpha := 2.0 / (ewmaSpan + 1)
+	rate := daily[0]
+	for _, amount := range daily[1:] {
+		rate = alpha*amount + (1-alpha)*rate
+	}
+	return rate
+}
+
+// forecastExhaustion fills in when the usage in the forecast will reach the
+// quota at the forecast's daily rate.
+func forecastExhaustion(forecast *api.UsageForecast, now time.Time) {
+	if forecast.Quota <= 0 {
+		return
+	}
+
+	if forecast.Usage >= forecast.Quota {
+		daysRemaining := 0.0
+		forecast.Exhausted = true
+		forecast.ExhaustionDate = &now
+		forecast.DaysRemaining = &daysRemaining
+		forecast.ExhaustedBeforeEnd = true
+		return
+	}
+
+	if forecast.DailyRate <= 0 {
+		return
+	}
+
+	daysRemaining := forecast.Remaining / forecast.DailyRate
+	exhaustionDate := now.Add(time.Duration(daysRemaining * float64(day)))
+	forecast.DaysRemaining = &daysRemaining
+	forecast.ExhaustionDate = &exhaustionDate
+	forecast.ExhaustedBeforeEnd = exhaustionDate.Before(forecast.SubscriptionEndDate)
+}
+
+func (a *App) forecastUsage(ctx context.Context, request *api.UsageForecastRequest) *api.UsageForecastResponse {
+	response := &api.UsageForecastResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	model := request.Model
+	if model == "" {
+		model = api.ForecastModelLinear
+	}
+	if model != api.ForecastModelLinear && model != api.ForecastModelEWMA {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidForecastModel)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	quota, _, err := d.GetCurrentQuota(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	usage, _, err := d.GetCurrentUsage(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	updates, err := d.UsageUpdates(
+		ctx, username, resourceType.ID, subscription.EffectiveStartDate, db.WithReadReplica(),
+	)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	now := time.Now()
+	points := usageSeries(subscription.EffectiveStartDate, now, updates, usage)
+
+	var rate float64
+	switch model {
+	case api.ForecastModelLinear:
+		rate = linearRate(points)
+	case api.ForecastModelEWMA:
+		rate = ewmaRate(points)
+	}
+
+	response.Forecast = &api.UsageForecast{
+		Username: username,
+		ResourceType: api.ResourceType{
+			ID:   resourceType.ID,
+			Name: resourceType.Name,
+			Unit: resourceType.Unit,
+		},
+		Model:               model,
+		Quota:               quota,
+		Usage:               usage,
+		Remaining:           math.Max(quota-usage, 0),
+		DailyRate:           math.Max(rate, 0),
+		DataPoints:          len(updates),
+		SubscriptionEndDate: subscription.EffectiveEndDate,
+	}
+	response.Forecast.Display = displayAmounts(
+		response.Forecast.ResourceType, quota, usage, response.Forecast.Remaining,
+	)
+	forecastExhaustion(response.Forecast, now)
+
+	return response
+}
+
+// ForecastUsageHandler projects when a user will run out of a resource at the
+// rate it has been used during the current subscription, so that users can be
+// warned before it happens.
+func (a *App) ForecastUsageHandler(subject, reply string, request *api.UsageForecastRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "usage forecast")
+
+	response := a.forecastUsage(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ForecastUsageHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.UsageForecastRequest{
+		Username:     c.Param("username"),
+		ResourceName: c.Param("resource_name"),
+		Model:        c.QueryParam("model"),
+	}
+
+	response := a.forecastUsage(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,62 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// SubscriptionStateHeader is the name of the response header that indicates
+// the state of the subscription that a response refers to: active, grace or
+// expired. The QMS response messages don't have a field for the subscription
+// state, so it's returned in the header instead.
+const SubscriptionStateHeader = "x-qms-subscription-state"
+
+// subscriptionOpts returns the query options used to look up a user's current
+// subscription, which include the grace period if one is configured, the
+// subscriptions of the user's groups if group subscriptions are enabled and the
+// default plan if one is configured.
+func (a *App) subscriptionOpts(opts ...db.QueryOption) []db.QueryOption {
+	if a.GracePeriod > 0 {
+		opts = append(opts, db.WithGracePeriod(a.GracePeriod))
+	}
+	if a.groups {
+		opts = append(opts, db.WithGroupSubscriptions())
+	}
+	if a.defaultPlan != "" {
+		opts = append(opts, db.WithDefaultPlan(a.defaultPlan))
+	}
+	return opts
+}
+
+// subscriptionState returns the current state of a subscription with the given
+// end date.
+func (a *App) subscriptionState(endDate time.Time) string {
+	subscription := &db.Subscription{EffectiveEndDate: endDate}
+	return subscription.StateAt(time.Now(), a.GracePeriod)
+}
+
+// currentSubscriptionState returns the state of the user's current
+// subscription, including subscriptions that are in their grace period. An
+// empty string is returned if the user doesn't have a current subscription.
+func (a *App) currentSubscriptionState(ctx context.Context, d *db.Database, username string) (string, error) {
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err == serrors.ErrSubscriptionNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return a.subscriptionState(subscription.EffectiveEndDate), nil
+}
+
+// setSubscriptionState records the subscription state in a response header.
+func setSubscriptionState(h *header.Header, state string) {
+	if state == "" {
+		return
+	}
+	setHeaderValue(h, SubscriptionStateHeader, state)
+}
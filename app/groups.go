@@ -0,0 +1,574 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// EnableGroupSubscriptions causes users who don't have a subscription of their
+// own to draw on the subscription of a group that they belong to. Group
+// subscriptions require the groups table.
+func (a *App) EnableGroupSubscriptions() {
+	a.groups = true
+}
+
+// groupMembers converts a list of group members to the type used in responses.
+func groupMembers(members []db.GroupMember) []*api.GroupMember {
+	result := make([]*api.GroupMember, len(members))
+	for i, member := range members {
+		result[i] = &api.GroupMember{
+			Username: member.Username,
+			AddedBy:  member.AddedBy,
+			AddedAt:  member.AddedAt,
+		}
+	}
+	return result
+}
+
+// lookUpGroup returns the named group, or ErrGroupNotFound if it doesn't exist.
+func lookUpGroup(ctx context.Context, d *db.Database, name string, opts ...db.QueryOption) (*db.Group, error) {
+	group, err := d.GetGroupByName(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, serrors.ErrGroupNotFound
+	}
+	return group, nil
+}
+
+func (a *App) addGroup(ctx context.Context, request *api.AddGroupRequest) *api.GroupResponse {
+	response := &api.GroupResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Name == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidGroupName)
+		return response
+	}
+
+	createdBy, err := a.FixUsername(request.CreatedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if createdBy == "" {
+		createdBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	group := &db.Group{
+		Name:        request.Name,
+		Description: sql.NullString{String: request.Description, Valid: request.Description != ""},
+		CreatedBy:   createdBy,
+	}
+	if _, err = d.AddGroup(ctx, group, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if group, err = lookUpGroup(ctx, d, request.Name, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Group = group.ToAPIType()
+	response.Members = []*api.GroupMember{}
+	return response
+}
+
+func (a *App) getGroup(ctx context.Context, request *api.GetGroupRequest) *api.GroupResponse {
+	response := &api.GroupResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	group, err := lookUpGroup(ctx, d, request.Name, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	members, err := d.ListGroupMembers(ctx, group.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Group = group.ToAPIType()
+	response.Members = groupMembers(members)
+	return response
+}
+
+func (a *App) addGroupMember(ctx context.Context, request *api.GroupMemberRequest) *api.GroupResponse {
+	response := &api.GroupResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	addedBy, err := a.FixUsername(request.AddedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if addedBy == "" {
+		addedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	group, err := lookUpGroup(ctx, d, request.Name, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = d.AddGroupMember(ctx, group.ID, user.ID, addedBy, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	members, err := d.ListGroupMembers(ctx, group.ID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// The user's current subscription may now be the group's.
+	a.invalidateSubscriptions(ctx, username)
+
+	response.Group = group.ToAPIType()
+	response.Members = groupMembers(members)
+	return response
+}
+
+func (a *App) removeGroupMember(ctx context.Context, request *api.GroupMemberRequest) *api.GroupResponse {
+	response := &api.GroupResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	group, err := lookUpGroup(ctx, d, request.Name, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	removed, err := d.RemoveGroupMember(ctx, group.ID, username, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !removed {
+		response.Error = serrors.NatsError(ctx, serrors.ErrUserNotFound)
+		return response
+	}
+
+	members, err := d.ListGroupMembers(ctx, group.ID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	a.invalidateSubscriptions(ctx, username)
+
+	response.Group = group.ToAPIType()
+	response.Members = groupMembers(members)
+	return response
+}
+
+func (a *App) subscribeGroup(ctx context.Context, request *api.GroupSubscriptionRequest) *api.GroupSubscriptionResponse {
+	response := &api.GroupSubscriptionResponse{Name: request.Name}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	opts, err := utils.OptsForValues(request.Paid, request.Periods, request.EndDate)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	group, err := lookUpGroup(ctx, d, request.Name, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	subscriptionID, err := d.SetActiveSubscription(ctx, group.User.ID, plan, opts, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	members, err := d.ListGroupMembers(ctx, group.ID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	log.WithFields(logrus.Fields{
+		"group":   group.Name,
+		"plan":    plan.Name,
+		"paid":    opts.Paid,
+		"periods": opts.Periods,
+	}).Info("subscribed a group to a plan")
+
+	// Members without subscriptions of their own may have cached the group's
+	// previous subscription.
+	usernames := make([]string, len(members))
+	for i, member := range members {
+		usernames[i] = member.Username
+	}
+	a.invalidateSubscriptions(ctx, usernames...)
+
+	response.SubscriptionID = subscriptionID
+	response.PlanName = plan.Name
+	return response
+}
+
+// AddGroupHandler adds a group whose members share the quotas of the group's
+// subscription.
+func (a *App) AddGroupHandler(subject, reply string, request *api.AddGroupRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding group")
+
+	response := a.addGroup(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddGroupHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.AddGroupRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.addGroup(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetGroupHandler returns a group along with its members.
+func (a *App) GetGroupHandler(subject, reply string, request *api.GetGroupRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting group")
+
+	response := a.getGroup(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetGroupHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getGroup(ctx, &api.GetGroupRequest{Name: c.Param("name")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// AddGroupMemberHandler adds a user to a group.
+func (a *App) AddGroupMemberHandler(subject, reply string, request *api.GroupMemberRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding group member")
+
+	response := a.addGroupMember(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddGroupMemberHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.GroupMemberRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Name = c.Param("name")
+	request.Username = c.Param("username")
+
+	response := a.addGroupMember(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// RemoveGroupMemberHandler removes a user from a group.
+func (a *App) RemoveGroupMemberHandler(subject, reply string, request *api.GroupMemberRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "removing group member")
+
+	response := a.removeGroupMember(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) RemoveGroupMemberHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.removeGroupMember(ctx, &api.GroupMemberRequest{
+		Name:     c.Param("name"),
+		Username: c.Param("username"),
+	})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// SubscribeGroupHandler subscribes a group to a plan. The group's members who
+// don't have subscriptions of their own share the subscription's quotas.
+func (a *App) SubscribeGroupHandler(subject, reply string, request *api.GroupSubscriptionRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "subscribing group")
+
+	response := a.subscribeGroup(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SubscribeGroupHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.GroupSubscriptionRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Name = c.Param("name")
+
+	response := a.subscribeGroup(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,241 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/service"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	qmssubs "github.com/cyverse-de/go-mod/subjects/qms"
+)
+
+// GRPCServiceName is the fully qualified name of the gRPC service. The service
+// uses the message types in the qms protocol buffer package, so it's named as
+// though it were declared in that package.
+const GRPCServiceName = "qms.QMS"
+
+// grpcMetadataPrefix is the prefix of the gRPC metadata keys that are copied to
+// and from the message headers, such as x-qms-caller-role and x-qms-dry-run.
+const grpcMetadataPrefix = "x-qms-"
+
+var grpcTracer = otel.Tracer("github.com/cyverse-de/subscriptions/app/grpc")
+
+// grpcRequest is implemented by every request message served over gRPC.
+type grpcRequest interface {
+	proto.Message
+	GetHeader() *header.Header
+}
+
+// grpcResponse is implemented by every response message served over gRPC.
+type grpcResponse interface {
+	proto.Message
+	GetHeader() *header.Header
+	GetError() *svcerror.ServiceError
+}
+
+// grpcHandler is the type that the gRPC service is registered with.
+type grpcHandler interface {
+	Service() service.QMS
+	serveGRPC(
+		ctx context.Context, subject string, request grpcRequest, call func(context.Context) (grpcResponse, error),
+	) (any, error)
+}
+
+// NewGRPCServer returns a gRPC server that serves the protocol buffer API. Each
+// RPC has the same time budget and concurrency limit as the NATS subject that
+// serves the same operation.
+func (a *App) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: GRPCServiceName,
+		HandlerType: (*grpcHandler)(nil),
+		Methods: []grpc.MethodDesc{
+			grpcMethod("GetUserUpdates", qmssubs.GetUserUpdates, service.QMS.GetUserUpdates),
+			grpcMethod("AddUserUpdate", qmssubs.AddUserUpdate, service.QMS.AddUserUpdate),
+			grpcMethod("GetUsages", qmssubs.GetUserUsages, service.QMS.GetUsages),
+			grpcMethod("AddUsage", qmssubs.AddUserUsages, service.QMS.AddUsage),
+			grpcMethod("GetUserOverages", qmssubs.GetUserOverages, service.QMS.GetUserOverages),
+			grpcMethod("CheckUserOverages", qmssubs.CheckUserOverages, service.QMS.CheckUserOverages),
+			grpcMethod("GetUserSummary", qmssubs.UserSummary, service.QMS.GetUserSummary),
+			grpcMethod("AddUser", qmssubs.AddUser, service.QMS.AddUser),
+			grpcMethod("AddQuota", qmssubs.AddQuota, service.QMS.AddQuota),
+			grpcMethod("ListPlans", qmssubs.ListPlans, service.QMS.ListPlans),
+			grpcMethod("AddPlan", qmssubs.AddPlan, service.QMS.AddPlan),
+			grpcMethod("GetPlan", qmssubs.GetPlan, service.QMS.GetPlan),
+			grpcMethod("UpsertQuotaDefaults", qmssubs.UpsertQuotaDefaults, service.QMS.UpsertQuotaDefaults),
+			grpcMethod("AddAddon", qmssubs.AddAddon, service.QMS.AddAddon),
+			grpcMethod("ListAddons", qmssubs.ListAddons, service.QMS.ListAddons),
+			grpcMethod("UpdateAddon", qmssubs.UpdateAddon, service.QMS.UpdateAddon),
+			grpcMethod("DeleteAddon", qmssubs.DeleteAddon, service.QMS.DeleteAddon),
+			grpcMethod("ListSubscriptionAddons", qmssubs.ListSubscriptionAddons, service.QMS.ListSubscriptionAddons),
+			grpcMethod("AddSubscriptionAddon", qmssubs.AddSubscriptionAddon, service.QMS.AddSubscriptionAddon),
+			grpcMethod("DeleteSubscriptionAddon", qmssubs.DeleteSubscriptionAddon, service.QMS.DeleteSubscriptionAddon),
+			grpcMethod("UpdateSubscriptionAddon", qmssubs.UpdateSubscriptionAddon, service.QMS.UpdateSubscriptionAddon),
+			grpcMethod("GetSubscriptionAddon", qmssubs.GetSubscriptionAddon, service.QMS.GetSubscriptionAddon),
+		},
+	}, a)
+	return server
+}
+
+// grpcMethod describes a unary RPC that calls a method of the service layer.
+// The subject is the NATS subject that serves the same operation, which the
+// time budget and concurrency limit are looked up by.
+func grpcMethod[Req grpcRequest, Resp grpcResponse](
+	name, subject string, call func(service.QMS, context.Context, Req) (Resp, error),
+) grpc.MethodDesc {
+	fullMethod := "/" + GRPCServiceName + "/" + name
+
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			var request Req
+			request = request.ProtoReflect().Type().New().Interface().(Req)
+			if err := dec(request); err != nil {
+				return nil, err
+			}
+
+			handler := func(ctx context.Context, req any) (any, error) {
+				h := srv.(grpcHandler)
+				return h.serveGRPC(ctx, subject, req.(Req), func(ctx context.Context) (grpcResponse, error) {
+					return call(h.Service(), ctx, req.(Req))
+				})
+			}
+			if interceptor == nil {
+				return handler(ctx, request)
+			}
+			return interceptor(ctx, request, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+		},
+	}
+}
+
+// serveGRPC handles a single RPC. The x-qms-* metadata sent by the caller is
+// copied to the request header so that the options that are passed in message
+// headers over NATS work the same way over gRPC, and the x-qms-* values set in
+// the response header are sent back as response metadata. Service errors are
+// returned as gRPC status errors with the original error attached as a detail.
+func (a *App) serveGRPC(
+	ctx context.Context, subject string, request grpcRequest, call func(context.Context) (grpcResponse, error),
+) (any, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, grpcMetadataCarrier(md))
+
+	ctx, span := grpcTracer.Start(ctx, subject, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	h := grpcRequestHeader(request)
+	for key, values := range md {
+		if strings.HasPrefix(key, grpcMetadataPrefix) && len(values) > 0 {
+			setHeaderValue(h, key, values[0])
+		}
+	}
+
+	response, err := call(ctx)
+
+	if rh := response.GetHeader(); rh != nil {
+		out := metadata.MD{}
+		for key, value := range rh.Map {
+			if strings.HasPrefix(key, grpcMetadataPrefix) && value != nil {
+				out.Append(key, value.Value...)
+			}
+		}
+		if len(out) > 0 {
+			if err := grpc.SetHeader(ctx, out); err != nil {
+				log.WithField("context", "grpc").Error(err)
+			}
+		}
+	}
+
+	var serviceErr *service.Error
+	if errors.As(err, &serviceErr) {
+		log.WithField("context", "grpc").Error(serviceErr)
+		st := status.New(grpcCode(serviceErr.StatusCode), serviceErr.Message)
+		if detailed, detailErr := st.WithDetails(serviceErr.ServiceError); detailErr == nil {
+			st = detailed
+		}
+		return nil, st.Err()
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return response, nil
+}
+
+// grpcRequestHeader returns the header of a request message, adding an empty
+// header to the message if it doesn't have one.
+func grpcRequestHeader(request grpcRequest) *header.Header {
+	if h := request.GetHeader(); h != nil {
+		return h
+	}
+
+	m := request.ProtoReflect()
+	if fd := m.Descriptor().Fields().ByName("header"); fd != nil {
+		m.Set(fd, protoreflect.ValueOfMessage((&header.Header{}).ProtoReflect()))
+	}
+	return request.GetHeader()
+}
+
+// grpcCode converts the HTTP status code of a service error to a gRPC status
+// code.
+func grpcCode(statusCode int32) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	default:
+		return codes.Internal
+	}
+}
+
+// grpcMetadataCarrier adapts incoming gRPC metadata for trace context
+// propagation.
+type grpcMetadataCarrier metadata.MD
+
+func (c grpcMetadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c grpcMetadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c grpcMetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
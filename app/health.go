@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/labstack/echo/v4"
+)
+
+// healthCheckTimeout limits how long each readiness check can take.
+const healthCheckTimeout = 2 * time.Second
+
+// healthServiceName is the service name included in health check responses.
+const healthServiceName = "subscriptions"
+
+// newAdminRouter returns the router for the admin port, which serves the health
+// checks used by Kubernetes probes and dashboards.
+func (a *App) newAdminRouter() *echo.Echo {
+	router := echo.New()
+	router.HideBanner = true
+	router.GET("/healthz", a.HealthzHTTPHandler)
+	router.GET("/livez", a.LivezHTTPHandler)
+	router.GET("/readyz", a.ReadyzHTTPHandler)
+	return router
+}
+
+// readiness checks the connections to the databases and to NATS.
+func (a *App) readiness(ctx context.Context) *api.HealthResponse {
+	response := &api.HealthResponse{
+		Service: healthServiceName,
+		Status:  api.HealthOK,
+		Checks:  make(map[string]string),
+	}
+
+	check := func(name string, fn func(context.Context) error) {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+
+		if err := fn(ctx); err != nil {
+			response.Checks[name] = err.Error()
+			response.Status = api.HealthUnavailable
+			return
+		}
+		response.Checks[name] = api.HealthOK
+	}
+
+	check("database", a.db.PingContext)
+	if a.replicaDB != nil {
+		check("replica", a.replicaDB.PingContext)
+	}
+	check("nats", func(context.Context) error {
+		if a.client == nil || !a.client.Connected() {
+			return errors.New("not connected to NATS")
+		}
+		return nil
+	})
+
+	return response
+}
+
+// HealthzHTTPHandler reports that the process is up.
+func (a *App) HealthzHTTPHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &api.HealthResponse{Service: healthServiceName, Status: api.HealthOK})
+}
+
+// LivezHTTPHandler reports that the process is able to handle HTTP requests.
+// It doesn't check any dependencies, so a database outage doesn't cause the
+// service to be restarted.
+func (a *App) LivezHTTPHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &api.HealthResponse{Service: healthServiceName, Status: api.HealthOK})
+}
+
+// ReadyzHTTPHandler reports whether the service can reach the database and
+// NATS. It responds with a 503 status code if it can't.
+func (a *App) ReadyzHTTPHandler(c echo.Context) error {
+	response := a.readiness(c.Request().Context())
+	if response.Status != api.HealthOK {
+		return c.JSON(http.StatusServiceUnavailable, response)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// PingHandler responds with the results of the readiness checks, which lets
+// callers verify that the service is handling NATS requests and can reach its
+// dependencies.
+func (a *App) PingHandler(subject, reply string, request *api.PingRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "ping")
+
+	response := a.readiness(ctx)
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
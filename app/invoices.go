@@ -0,0 +1,361 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// invoicePeriod returns the part of the requested period that overlaps the
+// subscription. The period defaults to the whole subscription, so invoices for
+// perpetual subscriptions, which never end, need an explicit end. The times are
+// truncated to the precision of the database so that invoices for the same
+// period can be found again.
+func invoicePeriod(subscription *db.Subscription, start, end *time.Time) (time.Time, time.Time, error) {
+	periodStart, periodEnd := subscription.EffectiveStartDate, subscription.EffectiveEndDate
+	if start != nil && start.After(periodStart) {
+		periodStart = *start
+	}
+	if end != nil && (subscription.Perpetual() || end.Before(periodEnd)) {
+		periodEnd = *end
+	}
+
+	periodStart = periodStart.UTC().Truncate(time.Microsecond)
+	periodEnd = periodEnd.UTC().Truncate(time.Microsecond)
+	if !periodEnd.After(periodStart) {
+		return time.Time{}, time.Time{}, serrors.ErrInvalidInvoicePeriod
+	}
+
+	return periodStart, periodEnd, nil
+}
+
+// buildInvoice returns an invoice for the period of the subscription. Each rate
+// is prorated by the portion of the subscription that the period covers, in
+// the same way as plan changes are. Only the plan and add-ons that are paid for
+// are charged, and the discount only applies to the plan.
+func buildInvoice(
+	subscription *db.Subscription,
+	subAddons []db.SubscriptionAddon,
+	discount *db.DiscountRedemption,
+	periodStart, periodEnd time.Time,
+) *db.Invoice {
+	fraction := 1.0
+	length := subscription.EffectiveEndDate.Sub(subscription.EffectiveStartDate)
+	if length > 0 {
+		fraction = math.Max(0, math.Min(1, float64(periodEnd.Sub(periodStart))/float64(length)))
+	}
+
+	invoice := &db.Invoice{
+		SubscriptionID:    subscription.ID,
+		Username:          subscription.User.Username,
+		PlanName:          subscription.Plan.Name,
+		PeriodStart:       periodStart,
+		PeriodEnd:         periodEnd,
+		ProrationFraction: fraction,
+	}
+
+	if subscription.Paid {
+		invoice.LineItems = append(invoice.LineItems, db.InvoiceLineItem{
+			ItemType:    db.InvoiceItemPlan,
+			Description: fmt.Sprintf("%s plan", subscription.Plan.Name),
+			Quantity:    1,
+			UnitRate:    subscription.Rate.Rate,
+			Amount:      roundCurrency(subscription.Rate.Rate * fraction),
+		})
+	}
+
+	for _, subAddon := range subAddons {
+		if !subAddon.Paid {
+			continue
+		}
+		invoice.LineItems = append(invoice.LineItems, db.InvoiceLineItem{
+			ItemType: db.InvoiceItemAddon,
+			Description: fmt.Sprintf(
+				"%s add-on (%g %s)", subAddon.Addon.Name, subAddon.Amount, subAddon.Addon.ResourceType.Unit,
+			),
+			SubscriptionAddonID: sql.NullString{String: subAddon.ID, Valid: true},
+			Quantity:            float64(subAddon.Quantity),
+			UnitRate:            subAddon.Rate.Rate,
+			Amount:              roundCurrency(subAddon.Rate.Rate * float64(subAddon.Quantity) * fraction),
+		})
+	}
+
+	for _, item := range invoice.LineItems {
+		invoice.Subtotal += item.Amount
+	}
+	invoice.Subtotal = roundCurrency(invoice.Subtotal)
+
+	if subscription.Paid && discount != nil && discount.DiscountedRate < discount.OriginalRate {
+		reduction := discount.DiscountedRate - discount.OriginalRate
+		item := db.InvoiceLineItem{
+			ItemType:    db.InvoiceItemDiscount,
+			Description: fmt.Sprintf("Discount code %s", discount.Code),
+			Quantity:    1,
+			UnitRate:    reduction,
+			Amount:      roundCurrency(reduction * fraction),
+		}
+		invoice.LineItems = append(invoice.LineItems, item)
+		invoice.DiscountTotal = -item.Amount
+	}
+
+	invoice.Total = roundCurrency(math.Max(0, invoice.Subtotal-invoice.DiscountTotal))
+
+	return invoice
+}
+
+func (a *App) generateInvoice(ctx context.Context, request *api.GenerateInvoiceRequest) *api.InvoiceResponse {
+	response := &api.InvoiceResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	var invoice *db.Invoice
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		subscription, err := d.GetSubscriptionByID(ctx, request.SubscriptionID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if subscription == nil {
+			return serrors.ErrSubscriptionNotFound
+		}
+
+		periodStart, periodEnd, err := invoicePeriod(subscription, request.PeriodStart, request.PeriodEnd)
+		if err != nil {
+			return err
+		}
+
+		// Invoices are never regenerated, so that they don't change if the
+		// rates do.
+		invoice, err = d.GetInvoiceForPeriod(ctx, subscription.ID, periodStart, periodEnd, db.WithTX(tx))
+		if err != nil || invoice != nil {
+			return err
+		}
+
+		subAddons, err := d.ListSubscriptionAddons(ctx, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		discount, err := d.GetSubscriptionDiscount(ctx, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		generated := buildInvoice(subscription, subAddons, discount, periodStart, periodEnd)
+		generated.CreatedBy = requestedBy
+
+		invoiceID, err := d.AddInvoice(ctx, generated, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		invoice, err = d.GetInvoice(ctx, invoiceID, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Invoice = invoice.ToAPIType()
+	return response
+}
+
+// GenerateInvoiceHandler generates an invoice for a subscription period, or
+// returns the invoice that was already generated for the period.
+func (a *App) GenerateInvoiceHandler(subject, reply string, request *api.GenerateInvoiceRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "generating invoice")
+
+	response := a.generateInvoice(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GenerateInvoiceHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.GenerateInvoiceRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.SubscriptionID = c.Param("uuid")
+
+	response := a.generateInvoice(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getInvoice(ctx context.Context, request *api.ByUUIDRequest) *api.InvoiceResponse {
+	response := &api.InvoiceResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	invoice, err := d.GetInvoice(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if invoice == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvoiceNotFound)
+		return response
+	}
+
+	response.Invoice = invoice.ToAPIType()
+	return response
+}
+
+// GetInvoiceHandler returns a generated invoice along with its line items.
+func (a *App) GetInvoiceHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting invoice")
+
+	response := a.getInvoice(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetInvoiceHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getInvoice(ctx, &api.ByUUIDRequest{UUID: c.Param("id")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listInvoices(ctx context.Context, request *api.ByUUIDRequest) *api.InvoiceListResponse {
+	response := &api.InvoiceListResponse{
+		SubscriptionID: request.UUID,
+		Invoices:       make([]*api.Invoice, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	subscription, err := d.GetSubscriptionByID(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if subscription == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrSubscriptionNotFound)
+		return response
+	}
+
+	invoices, err := d.ListInvoices(ctx, request.UUID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, invoice := range invoices {
+		response.Invoices = append(response.Invoices, invoice.ToAPIType())
+	}
+	return response
+}
+
+// ListInvoicesHandler lists the invoices generated for a subscription.
+func (a *App) ListInvoicesHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing invoices")
+
+	response := a.listInvoices(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListInvoicesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listInvoices(ctx, &api.ByUUIDRequest{UUID: c.Param("uuid")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
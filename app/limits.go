@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	qmssubs "github.com/cyverse-de/go-mod/subjects/qms"
+)
+
+// The default limits on the number of NATS requests handled at once.
+const (
+	DefaultConcurrency = 8
+	DefaultMaxQueued   = 100
+	DefaultQueueWait   = time.Second
+)
+
+// ConcurrencySettings limits the number of NATS requests for each subject that
+// are handled at once, so that a flood of requests for one subject can't use up
+// every database connection. Requests that arrive while a subject is at its
+// limit wait in a queue for a slot to become available. Requests that can't get
+// a slot in time, or that arrive while the queue is full, are rejected with an
+// error telling the caller to retry later rather than being left to time out.
+type ConcurrencySettings struct {
+	// Default is the limit for subjects that aren't listed in Subjects.
+	Default int
+
+	// Subjects maps base subjects to their limits.
+	Subjects map[string]int
+
+	// MaxQueued is the number of requests for each subject that can wait for a
+	// slot. Requests that arrive while the queue is full are rejected at once.
+	MaxQueued int
+
+	// Wait is how long a request can wait for a slot.
+	Wait time.Duration
+}
+
+// DefaultConcurrencySettings returns the limits used when none are configured.
+// Usage updates arrive in bursts and each one needs a transaction, so they get
+// a smaller share of the database connections than the other subjects.
+func DefaultConcurrencySettings() ConcurrencySettings {
+	return ConcurrencySettings{
+		Default:   DefaultConcurrency,
+		MaxQueued: DefaultMaxQueued,
+		Wait:      DefaultQueueWait,
+		Subjects: map[string]int{
+			qmssubs.AddUserUsages: 4,
+		},
+	}
+}
+
+// limitFor returns the concurrency limit for the base subject.
+func (s *ConcurrencySettings) limitFor(subject string) int {
+	if limit, ok := s.Subjects[subject]; ok && limit > 0 {
+		return limit
+	}
+	if s.Default > 0 {
+		return s.Default
+	}
+	return DefaultConcurrency
+}
+
+// The metrics describing the requests waiting for and rejected by the limiter.
+var (
+	queuedCounter   metric.Int64UpDownCounter
+	rejectedCounter metric.Int64Counter
+)
+
+func init() {
+	var err error
+	meter := otel.Meter("github.com/cyverse-de/subscriptions/app")
+
+	queuedCounter, err = meter.Int64UpDownCounter(
+		"qms.requests.queued",
+		metric.WithDescription("The number of NATS requests waiting for a slot to be handled in."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the queued request counter: %s", err)
+	}
+
+	rejectedCounter, err = meter.Int64Counter(
+		"qms.requests.rejected",
+		metric.WithDescription("The number of NATS requests rejected because their subject was too busy."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the rejected request counter: %s", err)
+	}
+}
+
+// subjectLimiter hands out the slots for a single subject.
+type subjectLimiter struct {
+	slots  chan struct{}
+	queued int
+}
+
+// limiter keeps track of the slots for every subject.
+type limiter struct {
+	mu       sync.Mutex
+	settings ConcurrencySettings
+	subjects map[string]*subjectLimiter
+}
+
+func newLimiter(settings ConcurrencySettings) *limiter {
+	return &limiter{settings: settings, subjects: make(map[string]*subjectLimiter)}
+}
+
+// enqueue returns the limiter for the subject and reserves a place in its
+// queue. It returns nil if the queue is full.
+func (l *limiter) enqueue(subject string) *subjectLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sl, ok := l.subjects[subject]
+	if !ok {
+		sl = &subjectLimiter{slots: make(chan struct{}, l.settings.limitFor(subject))}
+		l.subjects[subject] = sl
+	}
+
+	maxQueued := l.settings.MaxQueued
+	if maxQueued <= 0 {
+		maxQueued = DefaultMaxQueued
+	}
+	if sl.queued >= maxQueued {
+		return nil
+	}
+	sl.queued++
+	return sl
+}
+
+func (l *limiter) dequeue(sl *subjectLimiter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sl.queued--
+}
+
+// acquire waits for a slot for the base subject. The returned function releases
+// the slot. ErrServiceBusy is returned if no slot could be had.
+func (l *limiter) acquire(ctx context.Context, subject string) (func(), error) {
+	sl := l.enqueue(subject)
+	if sl == nil {
+		return nil, serrors.ErrServiceBusy
+	}
+	defer l.dequeue(sl)
+
+	release := func() { <-sl.slots }
+
+	// Don't bother with the metrics or the timer if there's a free slot.
+	select {
+	case sl.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	attrs := metric.WithAttributes(attribute.String("subject", subject))
+	if queuedCounter != nil {
+		queuedCounter.Add(context.Background(), 1, attrs)
+		defer queuedCounter.Add(context.Background(), -1, attrs)
+	}
+
+	wait := l.settings.Wait
+	if wait <= 0 {
+		wait = DefaultQueueWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case sl.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, serrors.ErrServiceBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// SetConcurrencyLimits sets the limits on the number of NATS requests handled
+// at once. It must be called before any requests are handled.
+func (a *App) SetConcurrencyLimits(settings ConcurrencySettings) {
+	a.limiter = newLimiter(settings)
+}
+
+// withSlot waits for a slot to handle a request for the base subject in. If no
+// slot can be had, the returned context is cancelled with ErrServiceBusy as its
+// cause, so that the handler fails fast and serrors.NatsError reports the
+// rejection to the caller. The returned function releases the slot.
+func (a *App) withSlot(ctx context.Context, base string) (context.Context, func()) {
+	release, err := a.limiter.acquire(ctx, base)
+	if err == nil {
+		return ctx, release
+	}
+
+	if err == serrors.ErrServiceBusy {
+		log.WithFields(logrus.Fields{"subject": base}).Warn("rejected a request because the subject is too busy")
+		if rejectedCounter != nil {
+			rejectedCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("subject", base)))
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	cancel(err)
+	return ctx, func() {}
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) setMeteredRate(ctx context.Context, request *api.MeteredRateRequest) *api.MeteredRateResponse {
+	response := &api.MeteredRateResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Rate < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidRate)
+		return response
+	}
+
+	effectiveDate := time.Now()
+	if request.EffectiveDate != "" {
+		var err error
+		if effectiveDate, err = utils.ParseTimestamp(request.EffectiveDate); err != nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidEffectiveDate)
+			return response
+		}
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	rate := &db.MeteredRate{
+		ResourceType:  *resourceType,
+		EffectiveDate: effectiveDate,
+		Rate:          request.Rate,
+		CreatedBy:     requestedBy,
+	}
+	if _, err = d.AddMeteredRate(ctx, rate); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Rate = rate.ToAPIType()
+	return response
+}
+
+// SetMeteredRateHandler sets the price of each unit of a resource that's used
+// beyond the user's quota, starting at the rate's effective date.
+func (a *App) SetMeteredRateHandler(subject, reply string, request *api.MeteredRateRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting metered rate")
+
+	response := a.setMeteredRate(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetMeteredRateHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.MeteredRateRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.setMeteredRate(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// priceOverages returns the charges for the use of each resource beyond the
+// user's quota under the given metered rates, along with the total. Resources
+// without a metered rate are listed, but aren't charged for.
+func priceOverages(overages []db.Overage, rates map[string]db.MeteredRate) ([]*api.OverageCharge, float64) {
+	charges := make([]*api.OverageCharge, 0)
+	total := 0.0
+
+	for _, overage := range overages {
+		if overage.UsageValue < overage.QuotaValue {
+			continue
+		}
+
+		charge := &api.OverageCharge{
+			ResourceName: overage.ResourceType.Name,
+			Unit:         overage.ResourceType.Unit,
+			Quota:        overage.QuotaValue,
+			Usage:        overage.UsageValue,
+			Overage:      overage.UsageValue - overage.QuotaValue,
+		}
+		if rate, ok := rates[overage.ResourceType.Name]; ok {
+			charge.Priced = true
+			charge.Rate = rate.Rate
+			charge.Amount = roundCurrency(charge.Overage * rate.Rate)
+			total += charge.Amount
+		}
+		charges = append(charges, charge)
+	}
+
+	return charges, roundCurrency(total)
+}
+
+func (a *App) previewOverageBilling(ctx context.Context, request *api.ByUsernameRequest) *api.OverageBillingPreviewResponse {
+	response := &api.OverageBillingPreviewResponse{
+		AsOf:    time.Now(),
+		Charges: make([]*api.OverageCharge, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	d := a.readDatabase(ctx)
+
+	// Users are never charged for overages that wouldn't be enforced.
+	if a.GracePeriod > 0 {
+		state, err := a.currentSubscriptionState(ctx, d, username)
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if state == db.SubscriptionStateGrace {
+			return response
+		}
+	}
+
+	overages, err := d.GetUserOverages(ctx, username, a.subscriptionOpts(db.WithReadReplica())...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	rates, err := d.CurrentMeteredRates(ctx, response.AsOf, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Charges, response.Total = priceOverages(overages, rates)
+	return response
+}
+
+// PreviewOverageBillingHandler shows what a user's current overages would cost
+// under the metered rates that are currently in effect. Nothing is charged.
+func (a *App) PreviewOverageBillingHandler(subject, reply string, request *api.ByUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "previewing overage billing")
+
+	response := a.previewOverageBilling(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) PreviewOverageBillingHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUsernameRequest{Username: c.Param("username")}
+	response := a.previewOverageBilling(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/overagekv"
+	"github.com/sirupsen/logrus"
+)
+
+// SetOverageStore configures the store used to maintain the projection of each
+// user's overage status. The projection isn't maintained if the store isn't
+// set.
+func (a *App) SetOverageStore(store *overagekv.Store) {
+	a.overageStore = store
+}
+
+// overageStatus determines a user's current overage status in the same way as
+// an overage check. The primary database is used so that the status reflects
+// changes that were just committed.
+func (a *App) overageStatus(ctx context.Context, d *db.Database, username string) (*api.OverageStatus, error) {
+	status := &api.OverageStatus{
+		Username:  username,
+		Overages:  make([]*api.ResourceOverage, 0),
+		UpdatedAt: time.Now(),
+	}
+
+	// Overage checks pass during the grace period.
+	if a.GracePeriod > 0 {
+		subscription, err := a.activeSubscription(ctx, d, username, true, false)
+		if err != nil && err != serrors.ErrSubscriptionNotFound {
+			return nil, err
+		}
+		if subscription != nil {
+			status.SubscriptionState = a.subscriptionState(subscription.EffectiveEndDate)
+		}
+		if status.SubscriptionState == db.SubscriptionStateGrace {
+			return status, nil
+		}
+	}
+
+	overages, err := d.GetUserOverages(ctx, username, a.subscriptionOpts()...)
+	if err != nil {
+		return nil, err
+	}
+	for _, overage := range overages {
+		if overage.UsageValue >= overage.QuotaValue {
+			resourceOverage := &api.ResourceOverage{
+				ResourceName: overage.ResourceType.Name,
+				Quota:        overage.QuotaValue,
+				Usage:        overage.UsageValue,
+				Remaining:    overage.Remaining,
+			}
+			if overage.PercentUsed.Valid {
+				percentUsed := overage.PercentUsed.Float64
+				resourceOverage.PercentUsed = &percentUsed
+			}
+			status.Overages = append(status.Overages, resourceOverage)
+		}
+	}
+	status.InOverage = len(status.Overages) > 0
+
+	return status, nil
+}
+
+// updateOverageProjection stores a user's current overage status.
+func (a *App) updateOverageProjection(ctx context.Context, d *db.Database, username string) error {
+	status, err := a.overageStatus(ctx, d, username)
+	if err != nil {
+		return err
+	}
+	return a.overageStore.Put(status)
+}
+
+// projectOverages updates the overage projection for the given users in the
+// background if the projection is enabled. It should be called after every
+// change that can affect whether a user is in overage.
+func (a *App) projectOverages(ctx context.Context, usernames ...string) {
+	if a.overageStore == nil || !a.ReportOverages {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		d := a.database(ctx)
+		for _, username := range usernames {
+			if err := a.updateOverageProjection(ctx, d, username); err != nil {
+				log.WithFields(logrus.Fields{"context": "projecting overages", "user": username}).Error(err)
+			}
+		}
+	}()
+}
+
+// removeOverageProjection removes the overage projection for a user who no
+// longer exists in the background if the projection is enabled.
+func (a *App) removeOverageProjection(username string) {
+	if a.overageStore == nil || !a.ReportOverages {
+		return
+	}
+
+	go func() {
+		if err := a.overageStore.Delete(username); err != nil {
+			log.WithFields(logrus.Fields{"context": "projecting overages", "user": username}).Error(err)
+		}
+	}()
+}
+
+// projectSubscriptionOverages updates the overage projection for the owner of
+// a subscription in the background if the projection is enabled.
+func (a *App) projectSubscriptionOverages(ctx context.Context, subscriptionID string) {
+	if a.overageStore == nil || !a.ReportOverages {
+		return
+	}
+
+	subscription, err := a.database(ctx).GetSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		log.WithFields(logrus.Fields{"context": "projecting overages", "subscription": subscriptionID}).Error(err)
+		return
+	}
+	a.projectOverages(ctx, subscription.User.Username)
+}
+
+// StartOverageProjectionWorker rebuilds the overage projection immediately and
+// then at regular intervals until the context is done, which picks up changes
+// that happen with the passage of time, such as subscriptions ending.
+func (a *App) StartOverageProjectionWorker(ctx context.Context) {
+	if a.overageStore == nil || !a.ReportOverages {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(a.overageStore.Settings().Interval)
+		defer ticker.Stop()
+
+		for {
+			if count, err := a.RebuildOverageProjection(ctx); err != nil {
+				log.Errorf("unable to rebuild the overage projection: %s", err)
+			} else {
+				log.Debugf("rebuilt the overage projection for %d users", count)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// RebuildOverageProjection stores the current overage status of every user and
+// returns the number of users whose status was stored. Users whose status can't
+// be determined are logged and skipped.
+func (a *App) RebuildOverageProjection(ctx context.Context) (int, error) {
+	d := a.database(ctx)
+
+	usernames, err := d.ListUsernames(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, username := range usernames {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		if err = a.updateOverageProjection(ctx, d, username); err != nil {
+			log.WithFields(logrus.Fields{"context": "rebuilding overage projection", "user": username}).Error(err)
+			continue
+		}
+		count++
+	}
+
+	return count, nil
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) getOverageReport(ctx context.Context, request *api.OverageReportRequest) *api.OverageReportResponse {
+	response := &api.OverageReportResponse{
+		GeneratedAt: time.Now(),
+		Overages:    make([]*api.OverageReportStats, 0),
+	}
+
+	d := a.readDatabase(ctx)
+
+	if request.PlanName != "" {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica(), db.WithIncludeDeleted())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+	}
+
+	opts, err := tagOpts(request.Tag, a.subscriptionOpts(db.WithReadReplica())...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	rows, err := d.OverageReport(ctx, request.PlanName, opts...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, row := range rows {
+		response.Overages = append(response.Overages, &api.OverageReportStats{
+			PlanName:     row.PlanName,
+			ResourceName: row.ResourceName,
+			ResourceUnit: row.ResourceUnit,
+			Users:        row.Users,
+			P50Amount:    row.MedianAmount,
+			P95Amount:    row.P95Amount,
+			MaxAmount:    row.MaxAmount,
+		})
+	}
+
+	return response
+}
+
+// GetOverageReportHandler reports how many users on each plan have reached
+// their quotas for each resource type, and by how much.
+func (a *App) GetOverageReportHandler(subject, reply string, request *api.OverageReportRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reporting overages")
+
+	response := a.getOverageReport(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetOverageReportHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.OverageReportRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.getOverageReport(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
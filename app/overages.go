@@ -12,6 +12,21 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// overageFor returns the user's overage for the named resource type, or nil if
+// the user hasn't reached the quota for the resource type.
+func (a *App) overageFor(ctx context.Context, d *db.Database, username, resourceName string) (*db.Overage, error) {
+	overages, err := d.GetUserOverages(ctx, username, a.subscriptionOpts()...)
+	if err != nil {
+		return nil, err
+	}
+	for _, overage := range overages {
+		if overage.ResourceType.Name == resourceName && overage.UsageValue >= overage.QuotaValue {
+			return &overage, nil
+		}
+	}
+	return nil, nil
+}
+
 func (a *App) getUserOverages(ctx context.Context, request *qms.AllUserOveragesRequest) *qms.OverageList {
 	response := pbinit.NewOverageList()
 
@@ -26,14 +41,24 @@ func (a *App) getUserOverages(ctx context.Context, request *qms.AllUserOveragesR
 		return response
 	}
 
-	d := db.New(a.db)
+	d := a.readDatabase(ctx)
 
-	results, err := d.GetUserOverages(ctx, username)
+	results, err := d.GetUserOverages(ctx, username, a.subscriptionOpts(db.WithReadReplica())...)
 	if err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
 	}
 
+	// Let the caller know if the subscription is in its grace period.
+	if a.GracePeriod > 0 {
+		state, err := a.currentSubscriptionState(ctx, d, username)
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		setSubscriptionState(response.Header, state)
+	}
+
 	for _, r := range results {
 		quota := r.QuotaValue
 		usage := r.UsageValue
@@ -58,10 +83,13 @@ func (a *App) GetUserOverages(subject, reply string, request *qms.AllUserOverage
 	ctx, span := pbinit.InitAllUserOveragesRequest(request, subject)
 	defer span.End()
 
-	response := a.getUserOverages(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.GetUserOverages(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -82,6 +110,7 @@ func (a *App) GetUserOveragesHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -101,9 +130,24 @@ func (a *App) checkUserOverages(ctx context.Context, request *qms.IsOverageReque
 
 	log = log.WithFields(logrus.Fields{"user": username})
 
-	d := db.New(a.db)
+	d := a.readDatabase(ctx)
+
+	// Overage checks pass during the grace period, but the caller is warned
+	// that the subscription has ended.
+	if a.GracePeriod > 0 {
+		state, err := a.currentSubscriptionState(ctx, d, username)
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		setSubscriptionState(response.Header, state)
+		if state == db.SubscriptionStateGrace {
+			response.IsOverage = false
+			return response
+		}
+	}
 
-	overages, err := d.GetUserOverages(ctx, username)
+	overages, err := d.GetUserOverages(ctx, username, a.subscriptionOpts(db.WithReadReplica())...)
 	if err != nil {
 		response.Error = serrors.NatsError(ctx, err)
 		return response
@@ -118,6 +162,15 @@ func (a *App) checkUserOverages(ctx context.Context, request *qms.IsOverageReque
 		response.IsOverage = false
 	}
 
+	// Reserved resources count against the quota as well.
+	if !response.IsOverage && a.reservations {
+		response.IsOverage, err = a.reservedOverage(ctx, d, username, request.GetResourceName())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
 	return response
 }
 
@@ -129,10 +182,13 @@ func (a *App) CheckUserOverages(subject, reply string, request *qms.IsOverageReq
 	ctx, span := pbinit.InitIsOverageRequest(request, subject)
 	defer span.End()
 
-	response := a.checkUserOverages(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.CheckUserOverages(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -156,5 +212,6 @@ func (a *App) CheckUserOveragesHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
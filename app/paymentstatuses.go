@@ -0,0 +1,240 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// paymentStatus fills in the payment status of a subscription and its history.
+func paymentStatus(
+	ctx context.Context, d *db.Database, subscriptionID string, response *api.PaymentStatusResponse, opts ...db.QueryOption,
+) error {
+	status, err := d.GetPaymentStatus(ctx, subscriptionID, opts...)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return serrors.ErrSubscriptionNotFound
+	}
+
+	changes, err := d.ListPaymentStatusChanges(ctx, subscriptionID, opts...)
+	if err != nil {
+		return err
+	}
+
+	response.SubscriptionID = subscriptionID
+	response.Status = status.Status()
+	response.Paid = status.Paid
+	response.UpdatedBy = status.UpdatedBy.String
+	if status.UpdatedAt.Valid {
+		response.UpdatedAt = &status.UpdatedAt.Time
+	}
+	response.History = make([]*api.PaymentStatusChange, 0, len(changes))
+	for _, change := range changes {
+		response.History = append(response.History, change.ToAPIType())
+	}
+
+	return nil
+}
+
+// paymentStatusUsernames returns the users whose cached subscriptions include
+// the paid flag of the subscription: its owner and, for group subscriptions,
+// the members of the group.
+func paymentStatusUsernames(ctx context.Context, d *db.Database, subscriptionID string) ([]string, error) {
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID)
+	if err != nil || subscription == nil {
+		return nil, err
+	}
+
+	usernames := []string{subscription.User.Username}
+	name, ok := strings.CutPrefix(subscription.User.Username, db.GroupAccountPrefix)
+	if !ok {
+		return usernames, nil
+	}
+
+	group, err := d.GetGroupByName(ctx, name)
+	if err != nil || group == nil {
+		return usernames, err
+	}
+	members, err := d.ListGroupMembers(ctx, group.ID)
+	if err != nil {
+		return usernames, err
+	}
+	for _, member := range members {
+		usernames = append(usernames, member.Username)
+	}
+
+	return usernames, nil
+}
+
+func (a *App) setPaymentStatus(ctx context.Context, request *api.SetPaymentStatusRequest) *api.PaymentStatusResponse {
+	response := &api.PaymentStatusResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	status := strings.ToLower(strings.TrimSpace(request.Status))
+	if err = db.ValidatePaymentStatus(status); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	previous, err := d.SetPaymentStatus(ctx, &db.PaymentStatusChange{
+		SubscriptionID: request.SubscriptionID,
+		ToStatus:       status,
+		Reason:         sql.NullString{String: request.Reason, Valid: request.Reason != ""},
+		ChangedBy:      requestedBy,
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if previous != status {
+		log.WithFields(logrus.Fields{
+			"subscription": request.SubscriptionID,
+			"from":         previous,
+			"to":           status,
+		}).Info("changed the payment status of a subscription")
+
+		usernames, err := paymentStatusUsernames(ctx, d, request.SubscriptionID)
+		if err != nil {
+			log.Errorf("unable to look up the users of subscription %s: %s", request.SubscriptionID, err)
+		}
+		a.invalidateSubscriptions(ctx, usernames...)
+	}
+
+	if err = paymentStatus(ctx, d, request.SubscriptionID, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.PreviousStatus = previous
+
+	return response
+}
+
+// SetSubscriptionPaymentStatusHandler changes the payment status of a
+// subscription and updates its paid flag to match.
+func (a *App) SetSubscriptionPaymentStatusHandler(subject, reply string, request *api.SetPaymentStatusRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting subscription payment status")
+
+	response := a.setPaymentStatus(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetSubscriptionPaymentStatusHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SetPaymentStatusRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.SubscriptionID = c.Param("uuid")
+
+	response := a.setPaymentStatus(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getPaymentStatus(ctx context.Context, request *api.ByUUIDRequest) *api.PaymentStatusResponse {
+	response := &api.PaymentStatusResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.readDatabase(ctx)
+
+	if err := paymentStatus(ctx, d, request.UUID, response, db.WithReadReplica()); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// GetSubscriptionPaymentStatusHandler returns the payment status of a
+// subscription along with the history of its changes.
+func (a *App) GetSubscriptionPaymentStatusHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting subscription payment status")
+
+	response := a.getPaymentStatus(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetSubscriptionPaymentStatusHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getPaymentStatus(ctx, &api.ByUUIDRequest{UUID: c.Param("uuid")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
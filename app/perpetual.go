@@ -0,0 +1,29 @@
+package app
+
+import (
+	"strconv"
+
+	serrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// PerpetualHeader is the name of the message header used to request a
+// perpetual subscription when a user is added. Perpetual subscriptions don't
+// have an end date, so they're meant for service accounts that should never
+// lose their subscriptions. The QMS messages don't have a field for the flag,
+// so it's passed in the header instead. HTTP requests use the perpetual query
+// parameter.
+const PerpetualHeader = "x-qms-perpetual"
+
+// parsePerpetual returns the value of a perpetual flag. An empty value means
+// that the subscription should end as usual.
+func parsePerpetual(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+
+	perpetual, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, serrors.ErrInvalidPerpetual
+	}
+	return perpetual, nil
+}
@@ -0,0 +1,444 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// planChangeBatchSize is the maximum number of plan changes that are applied
+// each time the worker runs.
+const planChangeBatchSize = 100
+
+func (a *App) schedulePlanChange(ctx context.Context, request *api.PlanChangeRequest) *api.PlanChangeResponse {
+	response := &api.PlanChangeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	periods, err := utils.PeriodsForRequestValue(request.Periods)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	subscription, err := d.GetActiveSubscription(ctx, username, a.subscriptionOpts()...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Scheduled changes take effect when the subscription ends, which perpetual
+	// subscriptions never do.
+	if subscription.Perpetual() {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPerpetualSubscription)
+		return response
+	}
+
+	// Moving to a plan with less of a non-consumable resource than the user is
+	// already using has to be forced.
+	if !request.Force {
+		if response.ExceededQuotas, err = checkDowngrade(ctx, d, subscription, plan); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	change := &db.PlanChange{
+		SubscriptionID: subscription.ID,
+		PlanID:         plan.ID,
+		Paid:           request.Paid,
+		Periods:        periods,
+		CreatedBy:      requestedBy,
+	}
+
+	// The new subscription can't end before it starts.
+	if request.EndDate != "" {
+		endDate, err := utils.ParseTimestamp(request.EndDate)
+		if err != nil || !endDate.After(subscription.EffectiveEndDate) {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidEffectiveDate)
+			return response
+		}
+		change.EndDate = sql.NullTime{Time: endDate, Valid: true}
+	}
+
+	// A dry run schedules the plan change in a transaction that's rolled back.
+	response.DryRun = request.DryRun
+	err = d.InDryRunTx(ctx, request.DryRun, func(tx *goqu.TxDatabase) error {
+		id, err := d.AddPlanChange(ctx, change, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		change, err = d.GetPlanChange(ctx, id, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.PlanChange = change.ToAPIType()
+	return response
+}
+
+// SchedulePlanChangeHandler schedules a change to a different plan that takes
+// effect when the user's current subscription ends.
+func (a *App) SchedulePlanChangeHandler(subject, reply string, request *api.PlanChangeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "scheduling plan change")
+
+	response := a.schedulePlanChange(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SchedulePlanChangeHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.PlanChangeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.schedulePlanChange(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listPlanChanges(ctx context.Context, request *api.ByUsernameRequest) *api.PlanChangeListResponse {
+	response := &api.PlanChangeListResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	changes, err := d.ListPlanChangesForUser(ctx, username, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.PlanChanges = make([]*api.PlanChange, len(changes))
+	for i, change := range changes {
+		response.PlanChanges[i] = change.ToAPIType()
+	}
+
+	return response
+}
+
+// ListPlanChangesHandler lists the plan changes that have been scheduled for a
+// user.
+func (a *App) ListPlanChangesHandler(subject, reply string, request *api.ByUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing plan changes")
+
+	response := a.listPlanChanges(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListPlanChangesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUsernameRequest{Username: c.Param("username")}
+	response := a.listPlanChanges(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) cancelPlanChange(ctx context.Context, request *api.ByUUIDRequest) *api.PlanChangeResponse {
+	response := &api.PlanChangeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if err := d.CancelPlanChange(ctx, request.UUID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	change, err := d.GetPlanChange(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.PlanChange = change.ToAPIType()
+	return response
+}
+
+// CancelPlanChangeHandler cancels a pending plan change.
+func (a *App) CancelPlanChangeHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "cancelling plan change")
+
+	response := a.cancelPlanChange(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) CancelPlanChangeHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{UUID: c.Param("id")}
+	response := a.cancelPlanChange(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartPlanChangeWorker applies plan changes that have come due at regular
+// intervals until the context is done.
+func (a *App) StartPlanChangeWorker(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be applied while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			// Keep going until there's nothing left to apply.
+			for {
+				count, err := a.ApplyDuePlanChanges(ctx)
+				if err != nil {
+					log.Errorf("unable to apply plan changes: %s", err)
+				}
+				if err != nil || count < planChangeBatchSize {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// ApplyDuePlanChanges applies a single batch of plan changes for subscriptions
+// that have ended and returns the number of plan changes that were processed.
+// Each plan change is applied in its own transaction. A plan change that can't
+// be applied is marked as failed so that it isn't attempted again.
+func (a *App) ApplyDuePlanChanges(ctx context.Context) (int, error) {
+	d := a.database(ctx)
+
+	ids, err := d.DuePlanChanges(ctx, planChangeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		log := log.WithFields(logrus.Fields{"context": "applying plan change", "plan_change": id})
+
+		change, err := a.applyPlanChange(ctx, d, id)
+		if err != nil {
+			log.Errorf("unable to apply the plan change: %s", err)
+			if err = d.FailPlanChange(ctx, id, err.Error()); err != nil {
+				log.Errorf("unable to mark the plan change as failed: %s", err)
+			}
+			continue
+		}
+		if change == nil {
+			continue
+		}
+
+		log.Infof("changed %s to the %s plan", change.Username, change.PlanName)
+		a.notify(ctx, planChangeEventType(change), &api.SubscriptionEventData{
+			SubscriptionID: change.NewSubscriptionID.String,
+			Username:       change.Username,
+			PlanName:       change.PlanName,
+		})
+		a.invalidateSubscriptions(ctx, change.Username)
+		a.projectOverages(ctx, change.Username)
+	}
+
+	return len(ids), nil
+}
+
+// planChangeEventType returns the type of event that's generated when a plan
+// change is applied. Changing to the same plan is treated as a renewal.
+func planChangeEventType(change *db.PlanChange) string {
+	if change.IsRenewal() {
+		return api.EventSubscriptionRenewed
+	}
+	return api.EventSubscriptionCreated
+}
+
+// applyPlanChange creates the subscription for a single plan change. Returns nil
+// if the plan change was already handled elsewhere.
+func (a *App) applyPlanChange(ctx context.Context, d *db.Database, id string) (*db.PlanChange, error) {
+	var result *db.PlanChange
+
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		result = nil
+
+		change, err := d.LockPendingPlanChange(ctx, id, db.WithTX(tx))
+		if err != nil || change == nil {
+			return err
+		}
+
+		plan, err := d.GetPlanByID(ctx, change.PlanID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		// Lock the subscription that's being replaced so that other changes to
+		// it wait until this one is done.
+		if _, err = d.GetSubscriptionByID(ctx, change.SubscriptionID, db.WithTX(tx), db.WithForUpdate()); err != nil {
+			return err
+		}
+
+		subscriptionID, err := d.SetActiveSubscription(ctx, change.UserID, plan, change.SubscriptionOptions(), db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if err = d.CompletePlanChange(ctx, id, subscriptionID, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		change.Status = db.PlanChangeStatusApplied
+		change.NewSubscriptionID = sql.NullString{String: subscriptionID, Valid: true}
+
+		if err = a.recordEvent(ctx, d, tx, planChangeEventType(change), &api.SubscriptionEventData{
+			SubscriptionID: subscriptionID,
+			Username:       change.Username,
+			PlanName:       change.PlanName,
+		}); err != nil {
+			return err
+		}
+
+		result = change
+		return nil
+	})
+
+	return result, err
+}
@@ -0,0 +1,219 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// clonedPlan returns a copy of the source plan with the name, description, quota
+// values and rate from the request. Copied quota defaults and rates keep their
+// effective dates, and the ones that are added take effect immediately.
+func clonedPlan(
+	ctx context.Context,
+	d *db.Database,
+	source *db.Plan,
+	request *api.ClonePlanRequest,
+	opts ...db.QueryOption,
+) (*db.Plan, error) {
+	now := time.Now()
+
+	plan := &db.Plan{
+		Name:          request.Name,
+		Description:   request.Description,
+		QuotaDefaults: make([]db.PlanQuotaDefault, 0, len(source.QuotaDefaults)),
+		Rates:         make([]db.PlanRate, 0, len(source.Rates)),
+	}
+	if plan.Description == "" {
+		plan.Description = source.Description
+	}
+
+	copied := make(map[string]bool)
+	for _, qd := range source.QuotaDefaults {
+		if value, ok := request.QuotaValues[qd.ResourceType.Name]; ok {
+			qd.QuotaValue = value
+		}
+		qd.ID = ""
+		qd.PlanID = ""
+		plan.QuotaDefaults = append(plan.QuotaDefaults, qd)
+		copied[qd.ResourceType.Name] = true
+	}
+
+	// Sort the names of the resource types that are added so that the quota
+	// defaults are added in a predictable order.
+	added := make([]string, 0, len(request.QuotaValues))
+	for name := range request.QuotaValues {
+		if !copied[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+
+	for _, name := range added {
+		rt, err := d.GetResourceTypeByName(ctx, name, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if rt.ID == "" {
+			return nil, serrors.ErrResourceTypeNotFound
+		}
+		plan.QuotaDefaults = append(plan.QuotaDefaults, db.PlanQuotaDefault{
+			QuotaValue:    request.QuotaValues[name],
+			ResourceType:  *rt,
+			EffectiveDate: now,
+		})
+	}
+
+	for _, r := range source.Rates {
+		if request.Rate != nil {
+			r.Rate = *request.Rate
+		}
+		r.ID = ""
+		r.PlanID = ""
+		plan.Rates = append(plan.Rates, r)
+	}
+	if request.Rate != nil && len(plan.Rates) == 0 {
+		plan.Rates = append(plan.Rates, db.PlanRate{Rate: *request.Rate, EffectiveDate: now})
+	}
+
+	return plan, nil
+}
+
+func (a *App) clonePlan(ctx context.Context, request *api.ClonePlanRequest) *api.ClonePlanResponse {
+	response := &api.ClonePlanResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, value := range request.QuotaValues {
+		if value < 0 {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuota)
+			return response
+		}
+	}
+	if request.Rate != nil && *request.Rate < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidRate)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	var plan *db.Plan
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		source, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if source == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		existing, err := d.GetPlanByName(ctx, request.Name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return serrors.ErrPlanExists
+		}
+
+		clone, err := clonedPlan(ctx, d, source, request, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		planID, err := d.AddPlan(ctx, clone, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		plan, err = d.GetPlanByID(ctx, planID, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	log.WithFields(logrus.Fields{
+		"source": request.PlanName,
+		"plan":   plan.Name,
+	}).Info("cloned a plan")
+
+	response.SourcePlanName = request.PlanName
+	response.PlanID = plan.ID
+	response.PlanName = plan.Name
+	response.Description = plan.Description
+	response.QuotaDefaults = make([]*api.PlanQuotaDefault, len(plan.QuotaDefaults))
+	for i, qd := range plan.QuotaDefaults {
+		response.QuotaDefaults[i] = qd.ToAPIType()
+	}
+	response.Rates = make([]*api.PlanRate, len(plan.Rates))
+	for i, r := range plan.Rates {
+		response.Rates[i] = r.ToAPIType()
+	}
+
+	return response
+}
+
+// ClonePlanHandler creates a plan with copies of the quota defaults and rates
+// of an existing plan.
+func (a *App) ClonePlanHandler(subject, reply string, request *api.ClonePlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "cloning plan")
+
+	response := a.clonePlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ClonePlanHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ClonePlanRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+
+	response := a.clonePlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// compareQuotas compares the current quotas and usages of a subscription with
+// the quota defaults of the target plan, in order by resource type name. A
+// resource type that's missing on either side has a quota of zero there.
+func compareQuotas(subscription *db.Subscription, target *db.Plan) []*api.QuotaComparison {
+	byID := make(map[string]*api.QuotaComparison)
+	comparison := func(resourceType db.ResourceType) *api.QuotaComparison {
+		c, ok := byID[resourceType.ID]
+		if !ok {
+			c = &api.QuotaComparison{
+				ResourceType: api.ResourceType{
+					ID:   resourceType.ID,
+					Name: resourceType.Name,
+					Unit: resourceType.Unit,
+				},
+			}
+			byID[resourceType.ID] = c
+		}
+		return c
+	}
+
+	for _, quota := range subscription.Quotas {
+		comparison(quota.ResourceType).CurrentQuota = quota.Quota
+	}
+	for _, quotaDefault := range target.GetActiveQuotaDefaults() {
+		comparison(quotaDefault.ResourceType).TargetQuota = quotaDefault.QuotaValue
+	}
+
+	// Usages only matter for resource types that have quotas.
+	for _, usage := range subscription.Usages {
+		if c, ok := byID[usage.ResourceType.ID]; ok {
+			c.Usage = usage.Usage
+		}
+	}
+
+	result := make([]*api.QuotaComparison, 0, len(byID))
+	for _, c := range byID {
+		c.Change = c.TargetQuota - c.CurrentQuota
+		c.Exceeded = c.Usage > c.TargetQuota
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ResourceType.Name < result[j].ResourceType.Name })
+
+	return result
+}
+
+// downgradeConflicts returns the comparisons for the non-consumable resource
+// types whose current usage in the subscription exceeds the target plan's
+// quotas. The subscription details have to be loaded.
+func downgradeConflicts(subscription *db.Subscription, target *db.Plan) []*api.QuotaComparison {
+	consumable := make(map[string]bool)
+	for _, usage := range subscription.Usages {
+		consumable[usage.ResourceType.ID] = usage.ResourceType.Consumable
+	}
+
+	var conflicts []*api.QuotaComparison
+	for _, c := range compareQuotas(subscription, target) {
+		if c.Exceeded && !consumable[c.ResourceType.ID] {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return conflicts
+}
+
+// checkDowngrade returns a DowngradeError listing the non-consumable resource
+// types whose current usage in the subscription exceeds the target plan's
+// quotas, along with the comparisons for those resource types. Returns nil if
+// the plan change can go ahead.
+func checkDowngrade(
+	ctx context.Context, d *db.Database, subscription *db.Subscription, target *db.Plan, opts ...db.QueryOption,
+) ([]*api.QuotaComparison, error) {
+	if err := d.LoadSubscriptionDetails(ctx, subscription, opts...); err != nil {
+		return nil, err
+	}
+
+	conflicts := downgradeConflicts(subscription, target)
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	downgradeErr := &serrors.DowngradeError{PlanName: target.Name}
+	for _, c := range conflicts {
+		downgradeErr.Resources = append(downgradeErr.Resources, c.ResourceType.Name)
+	}
+	return conflicts, downgradeErr
+}
+
+func (a *App) comparePlans(ctx context.Context, request *api.ComparePlansRequest) *api.ComparePlansResponse {
+	response := &api.ComparePlansResponse{Quotas: make([]*api.QuotaComparison, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	d := a.readDatabase(ctx)
+
+	target, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if target == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+	response.TargetPlan = target.Name
+
+	subscription, err := d.GetActiveSubscription(ctx, username, a.subscriptionOpts(db.WithReadReplica())...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if err = d.LoadSubscriptionDetails(ctx, subscription, db.WithReadReplica()); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.CurrentPlan = subscription.Plan.Name
+
+	currentRate := subscription.Rate.Rate
+	response.CurrentRate = &currentRate
+	if rate := target.GetActiveRate(); rate != nil {
+		targetRate := rate.Rate
+		response.TargetRate = &targetRate
+	}
+
+	response.Quotas = compareQuotas(subscription, target)
+	for _, c := range response.Quotas {
+		if c.Exceeded {
+			response.ExceedsQuotas = true
+		}
+	}
+
+	return response
+}
+
+// ComparePlansHandler describes what would change if a user moved from their
+// current plan to a different one, so that users can be warned before they
+// downgrade.
+func (a *App) ComparePlansHandler(subject, reply string, request *api.ComparePlansRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "comparing plans")
+
+	response := a.comparePlans(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ComparePlansHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ComparePlansRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.comparePlans(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
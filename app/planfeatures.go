@@ -0,0 +1,328 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// normalizeFeature returns the form of a feature name that's stored, so that
+// lookups don't depend on the case or surrounding whitespace used by callers.
+func normalizeFeature(feature string) string {
+	return strings.ToLower(strings.TrimSpace(feature))
+}
+
+// planFeatures fills in the features of a plan.
+func planFeatures(ctx context.Context, d *db.Database, plan *db.Plan, response *api.PlanFeaturesResponse, opts ...db.QueryOption) error {
+	features, err := d.ListPlanFeatures(ctx, plan.ID, opts...)
+	if err != nil {
+		return err
+	}
+
+	response.PlanName = plan.Name
+	response.Features = make([]*api.PlanFeature, 0, len(features))
+	for i := range features {
+		response.Features = append(response.Features, features[i].ToAPIType())
+	}
+
+	return nil
+}
+
+func (a *App) listPlanFeatures(ctx context.Context, request *api.ListPlanFeaturesRequest) *api.PlanFeaturesResponse {
+	response := &api.PlanFeaturesResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	if err = planFeatures(ctx, d, plan, response, db.WithReadReplica()); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// ListPlanFeaturesHandler lists the features that a plan gives its subscribers
+// access to.
+func (a *App) ListPlanFeaturesHandler(subject, reply string, request *api.ListPlanFeaturesRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing plan features")
+
+	response := a.listPlanFeatures(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListPlanFeaturesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listPlanFeatures(ctx, &api.ListPlanFeaturesRequest{PlanName: c.Param("plan_name")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// changePlanFeature adds a feature to a plan or removes one, and returns the
+// plan's features afterwards.
+func (a *App) changePlanFeature(ctx context.Context, request *api.PlanFeatureRequest, add bool) *api.PlanFeaturesResponse {
+	response := &api.PlanFeaturesResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	feature := normalizeFeature(request.Feature)
+	if add {
+		err = d.AddPlanFeature(ctx, &db.PlanFeature{PlanID: plan.ID, Feature: feature, CreatedBy: requestedBy})
+	} else {
+		var removed bool
+		removed, err = d.RemovePlanFeature(ctx, plan.ID, feature)
+		if err == nil && !removed {
+			err = serrors.ErrPlanFeatureNotFound
+		}
+	}
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	a.invalidatePlanSubscriptions(ctx, d, plan.ID)
+
+	log.WithFields(logrus.Fields{
+		"plan":    plan.Name,
+		"feature": feature,
+		"added":   add,
+		"by":      requestedBy,
+	}).Info("changed the features of a plan")
+
+	if err = planFeatures(ctx, d, plan, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// AddPlanFeatureHandler gives the subscribers to a plan access to a feature.
+func (a *App) AddPlanFeatureHandler(subject, reply string, request *api.PlanFeatureRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding plan feature")
+
+	response := a.changePlanFeature(ctx, request, true)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// RemovePlanFeatureHandler takes a feature away from the subscribers to a
+// plan.
+func (a *App) RemovePlanFeatureHandler(subject, reply string, request *api.PlanFeatureRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "removing plan feature")
+
+	response := a.changePlanFeature(ctx, request, false)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// changePlanFeatureHTTP adds or removes the feature named in the path of an
+// HTTP request. The body is optional, and only the requested_by field is used.
+func (a *App) changePlanFeatureHTTP(c echo.Context, add bool) error {
+	var (
+		err     error
+		request api.PlanFeatureRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+	request.Feature = c.Param("feature")
+
+	response := a.changePlanFeature(ctx, &request, add)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) AddPlanFeatureHTTPHandler(c echo.Context) error {
+	return a.changePlanFeatureHTTP(c, true)
+}
+
+func (a *App) RemovePlanFeatureHTTPHandler(c echo.Context) error {
+	return a.changePlanFeatureHTTP(c, false)
+}
+
+// userHasFeature looks up whether the plan of a user's active subscription,
+// including a subscription in its grace period, gives them access to a
+// feature. Users without an active subscription don't have access to any
+// features.
+func (a *App) userHasFeature(ctx context.Context, request *api.UserFeatureRequest) *api.UserFeatureResponse {
+	response := &api.UserFeatureResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+	response.Feature = normalizeFeature(request.Feature)
+
+	d := a.readDatabase(ctx)
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if errors.Is(err, serrors.ErrSubscriptionNotFound) {
+		return response
+	}
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.PlanName = subscription.Plan.Name
+
+	response.HasFeature, err = d.PlanHasFeature(ctx, subscription.Plan.ID, response.Feature, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// UserHasFeatureHandler looks up whether a user's plan gives them access to a
+// feature, for services that make authorization decisions based on it.
+func (a *App) UserHasFeatureHandler(subject, reply string, request *api.UserFeatureRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "checking user feature")
+
+	response := a.userHasFeature(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) UserHasFeatureHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.UserFeatureRequest{
+		Username: c.Param("username"),
+		Feature:  c.Param("feature"),
+	}
+
+	response := a.userHasFeature(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
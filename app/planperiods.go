@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) setPlanPeriod(ctx context.Context, request *api.PlanPeriodRequest) *api.PlanPeriodResponse {
+	response := &api.PlanPeriodResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	period := &db.SubscriptionPeriod{Unit: request.PeriodUnit, Days: request.PeriodDays}
+	if err := period.Validate(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	if err = d.SetPlanPeriod(ctx, plan.ID, period); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	a.invalidatePlanSubscriptions(ctx, d, plan.ID)
+
+	response.PlanName = plan.Name
+	response.PeriodUnit = period.Unit
+	if period.Unit == db.PeriodUnitDays {
+		response.PeriodDays = period.Days
+	}
+	return response
+}
+
+// SetPlanPeriodHandler changes the natural billing cadence of a plan, which
+// determines when new subscriptions to the plan end if no end date is given.
+func (a *App) SetPlanPeriodHandler(subject, reply string, request *api.PlanPeriodRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting plan period")
+
+	response := a.setPlanPeriod(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetPlanPeriodHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.PlanPeriodRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+
+	response := a.setPlanPeriod(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -7,16 +7,59 @@ import (
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
 	"github.com/labstack/echo/v4"
 )
 
-func (a *App) listPlans(ctx context.Context) *qms.PlanList {
+// SetDefaultPlan changes the plan that users are subscribed to when they don't
+// have a subscription yet. The plan must exist before users are subscribed to
+// it.
+func (a *App) SetDefaultPlan(planName string) {
+	a.defaultPlan = planName
+}
+
+// defaultPlanName returns the name of the plan that users are subscribed to
+// when they don't have a subscription yet.
+func (a *App) defaultPlanName() string {
+	if a.defaultPlan != "" {
+		return a.defaultPlan
+	}
+	return db.DefaultPlanName
+}
+
+// SetAutoSubscribe determines whether users who don't have a subscription are
+// subscribed to the default plan when their usage is recorded. Usage updates
+// for these users are rejected otherwise. Users are always subscribed to the
+// default plan when their subscription summary is requested.
+func (a *App) SetAutoSubscribe(enabled bool) {
+	a.autoSubscribe = enabled
+}
+
+// usageSubscriptionOpts returns the query options for looking up the
+// subscription that usage is recorded against.
+func (a *App) usageSubscriptionOpts(opts ...db.QueryOption) []db.QueryOption {
+	opts = a.subscriptionOpts(opts...)
+	if a.autoSubscribe {
+		opts = append(opts, db.WithDefaultSubscription())
+	}
+	return opts
+}
+
+func (a *App) listPlans(ctx context.Context, includeDeleted string) *qms.PlanList {
 	response := pbinit.NewPlanList()
 
-	d := db.New(a.db)
-	plans, err := d.ListPlans(ctx)
+	opts, err := includeDeletedOpts(includeDeleted)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+	plans, err := d.ListPlans(ctx, opts...)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
@@ -37,10 +80,13 @@ func (a *App) ListPlansHandler(subject, reply string, request *qms.NoParamsReque
 	ctx, span := pbinit.InitQMSNoParamsRequest(request, subject)
 	defer span.End()
 
-	response := a.listPlans(ctx)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.ListPlans(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -51,19 +97,24 @@ func (a *App) ListPlansHandler(subject, reply string, request *qms.NoParamsReque
 func (a *App) ListPlansHTTPHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	response := a.listPlans(ctx)
+	response := a.listPlans(ctx, c.QueryParam("include_deleted"))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) addPlan(ctx context.Context, request *qms.AddPlanRequest) *qms.PlanResponse {
 	response := pbinit.NewPlanResponse()
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 
 	tx, err := d.Begin()
 	if err != nil {
@@ -81,7 +132,7 @@ func (a *App) addPlan(ctx context.Context, request *qms.AddPlanRequest) *qms.Pla
 		if err != nil {
 			return err
 		} else if existingPlan != nil {
-			return fmt.Errorf("a plan named %s already exists", incomingPlan.Name)
+			return errors.ErrPlanExists
 		}
 
 		for i, pqd := range incomingPlan.QuotaDefaults {
@@ -131,10 +182,13 @@ func (a *App) AddPlanHandler(subject, reply string, request *qms.AddPlanRequest)
 	ctx, span := pbinit.InitQMSAddPlanRequest(request, subject)
 	defer span.End()
 
-	response := a.addPlan(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.AddPlan(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -162,13 +216,14 @@ func (a *App) AddPlanHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
 func (a *App) getPlan(ctx context.Context, request *qms.PlanRequest) *qms.PlanResponse {
 	response := pbinit.NewPlanResponse()
 
-	d := db.New(a.db)
+	d := a.database(ctx)
 
 	plan, err := d.GetPlanByID(ctx, request.PlanId)
 	if err != nil {
@@ -207,10 +262,13 @@ func (a *App) GetPlanHandler(subject, reply string, request *qms.PlanRequest) {
 	ctx, span := pbinit.InitQMSPlanRequest(request, subject)
 	defer span.End()
 
-	response := a.getPlan(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.GetPlan(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -231,6 +289,7 @@ func (a *App) GetPlanHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -246,9 +305,12 @@ func (a *App) UpsertQuotaDefaultsHandler(subject, reply string, request *qms.Add
 	ctx, span := pbinit.InitQMSAddPlanQuotaDefaultRequest(request, subject)
 	defer span.End()
 
-	response := a.upsertQuotaDefault(ctx, request)
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	response, err := a.service.UpsertQuotaDefaults(ctx, request)
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -276,5 +338,87 @@ func (a *App) UpsertQuotaDefaultsHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) deletePlan(ctx context.Context, request *api.DeletePlanRequest) *api.DeletePlanResponse {
+	response := &api.DeletePlanResponse{PlanName: request.PlanName}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
+	// New users are subscribed to the default plan, so it has to remain
+	// available.
+	if request.PlanName == a.defaultPlanName() {
+		response.Error = errors.NatsError(ctx, errors.ErrDefaultPlanDeletion)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return errors.ErrPlanNotFound
+		}
+		response.PlanID = plan.ID
+
+		return d.DeletePlan(ctx, plan.ID, db.WithTX(tx))
+	})
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	a.invalidatePlanSubscriptions(ctx, d, response.PlanID)
+	return response
+}
+
+// DeletePlanHandler marks a plan as deleted. Subscriptions to the plan aren't
+// affected, but users can no longer be subscribed to it.
+func (a *App) DeletePlanHandler(subject, reply string, request *api.DeletePlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "deleting plan")
+
+	response := a.deletePlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) DeletePlanHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.DeletePlanRequest{
+		PlanName: c.Param("plan_name"),
+	}
+
+	response := a.deletePlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
 	return c.JSON(http.StatusOK, response)
 }
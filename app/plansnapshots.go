@@ -0,0 +1,105 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) getPlanSnapshot(ctx context.Context, request *api.PlanSnapshotRequest) *api.PlanSnapshotResponse {
+	response := &api.PlanSnapshotResponse{QuotaDefaults: make([]*api.PlanQuotaDefault, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	asOf := time.Now()
+	if request.AsOf != "" {
+		var err error
+		if asOf, err = utils.ParseTimestamp(request.AsOf); err != nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidAsOf)
+			return response
+		}
+	}
+
+	d := a.readDatabase(ctx)
+
+	// Deleted plans are included because subscriptions to them may still need to
+	// be reconciled.
+	plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica(), db.WithIncludeDeleted())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	response.PlanID = plan.ID
+	response.PlanName = plan.Name
+	response.AsOf = asOf
+	for _, qd := range plan.QuotaDefaultsAsOf(asOf) {
+		response.QuotaDefaults = append(response.QuotaDefaults, qd.ToAPIType())
+	}
+	if rate := plan.RateAsOf(asOf); rate != nil {
+		response.Rate = rate.ToAPIType()
+	}
+
+	return response
+}
+
+// GetPlanSnapshotHandler returns the quota defaults and rate that were in
+// effect for a plan at a point in time, for billing reconciliation.
+func (a *App) GetPlanSnapshotHandler(subject, reply string, request *api.PlanSnapshotRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting plan snapshot")
+
+	response := a.getPlanSnapshot(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetPlanSnapshotHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.PlanSnapshotRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+
+	response := a.getPlanSnapshot(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
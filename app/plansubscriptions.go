@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) subscriptionsByPlan(ctx context.Context, request *api.SubscriptionsByPlanRequest) *api.SubscriptionsByPlanResponse {
+	response := &api.SubscriptionsByPlanResponse{Plans: make([]*api.PlanSubscriptionStats, 0)}
+
+	d := a.readDatabase(ctx)
+
+	if request.PlanName != "" {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica(), db.WithIncludeDeleted())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+	}
+
+	opts, err := tagOpts(request.Tag, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	counts, err := d.SubscriptionCountsByPlan(ctx, request.PlanName, opts...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	byName := make(map[string]*api.PlanSubscriptionStats, len(counts))
+	for _, c := range counts {
+		stats := &api.PlanSubscriptionStats{
+			PlanName:  c.PlanName,
+			Total:     c.Total,
+			Paid:      c.Paid,
+			Unpaid:    c.Unpaid,
+			Perpetual: c.Perpetual,
+		}
+		if request.IncludeUsers {
+			stats.Users = make([]*api.PlanSubscriber, 0, c.Total)
+		}
+		byName[c.PlanName] = stats
+		response.Plans = append(response.Plans, stats)
+	}
+
+	if !request.IncludeUsers {
+		return response
+	}
+
+	subscribers, err := d.PlanSubscribers(ctx, request.PlanName, opts...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, s := range subscribers {
+		stats, ok := byName[s.PlanName]
+		if !ok {
+			continue
+		}
+		stats.Users = append(stats.Users, &api.PlanSubscriber{
+			Username:           s.Username,
+			SubscriptionID:     s.SubscriptionID,
+			Paid:               s.Paid,
+			EffectiveStartDate: s.EffectiveStartDate,
+			EffectiveEndDate:   s.EffectiveEndDate,
+			Perpetual:          s.Perpetual,
+		})
+	}
+
+	return response
+}
+
+// SubscriptionsByPlanHandler reports the number of active subscriptions to
+// each plan, and optionally the users who hold them.
+func (a *App) SubscriptionsByPlanHandler(subject, reply string, request *api.SubscriptionsByPlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reporting subscriptions by plan")
+
+	response := a.subscriptionsByPlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SubscriptionsByPlanHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SubscriptionsByPlanRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.subscriptionsByPlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
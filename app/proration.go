@@ -0,0 +1,224 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// roundCurrency rounds an amount of money to the nearest cent.
+func roundCurrency(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// calculateProration returns the amounts owed when a user changes from the
+// previous subscription to a new plan at the given time, for the remainder of
+// the previous subscription's period. Only paid subscriptions are credited or
+// charged.
+func calculateProration(previous *db.Subscription, newRate float64, newPaid bool, asOf time.Time) *api.Proration {
+	fraction := 0.0
+	period := previous.EffectiveEndDate.Sub(previous.EffectiveStartDate)
+	if period > 0 {
+		remaining := previous.EffectiveEndDate.Sub(asOf)
+		fraction = math.Max(0, math.Min(1, float64(remaining)/float64(period)))
+	}
+
+	proration := &api.Proration{
+		PreviousRate:      previous.Rate.Rate,
+		NewRate:           newRate,
+		FractionRemaining: fraction,
+	}
+	if previous.Paid {
+		proration.Credit = roundCurrency(previous.Rate.Rate * fraction)
+	}
+	if newPaid {
+		proration.Charge = roundCurrency(newRate * fraction)
+	}
+	proration.Net = roundCurrency(proration.Charge - proration.Credit)
+
+	return proration
+}
+
+func (a *App) changeSubscriptionPlan(ctx context.Context, request *api.ChangeSubscriptionPlanRequest) *api.ChangeSubscriptionPlanResponse {
+	response := &api.ChangeSubscriptionPlanResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
+
+	// A dry run computes the outcome in a transaction that's rolled back.
+	response.DryRun = request.DryRun
+
+	var eventData *api.SubscriptionEventData
+	err = d.InDryRunTx(ctx, request.DryRun, func(tx *goqu.TxDatabase) error {
+		eventData = nil
+
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return serrors.ErrPlanNotFound
+		}
+		newRate := plan.GetActiveRate()
+		if newRate == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		// Lock the current subscription so that other changes to it wait until
+		// this one is done.
+		previous, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx), db.WithForUpdate())
+		if err != nil {
+			return err
+		}
+
+		// Moving to a plan with less of a non-consumable resource than the user
+		// is already using has to be forced.
+		if !request.Force {
+			if response.ExceededQuotas, err = checkDowngrade(ctx, d, previous, plan, db.WithTX(tx)); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		proration := calculateProration(previous, newRate.Rate, request.Paid, now)
+
+		// End the current subscription now and start the new one, which ends
+		// when the current one would have.
+		if err = d.EndSubscription(ctx, previous.ID, requestedBy, db.WithTX(tx)); err != nil {
+			return err
+		}
+		opts := db.DefaultSubscriptionOptions()
+		opts.Paid = request.Paid
+		opts.EndDate = previous.EffectiveEndDate
+		opts.Perpetual = request.Perpetual || previous.Perpetual()
+		subscriptionID, err := d.SetActiveSubscription(ctx, previous.User.ID, plan, opts, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		eventData = &api.SubscriptionEventData{
+			SubscriptionID: subscriptionID,
+			Username:       username,
+			PlanName:       plan.Name,
+		}
+		if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionCreated, eventData); err != nil {
+			return err
+		}
+
+		response.Username = username
+		response.PlanName = plan.Name
+		response.PreviousSubscriptionID = previous.ID
+		response.SubscriptionID = subscriptionID
+		response.Perpetual = opts.Perpetual
+		if !opts.Perpetual {
+			response.EffectiveEndDate = opts.EndDate
+		}
+		response.Proration = proration
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if !request.DryRun {
+		a.notify(ctx, api.EventSubscriptionCreated, eventData)
+		a.invalidateSubscriptions(ctx, username)
+		a.projectOverages(ctx, username)
+	}
+
+	return response
+}
+
+// ChangeSubscriptionPlanHandler moves a user to a different plan immediately
+// and returns the prorated amounts owed for the rest of the period.
+func (a *App) ChangeSubscriptionPlanHandler(subject, reply string, request *api.ChangeSubscriptionPlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "changing subscription plan")
+
+	response := a.changeSubscriptionPlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ChangeSubscriptionPlanHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ChangeSubscriptionPlanRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.changeSubscriptionPlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
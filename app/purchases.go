@@ -0,0 +1,473 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultPurchaseDuration is the amount of time until a pending purchase
+// expires if the request doesn't say otherwise.
+const DefaultPurchaseDuration = 30 * time.Minute
+
+func (a *App) beginPurchase(ctx context.Context, request *api.BeginPurchaseRequest) *api.PurchaseResponse {
+	response := &api.PurchaseResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	periods, err := utils.PeriodsForRequestValue(request.Periods)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	duration := DefaultPurchaseDuration
+	if request.Duration != "" {
+		duration, err = time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidDuration)
+			return response
+		}
+	}
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
+
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return serrors.ErrPlanNotFound
+		}
+		rate := plan.GetActiveRate()
+		if rate == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		// Buying a plan with less of a non-consumable resource than the user is
+		// already using has to be forced.
+		current, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+		if err != nil && err != serrors.ErrSubscriptionNotFound {
+			return err
+		}
+		if current != nil && !request.Force {
+			if response.ExceededQuotas, err = checkDowngrade(ctx, d, current, plan, db.WithTX(tx)); err != nil {
+				return err
+			}
+		}
+
+		// A purchase that has expired but hasn't been marked yet mustn't keep the
+		// user from starting a new one.
+		if _, err = d.ExpirePurchases(ctx, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		id, err := d.AddPurchase(ctx, &db.Purchase{
+			UserID:    user.ID,
+			PlanID:    plan.ID,
+			Periods:   periods,
+			Amount:    rate.Rate * float64(periods),
+			Reference: sql.NullString{String: request.Reference, Valid: request.Reference != ""},
+			ExpiresAt: time.Now().Add(duration),
+			CreatedBy: requestedBy,
+		}, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		purchase, err := d.GetPurchase(ctx, id, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		response.Purchase = purchase.ToAPIType()
+
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+	}
+	return response
+}
+
+// BeginPurchaseHandler reserves a subscription purchase for a user so that a
+// checkout can charge for it before the user's subscription is changed.
+func (a *App) BeginPurchaseHandler(subject, reply string, request *api.BeginPurchaseRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "beginning subscription purchase")
+
+	response := a.beginPurchase(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) BeginPurchaseHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.BeginPurchaseRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.beginPurchase(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) commitPurchase(ctx context.Context, request *api.CommitPurchaseRequest) *api.PurchaseResponse {
+	response := &api.PurchaseResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	purchase, err := d.GetPurchase(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if purchase == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPurchaseNotFound)
+		return response
+	}
+	username := purchase.Username
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	var eventData *api.SubscriptionEventData
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		eventData = nil
+
+		// Lock the purchase so that it can't be committed or aborted twice.
+		purchase, err := d.GetPurchase(ctx, request.UUID, db.WithTX(tx), db.WithForUpdate())
+		if err != nil {
+			return err
+		}
+		if purchase == nil {
+			return serrors.ErrPurchaseNotFound
+		}
+		if purchase.Status != db.PurchaseStatusPending {
+			return serrors.ErrPurchaseNotPending
+		}
+		if !purchase.ExpiresAt.After(time.Now()) {
+			return serrors.ErrPurchaseExpired
+		}
+
+		plan, err := d.GetPlanByID(ctx, purchase.PlanID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		// End the current subscription, if there is one, and start the
+		// purchased one.
+		previous, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx), db.WithForUpdate())
+		if err != nil && err != serrors.ErrSubscriptionNotFound {
+			return err
+		}
+		if previous != nil {
+			if err = d.EndSubscription(ctx, previous.ID, requestedBy, db.WithTX(tx)); err != nil {
+				return err
+			}
+		}
+		subscriptionID, err := d.SetActiveSubscription(
+			ctx, purchase.UserID, plan, purchase.SubscriptionOptions(), db.WithTX(tx),
+		)
+		if err != nil {
+			return err
+		}
+
+		if err = d.CommitPurchase(ctx, purchase.ID, subscriptionID, request.PaymentReference, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		eventData = &api.SubscriptionEventData{
+			SubscriptionID: subscriptionID,
+			Username:       username,
+			PlanName:       plan.Name,
+		}
+		if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionCreated, eventData); err != nil {
+			return err
+		}
+
+		if purchase, err = d.GetPurchase(ctx, purchase.ID, db.WithTX(tx)); err != nil {
+			return err
+		}
+		response.Purchase = purchase.ToAPIType()
+
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	a.notify(ctx, api.EventSubscriptionCreated, eventData)
+	a.invalidateSubscriptions(ctx, username)
+	a.projectOverages(ctx, username)
+
+	return response
+}
+
+// CommitPurchaseHandler commits a pending purchase once it's been paid for,
+// replacing the user's current subscription with a paid subscription to the
+// purchased plan.
+func (a *App) CommitPurchaseHandler(subject, reply string, request *api.CommitPurchaseRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "committing subscription purchase")
+
+	response := a.commitPurchase(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) CommitPurchaseHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.CommitPurchaseRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.UUID = c.Param("id")
+
+	response := a.commitPurchase(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) abortPurchase(ctx context.Context, request *api.ByUUIDRequest) *api.PurchaseResponse {
+	response := &api.PurchaseResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	purchase, err := d.GetPurchase(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if purchase == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPurchaseNotFound)
+		return response
+	}
+
+	if err = d.AbortPurchase(ctx, request.UUID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if purchase, err = d.GetPurchase(ctx, request.UUID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Purchase = purchase.ToAPIType()
+	return response
+}
+
+// AbortPurchaseHandler abandons a pending purchase, such as when the payment
+// fails, so that the user can start another one. The user's subscription isn't
+// changed.
+func (a *App) AbortPurchaseHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "aborting subscription purchase")
+
+	response := a.abortPurchase(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AbortPurchaseHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{
+		UUID: c.Param("id"),
+	}
+
+	response := a.abortPurchase(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartPurchaseReaper marks pending purchases that have expired at regular
+// intervals until the context is done. Expired purchases can't be committed
+// either way; the reaper keeps their status up to date.
+func (a *App) StartPurchaseReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be updated while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			count, err := a.database(ctx).ExpirePurchases(ctx)
+			if err != nil {
+				log.Errorf("unable to expire subscription purchases: %s", err)
+				continue
+			}
+			if count > 0 {
+				log.Infof("expired %d subscription purchases", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,203 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) listQuarantinedUpdates(ctx context.Context, request *api.QuarantinedUpdatesRequest) *api.QuarantinedUpdateListResponse {
+	response := &api.QuarantinedUpdateListResponse{Updates: make([]*api.QuarantinedUsageUpdate, 0)}
+
+	status := request.Status
+	if status == "" {
+		status = api.QuarantinePending
+	}
+	switch status {
+	case api.QuarantinePending, api.QuarantineApproved, api.QuarantineRejected:
+	default:
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuarantineStatus)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	updates, err := d.ListQuarantinedUpdates(ctx, status, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for i := range updates {
+		response.Updates = append(response.Updates, updates[i].ToAPIType())
+	}
+	return response
+}
+
+// ListQuarantinedUpdatesHandler lists the usage updates that are held for
+// review, or the ones that have already been approved or rejected.
+func (a *App) ListQuarantinedUpdatesHandler(subject, reply string, request *api.QuarantinedUpdatesRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing quarantined usage updates")
+
+	response := a.listQuarantinedUpdates(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListQuarantinedUpdatesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.QuarantinedUpdatesRequest{Status: c.QueryParam("status")}
+
+	response := a.listQuarantinedUpdates(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// resolveQuarantinedUpdate approves or rejects a quarantined usage update.
+// Approved updates are applied to the usage, so the user's overages are
+// projected again afterwards.
+func (a *App) resolveQuarantinedUpdate(ctx context.Context, request *api.ResolveQuarantinedUpdateRequest, status string) *api.QuarantinedUpdateResponse {
+	response := &api.QuarantinedUpdateResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	var update *db.QuarantinedUsageUpdate
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+		update, err = d.ResolveQuarantinedUpdate(ctx, request.ID, status, requestedBy, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if status == api.QuarantineApproved {
+		a.projectOverages(ctx, update.Username)
+	}
+
+	response.Update = update.ToAPIType()
+	return response
+}
+
+// ApproveQuarantinedUpdateHandler applies a quarantined usage update.
+func (a *App) ApproveQuarantinedUpdateHandler(subject, reply string, request *api.ResolveQuarantinedUpdateRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "approving quarantined usage update")
+
+	response := a.resolveQuarantinedUpdate(ctx, request, api.QuarantineApproved)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// RejectQuarantinedUpdateHandler discards a quarantined usage update without
+// applying it.
+func (a *App) RejectQuarantinedUpdateHandler(subject, reply string, request *api.ResolveQuarantinedUpdateRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "rejecting quarantined usage update")
+
+	response := a.resolveQuarantinedUpdate(ctx, request, api.QuarantineRejected)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// resolveQuarantinedUpdateHTTP approves or rejects the quarantined usage update
+// named in the path of an HTTP request.
+func (a *App) resolveQuarantinedUpdateHTTP(c echo.Context, status string) error {
+	var (
+		err     error
+		request api.ResolveQuarantinedUpdateRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.ID = c.Param("id")
+
+	response := a.resolveQuarantinedUpdate(ctx, &request, status)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) ApproveQuarantinedUpdateHTTPHandler(c echo.Context) error {
+	return a.resolveQuarantinedUpdateHTTP(c, api.QuarantineApproved)
+}
+
+func (a *App) RejectQuarantinedUpdateHTTPHandler(c echo.Context) error {
+	return a.resolveQuarantinedUpdateHTTP(c, api.QuarantineRejected)
+}
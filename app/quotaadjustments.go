@@ -0,0 +1,278 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// adjustedQuota returns the new value of a quota after a bulk adjustment.
+func adjustedQuota(operation string, current, value float64) float64 {
+	if operation == api.QuotaAdjustmentSet {
+		return value
+	}
+	return current + value
+}
+
+// quotaAdjustmentUsernames returns the usernames of the users whose quotas
+// should be adjusted, either from the request itself or from the active
+// subscriptions to the requested plan.
+func (a *App) quotaAdjustmentUsernames(ctx context.Context, d *db.Database, request *api.AdjustQuotasRequest) ([]string, error) {
+	if request.PlanName == "" {
+		return a.cohortUsernames(request.Usernames)
+	}
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithIncludeDeleted())
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, serrors.ErrPlanNotFound
+	}
+
+	subscribers, err := d.PlanSubscribers(ctx, plan.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make([]string, len(subscribers))
+	for i, subscriber := range subscribers {
+		usernames[i] = subscriber.Username
+	}
+	return usernames, nil
+}
+
+func (a *App) adjustQuotas(ctx context.Context, request *api.AdjustQuotasRequest) *api.AdjustQuotasResponse {
+	response := &api.AdjustQuotasResponse{Results: make([]*api.QuotaAdjustmentResult, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Validate the incoming request.
+	if request.Operation != api.QuotaAdjustmentAdd && request.Operation != api.QuotaAdjustmentSet {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuotaAdjustment)
+		return response
+	}
+	if request.Operation == api.QuotaAdjustmentSet && request.Value < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuota)
+		return response
+	}
+	if (len(request.Usernames) == 0) == (request.PlanName == "") {
+		response.Error = serrors.NatsError(ctx, serrors.ErrNoAdjustmentTargets)
+		return response
+	}
+	response.Operation, response.Value, response.DryRun = request.Operation, request.Value, request.DryRun
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+	response.ResourceType = api.ResourceType{
+		ID:   resourceType.ID,
+		Name: resourceType.Name,
+		Unit: resourceType.Unit,
+	}
+
+	usernames, err := a.quotaAdjustmentUsernames(ctx, d, request)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	log := log.WithField("context", "adjusting quotas").WithField("dry_run", request.DryRun)
+	log.Infof(
+		"%s is adjusting the %s quota for %d users (%s %g)",
+		requestedBy, resourceType.Name, len(usernames), request.Operation, request.Value,
+	)
+
+	// A failed batch is rolled back and reported, but doesn't prevent the
+	// remaining batches from being processed.
+	batchSize := cohortBatchSize(request.BatchSize)
+	for start := 0; start < len(usernames); start += batchSize {
+		end := min(start+batchSize, len(usernames))
+		batch := usernames[start:end]
+
+		results, err := a.adjustQuotasBatch(ctx, d, batch, resourceType, request)
+		if err != nil {
+			log.Errorf("unable to adjust the quotas for users %d through %d: %s", start, end-1, err)
+			for _, username := range batch {
+				results = append(results, &api.QuotaAdjustmentResult{
+					Username: username,
+					Status:   api.QuotaAdjustmentFailed,
+					Message:  err.Error(),
+				})
+			}
+		} else if !request.DryRun {
+			a.invalidateSubscriptions(ctx, batch...)
+			a.projectOverages(ctx, batch...)
+		}
+
+		for _, result := range results {
+			switch result.Status {
+			case api.QuotaAdjustmentApplied:
+				response.Applied++
+			case api.QuotaAdjustmentSkipped:
+				response.Skipped++
+			default:
+				response.Failed++
+			}
+		}
+		response.Results = append(response.Results, results...)
+	}
+
+	return response
+}
+
+// adjustQuotasBatch adjusts the quotas for a single batch of users inside of a
+// single transaction and returns the outcome for each user. The results are
+// only meaningful if the transaction succeeded. The transaction is rolled back
+// in a dry run.
+func (a *App) adjustQuotasBatch(
+	ctx context.Context,
+	d *db.Database,
+	usernames []string,
+	resourceType *db.ResourceType,
+	request *api.AdjustQuotasRequest,
+) ([]*api.QuotaAdjustmentResult, error) {
+	var results []*api.QuotaAdjustmentResult
+
+	err := d.InDryRunTx(ctx, request.DryRun, func(tx *goqu.TxDatabase) error {
+		results = make([]*api.QuotaAdjustmentResult, 0, len(usernames))
+
+		subscriptions, err := d.ActiveSubscriptionsForUsers(ctx, usernames, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		byUsername := make(map[string]db.Subscription, len(subscriptions))
+		for _, subscription := range subscriptions {
+			byUsername[subscription.User.Username] = subscription
+		}
+
+		for _, username := range usernames {
+			result := &api.QuotaAdjustmentResult{Username: username}
+			results = append(results, result)
+
+			subscription, ok := byUsername[username]
+			if !ok {
+				result.Status = api.QuotaAdjustmentSkipped
+				result.Message = serrors.ErrSubscriptionNotFound.Error()
+				continue
+			}
+			result.SubscriptionID = subscription.ID
+
+			current, _, err := d.GetCurrentQuota(
+				ctx, resourceType.ID, subscription.ID, db.WithTX(tx), db.WithForUpdate(),
+			)
+			if err != nil {
+				return err
+			}
+			result.PreviousQuota = current
+			result.Quota = current
+
+			quota := adjustedQuota(request.Operation, current, request.Value)
+			if quota < 0 {
+				result.Status = api.QuotaAdjustmentSkipped
+				result.Message = serrors.ErrInvalidQuota.Error()
+				continue
+			}
+
+			if err = d.UpsertQuota(ctx, quota, resourceType.ID, subscription.ID, db.WithTX(tx)); err != nil {
+				return err
+			}
+			if err = a.recordEvent(ctx, d, tx, api.EventQuotaUpdated, &api.QuotaEventData{
+				SubscriptionID: subscription.ID,
+				Username:       username,
+				ResourceName:   resourceType.Name,
+				Quota:          quota,
+			}); err != nil {
+				return err
+			}
+
+			result.Status = api.QuotaAdjustmentApplied
+			result.Quota = quota
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// AdjustQuotasBatchHandler applies the same adjustment to the quota for a
+// resource type in the active subscriptions of a list of users or of everyone
+// subscribed to a plan, and reports the outcome for each user.
+func (a *App) AdjustQuotasBatchHandler(subject, reply string, request *api.AdjustQuotasRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adjusting quotas")
+
+	response := a.adjustQuotas(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AdjustQuotasBatchHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.AdjustQuotasRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.adjustQuotas(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
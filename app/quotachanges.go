@@ -0,0 +1,392 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// quotaChangeBatchSize is the maximum number of quota changes that are applied
+// each time the worker runs.
+const quotaChangeBatchSize = 100
+
+func (a *App) scheduleQuotaChange(ctx context.Context, request *api.QuotaChangeRequest) *api.QuotaChangeResponse {
+	response := &api.QuotaChangeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Quota < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuota)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	effectiveDate, err := utils.ParseTimestamp(request.EffectiveDate)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidEffectiveDate)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	subscription, err := d.GetActiveSubscription(ctx, username, a.subscriptionOpts()...)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Quotas belong to subscriptions, so the change has to take effect in the
+	// future but before the current subscription ends, if it ever does.
+	endsFirst := !subscription.Perpetual() && !effectiveDate.Before(subscription.EffectiveEndDate)
+	if !effectiveDate.After(time.Now()) || endsFirst {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidEffectiveDate)
+		return response
+	}
+
+	change := &db.QuotaChange{
+		SubscriptionID: subscription.ID,
+		ResourceType:   *resourceType,
+		Quota:          request.Quota,
+		EffectiveDate:  effectiveDate,
+		CreatedBy:      requestedBy,
+	}
+
+	id, err := d.AddQuotaChange(ctx, change)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if change, err = d.GetQuotaChange(ctx, id); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.QuotaChange = change.ToAPIType()
+	return response
+}
+
+// ScheduleQuotaChangeHandler schedules a change to the quota for a resource
+// type in a user's current subscription that takes effect on a future date.
+func (a *App) ScheduleQuotaChangeHandler(subject, reply string, request *api.QuotaChangeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "scheduling quota change")
+
+	response := a.scheduleQuotaChange(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ScheduleQuotaChangeHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.QuotaChangeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.scheduleQuotaChange(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listQuotaChanges(ctx context.Context, request *api.ByUsernameRequest) *api.QuotaChangeListResponse {
+	response := &api.QuotaChangeListResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	changes, err := d.ListQuotaChangesForUser(ctx, username, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.QuotaChanges = make([]*api.QuotaChange, len(changes))
+	for i, change := range changes {
+		response.QuotaChanges[i] = change.ToAPIType()
+	}
+
+	return response
+}
+
+// ListQuotaChangesHandler lists the quota changes that have been scheduled for
+// a user.
+func (a *App) ListQuotaChangesHandler(subject, reply string, request *api.ByUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing quota changes")
+
+	response := a.listQuotaChanges(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListQuotaChangesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUsernameRequest{Username: c.Param("username")}
+	response := a.listQuotaChanges(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) cancelQuotaChange(ctx context.Context, request *api.ByUUIDRequest) *api.QuotaChangeResponse {
+	response := &api.QuotaChangeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	change, err := d.GetQuotaChange(ctx, request.UUID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = d.DeleteQuotaChange(ctx, request.UUID, db.WithTX(tx)); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = tx.Commit(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.QuotaChange = change.ToAPIType()
+	return response
+}
+
+// CancelQuotaChangeHandler cancels a quota change that hasn't been applied yet.
+func (a *App) CancelQuotaChangeHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "cancelling quota change")
+
+	response := a.cancelQuotaChange(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) CancelQuotaChangeHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{UUID: c.Param("id")}
+	response := a.cancelQuotaChange(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartQuotaChangeWorker copies quota changes that have come due into the
+// quotas table at regular intervals until the context is done. Quota lookups
+// take changes that have come due into account anyway, but the worker keeps
+// the quotas table, cached subscriptions, and projected overages up to date.
+func (a *App) StartQuotaChangeWorker(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be applied while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			// Keep going until there's nothing left to apply.
+			for {
+				count, err := a.ApplyDueQuotaChanges(ctx)
+				if err != nil {
+					log.Errorf("unable to apply quota changes: %s", err)
+				}
+				if err != nil || count < quotaChangeBatchSize {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// ApplyDueQuotaChanges applies a single batch of quota changes that have come
+// due and returns the number of quota changes that were applied. Each quota
+// change is applied in its own transaction.
+func (a *App) ApplyDueQuotaChanges(ctx context.Context) (int, error) {
+	d := a.database(ctx)
+
+	changes, err := d.DueQuotaChanges(ctx, quotaChangeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, change := range changes {
+		log := log.WithFields(logrus.Fields{"context": "applying quota change", "quota_change": change.ID})
+
+		if err = a.applyQuotaChange(ctx, d, &change); err != nil {
+			log.Errorf("unable to apply the quota change: %s", err)
+			continue
+		}
+		applied++
+
+		log.Infof("applied the scheduled %s quota change for %s", change.ResourceType.Name, change.Username)
+		a.invalidateSubscriptions(ctx, change.Username)
+		a.projectSubscriptionOverages(ctx, change.SubscriptionID)
+	}
+
+	return applied, nil
+}
+
+// applyQuotaChange copies the current quota for the subscription and resource
+// type of a quota change into the quotas table, which marks the quota change as
+// applied.
+func (a *App) applyQuotaChange(ctx context.Context, d *db.Database, change *db.QuotaChange) error {
+	return d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		// Look the quota up again in case it was changed after the quota change
+		// came due.
+		quota, _, err := d.GetCurrentQuota(ctx, change.ResourceType.ID, change.SubscriptionID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if err = d.UpsertQuota(ctx, quota, change.ResourceType.ID, change.SubscriptionID, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		return a.recordEvent(ctx, d, tx, api.EventQuotaUpdated, &api.QuotaEventData{
+			SubscriptionID: change.SubscriptionID,
+			Username:       change.Username,
+			ResourceName:   change.ResourceType.Name,
+			Quota:          quota,
+		})
+	})
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) setQuotaExemptPlan(ctx context.Context, request *api.QuotaExemptPlanRequest) *api.QuotaExemptPlanResponse {
+	response := &api.QuotaExemptPlanResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	if err = d.SetPlanQuotaExempt(ctx, plan.ID, request.QuotaExempt); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	a.invalidatePlanSubscriptions(ctx, d, plan.ID)
+
+	response.PlanName = plan.Name
+	response.QuotaExempt = request.QuotaExempt
+	return response
+}
+
+// SetQuotaExemptPlanHandler changes whether the subscriptions to a plan are
+// exempt from their quotas.
+func (a *App) SetQuotaExemptPlanHandler(subject, reply string, request *api.QuotaExemptPlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting quota-exempt plan")
+
+	response := a.setQuotaExemptPlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetQuotaExemptPlanHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.QuotaExemptPlanRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+
+	response := a.setQuotaExemptPlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
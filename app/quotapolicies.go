@@ -0,0 +1,349 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) setQuotaPolicy(ctx context.Context, request *api.QuotaPolicyRequest) *api.QuotaPolicyResponse {
+	response := &api.QuotaPolicyResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Mode != api.QuotaPolicyHard && request.Mode != api.QuotaPolicySoft {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidQuotaPolicy)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	policy := &db.QuotaPolicy{
+		ResourceType:   *resourceType,
+		Mode:           request.Mode,
+		EnforceInGrace: request.EnforceInGrace,
+		LastModifiedBy: requestedBy,
+	}
+	if err = d.SetQuotaPolicy(ctx, policy); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Policy = policy.ToAPIType()
+	return response
+}
+
+// SetQuotaPolicyHandler sets the policy that determines whether consumption of
+// a resource beyond the quota is denied or only warned about.
+func (a *App) SetQuotaPolicyHandler(subject, reply string, request *api.QuotaPolicyRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting quota policy")
+
+	response := a.setQuotaPolicy(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetQuotaPolicyHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.QuotaPolicyRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.setQuotaPolicy(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listQuotaPolicies(ctx context.Context) *api.QuotaPolicyListResponse {
+	response := &api.QuotaPolicyListResponse{Policies: make([]*api.QuotaPolicy, 0)}
+	d := a.readDatabase(ctx)
+
+	policies, err := d.ListQuotaPolicies(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for i := range policies {
+		response.Policies = append(response.Policies, policies[i].ToAPIType())
+	}
+	return response
+}
+
+// ListQuotaPoliciesHandler lists the quota policy of every resource type.
+func (a *App) ListQuotaPoliciesHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing quota policies")
+
+	response := a.listQuotaPolicies(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListQuotaPoliciesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listQuotaPolicies(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// decideQuota fills in whether the requested amount is allowed under the
+// policy, along with the reasons for the decision. The quota, usage, reserved
+// amount, requested amount and subscription state must already be set.
+// Subscriptions to quota-exempt plans are allowed to exceed their quotas, since
+// their overages are never enforced.
+func decideQuota(decision *api.QuotaDecision, policy *db.QuotaPolicy, quotaExempt bool) {
+	unit := decision.ResourceType.Unit
+	decision.Policy = policy.Mode
+	decision.Remaining = max(decision.Quota-decision.Usage-decision.Reserved, 0)
+	decision.Reasons = make([]*api.EnforcementReason, 0)
+
+	reason := func(code, format string, args ...any) {
+		decision.Reasons = append(decision.Reasons, &api.EnforcementReason{
+			Code:    code,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if decision.Reserved > 0 {
+		reason(api.EnforcementReserved, "%g %s of the quota is reserved", decision.Reserved, unit)
+	}
+
+	if decision.Usage+decision.Reserved+decision.Requested <= decision.Quota {
+		decision.Allowed = true
+		reason(api.EnforcementWithinQuota, "%g %s of the quota is left", decision.Remaining, unit)
+		return
+	}
+
+	reason(
+		api.EnforcementQuotaExceeded, "%g %s were requested, but only %g %s of the quota is left",
+		decision.Requested, unit, decision.Remaining, unit,
+	)
+
+	switch {
+	case quotaExempt:
+		decision.Allowed = true
+		reason(api.EnforcementQuotaExempt, "the quota isn't enforced for subscriptions to quota-exempt plans")
+	case decision.SubscriptionState == db.SubscriptionStateGrace && !policy.EnforceInGrace:
+		decision.Allowed = true
+		reason(api.EnforcementGracePeriod, "the quota isn't enforced while the subscription is in its grace period")
+	case policy.Mode == api.QuotaPolicySoft:
+		decision.Allowed = true
+		reason(
+			api.EnforcementSoftLimit, "the quota policy for %s only warns about exceeding the quota",
+			decision.ResourceType.Name,
+		)
+	}
+}
+
+func (a *App) enforceQuota(ctx context.Context, request *api.EnforceQuotaRequest) *api.EnforceQuotaResponse {
+	response := &api.EnforceQuotaResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Amount < 0 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidAmount)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	policy, err := d.GetQuotaPolicy(ctx, resourceType, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	quota, _, err := d.GetCurrentQuota(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	usage, _, err := d.GetCurrentUsage(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	quotaExempt, err := d.IsPlanQuotaExempt(ctx, subscription.Plan.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Reservations only count against the quota if they're enabled.
+	var reserved float64
+	if a.reservations {
+		reserved, err = d.ReservedAmount(ctx, subscription.ID, resourceType.ID, db.WithReadReplica())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	response.Decision = &api.QuotaDecision{
+		Username: username,
+		ResourceType: api.ResourceType{
+			ID:   resourceType.ID,
+			Name: resourceType.Name,
+			Unit: resourceType.Unit,
+		},
+		SubscriptionState: a.subscriptionState(subscription.EffectiveEndDate),
+		Requested:         request.Amount,
+		Quota:             quota,
+		Usage:             usage,
+		Reserved:          reserved,
+	}
+	decideQuota(response.Decision, policy, quotaExempt)
+
+	return response
+}
+
+// EnforceQuotaHandler decides whether a user may consume an amount of a
+// resource, taking the user's usage, reservations and quota policy into
+// account.
+func (a *App) EnforceQuotaHandler(subject, reply string, request *api.EnforceQuotaRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "enforcing quota")
+
+	response := a.enforceQuota(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) EnforceQuotaHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.EnforceQuotaRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.enforceQuota(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
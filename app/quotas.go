@@ -8,27 +8,58 @@ import (
 	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
 	"github.com/labstack/echo/v4"
 )
 
-func (a *App) addQuota(ctx context.Context, request *qms.AddQuotaRequest) *qms.QuotaResponse {
+// addQuota sets the quota for a resource type in a subscription. In a dry run,
+// the response describes the outcome, but the transaction is rolled back.
+func (a *App) addQuota(ctx context.Context, request *qms.AddQuotaRequest, expectedVersion, dryRunValue string) *qms.QuotaResponse {
 	var err error
 	response := pbinit.NewQuotaResponse()
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
 
-	subscriptionID := request.Quota.SubscriptionId
-
-	d := db.New(a.db)
-
-	if err = d.UpsertQuota(ctx, float64(request.Quota.Quota), request.Quota.ResourceType.Uuid, subscriptionID); err != nil {
+	dryRun, err := parseDryRun(dryRunValue)
+	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
+	setDryRunHeader(response.Header, dryRun)
+
+	subscriptionID := request.Quota.SubscriptionId
 
-	value, _, err := d.GetCurrentQuota(ctx, request.Quota.ResourceType.Uuid, subscriptionID)
+	d := a.database(ctx)
+
+	var (
+		version int64
+		value   float64
+	)
+	err = d.InDryRunTx(ctx, dryRun, func(tx *goqu.TxDatabase) error {
+		opts, err := expectedVersionOpts(expectedVersion, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		version, err = d.SetQuota(ctx, float64(request.Quota.Quota), request.Quota.ResourceType.Uuid, subscriptionID, opts...)
+		if err != nil {
+			return err
+		}
+
+		value, _, err = d.GetCurrentQuota(ctx, request.Quota.ResourceType.Uuid, subscriptionID, db.WithTX(tx))
+		return err
+	})
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
+	setVersionHeader(response.Header, version)
+	if !dryRun {
+		a.invalidateSubscriptionOwner(ctx, d, subscriptionID)
+		a.projectSubscriptionOverages(ctx, subscriptionID)
+	}
 
 	response.Quota = &qms.Quota{
 		Quota:          value,
@@ -47,10 +78,13 @@ func (a *App) AddQuotaHandler(subject, reply string, request *qms.AddQuotaReques
 	ctx, span := pbinit.InitQMSAddQuotaRequest(request, subject)
 	defer span.End()
 
-	response := a.addQuota(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.AddQuota(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -72,11 +106,15 @@ func (a *App) AddQuotaHTTPHandler(c echo.Context) error {
 		})
 	}
 
-	response := a.addQuota(ctx, &request)
+	response := a.addQuota(ctx, &request, c.Request().Header.Get(ExpectedVersionHeader), c.QueryParam("dry_run"))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	setHTTPVersionHeader(c, response.Header)
+	setHTTPDryRunHeader(c, response.Header)
+
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
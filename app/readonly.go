@@ -0,0 +1,22 @@
+package app
+
+import (
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// SetReadOnlyMonitor configures the monitor used to determine whether the
+// database currently accepts writes.
+func (a *App) SetReadOnlyMonitor(monitor *db.ReadOnlyMonitor) {
+	a.readOnly = monitor
+}
+
+// checkWritable returns ErrDatabaseReadOnly if the database is known to be
+// read-only. Handlers that modify the database call this before doing anything
+// else so that callers get a clear error that they can retry.
+func (a *App) checkWritable() error {
+	if a.readOnly != nil && a.readOnly.ReadOnly() {
+		return serrors.ErrDatabaseReadOnly
+	}
+	return nil
+}
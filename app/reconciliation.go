@@ -0,0 +1,352 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/service"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultReconciliationTimeout is the default amount of time to wait for a
+// source system to report its usage totals.
+const DefaultReconciliationTimeout = time.Minute
+
+// ReconciliationSource is a system that keeps the authoritative usage totals
+// for a resource type, such as the data store for data.size. The system reports
+// the totals in response to SourceTotalsRequest messages sent to its subject.
+type ReconciliationSource struct {
+	ResourceType string
+	Subject      string
+}
+
+// ReconciliationSettings controls how usages are reconciled against the source
+// systems.
+type ReconciliationSettings struct {
+	// Sources lists the source systems to query. Usages aren't reconciled if
+	// it's empty.
+	Sources []ReconciliationSource
+
+	// Tolerance is the largest difference between a usage and the source
+	// system's total, as a fraction of the total, that isn't reported as drift.
+	Tolerance float64
+
+	// Correct makes the reconciliation worker record SET updates that replace
+	// the usages that have drifted with the source systems' totals. Drift is
+	// only reported otherwise.
+	Correct bool
+
+	// Timeout is the amount of time to wait for each source system to report
+	// its totals. It defaults to DefaultReconciliationTimeout.
+	Timeout time.Duration
+}
+
+// driftCounter counts the usages that differed from the source systems' totals
+// by more than the tolerance.
+var driftCounter metric.Int64Counter
+
+func init() {
+	var err error
+	driftCounter, err = otel.Meter("github.com/cyverse-de/subscriptions/app").Int64Counter(
+		"qms.reconciliation.drifts",
+		metric.WithDescription("The number of usages that drifted from the totals reported by the source systems."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the reconciliation counter: %s", err)
+	}
+}
+
+// SetReconciliation sets how usages are reconciled against the source systems.
+func (a *App) SetReconciliation(settings ReconciliationSettings) {
+	if settings.Timeout <= 0 {
+		settings.Timeout = DefaultReconciliationTimeout
+	}
+	a.reconciliation = settings
+}
+
+// driftExceeds returns true if a usage differs from the source system's total
+// by more than the tolerance allows.
+func driftExceeds(sourceValue, qmsValue, tolerance float64) bool {
+	return math.Abs(sourceValue-qmsValue) > tolerance*math.Abs(sourceValue)
+}
+
+// correctUsage records a SET update that replaces a user's usage with the
+// source system's total.
+func (a *App) correctUsage(ctx context.Context, resourceType *db.ResourceType, username string, value float64) error {
+	request := &qms.AddUpdateRequest{
+		Update: &qms.Update{
+			EffectiveDate: timestamppb.Now(),
+			ValueType:     db.UsagesTrackedMetric,
+			Value:         value,
+			ResourceType: &qms.ResourceType{
+				Name: resourceType.Name,
+				Unit: resourceType.Unit,
+			},
+			Operation: &qms.UpdateOperation{
+				Name: db.UpdateTypeSet,
+			},
+			User: &qms.QMSUser{
+				Username: username,
+			},
+		},
+	}
+
+	response := a.addUserUpdate(ctx, request, "")
+	return service.ResponseError(response.Error)
+}
+
+// reconcileSource compares the usages of a resource type with the totals
+// reported by its source system. Only the users that the source system reports
+// are compared; the others are left alone.
+func (a *App) reconcileSource(ctx context.Context, source ReconciliationSource, correct bool) *api.ReconciliationResult {
+	result := &api.ReconciliationResult{
+		ResourceType: source.ResourceType,
+		Subject:      source.Subject,
+		Drifts:       make([]*api.UsageDrift, 0),
+	}
+
+	d := a.readDatabase(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, source.ResourceType, db.WithReadReplica())
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if resourceType.ID == "" {
+		result.Error = serrors.ErrResourceTypeNotFound.Error()
+		return result
+	}
+
+	requestCtx, cancel := context.WithTimeout(ctx, a.reconciliation.Timeout)
+	defer cancel()
+
+	request := &api.SourceTotalsRequest{ResourceType: resourceType.Name}
+	response := &api.SourceTotalsResponse{}
+	if err = a.client.RequestJSON(requestCtx, source.Subject, request, response); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	current, err := d.CurrentUsagesByResourceType(ctx, resourceType.ID, db.WithReadReplica())
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	usages := make(map[string]float64, len(current))
+	for _, usage := range current {
+		usages[usage.Username] = usage.Usage
+	}
+
+	for _, total := range response.Totals {
+		sourceValue := total.Value
+		if response.Unit != "" {
+			if sourceValue, err = convertToResourceUnit(sourceValue, response.Unit, resourceType); err != nil {
+				result.Error = err.Error()
+				return result
+			}
+		}
+
+		username, err := a.FixUsername(total.Username)
+		if err != nil {
+			result.Drifts = append(result.Drifts, &api.UsageDrift{Username: total.Username, Error: err.Error()})
+			continue
+		}
+
+		// Users without an active subscription haven't used anything as far as
+		// QMS is concerned.
+		result.Users++
+		qmsValue := usages[username]
+		if !driftExceeds(sourceValue, qmsValue, a.reconciliation.Tolerance) {
+			continue
+		}
+
+		drift := &api.UsageDrift{
+			Username:    username,
+			SourceValue: sourceValue,
+			QMSValue:    qmsValue,
+			Drift:       sourceValue - qmsValue,
+		}
+		if correct {
+			if err = a.correctUsage(ctx, resourceType, username, sourceValue); err != nil {
+				drift.Error = err.Error()
+			} else {
+				drift.Corrected = true
+			}
+		}
+		result.Drifts = append(result.Drifts, drift)
+
+		if driftCounter != nil {
+			driftCounter.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("resource_type", resourceType.Name),
+				attribute.Bool("corrected", drift.Corrected),
+			))
+		}
+	}
+
+	return result
+}
+
+// Reconcile compares the usages of each resource type that has a source system
+// with the totals that the source system reports, and returns the drift that's
+// beyond the tolerance. If correct is true, the usages that have drifted are
+// replaced with the source systems' totals. If resourceType isn't empty, only
+// its source system is queried. Returns ErrReconciliationDisabled if there
+// aren't any source systems, and ErrReconciliationSourceNotFound if the resource
+// type doesn't have one.
+func (a *App) Reconcile(ctx context.Context, resourceType string, correct bool) ([]*api.ReconciliationResult, error) {
+	if len(a.reconciliation.Sources) == 0 {
+		return nil, serrors.ErrReconciliationDisabled
+	}
+
+	results := make([]*api.ReconciliationResult, 0, len(a.reconciliation.Sources))
+	for _, source := range a.reconciliation.Sources {
+		if resourceType != "" && source.ResourceType != resourceType {
+			continue
+		}
+		results = append(results, a.reconcileSource(ctx, source, correct))
+	}
+	if len(results) == 0 {
+		return nil, serrors.ErrReconciliationSourceNotFound
+	}
+
+	return results, nil
+}
+
+func (a *App) runReconciliation(ctx context.Context, request *api.ReconciliationRequest) *api.ReconciliationResponse {
+	response := &api.ReconciliationResponse{
+		Tolerance: a.reconciliation.Tolerance,
+		Correct:   request.Correct,
+		Results:   make([]*api.ReconciliationResult, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.Correct {
+		if err := a.checkWritable(); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	results, err := a.Reconcile(ctx, request.ResourceType, request.Correct)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Results = results
+	return response
+}
+
+// RunReconciliationHandler reconciles usages against the source systems on
+// demand, optionally correcting the drift.
+func (a *App) RunReconciliationHandler(subject, reply string, request *api.ReconciliationRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reconciling usages")
+
+	response := a.runReconciliation(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) RunReconciliationHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ReconciliationRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.runReconciliation(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// logReconciliation logs the outcome of a run of the reconciliation worker.
+func logReconciliation(results []*api.ReconciliationResult) {
+	for _, result := range results {
+		log := log.WithFields(logrus.Fields{"resource_type": result.ResourceType, "subject": result.Subject})
+		if result.Error != "" {
+			log.Errorf("unable to reconcile usages: %s", result.Error)
+			continue
+		}
+		for _, drift := range result.Drifts {
+			log.WithFields(logrus.Fields{
+				"user":      drift.Username,
+				"source":    drift.SourceValue,
+				"qms":       drift.QMSValue,
+				"drift":     drift.Drift,
+				"corrected": drift.Corrected,
+			}).Warn("usage drifted from the source system's total")
+			if drift.Error != "" {
+				log.Errorf("unable to correct the usage of %s: %s", drift.Username, drift.Error)
+			}
+		}
+		log.Infof("compared the usages of %d users and found %d that drifted", result.Users, len(result.Drifts))
+	}
+}
+
+// StartReconciliationWorker reconciles usages against the source systems at
+// regular intervals until the context is done.
+func (a *App) StartReconciliationWorker(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Drift can't be corrected while the database is read-only, but it
+			// can still be reported.
+			correct := a.reconciliation.Correct && a.checkWritable() == nil
+
+			results, err := a.Reconcile(ctx, "", correct)
+			if err != nil {
+				log.Errorf("unable to reconcile usages: %s", err)
+				continue
+			}
+			logReconciliation(results)
+		}
+	}()
+}
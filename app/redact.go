@@ -0,0 +1,169 @@
+package app
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// CallerRoleHeader is the name of the message header (and HTTP header) used to
+// indicate the role of the caller. It can only lower the caller's role; callers
+// can't make themselves administrators with it.
+const CallerRoleHeader = "x-qms-caller-role"
+
+// AdminTokenHeader is the name of the message header (and HTTP header) that
+// administrators use to present the admin token. Only callers that present the
+// configured token are treated as administrators.
+const AdminTokenHeader = "x-qms-admin-token"
+
+// CallerRole indicates what a caller is allowed to see in responses.
+type CallerRole string
+
+const (
+	// RoleAdmin callers can see every field in every response.
+	RoleAdmin CallerRole = "admin"
+
+	// RoleUser callers can't see sensitive fields such as rates, paid status
+	// and the names of the users who created or modified records.
+	RoleUser CallerRole = "user"
+)
+
+// ParseCallerRole converts a string to a CallerRole. The second return value
+// is false if the string doesn't name a known role.
+func ParseCallerRole(value string) (CallerRole, bool) {
+	switch CallerRole(strings.ToLower(strings.TrimSpace(value))) {
+	case RoleAdmin:
+		return RoleAdmin, true
+	case RoleUser:
+		return RoleUser, true
+	default:
+		return "", false
+	}
+}
+
+// redactedFields lists the names of protocol buffer fields that are removed
+// from responses sent to callers that aren't administrators.
+var redactedFields = map[protoreflect.Name]bool{
+	"rate":             true,
+	"plan_rate":        true,
+	"plan_rates":       true,
+	"addon_rate":       true,
+	"addon_rates":      true,
+	"paid":             true,
+	"default_paid":     true,
+	"created_by":       true,
+	"last_modified_by": true,
+}
+
+// isAdminToken returns true if the token matches the configured admin token.
+// No token is accepted if an admin token isn't configured.
+func (a *App) isAdminToken(token string) bool {
+	if a.adminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) == 1
+}
+
+// resolveRole determines the role of a caller from the admin token that it
+// presented and the role that it asked for. Callers that present the admin
+// token are administrators, and everyone else is assigned the default role.
+// Asking for the user role lowers the caller's role, so that administrators
+// can see what users see, but asking for the admin role doesn't raise it.
+func (a *App) resolveRole(token, requested string) CallerRole {
+	if role, ok := ParseCallerRole(requested); ok && role == RoleUser {
+		return RoleUser
+	}
+	if a.isAdminToken(token) {
+		return RoleAdmin
+	}
+	return a.DefaultCallerRole
+}
+
+// callerRole determines the role of the caller from a NATS message header.
+func (a *App) callerRole(h *header.Header) CallerRole {
+	return a.resolveRole(headerValue(h, AdminTokenHeader), headerValue(h, CallerRoleHeader))
+}
+
+// apiCallerRole determines the role of the caller from the header of a plain
+// JSON message.
+func (a *App) apiCallerRole(h api.Header) CallerRole {
+	return a.resolveRole(h[AdminTokenHeader], h[CallerRoleHeader])
+}
+
+// httpCallerRole determines the role of the caller from an HTTP request.
+func (a *App) httpCallerRole(c echo.Context) CallerRole {
+	h := c.Request().Header
+	return a.resolveRole(h.Get(AdminTokenHeader), h.Get(CallerRoleHeader))
+}
+
+// requireAdmin is middleware that refuses requests from callers that don't
+// present the admin token, unless every caller is treated as an administrator.
+func (a *App) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.DefaultCallerRole != RoleAdmin && !a.isAdminToken(c.Request().Header.Get(AdminTokenHeader)) {
+			return echo.NewHTTPError(http.StatusUnauthorized, "the admin token is required")
+		}
+		return next(c)
+	}
+}
+
+// redact removes the fields from a response that a caller with the given role
+// isn't allowed to see. Responses are modified in place.
+func redact(role CallerRole, response proto.Message) {
+	if role == RoleAdmin || response == nil {
+		return
+	}
+	redactMessage(response.ProtoReflect())
+}
+
+// redactAPI removes the fields from a plain JSON response that a caller with the
+// given role isn't allowed to see.
+func redactAPI(role CallerRole, response api.Redactor) {
+	if role == RoleAdmin || response == nil {
+		return
+	}
+	response.Redact()
+}
+
+// redactMessage recursively clears the redacted fields in a message.
+func redactMessage(m protoreflect.Message) {
+	if !m.IsValid() {
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if redactedFields[fd.Name()] {
+			m.Clear(fd)
+			return true
+		}
+
+		if fd.Kind() != protoreflect.MessageKind && fd.Kind() != protoreflect.GroupKind {
+			return true
+		}
+
+		switch {
+		case fd.IsList():
+			list := v.List()
+			for i := 0; i < list.Len(); i++ {
+				redactMessage(list.Get(i).Message())
+			}
+		case fd.IsMap():
+			if fd.MapValue().Kind() == protoreflect.MessageKind {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					redactMessage(mv.Message())
+					return true
+				})
+			}
+		default:
+			redactMessage(v.Message())
+		}
+
+		return true
+	})
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestResolveRole(t *testing.T) {
+	const token = "secret"
+
+	tests := []struct {
+		name        string
+		adminToken  string
+		defaultRole CallerRole
+		token       string
+		requested   string
+		expected    CallerRole
+	}{
+		{name: "anonymous", adminToken: token, defaultRole: RoleUser, expected: RoleUser},
+		{name: "admin token", adminToken: token, defaultRole: RoleUser, token: token, expected: RoleAdmin},
+		{name: "wrong token", adminToken: token, defaultRole: RoleUser, token: "guess", expected: RoleUser},
+		{name: "claimed admin role", adminToken: token, defaultRole: RoleUser, requested: "admin", expected: RoleUser},
+		{name: "admin asking for user", adminToken: token, defaultRole: RoleUser, token: token, requested: "user", expected: RoleUser},
+		{name: "no admin token configured", defaultRole: RoleUser, requested: "admin", expected: RoleUser},
+		{name: "empty token", defaultRole: RoleUser, token: "", expected: RoleUser},
+		{name: "trusted network", defaultRole: RoleAdmin, expected: RoleAdmin},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &App{adminToken: tc.adminToken, DefaultCallerRole: tc.defaultRole}
+			if role := a.resolveRole(tc.token, tc.requested); role != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, role)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	const token = "secret"
+
+	tests := []struct {
+		name        string
+		defaultRole CallerRole
+		token       string
+		expected    int
+	}{
+		{name: "admin token", defaultRole: RoleUser, token: token, expected: http.StatusOK},
+		{name: "no token", defaultRole: RoleUser, expected: http.StatusUnauthorized},
+		{name: "wrong token", defaultRole: RoleUser, token: "guess", expected: http.StatusUnauthorized},
+		{name: "trusted network", defaultRole: RoleAdmin, expected: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &App{adminToken: token, DefaultCallerRole: tc.defaultRole}
+			router := echo.New()
+			router.Group("/admin", a.requireAdmin).GET("/users", func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+			if tc.token != "" {
+				req.Header.Set(AdminTokenHeader, tc.token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// reminderBatchSize is the maximum number of expiration reminders for a single
+// reminder window that are sent at a time.
+const reminderBatchSize = 100
+
+// DefaultReminderWindows returns the number of days before the end of a
+// subscription that expiration reminders are sent by default.
+func DefaultReminderWindows() []int32 {
+	return []int32{30, 7, 1}
+}
+
+// StartExpirationReminderWorker sends expiration reminders for subscriptions
+// that end within each of the reminder windows, which are numbers of days, at
+// regular intervals until the context is done. A subscription only gets a
+// reminder for the shortest window that it's in, so a subscription that ends
+// in five days when the reminders are first sent gets the seven day reminder
+// but not the thirty day reminder.
+func (a *App) StartExpirationReminderWorker(ctx context.Context, interval time.Duration, windows []int32) {
+	windows = slices.Clone(windows)
+	slices.Sort(windows)
+	windows = slices.Compact(windows)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Reminders can't be recorded while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			now := time.Now()
+			for i, window := range windows {
+				if window <= 0 {
+					continue
+				}
+
+				// The window starts where the next shorter window ends.
+				after := now
+				if i > 0 && windows[i-1] > 0 {
+					after = now.AddDate(0, 0, int(windows[i-1]))
+				}
+				before := now.AddDate(0, 0, int(window))
+
+				// Keep going until there's nothing left to send.
+				for {
+					count, err := a.SendExpirationReminders(ctx, window, after, before)
+					if err != nil {
+						log.Errorf("unable to send %d day expiration reminders: %s", window, err)
+					}
+					if err != nil || count < reminderBatchSize {
+						break
+					}
+				}
+			}
+		}
+	}()
+}
+
+// SendExpirationReminders sends a single batch of reminders for the
+// subscriptions that end after the first time and no later than the second,
+// and returns the number of reminders that were sent. Each subscription only
+// receives one reminder for each window.
+func (a *App) SendExpirationReminders(ctx context.Context, windowDays int32, after, before time.Time) (int, error) {
+	d := a.database(ctx)
+
+	var subscriptions []db.ExpiringSubscription
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+
+		subscriptions, err = d.SubscriptionsDueReminders(ctx, windowDays, after, before, reminderBatchSize, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(subscriptions))
+		for i, subscription := range subscriptions {
+			ids[i] = subscription.SubscriptionID
+			eventData := reminderEventData(&subscription, windowDays)
+			if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionExpiring, eventData); err != nil {
+				return err
+			}
+		}
+
+		return d.MarkRemindersSent(ctx, windowDays, ids, db.WithTX(tx))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, subscription := range subscriptions {
+		log.Infof("the %s subscription for %s ends at %s", subscription.PlanName, subscription.Username, subscription.EndsAt)
+		a.notify(ctx, api.EventSubscriptionExpiring, reminderEventData(&subscription, windowDays))
+	}
+
+	return len(subscriptions), nil
+}
+
+// reminderEventData returns the event data for an expiration reminder.
+func reminderEventData(subscription *db.ExpiringSubscription, windowDays int32) *api.ExpirationReminderEventData {
+	return &api.ExpirationReminderEventData{
+		SubscriptionID: subscription.SubscriptionID,
+		Username:       subscription.Username,
+		PlanName:       subscription.PlanName,
+		EndsAt:         subscription.EndsAt,
+		WindowDays:     windowDays,
+	}
+}
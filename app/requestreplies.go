@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/natscl"
+)
+
+// replyStore keeps the responses to NATS requests with message IDs in the
+// database, so that a retry is recognized no matter which instance of the
+// service handles it. The responses aren't scoped to tenants, since the keys
+// are only ever looked up by the messages that they were recorded for.
+type replyStore struct {
+	a *App
+}
+
+var _ natscl.ReplyStore = (*replyStore)(nil)
+
+// LoadReply returns the response recorded for a request at or after the given
+// time, if there is one.
+func (s *replyStore) LoadReply(ctx context.Context, key string, since time.Time) ([]byte, bool, error) {
+	return db.New(s.a.db).LoadRequestReply(ctx, key, since)
+}
+
+// SaveReply records the response for a request. Nothing is recorded while the
+// database is read-only, in which case only the instance that handled the
+// request will recognize its retries.
+func (s *replyStore) SaveReply(ctx context.Context, key string, data []byte) error {
+	if err := s.a.checkWritable(); err != nil {
+		return err
+	}
+	return db.New(s.a.db).SaveRequestReply(ctx, key, data)
+}
+
+// ReplyStore returns the store that keeps the responses to NATS requests with
+// message IDs in the database.
+func (a *App) ReplyStore() natscl.ReplyStore {
+	return &replyStore{a: a}
+}
+
+// StartRequestReplyPurger removes the recorded responses to NATS requests that
+// are older than the deduplication window at regular intervals until the
+// context is done.
+func (a *App) StartRequestReplyPurger(ctx context.Context, interval, window time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be removed while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			count, err := db.New(a.db).PurgeRequestReplies(ctx, time.Now().Add(-window))
+			if err != nil {
+				log.Errorf("unable to purge the recorded request responses: %s", err)
+				continue
+			}
+			if count > 0 {
+				log.Debugf("purged %d recorded request responses", count)
+			}
+		}
+	}()
+}
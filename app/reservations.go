@@ -0,0 +1,388 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultReservationDuration is the amount of time until a reservation expires
+// if the request doesn't say otherwise.
+const DefaultReservationDuration = time.Hour
+
+// EnableReservations causes reserved resources to count against users' quotas
+// in overage checks. Reservations require the reservations table.
+func (a *App) EnableReservations() {
+	a.reservations = true
+}
+
+// reservationAmounts validates the resources in a reservation request and
+// returns the amount requested for each resource name. Amounts for the same
+// resource are added together.
+func reservationAmounts(resources []*api.ResourceAmount) (map[string]float64, []string, error) {
+	amounts := make(map[string]float64)
+	var names []string
+	for _, resource := range resources {
+		if resource == nil || resource.ResourceName == "" || resource.Amount <= 0 {
+			return nil, nil, serrors.ErrInvalidReservation
+		}
+		if _, ok := amounts[resource.ResourceName]; !ok {
+			names = append(names, resource.ResourceName)
+		}
+		amounts[resource.ResourceName] += resource.Amount
+	}
+	if len(names) == 0 {
+		return nil, nil, serrors.ErrInvalidReservation
+	}
+	return amounts, names, nil
+}
+
+func (a *App) reserveResources(ctx context.Context, request *api.ReservationRequest) *api.ReservationResponse {
+	response := &api.ReservationResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	amounts, names, err := reservationAmounts(request.Resources)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	duration := DefaultReservationDuration
+	if request.Duration != "" {
+		duration, err = time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidDuration)
+			return response
+		}
+	}
+
+	log := log.WithFields(logrus.Fields{"context": "reserving resources", "user": username})
+
+	d := a.database(ctx)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	err = tx.Wrap(func() error {
+		// Lock the user so that concurrent reservations can't both claim the
+		// same remaining quota.
+		user, err := d.LockUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return serrors.ErrUserNotFound
+		}
+
+		subscription, err := d.GetActiveSubscription(ctx, username, a.subscriptionOpts(db.WithTX(tx))...)
+		if err != nil {
+			return err
+		}
+
+		// Quota-exempt subscriptions can reserve more than their quotas.
+		exempt, err := d.IsPlanQuotaExempt(ctx, subscription.Plan.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		reservation := &db.Reservation{
+			SubscriptionID: subscription.ID,
+			Reference:      sql.NullString{String: request.Reference, Valid: request.Reference != ""},
+			ExpiresAt:      time.Now().Add(duration),
+			CreatedBy:      requestedBy,
+		}
+
+		for _, name := range names {
+			resourceType, err := d.GetResourceTypeByName(ctx, name, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			if resourceType.ID == "" {
+				return serrors.ErrInvalidResourceName
+			}
+
+			quota, _, err := d.GetCurrentQuota(ctx, resourceType.ID, subscription.ID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			usage, _, err := d.GetCurrentUsage(ctx, resourceType.ID, subscription.ID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			reserved, err := d.ReservedAmount(ctx, subscription.ID, resourceType.ID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+
+			if !exempt && usage+reserved+amounts[name] > quota {
+				log.Infof(
+					"unable to reserve %f of %s: the quota is %f, the usage is %f and %f is already reserved",
+					amounts[name], name, quota, usage, reserved,
+				)
+				return serrors.ErrInsufficientQuota
+			}
+
+			reservation.Amounts = append(reservation.Amounts, db.ReservationAmount{
+				ResourceType: *resourceType,
+				Amount:       amounts[name],
+			})
+		}
+
+		id, err := d.AddReservation(ctx, reservation, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if reservation, err = d.GetReservation(ctx, id, db.WithTX(tx)); err != nil {
+			return err
+		}
+		response.Reservation = reservation.ToAPIType()
+
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+	}
+	return response
+}
+
+// ReserveResourceHandler reserves amounts of one or more resources for a user
+// so that planned consumption counts against the user's quotas right away. The
+// reservation is rejected if any of the resources doesn't have enough quota
+// remaining.
+func (a *App) ReserveResourceHandler(subject, reply string, request *api.ReservationRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reserving resources")
+
+	response := a.reserveResources(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ReserveResourceHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ReservationRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.reserveResources(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) releaseReservation(ctx context.Context, request *api.ByUUIDRequest) *api.ReservationResponse {
+	response := &api.ReservationResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	// Releasing a reservation that's no longer active has no effect.
+	if _, err := d.ReleaseReservation(ctx, request.UUID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	reservation, err := d.GetReservation(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if reservation == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrReservationNotFound)
+		return response
+	}
+
+	response.Reservation = reservation.ToAPIType()
+	return response
+}
+
+// ReleaseReservationHandler releases a reservation so that the resources it
+// reserved no longer count against the user's quotas. The actual usage should
+// be recorded separately.
+func (a *App) ReleaseReservationHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "releasing reservation")
+
+	response := a.releaseReservation(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ReleaseReservationHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{
+		UUID: c.Param("id"),
+	}
+
+	response := a.releaseReservation(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// reservedOverage returns true if the user's usage of the named resource plus
+// the amount reserved has reached the quota for the resource. Subscriptions to
+// quota-exempt plans never reach their quotas.
+func (a *App) reservedOverage(ctx context.Context, d *db.Database, username, resourceName string) (bool, error) {
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err == serrors.ErrSubscriptionNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	exempt, err := d.IsPlanQuotaExempt(ctx, subscription.Plan.ID, db.WithReadReplica())
+	if err != nil || exempt {
+		return false, err
+	}
+
+	resourceType, err := d.GetResourceTypeByName(ctx, resourceName, db.WithReadReplica())
+	if err != nil || resourceType.ID == "" {
+		return false, err
+	}
+
+	reserved, err := d.ReservedAmount(ctx, subscription.ID, resourceType.ID, db.WithReadReplica())
+	if err != nil || reserved <= 0 {
+		return false, err
+	}
+
+	quota, _, err := d.GetCurrentQuota(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		return false, err
+	}
+	usage, _, err := d.GetCurrentUsage(ctx, resourceType.ID, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		return false, err
+	}
+
+	return usage+reserved >= quota, nil
+}
+
+// StartReservationReaper marks reservations that have expired at regular
+// intervals until the context is done. Expired reservations stop counting
+// against quotas as soon as they expire either way; the reaper keeps their
+// status up to date.
+func (a *App) StartReservationReaper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be updated while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			count, err := a.database(ctx).ExpireReservations(ctx)
+			if err != nil {
+				log.Errorf("unable to expire reservations: %s", err)
+				continue
+			}
+			if count > 0 {
+				log.Infof("expired %d reservations", count)
+			}
+		}
+	}()
+}
@@ -0,0 +1,286 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/units"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// Resource type names are dot-separated lower case words, such as
+	// gpu.hours.
+	resourceNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*(\.[a-z][a-z0-9_]*)+$`)
+
+	// Resource units are lower case words separated by single spaces, such as
+	// cpu hours.
+	resourceUnitRegexp = regexp.MustCompile(`^[a-z]+( [a-z]+)*$`)
+)
+
+// normalizeResourceUnit returns the canonical form of a resource unit, which is
+// lower case with single spaces between words, so that units that only differ
+// in case or spacing are stored the same way. Returns ErrInvalidResourceUnit if
+// the unit isn't made up of words.
+func normalizeResourceUnit(unit string) (string, error) {
+	unit = units.Normalize(unit)
+	if !resourceUnitRegexp.MatchString(unit) {
+		return "", serrors.ErrInvalidResourceUnit
+	}
+	return unit, nil
+}
+
+func (a *App) addResourceType(ctx context.Context, request *api.ResourceTypeRequest) *api.ResourceTypeResponse {
+	response := &api.ResourceTypeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if !resourceNameRegexp.MatchString(request.Name) {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+	unit, err := normalizeResourceUnit(request.Unit)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	resourceType := &db.ResourceType{
+		Name:       request.Name,
+		Unit:       unit,
+		Consumable: request.Consumable,
+	}
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+		resourceType.ID, err = d.AddResourceType(ctx, resourceType, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.ResourceType = resourceType.ToAPIType()
+	return response
+}
+
+// AddResourceTypeHandler adds a resource type so that quotas and usages can be
+// tracked for a new kind of resource.
+func (a *App) AddResourceTypeHandler(subject, reply string, request *api.ResourceTypeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding resource type")
+
+	response := a.addResourceType(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddResourceTypeHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ResourceTypeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.addResourceType(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) updateResourceType(ctx context.Context, request *api.UpdateResourceTypeRequest) *api.ResourceTypeResponse {
+	response := &api.ResourceTypeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	var resourceType *db.ResourceType
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+
+		resourceType, err = d.GetResourceTypeByName(ctx, request.Name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if resourceType.ID == "" {
+			return serrors.ErrResourceTypeNotFound
+		}
+
+		if request.Unit != "" {
+			unit, err := normalizeResourceUnit(request.Unit)
+			if err != nil {
+				return err
+			}
+
+			// Changing the unit would change the meaning of the quotas and
+			// usages that have already been recorded.
+			if unit != resourceType.Unit {
+				inUse, err := d.ResourceTypeInUse(ctx, resourceType.ID, db.WithTX(tx))
+				if err != nil {
+					return err
+				}
+				if inUse {
+					return serrors.ErrResourceTypeInUse
+				}
+				resourceType.Unit = unit
+			}
+		}
+		if request.Consumable != nil {
+			resourceType.Consumable = *request.Consumable
+		}
+
+		return d.UpdateResourceType(ctx, resourceType, db.WithTX(tx))
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.ResourceType = resourceType.ToAPIType()
+	return response
+}
+
+// UpdateResourceTypeHandler changes the unit or the consumable flag of a
+// resource type. The unit can only be changed if nothing refers to the
+// resource type yet.
+func (a *App) UpdateResourceTypeHandler(subject, reply string, request *api.UpdateResourceTypeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "updating resource type")
+
+	response := a.updateResourceType(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) UpdateResourceTypeHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UpdateResourceTypeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Name = c.Param("name")
+
+	response := a.updateResourceType(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listResourceTypes(ctx context.Context) *api.ResourceTypeListResponse {
+	response := &api.ResourceTypeListResponse{ResourceTypes: make([]*api.ResourceTypeDefinition, 0)}
+	d := a.readDatabase(ctx)
+
+	resourceTypes, err := d.ListResourceTypes(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, resourceType := range resourceTypes {
+		response.ResourceTypes = append(response.ResourceTypes, resourceType.ToAPIType())
+	}
+	return response
+}
+
+// ListResourceTypesHandler lists all of the resource types.
+func (a *App) ListResourceTypesHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing resource types")
+
+	response := a.listResourceTypes(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListResourceTypesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listResourceTypes(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
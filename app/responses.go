@@ -0,0 +1,54 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) respondFailures(_ context.Context) *api.RespondFailuresResponse {
+	response := &api.RespondFailuresResponse{Subjects: make([]*api.RespondFailures, 0)}
+
+	for _, f := range a.client.RespondFailures() {
+		response.Subjects = append(response.Subjects, &api.RespondFailures{
+			Subject:      f.Subject,
+			Failures:     f.Failures,
+			Recovered:    f.Recovered,
+			LastError:    f.LastError,
+			LastFailedAt: f.LastFailedAt,
+		})
+	}
+
+	return response
+}
+
+// RespondFailuresHandler lists the NATS responses that couldn't be sent since
+// the service started, so that operators can tell when callers may have timed
+// out after their requests were applied.
+func (a *App) RespondFailuresHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing response failures")
+
+	response := a.respondFailures(ctx)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) RespondFailuresHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.respondFailures(ctx)
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// retentionBatchSize is the maximum number of updates that are archived in a
+// single transaction.
+const retentionBatchSize = 1000
+
+// RetentionSettings controls how long usage updates are kept in the updates
+// table before they're moved to the archive.
+type RetentionSettings struct {
+	// UpdateMonths is the number of months that updates are kept. Updates are
+	// never archived if it's zero.
+	UpdateMonths int
+
+	// DryRun makes the retention worker log the number of updates that it would
+	// have archived instead of archiving them.
+	DryRun bool
+}
+
+// archivedCounter counts the rows that were moved to an archive table.
+var archivedCounter metric.Int64Counter
+
+func init() {
+	var err error
+	archivedCounter, err = otel.Meter("github.com/cyverse-de/subscriptions/app").Int64Counter(
+		"qms.retention.archived",
+		metric.WithDescription("The number of rows that were moved to an archive table by the retention job."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the retention counter: %s", err)
+	}
+}
+
+// SetRetention sets the retention policy for usage updates.
+func (a *App) SetRetention(settings RetentionSettings) {
+	a.retention = settings
+}
+
+// ApplyRetention archives the updates that are older than the retention period
+// and returns the cutoff along with the number of updates that were archived.
+// In a dry run, the updates that would be archived are counted instead. Returns
+// ErrRetentionDisabled if the retention period isn't configured.
+func (a *App) ApplyRetention(ctx context.Context, dryRun bool) (time.Time, int64, error) {
+	if a.retention.UpdateMonths <= 0 {
+		return time.Time{}, 0, serrors.ErrRetentionDisabled
+	}
+	cutoff := time.Now().AddDate(0, -a.retention.UpdateMonths, 0)
+
+	d := a.database(ctx)
+
+	if dryRun {
+		count, err := d.CountArchivableUpdates(ctx, cutoff)
+		return cutoff, count, err
+	}
+
+	// Archive the updates in batches so that no single transaction holds too
+	// many locks.
+	var total int64
+	for {
+		var count int64
+		err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+			var err error
+			count, err = d.ArchiveUpdates(ctx, cutoff, retentionBatchSize, db.WithTX(tx))
+			return err
+		})
+		if err != nil {
+			return cutoff, total, err
+		}
+
+		total += count
+		if archivedCounter != nil && count > 0 {
+			archivedCounter.Add(ctx, count, metric.WithAttributes(attribute.String("table", "updates")))
+		}
+
+		if count < retentionBatchSize {
+			break
+		}
+	}
+
+	return cutoff, total, nil
+}
+
+func (a *App) runRetention(ctx context.Context, request *api.RetentionRequest) *api.RetentionResponse {
+	response := &api.RetentionResponse{DryRun: request.DryRun}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if !request.DryRun {
+		if err := a.checkWritable(); err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	cutoff, count, err := a.ApplyRetention(ctx, request.DryRun)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Cutoff = cutoff
+	response.Updates = count
+	return response
+}
+
+// RunRetentionHandler archives the updates that are older than the retention
+// period on demand, or counts them in a dry run.
+func (a *App) RunRetentionHandler(subject, reply string, request *api.RetentionRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "running the retention job")
+
+	response := a.runRetention(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) RunRetentionHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.RetentionRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.runRetention(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartRetentionWorker archives the updates that are older than the retention
+// period at regular intervals until the context is done.
+func (a *App) StartRetentionWorker(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be archived while the database is read-only.
+			if !a.retention.DryRun && a.checkWritable() != nil {
+				continue
+			}
+
+			cutoff, count, err := a.ApplyRetention(ctx, a.retention.DryRun)
+			if err != nil {
+				log.Errorf("unable to archive updates: %s", err)
+				continue
+			}
+
+			if a.retention.DryRun {
+				log.Infof("%d updates from before %s would have been archived", count, cutoff.Format(time.RFC3339))
+			} else if count > 0 {
+				log.Infof("archived %d updates from before %s", count, cutoff.Format(time.RFC3339))
+			}
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultRevenueMonths is the number of months in the revenue reporting window
+// when the start date isn't specified.
+const defaultRevenueMonths = 12
+
+// revenueWindow returns the reporting window for a revenue report request,
+// which covers whole months in UTC. Returns ErrInvalidReportWindow if either
+// date can't be parsed or the window is empty.
+func revenueWindow(request *api.RevenueReportRequest) (time.Time, time.Time, error) {
+	var err error
+
+	end := time.Now()
+	if request.EndDate != "" {
+		if end, err = utils.ParseTimestamp(request.EndDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	start := end.AddDate(0, -defaultRevenueMonths, 0)
+	if request.StartDate != "" {
+		if start, err = utils.ParseTimestamp(request.StartDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	// A partial month at the end of the window is included in full.
+	start = start.UTC()
+	start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	month := time.Date(end.UTC().Year(), end.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	if month.Equal(end) {
+		end = month
+	} else {
+		end = month.AddDate(0, 1, 0)
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+	}
+
+	return start, end, nil
+}
+
+func (a *App) getRevenueReport(ctx context.Context, request *api.RevenueReportRequest) *api.RevenueReportResponse {
+	response := &api.RevenueReportResponse{Revenue: make([]*api.PlanRevenue, 0)}
+
+	start, end, err := revenueWindow(request)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.StartDate, response.EndDate = start, end
+
+	d := a.readDatabase(ctx)
+
+	if request.PlanName != "" {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica(), db.WithIncludeDeleted())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+	}
+
+	rows, err := d.RevenueReport(ctx, start, end, request.PlanName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, row := range rows {
+		response.Revenue = append(response.Revenue, &api.PlanRevenue{
+			PlanName:          row.PlanName,
+			Month:             row.Month,
+			Subscriptions:     row.Subscriptions,
+			PaidSubscriptions: row.PaidSubscriptions,
+			PlanRevenue:       row.PlanRevenue,
+			AddonRevenue:      row.AddonRevenue,
+			TotalRevenue:      row.PlanRevenue + row.AddonRevenue,
+		})
+	}
+
+	return response
+}
+
+// GetRevenueReportHandler reports the revenue from subscriptions for each plan
+// and month in a window.
+func (a *App) GetRevenueReportHandler(subject, reply string, request *api.RevenueReportRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reporting revenue")
+
+	response := a.getRevenueReport(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetRevenueReportHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.RevenueReportRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.getRevenueReport(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) getEventSchemas(ctx context.Context, request *api.EventSchemaRequest) *api.EventSchemaResponse {
+	response := &api.EventSchemaResponse{
+		SchemaVersion: api.EventSchemaVersion,
+		Schemas:       make(map[string]api.Schema),
+	}
+
+	eventTypes := api.EmittedEventTypes()
+	if request.EventType != "" {
+		eventTypes = []string{request.EventType}
+	}
+
+	for _, eventType := range eventTypes {
+		schema, ok := api.EventSchema(eventType)
+		if !ok {
+			response.Error = serrors.NatsError(ctx, serrors.ErrUnknownEventType)
+			return response
+		}
+		response.Schemas[eventType] = schema
+	}
+
+	return response
+}
+
+// GetEventSchemasHandler returns the JSON schemas for the event payloads that
+// the service sends to webhooks and publishes to JetStream.
+func (a *App) GetEventSchemasHandler(subject, reply string, request *api.EventSchemaRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting event schemas")
+
+	response := a.getEventSchemas(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetEventSchemasHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.EventSchemaRequest{EventType: c.Param("type")}
+	response := a.getEventSchemas(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
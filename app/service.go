@@ -0,0 +1,252 @@
+package app
+
+import (
+	"context"
+
+	"github.com/cyverse-de/go-mod/pbinit"
+	qmsinit "github.com/cyverse-de/go-mod/pbinit/qms"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/requests"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/service"
+)
+
+// Service implements the transport-agnostic service layer on top of the app.
+// Tracing, time budgets and concurrency limits are left to the transports.
+type Service struct {
+	a *App
+}
+
+var _ service.QMS = (*Service)(nil)
+
+// Service returns the service layer that the NATS handlers and the gRPC server
+// call.
+func (a *App) Service() service.QMS {
+	return a.service
+}
+
+// SetService replaces the service layer that the NATS handlers and the gRPC
+// server call, which allows the transports to be exercised with a fake.
+func (a *App) SetService(svc service.QMS) {
+	a.service = svc
+}
+
+// GetUserUpdates lists the updates recorded for a user.
+func (s *Service) GetUserUpdates(ctx context.Context, request *qms.UpdateListRequest) (*qms.UpdateListResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getUserUpdates(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddUserUpdate records an update to a user's usage or quota.
+func (s *Service) AddUserUpdate(ctx context.Context, request *qms.AddUpdateRequest) (*qms.AddUpdateResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.addUserUpdate(ctx, request, headerValue(request.GetHeader(), SubscriptionAddonHeader))
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// GetUsages lists a user's current usages.
+func (s *Service) GetUsages(ctx context.Context, request *qms.GetUsages) (*qms.UsageList, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getUsages(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddUsage sets or adds to a user's usage, bypassing the updates.
+func (s *Service) AddUsage(ctx context.Context, request *qms.AddUsage) (*qms.UsageResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.addUsage(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// GetUserOverages lists the resources that a user has exceeded the quota for.
+func (s *Service) GetUserOverages(ctx context.Context, request *qms.AllUserOveragesRequest) (*qms.OverageList, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getUserOverages(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// CheckUserOverages checks whether a user has exceeded the quota for a resource.
+func (s *Service) CheckUserOverages(ctx context.Context, request *qms.IsOverageRequest) (*qms.IsOverage, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.checkUserOverages(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// GetUserSummary returns a user's active subscription, creating one with the
+// default plan if necessary.
+func (s *Service) GetUserSummary(ctx context.Context, request *qms.RequestByUsername) (*qms.SubscriptionResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getUserSummary(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddUser adds a user and subscribes them to a plan.
+func (s *Service) AddUser(ctx context.Context, request *qms.AddUserRequest) (*qms.AddUserResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	var response *qms.AddUserResponse
+	if ref, err := externalRef(request.GetHeader()); err != nil {
+		response = pbinit.NewQMSAddUserResponse()
+		response.Error = serrors.NatsError(ctx, err)
+	} else {
+		discountCode := normalizeDiscountCode(headerValue(request.GetHeader(), DiscountCodeHeader))
+		dryRun := headerValue(request.GetHeader(), DryRunHeader)
+		perpetual := headerValue(request.GetHeader(), PerpetualHeader)
+		response = s.a.addUser(ctx, request, ref, discountCode, dryRun, perpetual)
+	}
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddQuota sets the quota for a resource in a user's active subscription.
+func (s *Service) AddQuota(ctx context.Context, request *qms.AddQuotaRequest) (*qms.QuotaResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.addQuota(
+		ctx, request,
+		headerValue(request.GetHeader(), ExpectedVersionHeader),
+		headerValue(request.GetHeader(), DryRunHeader),
+	)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// ListPlans lists the subscription plans.
+func (s *Service) ListPlans(ctx context.Context, request *qms.NoParamsRequest) (*qms.PlanList, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.listPlans(ctx, headerValue(request.GetHeader(), IncludeDeletedHeader))
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddPlan adds a subscription plan.
+func (s *Service) AddPlan(ctx context.Context, request *qms.AddPlanRequest) (*qms.PlanResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.addPlan(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// GetPlan returns a single subscription plan.
+func (s *Service) GetPlan(ctx context.Context, request *qms.PlanRequest) (*qms.PlanResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getPlan(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// UpsertQuotaDefaults adds or updates the quota defaults for a plan.
+func (s *Service) UpsertQuotaDefaults(
+	ctx context.Context, request *qms.AddPlanQuotaDefaultRequest,
+) (*qms.QuotaDefaultResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.upsertQuotaDefault(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddAddon adds an add-on that can be applied to subscriptions.
+func (s *Service) AddAddon(ctx context.Context, request *qms.AddAddonRequest) (*qms.AddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.addAddon(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// ListAddons lists the add-ons that can be applied to subscriptions.
+func (s *Service) ListAddons(ctx context.Context, request *qms.NoParamsRequest) (*qms.AddonListResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	header := request.GetHeader()
+	response := s.a.listAddons(ctx, &addonListParams{
+		IncludeDeleted: headerValue(header, IncludeDeletedHeader),
+		ResourceType:   headerValue(header, AddonResourceTypeHeader),
+		Name:           headerValue(header, AddonNameHeader),
+		DefaultPaid:    headerValue(header, AddonDefaultPaidHeader),
+		Sort:           headerValue(header, AddonSortHeader),
+	})
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// UpdateAddon updates an add-on.
+func (s *Service) UpdateAddon(ctx context.Context, request *qms.UpdateAddonRequest) (*qms.AddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.updateAddon(
+		ctx, request,
+		headerValue(request.GetHeader(), ExpectedVersionHeader),
+		headerValue(request.GetHeader(), UpdateMaskHeader),
+	)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// DeleteAddon deletes an add-on.
+func (s *Service) DeleteAddon(ctx context.Context, request *requests.ByUUID) (*qms.AddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.deleteAddon(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// ListSubscriptionAddons lists the add-ons applied to a subscription.
+func (s *Service) ListSubscriptionAddons(
+	ctx context.Context, request *requests.ByUUID,
+) (*qms.SubscriptionAddonListResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.listSubscriptionAddons(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// AddSubscriptionAddon applies an add-on to a subscription.
+func (s *Service) AddSubscriptionAddon(
+	ctx context.Context, request *requests.AssociateByUUIDs,
+) (*qms.SubscriptionAddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	var response *qms.SubscriptionAddonResponse
+	if ref, err := externalRef(request.GetHeader()); err != nil {
+		response = qmsinit.NewSubscriptionAddonResponse()
+		response.Error = serrors.NatsError(ctx, err)
+	} else {
+		h := request.GetHeader()
+		response = s.a.addSubscriptionAddon(ctx, request, ref, headerValue(h, QuantityHeader), headerValue(h, AddonEndDateHeader))
+	}
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// DeleteSubscriptionAddon removes an add-on from a subscription.
+func (s *Service) DeleteSubscriptionAddon(
+	ctx context.Context, request *requests.ByUUID,
+) (*qms.SubscriptionAddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.deleteSubscriptionAddon(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// UpdateSubscriptionAddon updates an add-on applied to a subscription.
+func (s *Service) UpdateSubscriptionAddon(
+	ctx context.Context, request *qms.UpdateSubscriptionAddonRequest,
+) (*qms.SubscriptionAddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.updateSubscriptionAddon(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
+
+// GetSubscriptionAddon returns a single add-on applied to a subscription.
+func (s *Service) GetSubscriptionAddon(
+	ctx context.Context, request *requests.ByUUID,
+) (*qms.SubscriptionAddonResponse, error) {
+	ctx = withRequestTenant(ctx, request.GetHeader())
+	response := s.a.getSubscriptionAddon(ctx, request)
+	redact(s.a.callerRole(request.GetHeader()), response)
+	return response, service.ResponseError(response.Error)
+}
@@ -0,0 +1,31 @@
+package app
+
+import (
+	"strconv"
+
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// IncludeDeletedHeader is the name of the message header used to include
+// deleted add-ons and plans in listings. The QMS list requests don't have a
+// field for the flag, so it's passed in the header instead. HTTP requests use
+// the include_deleted query parameter.
+const IncludeDeletedHeader = "x-qms-include-deleted"
+
+// includeDeletedOpts returns the query options for the value of an
+// include_deleted flag. An empty value excludes deleted records.
+func includeDeletedOpts(value string, opts ...db.QueryOption) ([]db.QueryOption, error) {
+	if value == "" {
+		return opts, nil
+	}
+
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, serrors.ErrInvalidIncludeDeleted
+	}
+	if includeDeleted {
+		opts = append(opts, db.WithIncludeDeleted())
+	}
+	return opts, nil
+}
@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/subcache"
+	"github.com/sirupsen/logrus"
+)
+
+// invalidationBatchSize is the number of usernames removed from the
+// subscription cache, and relayed to the other instances, at a time.
+const invalidationBatchSize = 1000
+
+// SetSubscriptionCache configures the cache used for active subscription
+// lookups on hot paths. Subscriptions are always read from the database if the
+// cache isn't set.
+func (a *App) SetSubscriptionCache(cache subcache.Cache) {
+	a.subscriptionCache = cache
+}
+
+// activeSubscription returns the user's active subscription, using the
+// subscription cache if one is configured. If includeGrace is true, a
+// subscription in its grace period counts as active. Subscriptions read from
+// the read replica aren't added to the cache, since the replica may not have
+// caught up with a change that has just invalidated the cache.
+// ErrSubscriptionNotFound is returned if the user doesn't have an active
+// subscription.
+func (a *App) activeSubscription(
+	ctx context.Context, d *db.Database, username string, includeGrace, replica bool,
+) (*db.Subscription, error) {
+	var gracePeriod time.Duration
+	if includeGrace {
+		gracePeriod = a.GracePeriod
+	}
+
+	// A cached subscription can only be used if it hasn't ended since it was
+	// cached. The cache is keyed by username alone, so requests that are
+	// limited to a tenant always read from the database, which checks that the
+	// subscription belongs to the tenant.
+	if a.subscriptionCache != nil && tenantFromContext(ctx) == "" {
+		subscription, ok := a.subscriptionCache.Get(ctx, username)
+		if ok && subscription.StateAt(time.Now(), gracePeriod) != db.SubscriptionStateExpired {
+			return subscription, nil
+		}
+	}
+
+	var opts []db.QueryOption
+	if replica {
+		opts = append(opts, db.WithReadReplica())
+	}
+	if includeGrace {
+		opts = a.subscriptionOpts(opts...)
+	} else if a.groups {
+		opts = append(opts, db.WithGroupSubscriptions())
+	}
+
+	subscription, err := d.GetActiveSubscription(ctx, username, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.subscriptionCache != nil && !replica {
+		a.subscriptionCache.Set(ctx, username, subscription)
+	}
+	return subscription, nil
+}
+
+// invalidateSubscriptions removes the cached subscriptions of users whose
+// subscriptions have changed. It must be called after the change has been
+// committed.
+func (a *App) invalidateSubscriptions(ctx context.Context, usernames ...string) {
+	if a.subscriptionCache != nil {
+		a.subscriptionCache.Invalidate(ctx, usernames...)
+	}
+}
+
+// invalidatePlanSubscriptions removes the cached subscriptions of the users who
+// are subscribed to a plan that has changed, such as a plan that has been
+// deleted. It must be called after the change has been committed. Failures are
+// logged, and the entries are picked up once they expire.
+func (a *App) invalidatePlanSubscriptions(ctx context.Context, d *db.Database, planID string) {
+	if a.subscriptionCache == nil {
+		return
+	}
+
+	usernames, err := d.PlanSubscriberUsernames(ctx, planID, a.subscriptionOpts()...)
+	if err != nil {
+		log.WithFields(logrus.Fields{"context": "invalidating cached subscriptions", "plan": planID}).Error(err)
+		return
+	}
+
+	for start := 0; start < len(usernames); start += invalidationBatchSize {
+		a.subscriptionCache.Invalidate(ctx, usernames[start:min(start+invalidationBatchSize, len(usernames))]...)
+	}
+}
+
+// invalidateSubscriptionOwner removes the cached subscription of the user who
+// owns a subscription that has changed, such as one whose quotas have been
+// set. It must be called after the change has been committed.
+func (a *App) invalidateSubscriptionOwner(ctx context.Context, d *db.Database, subscriptionID string) {
+	if a.subscriptionCache == nil {
+		return
+	}
+
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		log.WithFields(logrus.Fields{"context": "invalidating cached subscriptions", "subscription": subscriptionID}).Error(err)
+		return
+	}
+	a.subscriptionCache.Invalidate(ctx, subscription.User.Username)
+}
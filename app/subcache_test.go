@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/subcache"
+	"github.com/jmoiron/sqlx"
+)
+
+// newCachedApp returns an *App with an in-memory subscription cache that holds
+// subscriptions for the given users, along with a database that runs its
+// statements against a mock.
+func newCachedApp(t *testing.T, usernames ...string) (*App, *db.Database, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unable to create the mock database: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cache := subcache.NewMemoryCache(time.Hour, 2*invalidationBatchSize)
+	for _, username := range usernames {
+		cache.Set(context.Background(), username, &db.Subscription{
+			ID:               "subscription-" + username,
+			User:             db.User{Username: username},
+			EffectiveEndDate: time.Now().Add(24 * time.Hour),
+		})
+	}
+
+	return &App{subscriptionCache: cache}, db.New(sqlx.NewDb(conn, "postgres")), mock
+}
+
+func TestQuotaChangeEvictsCachedSubscription(t *testing.T) {
+	ctx := context.Background()
+	a, d, mock := newCachedApp(t, "alice", "bob")
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM "subscriptions"`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "users.id", "users.username"}).
+			AddRow("subscription-alice", "alice-id", "alice"))
+
+	a.invalidateSubscriptionOwner(ctx, d, "subscription-alice")
+
+	if _, ok := a.subscriptionCache.Get(ctx, "alice"); ok {
+		t.Error("expected the subscription whose quota changed to be evicted")
+	}
+	if _, ok := a.subscriptionCache.Get(ctx, "bob"); !ok {
+		t.Error("expected other subscriptions to stay cached")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlanChangeEvictsCachedSubscriptions(t *testing.T) {
+	ctx := context.Background()
+
+	// Enough subscribers to need more than one batch.
+	usernames := make([]string, invalidationBatchSize+5)
+	rows := sqlmock.NewRows([]string{"username"})
+	for i := range usernames {
+		usernames[i] = fmt.Sprintf("user%04d", i)
+		rows.AddRow(usernames[i])
+	}
+	a, d, mock := newCachedApp(t, append(usernames, "carol")...)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM "subscriptions"`)).WillReturnRows(rows)
+
+	a.invalidatePlanSubscriptions(ctx, d, "plan-id")
+
+	for _, username := range usernames {
+		if _, ok := a.subscriptionCache.Get(ctx, username); ok {
+			t.Fatalf("expected the cached subscription of %s to be evicted", username)
+		}
+	}
+	if _, ok := a.subscriptionCache.Get(ctx, "carol"); !ok {
+		t.Error("expected the subscriptions to other plans to stay cached")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
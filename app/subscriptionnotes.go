@@ -0,0 +1,478 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// tagOpts returns the query options that limit a listing or report to the
+// subscriptions with a tag. The tag is either a key, which matches any value,
+// or a key=value pair. An empty tag leaves the listing unfiltered.
+func tagOpts(tag string, opts ...db.QueryOption) ([]db.QueryOption, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return opts, nil
+	}
+	key, value, hasValue := strings.Cut(tag, "=")
+	if key = strings.TrimSpace(key); key == "" {
+		return nil, serrors.ErrInvalidTagKey
+	}
+	return append(opts, db.WithSubscriptionTag(key, strings.TrimSpace(value), hasValue)), nil
+}
+
+// subscriptionAnnotations fills in the notes and tags of a subscription.
+func subscriptionAnnotations(
+	ctx context.Context, d *db.Database, subscriptionID string, response *api.SubscriptionAnnotationsResponse, opts ...db.QueryOption,
+) error {
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, opts...)
+	if err != nil {
+		return err
+	}
+	if subscription == nil {
+		return serrors.ErrSubscriptionNotFound
+	}
+
+	notes, err := d.ListSubscriptionNotes(ctx, subscriptionID, opts...)
+	if err != nil {
+		return err
+	}
+	tags, err := d.ListSubscriptionTags(ctx, subscriptionID, opts...)
+	if err != nil {
+		return err
+	}
+
+	response.SubscriptionID = subscriptionID
+	response.Notes = make([]*api.SubscriptionNote, 0, len(notes))
+	for i := range notes {
+		response.Notes = append(response.Notes, notes[i].ToAPIType())
+	}
+	response.Tags = make([]*api.SubscriptionTag, 0, len(tags))
+	for i := range tags {
+		response.Tags = append(response.Tags, tags[i].ToAPIType())
+	}
+
+	return nil
+}
+
+// requireSubscription returns ErrSubscriptionNotFound if the subscription
+// doesn't exist.
+func requireSubscription(ctx context.Context, d *db.Database, subscriptionID string) error {
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		return err
+	}
+	if subscription == nil {
+		return serrors.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+func (a *App) getSubscriptionAnnotations(ctx context.Context, request *api.ByUUIDRequest) *api.SubscriptionAnnotationsResponse {
+	response := &api.SubscriptionAnnotationsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	if err := subscriptionAnnotations(ctx, d, request.UUID, response, db.WithReadReplica()); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// GetSubscriptionAnnotationsHandler lists the notes and tags attached to a
+// subscription.
+func (a *App) GetSubscriptionAnnotationsHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting subscription annotations")
+
+	response := a.getSubscriptionAnnotations(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetSubscriptionAnnotationsHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.getSubscriptionAnnotations(ctx, &api.ByUUIDRequest{UUID: c.Param("uuid")})
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) addSubscriptionNote(ctx context.Context, request *api.AddSubscriptionNoteRequest) *api.SubscriptionAnnotationsResponse {
+	response := &api.SubscriptionAnnotationsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	if err = requireSubscription(ctx, d, request.SubscriptionID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	note := &db.SubscriptionNote{
+		SubscriptionID: request.SubscriptionID,
+		Note:           strings.TrimSpace(request.Note),
+		CreatedBy:      requestedBy,
+	}
+	if err = d.AddSubscriptionNote(ctx, note); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = subscriptionAnnotations(ctx, d, request.SubscriptionID, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// AddSubscriptionNoteHandler attaches a note to a subscription.
+func (a *App) AddSubscriptionNoteHandler(subject, reply string, request *api.AddSubscriptionNoteRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding subscription note")
+
+	response := a.addSubscriptionNote(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddSubscriptionNoteHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.AddSubscriptionNoteRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.SubscriptionID = c.Param("uuid")
+
+	response := a.addSubscriptionNote(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) deleteSubscriptionNote(ctx context.Context, request *api.DeleteSubscriptionNoteRequest) *api.SubscriptionAnnotationsResponse {
+	response := &api.SubscriptionAnnotationsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if err := requireSubscription(ctx, d, request.SubscriptionID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	deleted, err := d.DeleteSubscriptionNote(ctx, request.SubscriptionID, request.NoteID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !deleted {
+		response.Error = serrors.NatsError(ctx, serrors.ErrNoteNotFound)
+		return response
+	}
+
+	if err = subscriptionAnnotations(ctx, d, request.SubscriptionID, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// DeleteSubscriptionNoteHandler removes a note from a subscription.
+func (a *App) DeleteSubscriptionNoteHandler(subject, reply string, request *api.DeleteSubscriptionNoteRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "deleting subscription note")
+
+	response := a.deleteSubscriptionNote(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) DeleteSubscriptionNoteHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.DeleteSubscriptionNoteRequest{
+		SubscriptionID: c.Param("uuid"),
+		NoteID:         c.Param("note_uuid"),
+	}
+
+	response := a.deleteSubscriptionNote(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) setSubscriptionTag(ctx context.Context, request *api.SetSubscriptionTagRequest) *api.SubscriptionAnnotationsResponse {
+	response := &api.SubscriptionAnnotationsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	// Tag filters use the first equals sign to separate the key from the value.
+	key := strings.TrimSpace(request.Key)
+	if strings.Contains(key, "=") {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidTagKey)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	if err = requireSubscription(ctx, d, request.SubscriptionID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	tag := &db.SubscriptionTag{
+		SubscriptionID: request.SubscriptionID,
+		Key:            key,
+		Value:          strings.TrimSpace(request.Value),
+		LastModifiedBy: requestedBy,
+	}
+	if err = d.SetSubscriptionTag(ctx, tag); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = subscriptionAnnotations(ctx, d, request.SubscriptionID, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// SetSubscriptionTagHandler attaches a tag to a subscription, or changes the
+// value of a tag that's already attached.
+func (a *App) SetSubscriptionTagHandler(subject, reply string, request *api.SetSubscriptionTagRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting subscription tag")
+
+	response := a.setSubscriptionTag(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetSubscriptionTagHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.SetSubscriptionTagRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.SubscriptionID = c.Param("uuid")
+	request.Key = c.Param("key")
+
+	response := a.setSubscriptionTag(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) deleteSubscriptionTag(ctx context.Context, request *api.DeleteSubscriptionTagRequest) *api.SubscriptionAnnotationsResponse {
+	response := &api.SubscriptionAnnotationsResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if err := requireSubscription(ctx, d, request.SubscriptionID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	deleted, err := d.DeleteSubscriptionTag(ctx, request.SubscriptionID, strings.TrimSpace(request.Key))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !deleted {
+		response.Error = serrors.NatsError(ctx, serrors.ErrTagNotFound)
+		return response
+	}
+
+	if err = subscriptionAnnotations(ctx, d, request.SubscriptionID, response); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	return response
+}
+
+// DeleteSubscriptionTagHandler removes a tag from a subscription.
+func (a *App) DeleteSubscriptionTagHandler(subject, reply string, request *api.DeleteSubscriptionTagRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "deleting subscription tag")
+
+	response := a.deleteSubscriptionTag(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) DeleteSubscriptionTagHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.DeleteSubscriptionTagRequest{
+		SubscriptionID: c.Param("uuid"),
+		Key:            c.Param("key"),
+	}
+
+	response := a.deleteSubscriptionTag(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
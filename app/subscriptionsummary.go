@@ -0,0 +1,163 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// summarizeResources combines the plan quota defaults, resource statuses and
+// add-ons of a subscription into one summary per resource type. Resource types
+// that appear in any of them are included, in order of name. The quota, usage,
+// remaining amount and percentage used come from the resource statuses, which
+// are computed by the database.
+func summarizeResources(
+	defaults []*db.PlanQuotaDefault, statuses []db.ResourceStatus, subAddons []db.SubscriptionAddon,
+) []*api.ResourceSummary {
+	summaryFor := make(map[string]*api.ResourceSummary)
+	summary := func(rt db.ResourceType) *api.ResourceSummary {
+		s, ok := summaryFor[rt.ID]
+		if !ok {
+			s = &api.ResourceSummary{ResourceType: api.ResourceType{ID: rt.ID, Name: rt.Name, Unit: rt.Unit}}
+			summaryFor[rt.ID] = s
+		}
+		return s
+	}
+
+	for _, pqd := range defaults {
+		summary(pqd.ResourceType).PlanQuota = pqd.QuotaValue
+	}
+	for _, status := range statuses {
+		s := summary(status.ResourceType)
+		computed := status.ToAPIType()
+		s.Quota = computed.Quota
+		s.Usage = computed.Usage
+		s.Remaining = computed.Remaining
+		s.PercentUsed = computed.PercentUsed
+	}
+	for _, subAddon := range subAddons {
+		summary(subAddon.Addon.ResourceType).AddonAmount += subAddon.Amount
+	}
+
+	summaries := make([]*api.ResourceSummary, 0, len(summaryFor))
+	for _, s := range summaryFor {
+		s.Display = displayAmounts(s.ResourceType, s.Quota, s.Usage, s.Remaining)
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ResourceType.Name < summaries[j].ResourceType.Name })
+
+	return summaries
+}
+
+func (a *App) getSubscriptionSummary(ctx context.Context, request *api.ByUsernameRequest) *api.SubscriptionSummaryResponse {
+	response := &api.SubscriptionSummaryResponse{
+		Resources: make([]*api.ResourceSummary, 0),
+		Addons:    make([]*api.SubscriptionAddonSummary, 0),
+	}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	subscription, err := a.activeSubscription(ctx, d, username, true, true)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	plan, err := d.GetPlanByID(ctx, subscription.Plan.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	statuses, err := d.SubscriptionResourceStatuses(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	subAddons, err := d.ListSubscriptionAddons(ctx, subscription.ID, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	paid := subscription.Paid
+	response.Subscription = &api.SubscriptionSummary{
+		ID:                 subscription.ID,
+		Username:           username,
+		PlanName:           plan.Name,
+		EffectiveStartDate: subscription.EffectiveStartDate,
+		EffectiveEndDate:   subscription.EffectiveEndDate,
+		Perpetual:          subscription.Perpetual(),
+		State:              a.subscriptionState(subscription.EffectiveEndDate),
+		Paid:               &paid,
+	}
+	response.Resources = summarizeResources(plan.GetActiveQuotaDefaults(), statuses, subAddons)
+	response.Addons = summarizeSubscriptionAddons(subAddons)
+
+	return response
+}
+
+// GetSubscriptionSummaryHandler returns a user's current subscription along
+// with the quota, usage and add-ons for each resource type, so that callers
+// don't have to combine the results of several requests.
+func (a *App) GetSubscriptionSummaryHandler(subject, reply string, request *api.ByUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "subscription summary")
+
+	response := a.getSubscriptionSummary(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetSubscriptionSummaryHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUsernameRequest{
+		Username: c.Param("username"),
+	}
+
+	response := a.getSubscriptionSummary(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
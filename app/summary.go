@@ -2,11 +2,11 @@ package app
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/labstack/echo/v4"
@@ -23,9 +23,12 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 	)
 
 	// Get the user summary.
-	d := db.New(a.db)
+	d := a.database(ctx)
 
-	var subscription *db.Subscription
+	var (
+		subscription *db.Subscription
+		created      bool
+	)
 	tx, err := d.Begin()
 	if err != nil {
 		return nil, err
@@ -33,41 +36,29 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 	err = tx.Wrap(func() error {
 		log.Debugf("before getting the active user plan: %s", username)
 
-		subscription, err = d.GetActiveSubscription(ctx, username, db.WithTX(tx))
-		if err != nil {
+		subscription, err = d.GetActiveSubscription(ctx, username, a.subscriptionOpts(db.WithTX(tx))...)
+		if err != nil && err != errors.ErrSubscriptionNotFound {
 			log.Errorf("unable to get the active user plan: %s", err)
 			return err
 		}
 		log.Debugf("after getting the active user plan: %s", username)
 
-		if subscription == nil || subscription.ID == "" {
-			user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to ensure that the user exists in the database: %s", err)
-				return err
-			}
-
-			plan, err := d.GetPlanByName(ctx, db.DefaultPlanName, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the default plan: %s", err)
-				return err
-			}
-
-			opts := db.DefaultSubscriptionOptions()
-			subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, opts, db.WithTX(tx))
+		// Users who don't have a subscription yet are subscribed to the default
+		// plan.
+		if err == errors.ErrSubscriptionNotFound {
+			subscription, err = d.SubscribeToDefaultPlan(ctx, username, a.subscriptionOpts(db.WithTX(tx))...)
 			if err != nil {
 				log.Errorf("unable to subscribe the user to the default plan: %s", err)
 				return err
 			}
-
-			subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the new user plan: %s", err)
-				return err
-			}
-			if subscription == nil {
-				err = fmt.Errorf("the newly inserted user plan could not be found")
-				log.Error(err)
+			created = true
+
+			if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionCreated, &api.SubscriptionEventData{
+				SubscriptionID: subscription.ID,
+				Username:       username,
+				PlanName:       subscription.Plan.Name,
+			}); err != nil {
+				log.Errorf("unable to record the subscription event: %s", err)
 				return err
 			}
 		}
@@ -85,6 +76,16 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 		return nil, err
 	}
 
+	if created {
+		a.notify(ctx, api.EventSubscriptionCreated, &api.SubscriptionEventData{
+			SubscriptionID: subscription.ID,
+			Username:       username,
+			PlanName:       subscription.Plan.Name,
+		})
+		a.invalidateSubscriptions(ctx, username)
+		a.projectOverages(ctx, username)
+	}
+
 	return subscription.ToQMSSubscription(), nil
 }
 
@@ -104,6 +105,7 @@ func (a *App) getUserSummary(ctx context.Context, request *qms.RequestByUsername
 	}
 
 	response.Subscription = subscription
+	setSubscriptionState(response.Header, a.subscriptionState(subscription.EffectiveEndDate.AsTime()))
 
 	return response
 }
@@ -116,7 +118,10 @@ func (a *App) GetUserSummaryHandler(subject, reply string, request *qms.RequestB
 	ctx, span := pbinit.InitQMSRequestByUsername(request, subject)
 	defer span.End()
 
-	response := a.getUserSummary(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	response, _ := a.service.GetUserSummary(ctx, request)
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
 		log.Error(err)
@@ -136,5 +141,6 @@ func (a *App) GetUserSummaryHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
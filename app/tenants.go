@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TenantHeader is the name of the message header (or HTTP header) that names
+// the tenant that a request is made on behalf of. Deployments that share a
+// single database set it so that they only see their own users, plans and
+// subscriptions. Requests that don't set it aren't limited to a tenant.
+const TenantHeader = "x-qms-tenant"
+
+// tenantKey is the context key that the tenant of a request is stored under.
+type tenantKey struct{}
+
+// withTenant returns a copy of the context that carries the tenant named by
+// the header value. The context is returned as is if the value is empty.
+func withTenant(ctx context.Context, value string) context.Context {
+	tenant := strings.TrimSpace(value)
+	if tenant == "" {
+		return ctx
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("qms.tenant", tenant))
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant carried by the context, or an empty
+// string if the request isn't limited to a tenant.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// withRequestTenant adds the tenant in the header of a protocol buffer request
+// to the context.
+func withRequestTenant(ctx context.Context, h *header.Header) context.Context {
+	return withTenant(ctx, headerValue(h, TenantHeader))
+}
+
+// initRequest starts a span for a plain JSON request and adds the tenant in
+// its header to the context.
+func initRequest(h api.Header, subject string) (context.Context, trace.Span) {
+	ctx, span := api.InitRequest(h, subject)
+	return withTenant(ctx, h[TenantHeader]), span
+}
+
+// tenantMiddleware adds the tenant in the HTTP request header to the request
+// context.
+func tenantMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if value := c.Request().Header.Get(TenantHeader); value != "" {
+			r := c.Request()
+			c.SetRequest(r.WithContext(withTenant(r.Context(), value)))
+		}
+		return next(c)
+	}
+}
+
+// database returns a *db.Database for the primary database that limits every
+// query to the tenant of the request, if it has one.
+func (a *App) database(ctx context.Context) *db.Database {
+	return scopeToTenant(ctx, db.New(a.db))
+}
+
+// readDatabase is the same as database, except that queries that use the
+// db.WithReadReplica option are sent to the read replica.
+func (a *App) readDatabase(ctx context.Context) *db.Database {
+	return scopeToTenant(ctx, db.NewWithReadReplica(a.db, a.replicaDB))
+}
+
+// scopeToTenant limits a database to the tenant of the request, if it has one.
+func scopeToTenant(ctx context.Context, d *db.Database) *db.Database {
+	if tenant := tenantFromContext(ctx); tenant != "" {
+		return d.Scoped(db.WithTenant(tenant))
+	}
+	return d
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/cyverse-de/subscriptions/subjects"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	qmssubs "github.com/cyverse-de/go-mod/subjects/qms"
+)
+
+// DefaultTimeout is the time budget for handling a NATS request when no budget
+// is configured for its subject.
+const DefaultTimeout = 10 * time.Second
+
+// TimeoutSettings contains the time budgets for handling NATS requests. Each
+// request is given a context that's cancelled once its budget runs out, so a
+// slow operation can't stall a consumer indefinitely.
+type TimeoutSettings struct {
+	// Default is the budget for subjects that aren't listed in Subjects.
+	Default time.Duration
+
+	// Subjects maps base subjects to their budgets.
+	Subjects map[string]time.Duration
+}
+
+// DefaultTimeoutSettings returns the time budgets used when none are
+// configured. Overage checks are on the critical path for starting analyses, so
+// they get a short budget, and bulk operations get a long one.
+func DefaultTimeoutSettings() TimeoutSettings {
+	return TimeoutSettings{
+		Default: DefaultTimeout,
+		Subjects: map[string]time.Duration{
+			qmssubs.GetUserOverages:      2 * time.Second,
+			qmssubs.CheckUserOverages:    2 * time.Second,
+			subjects.ExpireCohort:        30 * time.Second,
+			subjects.AdjustQuotasBatch:   10 * time.Minute,
+			subjects.ExportSubscriptions: 10 * time.Minute,
+			subjects.RunRetention:        10 * time.Minute,
+		},
+	}
+}
+
+// BudgetFor returns the time budget for the base subject.
+func (s *TimeoutSettings) BudgetFor(subject string) time.Duration {
+	if budget, ok := s.Subjects[subject]; ok && budget > 0 {
+		return budget
+	}
+	if s.Default > 0 {
+		return s.Default
+	}
+	return DefaultTimeout
+}
+
+// timeoutCounter counts the requests that ran out of time.
+var timeoutCounter metric.Int64Counter
+
+func init() {
+	var err error
+	timeoutCounter, err = otel.Meter("github.com/cyverse-de/subscriptions/app").Int64Counter(
+		"qms.requests.timeouts",
+		metric.WithDescription("The number of NATS requests that exceeded their time budget."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the request timeout counter: %s", err)
+	}
+}
+
+// SetTimeouts sets the time budgets for handling NATS requests.
+func (a *App) SetTimeouts(settings TimeoutSettings) {
+	a.timeouts = settings
+}
+
+// withTimeout returns a context that's cancelled when the time budget for the
+// subject runs out. The request also waits for a slot to be handled in, subject
+// to the concurrency limits, and the context is cancelled at once if it doesn't
+// get one. The context records the subject so that failures to respond can be
+// attributed to it. The returned function must be called once the request has
+// been handled; it releases the context and the slot and records requests that
+// ran out of time.
+func (a *App) withTimeout(ctx context.Context, subject string) (context.Context, func()) {
+	base := a.client.BaseSubject(subject)
+	budget := a.timeouts.BudgetFor(base)
+
+	ctx, release := a.withSlot(ctx, base)
+	ctx, cancel := context.WithTimeout(natscl.WithRequestSubject(ctx, base), budget)
+	return ctx, func() {
+		defer release()
+		if ctx.Err() == context.DeadlineExceeded {
+			log.WithFields(logrus.Fields{"subject": base, "budget": budget.String()}).
+				Warn("the request exceeded its time budget")
+			if timeoutCounter != nil {
+				timeoutCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("subject", base)))
+			}
+		}
+		cancel()
+	}
+}
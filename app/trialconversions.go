@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultConversionWindow is the length of the trial conversion reporting
+// window when the start date isn't specified.
+const defaultConversionWindow = 30 * 24 * time.Hour
+
+// conversionWindow returns the reporting window for a trial conversion
+// request. Returns ErrInvalidReportWindow if either date can't be parsed or the
+// window is empty.
+func conversionWindow(request *api.TrialConversionRequest) (time.Time, time.Time, error) {
+	var err error
+
+	end := time.Now()
+	if request.EndDate != "" {
+		if end, err = utils.ParseTimestamp(request.EndDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	start := end.Add(-defaultConversionWindow)
+	if request.StartDate != "" {
+		if start, err = utils.ParseTimestamp(request.StartDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+	}
+
+	return start, end, nil
+}
+
+func (a *App) trialConversions(ctx context.Context, request *api.TrialConversionRequest) *api.TrialConversionResponse {
+	response := &api.TrialConversionResponse{Plans: make([]*api.TrialConversionStats, 0)}
+
+	start, end, err := conversionWindow(request)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.StartDate, response.EndDate = start, end
+
+	d := a.readDatabase(ctx)
+
+	if request.PlanName != "" {
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithReadReplica(), db.WithIncludeDeleted())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if plan == nil {
+			response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+			return response
+		}
+	}
+
+	stats, err := d.TrialConversions(ctx, start, end, request.PlanName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, s := range stats {
+		planStats := &api.TrialConversionStats{
+			PlanName:  s.PlanName,
+			Started:   s.Started,
+			Converted: s.Converted,
+			Expired:   s.Expired,
+			Active:    s.Active,
+		}
+		if s.Started > 0 {
+			planStats.ConversionRate = float64(s.Converted) / float64(s.Started)
+		}
+		response.Plans = append(response.Plans, planStats)
+	}
+
+	return response
+}
+
+// TrialConversionsHandler reports how many of the trials started within a
+// window were converted to paid subscriptions, for each trial plan.
+func (a *App) TrialConversionsHandler(subject, reply string, request *api.TrialConversionRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reporting trial conversions")
+
+	response := a.trialConversions(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) TrialConversionsHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.TrialConversionRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.trialConversions(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,351 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// trialBatchSize is the maximum number of trial expiration notices that are
+// sent each time the worker runs.
+const trialBatchSize = 100
+
+func (a *App) setTrialPlan(ctx context.Context, request *api.TrialPlanRequest) *api.TrialPlanResponse {
+	response := &api.TrialPlanResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if request.TrialDays < 1 {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidTrialLength)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	plan, err := d.GetPlanByName(ctx, request.PlanName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrPlanNotFound)
+		return response
+	}
+
+	settings := &db.TrialSettings{IsTrial: request.IsTrial, TrialDays: request.TrialDays}
+	if err = d.SetPlanTrialSettings(ctx, plan.ID, settings); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	a.invalidatePlanSubscriptions(ctx, d, plan.ID)
+
+	response.PlanName = plan.Name
+	response.IsTrial = settings.IsTrial
+	response.TrialDays = settings.TrialDays
+	return response
+}
+
+// SetTrialPlanHandler changes whether a plan is a trial plan and how long its
+// trial subscriptions last.
+func (a *App) SetTrialPlanHandler(subject, reply string, request *api.TrialPlanRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting trial plan")
+
+	response := a.setTrialPlan(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetTrialPlanHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.TrialPlanRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.PlanName = c.Param("plan_name")
+
+	response := a.setTrialPlan(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// startTrialSubscription subscribes a user to a trial plan for the plan's trial
+// length and records the trial. Returns ErrNotTrialPlan if the plan isn't a
+// trial plan and ErrTrialAlreadyUsed if the user has already had a trial
+// subscription to it.
+func (a *App) startTrialSubscription(
+	ctx context.Context, d *db.Database, tx *goqu.TxDatabase, user *db.User, plan *db.Plan,
+) (*db.Trial, error) {
+	settings, err := d.GetPlanTrialSettings(ctx, plan.ID, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+	if !settings.IsTrial {
+		return nil, serrors.ErrNotTrialPlan
+	}
+
+	now := time.Now()
+	opts := db.DefaultSubscriptionOptions()
+	opts.EndDate = now.AddDate(0, 0, settings.TrialDays)
+	subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, opts, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+
+	trial := &db.Trial{
+		UserID:         user.ID,
+		Username:       user.Username,
+		PlanID:         plan.ID,
+		PlanName:       plan.Name,
+		SubscriptionID: sql.NullString{String: subscriptionID, Valid: true},
+		StartedAt:      now,
+		EndsAt:         opts.EndDate,
+	}
+	if trial.ID, err = d.AddTrial(ctx, trial, db.WithTX(tx)); err != nil {
+		return nil, err
+	}
+
+	return trial, nil
+}
+
+func (a *App) startTrial(ctx context.Context, request *api.StartTrialRequest) *api.TrialResponse {
+	response := &api.TrialResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if username == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsername)
+		return response
+	}
+
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
+
+	var trial *db.Trial
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		trial = nil
+
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return serrors.ErrPlanNotFound
+		}
+
+		user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if trial, err = a.startTrialSubscription(ctx, d, tx, user, plan); err != nil {
+			return err
+		}
+
+		return a.recordEvent(ctx, d, tx, api.EventSubscriptionCreated, &api.SubscriptionEventData{
+			SubscriptionID: trial.SubscriptionID.String,
+			Username:       username,
+			PlanName:       plan.Name,
+		})
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	a.notify(ctx, api.EventSubscriptionCreated, &api.SubscriptionEventData{
+		SubscriptionID: trial.SubscriptionID.String,
+		Username:       username,
+		PlanName:       trial.PlanName,
+	})
+	a.invalidateSubscriptions(ctx, username)
+	a.projectOverages(ctx, username)
+
+	response.Trial = trial.ToAPIType()
+	return response
+}
+
+// StartTrialHandler subscribes a user to a trial plan. Each user may only have
+// one trial subscription to each trial plan.
+func (a *App) StartTrialHandler(subject, reply string, request *api.StartTrialRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "starting trial")
+
+	response := a.startTrial(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) StartTrialHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.StartTrialRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.startTrial(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartTrialExpirationWorker sends notices for trial subscriptions that end
+// within the notice period at regular intervals until the context is done.
+func (a *App) StartTrialExpirationWorker(ctx context.Context, interval, notice time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Notices can't be recorded while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			// Keep going until there's nothing left to send.
+			for {
+				count, err := a.SendTrialExpirationNotices(ctx, notice)
+				if err != nil {
+					log.Errorf("unable to send trial expiration notices: %s", err)
+				}
+				if err != nil || count < trialBatchSize {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// SendTrialExpirationNotices sends a single batch of notices for trial
+// subscriptions that end within the notice period and returns the number of
+// notices that were sent. Each trial only receives one notice.
+func (a *App) SendTrialExpirationNotices(ctx context.Context, notice time.Duration) (int, error) {
+	d := a.database(ctx)
+
+	var trials []db.Trial
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+
+		trials, err = d.ExpiringTrials(ctx, time.Now().Add(notice), trialBatchSize, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		ids := make([]string, len(trials))
+		for i, trial := range trials {
+			ids[i] = trial.ID
+			if err = a.recordEvent(ctx, d, tx, api.EventTrialExpiring, trialEventData(&trial)); err != nil {
+				return err
+			}
+		}
+
+		return d.MarkTrialExpirationsNotified(ctx, ids, db.WithTX(tx))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, trial := range trials {
+		log.Infof("the %s trial for %s ends at %s", trial.PlanName, trial.Username, trial.EndsAt)
+		a.notify(ctx, api.EventTrialExpiring, trialEventData(&trial))
+	}
+
+	return len(trials), nil
+}
+
+// trialEventData returns the event data for a trial.
+func trialEventData(trial *db.Trial) *api.TrialEventData {
+	return &api.TrialEventData{
+		SubscriptionID: trial.SubscriptionID.String,
+		Username:       trial.Username,
+		PlanName:       trial.PlanName,
+		EndsAt:         trial.EndsAt,
+	}
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/units"
+)
+
+// convertToResourceUnit converts an amount that a producer reported in a unit
+// to the unit that the resource type is tracked in, such as GiB to bytes.
+// Returns ErrInvalidResourceUnit if the unit is missing or can't be converted.
+func convertToResourceUnit(value float64, unit string, resourceType *db.ResourceType) (float64, error) {
+	if strings.TrimSpace(unit) == "" {
+		return 0, serrors.ErrInvalidResourceUnit
+	}
+	return units.Convert(value, unit, resourceType.Unit)
+}
+
+// displayQuantity converts an amount in a unit to the largest unit that it's
+// at least one of, for display.
+func displayQuantity(value float64, unit string) api.Quantity {
+	value, unit = units.Humanize(value, unit)
+	return api.Quantity{Value: value, Unit: unit}
+}
+
+// displayAmounts converts the quota, usage and remaining amount of a resource
+// type to units that are easy to read. Each amount is converted separately, so
+// a quota in terabytes can be shown next to usage in gigabytes.
+func displayAmounts(resourceType api.ResourceType, quota, usage, remaining float64) *api.DisplayAmounts {
+	return &api.DisplayAmounts{
+		Quota:     displayQuantity(quota, resourceType.Unit),
+		Usage:     displayQuantity(usage, resourceType.Unit),
+		Remaining: displayQuantity(remaining, resourceType.Unit),
+	}
+}
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/cyverse-de/p/go/qms"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// UpdateMaskHeader is the name of the message header (and HTTP header) that
+// lists the fields to change in an add-on update, separated by commas. The QMS
+// messages don't have a field for a FieldMask, so it's passed in the header
+// instead. The fields are named using the protocol buffer field names of the
+// add-on, such as default_amount.
+const UpdateMaskHeader = "x-qms-update-mask"
+
+// parseUpdateMask converts the value of the update mask header to a FieldMask
+// for the message, returning nil if the header is empty.
+func parseUpdateMask(value string, m *qms.Addon) (*fieldmaskpb.FieldMask, error) {
+	var paths []string
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	mask, err := fieldmaskpb.New(m, paths...)
+	if err != nil {
+		return nil, serrors.ErrInvalidUpdateMask
+	}
+	mask.Normalize()
+	return mask, nil
+}
+
+// applyAddonUpdateMask replaces the update flags in an add-on update request
+// with the fields named in the update mask header, so that only those fields
+// are changed. Fields that aren't named are left alone even if they're empty in
+// the request, and fields that are named are changed even if they're empty.
+// The flags in the request are used as they are if the header is empty.
+func applyAddonUpdateMask(request *qms.UpdateAddonRequest, value string) error {
+	mask, err := parseUpdateMask(value, request.GetAddon())
+	if err != nil || mask == nil {
+		return err
+	}
+
+	request.UpdateName = false
+	request.UpdateDescription = false
+	request.UpdateResourceType = false
+	request.UpdateDefaultAmount = false
+	request.UpdateDefaultPaid = false
+	request.UpdateAddonRates = false
+
+	for _, path := range mask.GetPaths() {
+		switch path {
+		case "name":
+			request.UpdateName = true
+		case "description":
+			request.UpdateDescription = true
+		case "resource_type":
+			request.UpdateResourceType = true
+		case "default_amount":
+			request.UpdateDefaultAmount = true
+		case "default_paid":
+			request.UpdateDefaultPaid = true
+		case "addon_rates":
+			request.UpdateAddonRates = true
+		default:
+			return serrors.ErrInvalidUpdateMask
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultRollupWindow is the length of the usage rollup reporting window when
+// the start date isn't specified.
+const defaultRollupWindow = 30 * 24 * time.Hour
+
+// usageRollupOverlap is how far before the previous aggregation the aggregator
+// looks for updates, so that updates from transactions that were still open
+// during the previous aggregation are included.
+const usageRollupOverlap = 10 * time.Minute
+
+// rollupWindow returns the reporting window for a usage rollup request, which
+// covers whole days in UTC. Returns ErrInvalidReportWindow if either date can't
+// be parsed or the window is empty.
+func rollupWindow(startDate, endDate string) (time.Time, time.Time, error) {
+	var err error
+
+	end := time.Now()
+	if endDate != "" {
+		if end, err = utils.ParseTimestamp(endDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	start := end.Add(-defaultRollupWindow)
+	if startDate != "" {
+		if start, err = utils.ParseTimestamp(startDate); err != nil {
+			return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+		}
+	}
+
+	// A partial day at the end of the window is included in full.
+	start = start.UTC().Truncate(24 * time.Hour)
+	if day := end.UTC().Truncate(24 * time.Hour); day.Equal(end) {
+		end = day
+	} else {
+		end = day.AddDate(0, 0, 1)
+	}
+
+	if !start.Before(end) {
+		return time.Time{}, time.Time{}, serrors.ErrInvalidReportWindow
+	}
+
+	return start, end, nil
+}
+
+func (a *App) usageTotals(ctx context.Context, request *api.UsageTotalsRequest) *api.UsageTotalsResponse {
+	response := &api.UsageTotalsResponse{Users: make([]*api.UsageTotal, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	start, end, err := rollupWindow(request.StartDate, request.EndDate)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.StartDate, response.EndDate = start, end
+
+	d := a.readDatabase(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+	response.ResourceType = api.ResourceType{
+		ID:   resourceType.ID,
+		Name: resourceType.Name,
+		Unit: resourceType.Unit,
+	}
+
+	totals, err := d.UsageTotalsByUser(ctx, resourceType.ID, start, end, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, total := range totals {
+		response.Users = append(response.Users, &api.UsageTotal{
+			Username:    total.Username,
+			Consumed:    total.Consumed,
+			UpdateCount: total.UpdateCount,
+		})
+	}
+
+	return response
+}
+
+// UsageTotalsHandler reports the total usage of a resource type consumed by
+// each user during a window, using the usage rollups.
+func (a *App) UsageTotalsHandler(subject, reply string, request *api.UsageTotalsRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reporting usage totals")
+
+	response := a.usageTotals(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) UsageTotalsHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UsageTotalsRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.usageTotals(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) usageRollups(ctx context.Context, request *api.UsageRollupsRequest) *api.UsageRollupsResponse {
+	response := &api.UsageRollupsResponse{Rollups: make([]*api.UsageRollup, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	response.Granularity = request.Granularity
+	if response.Granularity == "" {
+		response.Granularity = api.RollupDaily
+	}
+
+	start, end, err := rollupWindow(request.StartDate, request.EndDate)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.StartDate, response.EndDate = start, end
+
+	d := a.readDatabase(ctx)
+
+	var resourceTypeID string
+	if request.ResourceName != "" {
+		resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName, db.WithReadReplica())
+		if err != nil {
+			response.Error = serrors.NatsError(ctx, err)
+			return response
+		}
+		if resourceType.ID == "" {
+			response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+			return response
+		}
+		resourceTypeID = resourceType.ID
+	}
+
+	rollups, err := d.UserUsageRollups(
+		ctx, username, resourceTypeID, response.Granularity, start, end, db.WithReadReplica(),
+	)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, rollup := range rollups {
+		response.Rollups = append(response.Rollups, rollup.ToAPIType())
+	}
+
+	return response
+}
+
+// UsageRollupsHandler lists the daily or monthly usage rollups for a user.
+func (a *App) UsageRollupsHandler(subject, reply string, request *api.UsageRollupsRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing usage rollups")
+
+	response := a.usageRollups(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) UsageRollupsHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UsageRollupsRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+	request.Username = c.Param("username")
+
+	response := a.usageRollups(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// StartUsageRollupAggregator adds the usage updates that have been recorded
+// since the last aggregation to the usage rollups at regular intervals until
+// the context is done.
+func (a *App) StartUsageRollupAggregator(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Nothing can be aggregated while the database is read-only.
+			if a.checkWritable() != nil {
+				continue
+			}
+
+			count, err := a.AggregateUsageRollups(ctx)
+			if err != nil {
+				log.Errorf("unable to aggregate usage rollups: %s", err)
+				continue
+			}
+			if count > 0 {
+				log.Debugf("refreshed %d daily usage rollups", count)
+			}
+		}
+	}()
+}
+
+// AggregateUsageRollups adds the usage updates that have been recorded since
+// the last aggregation to the usage rollups, and returns the number of daily
+// rollups that were refreshed.
+func (a *App) AggregateUsageRollups(ctx context.Context) (int64, error) {
+	var count int64
+
+	d := a.database(ctx)
+
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+		count, err = d.AggregateUsageRollups(ctx, usageRollupOverlap, db.WithTX(tx))
+		return err
+	})
+
+	return count, err
+}
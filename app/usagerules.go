@@ -0,0 +1,327 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// nullFloat converts an optional value from a request to a nullable float.
+func nullFloat(value *float64) sql.NullFloat64 {
+	if value == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *value, Valid: true}
+}
+
+func (a *App) setUsageRule(ctx context.Context, request *api.UsageRuleRequest) *api.UsageRuleResponse {
+	response := &api.UsageRuleResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	action := request.Action
+	if action == "" {
+		action = api.UsageRuleReject
+	}
+	invalidRange := request.MinValue != nil && request.MaxValue != nil && *request.MinValue > *request.MaxValue
+	invalidDelta := request.MaxHourlyDelta != nil && *request.MaxHourlyDelta < 0
+	validAction := action == api.UsageRuleReject || action == api.UsageRuleFlag || action == api.UsageRuleQuarantine
+	if !validAction || invalidRange || invalidDelta {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidUsageRule)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidResourceName)
+		return response
+	}
+
+	rule := &db.UsageRule{
+		ResourceType:   *resourceType,
+		MinValue:       nullFloat(request.MinValue),
+		MaxValue:       nullFloat(request.MaxValue),
+		MaxHourlyDelta: nullFloat(request.MaxHourlyDelta),
+		AllowNegative:  request.AllowNegative,
+		Action:         action,
+		LastModifiedBy: requestedBy,
+	}
+	if err = d.SetUsageRule(ctx, rule); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Rule = rule.ToAPIType()
+	return response
+}
+
+// SetUsageRuleHandler sets the rule that usage updates for a resource type are
+// validated against.
+func (a *App) SetUsageRuleHandler(subject, reply string, request *api.UsageRuleRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "setting usage rule")
+
+	response := a.setUsageRule(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) SetUsageRuleHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UsageRuleRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.setUsageRule(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listUsageRules(ctx context.Context) *api.UsageRuleListResponse {
+	response := &api.UsageRuleListResponse{Rules: make([]*api.UsageRule, 0)}
+	d := a.readDatabase(ctx)
+
+	rules, err := d.ListUsageRules(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for i := range rules {
+		response.Rules = append(response.Rules, rules[i].ToAPIType())
+	}
+	return response
+}
+
+// ListUsageRulesHandler lists the usage validation rules of the resource types
+// that have them.
+func (a *App) ListUsageRulesHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing usage rules")
+
+	response := a.listUsageRules(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListUsageRulesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listUsageRules(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listFlaggedUsageUpdates(ctx context.Context, request *api.FlaggedUsageUpdatesRequest) *api.FlaggedUsageUpdateListResponse {
+	response := &api.FlaggedUsageUpdateListResponse{Updates: make([]*api.FlaggedUsageUpdate, 0)}
+	d := a.readDatabase(ctx)
+
+	updates, err := d.ListFlaggedUsageUpdates(ctx, request.IncludeReviewed, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for i := range updates {
+		response.Updates = append(response.Updates, updates[i].ToAPIType())
+	}
+	return response
+}
+
+// ListFlaggedUsageUpdatesHandler lists the usage updates that broke the
+// validation rules of their resource types.
+func (a *App) ListFlaggedUsageUpdatesHandler(subject, reply string, request *api.FlaggedUsageUpdatesRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing flagged usage updates")
+
+	response := a.listFlaggedUsageUpdates(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListFlaggedUsageUpdatesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := api.FlaggedUsageUpdatesRequest{}
+	if value := c.QueryParam("include_reviewed"); value != "" {
+		includeReviewed, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"message": "include_reviewed must be true or false",
+			})
+		}
+		request.IncludeReviewed = includeReviewed
+	}
+
+	response := a.listFlaggedUsageUpdates(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) reviewFlaggedUsageUpdate(ctx context.Context, request *api.ReviewFlaggedUsageUpdateRequest) *api.FlaggedUsageUpdateResponse {
+	response := &api.FlaggedUsageUpdateResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	update, err := a.database(ctx).ReviewFlaggedUsageUpdate(ctx, request.ID, requestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if update == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrFlaggedUpdateNotFound)
+		return response
+	}
+
+	response.Update = update.ToAPIType()
+	return response
+}
+
+// ReviewFlaggedUsageUpdateHandler marks a flagged usage update as reviewed.
+func (a *App) ReviewFlaggedUsageUpdateHandler(subject, reply string, request *api.ReviewFlaggedUsageUpdateRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "reviewing flagged usage update")
+
+	response := a.reviewFlaggedUsageUpdate(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ReviewFlaggedUsageUpdateHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.ReviewFlaggedUsageUpdateRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.ID = c.Param("id")
+
+	response := a.reviewFlaggedUsageUpdate(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
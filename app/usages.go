@@ -2,9 +2,12 @@ package app
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/p/go/header"
 	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
@@ -13,6 +16,42 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// The names of the message headers (and HTTP headers) used when usage is added.
+// The quota and the amount of it that's left are returned in the response
+// headers, since the QMS usage response doesn't have fields for them, as is the
+// ID of the quarantined update if the update was held for review. Producers
+// that don't wait for responses can set the no reply header to true so that
+// no response is sent.
+const (
+	QuotaHeader             = "x-qms-quota"
+	RemainingQuotaHeader    = "x-qms-remaining-quota"
+	QuarantinedUpdateHeader = "x-qms-quarantined-update"
+	NoReplyHeader           = "x-qms-no-reply"
+)
+
+// setQuotaHeaders adds the quota and the amount of it that hasn't been used to
+// a response header. The remaining quota doesn't go below zero.
+func setQuotaHeaders(h *header.Header, quota, usage float64) {
+	setHeaderValue(h, QuotaHeader, strconv.FormatFloat(quota, 'f', -1, 64))
+	setHeaderValue(h, RemainingQuotaHeader, strconv.FormatFloat(max(quota-usage, 0), 'f', -1, 64))
+}
+
+// setHTTPQuotaHeaders copies the quota and quarantine headers from a response
+// header to the HTTP response headers.
+func setHTTPQuotaHeaders(c echo.Context, h *header.Header) {
+	for _, name := range []string{QuotaHeader, RemainingQuotaHeader, QuarantinedUpdateHeader} {
+		if value := headerValue(h, name); value != "" {
+			c.Response().Header().Set(name, value)
+		}
+	}
+}
+
+// noReply returns true if the request header asks for no response to be sent.
+func noReply(h *header.Header) bool {
+	noReply, err := strconv.ParseBool(headerValue(h, NoReplyHeader))
+	return err == nil && noReply
+}
+
 func (a *App) getUsages(ctx context.Context, request *qms.GetUsages) *qms.UsageList {
 	response := pbinit.NewUsageList()
 
@@ -22,15 +61,15 @@ func (a *App) getUsages(ctx context.Context, request *qms.GetUsages) *qms.UsageL
 		return response
 	}
 
-	d := db.New(a.db)
+	d := a.readDatabase(ctx)
 
-	subscription, err := d.GetActiveSubscription(ctx, username)
+	subscription, err := a.activeSubscription(ctx, d, username, false, true)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
 
-	usages, err := d.SubscriptionUsages(ctx, subscription.ID)
+	usages, err := d.SubscriptionUsages(ctx, subscription.ID, db.WithReadReplica())
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
@@ -64,10 +103,13 @@ func (a *App) GetUsagesHandler(subject, reply string, request *qms.GetUsages) {
 	ctx, span := pbinit.InitGetUsages(request, subject)
 	defer span.End()
 
-	response := a.getUsages(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.GetUsages(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -88,6 +130,7 @@ func (a *App) GetUsagesHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -98,15 +141,31 @@ func (a *App) addUsage(ctx context.Context, request *qms.AddUsage) *qms.UsageRes
 	)
 
 	response := pbinit.NewUsageResponse()
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
 
-	d := db.New(a.db)
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
 
-	subscription, err := d.GetActiveSubscription(ctx, username)
+	subscription, err := a.activeSubscription(ctx, d, username, false, false)
+	if err == errors.ErrSubscriptionNotFound && a.autoSubscribe {
+		subscription, err = d.SubscribeToDefaultPlan(ctx, username, a.subscriptionOpts()...)
+	}
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
@@ -118,41 +177,96 @@ func (a *App) addUsage(ctx context.Context, request *qms.AddUsage) *qms.UsageRes
 		return response
 	}
 
-	resourceID, err := d.GetResourceTypeID(ctx, request.ResourceName, request.ResourceUnit)
+	resourceType, err := d.GetResourceTypeByName(ctx, request.ResourceName)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	if resourceType.ID == "" {
+		response.Error = errors.NatsError(ctx, errors.ErrInvalidResourceName)
+		return response
+	}
+	resourceID := resourceType.ID
+
+	// Usage can be reported in any unit that converts to the resource type's
+	// unit, such as GiB for a resource type that's tracked in bytes.
+	value, err := convertToResourceUnit(request.UsageValue, request.ResourceUnit, resourceType)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
 
 	usage = db.Usage{
-		Usage:          request.UsageValue,
+		Usage:          value,
 		SubscriptionID: subscription.ID,
-		ResourceType: db.ResourceType{
-			ID:   resourceID,
-			Name: request.ResourceName,
-			Unit: request.ResourceUnit,
-		},
+		ResourceType:   *resourceType,
 	}
 
-	if err = d.CalculateUsage(ctx, request.UpdateType, &usage); err != nil {
+	// The updated usage and the quota are read in the same transaction as the
+	// update so that the response reflects it.
+	var (
+		updated      *db.Usage
+		quota        float64
+		quarantineID string
+	)
+	tx, err := d.Begin()
+	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
-
-	u, _, err := d.GetCurrentUsage(ctx, resourceID, subscription.ID)
+	err = tx.Wrap(func() error {
+		// Quarantined updates are held rather than applied, so the quarantine
+		// is committed and the unchanged usage is returned.
+		err := d.CalculateUsage(ctx, request.UpdateType, &usage, db.WithTX(tx))
+		if quarantined, ok := errors.UsageQuarantine(err); ok {
+			quarantineID = quarantined.ID
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+
+		updated, err = d.GetUsage(ctx, resourceID, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if updated == nil && quarantineID != "" {
+			updated = &db.Usage{SubscriptionID: subscription.ID, ResourceType: *resourceType}
+		}
+		if updated == nil {
+			return fmt.Errorf("the updated usage could not be found")
+		}
+
+		quota, _, err = d.GetCurrentQuota(ctx, resourceID, subscription.ID, db.WithTX(tx))
+		return err
+	})
+	if rejected, ok := errors.UsageRejection(err); ok {
+		d.RecordRejectedUsage(ctx, request.UpdateType, &usage, rejected)
+	}
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
 
+	a.projectOverages(ctx, username)
+
 	response.Usage = &qms.Usage{
-		Usage:          u,
+		Uuid:           updated.ID,
+		Usage:          updated.Usage,
 		SubscriptionId: subscription.ID,
 		ResourceType: &qms.ResourceType{
-			Uuid: resourceID,
-			Name: request.ResourceName,
-			Unit: request.ResourceUnit,
+			Uuid: updated.ResourceType.ID,
+			Name: updated.ResourceType.Name,
+			Unit: updated.ResourceType.Unit,
 		},
+		CreatedAt:      timestamppb.New(updated.CreatedAt),
+		CreatedBy:      updated.CreatedBy,
+		LastModifiedBy: updated.LastModifiedBy,
+		LastModifiedAt: timestamppb.New(updated.LastModifiedAt),
+	}
+	setQuotaHeaders(response.Header, quota, updated.Usage)
+	if quarantineID != "" {
+		setHeaderValue(response.Header, QuarantinedUpdateHeader, quarantineID)
 	}
 
 	return response
@@ -164,10 +278,18 @@ func (a *App) AddUsageHandler(subject, reply string, request *qms.AddUsage) {
 	ctx, span := pbinit.InitAddUsage(request, subject)
 	defer span.End()
 
-	response := a.addUsage(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.AddUsage(ctx, request)
+
+	if err != nil {
+		log.Error(err)
+	}
+
+	// Fire-and-forget producers don't wait for the response.
+	if reply == "" || noReply(request.GetHeader()) {
+		return
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -197,5 +319,7 @@ func (a *App) AddUsageHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	setHTTPQuotaHeaders(c, response.Header)
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
@@ -0,0 +1,235 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+// subscriptionToEnd returns the active subscription that isn't kept when two
+// users with active subscriptions are merged. Ties between subscriptions that
+// end at the same time go to the target user's subscription.
+func subscriptionToEnd(policy string, source, target *db.Subscription) *db.Subscription {
+	switch policy {
+	case api.MergePolicyKeepSource:
+		return target
+	case api.MergePolicyKeepLatest:
+		if target.Perpetual() {
+			return source
+		}
+		if source.Perpetual() || source.EffectiveEndDate.After(target.EffectiveEndDate) {
+			return target
+		}
+		return source
+	default:
+		return source
+	}
+}
+
+// lockUsersForMerge locks the source and target users for the rest of the
+// transaction. The users are always locked in the same order so that
+// concurrent merges of the same pair of users can't deadlock.
+func lockUsersForMerge(
+	ctx context.Context, d *db.Database, tx *goqu.TxDatabase, sourceUsername, targetUsername string,
+) (*db.User, *db.User, error) {
+	usernames := []string{sourceUsername, targetUsername}
+	if targetUsername < sourceUsername {
+		usernames = []string{targetUsername, sourceUsername}
+	}
+
+	users := make(map[string]*db.User, len(usernames))
+	for _, username := range usernames {
+		user, err := d.LockUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return nil, nil, err
+		}
+		if user == nil {
+			return nil, nil, serrors.ErrUserNotFound
+		}
+		users[username] = user
+	}
+
+	return users[sourceUsername], users[targetUsername], nil
+}
+
+func (a *App) mergeUsers(ctx context.Context, request *api.UserMergeRequest) *api.UserMergeResponse {
+	response := &api.UserMergeResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	sourceUsername, err := a.requestedUsername(request.SourceUsername)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	targetUsername, err := a.requestedUsername(request.TargetUsername)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if sourceUsername == targetUsername {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidMerge)
+		return response
+	}
+
+	policy := request.Policy
+	if policy == "" {
+		policy = api.MergePolicyKeepTarget
+	}
+	if !api.ValidMergePolicy(policy) {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidMergePolicy)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	var (
+		merge     *db.UserMerge
+		eventData *api.SubscriptionEventData
+	)
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		merge, eventData = nil, nil
+
+		source, target, err := lockUsersForMerge(ctx, d, tx, sourceUsername, targetUsername)
+		if err != nil {
+			return err
+		}
+
+		m := &db.UserMerge{
+			SourceUserID:   source.ID,
+			SourceUsername: source.Username,
+			TargetUserID:   target.ID,
+			TargetUsername: target.Username,
+			Policy:         policy,
+			MergedBy:       requestedBy,
+		}
+
+		// Only one of the users' active subscriptions can survive the merge.
+		sourceSubscription, err := d.GetActiveSubscription(ctx, source.Username, db.WithTX(tx))
+		if err != nil && err != serrors.ErrSubscriptionNotFound {
+			return err
+		}
+		targetSubscription, err := d.GetActiveSubscription(ctx, target.Username, db.WithTX(tx))
+		if err != nil && err != serrors.ErrSubscriptionNotFound {
+			return err
+		}
+		if sourceSubscription != nil && targetSubscription != nil {
+			ended := subscriptionToEnd(policy, sourceSubscription, targetSubscription)
+			if err = d.EndSubscription(ctx, ended.ID, requestedBy, db.WithTX(tx)); err != nil {
+				return err
+			}
+
+			// A plan change scheduled for the ended subscription would start
+			// a new subscription that overlaps the one that was kept.
+			if err = d.CancelPlanChangesForSubscription(ctx, ended.ID, db.WithTX(tx)); err != nil {
+				return err
+			}
+
+			m.EndedSubscriptionID = sql.NullString{String: ended.ID, Valid: true}
+			eventData = &api.SubscriptionEventData{
+				SubscriptionID: ended.ID,
+				Username:       ended.User.Username,
+				PlanName:       ended.Plan.Name,
+			}
+			if err = a.recordEvent(ctx, d, tx, api.EventSubscriptionExpired, eventData); err != nil {
+				return err
+			}
+		}
+
+		if err = d.MergeUserRecords(ctx, m, db.WithTX(tx)); err != nil {
+			return err
+		}
+		if _, err = d.AddUserMerge(ctx, m, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		merge = m
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if eventData != nil {
+		a.notify(ctx, api.EventSubscriptionExpired, eventData)
+	}
+	a.invalidateSubscriptions(ctx, sourceUsername, targetUsername)
+	a.projectOverages(ctx, targetUsername)
+	a.removeOverageProjection(sourceUsername)
+
+	response.Merge = merge.ToAPIType()
+	return response
+}
+
+// MergeUsersHandler merges one user record into another, such as when a
+// username change has created a duplicate user.
+func (a *App) MergeUsersHandler(subject, reply string, request *api.UserMergeRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "merging users")
+
+	response := a.mergeUsers(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	} else {
+		log.Infof("merged %s into %s", response.Merge.SourceUsername, response.Merge.TargetUsername)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) MergeUsersHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UserMergeRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.mergeUsers(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,395 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+// The default and maximum number of users returned in a single page.
+const (
+	defaultUserPageSize = 100
+	maxUserPageSize     = 1000
+)
+
+// userPageSize returns the number of users to include in a page, given the
+// number that was requested.
+func userPageSize(requested uint) uint {
+	switch {
+	case requested == 0:
+		return defaultUserPageSize
+	case requested > maxUserPageSize:
+		return maxUserPageSize
+	default:
+		return requested
+	}
+}
+
+// requestedUsername returns the normalized username from a user request, or
+// ErrInvalidUsername if it's empty.
+func (a *App) requestedUsername(username string) (string, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		return "", serrors.ErrInvalidUsername
+	}
+	return username, nil
+}
+
+func (a *App) createUser(ctx context.Context, request *api.UserRequest) *api.UserResponse {
+	response := &api.UserResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	id, err := d.AddUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.User = &api.User{ID: id, Username: username}
+	return response
+}
+
+// CreateUserHandler adds a user without subscribing them to a plan. It fails
+// if the user already exists.
+func (a *App) CreateUserHandler(subject, reply string, request *api.UserRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "creating user")
+
+	response := a.createUser(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) CreateUserHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UserRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.createUser(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) ensureUser(ctx context.Context, request *api.UserRequest) *api.UserResponse {
+	response := &api.UserResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	user, err := d.EnsureUser(ctx, username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if user == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrUserNotFound)
+		return response
+	}
+
+	response.User = user.ToAPIType()
+	return response
+}
+
+// EnsureUserHandler adds a user if they don't exist already and returns the
+// user either way.
+func (a *App) EnsureUserHandler(subject, reply string, request *api.UserRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "ensuring user")
+
+	response := a.ensureUser(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) EnsureUserHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.UserRequest{Username: c.Param("username")}
+	response := a.ensureUser(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getUser(ctx context.Context, request *api.UserRequest) *api.UserResponse {
+	response := &api.UserResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.readDatabase(ctx)
+
+	var (
+		user *db.User
+		err  error
+	)
+	if request.UUID != "" {
+		user, err = d.GetUser(ctx, request.UUID, db.WithReadReplica())
+		if err == nil && user.ID == "" {
+			user = nil
+		}
+	} else {
+		var username string
+		if username, err = a.requestedUsername(request.Username); err == nil {
+			user, err = d.GetUserByUsername(ctx, username, db.WithReadReplica())
+		}
+	}
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if user == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrUserNotFound)
+		return response
+	}
+
+	response.User = user.ToAPIType()
+	return response
+}
+
+// GetUserHandler looks up a user by UUID or, if the UUID isn't provided, by
+// username.
+func (a *App) GetUserHandler(subject, reply string, request *api.UserRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting user")
+
+	response := a.getUser(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetUserHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.UserRequest{Username: c.Param("username")}
+	response := a.getUser(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listUsers(ctx context.Context, request *api.UserListRequest) *api.UserListResponse {
+	response := &api.UserListResponse{Users: make([]*api.User, 0)}
+
+	d := a.readDatabase(ctx)
+
+	total, err := d.CountUsers(ctx, request.Search, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	users, err := d.ListUsers(
+		ctx,
+		request.Search,
+		db.WithReadReplica(),
+		db.WithQueryLimit(userPageSize(request.Limit)),
+		db.WithQueryOffset(request.Offset),
+	)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, user := range users {
+		response.Users = append(response.Users, user.ToAPIType())
+	}
+	response.Total = total
+
+	return response
+}
+
+// ListUsersHandler lists a page of users, optionally limited to the users whose
+// usernames contain a search string.
+func (a *App) ListUsersHandler(subject, reply string, request *api.UserListRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing users")
+
+	response := a.listUsers(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListUsersHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.UserListRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid query parameters",
+		})
+	}
+
+	response := a.listUsers(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) normalizeUsername(ctx context.Context, request *api.NormalizeUsernameRequest) *api.NormalizeUsernameResponse {
+	response := &api.NormalizeUsernameResponse{Username: request.Username}
+
+	normalized, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Normalized = normalized
+	return response
+}
+
+// NormalizeUsernameHandler returns the canonical form of a username, which lets
+// other services find out how usernames are stored without duplicating the
+// normalization rules.
+func (a *App) NormalizeUsernameHandler(subject, reply string, request *api.NormalizeUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "normalizing username")
+
+	response := a.normalizeUsername(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) NormalizeUsernameHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.NormalizeUsernameRequest{
+		Username: c.QueryParam("username"),
+	}
+	response := a.normalizeUsername(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) purgeUser(ctx context.Context, request *api.PurgeUserRequest) *api.PurgeUserResponse {
+	response := &api.PurgeUserResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.requestedUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if requestedBy == "" {
+		requestedBy = "de"
+	}
+
+	d := a.database(ctx)
+
+	var purge *db.UserPurge
+	err = d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		purge = nil
+
+		user, err := d.LockUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return serrors.ErrUserNotFound
+		}
+
+		p := &db.UserPurge{
+			UserID:         user.ID,
+			UsernameSHA256: db.UsernameHash(user.Username),
+			PurgedBy:       requestedBy,
+		}
+		if err = d.PurgeUserRecords(ctx, p, user.Username, db.WithTX(tx)); err != nil {
+			return err
+		}
+		if _, err = d.AddUserPurge(ctx, p, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		purge = p
+		return nil
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	a.invalidateSubscriptions(ctx, username)
+	a.removeOverageProjection(username)
+
+	response.Purge = purge.ToAPIType()
+	return response
+}
+
+// PurgeUserHandler deletes all of a user's data in response to a data-deletion
+// request and leaves a tombstone that doesn't contain the username.
+func (a *App) PurgeUserHandler(subject, reply string, request *api.PurgeUserRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "purging user")
+
+	response := a.purgeUser(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	} else {
+		log.Infof("purged user %s", response.Purge.UserID)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) PurgeUserHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.PurgeUserRequest{
+		Username:    c.Param("username"),
+		RequestedBy: c.QueryParam("requested_by"),
+	}
+	response := a.purgeUser(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
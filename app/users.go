@@ -6,6 +6,7 @@ import (
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/cyverse-de/subscriptions/utils"
@@ -13,28 +14,64 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.AddUserResponse {
+// addUser adds a user if necessary and subscribes them to the requested plan
+// unless they're already on it. The external reference is attached to the new
+// subscription, and the discount code, if there is one, is redeemed for it.
+// Neither is used if a new subscription isn't needed. In a dry run, the
+// response describes the outcome, but the transaction is rolled back.
+func (a *App) addUser(
+	ctx context.Context, request *qms.AddUserRequest, ref *db.ExternalRef, discountCode, dryRunValue, perpetualValue string,
+) *qms.AddUserResponse {
 	response := pbinit.NewQMSAddUserResponse()
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+
+	dryRun, err := parseDryRun(dryRunValue)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	setDryRunHeader(response.Header, dryRun)
+
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
 
-	d := db.New(a.db)
+	ctx, unlock, err := a.lockUser(ctx, username)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	defer unlock()
+
+	d := a.database(ctx)
 
 	opts, err := utils.OptsForValues(request.Paid, request.Periods, request.EndDate)
 	if err != nil {
 		response.Error = errors.NatsError(ctx, err)
 		return response
 	}
+	if opts.Perpetual, err = parsePerpetual(perpetualValue); err != nil {
+		response.Error = errors.NatsError(ctx, err)
+		return response
+	}
+	if opts.Perpetual && !opts.EndDate.IsZero() {
+		response.Error = errors.NatsError(ctx, errors.ErrPerpetualEndDate)
+		return response
+	}
 	log = log.WithFields(
 		logrus.Fields{
-			"user":     username,
-			"plan":     request.PlanName,
-			"paid":     opts.Paid,
-			"periods":  opts.Periods,
-			"end_date": opts.EndDate,
+			"user":      username,
+			"plan":      request.PlanName,
+			"paid":      opts.Paid,
+			"periods":   opts.Periods,
+			"end_date":  opts.EndDate,
+			"perpetual": opts.Perpetual,
 		},
 	)
 
@@ -56,6 +93,32 @@ func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.Add
 		return response
 	}
 
+	// A request with an external ID that has already been used is treated as a
+	// retry of the request that used it first.
+	if ref != nil {
+		existingID, err := d.SubscriptionIDForExternalRef(ctx, ref, db.WithTX(tx))
+		if err != nil {
+			response.Error = errors.NatsError(ctx, err)
+			return response
+		}
+		if existingID != "" {
+			existing, err := d.GetSubscriptionByID(ctx, existingID, db.WithTX(tx))
+			if err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
+			if existing.User.Username != username || existing.Plan.ID != plan.ID {
+				response.Error = errors.NatsError(ctx, errors.ErrExternalIDExists)
+				return response
+			}
+			response.PlanName = existing.Plan.Name
+			response.PlanUuid = existing.Plan.ID
+			response.Username = existing.User.Username
+			response.Uuid = existing.User.ID
+			return response
+		}
+	}
+
 	// look for an existing user.
 	userExists, err := d.UserExists(ctx, username, db.WithTX(tx))
 	if err != nil {
@@ -78,6 +141,14 @@ func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.Add
 			response.Error = errors.NatsError(ctx, err)
 			return response
 		}
+
+		// Lock the user's current subscription, if there is one, so that other
+		// changes to it wait until this one is done.
+		_, err = d.GetActiveSubscription(ctx, username, db.WithTX(tx), db.WithForUpdate())
+		if err != nil && err != errors.ErrSubscriptionNotFound {
+			response.Error = errors.NatsError(ctx, err)
+			return response
+		}
 	}
 
 	// Create a new subscription if the caller requested it.
@@ -103,18 +174,82 @@ func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.Add
 		createSubscription = !onPlan
 	}
 
-	// Create the subscription if we're supposed to.
+	// Create the subscription if we're supposed to. A new subscription to the
+	// plan that the user is already on is treated as a renewal.
+	var (
+		subscriptionID string
+		redemption     *db.DiscountRedemption
+	)
+	eventType := api.EventSubscriptionCreated
 	if createSubscription {
-		if _, err = d.SetActiveSubscription(ctx, userID, plan, opts, db.WithTX(tx)); err != nil {
+		renewal, err := d.UserOnPlan(ctx, username, plan.Name, db.WithTX(tx))
+		if err != nil {
+			response.Error = errors.NatsError(ctx, err)
+			return response
+		}
+		if renewal {
+			eventType = api.EventSubscriptionRenewed
+		}
+
+		if subscriptionID, err = d.SetActiveSubscription(ctx, userID, plan, opts, db.WithTX(tx)); err != nil {
+			response.Error = errors.NatsError(ctx, err)
+			return response
+		}
+
+		if ref != nil {
+			if err = d.SetSubscriptionExternalRef(ctx, subscriptionID, ref, db.WithTX(tx)); err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
+		}
+
+		if discountCode != "" {
+			subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+			if err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
+			redemption, err = d.RedeemDiscountCode(
+				ctx, discountCode, subscriptionID, subscription.Rate.Rate, username, db.WithTX(tx),
+			)
+			if err != nil {
+				response.Error = errors.NatsError(ctx, err)
+				return response
+			}
+		}
+
+		if err = a.recordEvent(ctx, d, tx, eventType, &api.SubscriptionEventData{
+			SubscriptionID: subscriptionID,
+			Username:       username,
+			PlanName:       plan.Name,
+		}); err != nil {
 			response.Error = errors.NatsError(ctx, err)
 			return response
 		}
 	}
 
-	// Commit all of the changes
-	if err = tx.Commit(); err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
+	// Commit all of the changes unless this is a dry run, in which case the
+	// deferred rollback discards them.
+	if !dryRun {
+		if err = tx.Commit(); err != nil {
+			response.Error = errors.NatsError(ctx, err)
+			return response
+		}
+	}
+
+	if createSubscription && !dryRun {
+		a.notify(ctx, eventType, &api.SubscriptionEventData{
+			SubscriptionID: subscriptionID,
+			Username:       username,
+			PlanName:       plan.Name,
+		})
+		a.invalidateSubscriptions(ctx, username)
+		a.projectOverages(ctx, username)
+	}
+
+	// Let the billing pipeline know what to charge for the new subscription.
+	if redemption != nil {
+		setHeaderValue(response.Header, DiscountedRateHeader, formatRate(redemption.DiscountedRate))
 	}
 
 	response.PlanName = plan.Name
@@ -133,10 +268,13 @@ func (a *App) AddUserHandler(subject, reply string, request *qms.AddUserRequest)
 	ctx, span := pbinit.InitQMSAddUserRequest(request, subject)
 	defer span.End()
 
-	response := a.addUser(ctx, request)
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
 
-	if response.Error != nil {
-		log.Error(response.Error.Message)
+	response, err := a.service.AddUser(ctx, request)
+
+	if err != nil {
+		log.Error(err)
 	}
 
 	if err = a.client.Respond(ctx, reply, response); err != nil {
@@ -160,11 +298,26 @@ func (a *App) AddUserHTTPHandler(c echo.Context) error {
 
 	request.Username = c.Param("username")
 
-	response := a.addUser(ctx, &request)
+	ref, err := httpExternalRef(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": err.Error(),
+		})
+	}
+
+	discountCode := normalizeDiscountCode(c.Request().Header.Get(DiscountCodeHeader))
+	response := a.addUser(ctx, &request, ref, discountCode, c.QueryParam("dry_run"), c.QueryParam("perpetual"))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
+	setHTTPDryRunHeader(c, response.Header)
+
+	if value := headerValue(response.Header, DiscountedRateHeader); value != "" {
+		c.Response().Header().Set(DiscountedRateHeader, value)
+	}
+
+	redact(a.httpCallerRole(c), response)
 	return c.JSON(http.StatusOK, response)
 }
@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// DefaultUserShards is the number of shards that users are spread over when
+// their changes are serialized.
+const DefaultUserShards = 64
+
+// userShards serializes the changes made to each user's usages and
+// subscriptions within this instance of the service. Usernames are hashed to a
+// fixed number of shards, and only one change can be made in a shard at a time,
+// so two requests for the same user never read and update the same rows at
+// once. Users that share a shard also wait for each other, which is the price
+// of keeping the number of shards fixed. Instances of the service don't
+// coordinate with each other, so this narrows the window for races rather than
+// replacing the row locks taken in the database.
+type userShards struct {
+	slots []chan struct{}
+}
+
+func newUserShards(count int) *userShards {
+	if count <= 0 {
+		count = DefaultUserShards
+	}
+	shards := &userShards{slots: make([]chan struct{}, count)}
+	for i := range shards.slots {
+		shards.slots[i] = make(chan struct{}, 1)
+	}
+	return shards
+}
+
+// userShardKey is the context key used to record the shards held by a request,
+// in ascending order, so that a change that's made while handling another one
+// in a shard that's already held doesn't wait for itself.
+type userShardKey struct{}
+
+// shardFor returns the index of the shard for a normalized username.
+func (s *userShards) shardFor(username string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(username))
+	return int(hash.Sum32() % uint32(len(s.slots)))
+}
+
+// acquire waits for the user's shard to become available. The returned context
+// records that the shard is held along with any shards that were already held,
+// and the returned function releases it. The context's error is returned if
+// it's done before the shard becomes available.
+//
+// Shards are always acquired in ascending order, so that two requests can't
+// each hold a shard that the other is waiting for. A request that already holds
+// a shard can acquire another one with a higher index, but an error is returned
+// if it tries to acquire one with a lower index.
+func (s *userShards) acquire(ctx context.Context, username string) (context.Context, func(), error) {
+	shard := s.shardFor(username)
+
+	held, _ := ctx.Value(userShardKey{}).([]int)
+	if slices.Contains(held, shard) {
+		return ctx, func() {}, nil
+	}
+	if len(held) > 0 && shard < held[len(held)-1] {
+		return ctx, nil, fmt.Errorf("unable to lock user %s while holding the locks of users in later shards", username)
+	}
+
+	select {
+	case s.slots[shard] <- struct{}{}:
+		return context.WithValue(ctx, userShardKey{}, append(slices.Clone(held), shard)), func() { <-s.slots[shard] }, nil
+	case <-ctx.Done():
+		return ctx, nil, ctx.Err()
+	}
+}
+
+// SetUserShards sets the number of shards that users are spread over when their
+// changes are serialized. It must be called before any requests are handled.
+func (a *App) SetUserShards(count int) {
+	a.userShards = newUserShards(count)
+}
+
+// lockUser waits until no other change is being made to the user's usages or
+// subscriptions by this instance of the service. The username must already be
+// normalized. The returned function must be called once the change has been
+// made.
+func (a *App) lockUser(ctx context.Context, username string) (context.Context, func(), error) {
+	return a.userShards.acquire(ctx, username)
+}
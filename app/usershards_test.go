@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shardedUsernames returns two usernames that are in different shards, the
+// first in the lower one.
+func shardedUsernames(t *testing.T, shards *userShards) (string, string) {
+	t.Helper()
+	first := "user0"
+	for i := 1; i < 1000; i++ {
+		username := fmt.Sprintf("user%d", i)
+		switch {
+		case shards.shardFor(username) < shards.shardFor(first):
+			return username, first
+		case shards.shardFor(username) > shards.shardFor(first):
+			return first, username
+		}
+	}
+	t.Fatal("unable to find usernames in different shards")
+	return "", ""
+}
+
+// lockBoth acquires the shards of both users in the given order and holds them
+// briefly before releasing them.
+func lockBoth(ctx context.Context, shards *userShards, first, second string) error {
+	ctx, unlockFirst, err := shards.acquire(ctx, first)
+	if err != nil {
+		return err
+	}
+	defer unlockFirst()
+
+	_, unlockSecond, err := shards.acquire(ctx, second)
+	if err != nil {
+		return err
+	}
+	defer unlockSecond()
+
+	time.Sleep(time.Millisecond)
+	return nil
+}
+
+func TestUserShardsOverlappingSetsInOppositeOrders(t *testing.T) {
+	shards := newUserShards(8)
+	low, high := shardedUsernames(t, shards)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const attempts = 50
+	var (
+		wg                    sync.WaitGroup
+		ascending, descending []error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < attempts; i++ {
+			ascending = append(ascending, lockBoth(ctx, shards, low, high))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < attempts; i++ {
+			descending = append(descending, lockBoth(ctx, shards, high, low))
+		}
+	}()
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		t.Fatal("the requests deadlocked")
+	}
+	for _, err := range ascending {
+		if err != nil {
+			t.Errorf("expected the shards to be acquired in ascending order; got %s", err)
+		}
+	}
+	for _, err := range descending {
+		if err == nil {
+			t.Error("expected acquiring a lower shard while holding a higher one to fail")
+		}
+	}
+
+	// Every shard has to have been released.
+	for _, username := range []string{low, high} {
+		_, unlock, err := shards.acquire(ctx, username)
+		if err != nil {
+			t.Fatalf("the shard for %s wasn't released: %s", username, err)
+		}
+		unlock()
+	}
+}
+
+func TestUserShardsReentrant(t *testing.T) {
+	shards := newUserShards(8)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	ctx, unlock, err := shards.acquire(ctx, "alice")
+	if err != nil {
+		t.Fatalf("unable to acquire the shard: %s", err)
+	}
+	defer unlock()
+
+	if _, release, err := shards.acquire(ctx, "alice"); err != nil {
+		t.Errorf("expected a held shard to be acquired again without waiting; got %s", err)
+	} else {
+		release()
+	}
+}
@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/labstack/echo/v4"
+)
+
+func (a *App) listUserSubscriptions(ctx context.Context, request *api.ByUsernameRequest) *api.UserSubscriptionsResponse {
+	response := &api.UserSubscriptionsResponse{Subscriptions: make([]*api.UserSubscription, 0)}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	response.Username = username
+
+	d := a.readDatabase(ctx)
+
+	exists, err := d.UserExists(ctx, username, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	if !exists {
+		response.Error = serrors.NatsError(ctx, serrors.ErrUserNotFound)
+		return response
+	}
+
+	subscriptions, err := d.ListUserSubscriptions(ctx, username, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	ids := make([]string, len(subscriptions))
+	for i, subscription := range subscriptions {
+		ids[i] = subscription.ID
+	}
+	usages, err := d.UsagesBySubscription(ctx, ids, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	statuses, err := d.ResourceStatuses(ctx, ids, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, subscription := range subscriptions {
+		paid := subscription.Paid
+		userSubscription := &api.UserSubscription{
+			ID:                 subscription.ID,
+			PlanName:           subscription.Plan.Name,
+			EffectiveStartDate: subscription.EffectiveStartDate,
+			EffectiveEndDate:   subscription.EffectiveEndDate,
+			Perpetual:          subscription.Perpetual(),
+			State:              a.subscriptionState(subscription.EffectiveEndDate),
+			Paid:               &paid,
+			Usages:             make([]*api.ResourceUsage, 0),
+			Resources:          make([]*api.ResourceStatus, 0),
+		}
+		for _, usage := range usages[subscription.ID] {
+			userSubscription.Usages = append(userSubscription.Usages, &api.ResourceUsage{
+				ResourceType: api.ResourceType{
+					ID:   usage.ResourceType.ID,
+					Name: usage.ResourceType.Name,
+					Unit: usage.ResourceType.Unit,
+				},
+				Usage: usage.Usage,
+			})
+		}
+		for _, status := range statuses[subscription.ID] {
+			userSubscription.Resources = append(userSubscription.Resources, status.ToAPIType())
+		}
+		response.Subscriptions = append(response.Subscriptions, userSubscription)
+	}
+
+	return response
+}
+
+// ListUserSubscriptionsHandler lists all of a user's subscriptions, including
+// the ones that have ended, along with their usages and the status of each of
+// their resource types.
+func (a *App) ListUserSubscriptionsHandler(subject, reply string, request *api.ByUsernameRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing user subscriptions")
+
+	response := a.listUserSubscriptions(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	redactAPI(a.apiCallerRole(request.Header), response)
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListUserSubscriptionsHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUsernameRequest{
+		Username: c.Param("username"),
+	}
+
+	response := a.listUserSubscriptions(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	redactAPI(a.httpCallerRole(c), response)
+	return c.JSON(http.StatusOK, response)
+}
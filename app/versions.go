@@ -0,0 +1,53 @@
+package app
+
+import (
+	"strconv"
+
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// The names of the message headers (and HTTP headers) used for optimistic
+// concurrency control. Callers send the version of an add-on or quota that they
+// last saw in the expected version header when they update it, and the new
+// version is returned in the version header. The QMS messages don't have
+// fields for versions, so they're passed in the header instead.
+const (
+	ExpectedVersionHeader = "x-qms-expected-version"
+	VersionHeader         = "x-qms-version"
+)
+
+// expectedVersionOpts returns the query options for the value of the expected
+// version header. An empty value means that the update is unconditional.
+func expectedVersionOpts(value string, opts ...db.QueryOption) ([]db.QueryOption, error) {
+	if value == "" {
+		return opts, nil
+	}
+
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 1 {
+		return nil, serrors.ErrInvalidVersion
+	}
+	return append(opts, db.WithExpectedVersion(version)), nil
+}
+
+// setVersionHeader adds the version of an updated record to a response header.
+func setVersionHeader(h *header.Header, version int64) {
+	if h == nil || version == 0 {
+		return
+	}
+	if h.Map == nil {
+		h.Map = make(map[string]*header.Header_Value)
+	}
+	h.Map[VersionHeader] = &header.Header_Value{Value: []string{strconv.FormatInt(version, 10)}}
+}
+
+// setHTTPVersionHeader copies the version from a response header to the HTTP
+// response headers.
+func setHTTPVersionHeader(c echo.Context, h *header.Header) {
+	if version := headerValue(h, VersionHeader); version != "" {
+		c.Response().Header().Set(VersionHeader, version)
+	}
+}
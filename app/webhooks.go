@@ -0,0 +1,376 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/validate"
+	"github.com/cyverse-de/subscriptions/webhooks"
+	"github.com/labstack/echo/v4"
+)
+
+// SetWebhookDispatcher configures the dispatcher used to notify webhooks of
+// subscription lifecycle events. Events aren't sent anywhere if the dispatcher
+// isn't set.
+func (a *App) SetWebhookDispatcher(dispatcher *webhooks.Dispatcher) {
+	a.webhooks = dispatcher
+}
+
+// notify sends an event to the registered webhooks if webhooks are enabled,
+// and hands subscription lifecycle events to the billing provider if there is
+// one.
+func (a *App) notify(ctx context.Context, eventType string, data any) {
+	if a.webhooks != nil {
+		a.webhooks.Dispatch(ctx, eventType, data)
+	}
+	if a.billing != nil {
+		a.bill(ctx, eventType, data)
+	}
+}
+
+func (a *App) addWebhook(ctx context.Context, request *api.WebhookRequest) *api.WebhookResponse {
+	response := &api.WebhookResponse{}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if request.Webhook == nil {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidWebhook)
+		return response
+	}
+	webhook := db.NewWebhookFromAPI(request.Webhook)
+	if err := webhook.Validate(true); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	id, err := d.AddWebhook(ctx, webhook, requestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	newWebhook, err := d.GetWebhook(ctx, id)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Webhook = newWebhook.ToAPIType()
+	return response
+}
+
+// AddWebhookHandler registers a new webhook.
+func (a *App) AddWebhookHandler(subject, reply string, request *api.WebhookRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "adding webhook")
+
+	response := a.addWebhook(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) AddWebhookHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.WebhookRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+
+	response := a.addWebhook(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) listWebhooks(ctx context.Context) *api.WebhookListResponse {
+	response := &api.WebhookListResponse{Webhooks: make([]*api.Webhook, 0)}
+	d := a.readDatabase(ctx)
+
+	results, err := d.ListWebhooks(ctx, db.WithReadReplica())
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	for _, webhook := range results {
+		response.Webhooks = append(response.Webhooks, webhook.ToAPIType())
+	}
+	return response
+}
+
+// ListWebhooksHandler lists all of the registered webhooks.
+func (a *App) ListWebhooksHandler(subject, reply string, request *api.Request) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "listing webhooks")
+
+	response := a.listWebhooks(ctx)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) ListWebhooksHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	response := a.listWebhooks(ctx)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) getWebhook(ctx context.Context, request *api.ByUUIDRequest) *api.WebhookResponse {
+	response := &api.WebhookResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+	d := a.database(ctx)
+
+	webhook, err := d.GetWebhook(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Webhook = webhook.ToAPIType()
+	return response
+}
+
+// GetWebhookHandler returns a single webhook.
+func (a *App) GetWebhookHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "getting webhook")
+
+	response := a.getWebhook(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) GetWebhookHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{UUID: c.Param("id")}
+	response := a.getWebhook(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) updateWebhook(ctx context.Context, request *api.WebhookRequest) *api.WebhookResponse {
+	response := &api.WebhookResponse{}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	if request.Webhook == nil || request.Webhook.ID == "" {
+		response.Error = serrors.NatsError(ctx, serrors.ErrInvalidWebhook)
+		return response
+	}
+	webhook := db.NewWebhookFromAPI(request.Webhook)
+	if err := webhook.Validate(false); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	requestedBy, err := a.FixUsername(request.RequestedBy)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = d.UpdateWebhook(ctx, webhook, requestedBy); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	updated, err := d.GetWebhook(ctx, webhook.ID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Webhook = updated.ToAPIType()
+	return response
+}
+
+// UpdateWebhookHandler updates a webhook. The secret is only changed if a new
+// one is included in the request.
+func (a *App) UpdateWebhookHandler(subject, reply string, request *api.WebhookRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "updating webhook")
+
+	response := a.updateWebhook(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) UpdateWebhookHTTPHandler(c echo.Context) error {
+	var (
+		err     error
+		request api.WebhookRequest
+	)
+
+	ctx := c.Request().Context()
+
+	if err = c.Bind(&request); err != nil || request.Webhook == nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"message": "invalid body format",
+		})
+	}
+	request.Webhook.ID = c.Param("id")
+
+	response := a.updateWebhook(ctx, &request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (a *App) deleteWebhook(ctx context.Context, request *api.ByUUIDRequest) *api.WebhookResponse {
+	response := &api.WebhookResponse{}
+
+	if err := validate.Request(request); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err := a.checkWritable(); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	d := a.database(ctx)
+
+	webhook, err := d.GetWebhook(ctx, request.UUID)
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	if err = d.DeleteWebhook(ctx, request.UUID); err != nil {
+		response.Error = serrors.NatsError(ctx, err)
+		return response
+	}
+
+	response.Webhook = webhook.ToAPIType()
+	return response
+}
+
+// DeleteWebhookHandler removes a webhook.
+func (a *App) DeleteWebhookHandler(subject, reply string, request *api.ByUUIDRequest) {
+	var err error
+
+	ctx, span := initRequest(request.Header, subject)
+	defer span.End()
+
+	ctx, done := a.withTimeout(ctx, subject)
+	defer done()
+
+	log := log.WithField("context", "deleting webhook")
+
+	response := a.deleteWebhook(ctx, request)
+	if response.Error != nil {
+		log.Error(response.Error.Message)
+	}
+
+	if err = a.client.RespondJSON(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+func (a *App) DeleteWebhookHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &api.ByUUIDRequest{UUID: c.Param("id")}
+	response := a.deleteWebhook(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
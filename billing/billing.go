@@ -0,0 +1,77 @@
+// Package billing hands subscription lifecycle changes to an external billing
+// provider, such as Stripe, so that the provider can create the invoices or
+// checkout sessions that users pay through. Providers are optional; without
+// one, subscriptions are created without being billed.
+package billing
+
+import (
+	"context"
+	"fmt"
+)
+
+// The supported billing providers.
+const (
+	ProviderStub   = "stub"
+	ProviderStripe = "stripe"
+)
+
+// Subscription describes the subscription that a lifecycle change refers to.
+// The rate is the amount to charge for the subscription, after any discount.
+type Subscription struct {
+	ID       string
+	Username string
+	PlanName string
+	Rate     float64
+
+	// InvoiceIDs are the external IDs of the invoices that the provider has
+	// already created for the subscription. They're only set for cancellations.
+	InvoiceIDs []string
+}
+
+// Invoice is an invoice or checkout session created by a provider. The URL is
+// where the user can pay, if the provider has one.
+type Invoice struct {
+	ExternalID string
+	URL        string
+	Status     string
+	Amount     float64
+}
+
+// Provider is implemented by each billing provider. The methods are called
+// after the lifecycle change has been committed, and a nil invoice means that
+// the provider didn't need to create one.
+type Provider interface {
+	// Name returns the name of the provider, which is recorded along with the
+	// invoices that it creates.
+	Name() string
+
+	// SubscriptionCreated is called when a user subscribes to a plan.
+	SubscriptionCreated(ctx context.Context, subscription *Subscription) (*Invoice, error)
+
+	// SubscriptionRenewed is called when a user renews their subscription.
+	SubscriptionRenewed(ctx context.Context, subscription *Subscription) (*Invoice, error)
+
+	// SubscriptionCanceled is called when a subscription ends early, so that
+	// any unpaid invoices for it can be voided.
+	SubscriptionCanceled(ctx context.Context, subscription *Subscription) error
+}
+
+// Settings selects and configures the billing provider.
+type Settings struct {
+	// Provider is the name of the billing provider to use.
+	Provider string
+
+	Stripe StripeSettings
+}
+
+// New returns the configured billing provider.
+func New(settings Settings) (Provider, error) {
+	switch settings.Provider {
+	case ProviderStub:
+		return NewStubProvider(), nil
+	case ProviderStripe:
+		return NewStripeProvider(settings.Stripe)
+	default:
+		return nil, fmt.Errorf("unsupported billing provider: %q", settings.Provider)
+	}
+}
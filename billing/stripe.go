@@ -0,0 +1,197 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The default Stripe settings.
+const (
+	DefaultStripeEndpoint = "https://api.stripe.com"
+	DefaultStripeCurrency = "usd"
+	DefaultStripeTimeout  = 30 * time.Second
+)
+
+// StripeSettings configures the Stripe provider, which creates a Checkout
+// session for each new or renewed subscription.
+type StripeSettings struct {
+	// APIKey is the secret key used to authenticate to Stripe.
+	APIKey string
+
+	// Endpoint is the base URL of the Stripe API. It only needs to be changed
+	// for testing, such as with stripe-mock.
+	Endpoint string
+
+	// Currency is the three-letter ISO code of the currency that subscriptions
+	// are charged in. It defaults to usd.
+	Currency string
+
+	// SuccessURL and CancelURL are where Stripe sends users after they've paid
+	// or given up on paying.
+	SuccessURL string
+	CancelURL  string
+
+	// Timeout limits how long each request to Stripe can take.
+	Timeout time.Duration
+}
+
+// StripeProvider creates Stripe Checkout sessions for subscriptions.
+type StripeProvider struct {
+	settings StripeSettings
+	client   *http.Client
+}
+
+// NewStripeProvider returns a provider for the configured Stripe account.
+func NewStripeProvider(settings StripeSettings) (*StripeProvider, error) {
+	if settings.APIKey == "" {
+		return nil, fmt.Errorf("the Stripe API key is required")
+	}
+	if settings.SuccessURL == "" || settings.CancelURL == "" {
+		return nil, fmt.Errorf("the Stripe success and cancel URLs are required")
+	}
+	if settings.Endpoint == "" {
+		settings.Endpoint = DefaultStripeEndpoint
+	}
+	if settings.Currency == "" {
+		settings.Currency = DefaultStripeCurrency
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = DefaultStripeTimeout
+	}
+	settings.Endpoint = strings.TrimSuffix(settings.Endpoint, "/")
+
+	return &StripeProvider{
+		settings: settings,
+		client:   &http.Client{Timeout: settings.Timeout},
+	}, nil
+}
+
+func (p *StripeProvider) Name() string {
+	return ProviderStripe
+}
+
+// stripeError is an error reported by the Stripe API.
+type stripeError struct {
+	StatusCode int
+	Type       string `json:"type"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *stripeError) Error() string {
+	return fmt.Sprintf("stripe: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// checkoutSession contains the fields of a Stripe Checkout session that are
+// recorded.
+type checkoutSession struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	AmountTotal int64  `json:"amount_total"`
+}
+
+// post sends a form-encoded request to the Stripe API and decodes the response
+// into result.
+func (p *StripeProvider) post(ctx context.Context, path string, form url.Values, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.settings.Endpoint+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.settings.APIKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var envelope struct {
+			Error stripeError `json:"error"`
+		}
+		if err = json.Unmarshal(body, &envelope); err != nil || envelope.Error.Message == "" {
+			envelope.Error.Message = http.StatusText(resp.StatusCode)
+		}
+		envelope.Error.StatusCode = resp.StatusCode
+		return &envelope.Error
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+// checkout creates a Checkout session that charges the subscription's rate. No
+// session is created for subscriptions that don't cost anything.
+func (p *StripeProvider) checkout(ctx context.Context, subscription *Subscription, description string) (*Invoice, error) {
+	cents := int64(math.Round(subscription.Rate * 100))
+	if cents <= 0 {
+		return nil, nil
+	}
+
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("success_url", p.settings.SuccessURL)
+	form.Set("cancel_url", p.settings.CancelURL)
+	form.Set("client_reference_id", subscription.ID)
+	form.Set("metadata[subscription_uuid]", subscription.ID)
+	form.Set("metadata[username]", subscription.Username)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", p.settings.Currency)
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(cents, 10))
+	form.Set("line_items[0][price_data][product_data][name]", fmt.Sprintf("%s (%s)", subscription.PlanName, description))
+
+	var session checkoutSession
+	if err := p.post(ctx, "/v1/checkout/sessions", form, &session); err != nil {
+		return nil, err
+	}
+
+	return &Invoice{
+		ExternalID: session.ID,
+		URL:        session.URL,
+		Status:     session.Status,
+		Amount:     float64(session.AmountTotal) / 100,
+	}, nil
+}
+
+func (p *StripeProvider) SubscriptionCreated(ctx context.Context, subscription *Subscription) (*Invoice, error) {
+	return p.checkout(ctx, subscription, "new subscription")
+}
+
+func (p *StripeProvider) SubscriptionRenewed(ctx context.Context, subscription *Subscription) (*Invoice, error) {
+	return p.checkout(ctx, subscription, "renewal")
+}
+
+// SubscriptionCanceled expires the subscription's Checkout sessions so that
+// they can't be paid. Sessions that have already been completed or expired
+// are left alone.
+func (p *StripeProvider) SubscriptionCanceled(ctx context.Context, subscription *Subscription) error {
+	var errs []error
+	for _, id := range subscription.InvoiceIDs {
+		var session checkoutSession
+		err := p.post(ctx, "/v1/checkout/sessions/"+url.PathEscape(id)+"/expire", url.Values{}, &session)
+
+		var stripeErr *stripeError
+		if errors.As(err, &stripeErr) && stripeErr.StatusCode == http.StatusBadRequest {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to expire checkout session %s: %w", id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,40 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// StubProvider pretends to create invoices without contacting anything, which
+// is useful for trying out the billing integration.
+type StubProvider struct{}
+
+// NewStubProvider returns a provider that creates fake invoices.
+func NewStubProvider() *StubProvider {
+	return &StubProvider{}
+}
+
+func (p *StubProvider) Name() string {
+	return ProviderStub
+}
+
+func (p *StubProvider) invoice(subscription *Subscription) *Invoice {
+	return &Invoice{
+		ExternalID: "stub_" + uuid.NewString(),
+		Status:     "open",
+		Amount:     subscription.Rate,
+	}
+}
+
+func (p *StubProvider) SubscriptionCreated(_ context.Context, subscription *Subscription) (*Invoice, error) {
+	return p.invoice(subscription), nil
+}
+
+func (p *StubProvider) SubscriptionRenewed(_ context.Context, subscription *Subscription) (*Invoice, error) {
+	return p.invoice(subscription), nil
+}
+
+func (p *StubProvider) SubscriptionCanceled(_ context.Context, _ *Subscription) error {
+	return nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/legacy"
+	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/cyverse-de/subscriptions/usernames"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+)
+
+// adminAnnotation marks the commands that perform administrative tasks rather
+// than running the service.
+const adminAnnotation = "admin"
+
+// adminAnnotations returns the annotations for an administrative command.
+func adminAnnotations() map[string]string {
+	return map[string]string{adminAnnotation: "true"}
+}
+
+// adminEnv contains what the administrative commands need to work with the
+// database directly.
+type adminEnv struct {
+	config    *koanf.Koanf
+	dbconn    *sqlx.DB
+	d         *db.Database
+	usernames *usernames.Rules
+}
+
+// newAdminEnv loads the configuration and connects to the primary database.
+// The caller must close the environment.
+func newAdminEnv(global *globalOptions) (*adminEnv, error) {
+	config, err := loadConfig(global)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, _, err := usernameNormalizer(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn, err := sqlx.Connect("postgres", config.String("database.uri"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to the database: %w", err)
+	}
+
+	return &adminEnv{config: config, dbconn: dbconn, d: db.New(dbconn), usernames: rules}, nil
+}
+
+func (e *adminEnv) Close() error {
+	return e.dbconn.Close()
+}
+
+// recordEvent adds a domain event to the outbox if domain events are enabled,
+// so that the running service publishes events for changes made from the
+// command line too.
+func (e *adminEnv) recordEvent(ctx context.Context, tx *goqu.TxDatabase, eventType string, data any) error {
+	if !e.config.Bool("nats.events.enabled") {
+		return nil
+	}
+	return e.d.AddOutboxEvent(ctx, api.NewEvent(eventType, data), db.WithTX(tx))
+}
+
+// lookupPlan returns the named plan, or an error if it doesn't exist.
+func (e *adminEnv) lookupPlan(ctx context.Context, planName string) (*db.Plan, error) {
+	plan, err := e.d.GetPlanByName(ctx, planName)
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, fmt.Errorf("plan not found: %s", planName)
+	}
+	return plan, nil
+}
+
+func newSubscribeUserCommand(global *globalOptions) *cobra.Command {
+	var (
+		planName string
+		paid     bool
+		periods  int32
+		endDate  string
+		period   string
+		force    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "subscribe-user <username>",
+		Short: "Subscribes a user to a plan",
+		Long: "Subscribes a user to a plan, adding the user if necessary. Users who are already on the plan are left " +
+			"alone unless --force is used, in which case their subscriptions are renewed.",
+		Args:        cobra.ExactArgs(1),
+		Annotations: adminAnnotations(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			env, err := newAdminEnv(global)
+			if err != nil {
+				return err
+			}
+			defer env.Close() // nolint:errcheck
+
+			username, err := env.usernames.Normalize(args[0])
+			if err != nil {
+				return err
+			}
+
+			subscriptionOpts, err := utils.OptsForValues(paid, periods, endDate)
+			if err != nil {
+				return err
+			}
+			if period != "" {
+				if subscriptionOpts.Period, err = db.ParseSubscriptionPeriod(period); err != nil {
+					return err
+				}
+			}
+
+			plan, err := env.lookupPlan(ctx, planName)
+			if err != nil {
+				return err
+			}
+
+			var subscriptionID string
+			err = env.d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+				user, err := env.d.EnsureUser(ctx, username, db.WithTX(tx))
+				if err != nil {
+					return err
+				}
+
+				onPlan, err := env.d.UserOnPlan(ctx, username, plan.Name, db.WithTX(tx))
+				if err != nil {
+					return err
+				}
+				if onPlan && !force {
+					subscriptionID = ""
+					return nil
+				}
+
+				subscriptionID, err = env.d.SetActiveSubscription(ctx, user.ID, plan, subscriptionOpts, db.WithTX(tx))
+				if err != nil {
+					return err
+				}
+
+				eventType := api.EventSubscriptionCreated
+				if onPlan {
+					eventType = api.EventSubscriptionRenewed
+				}
+				return env.recordEvent(ctx, tx, eventType, &api.SubscriptionEventData{
+					SubscriptionID: subscriptionID,
+					Username:       username,
+					PlanName:       plan.Name,
+				})
+			})
+			if err != nil {
+				return err
+			}
+
+			if subscriptionID == "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s is already subscribed to %s\n", username, plan.Name)
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "subscribed %s to %s: %s\n", username, plan.Name, subscriptionID)
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&planName, "plan", "", "The name of the plan")
+	flags.BoolVar(&paid, "paid", false, "Marks the subscription as paid")
+	flags.Int32Var(&periods, "periods", 1, "The number of periods that the subscription lasts")
+	flags.StringVar(&endDate, "end-date", "", "When the subscription ends, defaulting to the end of the period")
+	flags.StringVar(&period, "period", "", "The length of each period, which defaults to the plan's period")
+	flags.BoolVar(&force, "force", false, "Creates a new subscription even if the user is already on the plan")
+	cmd.MarkFlagRequired("plan") // nolint:errcheck
+
+	return cmd
+}
+
+func newListOveragesCommand(global *globalOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:         "list-overages [username]",
+		Short:       "Lists the resource types for which users have reached their quotas",
+		Long:        "Lists the overages of the named user, or of every user other than test accounts if no username is given.",
+		Args:        cobra.MaximumNArgs(1),
+		Annotations: adminAnnotations(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			env, err := newAdminEnv(global)
+			if err != nil {
+				return err
+			}
+			defer env.Close() // nolint:errcheck
+
+			var opts []db.QueryOption
+			if grace := gracePeriod(env.config); grace > 0 {
+				opts = append(opts, db.WithGracePeriod(grace))
+			}
+
+			var overages []db.Overage
+			if len(args) == 1 {
+				username, err := env.usernames.Normalize(args[0])
+				if err != nil {
+					return err
+				}
+				overages, err = env.d.GetUserOverages(ctx, username, opts...)
+				if err != nil {
+					return err
+				}
+			} else {
+				if overages, err = env.d.ListOverages(ctx, opts...); err != nil {
+					return err
+				}
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "USERNAME\tPLAN\tRESOURCE\tQUOTA\tUSAGE\tUNIT")
+			for _, overage := range overages {
+				fmt.Fprintf(
+					w, "%s\t%s\t%s\t%g\t%g\t%s\n",
+					overage.User.Username, overage.Plan.Name, overage.ResourceType.Name,
+					overage.QuotaValue, overage.UsageValue, overage.ResourceType.Unit,
+				)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func newRenewCommand(global *globalOptions) *cobra.Command {
+	var (
+		planName string
+		within   time.Duration
+		paid     bool
+		periods  int32
+		endDate  string
+		period   string
+		dryRun   bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "renew",
+		Short: "Renews the subscriptions to a plan that are about to end",
+		Long: "Creates a new subscription to the same plan for every user whose current subscription to the plan " +
+			"ends within the given window. Each renewed subscription keeps the paid flag of the subscription that " +
+			"it replaces unless --paid is used.",
+		Args:        cobra.NoArgs,
+		Annotations: adminAnnotations(),
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			ctx := cmd.Context()
+
+			env, err := newAdminEnv(global)
+			if err != nil {
+				return err
+			}
+			defer env.Close() // nolint:errcheck
+
+			subscriptionOpts, err := utils.OptsForValues(paid, periods, endDate)
+			if err != nil {
+				return err
+			}
+			if period != "" {
+				if subscriptionOpts.Period, err = db.ParseSubscriptionPeriod(period); err != nil {
+					return err
+				}
+			}
+
+			plan, err := env.lookupPlan(ctx, planName)
+			if err != nil {
+				return err
+			}
+
+			expiring, err := env.d.ExpiringSubscriptions(ctx, plan.Name, time.Now().Add(within))
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "USERNAME\tENDS\tNEW SUBSCRIPTION")
+			for _, subscription := range expiring {
+				opts := *subscriptionOpts
+				if !cmd.Flags().Changed("paid") {
+					opts.Paid = subscription.Paid
+				}
+
+				newID := "(dry run)"
+				if !dryRun {
+					err = env.d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+						newID, err = env.d.SetActiveSubscription(ctx, subscription.User.ID, plan, &opts, db.WithTX(tx))
+						if err != nil {
+							return err
+						}
+						return env.recordEvent(ctx, tx, api.EventSubscriptionRenewed, &api.SubscriptionEventData{
+							SubscriptionID: newID,
+							Username:       subscription.User.Username,
+							PlanName:       plan.Name,
+						})
+					})
+					if err != nil {
+						w.Flush() // nolint:errcheck
+						return fmt.Errorf("unable to renew the subscription for %s: %w", subscription.User.Username, err)
+					}
+				}
+
+				fmt.Fprintf(
+					w, "%s\t%s\t%s\n",
+					subscription.User.Username, subscription.EffectiveEndDate.Format(time.RFC3339), newID,
+				)
+			}
+			return w.Flush()
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&planName, "plan", "", "The name of the plan")
+	flags.DurationVar(&within, "within", 7*24*time.Hour, "Renews the subscriptions that end within this long")
+	flags.BoolVar(&paid, "paid", false, "Marks the renewed subscriptions as paid or unpaid")
+	flags.Int32Var(&periods, "periods", 1, "The number of periods that the renewed subscriptions last")
+	flags.StringVar(&endDate, "end-date", "", "When the renewed subscriptions end, defaulting to the end of the period")
+	flags.StringVar(&period, "period", "", "The length of each period, which defaults to the plan's period")
+	flags.BoolVar(&dryRun, "dry-run", false, "Lists the subscriptions that would be renewed without renewing them")
+	cmd.MarkFlagRequired("plan") // nolint:errcheck
+
+	return cmd
+}
+
+func newReplayDeadLettersCommand(global *globalOptions) *cobra.Command {
+	var (
+		natsOpts natsOptions
+		subject  string
+		limit    int
+		timeout  time.Duration
+		dryRun   bool
+		keep     bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "replay-dead-letters",
+		Short: "Lists and replays the messages in the dead letter stream",
+		Long: "Sends each message in the dead letter stream back to the subject that it was originally received on and " +
+			"waits for the response. Messages that are handled successfully are removed from the stream unless --keep " +
+			"is used. Messages that are rejected again stay in the stream.",
+		Args:        cobra.NoArgs,
+		Annotations: adminAnnotations(),
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			config, err := loadConfig(global)
+			if err != nil {
+				return err
+			}
+			settings := deadLetterSettings(config)
+
+			connectionSettings := natsOpts.connectionSettings(config.String("nats.cluster"))
+			natsConn, err := natscl.NewConnection(&connectionSettings)
+			if err != nil {
+				return err
+			}
+			defer natsConn.Close()
+
+			js, err := natsConn.Conn.JetStream()
+			if err != nil {
+				return err
+			}
+			info, err := js.StreamInfo(settings.StreamName)
+			if err != nil {
+				return fmt.Errorf("unable to look up the %s stream: %w", settings.StreamName, err)
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "SEQUENCE\tRECEIVED\tSUBJECT\tERROR\tRESULT")
+
+			replayed := 0
+			for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+				if limit > 0 && replayed >= limit {
+					break
+				}
+
+				msg, err := js.GetMsg(settings.StreamName, seq)
+				if errors.Is(err, nats.ErrMsgNotFound) {
+					continue
+				}
+				if err != nil {
+					w.Flush() // nolint:errcheck
+					return fmt.Errorf("unable to get message %d: %w", seq, err)
+				}
+
+				original := msg.Header.Get(natscl.DeadLetterSubjectHeader)
+				if original == "" || (subject != "" && original != subject) {
+					continue
+				}
+				replayed++
+
+				result := "(dry run)"
+				if !dryRun {
+					result = replayDeadLetter(natsConn.Conn, msg, original, timeout)
+					if result == "replayed" && !keep {
+						if err = js.DeleteMsg(settings.StreamName, seq); err != nil {
+							result = fmt.Sprintf("replayed, but not removed: %s", err)
+						}
+					}
+				}
+
+				fmt.Fprintf(
+					w, "%d\t%s\t%s\t%s\t%s\n",
+					seq, msg.Header.Get(natscl.DeadLetterReceivedAtHeader), original,
+					msg.Header.Get(natscl.DeadLetterErrorHeader), result,
+				)
+			}
+			return w.Flush()
+		},
+	}
+
+	flags := cmd.Flags()
+	addNATSFlags(flags, &natsOpts)
+	flags.StringVar(&subject, "subject", "", "Only replays the messages originally received on this subject")
+	flags.IntVar(&limit, "limit", 0, "The maximum number of messages to replay; 0 replays all of them")
+	flags.DurationVar(&timeout, "timeout", 10*time.Second, "How long to wait for the response to each message")
+	flags.BoolVar(&dryRun, "dry-run", false, "Lists the messages without replaying them")
+	flags.BoolVar(&keep, "keep", false, "Keeps the messages that are replayed successfully in the stream")
+
+	return cmd
+}
+
+// replayDeadLetter sends a dead letter to the subject that it was originally
+// received on, without the headers that were added to it, and describes the
+// outcome. Both the protobuf and plain JSON responses report failures in their
+// error fields.
+func replayDeadLetter(conn *nats.Conn, msg *nats.RawStreamMsg, subject string, timeout time.Duration) string {
+	header := nats.Header{}
+	for key, values := range msg.Header {
+		if !strings.HasPrefix(key, "QMS-DLQ-") {
+			header[key] = values
+		}
+	}
+
+	response, err := conn.RequestMsg(&nats.Msg{Subject: subject, Header: header, Data: msg.Data}, timeout)
+	if err != nil {
+		return fmt.Sprintf("failed: %s", err)
+	}
+
+	var body struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err = json.Unmarshal(response.Data, &body); err != nil {
+		return fmt.Sprintf("unrecognized response: %s", err)
+	}
+	if body.Error != nil {
+		return fmt.Sprintf("rejected: %s", body.Error.Message)
+	}
+	return "replayed"
+}
+
+func newImportLegacyCommand(global *globalOptions) *cobra.Command {
+	var (
+		format        string
+		planNames     map[string]string
+		resourceTypes map[string]string
+		createdBy     string
+		dryRun        bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "import-legacy <path>",
+		Short: "Imports the users, plans, subscriptions, quotas and usages dumped from the old QMS service",
+		Long: "Imports a dump from the old QMS service, which is either a JSON file or a directory of CSV files. The " +
+			"dump is checked for referential integrity first, and nothing is imported if there are any problems. " +
+			"Users are matched by username and plans by name; plans that don't exist yet are added. Everything is " +
+			"imported in a single transaction. Subscriptions that were imported before are skipped, so the same " +
+			"dump can be imported again safely.",
+		Args:        cobra.ExactArgs(1),
+		Annotations: adminAnnotations(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			dump, err := legacy.Read(args[0], format)
+			if err != nil {
+				return err
+			}
+
+			env, err := newAdminEnv(global)
+			if err != nil {
+				return err
+			}
+			defer env.Close() // nolint:errcheck
+
+			report, err := legacy.Import(ctx, env.d, dump, &legacy.Settings{
+				CreatedBy:         createdBy,
+				NormalizeUsername: env.usernames.Normalize,
+				PlanNames:         planNames,
+				ResourceTypes:     resourceTypes,
+				DryRun:            dryRun,
+			})
+			var validationErr *legacy.ValidationError
+			if errors.As(err, &validationErr) {
+				for _, problem := range validationErr.Problems {
+					fmt.Fprintln(cmd.ErrOrStderr(), problem)
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "LEGACY ID\tUSERNAME\tPLAN\tSUBSCRIPTION\tRESULT")
+			for _, s := range report.Subscriptions {
+				result := "imported"
+				switch {
+				case s.Skipped:
+					result = "already imported"
+				case dryRun:
+					result = "(dry run)"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.LegacyID, s.Username, s.PlanName, s.SubscriptionID, result)
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(
+				cmd.OutOrStdout(),
+				"\nusers: %d added, %d matched\nplans: %d added, %d matched\n"+
+					"subscriptions: %d added, %d skipped\nquotas: %d\nusages: %d\n",
+				report.UsersAdded, report.UsersMatched, report.PlansAdded, report.PlansMatched,
+				report.SubscriptionsAdded, report.SubscriptionsSkipped, report.Quotas, report.Usages,
+			)
+			return nil
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&format, "format", legacy.FormatJSON, "The format of the dump: json or csv")
+	flags.StringToStringVar(&planNames, "plan-name", nil, "Maps a legacy plan name to a plan name, as legacy=name")
+	flags.StringToStringVar(
+		&resourceTypes, "resource-type", nil, "Maps a legacy resource type name to a resource type name, as legacy=name",
+	)
+	flags.StringVar(&createdBy, "created-by", "de", "The user recorded as the creator of the imported subscriptions")
+	flags.BoolVar(&dryRun, "dry-run", false, "Reports what would be imported without importing anything")
+
+	return cmd
+}
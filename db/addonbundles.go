@@ -0,0 +1,342 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// AddonBundle is a named group of add-ons that are attached to a subscription
+// together.
+type AddonBundle struct {
+	ID          string    `db:"id" goqu:"defaultifempty"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CreatedBy   string    `db:"created_by"`
+	CreatedAt   time.Time `db:"created_at" goqu:"defaultifempty"`
+	Addons      []Addon   `db:"-"`
+}
+
+// ToAPIType converts the add-on bundle to the type used in responses.
+func (b *AddonBundle) ToAPIType() *api.AddonBundle {
+	bundle := &api.AddonBundle{
+		ID:          b.ID,
+		Name:        b.Name,
+		Description: b.Description,
+		Addons:      make([]*api.BundledAddon, len(b.Addons)),
+		CreatedBy:   b.CreatedBy,
+		CreatedAt:   b.CreatedAt,
+	}
+	for i, addon := range b.Addons {
+		bundle.Addons[i] = &api.BundledAddon{
+			ID:   addon.ID,
+			Name: addon.Name,
+			ResourceType: api.ResourceType{
+				ID:   addon.ResourceType.ID,
+				Name: addon.ResourceType.Name,
+				Unit: addon.ResourceType.Unit,
+			},
+		}
+	}
+	return bundle
+}
+
+// AddonPrerequisite is a plan or add-on that a subscription must have for an
+// add-on to be attached to it. The type is either api.PrerequisitePlan or
+// api.PrerequisiteAddon.
+type AddonPrerequisite struct {
+	Type string `db:"type"`
+	ID   string `db:"id"`
+	Name string `db:"name"`
+}
+
+// ToAPIType converts the prerequisite to the type used in responses.
+func (p *AddonPrerequisite) ToAPIType() *api.AddonPrerequisite {
+	return &api.AddonPrerequisite{
+		Type: p.Type,
+		ID:   p.ID,
+		Name: p.Name,
+	}
+}
+
+// AddonsExist returns true if all of the add-ons with the given IDs exist and
+// haven't been deleted. The IDs must not contain duplicates. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) AddonsExist(ctx context.Context, addonIDs []string, opts ...QueryOption) (bool, error) {
+	if len(addonIDs) == 0 {
+		return true, nil
+	}
+
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.Addons).
+		Select(goqu.COUNT("*")).
+		Where(
+			t.Addons.Col("id").In(addonIDs),
+			t.Addons.Col("deleted_at").IsNull(),
+		)
+	d.LogSQL(ds)
+
+	var count int
+	if _, err := ds.Executor().ScanValContext(ctx, &count); err != nil {
+		return false, errors.Wrap(err, "unable to look up the add-ons")
+	}
+
+	return count == len(addonIDs), nil
+}
+
+// AddAddonBundle adds a bundle containing the add-ons with the given IDs and
+// returns the bundle's ID. ErrBundleExists is returned if a bundle with the
+// same name exists already, and ErrAddonNotFound is returned if any of the
+// add-ons doesn't exist or has been deleted. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported. A transaction should
+// be used so that the bundle isn't added without its add-ons.
+func (d *Database) AddAddonBundle(ctx context.Context, bundle *AddonBundle, addonIDs []string, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	exist, err := d.AddonsExist(ctx, addonIDs, opts...)
+	if err != nil {
+		return "", err
+	}
+	if !exist {
+		return "", suberrors.ErrAddonNotFound
+	}
+
+	ds := db.Insert(t.AddonBundles).
+		Rows(goqu.Record{
+			"name":        bundle.Name,
+			"description": bundle.Description,
+			"created_by":  bundle.CreatedBy,
+		}).
+		Returning(t.AddonBundles.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err = ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrBundleExists
+		}
+		return "", errors.Wrapf(err, "unable to add add-on bundle %s", bundle.Name)
+	}
+
+	rows := make([]any, len(addonIDs))
+	for i, addonID := range addonIDs {
+		rows[i] = goqu.Record{"bundle_id": id, "addon_id": addonID}
+	}
+	addonsDS := db.Insert(t.BundleAddons).Rows(rows...)
+	d.LogSQL(addonsDS)
+
+	if _, err = addonsDS.Executor().ExecContext(ctx); err != nil {
+		return "", errors.Wrapf(err, "unable to add the add-ons to bundle %s", bundle.Name)
+	}
+
+	return id, nil
+}
+
+// listBundledAddons returns the add-ons in a bundle, ordered by name.
+func (d *Database) listBundledAddons(ctx context.Context, bundleID string, opts ...QueryOption) ([]Addon, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := addonDS(db).
+		Join(t.BundleAddons, goqu.On(t.BundleAddons.Col("addon_id").Eq(t.Addons.Col("id")))).
+		Where(t.BundleAddons.Col("bundle_id").Eq(bundleID)).
+		Order(t.Addons.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var addons []Addon
+	if err := ds.Executor().ScanStructsContext(ctx, &addons); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the add-ons in bundle %s", bundleID)
+	}
+
+	return addons, nil
+}
+
+// GetAddonBundleByName returns the named add-on bundle along with its add-ons,
+// or nil if it doesn't exist. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetAddonBundleByName(ctx context.Context, name string, opts ...QueryOption) (*AddonBundle, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.AddonBundles).Where(t.AddonBundles.Col("name").Eq(name))
+	d.LogSQL(ds)
+
+	var bundle AddonBundle
+	found, err := ds.Executor().ScanStructContext(ctx, &bundle)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up add-on bundle %s", name)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	if bundle.Addons, err = d.listBundledAddons(ctx, bundle.ID, opts...); err != nil {
+		return nil, err
+	}
+
+	return &bundle, nil
+}
+
+// ListAddonBundles returns all of the add-on bundles along with their add-ons,
+// ordered by name. Accepts a variable number of QueryOptions, though only
+// WithTX and WithReadReplica are currently supported.
+func (d *Database) ListAddonBundles(ctx context.Context, opts ...QueryOption) ([]AddonBundle, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.AddonBundles).Order(t.AddonBundles.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var bundles []AddonBundle
+	if err := ds.Executor().ScanStructsContext(ctx, &bundles); err != nil {
+		return nil, errors.Wrap(err, "unable to list the add-on bundles")
+	}
+
+	for i := range bundles {
+		addons, err := d.listBundledAddons(ctx, bundles[i].ID, opts...)
+		if err != nil {
+			return nil, err
+		}
+		bundles[i].Addons = addons
+	}
+
+	return bundles, nil
+}
+
+// SetAddonPrerequisites replaces the prerequisites of an add-on with the plans
+// and add-ons with the given IDs. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported. A transaction should be used so
+// that the add-on isn't left without its prerequisites if adding them fails.
+func (d *Database) SetAddonPrerequisites(
+	ctx context.Context,
+	addonID string,
+	planIDs, requiredAddonIDs []string,
+	createdBy string,
+	opts ...QueryOption,
+) error {
+	_, db := d.querySettings(opts...)
+
+	deleteDS := db.From(t.Prerequisites).Delete().Where(t.Prerequisites.Col("addon_id").Eq(addonID))
+	d.LogSQL(deleteDS)
+
+	if _, err := deleteDS.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to remove the prerequisites of add-on %s", addonID)
+	}
+
+	rows := make([]any, 0, len(planIDs)+len(requiredAddonIDs))
+	for _, planID := range planIDs {
+		rows = append(rows, goqu.Record{
+			"addon_id":          addonID,
+			"required_plan_id":  planID,
+			"required_addon_id": nil,
+			"created_by":        createdBy,
+		})
+	}
+	for _, requiredAddonID := range requiredAddonIDs {
+		rows = append(rows, goqu.Record{
+			"addon_id":          addonID,
+			"required_plan_id":  nil,
+			"required_addon_id": requiredAddonID,
+			"created_by":        createdBy,
+		})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	ds := db.Insert(t.Prerequisites).Rows(rows...).OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to add the prerequisites of add-on %s", addonID)
+	}
+
+	return nil
+}
+
+// ListAddonPrerequisites returns the prerequisites of an add-on, with the
+// required plans ordered by name before the required add-ons ordered by name.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListAddonPrerequisites(ctx context.Context, addonID string, opts ...QueryOption) ([]AddonPrerequisite, error) {
+	_, db := d.querySettings(opts...)
+
+	plansDS := db.From(t.Prerequisites).
+		Join(t.Plans, goqu.On(t.Prerequisites.Col("required_plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			goqu.V(api.PrerequisitePlan).As("type"),
+			t.Plans.Col("id"),
+			t.Plans.Col("name"),
+		).
+		Where(t.Prerequisites.Col("addon_id").Eq(addonID)).
+		Order(t.Plans.Col("name").Asc())
+	d.LogSQL(plansDS)
+
+	var plans []AddonPrerequisite
+	if err := plansDS.Executor().ScanStructsContext(ctx, &plans); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the required plans of add-on %s", addonID)
+	}
+
+	addonsDS := db.From(t.Prerequisites).
+		Join(t.Addons, goqu.On(t.Prerequisites.Col("required_addon_id").Eq(t.Addons.Col("id")))).
+		Select(
+			goqu.V(api.PrerequisiteAddon).As("type"),
+			t.Addons.Col("id"),
+			t.Addons.Col("name"),
+		).
+		Where(t.Prerequisites.Col("addon_id").Eq(addonID)).
+		Order(t.Addons.Col("name").Asc())
+	d.LogSQL(addonsDS)
+
+	var addons []AddonPrerequisite
+	if err := addonsDS.Executor().ScanStructsContext(ctx, &addons); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the required add-ons of add-on %s", addonID)
+	}
+
+	return append(plans, addons...), nil
+}
+
+// AddonPrerequisitesMet returns true if an add-on can be attached to a
+// subscription. The prerequisites of an add-on are alternatives, so they're met
+// if the add-on doesn't have any, if the subscription is to one of the required
+// plans or if one of the required add-ons is already attached to the
+// subscription. Accepts a variable number of QueryOptions, though only WithTX
+// and WithReadReplica are currently supported.
+func (d *Database) AddonPrerequisitesMet(ctx context.Context, subscriptionID, addonID string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	prerequisites := db.From(t.Prerequisites).
+		Select(goqu.L("1")).
+		Where(t.Prerequisites.Col("addon_id").Eq(addonID))
+
+	attachedAddons := db.From(t.SubscriptionAddons).
+		Select(t.SubscriptionAddons.Col("addon_id")).
+		Where(t.SubscriptionAddons.Col("subscription_id").Eq(subscriptionID))
+
+	satisfied := prerequisites.
+		Join(t.Subscriptions, goqu.On(
+			t.Subscriptions.Col("id").Eq(subscriptionID),
+			querySettings.tenantExp(t.Subscriptions),
+		)).
+		Where(goqu.Or(
+			t.Prerequisites.Col("required_plan_id").Eq(t.Subscriptions.Col("plan_id")),
+			t.Prerequisites.Col("required_addon_id").In(attachedAddons),
+		))
+
+	ds := db.Select(goqu.Or(
+		goqu.L("NOT EXISTS ?", prerequisites),
+		goqu.L("EXISTS ?", satisfied),
+	))
+	d.LogSQL(ds)
+
+	var met bool
+	if _, err := ds.Executor().ScanValContext(ctx, &met); err != nil {
+		return false, errors.Wrapf(err, "unable to check the prerequisites of add-on %s", addonID)
+	}
+
+	return met, nil
+}
@@ -0,0 +1,170 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddAddonBundle(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	first := addTestAddon(t, storage, 1)
+	second := addTestAddon(t, storage, 2)
+
+	bundle := &AddonBundle{Name: uniqueName("bundle"), Description: "A bundle", CreatedBy: "test"}
+	addonIDs := []string{first.ID, second.ID}
+	if _, err := testDB.AddAddonBundle(ctx, bundle, addonIDs); err != nil {
+		t.Fatalf("unable to add the bundle: %s", err)
+	}
+
+	if _, err := testDB.AddAddonBundle(ctx, bundle, addonIDs); !errors.Is(err, suberrors.ErrBundleExists) {
+		t.Errorf("expected ErrBundleExists for a duplicate name, got %v", err)
+	}
+
+	missing := &AddonBundle{Name: uniqueName("bundle"), CreatedBy: "test"}
+	missingIDs := []string{first.ID, "00000000-0000-0000-0000-000000000000"}
+	if _, err := testDB.AddAddonBundle(ctx, missing, missingIDs); !errors.Is(err, suberrors.ErrAddonNotFound) {
+		t.Errorf("expected ErrAddonNotFound for a missing add-on, got %v", err)
+	}
+
+	loaded, err := testDB.GetAddonBundleByName(ctx, bundle.Name)
+	if err != nil {
+		t.Fatalf("unable to look up the bundle: %s", err)
+	}
+	if loaded == nil {
+		t.Fatal("the bundle wasn't found")
+	}
+	if len(loaded.Addons) != len(addonIDs) {
+		t.Fatalf("expected %d add-ons in the bundle, got %d", len(addonIDs), len(loaded.Addons))
+	}
+	for _, addon := range loaded.Addons {
+		if addon.ID != first.ID && addon.ID != second.ID {
+			t.Errorf("unexpected add-on %s in the bundle", addon.ID)
+		}
+	}
+
+	bundles, err := testDB.ListAddonBundles(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the bundles: %s", err)
+	}
+	var found bool
+	for _, listed := range bundles {
+		found = found || (listed.ID == loaded.ID && len(listed.Addons) == len(addonIDs))
+	}
+	if !found {
+		t.Errorf("expected %s to be listed with its add-ons", bundle.Name)
+	}
+
+	notFound, err := testDB.GetAddonBundleByName(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up a missing bundle: %s", err)
+	}
+	if notFound != nil {
+		t.Errorf("expected no bundle, got %s", notFound.ID)
+	}
+}
+
+func TestAddonsExist(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	addon := addTestAddon(t, storage, 1)
+	deleted := addTestAddon(t, storage, 1)
+	if err := testDB.DeleteAddon(ctx, deleted.ID); err != nil {
+		t.Fatalf("unable to delete the add-on: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		addonIDs []string
+		expected bool
+	}{
+		{name: "none", expected: true},
+		{name: "existing", addonIDs: []string{addon.ID}, expected: true},
+		{name: "deleted", addonIDs: []string{addon.ID, deleted.ID}},
+		{name: "missing", addonIDs: []string{"00000000-0000-0000-0000-000000000000"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			exist, err := testDB.AddonsExist(ctx, tc.addonIDs)
+			if err != nil {
+				t.Fatalf("unable to check whether the add-ons exist: %s", err)
+			}
+			if exist != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, exist)
+			}
+		})
+	}
+}
+
+func TestAddonPrerequisites(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	addon := addTestAddon(t, storage, 1)
+	required := addTestAddon(t, storage, 1)
+	plan := addTestPlan(t)
+
+	viaPlan := subscribeTestUser(t, addTestUser(t), plan, nil)
+	viaAddon := addTestSubscription(t)
+	attachTestAddon(t, viaAddon, required, 1)
+	neither := addTestSubscription(t)
+
+	checkMet := func(t *testing.T, subscription *Subscription, expected bool) {
+		t.Helper()
+
+		met, err := testDB.AddonPrerequisitesMet(ctx, subscription.ID, addon.ID)
+		if err != nil {
+			t.Fatalf("unable to check the prerequisites: %s", err)
+		}
+		if met != expected {
+			t.Errorf("expected %t for subscription %s, got %t", expected, subscription.ID, met)
+		}
+	}
+
+	// Add-ons without prerequisites can be attached to any subscription.
+	checkMet(t, neither, true)
+
+	err := testDB.SetAddonPrerequisites(ctx, addon.ID, []string{plan.ID}, []string{required.ID}, "test")
+	if err != nil {
+		t.Fatalf("unable to set the prerequisites: %s", err)
+	}
+
+	prerequisites, err := testDB.ListAddonPrerequisites(ctx, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to list the prerequisites: %s", err)
+	}
+	expected := []AddonPrerequisite{
+		{Type: api.PrerequisitePlan, ID: plan.ID, Name: plan.Name},
+		{Type: api.PrerequisiteAddon, ID: required.ID, Name: required.Name},
+	}
+	if len(prerequisites) != len(expected) {
+		t.Fatalf("expected %d prerequisites, got %+v", len(expected), prerequisites)
+	}
+	for i := range expected {
+		if prerequisites[i] != expected[i] {
+			t.Errorf("expected prerequisite %d to be %+v, got %+v", i, expected[i], prerequisites[i])
+		}
+	}
+
+	checkMet(t, viaPlan, true)
+	checkMet(t, viaAddon, true)
+	checkMet(t, neither, false)
+
+	// Replacing the prerequisites with an empty list removes them.
+	if err = testDB.SetAddonPrerequisites(ctx, addon.ID, nil, nil, "test"); err != nil {
+		t.Fatalf("unable to clear the prerequisites: %s", err)
+	}
+	checkMet(t, neither, true)
+}
@@ -0,0 +1,158 @@
+package db
+
+import (
+	"context"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// CompatiblePlan identifies a plan that an add-on can be attached to.
+type CompatiblePlan struct {
+	ID   string `db:"id"`
+	Name string `db:"name"`
+}
+
+// ToAPIType converts the compatible plan to the type used in responses.
+func (p *CompatiblePlan) ToAPIType() *api.CompatiblePlan {
+	return &api.CompatiblePlan{
+		ID:   p.ID,
+		Name: p.Name,
+	}
+}
+
+// compatibleWithPlan returns an expression that's true if the add-on can be
+// attached to subscriptions to the plan. Add-ons that aren't restricted to any
+// plans are compatible with every plan.
+func compatibleWithPlan(db GoquDatabase, addonID, planID any) exp.Expression {
+	restricted := db.From(t.Compatibility).
+		Select(goqu.L("1")).
+		Where(t.Compatibility.Col("addon_id").Eq(addonID))
+
+	allowed := restricted.Where(t.Compatibility.Col("plan_id").Eq(planID))
+
+	return goqu.Or(
+		goqu.L("NOT EXISTS ?", restricted),
+		goqu.L("EXISTS ?", allowed),
+	)
+}
+
+// SetAddonCompatibility replaces the plans that an add-on can be attached to
+// with the plans with the given IDs. An empty list of plans makes the add-on
+// compatible with every plan. Accepts a variable number of QueryOptions, though
+// only WithTX is currently supported. A transaction should be used so that the
+// add-on doesn't become compatible with every plan if adding the plans fails.
+func (d *Database) SetAddonCompatibility(ctx context.Context, addonID string, planIDs []string, createdBy string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	deleteDS := db.From(t.Compatibility).Delete().Where(t.Compatibility.Col("addon_id").Eq(addonID))
+	d.LogSQL(deleteDS)
+
+	if _, err := deleteDS.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to remove the compatible plans of add-on %s", addonID)
+	}
+
+	if len(planIDs) == 0 {
+		return nil
+	}
+
+	rows := make([]any, len(planIDs))
+	for i, planID := range planIDs {
+		rows[i] = goqu.Record{
+			"addon_id":   addonID,
+			"plan_id":    planID,
+			"created_by": createdBy,
+		}
+	}
+
+	ds := db.Insert(t.Compatibility).Rows(rows...).OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to add the compatible plans of add-on %s", addonID)
+	}
+
+	return nil
+}
+
+// ListCompatiblePlans returns the plans that an add-on is restricted to,
+// ordered by name. An empty list means that the add-on is compatible with every
+// plan. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListCompatiblePlans(ctx context.Context, addonID string, opts ...QueryOption) ([]CompatiblePlan, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Compatibility).
+		Join(t.Plans, goqu.On(t.Compatibility.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			t.Plans.Col("id"),
+			t.Plans.Col("name"),
+		).
+		Where(t.Compatibility.Col("addon_id").Eq(addonID), querySettings.sharedTenantExp(t.Plans)).
+		Order(t.Plans.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var plans []CompatiblePlan
+	if err := ds.Executor().ScanStructsContext(ctx, &plans); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the compatible plans of add-on %s", addonID)
+	}
+
+	return plans, nil
+}
+
+// AddonCompatibleWithSubscription returns true if an add-on can be attached to
+// a subscription, based on the subscription's plan. Accepts a variable number
+// of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) AddonCompatibleWithSubscription(ctx context.Context, subscriptionID, addonID string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	planID := db.From(t.Subscriptions).
+		Select(t.Subscriptions.Col("plan_id")).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID), querySettings.tenantExp(t.Subscriptions))
+
+	ds := db.Select(compatibleWithPlan(db, addonID, planID))
+	d.LogSQL(ds)
+
+	var compatible bool
+	if _, err := ds.Executor().ScanValContext(ctx, &compatible); err != nil {
+		return false, errors.Wrapf(err, "unable to check whether add-on %s is compatible with the subscription", addonID)
+	}
+
+	return compatible, nil
+}
+
+// ListAddonsForPlan returns the add-ons that can be attached to subscriptions
+// to a plan, ordered by name. Deleted add-ons are never included. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ListAddonsForPlan(ctx context.Context, planID string, opts ...QueryOption) ([]Addon, error) {
+	wrapMsg := "unable to list the add-ons for the plan"
+	_, db := d.querySettings(opts...)
+
+	ds := addonDS(db).
+		Where(
+			t.Addons.Col("deleted_at").IsNull(),
+			compatibleWithPlan(db, t.Addons.Col("id"), planID),
+		).
+		Order(t.Addons.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var addons []Addon
+	if err := ds.ScanStructsContext(ctx, &addons); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+
+	for i, addon := range addons {
+		addonRates, err := d.ListRatesForAddon(ctx, addon.ID, opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, wrapMsg)
+		}
+		addons[i].AddonRates = addonRates
+	}
+
+	return addons, nil
+}
@@ -0,0 +1,111 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAddonCompatibility(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	restricted := addTestAddon(t, storage, 1)
+	unrestricted := addTestAddon(t, storage, 1)
+	allowedPlan := addTestPlan(t)
+	otherPlan := addTestPlan(t)
+
+	allowed := subscribeTestUser(t, addTestUser(t), allowedPlan, nil)
+	other := subscribeTestUser(t, addTestUser(t), otherPlan, nil)
+
+	err := testDB.SetAddonCompatibility(ctx, restricted.ID, []string{allowedPlan.ID}, "test")
+	if err != nil {
+		t.Fatalf("unable to set the compatible plans: %s", err)
+	}
+
+	plans, err := testDB.ListCompatiblePlans(ctx, restricted.ID)
+	if err != nil {
+		t.Fatalf("unable to list the compatible plans: %s", err)
+	}
+	expected := CompatiblePlan{ID: allowedPlan.ID, Name: allowedPlan.Name}
+	if len(plans) != 1 || plans[0] != expected {
+		t.Errorf("expected %+v, got %+v", []CompatiblePlan{expected}, plans)
+	}
+
+	tests := []struct {
+		name         string
+		subscription *Subscription
+		addon        *Addon
+		expected     bool
+	}{
+		{name: "restricted to the plan", subscription: allowed, addon: restricted, expected: true},
+		{name: "restricted to another plan", subscription: other, addon: restricted},
+		{name: "unrestricted", subscription: other, addon: unrestricted, expected: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			compatible, err := testDB.AddonCompatibleWithSubscription(ctx, tc.subscription.ID, tc.addon.ID)
+			if err != nil {
+				t.Fatalf("unable to check the compatibility: %s", err)
+			}
+			if compatible != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, compatible)
+			}
+		})
+	}
+
+	// An empty list of plans makes the add-on compatible with every plan.
+	if err = testDB.SetAddonCompatibility(ctx, restricted.ID, nil, "test"); err != nil {
+		t.Fatalf("unable to clear the compatible plans: %s", err)
+	}
+	compatible, err := testDB.AddonCompatibleWithSubscription(ctx, other.ID, restricted.ID)
+	if err != nil {
+		t.Fatalf("unable to check the compatibility: %s", err)
+	}
+	if !compatible {
+		t.Error("expected the add-on to be compatible with every plan")
+	}
+}
+
+func TestListAddonsForPlan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	restricted := addTestAddon(t, storage, 1)
+	unrestricted := addTestAddon(t, storage, 1)
+	deleted := addTestAddon(t, storage, 1)
+	plan := addTestPlan(t)
+	otherPlan := addTestPlan(t)
+
+	if err := testDB.SetAddonCompatibility(ctx, restricted.ID, []string{otherPlan.ID}, "test"); err != nil {
+		t.Fatalf("unable to set the compatible plans: %s", err)
+	}
+	if err := testDB.DeleteAddon(ctx, deleted.ID); err != nil {
+		t.Fatalf("unable to delete the add-on: %s", err)
+	}
+
+	addons, err := testDB.ListAddonsForPlan(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to list the add-ons for the plan: %s", err)
+	}
+
+	listed := make(map[string]Addon)
+	for _, addon := range addons {
+		listed[addon.ID] = addon
+	}
+	if addon, ok := listed[unrestricted.ID]; !ok {
+		t.Error("expected the unrestricted add-on to be listed")
+	} else if len(addon.AddonRates) != 1 {
+		t.Errorf("expected the add-on to be listed with its rate, got %+v", addon.AddonRates)
+	}
+	if _, ok := listed[restricted.ID]; ok {
+		t.Error("expected the add-on restricted to another plan not to be listed")
+	}
+	if _, ok := listed[deleted.ID]; ok {
+		t.Error("expected the deleted add-on not to be listed")
+	}
+}
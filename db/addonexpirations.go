@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// SetSubscriptionAddonEndDate sets the time that a subscription add-on ends,
+// independently of the subscription that it's attached to. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetSubscriptionAddonEndDate(ctx context.Context, subAddonID string, endDate time.Time, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.SubscriptionAddons).
+		Set(goqu.Record{"effective_end_date": endDate}).
+		Where(
+			t.SubscriptionAddons.Col("id").Eq(subAddonID),
+			t.SubscriptionAddons.Col("expired_at").IsNull(),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to set the end date of the subscription add-on")
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to set the end date of the subscription add-on")
+	}
+	if count == 0 {
+		return suberrors.ErrSubAddonNotFound
+	}
+	return nil
+}
+
+// EndedSubscriptionAddons returns up to limit subscription add-ons that have
+// ended but whose amounts haven't been removed from the quotas yet, oldest
+// first. The rows are locked for the rest of the transaction, and rows that are
+// already locked are skipped so that replicas can expire add-ons at the same
+// time. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) EndedSubscriptionAddons(ctx context.Context, limit uint, opts ...QueryOption) ([]SubscriptionAddon, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := subAddonDS(db).
+		Where(
+			t.SubscriptionAddons.Col("effective_end_date").Lte(CurrentTimestamp),
+			t.SubscriptionAddons.Col("expired_at").IsNull(),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		Order(t.SubscriptionAddons.Col("effective_end_date").Asc()).
+		Limit(limit).
+		ForUpdate(exp.SkipLocked, t.SubscriptionAddons)
+	d.LogSQL(ds)
+
+	var subAddons []SubscriptionAddon
+	if err := ds.Executor().ScanStructsContext(ctx, &subAddons); err != nil {
+		return nil, errors.Wrap(err, "unable to list the ended subscription add-ons")
+	}
+
+	return subAddons, nil
+}
+
+// MarkSubscriptionAddonsExpired records that the amounts of subscription
+// add-ons have been removed from the quotas. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) MarkSubscriptionAddonsExpired(ctx context.Context, ids []string, opts ...QueryOption) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.SubscriptionAddons).
+		Set(goqu.Record{"expired_at": CurrentTimestamp}).
+		Where(
+			t.SubscriptionAddons.Col("id").In(ids),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to mark the subscription add-ons as expired")
+	}
+
+	return nil
+}
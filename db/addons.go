@@ -2,11 +2,13 @@ package db
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
 	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/pkg/errors"
 )
 
@@ -57,6 +59,9 @@ func addonDS(db GoquDatabase) *goqu.SelectDataset {
 			t.Addons.Col("description"),
 			t.Addons.Col("default_amount"),
 			t.Addons.Col("default_paid"),
+			t.Addons.Col("deleted_at"),
+			t.Addons.Col("version"),
+			t.Addons.Col("max_per_subscription"),
 
 			t.ResourceTypes.Col("id").As(goqu.C("resource_types.id")),
 			t.ResourceTypes.Col("name").As(goqu.C("resource_types.name")),
@@ -92,23 +97,86 @@ func (d *Database) GetAddonByID(ctx context.Context, addonID string, opts ...Que
 	return addon, nil
 }
 
-func (d *Database) ListAddons(ctx context.Context, opts ...QueryOption) ([]Addon, error) {
+// AddonFilter narrows down and orders the add-ons returned by ListAddons. The
+// zero value lists every add-on in order by name.
+type AddonFilter struct {
+	// ResourceType limits the listing to the add-ons for the resource type
+	// with this name.
+	ResourceType string
+
+	// NameContains limits the listing to the add-ons whose names contain this
+	// string, ignoring case.
+	NameContains string
+
+	// DefaultPaid limits the listing to the add-ons that are or aren't paid by
+	// default.
+	DefaultPaid *bool
+
+	// SortBy is the field that the add-ons are sorted by. It's one of the
+	// AddonSort constants.
+	SortBy string
+
+	// Descending reverses the order of the add-ons.
+	Descending bool
+}
+
+// The fields that add-ons can be sorted by.
+const (
+	AddonSortName          = "name"
+	AddonSortResourceType  = "resource_type"
+	AddonSortDefaultAmount = "default_amount"
+	AddonSortDefaultPaid   = "default_paid"
+)
+
+// addonSortColumns maps the fields that add-ons can be sorted by to their
+// columns.
+var addonSortColumns = map[string]exp.IdentifierExpression{
+	AddonSortName:          t.Addons.Col("name"),
+	AddonSortResourceType:  t.ResourceTypes.Col("name"),
+	AddonSortDefaultAmount: t.Addons.Col("default_amount"),
+	AddonSortDefaultPaid:   t.Addons.Col("default_paid"),
+}
+
+// ValidAddonSort returns true if add-ons can be sorted by the field.
+func ValidAddonSort(field string) bool {
+	_, ok := addonSortColumns[field]
+	return ok
+}
+
+// ListAddons returns the add-ons that match the filter. Ties in the sort order
+// are broken by name. Accepts a variable number of QueryOptions, including
+// WithTX, WithReadReplica and WithIncludeDeleted.
+func (d *Database) ListAddons(ctx context.Context, filter *AddonFilter, opts ...QueryOption) ([]Addon, error) {
 	wrapMsg := "unable to list addons"
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
-	ds := db.From(t.Addons).
-		Select(
-			t.Addons.Col("id"),
-			t.Addons.Col("name"),
-			t.Addons.Col("description"),
-			t.Addons.Col("default_amount"),
-			t.Addons.Col("default_paid"),
+	if filter == nil {
+		filter = &AddonFilter{}
+	}
 
-			t.ResourceTypes.Col("id").As(goqu.C("resource_types.id")),
-			t.ResourceTypes.Col("name").As(goqu.C("resource_types.name")),
-			t.ResourceTypes.Col("unit").As(goqu.C("resource_types.unit")),
-		).
-		Join(t.ResourceTypes, goqu.On(t.Addons.Col("resource_type_id").Eq(t.ResourceTypes.Col("id"))))
+	ds := addonDS(db)
+	if !qs.includeDeleted {
+		ds = ds.Where(t.Addons.Col("deleted_at").IsNull())
+	}
+	if filter.ResourceType != "" {
+		ds = ds.Where(t.ResourceTypes.Col("name").Eq(filter.ResourceType))
+	}
+	if filter.NameContains != "" {
+		ds = ds.Where(t.Addons.Col("name").ILike("%" + likeEscaper.Replace(filter.NameContains) + "%"))
+	}
+	if filter.DefaultPaid != nil {
+		ds = ds.Where(t.Addons.Col("default_paid").Eq(*filter.DefaultPaid))
+	}
+
+	sortCol, ok := addonSortColumns[filter.SortBy]
+	if !ok {
+		sortCol = addonSortColumns[AddonSortName]
+	}
+	if filter.Descending {
+		ds = ds.Order(sortCol.Desc(), t.Addons.Col("name").Desc())
+	} else {
+		ds = ds.Order(sortCol.Asc(), t.Addons.Col("name").Asc())
+	}
 	d.LogSQL(ds)
 
 	var addons []Addon
@@ -163,7 +231,7 @@ func (d *Database) ToggleAddonPaid(ctx context.Context, addonID string, opts ...
 	_, db := d.querySettings(opts...)
 
 	ds1 := db.Update(t.Addons).
-		Set(goqu.Record{"default_paid": goqu.L("NOT default_paid")}).
+		Set(goqu.Record{"default_paid": goqu.L("NOT default_paid"), "version": goqu.L("version + 1")}).
 		Where(t.Addons.Col("id").Eq(addonID)).
 		Executor()
 
@@ -283,7 +351,7 @@ func (d *Database) UpdateAddonRates(ctx context.Context, addonUpdateRecord *Upda
 }
 
 func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
 	rec := goqu.Record{}
 
@@ -309,11 +377,23 @@ func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAdd
 		updateAddon = true
 	}
 
-	// Update the top-level addon record if requested.
-	if updateAddon {
+	// Update the top-level addon record if requested. The version is also
+	// incremented when only the rates change, since the rates are part of the
+	// add-on as far as callers are concerned.
+	if updateAddon || addonUpdateRecord.UpdateAddonRates {
+		rec["version"] = goqu.L("version + 1")
+
+		where := []exp.Expression{
+			t.Addons.Col("id").Eq(addonUpdateRecord.ID),
+			t.Addons.Col("deleted_at").IsNull(),
+		}
+		if qs.hasExpectedVersion {
+			where = append(where, t.Addons.Col("version").Eq(qs.expectedVersion))
+		}
+
 		ds := db.Update(t.Addons).
 			Set(rec).
-			Where(t.Addons.Col("id").Eq(addonUpdateRecord.ID)).
+			Where(where...).
 			Executor()
 
 		r, err := ds.ExecContext(ctx)
@@ -324,6 +404,9 @@ func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAdd
 		if err != nil {
 			return errors.Wrap(err, "unable to determine how many rows were affected")
 		}
+		if rowsAffected == 0 && qs.hasExpectedVersion {
+			return suberrors.ErrVersionConflict
+		}
 		if rowsAffected == 0 {
 			return suberrors.ErrAddonNotFound
 		}
@@ -340,16 +423,33 @@ func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAdd
 	return nil
 }
 
+// DeleteAddon marks an add-on as deleted. The add-on is kept so that the
+// subscription add-ons that refer to it remain valid. Returns ErrAddonNotFound
+// if the add-on doesn't exist or has already been deleted.
 func (d *Database) DeleteAddon(ctx context.Context, addonID string, opts ...QueryOption) error {
 	_, db := d.querySettings(opts...)
 
-	ds := db.From(t.Addons).
-		Delete().
-		Where(t.Addons.Col("id").Eq(addonID)).
-		Executor()
+	ds := db.Update(t.Addons).
+		Set(goqu.Record{"deleted_at": CurrentTimestamp}).
+		Where(
+			t.Addons.Col("id").Eq(addonID),
+			t.Addons.Col("deleted_at").IsNull(),
+		)
+	d.LogSQL(ds)
 
-	_, err := ds.ExecContext(ctx)
-	return err
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return suberrors.ErrAddonNotFound
+	}
+	return nil
 }
 
 func subAddonDS(db GoquDatabase) *goqu.SelectDataset {
@@ -368,7 +468,7 @@ func subAddonDS(db GoquDatabase) *goqu.SelectDataset {
 
 			t.Subscriptions.Col("id").As(goqu.C("subscriptions.id")),
 			t.Subscriptions.Col("effective_start_date").As(goqu.C("subscriptions.effective_start_date")),
-			t.Subscriptions.Col("effective_end_date").As(goqu.C("subscriptions.effective_end_date")),
+			endDateExp(t.Subscriptions).As(goqu.C("subscriptions.effective_end_date")),
 			t.Subscriptions.Col("created_by").As(goqu.C("subscriptions.created_by")),
 			t.Subscriptions.Col("created_at").As(goqu.C("subscriptions.created_at")),
 			t.Subscriptions.Col("last_modified_by").As(goqu.C("subscriptions.last_modified_by")),
@@ -384,7 +484,10 @@ func subAddonDS(db GoquDatabase) *goqu.SelectDataset {
 			t.Plans.Col("description").As(goqu.C("subscriptions.plans.description")),
 
 			t.SubscriptionAddons.Col("amount"),
+			t.SubscriptionAddons.Col("quantity"),
 			t.SubscriptionAddons.Col("paid"),
+			t.SubscriptionAddons.Col("effective_end_date"),
+			t.SubscriptionAddons.Col("expired_at"),
 
 			t.AddonRates.Col("id").As(goqu.C("addon_rates.id")),
 			t.AddonRates.Col("effective_date").As(goqu.C("addon_rates.effective_date")),
@@ -400,10 +503,10 @@ func subAddonDS(db GoquDatabase) *goqu.SelectDataset {
 }
 
 func (d *Database) GetSubscriptionAddonByID(ctx context.Context, subAddonID string, opts ...QueryOption) (*SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ds := subAddonDS(db).
-		Where(t.SubscriptionAddons.Col("id").Eq(subAddonID)).
+		Where(t.SubscriptionAddons.Col("id").Eq(subAddonID), querySettings.tenantExp(t.Subscriptions)).
 		Executor()
 	d.LogSQL(ds)
 
@@ -425,10 +528,10 @@ func (d *Database) ListSubscriptionAddons(
 	subscriptionID string,
 	opts ...QueryOption,
 ) ([]SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ds := subAddonDS(db).
-		Where(t.Subscriptions.Col("id").Eq(subscriptionID)).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID), querySettings.tenantExp(t.Subscriptions)).
 		Executor()
 	d.LogSQL(ds)
 
@@ -440,9 +543,15 @@ func (d *Database) ListSubscriptionAddons(
 	return addons, nil
 }
 
+// AddSubscriptionAddon attaches the given quantity of an add-on to a
+// subscription in a single subscription add-on, which adds the add-on's default
+// amount multiplied by the quantity to the quota. ErrAddonLimitReached is
+// returned if the add-on has a maximum number of units per subscription and the
+// subscription would end up with more than that.
 func (d *Database) AddSubscriptionAddon(
 	ctx context.Context,
 	subscriptionID, addonID string,
+	quantity int64,
 	opts ...QueryOption,
 ) (*SubscriptionAddon, error) {
 	qs, db, err := d.querySettingsWithTX(opts...)
@@ -462,16 +571,58 @@ func (d *Database) AddSubscriptionAddon(
 	if err != nil {
 		return nil, err
 	}
+	if addon.DeletedAt.Valid {
+		return nil, suberrors.ErrAddonNotFound
+	}
 	addonRate := addon.GetCurrentRate()
 	if addonRate == nil {
 		return nil, fmt.Errorf("no active rate found for addon %s", addon.ID)
 	}
 
+	// The subscription is looked up first so that add-ons can't be attached to
+	// the subscriptions of other tenants.
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, WithTXRollbackCommit(db, false, false))
+	if err != nil {
+		return nil, err
+	}
+	if subscription == nil {
+		return nil, suberrors.ErrSubscriptionNotFound
+	}
+
+	// The subscription is locked so that concurrent requests can't attach more
+	// units of the add-on than the maximum between them.
+	if addon.MaxPerSubscription.Valid {
+		lockDS := db.From(t.Subscriptions).
+			Select(t.Subscriptions.Col("id")).
+			Where(t.Subscriptions.Col("id").Eq(subscriptionID)).
+			ForUpdate(exp.Wait)
+		d.LogSQL(lockDS)
+
+		var lockedID string
+		found, err := lockDS.Executor().ScanValContext(ctx, &lockedID)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to lock the subscription")
+		}
+		if !found {
+			return nil, suberrors.ErrSubscriptionNotFound
+		}
+
+		attached, err := d.AttachedAddonQuantity(ctx, subscriptionID, addonID, WithTX(db))
+		if err != nil {
+			return nil, err
+		}
+		if attached+quantity > addon.MaxPerSubscription.Int64 {
+			return nil, suberrors.ErrAddonLimitReached
+		}
+	}
+
+	amount := addon.DefaultAmount * float64(quantity)
 	ds := db.Insert(t.SubscriptionAddons).
 		Rows(goqu.Record{
 			"subscription_id": subscriptionID,
 			"addon_id":        addonID,
-			"amount":          addon.DefaultAmount,
+			"amount":          amount,
+			"quantity":        quantity,
 			"paid":            addon.DefaultPaid,
 			"addon_rate_id":   addonRate.ID,
 		}).
@@ -483,11 +634,6 @@ func (d *Database) AddSubscriptionAddon(
 		return nil, err
 	}
 
-	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, WithTXRollbackCommit(db, false, false))
-	if err != nil {
-		return nil, err
-	}
-
 	if qs.doCommit {
 		if err = db.Commit(); err != nil {
 			return nil, err
@@ -498,7 +644,8 @@ func (d *Database) AddSubscriptionAddon(
 		ID:           newAddonID,
 		Addon:        *addon,
 		Subscription: *subscription,
-		Amount:       addon.DefaultAmount,
+		Amount:       amount,
+		Quantity:     quantity,
 		Paid:         addon.DefaultPaid,
 		Rate:         *addonRate,
 	}
@@ -506,12 +653,74 @@ func (d *Database) AddSubscriptionAddon(
 	return retval, nil
 }
 
-func (d *Database) DeleteSubscriptionAddon(ctx context.Context, subAddonID string, opts ...QueryOption) error {
+// AttachedAddonQuantity returns the number of units of an add-on that are
+// attached to a subscription, not counting the units that have expired.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) AttachedAddonQuantity(ctx context.Context, subscriptionID, addonID string, opts ...QueryOption) (int64, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.SubscriptionAddons).
+		Select(goqu.COALESCE(goqu.SUM(t.SubscriptionAddons.Col("quantity")), 0)).
+		Where(
+			t.SubscriptionAddons.Col("subscription_id").Eq(subscriptionID),
+			t.SubscriptionAddons.Col("addon_id").Eq(addonID),
+			t.SubscriptionAddons.Col("expired_at").IsNull(),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	var quantity int64
+	if _, err := ds.Executor().ScanValContext(ctx, &quantity); err != nil {
+		return 0, errors.Wrapf(err, "unable to count the units of add-on %s attached to the subscription", addonID)
+	}
+
+	return quantity, nil
+}
+
+// SetAddonMaxPerSubscription sets the maximum number of units of an add-on that
+// can be attached to a single subscription. An invalid maximum removes the
+// limit. ErrAddonNotFound is returned if the add-on doesn't exist or has been
+// deleted. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) SetAddonMaxPerSubscription(ctx context.Context, addonID string, maximum sql.NullInt64, opts ...QueryOption) error {
 	_, db := d.querySettings(opts...)
 
+	ds := db.Update(t.Addons).
+		Set(goqu.Record{
+			"max_per_subscription": maximum,
+			"version":              goqu.L("version + 1"),
+		}).
+		Where(
+			t.Addons.Col("id").Eq(addonID),
+			t.Addons.Col("deleted_at").IsNull(),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the maximum per subscription for add-on %s", addonID)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the maximum per subscription for add-on %s", addonID)
+	}
+	if count == 0 {
+		return suberrors.ErrAddonNotFound
+	}
+
+	return nil
+}
+
+func (d *Database) DeleteSubscriptionAddon(ctx context.Context, subAddonID string, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
 	ds := db.From(t.SubscriptionAddons).
 		Delete().
-		Where(t.SubscriptionAddons.Col("id").Eq(subAddonID)).
+		Where(
+			t.SubscriptionAddons.Col("id").Eq(subAddonID),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		).
 		Executor()
 
 	_, err := ds.ExecContext(ctx)
@@ -542,7 +751,10 @@ func (d *Database) UpdateSubscriptionAddon(ctx context.Context, updated *UpdateS
 
 	ds := db.Update(t.SubscriptionAddons).
 		Set(rec).
-		Where(t.SubscriptionAddons.Col("id").Eq(updated.ID)).
+		Where(
+			t.SubscriptionAddons.Col("id").Eq(updated.ID),
+			qs.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		).
 		Returning(t.SubscriptionAddons.Col("id")).
 		Executor()
 
@@ -590,10 +802,10 @@ func (d *Database) UpdateSubscriptionAddon(ctx context.Context, updated *UpdateS
 }
 
 func (d *Database) ListSubscriptionAddonsByAddonID(ctx context.Context, addonID string, opts ...QueryOption) ([]SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ds := subAddonDS(db).
-		Where(t.Addons.Col("id").Eq(addonID)).
+		Where(t.Addons.Col("id").Eq(addonID), querySettings.tenantExp(t.Subscriptions)).
 		Executor()
 	d.LogSQL(ds)
 
@@ -0,0 +1,438 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestAddon adds an add-on with a unique name for the resource type, with a
+// rate that took effect a day ago, and returns the add-on as it's loaded from
+// the database.
+func addTestAddon(t *testing.T, resourceType ResourceType, defaultAmount float64) *Addon {
+	t.Helper()
+	ctx := context.Background()
+
+	addon := &Addon{
+		Name:          uniqueName("addon"),
+		Description:   "An add-on used by the integration tests.",
+		ResourceType:  resourceType,
+		DefaultAmount: defaultAmount,
+		DefaultPaid:   true,
+		AddonRates:    []AddonRate{{EffectiveDate: time.Now().Add(-24 * time.Hour), Rate: 10}},
+	}
+	id, err := testDB.AddAddon(ctx, addon)
+	if err != nil {
+		t.Fatalf("unable to add an add-on: %s", err)
+	}
+
+	loaded, err := testDB.GetAddonByID(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up add-on %s: %s", id, err)
+	}
+	return loaded
+}
+
+// attachTestAddon attaches units of the add-on to the subscription.
+func attachTestAddon(t *testing.T, subscription *Subscription, addon *Addon, quantity int64) *SubscriptionAddon {
+	t.Helper()
+
+	subAddon, err := testDB.AddSubscriptionAddon(context.Background(), subscription.ID, addon.ID, quantity)
+	if err != nil {
+		t.Fatalf("unable to attach add-on %s to subscription %s: %s", addon.Name, subscription.ID, err)
+	}
+	return subAddon
+}
+
+func TestAddAddon(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	addon := addTestAddon(t, storage, 5)
+
+	if addon.ResourceType.ID != storage.ID || addon.DefaultAmount != 5 || !addon.DefaultPaid {
+		t.Errorf("the add-on wasn't stored correctly: %+v", addon)
+	}
+	if addon.Version != 1 {
+		t.Errorf("expected a new add-on to have version 1, got %d", addon.Version)
+	}
+	if len(addon.AddonRates) != 1 || addon.AddonRates[0].Rate != 10 {
+		t.Errorf("expected a single rate of 10, got %+v", addon.AddonRates)
+	}
+
+	if _, err := testDB.GetAddonByID(ctx, "00000000-0000-0000-0000-000000000000"); err == nil {
+		t.Error("expected looking up a missing add-on to fail")
+	}
+}
+
+func TestUpdateAddon(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	addon := addTestAddon(t, storage, 5)
+
+	update := &UpdateAddon{
+		ID:                  addon.ID,
+		Description:         "An updated add-on.",
+		UpdateDescription:   true,
+		DefaultAmount:       7,
+		UpdateDefaultAmount: true,
+		AddonRates: []AddonRate{
+			{ID: addon.AddonRates[0].ID, AddonID: addon.ID, EffectiveDate: addon.AddonRates[0].EffectiveDate, Rate: 12},
+			{AddonID: addon.ID, EffectiveDate: time.Now().Add(24 * time.Hour), Rate: 15},
+		},
+		UpdateAddonRates: true,
+	}
+	if err := testDB.UpdateAddon(ctx, update, WithExpectedVersion(addon.Version)); err != nil {
+		t.Fatalf("unable to update the add-on: %s", err)
+	}
+
+	updated, err := testDB.GetAddonByID(ctx, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the add-on: %s", err)
+	}
+	if updated.Description != update.Description || updated.DefaultAmount != 7 || updated.Name != addon.Name {
+		t.Errorf("the add-on wasn't updated correctly: %+v", updated)
+	}
+	if updated.Version != addon.Version+1 {
+		t.Errorf("expected version %d, got %d", addon.Version+1, updated.Version)
+	}
+	if len(updated.AddonRates) != 2 || updated.AddonRates[0].Rate != 12 || updated.AddonRates[1].Rate != 15 {
+		t.Errorf("expected rates of 12 and 15, got %+v", updated.AddonRates)
+	}
+
+	rates, err := testDB.ListRatesForAddon(ctx, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to list the add-on rates: %s", err)
+	}
+	if len(rates) != 2 {
+		t.Errorf("expected 2 rates, got %d", len(rates))
+	}
+
+	// Updates based on an outdated version are refused.
+	update = &UpdateAddon{ID: addon.ID, Name: uniqueName("addon"), UpdateName: true}
+	if err = testDB.UpdateAddon(ctx, update, WithExpectedVersion(addon.Version)); !errors.Is(err, suberrors.ErrVersionConflict) {
+		t.Errorf("expected ErrVersionConflict, got %v", err)
+	}
+}
+
+func TestAddonRates(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	addon := addTestAddon(t, addTestResourceType(t, false), 5)
+
+	rate := AddonRate{AddonID: addon.ID, EffectiveDate: time.Now().Add(time.Hour), Rate: 20}
+	if err := testDB.AddAddonRate(ctx, rate); err != nil {
+		t.Fatalf("unable to add the rate: %s", err)
+	}
+
+	rates, err := testDB.ListRatesForAddon(ctx, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to list the add-on rates: %s", err)
+	}
+	if len(rates) != 2 || rates[1].Rate != 20 {
+		t.Fatalf("expected the new rate to be listed last, got %+v", rates)
+	}
+
+	rates[1].Rate = 25
+	if err = testDB.UpdateAddonRate(ctx, rates[1]); err != nil {
+		t.Fatalf("unable to update the rate: %s", err)
+	}
+	if rates, err = testDB.ListRatesForAddon(ctx, addon.ID); err != nil {
+		t.Fatalf("unable to list the add-on rates: %s", err)
+	}
+	if rates[1].Rate != 25 {
+		t.Errorf("expected the rate to be updated to 25, got %g", rates[1].Rate)
+	}
+
+	// Rates that aren't included in the replacement list are removed.
+	err = testDB.UpdateAddonRates(ctx, &UpdateAddon{ID: addon.ID, AddonRates: []AddonRate{rates[1]}})
+	if err != nil {
+		t.Fatalf("unable to replace the rates: %s", err)
+	}
+	if rates, err = testDB.ListRatesForAddon(ctx, addon.ID); err != nil {
+		t.Fatalf("unable to list the add-on rates: %s", err)
+	}
+	if len(rates) != 1 || rates[0].Rate != 25 {
+		t.Errorf("expected only the rate of 25 to be left, got %+v", rates)
+	}
+}
+
+func TestToggleAddonPaid(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	addon := addTestAddon(t, addTestResourceType(t, false), 5)
+
+	toggled, err := testDB.ToggleAddonPaid(ctx, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to toggle the paid flag: %s", err)
+	}
+	if toggled.DefaultPaid == addon.DefaultPaid {
+		t.Errorf("expected the paid flag to be toggled to %t", !addon.DefaultPaid)
+	}
+}
+
+func TestDeleteAddon(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	addon := addTestAddon(t, addTestResourceType(t, false), 5)
+	if err := testDB.DeleteAddon(ctx, addon.ID); err != nil {
+		t.Fatalf("unable to delete the add-on: %s", err)
+	}
+	if err := testDB.DeleteAddon(ctx, addon.ID); !errors.Is(err, suberrors.ErrAddonNotFound) {
+		t.Errorf("expected ErrAddonNotFound when deleting the add-on again, got %v", err)
+	}
+
+	// Deleted add-ons can't be updated or attached to subscriptions.
+	update := &UpdateAddon{ID: addon.ID, Name: uniqueName("addon"), UpdateName: true}
+	if err := testDB.UpdateAddon(ctx, update); !errors.Is(err, suberrors.ErrAddonNotFound) {
+		t.Errorf("expected ErrAddonNotFound when updating a deleted add-on, got %v", err)
+	}
+	subscription := addTestSubscription(t)
+	if _, err := testDB.AddSubscriptionAddon(ctx, subscription.ID, addon.ID, 1); !errors.Is(err, suberrors.ErrAddonNotFound) {
+		t.Errorf("expected ErrAddonNotFound when attaching a deleted add-on, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []QueryOption
+		expected bool
+	}{
+		{name: "default"},
+		{name: "deleted included", opts: []QueryOption{WithIncludeDeleted()}, expected: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addons, err := testDB.ListAddons(ctx, nil, tc.opts...)
+			if err != nil {
+				t.Fatalf("unable to list the add-ons: %s", err)
+			}
+
+			var listed bool
+			for _, listedAddon := range addons {
+				listed = listed || listedAddon.ID == addon.ID
+			}
+			if listed != tc.expected {
+				t.Errorf("expected the deleted add-on to be listed: %t", tc.expected)
+			}
+		})
+	}
+}
+
+func TestListAddonsFilter(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	large := addTestAddon(t, storage, 3)
+	small := addTestAddon(t, storage, 1)
+	medium := addTestAddon(t, storage, 2)
+	other := addTestAddon(t, addTestResourceType(t, false), 1)
+
+	free := false
+	if err := testDB.UpdateAddon(ctx, &UpdateAddon{ID: medium.ID, DefaultPaid: free, UpdateDefaultPaid: true}); err != nil {
+		t.Fatalf("unable to update the add-on: %s", err)
+	}
+
+	tests := []struct {
+		name     string
+		filter   *AddonFilter
+		expected []string
+	}{
+		{
+			name:     "by name",
+			filter:   &AddonFilter{ResourceType: storage.Name},
+			expected: sortedAddonIDs(large, small, medium),
+		},
+		{
+			name:     "by default amount descending",
+			filter:   &AddonFilter{ResourceType: storage.Name, SortBy: AddonSortDefaultAmount, Descending: true},
+			expected: []string{large.ID, medium.ID, small.ID},
+		},
+		{
+			name:     "name contains",
+			filter:   &AddonFilter{NameContains: strings.ToUpper(other.Name)},
+			expected: []string{other.ID},
+		},
+		{
+			name:     "default paid",
+			filter:   &AddonFilter{ResourceType: storage.Name, DefaultPaid: &free},
+			expected: []string{medium.ID},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addons, err := testDB.ListAddons(ctx, tc.filter)
+			if err != nil {
+				t.Fatalf("unable to list the add-ons: %s", err)
+			}
+
+			ids := make([]string, len(addons))
+			for i, addon := range addons {
+				ids[i] = addon.ID
+			}
+			if strings.Join(ids, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected add-ons %v, got %v", tc.expected, ids)
+			}
+		})
+	}
+}
+
+// sortedAddonIDs returns the IDs of the add-ons in order by name.
+func sortedAddonIDs(addons ...*Addon) []string {
+	sort.Slice(addons, func(i, j int) bool { return addons[i].Name < addons[j].Name })
+
+	ids := make([]string, len(addons))
+	for i, addon := range addons {
+		ids[i] = addon.ID
+	}
+	return ids
+}
+
+func TestSubscriptionAddons(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	addon := addTestAddon(t, storage, 5)
+	subscription := addTestSubscription(t)
+
+	subAddon := attachTestAddon(t, subscription, addon, 3)
+	if subAddon.Amount != 15 || subAddon.Quantity != 3 || !subAddon.Paid {
+		t.Errorf("expected 3 paid units with a total amount of 15, got %+v", subAddon)
+	}
+
+	loaded, err := testDB.GetSubscriptionAddonByID(ctx, subAddon.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription add-on: %s", err)
+	}
+	if loaded.Subscription.ID != subscription.ID || loaded.Addon.ID != addon.ID || loaded.Rate.Rate != 10 {
+		t.Errorf("the subscription add-on wasn't loaded correctly: %+v", loaded)
+	}
+
+	for name, list := range map[string]func() ([]SubscriptionAddon, error){
+		"by subscription": func() ([]SubscriptionAddon, error) {
+			return testDB.ListSubscriptionAddons(ctx, subscription.ID)
+		},
+		"by add-on": func() ([]SubscriptionAddon, error) {
+			return testDB.ListSubscriptionAddonsByAddonID(ctx, addon.ID)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			subAddons, err := list()
+			if err != nil {
+				t.Fatalf("unable to list the subscription add-ons: %s", err)
+			}
+			if len(subAddons) != 1 || subAddons[0].ID != subAddon.ID {
+				t.Errorf("expected only subscription add-on %s, got %+v", subAddon.ID, subAddons)
+			}
+		})
+	}
+
+	updated, err := testDB.UpdateSubscriptionAddon(ctx, &UpdateSubscriptionAddon{
+		ID:           subAddon.ID,
+		Amount:       20,
+		UpdateAmount: true,
+		Paid:         false,
+		UpdatePaid:   true,
+	})
+	if err != nil {
+		t.Fatalf("unable to update the subscription add-on: %s", err)
+	}
+	if updated.Amount != 20 || updated.Paid {
+		t.Errorf("expected an unpaid amount of 20, got %+v", updated)
+	}
+
+	if err = testDB.DeleteSubscriptionAddon(ctx, subAddon.ID); err != nil {
+		t.Fatalf("unable to delete the subscription add-on: %s", err)
+	}
+	if _, err = testDB.GetSubscriptionAddonByID(ctx, subAddon.ID); !errors.Is(err, suberrors.ErrSubAddonNotFound) {
+		t.Errorf("expected ErrSubAddonNotFound after deleting the subscription add-on, got %v", err)
+	}
+
+	_, err = testDB.UpdateSubscriptionAddon(ctx, &UpdateSubscriptionAddon{ID: subAddon.ID, Amount: 1, UpdateAmount: true})
+	if !errors.Is(err, suberrors.ErrSubAddonNotFound) {
+		t.Errorf("expected ErrSubAddonNotFound when updating a deleted subscription add-on, got %v", err)
+	}
+}
+
+func TestAddonMaxPerSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	addon := addTestAddon(t, addTestResourceType(t, false), 5)
+	if err := testDB.SetAddonMaxPerSubscription(ctx, addon.ID, sql.NullInt64{Int64: 3, Valid: true}); err != nil {
+		t.Fatalf("unable to set the maximum per subscription: %s", err)
+	}
+
+	subscription := addTestSubscription(t)
+	attachTestAddon(t, subscription, addon, 2)
+	if _, err := testDB.AddSubscriptionAddon(ctx, subscription.ID, addon.ID, 2); !errors.Is(err, suberrors.ErrAddonLimitReached) {
+		t.Errorf("expected ErrAddonLimitReached, got %v", err)
+	}
+	attachTestAddon(t, subscription, addon, 1)
+
+	quantity, err := testDB.AttachedAddonQuantity(ctx, subscription.ID, addon.ID)
+	if err != nil {
+		t.Fatalf("unable to count the attached units: %s", err)
+	}
+	if quantity != 3 {
+		t.Errorf("expected 3 units to be attached, got %d", quantity)
+	}
+
+	// Removing the limit allows more units to be attached.
+	if err = testDB.SetAddonMaxPerSubscription(ctx, addon.ID, sql.NullInt64{}); err != nil {
+		t.Fatalf("unable to remove the maximum per subscription: %s", err)
+	}
+	attachTestAddon(t, subscription, addon, 1)
+}
+
+func TestAddonUsages(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	addon := addTestAddon(t, compute, 5)
+	subscription := addTestSubscription(t)
+	subAddon := attachTestAddon(t, subscription, addon, 1)
+	attachTestAddon(t, subscription, addon, 1)
+
+	for _, update := range []struct {
+		operation string
+		value     float64
+	}{
+		{operation: UpdateTypeAdd, value: 2},
+		{operation: UpdateTypeAdd, value: 3},
+		{operation: UpdateTypeSet, value: 4},
+		{operation: UpdateTypeAdd, value: 1},
+	} {
+		if err := testDB.ApplyAddonUsage(ctx, subAddon.ID, update.operation, update.value); err != nil {
+			t.Fatalf("unable to apply the %s update: %s", update.operation, err)
+		}
+	}
+	if err := testDB.ApplyAddonUsage(ctx, subAddon.ID, "MULTIPLY", 2); err == nil {
+		t.Error("expected an invalid update type to be refused")
+	}
+
+	// Add-ons without any usage attributed to them aren't listed.
+	usages, err := testDB.SubscriptionAddonUsages(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the add-on usages: %s", err)
+	}
+	if len(usages) != 1 || usages[0].SubscriptionAddonID != subAddon.ID || usages[0].Usage != 5 {
+		t.Errorf("expected a usage of 5 for subscription add-on %s, got %+v", subAddon.ID, usages)
+	}
+}
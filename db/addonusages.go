@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// AddonUsage is the portion of a subscription's usage of a resource type that's
+// attributed to one of its add-ons.
+type AddonUsage struct {
+	SubscriptionAddonID string  `db:"subscription_addon_id"`
+	Usage               float64 `db:"usage"`
+}
+
+// ApplyAddonUsage updates the usage attributed to a subscription add-on in the
+// same way that a usage update changes the total usage: the value either
+// replaces the attributed usage or is added to it. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) ApplyAddonUsage(ctx context.Context, subAddonID, updateType string, value float64, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	// Usage can't be attributed to the add-ons of other tenants' subscriptions.
+	if querySettings.tenant != "" {
+		count, err := db.From(t.SubscriptionAddons).
+			Where(
+				t.SubscriptionAddons.Col("id").Eq(subAddonID),
+				querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+			).
+			CountContext(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up subscription add-on %s", subAddonID)
+		}
+		if count == 0 {
+			return suberrors.ErrSubAddonNotFound
+		}
+	}
+
+	var usage any
+	switch updateType {
+	case UpdateTypeSet:
+		usage = goqu.I("excluded.usage")
+	case UpdateTypeAdd:
+		usage = goqu.L("? + ?", t.AddonUsages.Col("usage"), goqu.I("excluded.usage"))
+	default:
+		return fmt.Errorf("invalid update type: %s", updateType)
+	}
+
+	ds := db.Insert(t.AddonUsages).
+		Rows(goqu.Record{
+			"subscription_addon_id": subAddonID,
+			"usage":                 value,
+		}).
+		OnConflict(goqu.DoUpdate("subscription_addon_id", goqu.Record{
+			"usage":            usage,
+			"last_modified_at": CurrentTimestamp,
+		}))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update the usage attributed to subscription add-on %s", subAddonID)
+	}
+
+	return nil
+}
+
+// SubscriptionAddonUsages returns the usages attributed to the add-ons of a
+// subscription. Add-ons that haven't had any usage attributed to them are
+// omitted. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) SubscriptionAddonUsages(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]AddonUsage, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.AddonUsages).
+		Join(t.SubscriptionAddons, goqu.On(t.AddonUsages.Col("subscription_addon_id").Eq(t.SubscriptionAddons.Col("id")))).
+		Select(
+			t.AddonUsages.Col("subscription_addon_id"),
+			t.AddonUsages.Col("usage"),
+		).
+		Where(
+			t.SubscriptionAddons.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionAddons.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	var usages []AddonUsage
+	if err := ds.Executor().ScanStructsContext(ctx, &usages); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the add-on usages for subscription %s", subscriptionID)
+	}
+
+	return usages, nil
+}
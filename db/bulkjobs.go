@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The possible states of a bulk job.
+const (
+	BulkJobStatusPending   = "pending"
+	BulkJobStatusRunning   = "running"
+	BulkJobStatusCompleted = "completed"
+	BulkJobStatusFailed    = "failed"
+)
+
+// BulkJob records the progress of an operation that is processed in batches.
+type BulkJob struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	Kind           string         `db:"kind"`
+	Status         string         `db:"status"`
+	Total          int            `db:"total"`
+	Processed      int            `db:"processed"`
+	Failed         int            `db:"failed"`
+	ErrorMessage   sql.NullString `db:"error_message"`
+	CreatedBy      string         `db:"created_by"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the bulk job to the type used in responses.
+func (j *BulkJob) ToAPIType() *api.BulkJob {
+	return &api.BulkJob{
+		ID:             j.ID,
+		Kind:           j.Kind,
+		Status:         j.Status,
+		Total:          j.Total,
+		Processed:      j.Processed,
+		Failed:         j.Failed,
+		ErrorMessage:   j.ErrorMessage.String,
+		CreatedBy:      j.CreatedBy,
+		CreatedAt:      j.CreatedAt,
+		LastModifiedAt: j.LastModifiedAt,
+	}
+}
+
+// AddBulkJob records a new bulk job in the pending state and returns its ID.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) AddBulkJob(ctx context.Context, kind string, total int, createdBy string, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.BulkJobs).
+		Rows(goqu.Record{
+			"kind":       kind,
+			"status":     BulkJobStatusPending,
+			"total":      total,
+			"created_by": createdBy,
+		}).
+		Returning(t.BulkJobs.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrap(err, "unable to add the bulk job")
+	}
+
+	return id, nil
+}
+
+// UpdateBulkJob records the current status and progress of a bulk job. An
+// empty error message leaves the existing error message alone. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) UpdateBulkJob(ctx context.Context, job *BulkJob, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	rec := goqu.Record{
+		"status":           job.Status,
+		"processed":        job.Processed,
+		"failed":           job.Failed,
+		"last_modified_at": CurrentTimestamp,
+	}
+	if job.ErrorMessage.Valid {
+		rec["error_message"] = job.ErrorMessage.String
+	}
+
+	ds := db.Update(t.BulkJobs).
+		Set(rec).
+		Where(t.BulkJobs.Col("id").Eq(job.ID))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update bulk job %s", job.ID)
+	}
+
+	return nil
+}
+
+// GetBulkJob returns the bulk job with the given ID. Accepts a variable number
+// of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) GetBulkJob(ctx context.Context, id string, opts ...QueryOption) (*BulkJob, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.BulkJobs).
+		Select(
+			t.BulkJobs.Col("id"),
+			t.BulkJobs.Col("kind"),
+			t.BulkJobs.Col("status"),
+			t.BulkJobs.Col("total"),
+			t.BulkJobs.Col("processed"),
+			t.BulkJobs.Col("failed"),
+			t.BulkJobs.Col("error_message"),
+			t.BulkJobs.Col("created_by"),
+			t.BulkJobs.Col("created_at"),
+			t.BulkJobs.Col("last_modified_at"),
+		).
+		Where(t.BulkJobs.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	var job BulkJob
+	found, err := ds.Executor().ScanStructContext(ctx, &job)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up bulk job %s", id)
+	}
+	if !found {
+		return nil, suberrors.ErrBulkJobNotFound
+	}
+
+	return &job, nil
+}
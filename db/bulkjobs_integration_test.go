@@ -0,0 +1,54 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestBulkJobs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	kind := uniqueName("kind")
+	id, err := testDB.AddBulkJob(ctx, kind, 10, "test")
+	if err != nil {
+		t.Fatalf("unable to add the bulk job: %s", err)
+	}
+
+	job, err := testDB.GetBulkJob(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the bulk job: %s", err)
+	}
+	if job.Kind != kind || job.Status != BulkJobStatusPending || job.Total != 10 || job.Processed != 0 {
+		t.Errorf("the bulk job wasn't stored correctly: %+v", job)
+	}
+
+	updates := []BulkJob{
+		{ID: id, Status: BulkJobStatusRunning, Processed: 4, Failed: 1, ErrorMessage: sql.NullString{String: "failed", Valid: true}},
+		{ID: id, Status: BulkJobStatusCompleted, Processed: 10, Failed: 1},
+	}
+	for _, update := range updates {
+		if err = testDB.UpdateBulkJob(ctx, &update); err != nil {
+			t.Fatalf("unable to update the bulk job: %s", err)
+		}
+	}
+
+	// The error message from the first update is kept by the second one.
+	job, err = testDB.GetBulkJob(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the bulk job: %s", err)
+	}
+	if job.Status != BulkJobStatusCompleted || job.Processed != 10 || job.Failed != 1 || job.ErrorMessage.String != "failed" {
+		t.Errorf("the bulk job wasn't updated correctly: %+v", job)
+	}
+
+	if _, err = testDB.GetBulkJob(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, suberrors.ErrBulkJobNotFound) {
+		t.Errorf("expected ErrBulkJobNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// ActiveSubscriptionsForUsers returns the active subscriptions for all of the
+// users in the list of usernames. Accepts a variable number of QueryOptions,
+// though only WithTX, WithReadReplica, WithIncludeExpired and WithEffectiveDate
+// are currently supported.
+func (d *Database) ActiveSubscriptionsForUsers(ctx context.Context, usernames []string, opts ...QueryOption) ([]Subscription, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := subscriptionDS(db).
+		Where(
+			t.Users.Col("username").In(usernames),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var subscriptions []Subscription
+	if err := ds.Executor().ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrap(err, "unable to list the active subscriptions")
+	}
+
+	return subscriptions, nil
+}
+
+// EndSubscription sets the end date of a subscription to the current time,
+// which causes it to expire immediately. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) EndSubscription(ctx context.Context, subscriptionID, modifiedBy string, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Subscriptions).
+		Set(goqu.Record{
+			"effective_end_date": CurrentTimestamp,
+			"last_modified_by":   modifiedBy,
+			"last_modified_at":   CurrentTimestamp,
+		}).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID), querySettings.tenantExp(t.Subscriptions))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to end subscription %s", subscriptionID)
+	}
+
+	return nil
+}
+
+// RemoveSubscriptionAddons removes all of the add-ons from a subscription,
+// subtracting the amount each add-on contributed from the subscription's
+// quotas. Returns the number of add-ons that were removed. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) RemoveSubscriptionAddons(ctx context.Context, subscriptionID string, opts ...QueryOption) (int, error) {
+	subAddons, err := d.ListSubscriptionAddons(ctx, subscriptionID, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, subAddon := range subAddons {
+		quotaValue, _, err := d.GetCurrentQuota(ctx, subAddon.Addon.ResourceType.ID, subscriptionID, opts...)
+		if err != nil {
+			return 0, err
+		}
+
+		err = d.UpsertQuota(ctx, quotaValue-subAddon.Amount, subAddon.Addon.ResourceType.ID, subscriptionID, opts...)
+		if err != nil {
+			return 0, err
+		}
+
+		if err = d.DeleteSubscriptionAddon(ctx, subAddon.ID, opts...); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(subAddons), nil
+}
@@ -0,0 +1,87 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestActiveSubscriptionsForUsers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	active := subscribeTestUser(t, addTestUser(t), plan, nil)
+	ended := subscribeTestUser(t, addTestUser(t), plan, nil)
+	unlisted := subscribeTestUser(t, addTestUser(t), plan, nil)
+
+	if err := testDB.EndSubscription(ctx, ended.ID, "test"); err != nil {
+		t.Fatalf("unable to end the subscription: %s", err)
+	}
+
+	// The end date is the current time, so it's only in the past once the
+	// clock has moved on.
+	time.Sleep(10 * time.Millisecond)
+
+	usernames := []string{active.User.Username, ended.User.Username}
+	subscriptions, err := testDB.ActiveSubscriptionsForUsers(ctx, usernames)
+	if err != nil {
+		t.Fatalf("unable to list the active subscriptions: %s", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].ID != active.ID {
+		t.Errorf("expected only subscription %s, got %+v", active.ID, subscriptions)
+	}
+
+	subscriptions, err = testDB.ActiveSubscriptionsForUsers(ctx, usernames, WithIncludeExpired())
+	if err != nil {
+		t.Fatalf("unable to list the subscriptions: %s", err)
+	}
+	if len(subscriptions) != 2 {
+		t.Errorf("expected the ended subscription to be included, got %+v", subscriptions)
+	}
+	for _, subscription := range subscriptions {
+		if subscription.ID == unlisted.ID {
+			t.Errorf("expected the subscription for %s not to be included", unlisted.User.Username)
+		}
+	}
+}
+
+func TestRemoveSubscriptionAddons(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+	if err := testDB.UpsertQuota(ctx, 20, storage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to set the quota: %s", err)
+	}
+	addon := addTestAddon(t, storage, 5)
+	attachTestAddon(t, subscription, addon, 1)
+	attachTestAddon(t, subscription, addon, 2)
+
+	removed, err := testDB.RemoveSubscriptionAddons(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to remove the add-ons: %s", err)
+	}
+	if removed != 2 {
+		t.Errorf("expected 2 add-ons to be removed, got %d", removed)
+	}
+
+	quota, _, err := testDB.GetCurrentQuota(ctx, storage.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the quota: %s", err)
+	}
+	if quota != 5 {
+		t.Errorf("expected the add-on amounts to be subtracted from the quota, got %f", quota)
+	}
+
+	subAddons, err := testDB.ListSubscriptionAddons(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the subscription add-ons: %s", err)
+	}
+	if len(subAddons) != 0 {
+		t.Errorf("expected no add-ons to be left, got %+v", subAddons)
+	}
+}
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// The kinds of entries in the credit ledger.
+const (
+	CreditDeposit = "deposit"
+	CreditDraw    = "draw"
+)
+
+// CreditBalance is the amount of credit that a user has left for a resource
+// type.
+type CreditBalance struct {
+	ResourceType   ResourceType `db:"resource_types"`
+	Balance        float64      `db:"balance"`
+	LastModifiedAt time.Time    `db:"last_modified_at"`
+}
+
+// ToAPIType converts the credit balance to the type used in responses.
+func (b *CreditBalance) ToAPIType() *api.CreditBalance {
+	return &api.CreditBalance{
+		ResourceType: api.ResourceType{
+			ID:   b.ResourceType.ID,
+			Name: b.ResourceType.Name,
+			Unit: b.ResourceType.Unit,
+		},
+		Balance:        b.Balance,
+		LastModifiedAt: b.LastModifiedAt,
+	}
+}
+
+// CreditEntry is a single deposit or draw in the credit ledger.
+type CreditEntry struct {
+	ID           string         `db:"id" goqu:"defaultifempty"`
+	Username     string         `db:"username"`
+	ResourceType ResourceType   `db:"resource_types"`
+	Kind         string         `db:"kind"`
+	Amount       float64        `db:"amount"`
+	UpdateID     sql.NullString `db:"update_id"`
+	Description  sql.NullString `db:"description"`
+	CreatedBy    string         `db:"created_by"`
+	CreatedAt    time.Time      `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the credit ledger entry to the type used in responses.
+func (e *CreditEntry) ToAPIType() *api.CreditEntry {
+	return &api.CreditEntry{
+		ID:       e.ID,
+		Username: e.Username,
+		ResourceType: api.ResourceType{
+			ID:   e.ResourceType.ID,
+			Name: e.ResourceType.Name,
+			Unit: e.ResourceType.Unit,
+		},
+		Kind:        e.Kind,
+		Amount:      e.Amount,
+		UpdateID:    e.UpdateID.String,
+		Description: e.Description.String,
+		CreatedBy:   e.CreatedBy,
+		CreatedAt:   e.CreatedAt,
+	}
+}
+
+// creditBalanceDS returns the dataset used to look up credit balances.
+func creditBalanceDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.CreditBalances).
+		Join(t.Users, goqu.On(t.CreditBalances.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(t.CreditBalances.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.CreditBalances.Col("balance"),
+			t.CreditBalances.Col("last_modified_at"),
+		)
+}
+
+// creditEntryDS returns the dataset used to look up credit ledger entries.
+func creditEntryDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.CreditLedger).
+		Join(t.Users, goqu.On(t.CreditLedger.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(t.CreditLedger.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.CreditLedger.Col("id"),
+			t.Users.Col("username"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.CreditLedger.Col("kind"),
+			t.CreditLedger.Col("amount"),
+			t.CreditLedger.Col("update_id"),
+			t.CreditLedger.Col("description"),
+			t.CreditLedger.Col("created_by"),
+			t.CreditLedger.Col("created_at"),
+		)
+}
+
+// addCreditEntry adds an entry to the credit ledger and returns its ID.
+func (d *Database) addCreditEntry(ctx context.Context, db GoquDatabase, userID string, entry *CreditEntry) (string, error) {
+	ds := db.Insert(t.CreditLedger).
+		Rows(goqu.Record{
+			"user_id":          userID,
+			"resource_type_id": entry.ResourceType.ID,
+			"kind":             entry.Kind,
+			"amount":           entry.Amount,
+			"update_id":        entry.UpdateID,
+			"description":      entry.Description,
+			"created_by":       entry.CreatedBy,
+		}).
+		Returning(t.CreditLedger.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrap(err, "unable to add the credit ledger entry")
+	}
+
+	return id, nil
+}
+
+// DepositCredits adds credits for a resource type to a user's balance, records
+// the deposit in the ledger and returns the ID of the ledger entry along with
+// the new balance. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) DepositCredits(ctx context.Context, userID string, entry *CreditEntry, opts ...QueryOption) (string, float64, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.CreditBalances).
+		Rows(goqu.Record{
+			"user_id":          userID,
+			"resource_type_id": entry.ResourceType.ID,
+			"balance":          entry.Amount,
+		}).
+		OnConflict(goqu.DoUpdate("user_id, resource_type_id", goqu.Record{
+			"balance":          goqu.L("? + ?", t.CreditBalances.Col("balance"), goqu.I("excluded.balance")),
+			"last_modified_at": CurrentTimestamp,
+		})).
+		Returning(t.CreditBalances.Col("balance"))
+	d.LogSQL(ds)
+
+	var balance float64
+	if _, err := ds.Executor().ScanValContext(ctx, &balance); err != nil {
+		return "", 0, errors.Wrapf(err, "unable to deposit credits for user %s", userID)
+	}
+
+	entry.Kind = CreditDeposit
+	id, err := d.addCreditEntry(ctx, db, userID, entry)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return id, balance, nil
+}
+
+// WithUpdateID allows callers to record the usage update that credits are drawn
+// for in the credit ledger.
+func WithUpdateID(updateID string) QueryOption {
+	return func(s *QuerySettings) {
+		s.updateID = updateID
+	}
+}
+
+// DrawCredits draws up to the given amount from a user's credits for a resource
+// type on behalf of a usage update and returns the amount that was drawn, which
+// is zero if the user doesn't have any credits left. The balance is locked for
+// the rest of the transaction. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) DrawCredits(
+	ctx context.Context, userID, resourceTypeID string, amount float64, updateID string, opts ...QueryOption,
+) (float64, error) {
+	if amount <= 0 {
+		return 0, nil
+	}
+
+	_, db := d.querySettings(opts...)
+
+	where := goqu.And(
+		t.CreditBalances.Col("user_id").Eq(userID),
+		t.CreditBalances.Col("resource_type_id").Eq(resourceTypeID),
+	)
+
+	ds := db.From(t.CreditBalances).
+		Select(t.CreditBalances.Col("balance")).
+		Where(where).
+		ForUpdate(exp.Wait)
+	d.LogSQL(ds)
+
+	var balance float64
+	found, err := ds.Executor().ScanValContext(ctx, &balance)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to look up the credit balance for user %s", userID)
+	}
+	if !found || balance <= 0 {
+		return 0, nil
+	}
+
+	drawn := min(balance, amount)
+	updateDS := db.Update(t.CreditBalances).
+		Set(goqu.Record{
+			"balance":          balance - drawn,
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(where)
+	d.LogSQL(updateDS)
+
+	if _, err = updateDS.Executor().ExecContext(ctx); err != nil {
+		return 0, errors.Wrapf(err, "unable to draw credits for user %s", userID)
+	}
+
+	entry := &CreditEntry{
+		ResourceType: ResourceType{ID: resourceTypeID},
+		Kind:         CreditDraw,
+		Amount:       drawn,
+		UpdateID:     sql.NullString{String: updateID, Valid: updateID != ""},
+		CreatedBy:    "de",
+	}
+	if _, err = d.addCreditEntry(ctx, db, userID, entry); err != nil {
+		return 0, err
+	}
+
+	return drawn, nil
+}
+
+// CreditBalances returns a user's credit balances, optionally limited to a
+// single resource type, in order of resource type name. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) CreditBalances(ctx context.Context, username, resourceName string, opts ...QueryOption) ([]CreditBalance, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := creditBalanceDS(db).
+		Where(
+			t.Users.Col("username").Eq(username),
+			querySettings.tenantExp(t.Users),
+		).
+		Order(t.RT.Col("name").Asc())
+	if resourceName != "" {
+		ds = ds.Where(t.RT.Col("name").Eq(resourceName))
+	}
+	d.LogSQL(ds)
+
+	var balances []CreditBalance
+	if err := ds.Executor().ScanStructsContext(ctx, &balances); err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the credit balances for %s", username)
+	}
+
+	return balances, nil
+}
+
+// GetCreditEntry returns the credit ledger entry with the given ID, or nil if
+// it doesn't exist. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) GetCreditEntry(ctx context.Context, id string, opts ...QueryOption) (*CreditEntry, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := creditEntryDS(db).Where(t.CreditLedger.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	var entry CreditEntry
+	found, err := ds.Executor().ScanStructContext(ctx, &entry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up credit ledger entry %s", id)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+// ListCreditEntries returns the entries in a user's credit ledger, optionally
+// limited to a single resource type, most recent first. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) ListCreditEntries(ctx context.Context, username, resourceName string, opts ...QueryOption) ([]CreditEntry, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := creditEntryDS(db).
+		Where(
+			t.Users.Col("username").Eq(username),
+			querySettings.tenantExp(t.Users),
+		).
+		Order(t.CreditLedger.Col("created_at").Desc())
+	if resourceName != "" {
+		ds = ds.Where(t.RT.Col("name").Eq(resourceName))
+	}
+	d.LogSQL(ds)
+
+	var entries []CreditEntry
+	if err := ds.Executor().ScanStructsContext(ctx, &entries); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the credit ledger entries for %s", username)
+	}
+
+	return entries, nil
+}
+
+// mergeCredits adds the credit balances of the source user to those of the
+// target user and moves the source user's ledger entries to the target user.
+func (d *Database) mergeCredits(ctx context.Context, db GoquDatabase, sourceID, targetID string) error {
+	ds := db.Insert(t.CreditBalances).
+		Cols("user_id", "resource_type_id", "balance").
+		FromQuery(
+			db.From(t.CreditBalances).
+				Select(goqu.V(targetID), t.CreditBalances.Col("resource_type_id"), t.CreditBalances.Col("balance")).
+				Where(t.CreditBalances.Col("user_id").Eq(sourceID)),
+		).
+		OnConflict(goqu.DoUpdate("user_id, resource_type_id", goqu.Record{
+			"balance":          goqu.L("? + ?", t.CreditBalances.Col("balance"), goqu.I("excluded.balance")),
+			"last_modified_at": CurrentTimestamp,
+		}))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to merge the credit balances")
+	}
+
+	if _, err := d.deleteRows(ctx, db, t.CreditBalances, t.CreditBalances.Col("user_id").Eq(sourceID)); err != nil {
+		return err
+	}
+
+	if _, err := d.reassignUserID(ctx, db, t.CreditLedger, sourceID, targetID); err != nil {
+		return err
+	}
+
+	return nil
+}
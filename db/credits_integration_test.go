@@ -0,0 +1,254 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// depositTestCredits deposits credits for the resource type to the user's
+// balance.
+func depositTestCredits(t *testing.T, user *User, resourceType ResourceType, amount float64) {
+	t.Helper()
+
+	_, _, err := testDB.DepositCredits(context.Background(), user.ID, &CreditEntry{
+		ResourceType: resourceType,
+		Amount:       amount,
+		CreatedBy:    "test",
+	})
+	if err != nil {
+		t.Fatalf("unable to deposit credits: %s", err)
+	}
+}
+
+// creditBalance returns the user's credit balance for the resource type.
+func creditBalance(t *testing.T, user *User, resourceType ResourceType) float64 {
+	t.Helper()
+
+	balances, err := testDB.CreditBalances(context.Background(), user.Username, resourceType.Name)
+	if err != nil {
+		t.Fatalf("unable to look up the credit balance: %s", err)
+	}
+	if len(balances) != 1 {
+		t.Fatalf("expected 1 credit balance, got %d", len(balances))
+	}
+	return balances[0].Balance
+}
+
+// creditDraws returns the draws in the user's credit ledger for the resource
+// type.
+func creditDraws(t *testing.T, user *User, resourceType ResourceType) []CreditEntry {
+	t.Helper()
+
+	entries, err := testDB.ListCreditEntries(context.Background(), user.Username, resourceType.Name)
+	if err != nil {
+		t.Fatalf("unable to list the credit ledger: %s", err)
+	}
+
+	var draws []CreditEntry
+	for _, entry := range entries {
+		if entry.Kind == CreditDraw {
+			draws = append(draws, entry)
+		}
+	}
+	return draws
+}
+
+func TestDepositCredits(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+
+	var lastID string
+	for _, deposit := range []struct {
+		amount   float64
+		expected float64
+	}{
+		{amount: 10, expected: 10},
+		{amount: 5, expected: 15},
+	} {
+		id, balance, err := testDB.DepositCredits(ctx, user.ID, &CreditEntry{
+			ResourceType: compute,
+			Amount:       deposit.amount,
+			CreatedBy:    "test",
+		})
+		if err != nil {
+			t.Fatalf("unable to deposit credits: %s", err)
+		}
+		if balance != deposit.expected {
+			t.Errorf("expected a balance of %g, got %g", deposit.expected, balance)
+		}
+		lastID = id
+	}
+
+	if balance := creditBalance(t, user, compute); balance != 15 {
+		t.Errorf("expected a balance of 15, got %g", balance)
+	}
+
+	entry, err := testDB.GetCreditEntry(ctx, lastID)
+	if err != nil {
+		t.Fatalf("unable to look up the ledger entry: %s", err)
+	}
+	if entry == nil {
+		t.Fatal("the ledger entry wasn't found")
+	}
+	if entry.Kind != CreditDeposit || entry.Amount != 5 || entry.Username != user.Username {
+		t.Errorf("expected a deposit of 5 for %s, got %+v", user.Username, entry)
+	}
+
+	entries, err := testDB.ListCreditEntries(ctx, user.Username, compute.Name)
+	if err != nil {
+		t.Fatalf("unable to list the credit ledger: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected 2 ledger entries, got %d", len(entries))
+	}
+}
+
+func TestDrawCredits(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+
+	// Users without credits don't have anything drawn.
+	drawn, err := testDB.DrawCredits(ctx, user.ID, compute.ID, 5, "")
+	if err != nil {
+		t.Fatalf("unable to draw credits: %s", err)
+	}
+	if drawn != 0 {
+		t.Errorf("expected nothing to be drawn, got %g", drawn)
+	}
+
+	depositTestCredits(t, user, compute, 8)
+
+	for _, draw := range []struct {
+		amount   float64
+		expected float64
+	}{
+		{amount: 5, expected: 5},
+		{amount: 5, expected: 3},
+		{amount: 5, expected: 0},
+	} {
+		drawn, err = testDB.DrawCredits(ctx, user.ID, compute.ID, draw.amount, "")
+		if err != nil {
+			t.Fatalf("unable to draw credits: %s", err)
+		}
+		if drawn != draw.expected {
+			t.Errorf("expected %g to be drawn, got %g", draw.expected, drawn)
+		}
+	}
+
+	if balance := creditBalance(t, user, compute); balance != 0 {
+		t.Errorf("expected the credits to be used up, got %g", balance)
+	}
+	if draws := creditDraws(t, user, compute); len(draws) != 2 {
+		t.Errorf("expected 2 draws in the ledger, got %d", len(draws))
+	}
+}
+
+func TestMergeUserRecordsCredits(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	source, target := addTestUser(t), addTestUser(t)
+	depositTestCredits(t, source, compute, 4)
+	depositTestCredits(t, target, compute, 3)
+
+	merge := &UserMerge{
+		SourceUserID:   source.ID,
+		SourceUsername: source.Username,
+		TargetUserID:   target.ID,
+		TargetUsername: target.Username,
+		Policy:         api.MergePolicyKeepTarget,
+		MergedBy:       "test",
+	}
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		return testDB.MergeUserRecords(ctx, merge, WithTX(tx))
+	})
+	if err != nil {
+		t.Fatalf("unable to merge the users: %s", err)
+	}
+
+	// The balances are added together and the ledger entries move with them.
+	if balance := creditBalance(t, target, compute); balance != 7 {
+		t.Errorf("expected a balance of 7, got %g", balance)
+	}
+	if count := countRows(t, "credit_balances", goqu.Ex{"user_id": source.ID}); count != 0 {
+		t.Errorf("expected the source user's balances to be removed, got %d", count)
+	}
+	if count := countRows(t, "credit_ledger", goqu.Ex{"user_id": target.ID}); count != 2 {
+		t.Errorf("expected the target user to have 2 ledger entries, got %d", count)
+	}
+}
+
+func TestProcessUpdateForUsageDrawsCreditsOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	subscription := subscribeTestUser(t, user, addTestPlan(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10}), nil)
+	depositTestCredits(t, user, compute, 3)
+
+	update := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 5)
+	if _, err := testDB.AddUserUpdate(ctx, update); err != nil {
+		t.Fatalf("unable to add the update: %s", err)
+	}
+	if err := testDB.ProcessUpdateForUsage(ctx, update); err != nil {
+		t.Fatalf("unable to process the update: %s", err)
+	}
+
+	if balance := creditBalance(t, user, compute); balance != 0 {
+		t.Errorf("expected the credits to be used up, got %g", balance)
+	}
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != 2 {
+		t.Errorf("expected a usage of 2, got %g", usage)
+	}
+
+	draws := creditDraws(t, user, compute)
+	if len(draws) != 1 {
+		t.Fatalf("expected 1 draw in the ledger, got %d", len(draws))
+	}
+	if draws[0].Amount != 3 || draws[0].UpdateID.String != update.ID {
+		t.Errorf("expected a draw of 3 for update %s, got %+v", update.ID, draws[0])
+	}
+}
+
+func TestApplyUsageConcurrentCreditDraws(t *testing.T) {
+	t.Parallel()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	subscription := subscribeTestUser(t, user, addTestPlan(t), nil)
+
+	const credits = 10
+	depositTestCredits(t, user, compute, credits)
+
+	// Each update draws from the balance in its own transaction, so the credits
+	// can't be drawn more than once.
+	applyConcurrently(t, func(ctx context.Context) error {
+		return testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+			_, _, err := testDB.ApplyUsage(ctx, UpdateTypeAdd, 1, compute.ID, subscription.ID, WithTX(tx))
+			return err
+		})
+	})
+
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != concurrentUpdates-credits {
+		t.Errorf("expected a usage of %d, got %g", concurrentUpdates-credits, usage)
+	}
+	if balance := creditBalance(t, user, compute); balance != 0 {
+		t.Errorf("expected the credits to be used up, got %g", balance)
+	}
+	if draws := creditDraws(t, user, compute); len(draws) != credits {
+		t.Errorf("expected %d draws in the ledger, got %d", credits, len(draws))
+	}
+}
@@ -1,9 +1,13 @@
 package db
 
 import (
+	"time"
+
 	"github.com/cyverse-de/go-mod/logging"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -11,14 +15,21 @@ import (
 var log = logging.Log.WithFields(logrus.Fields{"package": "db"})
 
 type Database struct {
-	db     *sqlx.DB
-	fullDB *goqu.Database
-	goquDB GoquDatabase
-	logSQL bool
+	db        *sqlx.DB
+	fullDB    *goqu.Database
+	goquDB    GoquDatabase
+	replicaDB GoquDatabase
+	logSQL    bool
+	defaults  []QueryOption
 }
 
+// dialect is the name of the goqu dialect used for every connection.
+const dialect = "postgresql"
+
+// New returns a *Database that uses the connection for every query. Each
+// statement gets its own span.
 func New(dbconn *sqlx.DB) *Database {
-	goquDB := goqu.New("postgresql", dbconn)
+	goquDB := goqu.New(dialect, &tracedDB{db: dbconn})
 	return &Database{
 		db:     dbconn, // Used when a method needs direct access to sqlx for struct scanning.
 		fullDB: goquDB, // Used when a method needs to use a method not defined in the GoquDatabase interface.
@@ -27,6 +38,21 @@ func New(dbconn *sqlx.DB) *Database {
 	}
 }
 
+// NewWithReadReplica returns a *Database that sends queries to the primary
+// database by default, but sends queries that use the WithReadReplica option
+// to the read replica. If the replica connection is nil, all queries go to the
+// primary database.
+func NewWithReadReplica(dbconn, replicaConn *sqlx.DB) *Database {
+	d := New(dbconn)
+	if replicaConn != nil {
+		d.replicaDB = goqu.New(dialect, &tracedDB{
+			db:    replicaConn,
+			attrs: []attribute.KeyValue{dbReplicaKey.Bool(true)},
+		})
+	}
+	return d
+}
+
 // EnableSQLLogging enables SQL logging for the database instance.
 func (d *Database) EnableSQLLogging() {
 	d.logSQL = true
@@ -44,20 +70,38 @@ func (d *Database) LogSQL(statement SQLStatement) {
 	}
 }
 
+// Begin starts a transaction. Each statement in the transaction gets its own
+// span.
 func (d *Database) Begin() (*goqu.TxDatabase, error) {
-	return d.fullDB.Begin()
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return goqu.NewTx(dialect, &tracedTx{tx: tx}), nil
 }
 
-func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatabase) {
-	var db GoquDatabase
-
+// newQuerySettings applies the default options of the database followed by the
+// options passed to a method.
+func (d *Database) newQuerySettings(opts ...QueryOption) *QuerySettings {
 	querySettings := &QuerySettings{}
+	for _, opt := range d.defaults {
+		opt(querySettings)
+	}
 	for _, opt := range opts {
 		opt(querySettings)
 	}
+	return querySettings
+}
+
+func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatabase) {
+	var db GoquDatabase
+
+	querySettings := d.newQuerySettings(opts...)
 
 	if querySettings.tx != nil {
 		db = querySettings.tx
+	} else if querySettings.readReplica && d.replicaDB != nil {
+		db = d.replicaDB
 	} else {
 		db = d.goquDB
 	}
@@ -71,10 +115,7 @@ func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatab
 func (d *Database) querySettingsWithTX(opts ...QueryOption) (*QuerySettings, *goqu.TxDatabase, error) {
 	var db *goqu.TxDatabase
 
-	querySettings := &QuerySettings{}
-	for _, opt := range opts {
-		opt(querySettings)
-	}
+	querySettings := d.newQuerySettings(opts...)
 
 	if querySettings.tx != nil {
 		db = querySettings.tx
@@ -95,13 +136,40 @@ func (d *Database) querySettingsWithTX(opts ...QueryOption) (*QuerySettings, *go
 // QuerySettings provides configuration for queries, such as including a limit
 // statement, an offset statement, or running the query as part of a transaction.
 type QuerySettings struct {
-	hasLimit   bool
-	limit      uint
-	hasOffset  bool
-	offset     uint
-	tx         *goqu.TxDatabase
-	doRollback bool
-	doCommit   bool
+	hasLimit    bool
+	limit       uint
+	hasOffset   bool
+	offset      uint
+	tx          *goqu.TxDatabase
+	doRollback  bool
+	doCommit    bool
+	readReplica bool
+
+	includeExpired   bool
+	hasEffectiveDate bool
+	effectiveDate    time.Time
+	gracePeriod      time.Duration
+	groups           bool
+
+	outbox bool
+
+	includeDeleted bool
+
+	defaultPlan         string
+	defaultSubscription bool
+
+	hasExpectedVersion bool
+	expectedVersion    int64
+
+	forUpdate bool
+
+	tenant string
+
+	updateID string
+
+	tagKey      string
+	tagValue    string
+	hasTagValue bool
 }
 
 // QueryOption defines the signature for functions that can modify a QuerySettings
@@ -141,3 +209,125 @@ func WithTXRollbackCommit(tx *goqu.TxDatabase, doRollback, doCommit bool) QueryO
 		s.doCommit = doCommit
 	}
 }
+
+// WithReadReplica allows callers to send a read-only query to the read replica
+// if one is configured. The option is ignored for queries that are run as part
+// of a transaction, since those must always run against the primary database.
+func WithReadReplica() QueryOption {
+	return func(s *QuerySettings) {
+		s.readReplica = true
+	}
+}
+
+// WithIncludeExpired allows callers to look up subscriptions that have already
+// ended. Subscription lookups that support this option match any subscription
+// that started on or before the effective date instead of only the subscriptions
+// that are active on that date.
+func WithIncludeExpired() QueryOption {
+	return func(s *QuerySettings) {
+		s.includeExpired = true
+	}
+}
+
+// WithEffectiveDate allows callers to look up the subscriptions that were
+// active at a specific time rather than the ones that are active now.
+func WithEffectiveDate(effectiveDate time.Time) QueryOption {
+	return func(s *QuerySettings) {
+		s.hasEffectiveDate = true
+		s.effectiveDate = effectiveDate
+	}
+}
+
+// WithGracePeriod allows callers to treat subscriptions that ended less than
+// the given amount of time before the effective date as if they were still
+// active. The option has no effect if WithIncludeExpired is also used.
+func WithGracePeriod(gracePeriod time.Duration) QueryOption {
+	return func(s *QuerySettings) {
+		s.gracePeriod = gracePeriod
+	}
+}
+
+// WithGroupSubscriptions allows callers to fall back to the subscriptions of
+// the groups that a user belongs to when the user doesn't have a subscription
+// of their own. Group subscriptions require the groups table.
+func WithGroupSubscriptions() QueryOption {
+	return func(s *QuerySettings) {
+		s.groups = true
+	}
+}
+
+// WithOutbox allows callers to have functions that support it add domain
+// events to the outbox table as part of the transaction that makes the changes
+// that the events describe.
+func WithOutbox() QueryOption {
+	return func(s *QuerySettings) {
+		s.outbox = true
+	}
+}
+
+// WithIncludeDeleted allows callers to include add-ons and plans that have been
+// deleted in listings and name lookups. Lookups by ID always include them so
+// that historical subscriptions can still be resolved.
+func WithIncludeDeleted() QueryOption {
+	return func(s *QuerySettings) {
+		s.includeDeleted = true
+	}
+}
+
+// WithDefaultPlan allows callers to change the plan that users are subscribed
+// to when they don't have a subscription yet. The plan named by DefaultPlanName
+// is used if this option isn't.
+func WithDefaultPlan(planName string) QueryOption {
+	return func(s *QuerySettings) {
+		s.defaultPlan = planName
+	}
+}
+
+// WithDefaultSubscription allows callers to have functions that support it
+// subscribe users who don't have an active subscription to the default plan
+// instead of failing with ErrSubscriptionNotFound.
+func WithDefaultSubscription() QueryOption {
+	return func(s *QuerySettings) {
+		s.defaultSubscription = true
+	}
+}
+
+// defaultPlanName returns the name of the plan that users are subscribed to
+// when they don't have a subscription yet.
+func (s *QuerySettings) defaultPlanName() string {
+	if s.defaultPlan != "" {
+		return s.defaultPlan
+	}
+	return DefaultPlanName
+}
+
+// WithExpectedVersion allows callers to make an update conditional on the
+// version of the record being updated. Functions that support this option
+// return ErrVersionConflict if the record has been updated since the caller
+// last saw it.
+func WithExpectedVersion(version int64) QueryOption {
+	return func(s *QuerySettings) {
+		s.hasExpectedVersion = true
+		s.expectedVersion = version
+	}
+}
+
+// WithForUpdate allows callers to lock the subscription and quota rows that a
+// lookup returns until the end of the transaction, so that operations that
+// change the same subscription, such as renewals, plan changes and add-on
+// attachments, wait for each other instead of racing. The option only has an
+// effect when it's used along with WithTX.
+func WithForUpdate() QueryOption {
+	return func(s *QuerySettings) {
+		s.forUpdate = true
+	}
+}
+
+// lockRows adds a FOR UPDATE clause to a query that locks the rows of the given
+// tables if the WithForUpdate option was used.
+func (s *QuerySettings) lockRows(ds *goqu.SelectDataset, tables ...exp.IdentifierExpression) *goqu.SelectDataset {
+	if !s.forUpdate || s.tx == nil {
+		return ds
+	}
+	return ds.ForUpdate(exp.Wait, tables...)
+}
@@ -0,0 +1,37 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewWithReadReplica(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+
+	// The primary connection stands in for the replica, and queries go to the
+	// primary database when there's no replica.
+	tests := []struct {
+		name     string
+		database *Database
+	}{
+		{name: "replica", database: NewWithReadReplica(testDB.db, testDB.db)},
+		{name: "no replica", database: NewWithReadReplica(testDB.db, nil)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := tc.database.GetUserByUsername(ctx, user.Username, WithReadReplica())
+			if err != nil {
+				t.Fatalf("unable to look up %s: %s", user.Username, err)
+			}
+			if found == nil || found.ID != user.ID {
+				t.Errorf("expected user %s, got %+v", user.ID, found)
+			}
+		})
+	}
+}
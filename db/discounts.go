@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The types of discounts. Percent discounts take a percentage off the plan
+// rate, and fixed discounts subtract a fixed amount from it.
+const (
+	DiscountTypePercent = "percent"
+	DiscountTypeFixed   = "fixed"
+)
+
+// DiscountCode is a code that can be redeemed for a discount on the rate of a
+// new or renewed subscription.
+type DiscountCode struct {
+	ID              string         `db:"id" goqu:"defaultifempty"`
+	Code            string         `db:"code"`
+	Description     sql.NullString `db:"description"`
+	DiscountType    string         `db:"discount_type"`
+	Amount          float64        `db:"amount"`
+	ExpiresAt       sql.NullTime   `db:"expires_at"`
+	MaxRedemptions  sql.NullInt32  `db:"max_redemptions"`
+	RedemptionCount int32          `db:"redemption_count"`
+	CreatedBy       string         `db:"created_by"`
+	CreatedAt       time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt  time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// Validate checks that the discount is either a percentage between 0 and 100
+// or a positive fixed amount.
+func (c *DiscountCode) Validate() error {
+	switch c.DiscountType {
+	case DiscountTypePercent:
+		if c.Amount > 0 && c.Amount <= 100 {
+			return nil
+		}
+	case DiscountTypeFixed:
+		if c.Amount > 0 {
+			return nil
+		}
+	}
+	return suberrors.ErrInvalidDiscount
+}
+
+// Apply returns the rate after the discount. Rates are never discounted below
+// zero, and they're rounded to the nearest cent.
+func (c *DiscountCode) Apply(rate float64) float64 {
+	var discounted float64
+	switch c.DiscountType {
+	case DiscountTypePercent:
+		discounted = rate * (1 - c.Amount/100)
+	case DiscountTypeFixed:
+		discounted = rate - c.Amount
+	default:
+		discounted = rate
+	}
+	return math.Round(math.Max(discounted, 0)*100) / 100
+}
+
+// ToAPIType converts the discount code to the type used in responses.
+func (c *DiscountCode) ToAPIType() *api.DiscountCode {
+	result := &api.DiscountCode{
+		ID:              c.ID,
+		Code:            c.Code,
+		Description:     c.Description.String,
+		DiscountType:    c.DiscountType,
+		Amount:          c.Amount,
+		RedemptionCount: c.RedemptionCount,
+		CreatedBy:       c.CreatedBy,
+		CreatedAt:       c.CreatedAt,
+		LastModifiedAt:  c.LastModifiedAt,
+	}
+	if c.ExpiresAt.Valid {
+		result.ExpiresAt = &c.ExpiresAt.Time
+	}
+	if c.MaxRedemptions.Valid {
+		result.MaxRedemptions = c.MaxRedemptions.Int32
+	}
+	return result
+}
+
+// DiscountRedemption records the discount applied to a subscription.
+type DiscountRedemption struct {
+	ID             string    `db:"id" goqu:"defaultifempty"`
+	Code           string    `db:"code"`
+	DiscountType   string    `db:"discount_type"`
+	Amount         float64   `db:"amount"`
+	SubscriptionID string    `db:"subscription_id"`
+	OriginalRate   float64   `db:"original_rate"`
+	DiscountedRate float64   `db:"discounted_rate"`
+	RedeemedBy     string    `db:"redeemed_by"`
+	RedeemedAt     time.Time `db:"redeemed_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the redemption to the type used in responses.
+func (r *DiscountRedemption) ToAPIType() *api.DiscountRedemption {
+	return &api.DiscountRedemption{
+		ID:             r.ID,
+		Code:           r.Code,
+		DiscountType:   r.DiscountType,
+		Amount:         r.Amount,
+		SubscriptionID: r.SubscriptionID,
+		OriginalRate:   r.OriginalRate,
+		DiscountedRate: r.DiscountedRate,
+		RedeemedBy:     r.RedeemedBy,
+		RedeemedAt:     r.RedeemedAt,
+	}
+}
+
+// discountCodeDS returns the dataset used to look up discount codes.
+func discountCodeDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.DiscountCodes).
+		Select(
+			t.DiscountCodes.Col("id"),
+			t.DiscountCodes.Col("code"),
+			t.DiscountCodes.Col("description"),
+			t.DiscountCodes.Col("discount_type"),
+			t.DiscountCodes.Col("amount"),
+			t.DiscountCodes.Col("expires_at"),
+			t.DiscountCodes.Col("max_redemptions"),
+			t.DiscountCodes.Col("redemption_count"),
+			t.DiscountCodes.Col("created_by"),
+			t.DiscountCodes.Col("created_at"),
+			t.DiscountCodes.Col("last_modified_at"),
+		)
+}
+
+// AddDiscountCode adds a discount code and returns its ID. ErrDiscountCodeExists
+// is returned if the code is already in use. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddDiscountCode(ctx context.Context, code *DiscountCode, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	rec := goqu.Record{
+		"code":          code.Code,
+		"discount_type": code.DiscountType,
+		"amount":        code.Amount,
+		"created_by":    code.CreatedBy,
+	}
+	if code.Description.Valid {
+		rec["description"] = code.Description.String
+	}
+	if code.ExpiresAt.Valid {
+		rec["expires_at"] = code.ExpiresAt.Time
+	}
+	if code.MaxRedemptions.Valid {
+		rec["max_redemptions"] = code.MaxRedemptions.Int32
+	}
+
+	ds := db.Insert(t.DiscountCodes).Rows(rec).Returning(t.DiscountCodes.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrDiscountCodeExists
+		}
+		return "", errors.Wrapf(err, "unable to add discount code %s", code.Code)
+	}
+
+	return id, nil
+}
+
+// GetDiscountCode returns the discount code, or nil if it doesn't exist.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) GetDiscountCode(ctx context.Context, code string, opts ...QueryOption) (*DiscountCode, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := discountCodeDS(db).Where(t.DiscountCodes.Col("code").Eq(code))
+	d.LogSQL(ds)
+
+	var result DiscountCode
+	found, err := ds.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up discount code %s", code)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &result, nil
+}
+
+// ListDiscountCodes returns all of the discount codes, ordered by code. Accepts
+// a variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ListDiscountCodes(ctx context.Context, opts ...QueryOption) ([]DiscountCode, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := discountCodeDS(db).Order(t.DiscountCodes.Col("code").Asc())
+	d.LogSQL(ds)
+
+	var codes []DiscountCode
+	if err := ds.Executor().ScanStructsContext(ctx, &codes); err != nil {
+		return nil, errors.Wrap(err, "unable to list the discount codes")
+	}
+
+	return codes, nil
+}
+
+// RedeemDiscountCode applies a discount code to a subscription with the given
+// rate and returns the redemption. The code's redemption count is incremented
+// in the same statement that checks that the code hasn't expired and hasn't
+// been redeemed the maximum number of times, so that concurrent redemptions
+// can't exceed the limit. Accepts a variable number of QueryOptions, though
+// only WithTX is currently supported. A transaction should be used so that the
+// redemption isn't counted if the subscription isn't created.
+func (d *Database) RedeemDiscountCode(
+	ctx context.Context, code, subscriptionID string, rate float64, redeemedBy string, opts ...QueryOption,
+) (*DiscountRedemption, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, subscriptionID); err != nil {
+		return nil, err
+	}
+
+	countDS := db.Update(t.DiscountCodes).
+		Set(goqu.Record{
+			"redemption_count": goqu.L("? + 1", t.DiscountCodes.Col("redemption_count")),
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(
+			t.DiscountCodes.Col("code").Eq(code),
+			goqu.Or(
+				t.DiscountCodes.Col("expires_at").IsNull(),
+				t.DiscountCodes.Col("expires_at").Gt(CurrentTimestamp),
+			),
+			goqu.Or(
+				t.DiscountCodes.Col("max_redemptions").IsNull(),
+				t.DiscountCodes.Col("redemption_count").Lt(t.DiscountCodes.Col("max_redemptions")),
+			),
+		).
+		Returning(
+			t.DiscountCodes.Col("id"),
+			t.DiscountCodes.Col("code"),
+			t.DiscountCodes.Col("discount_type"),
+			t.DiscountCodes.Col("amount"),
+		)
+	d.LogSQL(countDS)
+
+	var discount DiscountCode
+	found, err := countDS.Executor().ScanStructContext(ctx, &discount)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to redeem discount code %s", code)
+	}
+	if !found {
+		existing, err := d.GetDiscountCode(ctx, code, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, suberrors.ErrDiscountCodeNotFound
+		}
+		return nil, suberrors.ErrDiscountCodeUnavailable
+	}
+
+	redemption := &DiscountRedemption{
+		Code:           discount.Code,
+		DiscountType:   discount.DiscountType,
+		Amount:         discount.Amount,
+		SubscriptionID: subscriptionID,
+		OriginalRate:   rate,
+		DiscountedRate: discount.Apply(rate),
+		RedeemedBy:     redeemedBy,
+	}
+
+	insertDS := db.Insert(t.Redemptions).
+		Rows(goqu.Record{
+			"discount_code_id": discount.ID,
+			"subscription_id":  subscriptionID,
+			"original_rate":    redemption.OriginalRate,
+			"discounted_rate":  redemption.DiscountedRate,
+			"redeemed_by":      redeemedBy,
+		}).
+		Returning(t.Redemptions.Col("id"), t.Redemptions.Col("redeemed_at"))
+	d.LogSQL(insertDS)
+
+	if _, err = insertDS.Executor().ScanStructContext(ctx, redemption); err != nil {
+		return nil, errors.Wrapf(err, "unable to record the redemption of discount code %s", code)
+	}
+
+	return redemption, nil
+}
+
+// GetSubscriptionDiscount returns the discount applied to a subscription, or
+// nil if there isn't one. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetSubscriptionDiscount(ctx context.Context, subscriptionID string, opts ...QueryOption) (*DiscountRedemption, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Redemptions).
+		Join(t.DiscountCodes, goqu.On(t.Redemptions.Col("discount_code_id").Eq(t.DiscountCodes.Col("id")))).
+		Select(
+			t.Redemptions.Col("id"),
+			t.DiscountCodes.Col("code"),
+			t.DiscountCodes.Col("discount_type"),
+			t.DiscountCodes.Col("amount"),
+			t.Redemptions.Col("subscription_id"),
+			t.Redemptions.Col("original_rate"),
+			t.Redemptions.Col("discounted_rate"),
+			t.Redemptions.Col("redeemed_by"),
+			t.Redemptions.Col("redeemed_at"),
+		).
+		Where(
+			t.Redemptions.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.Redemptions.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	var redemption DiscountRedemption
+	found, err := ds.Executor().ScanStructContext(ctx, &redemption)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the discount for subscription %s", subscriptionID)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &redemption, nil
+}
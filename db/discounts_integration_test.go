@@ -0,0 +1,181 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestDiscountCode adds a discount code with a unique code.
+func addTestDiscountCode(t *testing.T, code DiscountCode) *DiscountCode {
+	t.Helper()
+
+	code.Code = uniqueName("code")
+	code.CreatedBy = "test"
+	id, err := testDB.AddDiscountCode(context.Background(), &code)
+	if err != nil {
+		t.Fatalf("unable to add a discount code: %s", err)
+	}
+	code.ID = id
+	return &code
+}
+
+func TestAddDiscountCode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	code := addTestDiscountCode(t, DiscountCode{
+		Description:    sql.NullString{String: "Ten percent off", Valid: true},
+		DiscountType:   DiscountTypePercent,
+		Amount:         10,
+		MaxRedemptions: sql.NullInt32{Int32: 5, Valid: true},
+	})
+
+	if _, err := testDB.AddDiscountCode(ctx, code); !errors.Is(err, suberrors.ErrDiscountCodeExists) {
+		t.Errorf("expected ErrDiscountCodeExists for a duplicate code, got %v", err)
+	}
+
+	loaded, err := testDB.GetDiscountCode(ctx, code.Code)
+	if err != nil {
+		t.Fatalf("unable to look up the discount code: %s", err)
+	}
+	if loaded == nil {
+		t.Fatal("the discount code wasn't found")
+	}
+	if loaded.ID != code.ID || loaded.Description != code.Description || loaded.MaxRedemptions != code.MaxRedemptions ||
+		loaded.ExpiresAt.Valid || loaded.RedemptionCount != 0 {
+		t.Errorf("the discount code wasn't stored correctly: %+v", loaded)
+	}
+
+	codes, err := testDB.ListDiscountCodes(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the discount codes: %s", err)
+	}
+	var found bool
+	for _, listed := range codes {
+		found = found || listed.ID == code.ID
+	}
+	if !found {
+		t.Errorf("expected %s to be listed", code.Code)
+	}
+
+	missing, err := testDB.GetDiscountCode(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up a missing discount code: %s", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no discount code, got %s", missing.ID)
+	}
+}
+
+func TestRedeemDiscountCode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	code := addTestDiscountCode(t, DiscountCode{
+		DiscountType:   DiscountTypeFixed,
+		Amount:         30,
+		MaxRedemptions: sql.NullInt32{Int32: 1, Valid: true},
+	})
+	expired := addTestDiscountCode(t, DiscountCode{
+		DiscountType: DiscountTypePercent,
+		Amount:       50,
+		ExpiresAt:    sql.NullTime{Time: time.Now().Add(-time.Hour), Valid: true},
+	})
+
+	subscription := addTestSubscription(t)
+	redemption, err := testDB.RedeemDiscountCode(ctx, code.Code, subscription.ID, 100, "test")
+	if err != nil {
+		t.Fatalf("unable to redeem the discount code: %s", err)
+	}
+	if redemption.OriginalRate != 100 || redemption.DiscountedRate != 70 || redemption.ID == "" {
+		t.Errorf("the redemption wasn't recorded correctly: %+v", redemption)
+	}
+
+	discount, err := testDB.GetSubscriptionDiscount(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription's discount: %s", err)
+	}
+	if discount == nil || discount.ID != redemption.ID || discount.Code != code.Code || discount.DiscountedRate != 70 {
+		t.Errorf("expected redemption %+v, got %+v", redemption, discount)
+	}
+
+	other := addTestSubscription(t)
+	tests := []struct {
+		name     string
+		code     string
+		expected error
+	}{
+		{name: "fully redeemed", code: code.Code, expected: suberrors.ErrDiscountCodeUnavailable},
+		{name: "expired", code: expired.Code, expected: suberrors.ErrDiscountCodeUnavailable},
+		{name: "missing", code: uniqueName("missing"), expected: suberrors.ErrDiscountCodeNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := testDB.RedeemDiscountCode(ctx, tc.code, other.ID, 100, "test"); !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+
+	none, err := testDB.GetSubscriptionDiscount(ctx, other.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription's discount: %s", err)
+	}
+	if none != nil {
+		t.Errorf("expected no discount, got %+v", none)
+	}
+}
+
+func TestRedeemDiscountCodeConcurrently(t *testing.T) {
+	t.Parallel()
+
+	const maxRedemptions = 3
+	code := addTestDiscountCode(t, DiscountCode{
+		DiscountType:   DiscountTypePercent,
+		Amount:         10,
+		MaxRedemptions: sql.NullInt32{Int32: maxRedemptions, Valid: true},
+	})
+
+	subscriptions := make([]*Subscription, 10)
+	for i := range subscriptions {
+		subscriptions[i] = addTestSubscription(t)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		redeemed int
+		start    = make(chan struct{})
+	)
+	for _, subscription := range subscriptions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, err := testDB.RedeemDiscountCode(context.Background(), code.Code, subscription.ID, 100, "test")
+			switch {
+			case err == nil:
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			case !errors.Is(err, suberrors.ErrDiscountCodeUnavailable):
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if redeemed != maxRedemptions {
+		t.Errorf("expected %d redemptions, got %d", maxRedemptions, redeemed)
+	}
+}
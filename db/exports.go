@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// DefaultExportBatchSize is the number of subscriptions fetched at a time when
+// subscriptions are exported.
+const DefaultExportBatchSize = 1000
+
+// SubscriptionExportRow contains a subscription along with one of its quotas
+// and the usage of the same resource type. The resource type, quota and usage
+// are missing for subscriptions without quotas, and the usage is missing if
+// nothing has been recorded for the resource type.
+type SubscriptionExportRow struct {
+	SubscriptionID     string          `db:"subscription_id"`
+	Username           string          `db:"username"`
+	PlanName           string          `db:"plan_name"`
+	EffectiveStartDate time.Time       `db:"effective_start_date"`
+	EffectiveEndDate   sql.NullTime    `db:"effective_end_date"`
+	Paid               bool            `db:"paid"`
+	CreatedAt          time.Time       `db:"created_at"`
+	ResourceName       sql.NullString  `db:"resource_name"`
+	ResourceUnit       sql.NullString  `db:"resource_unit"`
+	Quota              sql.NullFloat64 `db:"quota"`
+	Usage              sql.NullFloat64 `db:"usage"`
+}
+
+// ExportSubscriptions passes every subscription to fn along with its quotas
+// and usages, a batch at a time, in order by subscription ID. Each batch
+// contains the rows for at most batchSize subscriptions, and the rows for a
+// subscription are never split between batches. The batches are fetched with
+// separate queries that pick up after the last subscription in the previous
+// batch, so only one batch is held in memory at a time and no long-running
+// transaction is needed. Iteration stops at the first error returned by fn.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ExportSubscriptions(
+	ctx context.Context, batchSize int, fn func([]SubscriptionExportRow) error, opts ...QueryOption,
+) error {
+	querySettings, db := d.querySettings(opts...)
+
+	if batchSize <= 0 {
+		batchSize = DefaultExportBatchSize
+	}
+
+	var cursor string
+	for {
+		page := db.From(t.Subscriptions).
+			Select(
+				t.Subscriptions.Col("id"),
+				t.Subscriptions.Col("user_id"),
+				t.Subscriptions.Col("plan_id"),
+				t.Subscriptions.Col("effective_start_date"),
+				t.Subscriptions.Col("effective_end_date"),
+				t.Subscriptions.Col("paid"),
+				t.Subscriptions.Col("created_at"),
+			).
+			Where(querySettings.tenantExp(t.Subscriptions)).
+			Order(t.Subscriptions.Col("id").Asc()).
+			Limit(uint(batchSize))
+		if cursor != "" {
+			page = page.Where(t.Subscriptions.Col("id").Gt(cursor))
+		}
+
+		pageT := goqu.T("page")
+		ds := db.From(page.As("page")).
+			Join(t.Users, goqu.On(pageT.Col("user_id").Eq(t.Users.Col("id")))).
+			Join(t.Plans, goqu.On(pageT.Col("plan_id").Eq(t.Plans.Col("id")))).
+			LeftJoin(t.Quotas, goqu.On(pageT.Col("id").Eq(t.Quotas.Col("subscription_id")))).
+			LeftJoin(t.ResourceTypes, goqu.On(t.Quotas.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+			LeftJoin(t.Usages, goqu.On(goqu.And(
+				pageT.Col("id").Eq(t.Usages.Col("subscription_id")),
+				t.Quotas.Col("resource_type_id").Eq(t.Usages.Col("resource_type_id")),
+			))).
+			Select(
+				pageT.Col("id").As("subscription_id"),
+				t.Users.Col("username").As("username"),
+				t.Plans.Col("name").As("plan_name"),
+				pageT.Col("effective_start_date"),
+				pageT.Col("effective_end_date"),
+				pageT.Col("paid"),
+				pageT.Col("created_at"),
+				t.ResourceTypes.Col("name").As("resource_name"),
+				t.ResourceTypes.Col("unit").As("resource_unit"),
+				t.Quotas.Col("quota").As("quota"),
+				t.Usages.Col("usage").As("usage"),
+			).
+			Order(pageT.Col("id").Asc(), t.ResourceTypes.Col("name").Asc())
+		d.LogSQL(ds)
+
+		var rows []SubscriptionExportRow
+		if err := ds.Executor().ScanStructsContext(ctx, &rows); err != nil {
+			return errors.Wrap(err, "unable to look up the subscriptions to export")
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		if err := fn(rows); err != nil {
+			return err
+		}
+
+		subscriptions := 1
+		for i := 1; i < len(rows); i++ {
+			if rows[i].SubscriptionID != rows[i-1].SubscriptionID {
+				subscriptions++
+			}
+		}
+		if subscriptions < batchSize {
+			return nil
+		}
+		cursor = rows[len(rows)-1].SubscriptionID
+	}
+}
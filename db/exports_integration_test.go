@@ -0,0 +1,94 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestExportSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	withQuotas := addTestSubscription(
+		t,
+		PlanQuotaDefault{ResourceType: storage, QuotaValue: 10},
+		PlanQuotaDefault{ResourceType: compute, QuotaValue: 20},
+	)
+	if _, _, err := testDB.ApplyUsage(ctx, UpdateTypeSet, 5, compute.ID, withQuotas.ID); err != nil {
+		t.Fatalf("unable to record the usage: %s", err)
+	}
+	withoutQuotas := addTestSubscription(t)
+
+	// The other tests add subscriptions at the same time, so only the rows
+	// for the subscriptions added here are checked.
+	exported := make(map[string][]SubscriptionExportRow)
+	var lastID string
+	err := testDB.ExportSubscriptions(ctx, 2, func(rows []SubscriptionExportRow) error {
+		for _, row := range rows {
+			if row.SubscriptionID < lastID {
+				t.Errorf("subscription %s was exported out of order", row.SubscriptionID)
+			}
+			if row.SubscriptionID != lastID && len(exported[row.SubscriptionID]) > 0 {
+				t.Errorf("the rows for subscription %s were split up", row.SubscriptionID)
+			}
+			lastID = row.SubscriptionID
+			exported[row.SubscriptionID] = append(exported[row.SubscriptionID], row)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to export the subscriptions: %s", err)
+	}
+
+	rows := exported[withQuotas.ID]
+	if len(rows) != 2 {
+		t.Fatalf("expected a row for each quota, got %+v", rows)
+	}
+	for _, row := range rows {
+		if row.Username != withQuotas.User.Username || row.PlanName != withQuotas.Plan.Name {
+			t.Errorf("the subscription wasn't exported correctly: %+v", row)
+		}
+		switch row.ResourceName.String {
+		case storage.Name:
+			if row.Quota.Float64 != 10 || row.Usage.Valid {
+				t.Errorf("expected a quota of 10 without a usage, got %+v", row)
+			}
+		case compute.Name:
+			if row.Quota.Float64 != 20 || row.Usage.Float64 != 5 {
+				t.Errorf("expected a quota of 20 with a usage of 5, got %+v", row)
+			}
+		default:
+			t.Errorf("unexpected resource type %s", row.ResourceName.String)
+		}
+	}
+
+	rows = exported[withoutQuotas.ID]
+	if len(rows) != 1 || rows[0].ResourceName.Valid || rows[0].Quota.Valid {
+		t.Errorf("expected a single row without a quota, got %+v", rows)
+	}
+}
+
+func TestExportSubscriptionsStopsOnError(t *testing.T) {
+	t.Parallel()
+
+	addTestSubscription(t)
+	addTestSubscription(t)
+
+	stop := errors.New("stop")
+	var batches int
+	err := testDB.ExportSubscriptions(context.Background(), 1, func([]SubscriptionExportRow) error {
+		batches++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("expected the error from the callback, got %v", err)
+	}
+	if batches != 1 {
+		t.Errorf("expected the export to stop after the first batch, got %d batches", batches)
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// ExternalRef is an identifier assigned to a subscription or subscription
+// add-on by an external system, such as an order number from a storefront.
+// External IDs are unique within their source.
+type ExternalRef struct {
+	Source string
+	ID     string
+}
+
+// externalRefIDFor returns the ID of the row in the table that has the given
+// external reference, or an empty string if there isn't one.
+func (d *Database) externalRefIDFor(ctx context.Context, table exp.IdentifierExpression, ref *ExternalRef, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(table).
+		Select(table.Col("id")).
+		Where(
+			table.Col("external_source").Eq(ref.Source),
+			table.Col("external_id").Eq(ref.ID),
+		)
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrapf(err, "unable to look up external ID %s from %s", ref.ID, ref.Source)
+	}
+
+	return id, nil
+}
+
+// setExternalRef records the external reference for a row in the table.
+// Returns ErrExternalIDExists if another row already has the same reference.
+func (d *Database) setExternalRef(ctx context.Context, table exp.IdentifierExpression, id string, ref *ExternalRef, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Update(table).
+		Set(goqu.Record{
+			"external_source": ref.Source,
+			"external_id":     ref.ID,
+		}).
+		Where(table.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		if isUniqueViolation(err) {
+			return suberrors.ErrExternalIDExists
+		}
+		return errors.Wrapf(err, "unable to record external ID %s from %s", ref.ID, ref.Source)
+	}
+
+	return nil
+}
+
+// SubscriptionIDForExternalRef returns the ID of the subscription with the given
+// external reference, or an empty string if there isn't one. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) SubscriptionIDForExternalRef(ctx context.Context, ref *ExternalRef, opts ...QueryOption) (string, error) {
+	return d.externalRefIDFor(ctx, t.Subscriptions, ref, opts...)
+}
+
+// SetSubscriptionExternalRef records the external reference for a
+// subscription. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) SetSubscriptionExternalRef(ctx context.Context, subscriptionID string, ref *ExternalRef, opts ...QueryOption) error {
+	return d.setExternalRef(ctx, t.Subscriptions, subscriptionID, ref, opts...)
+}
+
+// SubscriptionAddonIDForExternalRef returns the ID of the subscription add-on
+// with the given external reference, or an empty string if there isn't one.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) SubscriptionAddonIDForExternalRef(ctx context.Context, ref *ExternalRef, opts ...QueryOption) (string, error) {
+	return d.externalRefIDFor(ctx, t.SubscriptionAddons, ref, opts...)
+}
+
+// SetSubscriptionAddonExternalRef records the external reference for a
+// subscription add-on. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) SetSubscriptionAddonExternalRef(ctx context.Context, subAddonID string, ref *ExternalRef, opts ...QueryOption) error {
+	return d.setExternalRef(ctx, t.SubscriptionAddons, subAddonID, ref, opts...)
+}
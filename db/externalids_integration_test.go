@@ -0,0 +1,77 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestExternalRefs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	other := addTestSubscription(t)
+	subAddon := attachTestAddon(t, subscription, addTestAddon(t, addTestResourceType(t, false), 1), 1)
+	otherSubAddon := attachTestAddon(t, other, addTestAddon(t, addTestResourceType(t, false), 1), 1)
+
+	tests := []struct {
+		name    string
+		id      string
+		otherID string
+		set     func(context.Context, string, *ExternalRef, ...QueryOption) error
+		lookup  func(context.Context, *ExternalRef, ...QueryOption) (string, error)
+	}{
+		{
+			name:    "subscription",
+			id:      subscription.ID,
+			otherID: other.ID,
+			set:     testDB.SetSubscriptionExternalRef,
+			lookup:  testDB.SubscriptionIDForExternalRef,
+		},
+		{
+			name:    "subscription add-on",
+			id:      subAddon.ID,
+			otherID: otherSubAddon.ID,
+			set:     testDB.SetSubscriptionAddonExternalRef,
+			lookup:  testDB.SubscriptionAddonIDForExternalRef,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ref := &ExternalRef{Source: "storefront", ID: uniqueName("order")}
+
+			id, err := tc.lookup(ctx, ref)
+			if err != nil {
+				t.Fatalf("unable to look up the external reference: %s", err)
+			}
+			if id != "" {
+				t.Errorf("expected no match before the reference is set, got %s", id)
+			}
+
+			if err = tc.set(ctx, tc.id, ref); err != nil {
+				t.Fatalf("unable to set the external reference: %s", err)
+			}
+			if id, err = tc.lookup(ctx, ref); err != nil {
+				t.Fatalf("unable to look up the external reference: %s", err)
+			}
+			if id != tc.id {
+				t.Errorf("expected %s, got %s", tc.id, id)
+			}
+
+			if err = tc.set(ctx, tc.otherID, ref); !errors.Is(err, suberrors.ErrExternalIDExists) {
+				t.Errorf("expected ErrExternalIDExists when reusing the reference, got %v", err)
+			}
+
+			// The same ID from another source is a different reference.
+			if err = tc.set(ctx, tc.otherID, &ExternalRef{Source: "other", ID: ref.ID}); err != nil {
+				t.Errorf("unable to set an external reference from another source: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// ExternalInvoice is an invoice or checkout session created for a subscription
+// by the billing provider.
+type ExternalInvoice struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	SubscriptionID string         `db:"subscription_id"`
+	Provider       string         `db:"provider"`
+	ExternalID     string         `db:"external_id"`
+	EventType      string         `db:"event_type"`
+	Status         sql.NullString `db:"status"`
+	URL            sql.NullString `db:"url"`
+	Amount         float64        `db:"amount"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the invoice to the type used in responses.
+func (i *ExternalInvoice) ToAPIType() *api.ExternalInvoice {
+	return &api.ExternalInvoice{
+		ID:             i.ID,
+		SubscriptionID: i.SubscriptionID,
+		Provider:       i.Provider,
+		ExternalID:     i.ExternalID,
+		EventType:      i.EventType,
+		Status:         i.Status.String,
+		URL:            i.URL.String,
+		Amount:         i.Amount,
+		CreatedAt:      i.CreatedAt,
+	}
+}
+
+// AddExternalInvoice records an invoice created by the billing provider.
+// Recording the same invoice twice has no effect. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddExternalInvoice(ctx context.Context, invoice *ExternalInvoice, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	rec := goqu.Record{
+		"subscription_id": invoice.SubscriptionID,
+		"provider":        invoice.Provider,
+		"external_id":     invoice.ExternalID,
+		"event_type":      invoice.EventType,
+		"amount":          invoice.Amount,
+	}
+	if invoice.Status.Valid {
+		rec["status"] = invoice.Status.String
+	}
+	if invoice.URL.Valid {
+		rec["url"] = invoice.URL.String
+	}
+
+	ds := db.Insert(t.ExternalInvoices).Rows(rec).OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to record invoice %s for subscription %s", invoice.ExternalID, invoice.SubscriptionID)
+	}
+
+	return nil
+}
+
+// ListExternalInvoices returns the invoices created for a subscription by the
+// billing provider, oldest first. Accepts a variable number of QueryOptions,
+// though only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListExternalInvoices(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]ExternalInvoice, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.ExternalInvoices).
+		Select(
+			t.ExternalInvoices.Col("id"),
+			t.ExternalInvoices.Col("subscription_id"),
+			t.ExternalInvoices.Col("provider"),
+			t.ExternalInvoices.Col("external_id"),
+			t.ExternalInvoices.Col("event_type"),
+			t.ExternalInvoices.Col("status"),
+			t.ExternalInvoices.Col("url"),
+			t.ExternalInvoices.Col("amount"),
+			t.ExternalInvoices.Col("created_at"),
+		).
+		Where(t.ExternalInvoices.Col("subscription_id").Eq(subscriptionID)).
+		Order(t.ExternalInvoices.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var invoices []ExternalInvoice
+	if err := ds.Executor().ScanStructsContext(ctx, &invoices); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the invoices for subscription %s", subscriptionID)
+	}
+
+	return invoices, nil
+}
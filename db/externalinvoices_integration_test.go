@@ -0,0 +1,64 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestExternalInvoices(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	invoices := []ExternalInvoice{
+		{
+			SubscriptionID: subscription.ID,
+			Provider:       "stripe",
+			ExternalID:     uniqueName("session"),
+			EventType:      "checkout.session.created",
+			URL:            sql.NullString{String: "https://example.com/checkout", Valid: true},
+			Amount:         100,
+		},
+		{
+			SubscriptionID: subscription.ID,
+			Provider:       "stripe",
+			ExternalID:     uniqueName("invoice"),
+			EventType:      "invoice.paid",
+			Status:         sql.NullString{String: "paid", Valid: true},
+			Amount:         100,
+		},
+	}
+
+	// Recording an invoice a second time has no effect.
+	for _, invoice := range append(invoices, invoices[0]) {
+		if err := testDB.AddExternalInvoice(ctx, &invoice); err != nil {
+			t.Fatalf("unable to record invoice %s: %s", invoice.ExternalID, err)
+		}
+	}
+
+	listed, err := testDB.ListExternalInvoices(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the invoices: %s", err)
+	}
+	if len(listed) != len(invoices) {
+		t.Fatalf("expected %d invoices, got %+v", len(invoices), listed)
+	}
+	for i, invoice := range listed {
+		expected := invoices[i]
+		if invoice.ExternalID != expected.ExternalID || invoice.EventType != expected.EventType ||
+			invoice.Status != expected.Status || invoice.URL != expected.URL || invoice.Amount != expected.Amount {
+			t.Errorf("expected %+v, got %+v", expected, invoice)
+		}
+	}
+
+	other, err := testDB.ListExternalInvoices(ctx, addTestSubscription(t).ID)
+	if err != nil {
+		t.Fatalf("unable to list the invoices: %s", err)
+	}
+	if len(other) != 0 {
+		t.Errorf("expected no invoices for another subscription, got %+v", other)
+	}
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// GroupAccountPrefix is prepended to the name of a group to get the username of
+// the account that owns the group's subscriptions. Usernames never contain a
+// colon, so group accounts can't clash with user accounts.
+const GroupAccountPrefix = "group:"
+
+// GroupAccountUsername returns the username of the account that owns the
+// subscriptions of the named group.
+func GroupAccountUsername(name string) string {
+	return GroupAccountPrefix + name
+}
+
+// Group is a set of users who share the quotas of the group's subscription.
+type Group struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	Name           string         `db:"name"`
+	Description    sql.NullString `db:"description"`
+	User           User           `db:"users"`
+	CreatedBy      string         `db:"created_by"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the group to the type used in responses.
+func (g *Group) ToAPIType() *api.Group {
+	return &api.Group{
+		ID:             g.ID,
+		Name:           g.Name,
+		Description:    g.Description.String,
+		AccountName:    g.User.Username,
+		CreatedBy:      g.CreatedBy,
+		CreatedAt:      g.CreatedAt,
+		LastModifiedAt: g.LastModifiedAt,
+	}
+}
+
+// GroupMember is a user who belongs to a group.
+type GroupMember struct {
+	Username string    `db:"username"`
+	AddedBy  string    `db:"added_by"`
+	AddedAt  time.Time `db:"added_at"`
+}
+
+// groupDS returns the dataset used to look up groups.
+func groupDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Groups).
+		Join(t.Users, goqu.On(t.Groups.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.Groups.Col("id"),
+			t.Groups.Col("name"),
+			t.Groups.Col("description"),
+			t.Users.Col("id").As(goqu.C("users.id")),
+			t.Users.Col("username").As(goqu.C("users.username")),
+			t.Groups.Col("created_by"),
+			t.Groups.Col("created_at"),
+			t.Groups.Col("last_modified_at"),
+		)
+}
+
+// AddGroup adds a group along with the account that owns its subscriptions and
+// returns the group's ID. ErrGroupExists is returned if a group with the same
+// name exists already. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported. A transaction should be used so that the
+// account isn't added without the group.
+func (d *Database) AddGroup(ctx context.Context, group *Group, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	account, err := d.EnsureUser(ctx, GroupAccountUsername(group.Name), opts...)
+	if err != nil {
+		return "", err
+	}
+
+	rec := goqu.Record{
+		"name":       group.Name,
+		"user_id":    account.ID,
+		"created_by": group.CreatedBy,
+	}
+	if group.Description.Valid {
+		rec["description"] = group.Description.String
+	}
+
+	ds := db.Insert(t.Groups).Rows(rec).Returning(t.Groups.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err = ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrGroupExists
+		}
+		return "", errors.Wrapf(err, "unable to add group %s", group.Name)
+	}
+
+	return id, nil
+}
+
+// GetGroupByName returns the named group, or nil if it doesn't exist. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) GetGroupByName(ctx context.Context, name string, opts ...QueryOption) (*Group, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := groupDS(db).Where(t.Groups.Col("name").Eq(name))
+	d.LogSQL(ds)
+
+	var group Group
+	found, err := ds.Executor().ScanStructContext(ctx, &group)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up group %s", name)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &group, nil
+}
+
+// ListGroupMembers returns the members of a group, ordered by username. Accepts
+// a variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ListGroupMembers(ctx context.Context, groupID string, opts ...QueryOption) ([]GroupMember, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.GroupMembers).
+		Join(t.Users, goqu.On(t.GroupMembers.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.Users.Col("username"),
+			t.GroupMembers.Col("added_by"),
+			t.GroupMembers.Col("added_at"),
+		).
+		Where(t.GroupMembers.Col("group_id").Eq(groupID)).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var members []GroupMember
+	if err := ds.Executor().ScanStructsContext(ctx, &members); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the members of group %s", groupID)
+	}
+
+	return members, nil
+}
+
+// AddGroupMember adds a user to a group. Adding a user who already belongs to
+// the group has no effect. Accepts a variable number of QueryOptions, though
+// only WithTX is currently supported.
+func (d *Database) AddGroupMember(ctx context.Context, groupID, userID, addedBy string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.GroupMembers).
+		Rows(goqu.Record{
+			"group_id": groupID,
+			"user_id":  userID,
+			"added_by": addedBy,
+		}).
+		OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to add user %s to group %s", userID, groupID)
+	}
+
+	return nil
+}
+
+// RemoveGroupMember removes a user from a group and returns true if the user
+// belonged to it. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) RemoveGroupMember(ctx context.Context, groupID, username string, opts ...QueryOption) (bool, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.GroupMembers).
+		Delete().
+		Where(
+			t.GroupMembers.Col("group_id").Eq(groupID),
+			t.GroupMembers.Col("user_id").In(
+				db.From(t.Users).Select(t.Users.Col("id")).Where(t.Users.Col("username").Eq(username)),
+			),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove user %s from group %s", username, groupID)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove user %s from group %s", username, groupID)
+	}
+
+	return rows > 0, nil
+}
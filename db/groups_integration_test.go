@@ -0,0 +1,159 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestGroup adds a group with a unique name.
+func addTestGroup(t *testing.T) *Group {
+	t.Helper()
+	ctx := context.Background()
+
+	name := uniqueName("group")
+	group := &Group{Name: name, Description: sql.NullString{String: "A group", Valid: true}, CreatedBy: "test"}
+	if _, err := testDB.AddGroup(ctx, group); err != nil {
+		t.Fatalf("unable to add group %s: %s", name, err)
+	}
+
+	loaded, err := testDB.GetGroupByName(ctx, name)
+	if err != nil {
+		t.Fatalf("unable to look up group %s: %s", name, err)
+	}
+	if loaded == nil {
+		t.Fatalf("group %s wasn't found", name)
+	}
+	return loaded
+}
+
+func TestAddGroup(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	group := addTestGroup(t)
+	if group.User.Username != GroupAccountUsername(group.Name) || group.Description.String != "A group" {
+		t.Errorf("the group wasn't stored correctly: %+v", group)
+	}
+
+	if _, err := testDB.AddGroup(ctx, &Group{Name: group.Name, CreatedBy: "test"}); !errors.Is(err, suberrors.ErrGroupExists) {
+		t.Errorf("expected ErrGroupExists for a duplicate name, got %v", err)
+	}
+
+	missing, err := testDB.GetGroupByName(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up a missing group: %s", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no group, got %s", missing.ID)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	group := addTestGroup(t)
+	users := []*User{addTestUser(t), addTestUser(t)}
+
+	// Adding a member a second time has no effect.
+	for _, user := range append(users, users[0]) {
+		if err := testDB.AddGroupMember(ctx, group.ID, user.ID, "test"); err != nil {
+			t.Fatalf("unable to add %s to the group: %s", user.Username, err)
+		}
+	}
+
+	members, err := testDB.ListGroupMembers(ctx, group.ID)
+	if err != nil {
+		t.Fatalf("unable to list the group members: %s", err)
+	}
+	if len(members) != len(users) {
+		t.Fatalf("expected %d members, got %+v", len(users), members)
+	}
+
+	removed, err := testDB.RemoveGroupMember(ctx, group.ID, users[0].Username)
+	if err != nil {
+		t.Fatalf("unable to remove %s from the group: %s", users[0].Username, err)
+	}
+	if !removed {
+		t.Errorf("expected %s to be removed", users[0].Username)
+	}
+	if removed, err = testDB.RemoveGroupMember(ctx, group.ID, users[0].Username); err != nil || removed {
+		t.Errorf("expected removing %s again to do nothing, got %t, %v", users[0].Username, removed, err)
+	}
+
+	if members, err = testDB.ListGroupMembers(ctx, group.ID); err != nil {
+		t.Fatalf("unable to list the group members: %s", err)
+	}
+	if len(members) != 1 || members[0].Username != users[1].Username {
+		t.Errorf("expected only %s to be left, got %+v", users[1].Username, members)
+	}
+}
+
+func TestGroupSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	plan := addTestPlan(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+	group := addTestGroup(t)
+	groupSubscription := subscribeTestUser(t, &group.User, plan, nil)
+
+	member := addTestUser(t)
+	if err := testDB.AddGroupMember(ctx, group.ID, member.ID, "test"); err != nil {
+		t.Fatalf("unable to add %s to the group: %s", member.Username, err)
+	}
+	withOwn := addTestUser(t)
+	if err := testDB.AddGroupMember(ctx, group.ID, withOwn.ID, "test"); err != nil {
+		t.Fatalf("unable to add %s to the group: %s", withOwn.Username, err)
+	}
+	ownSubscription := subscribeTestUser(t, withOwn, plan, nil)
+
+	// Group subscriptions are only used when they're asked for.
+	if _, err := testDB.GetActiveSubscription(ctx, member.Username); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound without group subscriptions, got %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		user     *User
+		expected string
+	}{
+		{name: "member", user: member, expected: groupSubscription.ID},
+		{name: "member with a subscription", user: withOwn, expected: ownSubscription.ID},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			subscription, err := testDB.GetActiveSubscription(ctx, tc.user.Username, WithGroupSubscriptions())
+			if err != nil {
+				t.Fatalf("unable to look up the subscription: %s", err)
+			}
+			if subscription.ID != tc.expected {
+				t.Errorf("expected subscription %s, got %s", tc.expected, subscription.ID)
+			}
+		})
+	}
+
+	// Members draw on the group's quotas and share its overages.
+	update := newTestUpdate(t, *member, compute, UsagesTrackedMetric, UpdateTypeAdd, 12)
+	if err := testDB.ProcessUpdateForUsage(ctx, update, WithGroupSubscriptions()); err != nil {
+		t.Fatalf("unable to process the update: %s", err)
+	}
+	if usage := currentUsage(t, compute.ID, groupSubscription.ID); usage != 12 {
+		t.Errorf("expected the usage to be recorded for the group, got %g", usage)
+	}
+
+	overages, err := testDB.GetUserOverages(ctx, member.Username, WithGroupSubscriptions())
+	if err != nil {
+		t.Fatalf("unable to look up the overages: %s", err)
+	}
+	if len(overages) != 1 || overages[0].SubscriptionID != groupSubscription.ID {
+		t.Errorf("expected the group's overage, got %+v", overages)
+	}
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// ImportedSubscription is a subscription that's being brought over from another
+// system as it is, rather than being created from the plan's current settings.
+// A subscription without an end date is perpetual.
+type ImportedSubscription struct {
+	UserID             string
+	Plan               *Plan
+	EffectiveStartDate time.Time
+	EffectiveEndDate   sql.NullTime
+	Paid               bool
+	CreatedBy          string
+	ExternalRef        *ExternalRef
+}
+
+// AddImportedSubscription adds a subscription with the dates and paid flag it
+// had in the system that it's imported from, and records its external
+// reference so that importing it again can be detected. The subscription uses
+// the plan rate that was in effect when it started, or the plan's earliest
+// rate if it started before the plan had one. No quotas are added; the caller
+// adds the quotas that the subscription had. Returns ErrExternalIDExists if a
+// subscription with the same external reference already exists. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddImportedSubscription(ctx context.Context, sub *ImportedSubscription, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	rate := sub.Plan.RateAsOf(sub.EffectiveStartDate)
+	if rate == nil && len(sub.Plan.Rates) > 0 {
+		rate = &sub.Plan.Rates[0]
+	}
+	if rate == nil {
+		return "", errors.Errorf("the %s subscription plan has no rates", sub.Plan.Name)
+	}
+
+	var endDate any
+	if sub.EffectiveEndDate.Valid {
+		endDate = sub.EffectiveEndDate.Time
+	}
+
+	rec := goqu.Record{
+		"effective_start_date": sub.EffectiveStartDate,
+		"effective_end_date":   endDate,
+		"user_id":              sub.UserID,
+		"plan_id":              sub.Plan.ID,
+		"created_by":           sub.CreatedBy,
+		"last_modified_by":     sub.CreatedBy,
+		"paid":                 sub.Paid,
+		"plan_rate_id":         rate.ID,
+	}
+	if sub.ExternalRef != nil {
+		rec["external_source"] = sub.ExternalRef.Source
+		rec["external_id"] = sub.ExternalRef.ID
+	}
+
+	ds := db.Insert(t.Subscriptions).
+		Rows(querySettings.tenantRecord(rec)).
+		Returning(t.Subscriptions.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrExternalIDExists
+		}
+		return "", errors.Wrapf(err, "unable to import a %s subscription for user ID %s", sub.Plan.Name, sub.UserID)
+	}
+
+	return id, nil
+}
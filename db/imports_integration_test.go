@@ -0,0 +1,114 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddImportedSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	user := addTestUser(t)
+
+	start := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	imported := &ImportedSubscription{
+		UserID:             user.ID,
+		Plan:               plan,
+		EffectiveStartDate: start,
+		Paid:               true,
+		CreatedBy:          "test",
+		ExternalRef:        &ExternalRef{Source: "qms", ID: uniqueName("subscription")},
+	}
+	id, err := testDB.AddImportedSubscription(ctx, imported)
+	if err != nil {
+		t.Fatalf("unable to import the subscription: %s", err)
+	}
+
+	subscription, err := testDB.GetSubscriptionByID(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription: %s", err)
+	}
+	if subscription == nil {
+		t.Fatal("the imported subscription wasn't found")
+	}
+	if !subscription.Perpetual() || !subscription.Paid || !subscription.EffectiveStartDate.Equal(start) {
+		t.Errorf("expected a paid, perpetual subscription starting at %s, got %+v", start, subscription)
+	}
+
+	// Importing the same subscription again is detected.
+	if _, err = testDB.AddImportedSubscription(ctx, imported); !errors.Is(err, suberrors.ErrExternalIDExists) {
+		t.Errorf("expected ErrExternalIDExists, got %v", err)
+	}
+
+	ended := &ImportedSubscription{
+		UserID:             user.ID,
+		Plan:               plan,
+		EffectiveStartDate: start,
+		EffectiveEndDate:   sql.NullTime{Time: start.AddDate(1, 0, 0), Valid: true},
+		CreatedBy:          "test",
+	}
+	if id, err = testDB.AddImportedSubscription(ctx, ended); err != nil {
+		t.Fatalf("unable to import the subscription: %s", err)
+	}
+	if subscription, err = testDB.GetSubscriptionByID(ctx, id); err != nil {
+		t.Fatalf("unable to look up the subscription: %s", err)
+	}
+	if subscription.Perpetual() || !subscription.EffectiveEndDate.Equal(ended.EffectiveEndDate.Time) {
+		t.Errorf("expected the subscription to end at %s, got %s", ended.EffectiveEndDate.Time, subscription.EffectiveEndDate)
+	}
+}
+
+func TestImportedUsageDrawsCreditsOnce(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	depositTestCredits(t, user, compute, 3)
+
+	subscriptionID, err := testDB.AddImportedSubscription(ctx, &ImportedSubscription{
+		UserID:             user.ID,
+		Plan:               addTestPlan(t),
+		EffectiveStartDate: time.Now().AddDate(0, -1, 0),
+		CreatedBy:          "test",
+	})
+	if err != nil {
+		t.Fatalf("unable to import the subscription: %s", err)
+	}
+
+	// The imported usage replaces the usage as it was in the legacy service,
+	// so it isn't drawn from credits.
+	if _, drawn, err := testDB.ApplyUsage(ctx, UpdateTypeSet, 4, compute.ID, subscriptionID); err != nil {
+		t.Fatalf("unable to import the usage: %s", err)
+	} else if drawn != 0 {
+		t.Errorf("expected nothing to be drawn for the imported usage, got %g", drawn)
+	}
+
+	// Usage that's added afterwards is drawn from credits once.
+	update := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 5)
+	if _, err = testDB.AddUserUpdate(ctx, update); err != nil {
+		t.Fatalf("unable to add the update: %s", err)
+	}
+	if err = testDB.ProcessUpdateForUsage(ctx, update); err != nil {
+		t.Fatalf("unable to process the update: %s", err)
+	}
+
+	if balance := creditBalance(t, user, compute); balance != 0 {
+		t.Errorf("expected the credits to be used up, got %g", balance)
+	}
+	if usage := currentUsage(t, compute.ID, subscriptionID); usage != 6 {
+		t.Errorf("expected a usage of 6, got %g", usage)
+	}
+	if draws := creditDraws(t, user, compute); len(draws) != 1 || draws[0].UpdateID.String != update.ID {
+		t.Errorf("expected a single draw for update %s, got %+v", update.ID, draws)
+	}
+}
@@ -0,0 +1,278 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/migrations"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// The integration tests run against a PostgreSQL database. A database is
+// started in a container for each run unless QMS_TEST_DATABASE_URI points at
+// an empty database that can be used instead. Either way, the QMS migrations
+// in the directory that QMS_MIGRATIONS_DIR points at are applied first, and
+// then the embedded migrations in this repository are applied on top of them
+// the same way the service applies them, which is how production databases are
+// set up.
+//
+// The tests share the database and run in parallel, so each one adds its own
+// users, plans and resource types with unique names rather than relying on
+// any seeded data.
+
+// The environment variables used to configure the integration tests.
+const (
+	testDatabaseEnv      = "QMS_TEST_DATABASE_URI"
+	qmsMigrationsDirEnv  = "QMS_MIGRATIONS_DIR"
+	migrationFilePattern = "*.up.sql"
+)
+
+// The container used when an existing database isn't provided.
+const (
+	postgresRepository = "postgres"
+	postgresTag        = "16-alpine"
+	postgresPassword   = "qms"
+	postgresDatabase   = "qms"
+)
+
+// testDB is the database used by every integration test.
+var testDB *Database
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegrationTests(m))
+}
+
+// runIntegrationTests prepares the database and runs the tests, returning the
+// exit code. It's separate from TestMain so that the container is removed
+// before the process exits.
+func runIntegrationTests(m *testing.M) int {
+	ctx := context.Background()
+
+	qmsMigrationsDir := os.Getenv(qmsMigrationsDirEnv)
+	if qmsMigrationsDir == "" {
+		fmt.Fprintf(os.Stderr, "%s must be set to the migrations directory of the QMS repository\n", qmsMigrationsDirEnv)
+		return 1
+	}
+
+	dsn := os.Getenv(testDatabaseEnv)
+	if dsn == "" {
+		pool, err := dockertest.NewPool("")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to connect to docker: %s\n", err)
+			return 1
+		}
+		pool.MaxWait = 2 * time.Minute
+
+		resource, err := pool.RunWithOptions(
+			&dockertest.RunOptions{
+				Repository: postgresRepository,
+				Tag:        postgresTag,
+				Env: []string{
+					"POSTGRES_PASSWORD=" + postgresPassword,
+					"POSTGRES_DB=" + postgresDatabase,
+				},
+			},
+			func(config *docker.HostConfig) {
+				config.AutoRemove = true
+				config.RestartPolicy = docker.RestartPolicy{Name: "no"}
+			},
+		)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to start postgres: %s\n", err)
+			return 1
+		}
+		defer pool.Purge(resource) // nolint:errcheck
+
+		// The container is removed after ten minutes even if the tests are
+		// killed before they can clean up after themselves.
+		_ = resource.Expire(600)
+
+		dsn = fmt.Sprintf(
+			"postgres://postgres:%s@%s/%s?sslmode=disable",
+			postgresPassword, resource.GetHostPort("5432/tcp"), postgresDatabase,
+		)
+		err = pool.Retry(func() error {
+			conn, err := sqlx.Connect("postgres", dsn)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "postgres didn't start: %s\n", err)
+			return 1
+		}
+	}
+
+	conn, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to connect to the database: %s\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	if err = applyMigrationFiles(ctx, conn, qmsMigrationsDir); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to apply the QMS migrations in %s: %s\n", qmsMigrationsDir, err)
+		return 1
+	}
+	if _, err = migrations.Apply(ctx, conn.DB, migrations.DefaultTable); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to apply the migrations: %s\n", err)
+		return 1
+	}
+
+	testDB = New(conn)
+	return m.Run()
+}
+
+// applyMigrationFiles runs the up migrations in the directory in order by file
+// name, which is the order that golang-migrate applies them in. The QMS
+// migrations aren't embedded anywhere, so they're read from the files.
+func applyMigrationFiles(ctx context.Context, conn *sqlx.DB, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, migrationFilePattern))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no files match %s", migrationFilePattern)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		migration, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, string(migration)); err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+	}
+
+	return nil
+}
+
+// uniqueName returns a name that no other test uses.
+func uniqueName(prefix string) string {
+	return prefix + "-" + uuid.NewString()
+}
+
+// addTestUser adds a user with a unique username.
+func addTestUser(t *testing.T) *User {
+	t.Helper()
+
+	user, err := testDB.EnsureUser(context.Background(), uniqueName("user"))
+	if err != nil {
+		t.Fatalf("unable to add a user: %s", err)
+	}
+	return user
+}
+
+// addTestResourceType adds a resource type with a unique name.
+func addTestResourceType(t *testing.T, consumable bool) ResourceType {
+	t.Helper()
+
+	resourceType := ResourceType{Name: uniqueName("resource"), Unit: "bytes", Consumable: consumable}
+	id, err := testDB.AddResourceType(context.Background(), &resourceType)
+	if err != nil {
+		t.Fatalf("unable to add a resource type: %s", err)
+	}
+	resourceType.ID = id
+	return resourceType
+}
+
+// addTestPlan adds a plan with a unique name, a rate and the quota defaults,
+// all of which took effect a day ago, and returns the plan as it's loaded from
+// the database.
+func addTestPlan(t *testing.T, quotaDefaults ...PlanQuotaDefault) *Plan {
+	t.Helper()
+	ctx := context.Background()
+
+	effectiveDate := time.Now().Add(-24 * time.Hour)
+	for i := range quotaDefaults {
+		quotaDefaults[i].EffectiveDate = effectiveDate
+	}
+
+	plan := &Plan{
+		Name:          uniqueName("plan"),
+		Description:   "A plan used by the integration tests.",
+		QuotaDefaults: quotaDefaults,
+		Rates:         []PlanRate{{EffectiveDate: effectiveDate, Rate: 100}},
+	}
+	if _, err := testDB.AddPlan(ctx, plan); err != nil {
+		t.Fatalf("unable to add a plan: %s", err)
+	}
+
+	loaded, err := testDB.GetPlanByName(ctx, plan.Name)
+	if err != nil {
+		t.Fatalf("unable to look up plan %s: %s", plan.Name, err)
+	}
+	if loaded == nil {
+		t.Fatalf("plan %s wasn't found", plan.Name)
+	}
+	return loaded
+}
+
+// subscribeTestUser subscribes the user to the plan and returns the new
+// subscription as it's loaded from the database.
+func subscribeTestUser(t *testing.T, user *User, plan *Plan, opts *SubscriptionOptions) *Subscription {
+	t.Helper()
+	ctx := context.Background()
+
+	subscriptionID, err := testDB.SetActiveSubscription(ctx, user.ID, plan, opts)
+	if err != nil {
+		t.Fatalf("unable to subscribe %s to %s: %s", user.Username, plan.Name, err)
+	}
+
+	subscription, err := testDB.GetSubscriptionByID(ctx, subscriptionID)
+	if err != nil {
+		t.Fatalf("unable to look up subscription %s: %s", subscriptionID, err)
+	}
+	if subscription == nil {
+		t.Fatalf("subscription %s wasn't found", subscriptionID)
+	}
+	return subscription
+}
+
+// addTestSubscription adds a user and subscribes them to a new plan with the
+// quota defaults.
+func addTestSubscription(t *testing.T, quotaDefaults ...PlanQuotaDefault) *Subscription {
+	t.Helper()
+
+	return subscribeTestUser(t, addTestUser(t), addTestPlan(t, quotaDefaults...), nil)
+}
+
+// operationID returns the ID of the update operation with the given name.
+func operationID(t *testing.T, name string) string {
+	t.Helper()
+
+	id, err := testDB.GetOperationID(context.Background(), name)
+	if err != nil {
+		t.Fatalf("unable to look up the %s operation: %s", name, err)
+	}
+	if id == "" {
+		t.Fatalf("the %s operation wasn't found", name)
+	}
+	return id
+}
+
+// countRows returns the number of rows in the table that match the conditions.
+func countRows(t *testing.T, table string, where ...exp.Expression) int64 {
+	t.Helper()
+
+	count, err := testDB.fullDB.From(table).Where(where...).CountContext(context.Background())
+	if err != nil {
+		t.Fatalf("unable to count the rows in %s: %s", table, err)
+	}
+	return count
+}
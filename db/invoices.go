@@ -0,0 +1,319 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The types of invoice line items.
+const (
+	InvoiceItemPlan     = "plan"
+	InvoiceItemAddon    = "addon"
+	InvoiceItemDiscount = "discount"
+)
+
+// Invoice is the amount owed for a subscription period. Everything needed to
+// explain the amount is copied into the invoice when it's generated, so that
+// the invoice doesn't change if the plan or add-on rates do.
+type Invoice struct {
+	ID                string            `db:"id" goqu:"defaultifempty"`
+	SubscriptionID    string            `db:"subscription_id"`
+	Username          string            `db:"username"`
+	PlanName          string            `db:"plan_name"`
+	PeriodStart       time.Time         `db:"period_start"`
+	PeriodEnd         time.Time         `db:"period_end"`
+	ProrationFraction float64           `db:"proration_fraction"`
+	Subtotal          float64           `db:"subtotal"`
+	DiscountTotal     float64           `db:"discount_total"`
+	Total             float64           `db:"total"`
+	CreatedBy         string            `db:"created_by"`
+	CreatedAt         time.Time         `db:"created_at" goqu:"defaultifempty"`
+	LineItems         []InvoiceLineItem `db:"-"`
+}
+
+// InvoiceLineItem is a single charge or credit on an invoice. The subscription
+// add-on ID is only set for add-on line items.
+type InvoiceLineItem struct {
+	ID                  string         `db:"id" goqu:"defaultifempty"`
+	InvoiceID           string         `db:"invoice_id"`
+	Position            int32          `db:"position"`
+	ItemType            string         `db:"item_type"`
+	Description         string         `db:"description"`
+	SubscriptionAddonID sql.NullString `db:"subscription_addon_id"`
+	Quantity            float64        `db:"quantity"`
+	UnitRate            float64        `db:"unit_rate"`
+	Amount              float64        `db:"amount"`
+}
+
+// ToAPIType converts the invoice to the type used in responses.
+func (i *Invoice) ToAPIType() *api.Invoice {
+	result := &api.Invoice{
+		ID:                i.ID,
+		SubscriptionID:    i.SubscriptionID,
+		Username:          i.Username,
+		PlanName:          i.PlanName,
+		PeriodStart:       i.PeriodStart,
+		PeriodEnd:         i.PeriodEnd,
+		ProrationFraction: i.ProrationFraction,
+		Subtotal:          i.Subtotal,
+		DiscountTotal:     i.DiscountTotal,
+		Total:             i.Total,
+		CreatedBy:         i.CreatedBy,
+		CreatedAt:         i.CreatedAt,
+		LineItems:         make([]*api.InvoiceLineItem, 0, len(i.LineItems)),
+	}
+	for _, item := range i.LineItems {
+		result.LineItems = append(result.LineItems, &api.InvoiceLineItem{
+			ID:                  item.ID,
+			ItemType:            item.ItemType,
+			Description:         item.Description,
+			SubscriptionAddonID: item.SubscriptionAddonID.String,
+			Quantity:            item.Quantity,
+			UnitRate:            item.UnitRate,
+			Amount:              item.Amount,
+		})
+	}
+	return result
+}
+
+// invoiceDS returns the dataset used to look up invoices.
+func invoiceDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Invoices).
+		Select(
+			t.Invoices.Col("id"),
+			t.Invoices.Col("subscription_id"),
+			t.Invoices.Col("username"),
+			t.Invoices.Col("plan_name"),
+			t.Invoices.Col("period_start"),
+			t.Invoices.Col("period_end"),
+			t.Invoices.Col("proration_fraction"),
+			t.Invoices.Col("subtotal"),
+			t.Invoices.Col("discount_total"),
+			t.Invoices.Col("total"),
+			t.Invoices.Col("created_by"),
+			t.Invoices.Col("created_at"),
+		)
+}
+
+// AddInvoice records an invoice along with its line items and returns its ID.
+// The line items are numbered in the order that they're given in.
+// ErrInvoiceExists is returned if an invoice has already been generated for
+// the same subscription period. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) AddInvoice(ctx context.Context, invoice *Invoice, opts ...QueryOption) (string, error) {
+	var id string
+
+	querySettings := d.newQuerySettings(opts...)
+	err := d.inTxWithOpts(ctx, func(tx *goqu.TxDatabase) error {
+		if err := d.checkSubscriptionTenant(ctx, tx, querySettings, invoice.SubscriptionID); err != nil {
+			return err
+		}
+
+		ds := tx.Insert(t.Invoices).
+			Rows(goqu.Record{
+				"subscription_id":    invoice.SubscriptionID,
+				"username":           invoice.Username,
+				"plan_name":          invoice.PlanName,
+				"period_start":       invoice.PeriodStart,
+				"period_end":         invoice.PeriodEnd,
+				"proration_fraction": invoice.ProrationFraction,
+				"subtotal":           invoice.Subtotal,
+				"discount_total":     invoice.DiscountTotal,
+				"total":              invoice.Total,
+				"created_by":         invoice.CreatedBy,
+			}).
+			Returning(t.Invoices.Col("id"))
+		d.LogSQL(ds)
+
+		if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+			if isUniqueViolation(err) {
+				return suberrors.ErrInvoiceExists
+			}
+			return errors.Wrapf(err, "unable to add an invoice for subscription %s", invoice.SubscriptionID)
+		}
+
+		if len(invoice.LineItems) == 0 {
+			return nil
+		}
+
+		rows := make([]any, len(invoice.LineItems))
+		for i, item := range invoice.LineItems {
+			rec := goqu.Record{
+				"invoice_id":  id,
+				"position":    i,
+				"item_type":   item.ItemType,
+				"description": item.Description,
+				"quantity":    item.Quantity,
+				"unit_rate":   item.UnitRate,
+				"amount":      item.Amount,
+			}
+			if item.SubscriptionAddonID.Valid {
+				rec["subscription_addon_id"] = item.SubscriptionAddonID.String
+			} else {
+				rec["subscription_addon_id"] = nil
+			}
+			rows[i] = rec
+		}
+
+		itemsDS := tx.Insert(t.InvoiceLineItems).Rows(rows...)
+		d.LogSQL(itemsDS)
+
+		if _, err := itemsDS.Executor().ExecContext(ctx); err != nil {
+			return errors.Wrapf(err, "unable to add the line items for invoice %s", id)
+		}
+
+		return nil
+	}, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// addLineItems looks up the line items of the invoices and adds them to the
+// invoices, in order.
+func (d *Database) addLineItems(ctx context.Context, db GoquDatabase, invoices []Invoice) error {
+	if len(invoices) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(invoices))
+	byID := make(map[string]*Invoice, len(invoices))
+	for i := range invoices {
+		ids[i] = invoices[i].ID
+		byID[invoices[i].ID] = &invoices[i]
+	}
+
+	ds := db.From(t.InvoiceLineItems).
+		Select(
+			t.InvoiceLineItems.Col("id"),
+			t.InvoiceLineItems.Col("invoice_id"),
+			t.InvoiceLineItems.Col("position"),
+			t.InvoiceLineItems.Col("item_type"),
+			t.InvoiceLineItems.Col("description"),
+			t.InvoiceLineItems.Col("subscription_addon_id"),
+			t.InvoiceLineItems.Col("quantity"),
+			t.InvoiceLineItems.Col("unit_rate"),
+			t.InvoiceLineItems.Col("amount"),
+		).
+		Where(t.InvoiceLineItems.Col("invoice_id").In(ids)).
+		Order(t.InvoiceLineItems.Col("invoice_id").Asc(), t.InvoiceLineItems.Col("position").Asc())
+	d.LogSQL(ds)
+
+	var items []InvoiceLineItem
+	if err := ds.Executor().ScanStructsContext(ctx, &items); err != nil {
+		return errors.Wrap(err, "unable to look up the invoice line items")
+	}
+
+	for _, item := range items {
+		invoice := byID[item.InvoiceID]
+		invoice.LineItems = append(invoice.LineItems, item)
+	}
+
+	return nil
+}
+
+// getInvoice returns the first invoice matching the dataset along with its line
+// items, or nil if there isn't one.
+func (d *Database) getInvoice(ctx context.Context, db GoquDatabase, ds *goqu.SelectDataset) (*Invoice, error) {
+	d.LogSQL(ds)
+
+	var invoice Invoice
+	found, err := ds.Executor().ScanStructContext(ctx, &invoice)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	invoices := []Invoice{invoice}
+	if err = d.addLineItems(ctx, db, invoices); err != nil {
+		return nil, err
+	}
+
+	return &invoices[0], nil
+}
+
+// GetInvoice returns the invoice along with its line items, or nil if it
+// doesn't exist. Accepts a variable number of QueryOptions, though only WithTX
+// and WithReadReplica are currently supported.
+func (d *Database) GetInvoice(ctx context.Context, invoiceID string, opts ...QueryOption) (*Invoice, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := invoiceDS(db).
+		Where(
+			t.Invoices.Col("id").Eq(invoiceID),
+			querySettings.subscriptionTenantExp(db, t.Invoices.Col("subscription_id")),
+		)
+
+	invoice, err := d.getInvoice(ctx, db, ds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up invoice %s", invoiceID)
+	}
+
+	return invoice, nil
+}
+
+// GetInvoiceForPeriod returns the invoice generated for a subscription period
+// along with its line items, or nil if one hasn't been generated. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) GetInvoiceForPeriod(
+	ctx context.Context,
+	subscriptionID string,
+	periodStart, periodEnd time.Time,
+	opts ...QueryOption,
+) (*Invoice, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := invoiceDS(db).
+		Where(
+			t.Invoices.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.Invoices.Col("subscription_id")),
+			t.Invoices.Col("period_start").Eq(periodStart),
+			t.Invoices.Col("period_end").Eq(periodEnd),
+		)
+
+	invoice, err := d.getInvoice(ctx, db, ds)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the invoice for subscription %s", subscriptionID)
+	}
+
+	return invoice, nil
+}
+
+// ListInvoices returns the invoices generated for a subscription along with
+// their line items, ordered by the start of the period. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) ListInvoices(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Invoice, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := invoiceDS(db).
+		Where(
+			t.Invoices.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.Invoices.Col("subscription_id")),
+		).
+		Order(t.Invoices.Col("period_start").Asc(), t.Invoices.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var invoices []Invoice
+	if err := ds.Executor().ScanStructsContext(ctx, &invoices); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the invoices for subscription %s", subscriptionID)
+	}
+
+	if err := d.addLineItems(ctx, db, invoices); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
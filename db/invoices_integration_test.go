@@ -0,0 +1,119 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestInvoices(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	subAddon := attachTestAddon(t, subscription, addTestAddon(t, addTestResourceType(t, false), 1), 1)
+
+	// The periods are truncated to whole days so that they survive the round
+	// trip through the database unchanged.
+	periodStart := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd := periodStart.AddDate(0, 1, 0)
+	invoice := &Invoice{
+		SubscriptionID:    subscription.ID,
+		Username:          subscription.User.Username,
+		PlanName:          subscription.Plan.Name,
+		PeriodStart:       periodStart,
+		PeriodEnd:         periodEnd,
+		ProrationFraction: 1,
+		Subtotal:          110,
+		DiscountTotal:     10,
+		Total:             100,
+		CreatedBy:         "test",
+		LineItems: []InvoiceLineItem{
+			{ItemType: InvoiceItemPlan, Description: "plan", Quantity: 1, UnitRate: 100, Amount: 100},
+			{
+				ItemType:            InvoiceItemAddon,
+				Description:         "add-on",
+				SubscriptionAddonID: sql.NullString{String: subAddon.ID, Valid: true},
+				Quantity:            1,
+				UnitRate:            10,
+				Amount:              10,
+			},
+			{ItemType: InvoiceItemDiscount, Description: "discount", Quantity: 1, UnitRate: -10, Amount: -10},
+		},
+	}
+	id, err := testDB.AddInvoice(ctx, invoice)
+	if err != nil {
+		t.Fatalf("unable to add the invoice: %s", err)
+	}
+
+	if _, err = testDB.AddInvoice(ctx, invoice); !errors.Is(err, suberrors.ErrInvoiceExists) {
+		t.Errorf("expected ErrInvoiceExists for the same period, got %v", err)
+	}
+
+	checkInvoice := func(t *testing.T, actual *Invoice) {
+		t.Helper()
+
+		if actual == nil {
+			t.Fatal("the invoice wasn't found")
+		}
+		if actual.ID != id || actual.Total != invoice.Total || !actual.PeriodStart.Equal(periodStart) {
+			t.Errorf("the invoice wasn't stored correctly: %+v", actual)
+		}
+		if len(actual.LineItems) != len(invoice.LineItems) {
+			t.Fatalf("expected %d line items, got %+v", len(invoice.LineItems), actual.LineItems)
+		}
+		for i, item := range actual.LineItems {
+			expected := invoice.LineItems[i]
+			if item.Position != int32(i) || item.ItemType != expected.ItemType || item.Amount != expected.Amount ||
+				item.SubscriptionAddonID != expected.SubscriptionAddonID {
+				t.Errorf("expected line item %d to be %+v, got %+v", i, expected, item)
+			}
+		}
+	}
+
+	loaded, err := testDB.GetInvoice(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the invoice: %s", err)
+	}
+	checkInvoice(t, loaded)
+
+	loaded, err = testDB.GetInvoiceForPeriod(ctx, subscription.ID, periodStart, periodEnd)
+	if err != nil {
+		t.Fatalf("unable to look up the invoice for the period: %s", err)
+	}
+	checkInvoice(t, loaded)
+
+	// Invoices without line items can be added as well.
+	next := *invoice
+	next.PeriodStart, next.PeriodEnd = periodEnd, periodEnd.AddDate(0, 1, 0)
+	next.LineItems = nil
+	if _, err = testDB.AddInvoice(ctx, &next); err != nil {
+		t.Fatalf("unable to add the next invoice: %s", err)
+	}
+
+	invoices, err := testDB.ListInvoices(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the invoices: %s", err)
+	}
+	if len(invoices) != 2 {
+		t.Fatalf("expected 2 invoices, got %+v", invoices)
+	}
+	checkInvoice(t, &invoices[0])
+	if len(invoices[1].LineItems) != 0 {
+		t.Errorf("expected the second invoice not to have line items, got %+v", invoices[1].LineItems)
+	}
+
+	missing, err := testDB.GetInvoiceForPeriod(ctx, subscription.ID, periodStart.AddDate(-1, 0, 0), periodStart)
+	if err != nil {
+		t.Fatalf("unable to look up a missing invoice: %s", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no invoice, got %s", missing.ID)
+	}
+}
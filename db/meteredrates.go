@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// MeteredRate is the price of each unit of a resource that's used beyond the
+// user's quota, starting at its effective date.
+type MeteredRate struct {
+	ID            string       `db:"id" goqu:"defaultifempty"`
+	ResourceType  ResourceType `db:"resource_types"`
+	EffectiveDate time.Time    `db:"effective_date"`
+	Rate          float64      `db:"rate"`
+	CreatedBy     string       `db:"created_by"`
+	CreatedAt     time.Time    `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the metered rate to the type used in responses.
+func (r *MeteredRate) ToAPIType() *api.MeteredRate {
+	return &api.MeteredRate{
+		ID:            r.ID,
+		ResourceName:  r.ResourceType.Name,
+		Unit:          r.ResourceType.Unit,
+		EffectiveDate: r.EffectiveDate,
+		Rate:          r.Rate,
+		CreatedBy:     r.CreatedBy,
+		CreatedAt:     r.CreatedAt,
+	}
+}
+
+// AddMeteredRate adds a metered rate for a resource type, replacing any rate for
+// the same resource type with the same effective date, and returns its ID. The
+// resource type must be set in the rate. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddMeteredRate(ctx context.Context, rate *MeteredRate, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.MeteredRates).
+		Rows(goqu.Record{
+			"resource_type_id": rate.ResourceType.ID,
+			"effective_date":   rate.EffectiveDate,
+			"rate":             rate.Rate,
+			"created_by":       rate.CreatedBy,
+		}).
+		OnConflict(goqu.DoUpdate("resource_type_id, effective_date", goqu.Record{
+			"rate":       goqu.I("excluded.rate"),
+			"created_by": goqu.I("excluded.created_by"),
+			"created_at": CurrentTimestamp,
+		})).
+		Returning(t.MeteredRates.Col("id"), t.MeteredRates.Col("created_at"))
+	d.LogSQL(ds)
+
+	var result struct {
+		ID        string    `db:"id"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	if _, err := ds.Executor().ScanStructContext(ctx, &result); err != nil {
+		return "", errors.Wrapf(err, "unable to add the metered rate for %s", rate.ResourceType.Name)
+	}
+	rate.ID = result.ID
+	rate.CreatedAt = result.CreatedAt
+
+	return result.ID, nil
+}
+
+// CurrentMeteredRates returns the metered rate in effect at the given time for
+// each resource type that has one, keyed by resource type name. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) CurrentMeteredRates(ctx context.Context, asOf time.Time, opts ...QueryOption) (map[string]MeteredRate, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.MeteredRates).
+		Join(t.ResourceTypes, goqu.On(t.MeteredRates.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+		Select(
+			t.MeteredRates.Col("id"),
+			t.ResourceTypes.Col("id").As(goqu.C("resource_types.id")),
+			t.ResourceTypes.Col("name").As(goqu.C("resource_types.name")),
+			t.ResourceTypes.Col("unit").As(goqu.C("resource_types.unit")),
+			t.ResourceTypes.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.MeteredRates.Col("effective_date"),
+			t.MeteredRates.Col("rate"),
+			t.MeteredRates.Col("created_by"),
+			t.MeteredRates.Col("created_at"),
+		).
+		Distinct(t.MeteredRates.Col("resource_type_id")).
+		Where(t.MeteredRates.Col("effective_date").Lte(asOf)).
+		Order(t.MeteredRates.Col("resource_type_id").Asc(), t.MeteredRates.Col("effective_date").Desc())
+	d.LogSQL(ds)
+
+	var rates []MeteredRate
+	if err := ds.Executor().ScanStructsContext(ctx, &rates); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the current metered rates")
+	}
+
+	result := make(map[string]MeteredRate, len(rates))
+	for _, rate := range rates {
+		result[rate.ResourceType.Name] = rate
+	}
+
+	return result, nil
+}
@@ -0,0 +1,68 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMeteredRates(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	now := time.Now()
+	rates := []MeteredRate{
+		{ResourceType: compute, EffectiveDate: now.Add(-48 * time.Hour), Rate: 1, CreatedBy: "test"},
+		{ResourceType: compute, EffectiveDate: now.Add(-24 * time.Hour), Rate: 2, CreatedBy: "test"},
+		{ResourceType: compute, EffectiveDate: now.Add(24 * time.Hour), Rate: 3, CreatedBy: "test"},
+	}
+	for i := range rates {
+		if _, err := testDB.AddMeteredRate(ctx, &rates[i]); err != nil {
+			t.Fatalf("unable to add the metered rate: %s", err)
+		}
+	}
+
+	// Adding a rate with the same effective date replaces the existing one.
+	replacement := rates[1]
+	replacement.Rate = 4
+	id, err := testDB.AddMeteredRate(ctx, &replacement)
+	if err != nil {
+		t.Fatalf("unable to replace the metered rate: %s", err)
+	}
+	if id != rates[1].ID {
+		t.Errorf("expected the existing rate %s to be updated, got %s", rates[1].ID, id)
+	}
+
+	tests := []struct {
+		name     string
+		asOf     time.Time
+		expected float64
+	}{
+		{name: "before the first rate", asOf: now.Add(-72 * time.Hour)},
+		{name: "first rate", asOf: now.Add(-36 * time.Hour), expected: 1},
+		{name: "replaced rate", asOf: now, expected: 4},
+		{name: "future rate", asOf: now.Add(48 * time.Hour), expected: 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			current, err := testDB.CurrentMeteredRates(ctx, tc.asOf)
+			if err != nil {
+				t.Fatalf("unable to look up the current metered rates: %s", err)
+			}
+
+			rate, ok := current[compute.Name]
+			switch {
+			case tc.expected == 0 && ok:
+				t.Errorf("expected no rate, got %+v", rate)
+			case tc.expected != 0 && !ok:
+				t.Errorf("expected a rate of %f, got none", tc.expected)
+			case ok && (rate.Rate != tc.expected || rate.ResourceType != compute):
+				t.Errorf("expected a rate of %f for %s, got %+v", tc.expected, compute.Name, rate)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// OutboxEvent is a domain event that is waiting to be published.
+type OutboxEvent struct {
+	ID            string       `db:"id"`
+	EventType     string       `db:"event_type"`
+	SchemaVersion int          `db:"schema_version"`
+	Payload       string       `db:"payload"`
+	CreatedAt     time.Time    `db:"created_at" goqu:"defaultifempty"`
+	PublishedAt   sql.NullTime `db:"published_at"`
+}
+
+// AddOutboxEvent adds an event to the outbox. This should be called inside of
+// the transaction that makes the changes that the event describes, so that the
+// event is only published if the changes are committed. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddOutboxEvent(ctx context.Context, event *api.Event, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode the %s event", event.Type)
+	}
+
+	ds := db.Insert(t.EventOutbox).
+		Rows(goqu.Record{
+			"id":             event.ID,
+			"event_type":     event.Type,
+			"schema_version": event.SchemaVersion,
+			"payload":        string(payload),
+		})
+	d.LogSQL(ds)
+
+	if _, err = ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to add the %s event to the outbox", event.Type)
+	}
+
+	return nil
+}
+
+// recordEvent adds an event to the outbox if the WithOutbox option was passed
+// to the calling function. Otherwise, it does nothing.
+func (d *Database) recordEvent(ctx context.Context, querySettings *QuerySettings, eventType string, data any, opts ...QueryOption) error {
+	if !querySettings.outbox {
+		return nil
+	}
+	return d.AddOutboxEvent(ctx, api.NewEvent(eventType, data), opts...)
+}
+
+// UnpublishedOutboxEvents returns up to limit events that haven't been published
+// yet, oldest first. The events are locked until the transaction ends, and
+// events that are locked by other transactions are skipped, so that multiple
+// instances of the service can publish events at the same time. Must be called
+// with the WithTX option.
+func (d *Database) UnpublishedOutboxEvents(ctx context.Context, limit uint, opts ...QueryOption) ([]OutboxEvent, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.EventOutbox).
+		Select(
+			t.EventOutbox.Col("id"),
+			t.EventOutbox.Col("event_type"),
+			t.EventOutbox.Col("schema_version"),
+			t.EventOutbox.Col("payload"),
+			t.EventOutbox.Col("created_at"),
+			t.EventOutbox.Col("published_at"),
+		).
+		Where(t.EventOutbox.Col("published_at").IsNull()).
+		Order(t.EventOutbox.Col("created_at").Asc()).
+		Limit(limit).
+		ForUpdate(exp.SkipLocked)
+	d.LogSQL(ds)
+
+	var events []OutboxEvent
+	if err := ds.Executor().ScanStructsContext(ctx, &events); err != nil {
+		return nil, errors.Wrap(err, "unable to list the unpublished events")
+	}
+
+	return events, nil
+}
+
+// MarkOutboxEventsPublished records the time that events were published.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) MarkOutboxEventsPublished(ctx context.Context, ids []string, opts ...QueryOption) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, db := d.querySettings(opts...)
+
+	ds := db.Update(t.EventOutbox).
+		Set(goqu.Record{"published_at": CurrentTimestamp}).
+		Where(t.EventOutbox.Col("id").In(ids))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to mark the events as published")
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// outboxEventCounts returns the number of events of each type in the outbox
+// that refer to the subscription.
+func outboxEventCounts(t *testing.T, subscriptionID string) map[string]int {
+	t.Helper()
+
+	var eventTypes []string
+	err := testDB.fullDB.From("event_outbox").
+		Select("event_type").
+		Where(goqu.L("payload->'data'->>'subscription_uuid' = ?", subscriptionID)).
+		ScanValsContext(context.Background(), &eventTypes)
+	if err != nil {
+		t.Fatalf("unable to list the events for subscription %s: %s", subscriptionID, err)
+	}
+
+	counts := make(map[string]int)
+	for _, eventType := range eventTypes {
+		counts[eventType]++
+	}
+	return counts
+}
+
+func TestOutbox(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscriptionID := uniqueName("subscription")
+	event := api.NewEvent(api.EventSubscriptionCreated, &api.SubscriptionEventData{SubscriptionID: subscriptionID})
+	if err := testDB.AddOutboxEvent(ctx, event); err != nil {
+		t.Fatalf("unable to add the event: %s", err)
+	}
+	if counts := outboxEventCounts(t, subscriptionID); counts[api.EventSubscriptionCreated] != 1 {
+		t.Fatalf("expected the event to be added, got %v", counts)
+	}
+
+	// unpublishedIDs returns the IDs of the unpublished events. Other tests
+	// add events too, so the limit is high enough to include all of them.
+	unpublishedIDs := func() []string {
+		var ids []string
+		err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+			events, err := testDB.UnpublishedOutboxEvents(ctx, 100000, WithTX(tx))
+			for _, event := range events {
+				ids = append(ids, event.ID)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unable to list the unpublished events: %s", err)
+		}
+		return ids
+	}
+
+	if !slices.Contains(unpublishedIDs(), event.ID) {
+		t.Fatal("expected the event to be unpublished")
+	}
+	if err := testDB.MarkOutboxEventsPublished(ctx, []string{event.ID}); err != nil {
+		t.Fatalf("unable to mark the event as published: %s", err)
+	}
+	if slices.Contains(unpublishedIDs(), event.ID) {
+		t.Error("expected the event to be published")
+	}
+}
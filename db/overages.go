@@ -1,24 +1,20 @@
-// GetUserOverages returns a user's list of overages. Accepts a variable number
-// of QueryOptions, though only WithTX is currently supported.
 package db
 
 import (
 	"context"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
 )
 
-func (d *Database) GetUserOverages(ctx context.Context, username string, opts ...QueryOption) ([]Overage, error) {
-	var (
-		err      error
-		db       GoquDatabase
-		overages []Overage
-	)
-
-	_, db = d.querySettings(opts...)
-
-	query := db.From(t.Subscriptions).
+// overagesDS returns the dataset for listing the overages for the current
+// subscriptions, but without the conditions that select the users.
+// Subscriptions to quota-exempt plans never have overages.
+func overagesDS(db GoquDatabase, querySettings *QuerySettings) *goqu.SelectDataset {
+	return db.From(t.Subscriptions).
 		Select(
 			t.Subscriptions.Col("id").As("subscription_id"),
 
@@ -35,6 +31,8 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 
 			t.Quotas.Col("quota").As("quota_value"),
 			t.Usages.Col("usage").As("usage_value"),
+			remainingExp(t.Quotas.Col("quota"), t.Usages.Col("usage")).As("remaining"),
+			percentUsedExp(t.Quotas.Col("quota"), t.Usages.Col("usage")).As("percent_used"),
 		).
 		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
 		Join(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id")))).
@@ -42,17 +40,41 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 		Join(t.Usages, goqu.On(t.Subscriptions.Col("id").Eq(t.Usages.Col("subscription_id")))).
 		Join(t.ResourceTypes, goqu.On(t.Usages.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
 		Where(goqu.And(
-			t.Users.Col("username").Eq(username),
-			goqu.Or(
-				CurrentTimestamp.Between(goqu.Range(t.Subscriptions.Col("effective_start_date"), t.Subscriptions.Col("effective_end_date"))),
-				goqu.And(
-					CurrentTimestamp.Gt(t.Subscriptions.Col("effective_start_date")),
-					t.Subscriptions.Col("effective_end_date").IsNull(),
-				),
-			),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
 			t.Usages.Col("resource_type_id").Eq(t.Quotas.Col("resource_type_id")),
 			t.Usages.Col("usage").Gte(t.Quotas.Col("quota")),
-		)).Executor()
+			notQuotaExemptExp(),
+		))
+}
+
+// GetUserOverages returns a user's list of overages. Accepts a variable number
+// of QueryOptions, though only WithTX, WithReadReplica, WithEffectiveDate,
+// WithGracePeriod and WithGroupSubscriptions are currently supported. If
+// WithGroupSubscriptions is used and the user doesn't have a subscription, the
+// overages of the group subscription that the user draws on are returned.
+func (d *Database) GetUserOverages(ctx context.Context, username string, opts ...QueryOption) ([]Overage, error) {
+	var (
+		err      error
+		overages []Overage
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	owner := username
+	if querySettings.groups {
+		subscription, err := d.GetActiveSubscription(ctx, username, opts...)
+		if err != nil && err != suberrors.ErrSubscriptionNotFound {
+			return nil, err
+		}
+		if subscription != nil {
+			owner = subscription.User.Username
+		}
+	}
+
+	query := overagesDS(db, querySettings).
+		Where(t.Users.Col("username").Eq(owner)).
+		Executor()
 
 	if err = query.ScanStructsContext(ctx, &overages); err != nil {
 		return nil, err
@@ -60,3 +82,91 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 
 	return overages, nil
 }
+
+// ListOverages returns the overages of every user, in order by username and
+// resource type name. Test accounts are left out, since this is a report.
+// Accepts a variable number of QueryOptions, though only WithTX,
+// WithReadReplica, WithEffectiveDate and WithGracePeriod are currently
+// supported.
+func (d *Database) ListOverages(ctx context.Context, opts ...QueryOption) ([]Overage, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := overagesDS(db, querySettings).
+		Where(t.Users.Col("test").IsFalse()).
+		Order(t.Users.Col("username").Asc(), t.ResourceTypes.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var overages []Overage
+	if err := ds.Executor().ScanStructsContext(ctx, &overages); err != nil {
+		return nil, errors.Wrap(err, "unable to list the overages")
+	}
+
+	return overages, nil
+}
+
+// OverageReportRow summarizes the overages for a plan and resource type. The
+// amounts are the differences between usage and quota for the users who have
+// reached their quotas.
+type OverageReportRow struct {
+	PlanName     string  `db:"plan_name"`
+	ResourceName string  `db:"resource_name"`
+	ResourceUnit string  `db:"resource_unit"`
+	Users        int64   `db:"users"`
+	MedianAmount float64 `db:"p50_amount"`
+	P95Amount    float64 `db:"p95_amount"`
+	MaxAmount    float64 `db:"max_amount"`
+}
+
+// OverageReport returns the number of users who have reached their quotas for
+// each plan and resource type, along with the distribution of the amounts by
+// which they've exceeded them. Only current subscriptions are included, and
+// test accounts and quota-exempt plans are left out. If planName is empty,
+// every plan is included. Accepts a variable number of QueryOptions, though
+// only WithTX, WithReadReplica, WithEffectiveDate, WithGracePeriod and
+// WithSubscriptionTag are currently supported.
+func (d *Database) OverageReport(ctx context.Context, planName string, opts ...QueryOption) ([]OverageReportRow, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	where := []exp.Expression{
+		subscriptionPeriodExp(querySettings),
+		querySettings.tenantExp(t.Subscriptions),
+		t.Users.Col("test").IsFalse(),
+		t.Usages.Col("usage").Gte(t.Quotas.Col("quota")),
+		notQuotaExemptExp(),
+		querySettings.tagExp(db, t.Subscriptions.Col("id")),
+	}
+	if planName != "" {
+		where = append(where, t.Plans.Col("name").Eq(planName))
+	}
+
+	amount := goqu.L("? - ?", t.Usages.Col("usage"), t.Quotas.Col("quota"))
+	ds := db.From(t.Subscriptions).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Join(t.Quotas, goqu.On(t.Subscriptions.Col("id").Eq(t.Quotas.Col("subscription_id")))).
+		Join(t.Usages, goqu.On(goqu.And(
+			t.Subscriptions.Col("id").Eq(t.Usages.Col("subscription_id")),
+			t.Usages.Col("resource_type_id").Eq(t.Quotas.Col("resource_type_id")),
+		))).
+		Join(t.ResourceTypes, goqu.On(t.Usages.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+		Select(
+			t.Plans.Col("name").As("plan_name"),
+			t.ResourceTypes.Col("name").As("resource_name"),
+			t.ResourceTypes.Col("unit").As("resource_unit"),
+			goqu.L("count(DISTINCT ?)", t.Users.Col("id")).As("users"),
+			goqu.L("percentile_cont(0.5) WITHIN GROUP (ORDER BY ?)", amount).As("p50_amount"),
+			goqu.L("percentile_cont(0.95) WITHIN GROUP (ORDER BY ?)", amount).As("p95_amount"),
+			goqu.MAX(amount).As("max_amount"),
+		).
+		Where(where...).
+		GroupBy(t.Plans.Col("name"), t.ResourceTypes.Col("name"), t.ResourceTypes.Col("unit")).
+		Order(t.Plans.Col("name").Asc(), t.ResourceTypes.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var rows []OverageReportRow
+	if err := ds.Executor().ScanStructsContext(ctx, &rows); err != nil {
+		return nil, errors.Wrap(err, "unable to compute the overage report")
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,85 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestOverages(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	plan := addTestPlan(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+
+	// Each subscription is given the usage in the map.
+	usages := map[string]float64{"over": 15, "further over": 12, "under": 5, "test": 100}
+	subscriptions := make(map[string]*Subscription, len(usages))
+	for name, usage := range usages {
+		subscription := subscribeTestUser(t, addTestUser(t), plan, nil)
+		if _, _, err := testDB.ApplyUsage(ctx, UpdateTypeSet, usage, compute.ID, subscription.ID); err != nil {
+			t.Fatalf("unable to record the usage: %s", err)
+		}
+		subscriptions[name] = subscription
+	}
+	if err := testDB.SetTestUser(ctx, subscriptions["test"].User.Username, true); err != nil {
+		t.Fatalf("unable to mark the user as a test user: %s", err)
+	}
+
+	t.Run("user", func(t *testing.T) {
+		overages, err := testDB.GetUserOverages(ctx, subscriptions["over"].User.Username)
+		if err != nil {
+			t.Fatalf("unable to look up the user's overages: %s", err)
+		}
+		if len(overages) != 1 {
+			t.Fatalf("expected a single overage, got %+v", overages)
+		}
+		overage := overages[0]
+		if overage.SubscriptionID != subscriptions["over"].ID || overage.ResourceType.ID != compute.ID ||
+			overage.QuotaValue != 10 || overage.UsageValue != 15 {
+			t.Errorf("the overage wasn't reported correctly: %+v", overage)
+		}
+
+		overages, err = testDB.GetUserOverages(ctx, subscriptions["under"].User.Username)
+		if err != nil {
+			t.Fatalf("unable to look up the user's overages: %s", err)
+		}
+		if len(overages) != 0 {
+			t.Errorf("expected no overages, got %+v", overages)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		overages, err := testDB.ListOverages(ctx)
+		if err != nil {
+			t.Fatalf("unable to list the overages: %s", err)
+		}
+
+		listed := make(map[string]bool)
+		for _, overage := range overages {
+			listed[overage.SubscriptionID] = true
+		}
+		for name, expected := range map[string]bool{"over": true, "further over": true, "under": false, "test": false} {
+			if listed[subscriptions[name].ID] != expected {
+				t.Errorf("expected the %s subscription to be listed: %t", name, expected)
+			}
+		}
+	})
+
+	t.Run("report", func(t *testing.T) {
+		rows, err := testDB.OverageReport(ctx, plan.Name)
+		if err != nil {
+			t.Fatalf("unable to compute the overage report: %s", err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected a single row, got %+v", rows)
+		}
+		row := rows[0]
+		if row.PlanName != plan.Name || row.ResourceName != compute.Name || row.Users != 2 ||
+			row.MedianAmount != 3.5 || row.MaxAmount != 5 {
+			t.Errorf("the overage report wasn't computed correctly: %+v", row)
+		}
+	})
+}
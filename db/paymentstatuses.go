@@ -0,0 +1,259 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// The payment statuses that a subscription can have.
+const (
+	PaymentStatusPending  = "pending"
+	PaymentStatusPaid     = "paid"
+	PaymentStatusFailed   = "failed"
+	PaymentStatusRefunded = "refunded"
+	PaymentStatusWaived   = "waived"
+)
+
+// paymentTransitions lists the statuses that each payment status can change
+// to. Refunds are final.
+var paymentTransitions = map[string][]string{
+	PaymentStatusPending:  {PaymentStatusPaid, PaymentStatusFailed, PaymentStatusWaived},
+	PaymentStatusFailed:   {PaymentStatusPending, PaymentStatusPaid, PaymentStatusWaived},
+	PaymentStatusPaid:     {PaymentStatusRefunded},
+	PaymentStatusWaived:   {PaymentStatusPending, PaymentStatusPaid},
+	PaymentStatusRefunded: {},
+}
+
+// ValidatePaymentStatus returns ErrInvalidPaymentStatus if the status isn't
+// recognized.
+func ValidatePaymentStatus(status string) error {
+	if _, ok := paymentTransitions[status]; !ok {
+		return suberrors.ErrInvalidPaymentStatus
+	}
+	return nil
+}
+
+// CanChangePaymentStatus returns true if a subscription can go from one
+// payment status to the other.
+func CanChangePaymentStatus(from, to string) bool {
+	for _, status := range paymentTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPaidStatus returns true if subscriptions with the payment status count as
+// paid for. Waived payments count as paid, since nothing more is owed.
+func IsPaidStatus(status string) bool {
+	return status == PaymentStatusPaid || status == PaymentStatusWaived
+}
+
+// PaymentStatus is the payment status of a subscription. The recorded status is
+// only set once the status has been changed. Until then, the status is derived
+// from the subscription's paid flag.
+type PaymentStatus struct {
+	SubscriptionID string         `db:"subscription_id"`
+	Paid           bool           `db:"paid"`
+	RecordedStatus sql.NullString `db:"status"`
+	UpdatedBy      sql.NullString `db:"updated_by"`
+	UpdatedAt      sql.NullTime   `db:"updated_at"`
+}
+
+// Status returns the current payment status of the subscription.
+func (s *PaymentStatus) Status() string {
+	if s.RecordedStatus.Valid {
+		return s.RecordedStatus.String
+	}
+	if s.Paid {
+		return PaymentStatusPaid
+	}
+	return PaymentStatusPending
+}
+
+// PaymentStatusChange records a change to the payment status of a
+// subscription.
+type PaymentStatusChange struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	SubscriptionID string         `db:"subscription_id"`
+	FromStatus     string         `db:"from_status"`
+	ToStatus       string         `db:"to_status"`
+	Reason         sql.NullString `db:"reason"`
+	ChangedBy      string         `db:"changed_by"`
+	ChangedAt      time.Time      `db:"changed_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the change to the type used in responses.
+func (c *PaymentStatusChange) ToAPIType() *api.PaymentStatusChange {
+	return &api.PaymentStatusChange{
+		ID:         c.ID,
+		FromStatus: c.FromStatus,
+		ToStatus:   c.ToStatus,
+		Reason:     c.Reason.String,
+		ChangedBy:  c.ChangedBy,
+		ChangedAt:  c.ChangedAt,
+	}
+}
+
+// paymentStatusDS returns the dataset used to look up the payment status of a
+// subscription. Subscriptions that belong to other tenants aren't found.
+func paymentStatusDS(db GoquDatabase, querySettings *QuerySettings, subscriptionID string) *goqu.SelectDataset {
+	return db.From(t.Subscriptions).
+		LeftJoin(t.PaymentStatuses, goqu.On(t.PaymentStatuses.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Select(
+			t.Subscriptions.Col("id").As("subscription_id"),
+			t.Subscriptions.Col("paid"),
+			t.PaymentStatuses.Col("status"),
+			t.PaymentStatuses.Col("updated_by"),
+			t.PaymentStatuses.Col("updated_at"),
+		).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID), querySettings.tenantExp(t.Subscriptions))
+}
+
+// GetPaymentStatus returns the payment status of a subscription, or nil if the
+// subscription doesn't exist. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetPaymentStatus(ctx context.Context, subscriptionID string, opts ...QueryOption) (*PaymentStatus, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := paymentStatusDS(db, querySettings, subscriptionID)
+	d.LogSQL(ds)
+
+	var status PaymentStatus
+	found, err := ds.Executor().ScanStructContext(ctx, &status)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the payment status of subscription %s", subscriptionID)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &status, nil
+}
+
+// SetPaymentStatus changes the payment status of a subscription, records the
+// change and updates the subscription's paid flag to match. The subscription is
+// locked while its status is changed so that concurrent changes are applied one
+// at a time. Setting the status that the subscription already has does nothing.
+// Returns the previous status. ErrSubscriptionNotFound is returned if the
+// subscription doesn't exist, and ErrInvalidPaymentTransition is returned if
+// the subscription can't go from its current status to the new one. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetPaymentStatus(ctx context.Context, change *PaymentStatusChange, opts ...QueryOption) (string, error) {
+	var previous string
+
+	querySettings := d.newQuerySettings(opts...)
+	err := d.inTxWithOpts(ctx, func(tx *goqu.TxDatabase) error {
+		ds := paymentStatusDS(tx, querySettings, change.SubscriptionID).ForUpdate(exp.Wait, t.Subscriptions)
+		d.LogSQL(ds)
+
+		var current PaymentStatus
+		found, err := ds.Executor().ScanStructContext(ctx, &current)
+		if err != nil {
+			return errors.Wrapf(err, "unable to lock subscription %s", change.SubscriptionID)
+		}
+		if !found {
+			return suberrors.ErrSubscriptionNotFound
+		}
+
+		previous = current.Status()
+		if previous == change.ToStatus {
+			return nil
+		}
+		if !CanChangePaymentStatus(previous, change.ToStatus) {
+			return suberrors.ErrInvalidPaymentTransition
+		}
+
+		upsert := tx.Insert(t.PaymentStatuses).
+			Rows(goqu.Record{
+				"subscription_id": change.SubscriptionID,
+				"status":          change.ToStatus,
+				"updated_by":      change.ChangedBy,
+			}).
+			OnConflict(goqu.DoUpdate("subscription_id", goqu.Record{
+				"status":     goqu.L("excluded.status"),
+				"updated_by": goqu.L("excluded.updated_by"),
+				"updated_at": goqu.L("now()"),
+			}))
+		d.LogSQL(upsert)
+		if _, err = upsert.Executor().ExecContext(ctx); err != nil {
+			return errors.Wrapf(err, "unable to set the payment status of subscription %s", change.SubscriptionID)
+		}
+
+		rec := goqu.Record{
+			"subscription_id": change.SubscriptionID,
+			"from_status":     previous,
+			"to_status":       change.ToStatus,
+			"changed_by":      change.ChangedBy,
+		}
+		if change.Reason.Valid {
+			rec["reason"] = change.Reason.String
+		}
+		history := tx.Insert(t.PaymentChanges).Rows(rec)
+		d.LogSQL(history)
+		if _, err = history.Executor().ExecContext(ctx); err != nil {
+			return errors.Wrapf(err, "unable to record the payment status change for subscription %s", change.SubscriptionID)
+		}
+
+		if paid := IsPaidStatus(change.ToStatus); paid != current.Paid {
+			update := tx.Update(t.Subscriptions).
+				Set(goqu.Record{
+					"paid":             paid,
+					"last_modified_by": change.ChangedBy,
+					"last_modified_at": goqu.L("now()"),
+				}).
+				Where(t.Subscriptions.Col("id").Eq(change.SubscriptionID))
+			d.LogSQL(update)
+			if _, err = update.Executor().ExecContext(ctx); err != nil {
+				return errors.Wrapf(err, "unable to update the paid flag of subscription %s", change.SubscriptionID)
+			}
+		}
+
+		return nil
+	}, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	return previous, nil
+}
+
+// ListPaymentStatusChanges returns the payment status changes of a
+// subscription, oldest first. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListPaymentStatusChanges(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]PaymentStatusChange, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.PaymentChanges).
+		Select(
+			t.PaymentChanges.Col("id"),
+			t.PaymentChanges.Col("subscription_id"),
+			t.PaymentChanges.Col("from_status"),
+			t.PaymentChanges.Col("to_status"),
+			t.PaymentChanges.Col("reason"),
+			t.PaymentChanges.Col("changed_by"),
+			t.PaymentChanges.Col("changed_at"),
+		).
+		Where(
+			t.PaymentChanges.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.PaymentChanges.Col("subscription_id")),
+		).
+		Order(t.PaymentChanges.Col("changed_at").Asc())
+	d.LogSQL(ds)
+
+	var changes []PaymentStatusChange
+	if err := ds.Executor().ScanStructsContext(ctx, &changes); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the payment status changes for subscription %s", subscriptionID)
+	}
+
+	return changes, nil
+}
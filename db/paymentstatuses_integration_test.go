@@ -0,0 +1,100 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestSetPaymentStatus(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+
+	// The status is derived from the paid flag until it's changed.
+	status, err := testDB.GetPaymentStatus(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the payment status: %s", err)
+	}
+	if status.Status() != PaymentStatusPending || status.RecordedStatus.Valid {
+		t.Errorf("expected an unrecorded pending status, got %+v", status)
+	}
+
+	steps := []struct {
+		to       string
+		previous string
+		paid     bool
+		err      error
+	}{
+		{to: PaymentStatusPaid, previous: PaymentStatusPending, paid: true},
+		{to: PaymentStatusPaid, previous: PaymentStatusPaid, paid: true},
+		{to: PaymentStatusPending, paid: true, err: suberrors.ErrInvalidPaymentTransition},
+		{to: PaymentStatusRefunded, previous: PaymentStatusPaid},
+	}
+	for _, step := range steps {
+		previous, err := testDB.SetPaymentStatus(ctx, &PaymentStatusChange{
+			SubscriptionID: subscription.ID,
+			ToStatus:       step.to,
+			Reason:         sql.NullString{String: "testing", Valid: true},
+			ChangedBy:      "test",
+		})
+		if step.err != nil {
+			if !errors.Is(err, step.err) {
+				t.Errorf("expected %v when changing to %s, got %v", step.err, step.to, err)
+			}
+		} else if err != nil {
+			t.Fatalf("unable to change the payment status to %s: %s", step.to, err)
+		} else if previous != step.previous {
+			t.Errorf("expected the previous status to be %s, got %s", step.previous, previous)
+		}
+
+		loaded, err := testDB.GetSubscriptionByID(ctx, subscription.ID)
+		if err != nil {
+			t.Fatalf("unable to look up the subscription: %s", err)
+		}
+		if loaded.Paid != step.paid {
+			t.Errorf("expected the paid flag to be %t after changing to %s, got %t", step.paid, step.to, loaded.Paid)
+		}
+	}
+
+	status, err = testDB.GetPaymentStatus(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the payment status: %s", err)
+	}
+	if status.Status() != PaymentStatusRefunded || status.UpdatedBy.String != "test" {
+		t.Errorf("expected a refunded status, got %+v", status)
+	}
+
+	// Setting the status that the subscription already has isn't recorded.
+	changes, err := testDB.ListPaymentStatusChanges(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the payment status changes: %s", err)
+	}
+	expected := [][2]string{
+		{PaymentStatusPending, PaymentStatusPaid},
+		{PaymentStatusPaid, PaymentStatusRefunded},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), changes)
+	}
+	for i, change := range changes {
+		if change.FromStatus != expected[i][0] || change.ToStatus != expected[i][1] || change.Reason.String != "testing" {
+			t.Errorf("expected a change from %s to %s, got %+v", expected[i][0], expected[i][1], change)
+		}
+	}
+
+	missing := "00000000-0000-0000-0000-000000000000"
+	_, err = testDB.SetPaymentStatus(ctx, &PaymentStatusChange{SubscriptionID: missing, ToStatus: PaymentStatusPaid, ChangedBy: "test"})
+	if !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound, got %v", err)
+	}
+	if status, err = testDB.GetPaymentStatus(ctx, missing); err != nil || status != nil {
+		t.Errorf("expected no payment status for a missing subscription, got %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// The possible states of a plan change.
+const (
+	PlanChangeStatusPending   = "pending"
+	PlanChangeStatusApplied   = "applied"
+	PlanChangeStatusCancelled = "cancelled"
+	PlanChangeStatusFailed    = "failed"
+)
+
+// PlanChange is a change to a different subscription plan that takes effect
+// when the subscription it refers to ends.
+type PlanChange struct {
+	ID                string         `db:"id" goqu:"defaultifempty"`
+	SubscriptionID    string         `db:"subscription_id"`
+	UserID            string         `db:"user_id"`
+	Username          string         `db:"username"`
+	PlanID            string         `db:"plan_id"`
+	PlanName          string         `db:"plan_name"`
+	PreviousPlanID    string         `db:"previous_plan_id"`
+	Paid              bool           `db:"paid"`
+	Periods           int32          `db:"periods"`
+	EndDate           sql.NullTime   `db:"end_date"`
+	EffectiveDate     time.Time      `db:"effective_date"`
+	Status            string         `db:"status"`
+	NewSubscriptionID sql.NullString `db:"new_subscription_id"`
+	ErrorMessage      sql.NullString `db:"error_message"`
+	CreatedBy         string         `db:"created_by"`
+	CreatedAt         time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt    time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the plan change to the type used in responses.
+func (c *PlanChange) ToAPIType() *api.PlanChange {
+	result := &api.PlanChange{
+		ID:                c.ID,
+		SubscriptionID:    c.SubscriptionID,
+		Username:          c.Username,
+		PlanName:          c.PlanName,
+		Paid:              c.Paid,
+		Periods:           c.Periods,
+		EffectiveDate:     c.EffectiveDate,
+		Status:            c.Status,
+		NewSubscriptionID: c.NewSubscriptionID.String,
+		ErrorMessage:      c.ErrorMessage.String,
+		CreatedBy:         c.CreatedBy,
+		CreatedAt:         c.CreatedAt,
+		LastModifiedAt:    c.LastModifiedAt,
+	}
+	if c.EndDate.Valid {
+		result.EndDate = &c.EndDate.Time
+	}
+	return result
+}
+
+// IsRenewal returns true if the plan change keeps the user on the same plan.
+func (c *PlanChange) IsRenewal() bool {
+	return c.PlanID == c.PreviousPlanID
+}
+
+// SubscriptionOptions returns the options for the subscription that's created
+// when the plan change is applied.
+func (c *PlanChange) SubscriptionOptions() *SubscriptionOptions {
+	opts := DefaultSubscriptionOptions()
+	opts.Paid = c.Paid
+	if c.Periods > 0 {
+		opts.Periods = c.Periods
+	}
+	if c.EndDate.Valid {
+		opts.EndDate = c.EndDate.Time
+	}
+	return opts
+}
+
+// planChangeDS returns the dataset used to look up plan changes.
+func planChangeDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.PendingChanges).
+		Join(t.Subscriptions, goqu.On(t.PendingChanges.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.PendingChanges.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			t.PendingChanges.Col("id"),
+			t.PendingChanges.Col("subscription_id"),
+			t.Users.Col("id").As("user_id"),
+			t.Users.Col("username"),
+			t.PendingChanges.Col("plan_id"),
+			t.Plans.Col("name").As("plan_name"),
+			t.Subscriptions.Col("plan_id").As("previous_plan_id"),
+			t.PendingChanges.Col("paid"),
+			t.PendingChanges.Col("periods"),
+			t.PendingChanges.Col("end_date"),
+			endDateExp(t.Subscriptions).As("effective_date"),
+			t.PendingChanges.Col("status"),
+			t.PendingChanges.Col("new_subscription_id"),
+			t.PendingChanges.Col("error_message"),
+			t.PendingChanges.Col("created_by"),
+			t.PendingChanges.Col("created_at"),
+			t.PendingChanges.Col("last_modified_at"),
+		)
+}
+
+// AddPlanChange schedules a plan change and returns its ID. Returns
+// ErrPlanChangeExists if a change is already pending for the subscription.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) AddPlanChange(ctx context.Context, change *PlanChange, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, change.SubscriptionID); err != nil {
+		return "", err
+	}
+
+	rec := goqu.Record{
+		"subscription_id": change.SubscriptionID,
+		"plan_id":         change.PlanID,
+		"paid":            change.Paid,
+		"periods":         change.Periods,
+		"created_by":      change.CreatedBy,
+	}
+	if change.EndDate.Valid {
+		rec["end_date"] = change.EndDate.Time
+	}
+
+	ds := db.Insert(t.PendingChanges).Rows(rec).Returning(t.PendingChanges.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrPlanChangeExists
+		}
+		return "", errors.Wrap(err, "unable to schedule the plan change")
+	}
+
+	return id, nil
+}
+
+// GetPlanChange returns the plan change with the given ID. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) GetPlanChange(ctx context.Context, id string, opts ...QueryOption) (*PlanChange, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := planChangeDS(db).Where(t.PendingChanges.Col("id").Eq(id), querySettings.tenantExp(t.Subscriptions))
+	d.LogSQL(ds)
+
+	var change PlanChange
+	found, err := ds.Executor().ScanStructContext(ctx, &change)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up plan change %s", id)
+	}
+	if !found {
+		return nil, suberrors.ErrPlanChangeNotFound
+	}
+
+	return &change, nil
+}
+
+// ListPlanChangesForUser returns all of the plan changes scheduled for a user,
+// most recent first. Accepts a variable number of QueryOptions, though only
+// WithTX and WithReadReplica are currently supported.
+func (d *Database) ListPlanChangesForUser(ctx context.Context, username string, opts ...QueryOption) ([]PlanChange, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := planChangeDS(db).
+		Where(t.Users.Col("username").Eq(username), querySettings.tenantExp(t.Subscriptions)).
+		Order(t.PendingChanges.Col("created_at").Desc())
+	d.LogSQL(ds)
+
+	var changes []PlanChange
+	if err := ds.Executor().ScanStructsContext(ctx, &changes); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the plan changes for %s", username)
+	}
+
+	return changes, nil
+}
+
+// DuePlanChanges returns the IDs of pending plan changes for subscriptions that
+// have ended. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) DuePlanChanges(ctx context.Context, limit uint, opts ...QueryOption) ([]string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.PendingChanges).
+		Join(t.Subscriptions, goqu.On(t.PendingChanges.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Select(t.PendingChanges.Col("id")).
+		Where(
+			t.PendingChanges.Col("status").Eq(PlanChangeStatusPending),
+			t.Subscriptions.Col("effective_end_date").Lte(CurrentTimestamp),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		Order(t.Subscriptions.Col("effective_end_date").Asc()).
+		Limit(limit)
+	d.LogSQL(ds)
+
+	var ids []string
+	if err := ds.Executor().ScanValsContext(ctx, &ids); err != nil {
+		return nil, errors.Wrap(err, "unable to list the plan changes that are due")
+	}
+
+	return ids, nil
+}
+
+// LockPendingPlanChange locks a plan change for the rest of the transaction if
+// it's still pending and nothing else has locked it. Returns nil if the plan
+// change can't be locked. Only WithTX is currently supported, and a transaction
+// is required for the lock to be useful.
+func (d *Database) LockPendingPlanChange(ctx context.Context, id string, opts ...QueryOption) (*PlanChange, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := planChangeDS(db).
+		Where(
+			t.PendingChanges.Col("id").Eq(id),
+			t.PendingChanges.Col("status").Eq(PlanChangeStatusPending),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		ForUpdate(exp.SkipLocked, t.PendingChanges)
+	d.LogSQL(ds)
+
+	var change PlanChange
+	found, err := ds.Executor().ScanStructContext(ctx, &change)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to lock plan change %s", id)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &change, nil
+}
+
+// setPlanChangeStatus updates the status of a plan change that's still pending,
+// along with any other columns in rec. Returns ErrPlanChangeNotFound if the plan
+// change doesn't exist or isn't pending.
+func (d *Database) setPlanChangeStatus(ctx context.Context, id, status string, rec goqu.Record, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	rec["status"] = status
+	rec["last_modified_at"] = CurrentTimestamp
+
+	ds := db.Update(t.PendingChanges).
+		Set(rec).
+		Where(
+			t.PendingChanges.Col("id").Eq(id),
+			t.PendingChanges.Col("status").Eq(PlanChangeStatusPending),
+			querySettings.subscriptionTenantExp(db, t.PendingChanges.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to mark plan change %s as %s", id, status)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+	if rowsAffected == 0 {
+		return suberrors.ErrPlanChangeNotFound
+	}
+
+	return nil
+}
+
+// CancelPlanChange cancels a pending plan change. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) CancelPlanChange(ctx context.Context, id string, opts ...QueryOption) error {
+	return d.setPlanChangeStatus(ctx, id, PlanChangeStatusCancelled, goqu.Record{}, opts...)
+}
+
+// CompletePlanChange records that a plan change was applied by creating the
+// subscription with the given ID. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) CompletePlanChange(ctx context.Context, id, newSubscriptionID string, opts ...QueryOption) error {
+	return d.setPlanChangeStatus(ctx, id, PlanChangeStatusApplied, goqu.Record{
+		"new_subscription_id": newSubscriptionID,
+	}, opts...)
+}
+
+// FailPlanChange records that a plan change couldn't be applied so that it
+// isn't attempted again. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) FailPlanChange(ctx context.Context, id, message string, opts ...QueryOption) error {
+	return d.setPlanChangeStatus(ctx, id, PlanChangeStatusFailed, goqu.Record{
+		"error_message": message,
+	}, opts...)
+}
+
+// CancelPlanChangesForSubscription cancels the plan change that's pending for a
+// subscription, if there is one. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) CancelPlanChangesForSubscription(ctx context.Context, subscriptionID string, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.PendingChanges).
+		Set(goqu.Record{
+			"status":           PlanChangeStatusCancelled,
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(
+			t.PendingChanges.Col("subscription_id").Eq(subscriptionID),
+			t.PendingChanges.Col("status").Eq(PlanChangeStatusPending),
+			querySettings.subscriptionTenantExp(db, t.PendingChanges.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to cancel the plan changes for subscription %s", subscriptionID)
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// addTestPlanChange schedules a change of the subscription to a new plan.
+func addTestPlanChange(t *testing.T, subscription *Subscription) *PlanChange {
+	t.Helper()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	id, err := testDB.AddPlanChange(ctx, &PlanChange{
+		SubscriptionID: subscription.ID,
+		PlanID:         plan.ID,
+		Paid:           true,
+		Periods:        2,
+		CreatedBy:      "test",
+	})
+	if err != nil {
+		t.Fatalf("unable to schedule the plan change: %s", err)
+	}
+
+	change, err := testDB.GetPlanChange(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up plan change %s: %s", id, err)
+	}
+	return change
+}
+
+func TestAddPlanChange(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	change := addTestPlanChange(t, subscription)
+
+	if change.Username != subscription.User.Username || change.PreviousPlanID != subscription.Plan.ID ||
+		change.Status != PlanChangeStatusPending || !change.EffectiveDate.Equal(subscription.EffectiveEndDate) {
+		t.Errorf("the plan change wasn't stored correctly: %+v", change)
+	}
+	if change.IsRenewal() {
+		t.Error("expected a change to a different plan not to be a renewal")
+	}
+
+	_, err := testDB.AddPlanChange(ctx, &PlanChange{SubscriptionID: subscription.ID, PlanID: change.PlanID, CreatedBy: "test"})
+	if !errors.Is(err, suberrors.ErrPlanChangeExists) {
+		t.Errorf("expected ErrPlanChangeExists for a second pending change, got %v", err)
+	}
+
+	changes, err := testDB.ListPlanChangesForUser(ctx, subscription.User.Username)
+	if err != nil {
+		t.Fatalf("unable to list the plan changes: %s", err)
+	}
+	if len(changes) != 1 || changes[0].ID != change.ID {
+		t.Errorf("expected only plan change %s, got %+v", change.ID, changes)
+	}
+
+	if _, err = testDB.GetPlanChange(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, suberrors.ErrPlanChangeNotFound) {
+		t.Errorf("expected ErrPlanChangeNotFound, got %v", err)
+	}
+}
+
+func TestPlanChangeStatus(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		finish   func(t *testing.T, id string) error
+		expected string
+	}{
+		{
+			name:     "cancel",
+			finish:   func(t *testing.T, id string) error { return testDB.CancelPlanChange(ctx, id) },
+			expected: PlanChangeStatusCancelled,
+		},
+		{
+			name: "complete",
+			finish: func(t *testing.T, id string) error {
+				return testDB.CompletePlanChange(ctx, id, addTestSubscription(t).ID)
+			},
+			expected: PlanChangeStatusApplied,
+		},
+		{
+			name:     "fail",
+			finish:   func(t *testing.T, id string) error { return testDB.FailPlanChange(ctx, id, "failed") },
+			expected: PlanChangeStatusFailed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			change := addTestPlanChange(t, addTestSubscription(t))
+			if err := tc.finish(t, change.ID); err != nil {
+				t.Fatalf("unable to update the plan change: %s", err)
+			}
+
+			updated, err := testDB.GetPlanChange(ctx, change.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the plan change: %s", err)
+			}
+			if updated.Status != tc.expected {
+				t.Errorf("expected the status to be %s, got %s", tc.expected, updated.Status)
+			}
+
+			// Only pending plan changes can be updated.
+			if err = tc.finish(t, change.ID); !errors.Is(err, suberrors.ErrPlanChangeNotFound) {
+				t.Errorf("expected ErrPlanChangeNotFound for a plan change that isn't pending, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelPlanChangesForSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	change := addTestPlanChange(t, subscription)
+	if err := testDB.CancelPlanChangesForSubscription(ctx, subscription.ID); err != nil {
+		t.Fatalf("unable to cancel the plan changes: %s", err)
+	}
+
+	updated, err := testDB.GetPlanChange(ctx, change.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the plan change: %s", err)
+	}
+	if updated.Status != PlanChangeStatusCancelled {
+		t.Errorf("expected the plan change to be cancelled, got %s", updated.Status)
+	}
+
+	// Another change can be scheduled once the first one is cancelled.
+	addTestPlanChange(t, subscription)
+}
+
+func TestDuePlanChanges(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	ended := addTestSubscription(t)
+	due := addTestPlanChange(t, ended)
+	if err := testDB.EndSubscription(ctx, ended.ID, "test"); err != nil {
+		t.Fatalf("unable to end the subscription: %s", err)
+	}
+	notDue := addTestPlanChange(t, addTestSubscription(t))
+
+	ids, err := testDB.DuePlanChanges(ctx, 100000)
+	if err != nil {
+		t.Fatalf("unable to list the plan changes that are due: %s", err)
+	}
+	if !slices.Contains(ids, due.ID) {
+		t.Errorf("expected plan change %s to be due", due.ID)
+	}
+	if slices.Contains(ids, notDue.ID) {
+		t.Errorf("expected plan change %s not to be due", notDue.ID)
+	}
+}
+
+func TestLockPendingPlanChange(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	change := addTestPlanChange(t, addTestSubscription(t))
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		t.Fatalf("unable to begin a transaction: %s", err)
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	locked, err := testDB.LockPendingPlanChange(ctx, change.ID, WithTX(tx))
+	if err != nil {
+		t.Fatalf("unable to lock the plan change: %s", err)
+	}
+	if locked == nil || locked.ID != change.ID {
+		t.Fatalf("expected plan change %s to be locked, got %+v", change.ID, locked)
+	}
+
+	// Plan changes that are locked elsewhere are skipped.
+	err = testDB.InTx(ctx, func(other *goqu.TxDatabase) error {
+		skipped, err := testDB.LockPendingPlanChange(ctx, change.ID, WithTX(other))
+		if err != nil {
+			return err
+		}
+		if skipped != nil {
+			t.Errorf("expected the locked plan change to be skipped, got %+v", skipped)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to try to lock the plan change: %s", err)
+	}
+
+	if err = testDB.CancelPlanChange(ctx, change.ID, WithTX(tx)); err != nil {
+		t.Fatalf("unable to cancel the plan change: %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("unable to commit the transaction: %s", err)
+	}
+
+	// Plan changes that aren't pending can't be locked.
+	locked, err = testDB.LockPendingPlanChange(ctx, change.ID)
+	if err != nil {
+		t.Fatalf("unable to try to lock the plan change: %s", err)
+	}
+	if locked != nil {
+		t.Errorf("expected a cancelled plan change not to be locked, got %+v", locked)
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// PlanFeature is a feature that a plan gives its subscribers access to.
+type PlanFeature struct {
+	PlanID    string    `db:"plan_id"`
+	Feature   string    `db:"feature"`
+	CreatedBy string    `db:"created_by"`
+	CreatedAt time.Time `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the plan feature to the type used in responses.
+func (f *PlanFeature) ToAPIType() *api.PlanFeature {
+	return &api.PlanFeature{
+		Feature:   f.Feature,
+		CreatedBy: f.CreatedBy,
+		CreatedAt: f.CreatedAt,
+	}
+}
+
+// ListPlanFeatures returns the features of a plan, in order by name. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ListPlanFeatures(ctx context.Context, planID string, opts ...QueryOption) ([]PlanFeature, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.PlanFeatures).
+		Select(
+			t.PlanFeatures.Col("plan_id"),
+			t.PlanFeatures.Col("feature"),
+			t.PlanFeatures.Col("created_by"),
+			t.PlanFeatures.Col("created_at"),
+		).
+		Where(
+			t.PlanFeatures.Col("plan_id").Eq(planID),
+			querySettings.planTenantExp(db, t.PlanFeatures.Col("plan_id")),
+		).
+		Order(t.PlanFeatures.Col("feature").Asc())
+	d.LogSQL(ds)
+
+	var features []PlanFeature
+	if err := ds.Executor().ScanStructsContext(ctx, &features); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the features of plan %s", planID)
+	}
+
+	return features, nil
+}
+
+// AddPlanFeature gives the subscribers to a plan access to a feature. Adding a
+// feature that the plan already has does nothing. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddPlanFeature(ctx context.Context, feature *PlanFeature, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkPlanTenant(ctx, db, querySettings, feature.PlanID); err != nil {
+		return err
+	}
+
+	ds := db.Insert(t.PlanFeatures).
+		Rows(goqu.Record{
+			"plan_id":    feature.PlanID,
+			"feature":    feature.Feature,
+			"created_by": feature.CreatedBy,
+		}).
+		OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to add feature %s to plan %s", feature.Feature, feature.PlanID)
+	}
+
+	return nil
+}
+
+// RemovePlanFeature takes a feature away from a plan. It returns false if the
+// plan doesn't have the feature. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) RemovePlanFeature(ctx context.Context, planID, feature string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkPlanTenant(ctx, db, querySettings, planID); err != nil {
+		return false, err
+	}
+
+	count, err := d.deleteRows(
+		ctx, db, t.PlanFeatures,
+		t.PlanFeatures.Col("plan_id").Eq(planID),
+		t.PlanFeatures.Col("feature").Eq(feature),
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove feature %s from plan %s", feature, planID)
+	}
+
+	return count > 0, nil
+}
+
+// PlanHasFeature returns true if a plan gives its subscribers access to a
+// feature. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) PlanHasFeature(ctx context.Context, planID, feature string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	features := db.From(t.PlanFeatures).
+		Select(goqu.L("1")).
+		Where(
+			t.PlanFeatures.Col("plan_id").Eq(planID),
+			querySettings.planTenantExp(db, t.PlanFeatures.Col("plan_id")),
+			t.PlanFeatures.Col("feature").Eq(feature),
+		)
+
+	ds := db.Select(goqu.L("EXISTS ?", features))
+	d.LogSQL(ds)
+
+	var found bool
+	if _, err := ds.Executor().ScanValContext(ctx, &found); err != nil {
+		return false, errors.Wrapf(err, "unable to determine whether plan %s has feature %s", planID, feature)
+	}
+
+	return found, nil
+}
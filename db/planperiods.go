@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The units that subscription periods can be measured in.
+const (
+	PeriodUnitMonthly   = "monthly"
+	PeriodUnitQuarterly = "quarterly"
+	PeriodUnitYearly    = "yearly"
+	PeriodUnitDays      = "days"
+)
+
+// SubscriptionPeriod is the length of a single subscription period. The number
+// of days is only used if the unit is PeriodUnitDays.
+type SubscriptionPeriod struct {
+	Unit string `db:"period_unit"`
+	Days int32  `db:"period_days"`
+}
+
+// DefaultSubscriptionPeriod returns the period used for plans that don't have
+// one of their own.
+func DefaultSubscriptionPeriod() *SubscriptionPeriod {
+	return &SubscriptionPeriod{Unit: PeriodUnitYearly}
+}
+
+// ParseSubscriptionPeriod parses a period in the form used on the command line:
+// one of monthly, quarterly or yearly, or a number of days such as 30d.
+func ParseSubscriptionPeriod(value string) (*SubscriptionPeriod, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	var period SubscriptionPeriod
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseInt(days, 10, 32)
+		if err != nil {
+			return nil, suberrors.ErrInvalidPeriod
+		}
+		period = SubscriptionPeriod{Unit: PeriodUnitDays, Days: int32(n)}
+	} else {
+		period = SubscriptionPeriod{Unit: value}
+	}
+
+	if err := period.Validate(); err != nil {
+		return nil, err
+	}
+	return &period, nil
+}
+
+// Validate returns ErrInvalidPeriod if the unit isn't recognized or a custom
+// period doesn't have a positive number of days.
+func (p *SubscriptionPeriod) Validate() error {
+	switch p.Unit {
+	case PeriodUnitMonthly, PeriodUnitQuarterly, PeriodUnitYearly:
+		return nil
+	case PeriodUnitDays:
+		if p.Days > 0 {
+			return nil
+		}
+	}
+	return suberrors.ErrInvalidPeriod
+}
+
+// EndDate returns the end of a subscription that starts at the given time and
+// lasts for the given number of periods. At least one period is always used.
+// Periods with unrecognized units are treated as years.
+func (p *SubscriptionPeriod) EndDate(start time.Time, periods int32) time.Time {
+	n := int(max(periods, 1))
+	switch p.Unit {
+	case PeriodUnitMonthly:
+		return start.AddDate(0, n, 0)
+	case PeriodUnitQuarterly:
+		return start.AddDate(0, 3*n, 0)
+	case PeriodUnitDays:
+		return start.AddDate(0, 0, int(p.Days)*n)
+	default:
+		return start.AddDate(n, 0, 0)
+	}
+}
+
+// GetPlanPeriod returns the subscription period of a plan. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) GetPlanPeriod(ctx context.Context, planID string, opts ...QueryOption) (*SubscriptionPeriod, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Plans).
+		Select(t.Plans.Col("period_unit"), t.Plans.Col("period_days")).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.sharedTenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	var period SubscriptionPeriod
+	found, err := ds.Executor().ScanStructContext(ctx, &period)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the subscription period for plan %s", planID)
+	}
+	if !found {
+		return nil, suberrors.ErrPlanNotFound
+	}
+
+	return &period, nil
+}
+
+// SetPlanPeriod changes the subscription period of a plan. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetPlanPeriod(ctx context.Context, planID string, period *SubscriptionPeriod, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	days := period.Days
+	if period.Unit != PeriodUnitDays {
+		days = 0
+	}
+
+	ds := db.Update(t.Plans).
+		Set(goqu.Record{
+			"period_unit": period.Unit,
+			"period_days": days,
+		}).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.tenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update the subscription period for plan %s", planID)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestPlanPeriod(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+
+	period, err := testDB.GetPlanPeriod(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the plan period: %s", err)
+	}
+	if *period != *DefaultSubscriptionPeriod() {
+		t.Errorf("expected new plans to use the default period, got %+v", period)
+	}
+
+	tests := []struct {
+		name     string
+		period   SubscriptionPeriod
+		expected SubscriptionPeriod
+	}{
+		{
+			name:     "days",
+			period:   SubscriptionPeriod{Unit: PeriodUnitDays, Days: 30},
+			expected: SubscriptionPeriod{Unit: PeriodUnitDays, Days: 30},
+		},
+		{
+			name:     "days are ignored for other units",
+			period:   SubscriptionPeriod{Unit: PeriodUnitMonthly, Days: 30},
+			expected: SubscriptionPeriod{Unit: PeriodUnitMonthly},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := testDB.SetPlanPeriod(ctx, plan.ID, &tc.period); err != nil {
+				t.Fatalf("unable to set the plan period: %s", err)
+			}
+
+			period, err := testDB.GetPlanPeriod(ctx, plan.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the plan period: %s", err)
+			}
+			if *period != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, *period)
+			}
+		})
+	}
+
+	if _, err = testDB.GetPlanPeriod(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, suberrors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/pkg/errors"
 )
@@ -20,6 +21,7 @@ func planQuotaDefaultsDS(db GoquDatabase, planID string) *goqu.SelectDataset {
 			t.RT.Col("id").As(goqu.C("resource_types.id")),
 			t.RT.Col("name").As(goqu.C("resource_types.name")),
 			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
 		).
 		Join(t.RT, goqu.On(t.PQD.Col("resource_type_id").Eq(t.RT.Col("id")))).
 		Where(t.PQD.Col("plan_id").Eq(planID)).
@@ -39,10 +41,13 @@ func planRatesDS(db GoquDatabase, planID string) *goqu.SelectDataset {
 
 func (d *Database) getPlanList(ctx context.Context, opts ...QueryOption) ([]Plan, error) {
 	wrapMsg := "unable to list the plans"
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
 	// Build the query.
-	query := db.From(t.Plans)
+	query := db.From(t.Plans).Where(qs.sharedTenantExp(t.Plans))
+	if !qs.includeDeleted {
+		query = query.Where(t.Plans.Col("deleted_at").IsNull())
+	}
 	d.LogSQL(query)
 
 	// Execute the query and scan the results.
@@ -121,10 +126,10 @@ func (d *Database) ListPlans(ctx context.Context, opts ...QueryOption) ([]Plan,
 
 func (d *Database) GetPlanByID(ctx context.Context, planID string, opts ...QueryOption) (*Plan, error) {
 	wrapMsg := fmt.Sprintf("unable to look up plan %s", planID)
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
 	// Build the query.
-	query := db.From(t.Plans).Where(t.Plans.Col("id").Eq(planID))
+	query := db.From(t.Plans).Where(t.Plans.Col("id").Eq(planID), qs.sharedTenantExp(t.Plans))
 	d.LogSQL(query)
 
 	// Execute the query and scan the results.
@@ -148,10 +153,14 @@ func (d *Database) GetPlanByID(ctx context.Context, planID string, opts ...Query
 
 func (d *Database) GetPlanByName(ctx context.Context, name string, opts ...QueryOption) (*Plan, error) {
 	wrapMsg := fmt.Sprintf("unable to look up plan %s", name)
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
-	// Build the query.
-	query := db.From(t.Plans).Where(t.Plans.Col("name").Eq(name))
+	// Build the query. Deleted plans can't be looked up by name unless they're
+	// explicitly requested, which prevents new subscriptions to them.
+	query := db.From(t.Plans).Where(t.Plans.Col("name").Eq(name), qs.sharedTenantExp(t.Plans))
+	if !qs.includeDeleted {
+		query = query.Where(t.Plans.Col("deleted_at").IsNull())
+	}
 	d.LogSQL(query)
 
 	// Execute the query and scan the results.
@@ -173,14 +182,44 @@ func (d *Database) GetPlanByName(ctx context.Context, name string, opts ...Query
 	return &plan, nil
 }
 
+// DeletePlan marks a plan as deleted. The plan is kept so that the
+// subscriptions that refer to it remain valid. Returns ErrPlanNotFound if the
+// plan doesn't exist or has already been deleted.
+func (d *Database) DeletePlan(ctx context.Context, planID string, opts ...QueryOption) error {
+	qs, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Plans).
+		Set(goqu.Record{"deleted_at": CurrentTimestamp}).
+		Where(
+			t.Plans.Col("id").Eq(planID),
+			t.Plans.Col("deleted_at").IsNull(),
+			qs.tenantExp(t.Plans),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to delete the plan")
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to delete the plan")
+	}
+	if count == 0 {
+		return suberrors.ErrPlanNotFound
+	}
+	return nil
+}
+
 func (d *Database) AddPlan(ctx context.Context, plan *Plan, opts ...QueryOption) (string, error) {
-	_, db := d.querySettings(opts...)
+	qs, db := d.querySettings(opts...)
 
 	ds := db.Insert(t.Plans).Rows(
-		goqu.Record{
+		qs.tenantRecord(goqu.Record{
 			"name":        plan.Name,
 			"description": plan.Description,
-		},
+		}),
 	).
 		Returning(t.Plans.Col("id")).
 		Executor()
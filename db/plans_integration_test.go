@@ -0,0 +1,175 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddPlan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	plan := addTestPlan(t,
+		PlanQuotaDefault{ResourceType: storage, QuotaValue: 5},
+		PlanQuotaDefault{ResourceType: compute, QuotaValue: 100},
+	)
+
+	if len(plan.QuotaDefaults) != 2 {
+		t.Fatalf("expected 2 quota defaults, got %d", len(plan.QuotaDefaults))
+	}
+	for _, quotaDefault := range plan.QuotaDefaults {
+		if quotaDefault.PlanID != plan.ID {
+			t.Errorf("expected the quota default to belong to plan %s, got %s", plan.ID, quotaDefault.PlanID)
+		}
+		if quotaDefault.ResourceType.Consumable != (quotaDefault.ResourceType.ID == compute.ID) {
+			t.Errorf("the consumable flag of %s wasn't loaded", quotaDefault.ResourceType.Name)
+		}
+	}
+	if len(plan.Rates) != 1 || plan.Rates[0].Rate != 100 {
+		t.Errorf("expected a single rate of 100, got %+v", plan.Rates)
+	}
+
+	byID, err := testDB.GetPlanByID(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to look up plan %s: %s", plan.ID, err)
+	}
+	if byID == nil || byID.Name != plan.Name || len(byID.QuotaDefaults) != 2 || len(byID.Rates) != 1 {
+		t.Errorf("expected plan %s with its details, got %+v", plan.Name, byID)
+	}
+
+	rates, err := testDB.SubscriptionPlanRates(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to list the plan rates: %s", err)
+	}
+	if len(rates) != 1 || rates[0].PlanID != plan.ID {
+		t.Errorf("expected a single rate for plan %s, got %+v", plan.ID, rates)
+	}
+
+	quotaDefaults, err := testDB.SubscriptionQuotaDefaults(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to list the plan quota defaults: %s", err)
+	}
+	if len(quotaDefaults) != 2 {
+		t.Errorf("expected 2 quota defaults, got %d", len(quotaDefaults))
+	}
+}
+
+func TestAddPlanMissingResourceType(t *testing.T) {
+	t.Parallel()
+
+	plan := &Plan{
+		Name:        uniqueName("plan"),
+		Description: "A plan with a quota default for a resource type that doesn't exist.",
+		QuotaDefaults: []PlanQuotaDefault{{
+			ResourceType:  ResourceType{ID: "00000000-0000-0000-0000-000000000000"},
+			QuotaValue:    1,
+			EffectiveDate: time.Now(),
+		}},
+	}
+	if _, err := testDB.AddPlan(context.Background(), plan); err == nil {
+		t.Error("expected a quota default for a missing resource type to be refused")
+	}
+}
+
+func TestGetPlanNotFound(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	byID, err := testDB.GetPlanByID(ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		t.Fatalf("unable to look up a missing plan by ID: %s", err)
+	}
+	if byID != nil {
+		t.Errorf("expected no plan, got %s", byID.Name)
+	}
+
+	byName, err := testDB.GetPlanByName(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up a missing plan by name: %s", err)
+	}
+	if byName != nil {
+		t.Errorf("expected no plan, got %s", byName.Name)
+	}
+}
+
+func TestDeletePlan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	if err := testDB.DeletePlan(ctx, plan.ID); err != nil {
+		t.Fatalf("unable to delete plan %s: %s", plan.Name, err)
+	}
+
+	deleted, err := testDB.GetPlanByName(ctx, plan.Name)
+	if err != nil {
+		t.Fatalf("unable to look up plan %s: %s", plan.Name, err)
+	}
+	if deleted != nil {
+		t.Error("expected a deleted plan not to be found by name")
+	}
+
+	// Deleted plans can still be found when they're explicitly requested, and
+	// they can always be looked up by ID.
+	deleted, err = testDB.GetPlanByName(ctx, plan.Name, WithIncludeDeleted())
+	if err != nil {
+		t.Fatalf("unable to look up plan %s: %s", plan.Name, err)
+	}
+	if deleted == nil || !deleted.DeletedAt.Valid {
+		t.Errorf("expected deleted plan %s to be found, got %+v", plan.Name, deleted)
+	}
+	if deleted, err = testDB.GetPlanByID(ctx, plan.ID); err != nil || deleted == nil {
+		t.Errorf("expected deleted plan %s to be found by ID, got %v", plan.Name, err)
+	}
+
+	if err = testDB.DeletePlan(ctx, plan.ID); !errors.Is(err, suberrors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound when deleting the plan again, got %v", err)
+	}
+}
+
+func TestListPlans(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	active := addTestPlan(t)
+	deleted := addTestPlan(t)
+	if err := testDB.DeletePlan(ctx, deleted.ID); err != nil {
+		t.Fatalf("unable to delete plan %s: %s", deleted.Name, err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     []QueryOption
+		expected map[string]bool
+	}{
+		{name: "default", expected: map[string]bool{active.ID: true, deleted.ID: false}},
+		{name: "deleted included", opts: []QueryOption{WithIncludeDeleted()}, expected: map[string]bool{active.ID: true, deleted.ID: true}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plans, err := testDB.ListPlans(ctx, tc.opts...)
+			if err != nil {
+				t.Fatalf("unable to list the plans: %s", err)
+			}
+
+			listed := make(map[string]bool)
+			for _, plan := range plans {
+				listed[plan.ID] = true
+			}
+			for planID, expected := range tc.expected {
+				if listed[planID] != expected {
+					t.Errorf("expected plan %s to be listed: %t", planID, expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// PlanSubscriptionCounts contains the number of active subscriptions to a
+// plan, broken down by whether they were paid for.
+type PlanSubscriptionCounts struct {
+	PlanName  string `db:"plan_name"`
+	Total     int64  `db:"total"`
+	Paid      int64  `db:"paid"`
+	Unpaid    int64  `db:"unpaid"`
+	Perpetual int64  `db:"perpetual"`
+}
+
+// PlanSubscriber is a user with an active subscription to a plan.
+type PlanSubscriber struct {
+	PlanName           string    `db:"plan_name"`
+	SubscriptionID     string    `db:"subscription_id"`
+	Username           string    `db:"username"`
+	Paid               bool      `db:"paid"`
+	EffectiveStartDate time.Time `db:"effective_start_date"`
+	EffectiveEndDate   time.Time `db:"effective_end_date"`
+	Perpetual          bool      `db:"perpetual"`
+}
+
+// currentSubscriptionsDS returns the dataset used to look up the subscription
+// that's currently active for each user. Only the most recent subscription is
+// used when a user has more than one, which matches GetActiveSubscription.
+// Only the subscriptions of the tenant are included if the query is scoped to
+// one.
+func currentSubscriptionsDS(db GoquDatabase, querySettings *QuerySettings) *goqu.SelectDataset {
+	return db.From(t.Subscriptions).
+		Distinct(t.Subscriptions.Col("user_id")).
+		Select(
+			t.Subscriptions.Col("id"),
+			t.Subscriptions.Col("user_id"),
+			t.Subscriptions.Col("plan_id"),
+			t.Subscriptions.Col("paid"),
+			t.Subscriptions.Col("effective_start_date"),
+			t.Subscriptions.Col("effective_end_date"),
+		).
+		Where(subscriptionPeriodExp(&QuerySettings{}), querySettings.tenantExp(t.Subscriptions)).
+		Order(
+			t.Subscriptions.Col("user_id").Asc(),
+			t.Subscriptions.Col("effective_start_date").Desc(),
+		)
+}
+
+// reportedSubscriptionsDS returns the dataset used to look up the subscription
+// that's currently active for each user, leaving out test accounts so that they
+// don't appear in reports.
+func reportedSubscriptionsDS(db GoquDatabase, querySettings *QuerySettings) *goqu.SelectDataset {
+	return currentSubscriptionsDS(db, querySettings).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Where(t.Users.Col("test").IsFalse())
+}
+
+// SubscriptionCountsByPlan returns the number of active subscriptions to each
+// plan, in order by plan name. Test accounts aren't counted. Plans without any
+// active subscriptions are included unless they've been deleted. If planName
+// isn't empty, only that plan is included. Accepts a variable number of
+// QueryOptions, though only WithTX, WithReadReplica and WithSubscriptionTag are
+// currently supported.
+func (d *Database) SubscriptionCountsByPlan(ctx context.Context, planName string, opts ...QueryOption) ([]PlanSubscriptionCounts, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	current := goqu.T("current")
+
+	where := []exp.Expression{
+		goqu.Or(t.Plans.Col("deleted_at").IsNull(), current.Col("id").IsNotNull()),
+		querySettings.sharedTenantExp(t.Plans),
+	}
+	if planName != "" {
+		where = append(where, t.Plans.Col("name").Eq(planName))
+	}
+
+	ds := db.From(t.Plans).
+		LeftJoin(
+			reportedSubscriptionsDS(db, querySettings).As("current"),
+			goqu.On(current.Col("plan_id").Eq(t.Plans.Col("id")), querySettings.tagExp(db, current.Col("id"))),
+		).
+		Select(
+			t.Plans.Col("name").As("plan_name"),
+			goqu.COUNT(current.Col("id")).As("total"),
+			goqu.L("count(?) FILTER (WHERE ?)", current.Col("id"), current.Col("paid")).As("paid"),
+			goqu.L("count(?) FILTER (WHERE NOT ?)", current.Col("id"), current.Col("paid")).As("unpaid"),
+			goqu.L("count(?) FILTER (WHERE ? IS NULL)", current.Col("id"), current.Col("effective_end_date")).As("perpetual"),
+		).
+		Where(where...).
+		GroupBy(t.Plans.Col("name")).
+		Order(t.Plans.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var counts []PlanSubscriptionCounts
+	if err := ds.Executor().ScanStructsContext(ctx, &counts); err != nil {
+		return nil, errors.Wrap(err, "unable to count the active subscriptions for each plan")
+	}
+
+	return counts, nil
+}
+
+// PlanSubscribers returns the users with active subscriptions, other than test
+// accounts, in order by plan name and username. If planName isn't empty, only
+// the subscribers to that plan are included. Accepts a variable number of
+// QueryOptions, though only WithTX, WithReadReplica and WithSubscriptionTag are
+// currently supported.
+func (d *Database) PlanSubscribers(ctx context.Context, planName string, opts ...QueryOption) ([]PlanSubscriber, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	current := goqu.T("current")
+
+	ds := db.From(reportedSubscriptionsDS(db, querySettings).As("current")).
+		Join(t.Plans, goqu.On(current.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Join(t.Users, goqu.On(current.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.Plans.Col("name").As("plan_name"),
+			current.Col("id").As("subscription_id"),
+			t.Users.Col("username"),
+			current.Col("paid"),
+			current.Col("effective_start_date"),
+			endDateExp(current).As("effective_end_date"),
+			current.Col("effective_end_date").IsNull().As("perpetual"),
+		).
+		Where(querySettings.tagExp(db, current.Col("id"))).
+		Order(t.Plans.Col("name").Asc(), t.Users.Col("username").Asc())
+	if planName != "" {
+		ds = ds.Where(t.Plans.Col("name").Eq(planName))
+	}
+	d.LogSQL(ds)
+
+	var subscribers []PlanSubscriber
+	if err := ds.Executor().ScanStructsContext(ctx, &subscribers); err != nil {
+		return nil, errors.Wrap(err, "unable to list the users with active subscriptions")
+	}
+
+	return subscribers, nil
+}
+
+// PlanSubscriberUsernames returns the usernames of the users whose active
+// subscriptions are to the plan, in order. Test accounts are included, since
+// it's used to find the cached subscriptions that a change to the plan affects.
+// Accepts a variable number of QueryOptions, though only WithTX,
+// WithReadReplica and WithGracePeriod are currently supported.
+func (d *Database) PlanSubscriberUsernames(ctx context.Context, planID string, opts ...QueryOption) ([]string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Subscriptions).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(t.Users.Col("username")).
+		Distinct().
+		Where(
+			t.Subscriptions.Col("plan_id").Eq(planID),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var usernames []string
+	if err := ds.Executor().ScanValsContext(ctx, &usernames); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscribers to plan %s", planID)
+	}
+
+	return usernames, nil
+}
@@ -0,0 +1,100 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestPlanSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	paid := subscribeTestUser(t, addTestUser(t), plan, &SubscriptionOptions{Paid: true, Periods: 1})
+	unpaid := subscribeTestUser(t, addTestUser(t), plan, nil)
+	test := subscribeTestUser(t, addTestUser(t), plan, nil)
+	if err := testDB.SetTestUser(ctx, test.User.Username, true); err != nil {
+		t.Fatalf("unable to mark the user as a test user: %s", err)
+	}
+
+	t.Run("counts", func(t *testing.T) {
+		counts, err := testDB.SubscriptionCountsByPlan(ctx, plan.Name)
+		if err != nil {
+			t.Fatalf("unable to count the subscriptions: %s", err)
+		}
+		expected := PlanSubscriptionCounts{PlanName: plan.Name, Total: 2, Paid: 1, Unpaid: 1}
+		if len(counts) != 1 || counts[0] != expected {
+			t.Errorf("expected %+v, got %+v", expected, counts)
+		}
+	})
+
+	t.Run("subscribers", func(t *testing.T) {
+		subscribers, err := testDB.PlanSubscribers(ctx, plan.Name)
+		if err != nil {
+			t.Fatalf("unable to list the subscribers: %s", err)
+		}
+
+		var subscriptionIDs []string
+		for _, subscriber := range subscribers {
+			subscriptionIDs = append(subscriptionIDs, subscriber.SubscriptionID)
+		}
+		slices.Sort(subscriptionIDs)
+		expected := []string{paid.ID, unpaid.ID}
+		slices.Sort(expected)
+		if !slices.Equal(subscriptionIDs, expected) {
+			t.Errorf("expected %v, got %v", expected, subscriptionIDs)
+		}
+	})
+
+	t.Run("usernames", func(t *testing.T) {
+		usernames, err := testDB.PlanSubscriberUsernames(ctx, plan.ID)
+		if err != nil {
+			t.Fatalf("unable to list the subscriber usernames: %s", err)
+		}
+
+		// Test accounts are included.
+		for _, subscription := range []*Subscription{paid, unpaid, test} {
+			if !slices.Contains(usernames, subscription.User.Username) {
+				t.Errorf("expected %s to be listed", subscription.User.Username)
+			}
+		}
+		if len(usernames) != 3 {
+			t.Errorf("expected 3 usernames, got %v", usernames)
+		}
+	})
+}
+
+func TestSubscriptionCountsForDeletedPlans(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	empty := addTestPlan(t)
+	inUse := addTestPlan(t)
+	subscribeTestUser(t, addTestUser(t), inUse, nil)
+	for _, plan := range []*Plan{empty, inUse} {
+		if err := testDB.DeletePlan(ctx, plan.ID); err != nil {
+			t.Fatalf("unable to delete plan %s: %s", plan.Name, err)
+		}
+	}
+
+	// Deleted plans are only counted while they still have subscribers.
+	tests := []struct {
+		plan     *Plan
+		expected int
+	}{
+		{plan: empty},
+		{plan: inUse, expected: 1},
+	}
+	for _, tc := range tests {
+		counts, err := testDB.SubscriptionCountsByPlan(ctx, tc.plan.Name)
+		if err != nil {
+			t.Fatalf("unable to count the subscriptions: %s", err)
+		}
+		if len(counts) != tc.expected {
+			t.Errorf("expected %d rows for plan %s, got %+v", tc.expected, tc.plan.Name, counts)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The possible states of a subscription purchase.
+const (
+	PurchaseStatusPending   = "pending"
+	PurchaseStatusCommitted = "committed"
+	PurchaseStatusAborted   = "aborted"
+	PurchaseStatusExpired   = "expired"
+)
+
+// Purchase is a subscription to a plan that a checkout has reserved for a user
+// while the user pays for it. The user's subscription is only changed once the
+// purchase is committed.
+type Purchase struct {
+	ID                string         `db:"id" goqu:"defaultifempty"`
+	UserID            string         `db:"user_id"`
+	Username          string         `db:"username"`
+	PlanID            string         `db:"plan_id"`
+	PlanName          string         `db:"plan_name"`
+	Periods           int32          `db:"periods"`
+	Amount            float64        `db:"amount"`
+	Reference         sql.NullString `db:"reference"`
+	PaymentReference  sql.NullString `db:"payment_reference"`
+	Status            string         `db:"status"`
+	ExpiresAt         time.Time      `db:"expires_at"`
+	NewSubscriptionID sql.NullString `db:"new_subscription_id"`
+	CreatedBy         string         `db:"created_by"`
+	CreatedAt         time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt    time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the purchase to the type used in responses.
+func (p *Purchase) ToAPIType() *api.Purchase {
+	amount := p.Amount
+	return &api.Purchase{
+		ID:                p.ID,
+		Username:          p.Username,
+		PlanName:          p.PlanName,
+		Periods:           p.Periods,
+		Amount:            &amount,
+		Reference:         p.Reference.String,
+		PaymentReference:  p.PaymentReference.String,
+		Status:            p.Status,
+		ExpiresAt:         p.ExpiresAt,
+		NewSubscriptionID: p.NewSubscriptionID.String,
+		CreatedBy:         p.CreatedBy,
+		CreatedAt:         p.CreatedAt,
+		LastModifiedAt:    p.LastModifiedAt,
+	}
+}
+
+// SubscriptionOptions returns the options for the subscription that's created
+// when the purchase is committed. Purchased subscriptions are always paid.
+func (p *Purchase) SubscriptionOptions() *SubscriptionOptions {
+	opts := DefaultSubscriptionOptions()
+	opts.Paid = true
+	if p.Periods > 0 {
+		opts.Periods = p.Periods
+	}
+	return opts
+}
+
+// purchaseDS returns the dataset used to look up purchases.
+func purchaseDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Purchases).
+		Join(t.Users, goqu.On(t.Purchases.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Purchases.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			t.Purchases.Col("id"),
+			t.Purchases.Col("user_id"),
+			t.Users.Col("username"),
+			t.Purchases.Col("plan_id"),
+			t.Plans.Col("name").As("plan_name"),
+			t.Purchases.Col("periods"),
+			t.Purchases.Col("amount"),
+			t.Purchases.Col("reference"),
+			t.Purchases.Col("payment_reference"),
+			t.Purchases.Col("status"),
+			t.Purchases.Col("expires_at"),
+			t.Purchases.Col("new_subscription_id"),
+			t.Purchases.Col("created_by"),
+			t.Purchases.Col("created_at"),
+			t.Purchases.Col("last_modified_at"),
+		)
+}
+
+// AddPurchase records a pending purchase and returns its ID. Returns
+// ErrPurchasePending if a purchase is already pending for the user. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddPurchase(ctx context.Context, purchase *Purchase, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	rec := goqu.Record{
+		"user_id":    purchase.UserID,
+		"plan_id":    purchase.PlanID,
+		"periods":    purchase.Periods,
+		"amount":     purchase.Amount,
+		"expires_at": purchase.ExpiresAt,
+		"created_by": purchase.CreatedBy,
+	}
+	if purchase.Reference.Valid {
+		rec["reference"] = purchase.Reference.String
+	}
+
+	ds := db.Insert(t.Purchases).Rows(rec).Returning(t.Purchases.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrPurchasePending
+		}
+		return "", errors.Wrap(err, "unable to add the subscription purchase")
+	}
+
+	return id, nil
+}
+
+// GetPurchase returns the purchase with the given ID, or nil if it doesn't
+// exist. Accepts a variable number of QueryOptions, though only WithTX and
+// WithForUpdate are currently supported.
+func (d *Database) GetPurchase(ctx context.Context, id string, opts ...QueryOption) (*Purchase, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := querySettings.lockRows(purchaseDS(db).Where(t.Purchases.Col("id").Eq(id)), t.Purchases)
+	d.LogSQL(ds)
+
+	var purchase Purchase
+	found, err := ds.Executor().ScanStructContext(ctx, &purchase)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up subscription purchase %s", id)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &purchase, nil
+}
+
+// setPurchaseStatus updates the status of a purchase that's still pending,
+// along with any other columns in rec. Returns ErrPurchaseNotPending if the
+// purchase isn't pending.
+func (d *Database) setPurchaseStatus(ctx context.Context, id, status string, rec goqu.Record, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	rec["status"] = status
+	rec["last_modified_at"] = CurrentTimestamp
+
+	ds := db.Update(t.Purchases).
+		Set(rec).
+		Where(
+			t.Purchases.Col("id").Eq(id),
+			t.Purchases.Col("status").Eq(PurchaseStatusPending),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to mark subscription purchase %s as %s", id, status)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+	if rowsAffected == 0 {
+		return suberrors.ErrPurchaseNotPending
+	}
+
+	return nil
+}
+
+// CommitPurchase records that a purchase was paid for and that the subscription
+// with the given ID was created for it. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) CommitPurchase(ctx context.Context, id, newSubscriptionID, paymentReference string, opts ...QueryOption) error {
+	rec := goqu.Record{"new_subscription_id": newSubscriptionID}
+	if paymentReference != "" {
+		rec["payment_reference"] = paymentReference
+	}
+	return d.setPurchaseStatus(ctx, id, PurchaseStatusCommitted, rec, opts...)
+}
+
+// AbortPurchase records that a purchase was abandoned. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AbortPurchase(ctx context.Context, id string, opts ...QueryOption) error {
+	return d.setPurchaseStatus(ctx, id, PurchaseStatusAborted, goqu.Record{}, opts...)
+}
+
+// ExpirePurchases marks the pending purchases that have passed their
+// expiration times as expired and returns the number of purchases that were
+// marked. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) ExpirePurchases(ctx context.Context, opts ...QueryOption) (int64, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Purchases).
+		Set(goqu.Record{
+			"status":           PurchaseStatusExpired,
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(
+			t.Purchases.Col("status").Eq(PurchaseStatusPending),
+			t.Purchases.Col("expires_at").Lte(CurrentTimestamp),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to expire subscription purchases")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return rowsAffected, nil
+}
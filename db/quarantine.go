@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// QuarantinedUsageUpdate is a usage update that's held until an administrator
+// approves or rejects it.
+type QuarantinedUsageUpdate struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	Username       string         `db:"username"`
+	SubscriptionID string         `db:"subscription_id"`
+	ResourceType   ResourceType   `db:"resource_types"`
+	UpdateType     string         `db:"update_type"`
+	Value          float64        `db:"value"`
+	Reason         string         `db:"reason"`
+	Status         string         `db:"status"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+	ResolvedBy     sql.NullString `db:"resolved_by"`
+	ResolvedAt     sql.NullTime   `db:"resolved_at"`
+}
+
+// ToAPIType converts the quarantined usage update to the type used in
+// responses.
+func (q *QuarantinedUsageUpdate) ToAPIType() *api.QuarantinedUsageUpdate {
+	update := &api.QuarantinedUsageUpdate{
+		ID:             q.ID,
+		Username:       q.Username,
+		SubscriptionID: q.SubscriptionID,
+		ResourceType: api.ResourceType{
+			ID:   q.ResourceType.ID,
+			Name: q.ResourceType.Name,
+			Unit: q.ResourceType.Unit,
+		},
+		UpdateType: q.UpdateType,
+		Value:      q.Value,
+		Reason:     q.Reason,
+		Status:     q.Status,
+		CreatedAt:  q.CreatedAt,
+		ResolvedBy: q.ResolvedBy.String,
+	}
+	if q.ResolvedAt.Valid {
+		update.ResolvedAt = &q.ResolvedAt.Time
+	}
+	return update
+}
+
+// quarantinedUpdatesDS returns the dataset used to look up quarantined usage
+// updates.
+func quarantinedUpdatesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.QuarantinedUpdates).
+		Join(t.Subscriptions, goqu.On(t.QuarantinedUpdates.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(t.QuarantinedUpdates.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.QuarantinedUpdates.Col("id"),
+			t.Users.Col("username"),
+			t.QuarantinedUpdates.Col("subscription_id"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.QuarantinedUpdates.Col("update_type"),
+			t.QuarantinedUpdates.Col("value"),
+			t.QuarantinedUpdates.Col("reason"),
+			t.QuarantinedUpdates.Col("status"),
+			t.QuarantinedUpdates.Col("created_at"),
+			t.QuarantinedUpdates.Col("resolved_by"),
+			t.QuarantinedUpdates.Col("resolved_at"),
+		)
+}
+
+// QuarantineUsageUpdate holds a usage update for review instead of applying
+// it, and sets the ID of the quarantined update. The subscription ID, resource
+// type, update type, value and reason must be set. Accepts a variable number
+// of QueryOptions, though only WithTX is currently supported.
+func (d *Database) QuarantineUsageUpdate(ctx context.Context, update *QuarantinedUsageUpdate, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.QuarantinedUpdates).
+		Rows(goqu.Record{
+			"subscription_id":  update.SubscriptionID,
+			"resource_type_id": update.ResourceType.ID,
+			"update_type":      update.UpdateType,
+			"value":            update.Value,
+			"reason":           update.Reason,
+		}).
+		Returning(t.QuarantinedUpdates.Col("id"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanValContext(ctx, &update.ID); err != nil {
+		return errors.Wrapf(err, "unable to quarantine the usage update for subscription %s", update.SubscriptionID)
+	}
+	update.Status = api.QuarantinePending
+
+	return nil
+}
+
+// ListQuarantinedUpdates returns the quarantined usage updates with a status,
+// oldest first, so that they're reviewed in the order that they arrived.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListQuarantinedUpdates(ctx context.Context, status string, opts ...QueryOption) ([]QuarantinedUsageUpdate, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := quarantinedUpdatesDS(db).
+		Where(
+			t.QuarantinedUpdates.Col("status").Eq(status),
+			querySettings.tenantExp(t.Users),
+		).
+		Order(t.QuarantinedUpdates.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var updates []QuarantinedUsageUpdate
+	if err := ds.Executor().ScanStructsContext(ctx, &updates); err != nil {
+		return nil, errors.Wrap(err, "unable to list the quarantined usage updates")
+	}
+
+	return updates, nil
+}
+
+// ResolveQuarantinedUpdate approves or rejects a quarantined usage update and
+// returns it. Approved updates are applied to the usage; they've already been
+// reviewed, so the validation rule isn't checked again. Returns
+// ErrQuarantineNotFound if the update doesn't exist and ErrQuarantineResolved
+// if it's already been approved or rejected. Should be called in a
+// transaction. Accepts a variable number of QueryOptions, though only WithTX
+// is currently supported.
+func (d *Database) ResolveQuarantinedUpdate(ctx context.Context, id, status, resolvedBy string, opts ...QueryOption) (*QuarantinedUsageUpdate, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	lookup := quarantinedUpdatesDS(db).
+		Where(
+			t.QuarantinedUpdates.Col("id").Eq(id),
+			querySettings.tenantExp(t.Users),
+		).
+		ForUpdate(exp.Wait, t.QuarantinedUpdates)
+	d.LogSQL(lookup)
+
+	var update QuarantinedUsageUpdate
+	found, err := lookup.Executor().ScanStructContext(ctx, &update)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the quarantined usage update %s", id)
+	}
+	if !found {
+		return nil, suberrors.ErrQuarantineNotFound
+	}
+	if update.Status != api.QuarantinePending {
+		return nil, suberrors.ErrQuarantineResolved
+	}
+
+	if status == api.QuarantineApproved {
+		_, _, err = d.ApplyUsage(ctx, update.UpdateType, update.Value, update.ResourceType.ID, update.SubscriptionID, opts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ds := db.Update(t.QuarantinedUpdates).
+		Set(goqu.Record{
+			"status":      status,
+			"resolved_by": resolvedBy,
+			"resolved_at": CurrentTimestamp,
+		}).
+		Where(t.QuarantinedUpdates.Col("id").Eq(id)).
+		Returning(t.QuarantinedUpdates.Col("resolved_at"))
+	d.LogSQL(ds)
+
+	if _, err = ds.Executor().ScanValContext(ctx, &update.ResolvedAt); err != nil {
+		return nil, errors.Wrapf(err, "unable to resolve the quarantined usage update %s", id)
+	}
+	update.Status = status
+	update.ResolvedBy = sql.NullString{String: resolvedBy, Valid: true}
+
+	return &update, nil
+}
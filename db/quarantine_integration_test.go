@@ -0,0 +1,187 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// quarantineTestUpdate quarantines an update that adds the value to the usage
+// of the resource type in the subscription.
+func quarantineTestUpdate(t *testing.T, subscription *Subscription, resourceType ResourceType, value float64) *QuarantinedUsageUpdate {
+	t.Helper()
+
+	update := &QuarantinedUsageUpdate{
+		SubscriptionID: subscription.ID,
+		ResourceType:   resourceType,
+		UpdateType:     UpdateTypeAdd,
+		Value:          value,
+		Reason:         "test",
+	}
+	if err := testDB.QuarantineUsageUpdate(context.Background(), update); err != nil {
+		t.Fatalf("unable to quarantine the update: %s", err)
+	}
+	return update
+}
+
+// resolveTestUpdate approves or rejects the quarantined update.
+func resolveTestUpdate(t *testing.T, id, status string) (*QuarantinedUsageUpdate, error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	var update *QuarantinedUsageUpdate
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+		update, err = testDB.ResolveQuarantinedUpdate(ctx, id, status, "test", WithTX(tx))
+		return err
+	})
+	return update, err
+}
+
+func TestListQuarantinedUpdates(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+	quarantined := quarantineTestUpdate(t, subscription, compute, 5)
+
+	if quarantined.ID == "" || quarantined.Status != api.QuarantinePending {
+		t.Errorf("expected a pending update with an ID, got %+v", quarantined)
+	}
+
+	isListed := func(status string) bool {
+		updates, err := testDB.ListQuarantinedUpdates(ctx, status)
+		if err != nil {
+			t.Fatalf("unable to list the quarantined updates: %s", err)
+		}
+		for _, update := range updates {
+			if update.ID == quarantined.ID {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isListed(api.QuarantinePending) {
+		t.Error("expected the update to be listed as pending")
+	}
+
+	if _, err := resolveTestUpdate(t, quarantined.ID, api.QuarantineRejected); err != nil {
+		t.Fatalf("unable to reject the update: %s", err)
+	}
+	if isListed(api.QuarantinePending) || !isListed(api.QuarantineRejected) {
+		t.Error("expected the update to be listed as rejected")
+	}
+}
+
+func TestResolveQuarantinedUpdate(t *testing.T) {
+	t.Parallel()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+
+	rejected := quarantineTestUpdate(t, subscription, compute, 3)
+	update, err := resolveTestUpdate(t, rejected.ID, api.QuarantineRejected)
+	if err != nil {
+		t.Fatalf("unable to reject the update: %s", err)
+	}
+	if update.Status != api.QuarantineRejected || update.ResolvedBy.String != "test" || !update.ResolvedAt.Valid {
+		t.Errorf("expected the update to be rejected by test, got %+v", update)
+	}
+	if _, found, err := testDB.GetCurrentUsage(context.Background(), compute.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	} else if found {
+		t.Error("expected a rejected update not to be applied")
+	}
+
+	approved := quarantineTestUpdate(t, subscription, compute, 5)
+	if _, err = resolveTestUpdate(t, approved.ID, api.QuarantineApproved); err != nil {
+		t.Fatalf("unable to approve the update: %s", err)
+	}
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != 5 {
+		t.Errorf("expected a usage of 5, got %g", usage)
+	}
+
+	// Resolved updates can't be resolved again.
+	if _, err = resolveTestUpdate(t, approved.ID, api.QuarantineApproved); !errors.Is(err, suberrors.ErrQuarantineResolved) {
+		t.Errorf("expected ErrQuarantineResolved, got %v", err)
+	}
+	if _, err = resolveTestUpdate(t, "00000000-0000-0000-0000-000000000000", api.QuarantineApproved); !errors.Is(err, suberrors.ErrQuarantineNotFound) {
+		t.Errorf("expected ErrQuarantineNotFound, got %v", err)
+	}
+}
+
+func TestApproveQuarantinedUpdateDrawsCreditsOnce(t *testing.T) {
+	t.Parallel()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	subscription := subscribeTestUser(t, user, addTestPlan(t), nil)
+	depositTestCredits(t, user, compute, 3)
+
+	quarantined := quarantineTestUpdate(t, subscription, compute, 5)
+	if draws := creditDraws(t, user, compute); len(draws) != 0 {
+		t.Errorf("expected nothing to be drawn while the update is quarantined, got %d draws", len(draws))
+	}
+
+	if _, err := resolveTestUpdate(t, quarantined.ID, api.QuarantineApproved); err != nil {
+		t.Fatalf("unable to approve the update: %s", err)
+	}
+	if _, err := resolveTestUpdate(t, quarantined.ID, api.QuarantineApproved); !errors.Is(err, suberrors.ErrQuarantineResolved) {
+		t.Errorf("expected ErrQuarantineResolved, got %v", err)
+	}
+
+	if balance := creditBalance(t, user, compute); balance != 0 {
+		t.Errorf("expected the credits to be used up, got %g", balance)
+	}
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != 2 {
+		t.Errorf("expected a usage of 2, got %g", usage)
+	}
+	if draws := creditDraws(t, user, compute); len(draws) != 1 || draws[0].Amount != 3 {
+		t.Errorf("expected a single draw of 3, got %+v", draws)
+	}
+}
+
+func TestProcessUpdateForUsageQuarantine(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+	user := &subscription.User
+	setTestUsageRule(t, compute, api.UsageRuleQuarantine, 10)
+
+	update := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 20)
+	quarantined, ok := suberrors.UsageQuarantine(testDB.ProcessUpdateForUsage(ctx, update))
+	if !ok {
+		t.Fatal("expected the update to be quarantined")
+	}
+
+	// The quarantine is kept, but the update isn't recorded or applied.
+	if count := countRows(t, "quarantined_usage_updates", goqu.Ex{"id": quarantined.ID, "status": api.QuarantinePending}); count != 1 {
+		t.Error("expected the update to be held for review")
+	}
+	if count := countRows(t, "updates", goqu.Ex{"user_id": user.ID}); count != 0 {
+		t.Errorf("expected the update not to be recorded, got %d updates", count)
+	}
+	if _, found, err := testDB.GetCurrentUsage(ctx, compute.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	} else if found {
+		t.Error("expected the quarantined update not to be applied")
+	}
+
+	if _, err := resolveTestUpdate(t, quarantined.ID, api.QuarantineApproved); err != nil {
+		t.Fatalf("unable to approve the update: %s", err)
+	}
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != 20 {
+		t.Errorf("expected a usage of 20, got %g", usage)
+	}
+}
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// QuotaChange is a change to a subscription's quota for a resource type that
+// takes effect on a future date.
+type QuotaChange struct {
+	ID             string       `db:"id" goqu:"defaultifempty"`
+	SubscriptionID string       `db:"subscription_id"`
+	Username       string       `db:"username"`
+	ResourceType   ResourceType `db:"resource_types"`
+	Quota          float64      `db:"quota"`
+	EffectiveDate  time.Time    `db:"effective_date"`
+	AppliedAt      sql.NullTime `db:"applied_at"`
+	CreatedBy      string       `db:"created_by"`
+	CreatedAt      time.Time    `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the quota change to the type used in responses.
+func (c *QuotaChange) ToAPIType() *api.QuotaChange {
+	result := &api.QuotaChange{
+		ID:             c.ID,
+		SubscriptionID: c.SubscriptionID,
+		Username:       c.Username,
+		ResourceType: api.ResourceType{
+			ID:   c.ResourceType.ID,
+			Name: c.ResourceType.Name,
+			Unit: c.ResourceType.Unit,
+		},
+		Quota:         c.Quota,
+		EffectiveDate: c.EffectiveDate,
+		CreatedBy:     c.CreatedBy,
+		CreatedAt:     c.CreatedAt,
+	}
+	if c.AppliedAt.Valid {
+		result.AppliedAt = &c.AppliedAt.Time
+	}
+	return result
+}
+
+// quotaChangeDS returns the dataset used to look up quota changes.
+func quotaChangeDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.QuotaChanges).
+		Join(t.Subscriptions, goqu.On(t.QuotaChanges.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(t.QuotaChanges.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.QuotaChanges.Col("id"),
+			t.QuotaChanges.Col("subscription_id"),
+			t.Users.Col("username"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.QuotaChanges.Col("quota"),
+			t.QuotaChanges.Col("effective_date"),
+			t.QuotaChanges.Col("applied_at"),
+			t.QuotaChanges.Col("created_by"),
+			t.QuotaChanges.Col("created_at"),
+		)
+}
+
+// dueQuotaChangeDS returns the dataset used to look up the quota changes that
+// have come due but haven't been applied yet. Only the most recent change for
+// each subscription and resource type is included, because it replaces any
+// earlier ones.
+func dueQuotaChangeDS(db GoquDatabase) *goqu.SelectDataset {
+	return quotaChangeDS(db).
+		Distinct(t.QuotaChanges.Col("subscription_id"), t.QuotaChanges.Col("resource_type_id")).
+		Where(
+			t.QuotaChanges.Col("applied_at").IsNull(),
+			t.QuotaChanges.Col("effective_date").Lte(CurrentTimestamp),
+		).
+		Order(
+			t.QuotaChanges.Col("subscription_id").Asc(),
+			t.QuotaChanges.Col("resource_type_id").Asc(),
+			t.QuotaChanges.Col("effective_date").Desc(),
+			t.QuotaChanges.Col("created_at").Desc(),
+		)
+}
+
+// AddQuotaChange schedules a quota change and returns its ID. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddQuotaChange(ctx context.Context, change *QuotaChange, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.QuotaChanges).
+		Rows(goqu.Record{
+			"subscription_id":  change.SubscriptionID,
+			"resource_type_id": change.ResourceType.ID,
+			"quota":            change.Quota,
+			"effective_date":   change.EffectiveDate,
+			"created_by":       change.CreatedBy,
+		}).
+		Returning(t.QuotaChanges.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrap(err, "unable to schedule the quota change")
+	}
+
+	return id, nil
+}
+
+// GetQuotaChange returns the quota change with the given ID. Returns
+// ErrQuotaChangeNotFound if the quota change doesn't exist. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) GetQuotaChange(ctx context.Context, id string, opts ...QueryOption) (*QuotaChange, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := quotaChangeDS(db).Where(t.QuotaChanges.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	var change QuotaChange
+	found, err := ds.Executor().ScanStructContext(ctx, &change)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up quota change %s", id)
+	}
+	if !found {
+		return nil, suberrors.ErrQuotaChangeNotFound
+	}
+
+	return &change, nil
+}
+
+// ListQuotaChangesForUser returns all of the quota changes scheduled for a
+// user, latest effective date first. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListQuotaChangesForUser(ctx context.Context, username string, opts ...QueryOption) ([]QuotaChange, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := quotaChangeDS(db).
+		Where(t.Users.Col("username").Eq(username)).
+		Order(
+			t.QuotaChanges.Col("effective_date").Desc(),
+			t.QuotaChanges.Col("created_at").Desc(),
+		)
+	d.LogSQL(ds)
+
+	var changes []QuotaChange
+	if err := ds.Executor().ScanStructsContext(ctx, &changes); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the quota changes for %s", username)
+	}
+
+	return changes, nil
+}
+
+// DeleteQuotaChange removes a quota change that hasn't been applied yet.
+// Returns ErrQuotaChangeNotFound if the quota change doesn't exist or was
+// already applied. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) DeleteQuotaChange(ctx context.Context, id string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.QuotaChanges).
+		Delete().
+		Where(
+			t.QuotaChanges.Col("id").Eq(id),
+			t.QuotaChanges.Col("applied_at").IsNull(),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to delete quota change %s", id)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+	if rowsAffected == 0 {
+		return suberrors.ErrQuotaChangeNotFound
+	}
+
+	return nil
+}
+
+// DueQuotaChanges returns the quota changes that have come due but haven't been
+// applied yet, with at most one change for each subscription and resource type.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) DueQuotaChanges(ctx context.Context, limit uint, opts ...QueryOption) ([]QuotaChange, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := dueQuotaChangeDS(db).Limit(limit)
+	d.LogSQL(ds)
+
+	var changes []QuotaChange
+	if err := ds.Executor().ScanStructsContext(ctx, &changes); err != nil {
+		return nil, errors.Wrap(err, "unable to list the quota changes that are due")
+	}
+
+	return changes, nil
+}
+
+// effectiveQuotaChanges returns the quota changes that determine the current
+// quotas of a subscription because they've come due but haven't been applied
+// yet, keyed by resource type ID.
+func (d *Database) effectiveQuotaChanges(ctx context.Context, subscriptionID string, opts ...QueryOption) (map[string]QuotaChange, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := dueQuotaChangeDS(db).Where(t.QuotaChanges.Col("subscription_id").Eq(subscriptionID))
+	d.LogSQL(ds)
+
+	var changes []QuotaChange
+	if err := ds.Executor().ScanStructsContext(ctx, &changes); err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the quota changes for subscription %s", subscriptionID)
+	}
+
+	result := make(map[string]QuotaChange, len(changes))
+	for _, change := range changes {
+		result[change.ResourceType.ID] = change
+	}
+
+	return result, nil
+}
+
+// effectiveQuotaChange returns the quota change that determines the current
+// quota of a subscription for a resource type, or nil if the quota in the
+// quotas table is current.
+func (d *Database) effectiveQuotaChange(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (*QuotaChange, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := dueQuotaChangeDS(db).
+		Where(
+			t.QuotaChanges.Col("subscription_id").Eq(subscriptionID),
+			t.QuotaChanges.Col("resource_type_id").Eq(resourceTypeID),
+		)
+	d.LogSQL(ds)
+
+	var change QuotaChange
+	found, err := ds.Executor().ScanStructContext(ctx, &change)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the quota change for subscription %s", subscriptionID)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &change, nil
+}
+
+// markQuotaChangesApplied records that the quota changes for a subscription and
+// resource type that have come due are reflected in the quotas table, so that
+// they no longer override it.
+func (d *Database) markQuotaChangesApplied(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Update(t.QuotaChanges).
+		Set(goqu.Record{"applied_at": CurrentTimestamp}).
+		Where(
+			t.QuotaChanges.Col("subscription_id").Eq(subscriptionID),
+			t.QuotaChanges.Col("resource_type_id").Eq(resourceTypeID),
+			t.QuotaChanges.Col("applied_at").IsNull(),
+			t.QuotaChanges.Col("effective_date").Lte(CurrentTimestamp),
+		)
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to mark the quota changes for subscription %s as applied", subscriptionID)
+	}
+
+	return nil
+}
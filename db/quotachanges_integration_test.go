@@ -0,0 +1,149 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestQuotaChange schedules a change to the subscription's quota for the
+// resource type.
+func addTestQuotaChange(t *testing.T, subscription *Subscription, resourceType ResourceType, quota float64, effectiveDate time.Time) string {
+	t.Helper()
+
+	id, err := testDB.AddQuotaChange(context.Background(), &QuotaChange{
+		SubscriptionID: subscription.ID,
+		ResourceType:   resourceType,
+		Quota:          quota,
+		EffectiveDate:  effectiveDate,
+		CreatedBy:      "test",
+	})
+	if err != nil {
+		t.Fatalf("unable to schedule the quota change: %s", err)
+	}
+	return id
+}
+
+func TestAddQuotaChange(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+	later := addTestQuotaChange(t, subscription, storage, 20, time.Now().Add(48*time.Hour))
+	sooner := addTestQuotaChange(t, subscription, storage, 10, time.Now().Add(24*time.Hour))
+
+	change, err := testDB.GetQuotaChange(ctx, sooner)
+	if err != nil {
+		t.Fatalf("unable to look up the quota change: %s", err)
+	}
+	if change.Username != subscription.User.Username || change.ResourceType != storage || change.Quota != 10 ||
+		change.AppliedAt.Valid {
+		t.Errorf("the quota change wasn't stored correctly: %+v", change)
+	}
+
+	changes, err := testDB.ListQuotaChangesForUser(ctx, subscription.User.Username)
+	if err != nil {
+		t.Fatalf("unable to list the quota changes: %s", err)
+	}
+	if len(changes) != 2 || changes[0].ID != later || changes[1].ID != sooner {
+		t.Errorf("expected quota changes %s and %s, got %+v", later, sooner, changes)
+	}
+
+	if err = testDB.DeleteQuotaChange(ctx, later); err != nil {
+		t.Fatalf("unable to delete the quota change: %s", err)
+	}
+	if _, err = testDB.GetQuotaChange(ctx, later); !errors.Is(err, suberrors.ErrQuotaChangeNotFound) {
+		t.Errorf("expected ErrQuotaChangeNotFound after deleting the quota change, got %v", err)
+	}
+	if err = testDB.DeleteQuotaChange(ctx, later); !errors.Is(err, suberrors.ErrQuotaChangeNotFound) {
+		t.Errorf("expected ErrQuotaChangeNotFound when deleting the quota change again, got %v", err)
+	}
+}
+
+func TestDueQuotaChanges(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(
+		t,
+		PlanQuotaDefault{ResourceType: storage, QuotaValue: 5},
+		PlanQuotaDefault{ResourceType: compute, QuotaValue: 5},
+	)
+
+	// Only the most recent change that has come due takes effect.
+	addTestQuotaChange(t, subscription, storage, 10, time.Now().Add(-2*time.Hour))
+	due := addTestQuotaChange(t, subscription, storage, 20, time.Now().Add(-time.Hour))
+	addTestQuotaChange(t, subscription, storage, 30, time.Now().Add(time.Hour))
+	addTestQuotaChange(t, subscription, compute, 40, time.Now().Add(time.Hour))
+
+	changes, err := testDB.DueQuotaChanges(ctx, 100000)
+	if err != nil {
+		t.Fatalf("unable to list the quota changes that are due: %s", err)
+	}
+	var ours []QuotaChange
+	for _, change := range changes {
+		if change.SubscriptionID == subscription.ID {
+			ours = append(ours, change)
+		}
+	}
+	if len(ours) != 1 || ours[0].ID != due {
+		t.Errorf("expected only quota change %s to be due, got %+v", due, ours)
+	}
+
+	// The due change overrides the quotas table until a new quota is set.
+	quota, found, err := testDB.GetCurrentQuota(ctx, storage.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the quota: %s", err)
+	}
+	if !found || quota != 20 {
+		t.Errorf("expected the quota change to take effect, got %f", quota)
+	}
+	quotas := subscriptionQuotaValues(t, subscription.ID)
+	if quotas[storage.ID] != 20 || quotas[compute.ID] != 5 {
+		t.Errorf("expected the quota change to be listed, got %v", quotas)
+	}
+
+	if err = testDB.UpsertQuota(ctx, 25, storage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to set the quota: %s", err)
+	}
+	applied, err := testDB.GetQuotaChange(ctx, due)
+	if err != nil {
+		t.Fatalf("unable to look up the quota change: %s", err)
+	}
+	if !applied.AppliedAt.Valid {
+		t.Error("expected setting the quota to mark the quota change as applied")
+	}
+	if quota, _, err = testDB.GetCurrentQuota(ctx, storage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to look up the quota: %s", err)
+	}
+	if quota != 25 {
+		t.Errorf("expected the new quota to replace the quota change, got %f", quota)
+	}
+
+	// Applied quota changes can't be deleted.
+	if err = testDB.DeleteQuotaChange(ctx, due); !errors.Is(err, suberrors.ErrQuotaChangeNotFound) {
+		t.Errorf("expected ErrQuotaChangeNotFound for an applied quota change, got %v", err)
+	}
+}
+
+func TestQuotaChangeForNewResourceType(t *testing.T) {
+	t.Parallel()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+	addTestQuotaChange(t, subscription, storage, 15, time.Now().Add(-time.Hour))
+
+	// A quota change can add a quota that the subscription didn't have.
+	quotas := subscriptionQuotaValues(t, subscription.ID)
+	if quotas[storage.ID] != 15 {
+		t.Errorf("expected the quota change to add a quota, got %v", quotas)
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// notQuotaExemptExp returns the expression that leaves out the subscriptions to
+// quota-exempt plans. The plans table must be joined.
+func notQuotaExemptExp() exp.Expression {
+	return t.Plans.Col("quota_exempt").IsFalse()
+}
+
+// IsPlanQuotaExempt returns true if the subscriptions to a plan are exempt from
+// their quotas. Accepts a variable number of QueryOptions, though only WithTX
+// and WithReadReplica are currently supported.
+func (d *Database) IsPlanQuotaExempt(ctx context.Context, planID string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Plans).
+		Select(t.Plans.Col("quota_exempt")).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.sharedTenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	var exempt bool
+	found, err := ds.Executor().ScanValContext(ctx, &exempt)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to determine whether plan %s is quota-exempt", planID)
+	}
+	if !found {
+		return false, suberrors.ErrPlanNotFound
+	}
+
+	return exempt, nil
+}
+
+// SetPlanQuotaExempt changes whether the subscriptions to a plan are exempt
+// from their quotas. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) SetPlanQuotaExempt(ctx context.Context, planID string, exempt bool, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Plans).
+		Set(goqu.Record{"quota_exempt": exempt}).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.tenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update the quota exemption for plan %s", planID)
+	}
+
+	return nil
+}
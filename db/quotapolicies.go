@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// QuotaPolicy determines what happens when consuming a resource would take a
+// user beyond the quota. Resource types without a stored policy use the
+// default policy, which has a zero modification time.
+type QuotaPolicy struct {
+	ResourceType   ResourceType `db:"resource_types"`
+	Mode           string       `db:"mode"`
+	EnforceInGrace bool         `db:"enforce_in_grace"`
+	LastModifiedBy string       `db:"last_modified_by"`
+	LastModifiedAt time.Time    `db:"last_modified_at"`
+}
+
+// DefaultQuotaPolicy returns the policy used for resource types that don't
+// have a policy of their own, which denies consumption beyond the quota except
+// during a subscription's grace period.
+func DefaultQuotaPolicy(resourceType ResourceType) *QuotaPolicy {
+	return &QuotaPolicy{ResourceType: resourceType, Mode: api.QuotaPolicyHard}
+}
+
+// ToAPIType converts the quota policy to the type used in responses.
+func (p *QuotaPolicy) ToAPIType() *api.QuotaPolicy {
+	policy := &api.QuotaPolicy{
+		ResourceType: api.ResourceType{
+			ID:   p.ResourceType.ID,
+			Name: p.ResourceType.Name,
+			Unit: p.ResourceType.Unit,
+		},
+		Mode:           p.Mode,
+		EnforceInGrace: p.EnforceInGrace,
+		LastModifiedBy: p.LastModifiedBy,
+	}
+	if !p.LastModifiedAt.IsZero() {
+		policy.LastModifiedAt = &p.LastModifiedAt
+	}
+	return policy
+}
+
+// quotaPoliciesDS returns the dataset for listing quota policies along with
+// their resource types.
+func quotaPoliciesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.QuotaPolicies).
+		Join(t.RT, goqu.On(t.QuotaPolicies.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.QuotaPolicies.Col("mode"),
+			t.QuotaPolicies.Col("enforce_in_grace"),
+			t.QuotaPolicies.Col("last_modified_by"),
+			t.QuotaPolicies.Col("last_modified_at"),
+		)
+}
+
+// SetQuotaPolicy adds or replaces the quota policy for a resource type. The
+// resource type must be set in the policy. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetQuotaPolicy(ctx context.Context, policy *QuotaPolicy, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.QuotaPolicies).
+		Rows(goqu.Record{
+			"resource_type_id": policy.ResourceType.ID,
+			"mode":             policy.Mode,
+			"enforce_in_grace": policy.EnforceInGrace,
+			"last_modified_by": policy.LastModifiedBy,
+		}).
+		OnConflict(goqu.DoUpdate("resource_type_id", goqu.Record{
+			"mode":             goqu.I("excluded.mode"),
+			"enforce_in_grace": goqu.I("excluded.enforce_in_grace"),
+			"last_modified_by": goqu.I("excluded.last_modified_by"),
+			"last_modified_at": CurrentTimestamp,
+		})).
+		Returning(t.QuotaPolicies.Col("last_modified_at"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanValContext(ctx, &policy.LastModifiedAt); err != nil {
+		return errors.Wrapf(err, "unable to set the quota policy for %s", policy.ResourceType.Name)
+	}
+
+	return nil
+}
+
+// GetQuotaPolicy returns the quota policy for a resource type, or the default
+// policy if the resource type doesn't have one. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetQuotaPolicy(ctx context.Context, resourceType *ResourceType, opts ...QueryOption) (*QuotaPolicy, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := quotaPoliciesDS(db).Where(t.QuotaPolicies.Col("resource_type_id").Eq(resourceType.ID))
+	d.LogSQL(ds)
+
+	var policy QuotaPolicy
+	found, err := ds.Executor().ScanStructContext(ctx, &policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the quota policy for %s", resourceType.Name)
+	}
+	if !found {
+		return DefaultQuotaPolicy(*resourceType), nil
+	}
+
+	return &policy, nil
+}
+
+// ListQuotaPolicies returns the quota policy for every resource type, including
+// the default policy for resource types that don't have one, in order by
+// resource type name. Accepts a variable number of QueryOptions, though only
+// WithTX and WithReadReplica are currently supported.
+func (d *Database) ListQuotaPolicies(ctx context.Context, opts ...QueryOption) ([]QuotaPolicy, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := quotaPoliciesDS(db)
+	d.LogSQL(ds)
+
+	var stored []QuotaPolicy
+	if err := ds.Executor().ScanStructsContext(ctx, &stored); err != nil {
+		return nil, errors.Wrap(err, "unable to list the quota policies")
+	}
+
+	byResourceType := make(map[string]QuotaPolicy, len(stored))
+	for _, policy := range stored {
+		byResourceType[policy.ResourceType.ID] = policy
+	}
+
+	resourceTypes, err := d.ListResourceTypes(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make([]QuotaPolicy, 0, len(resourceTypes))
+	for _, resourceType := range resourceTypes {
+		if policy, ok := byResourceType[resourceType.ID]; ok {
+			policies = append(policies, policy)
+			continue
+		}
+		policies = append(policies, *DefaultQuotaPolicy(resourceType))
+	}
+
+	return policies, nil
+}
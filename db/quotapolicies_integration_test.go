@@ -0,0 +1,58 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+)
+
+func TestQuotaPolicies(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+
+	// Resource types without a stored policy use the default policy.
+	policy, err := testDB.GetQuotaPolicy(ctx, &storage)
+	if err != nil {
+		t.Fatalf("unable to look up the quota policy: %s", err)
+	}
+	if *policy != *DefaultQuotaPolicy(storage) {
+		t.Errorf("expected the default policy, got %+v", policy)
+	}
+
+	// Setting the policy a second time replaces the first one.
+	for _, mode := range []string{api.QuotaPolicyHard, api.QuotaPolicySoft} {
+		policy = &QuotaPolicy{ResourceType: compute, Mode: mode, EnforceInGrace: true, LastModifiedBy: "test"}
+		if err = testDB.SetQuotaPolicy(ctx, policy); err != nil {
+			t.Fatalf("unable to set the quota policy: %s", err)
+		}
+		if policy.LastModifiedAt.IsZero() {
+			t.Error("expected the modification time to be returned")
+		}
+	}
+
+	stored, err := testDB.GetQuotaPolicy(ctx, &compute)
+	if err != nil {
+		t.Fatalf("unable to look up the quota policy: %s", err)
+	}
+	if stored.Mode != api.QuotaPolicySoft || !stored.EnforceInGrace || stored.ResourceType != compute {
+		t.Errorf("expected the replacement policy, got %+v", stored)
+	}
+
+	policies, err := testDB.ListQuotaPolicies(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the quota policies: %s", err)
+	}
+	modes := make(map[string]string)
+	for _, listed := range policies {
+		modes[listed.ResourceType.ID] = listed.Mode
+	}
+	if modes[storage.ID] != api.QuotaPolicyHard || modes[compute.ID] != api.QuotaPolicySoft {
+		t.Errorf("expected both resource types to be listed with their policies, got %v", modes)
+	}
+}
@@ -3,31 +3,42 @@ package db
 import (
 	"context"
 
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 )
 
 // GetCurrentQuota returns the current quota value for a resource type and
-// user plan. Also returns a boolean that is true when the actual quota value
-// was found and returned and is false when the actual quota was not found and
-// the default value was returned. Accepts a variable number of QuotaOptions,
-// but only WithTX is currently supported.
+// user plan. A scheduled quota change that has come due takes precedence over
+// the value in the quotas table. Also returns a boolean that is true when the
+// actual quota value was found and returned and is false when the actual quota
+// was not found and the default value was returned. Accepts a variable number
+// of QuotaOptions, but only WithTX, WithReadReplica and WithForUpdate are
+// currently supported.
 func (d *Database) GetCurrentQuota(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error) {
 	var (
 		err        error
-		db         GoquDatabase
 		quotaValue float64
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
-	quotasE := db.From("quotas").
+	change, err := d.effectiveQuotaChange(ctx, resourceTypeID, subscriptionID, opts...)
+	if err != nil {
+		return quotaValue, false, err
+	}
+	if change != nil {
+		return change.Quota, true, nil
+	}
+
+	quotasDS := db.From("quotas").
 		Select(goqu.C("quota")).
 		Where(goqu.And(
 			goqu.I("resource_type_id").Eq(resourceTypeID),
 			goqu.I("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, goqu.I("subscription_id")),
 		)).
-		Limit(1).
-		Executor()
+		Limit(1)
+	quotasE := querySettings.lockRows(quotasDS).Executor()
 
 	if _, err := quotasE.ScanValContext(ctx, &quotaValue); err != nil {
 		return quotaValue, false, err
@@ -43,14 +54,26 @@ func (d *Database) GetCurrentQuota(ctx context.Context, resourceTypeID, subscrip
 
 // UpsertQuota inserts or updates a quota into the database for the given
 // resource type and user plan. Accepts a variable number of QueryOptions,
-// though only WithTX is currently supported.
+// though only WithTX and WithExpectedVersion are currently supported.
 func (d *Database) UpsertQuota(ctx context.Context, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
-	var (
-		err error
-		db  GoquDatabase
-	)
+	_, err := d.SetQuota(ctx, value, resourceTypeID, subscriptionID, opts...)
+	return err
+}
 
-	_, db = d.querySettings(opts...)
+// SetQuota inserts or updates a quota into the database for the given resource
+// type and user plan, and returns the new version of the quota. If the
+// WithExpectedVersion option is used and the quota already exists, the quota
+// is only updated if its version matches, and ErrVersionConflict is returned
+// if it doesn't. Scheduled quota changes that have come due are marked as
+// applied, because the new value replaces them. Accepts a variable number of
+// QueryOptions, though only WithTX and WithExpectedVersion are currently
+// supported.
+func (d *Database) SetQuota(ctx context.Context, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) (int64, error) {
+	qs, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, qs, subscriptionID); err != nil {
+		return 0, err
+	}
 
 	updateRecord := goqu.Record{
 		"quota":            value,
@@ -60,20 +83,39 @@ func (d *Database) UpsertQuota(ctx context.Context, value float64, resourceTypeI
 		"last_modified_by": "de",
 	}
 
+	conflict := goqu.DoUpdate(
+		"resource_type_id, subscription_id",
+		goqu.Record{
+			"quota":   goqu.I("excluded.quota"),
+			"version": goqu.L("quotas.version + 1"),
+		},
+	)
+	if qs.hasExpectedVersion {
+		conflict = conflict.Where(goqu.I("quotas.version").Eq(qs.expectedVersion))
+	}
+
 	upsertE := db.Insert("quotas").
 		Rows(updateRecord).
-		OnConflict(
-			goqu.DoUpdate(
-				"resource_type_id, subscription_id",
-				goqu.C("quota").Set(goqu.I("excluded.quota"))),
-		).Executor()
+		OnConflict(conflict).
+		Returning(goqu.C("version")).
+		Executor()
 
 	log.Info(upsertE.ToSQL())
 
-	_, err = upsertE.ExecContext(ctx)
+	var version int64
+	found, err := upsertE.ScanValContext(ctx, &version)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// The upsert only skips the row when the version didn't match.
+	if !found {
+		return 0, suberrors.ErrVersionConflict
+	}
+
+	if err = d.markQuotaChangesApplied(ctx, resourceTypeID, subscriptionID, opts...); err != nil {
+		return 0, err
 	}
 
-	return nil
+	return version, nil
 }
@@ -0,0 +1,65 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestSetQuota(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+
+	if quota, found, err := testDB.GetCurrentQuota(ctx, storage.ID, subscription.ID); err != nil || found {
+		t.Fatalf("expected no quota, got %g, %t, %v", quota, found, err)
+	}
+
+	version, err := testDB.SetQuota(ctx, 10, storage.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to set the quota: %s", err)
+	}
+	if version != 1 {
+		t.Errorf("expected a new quota to have version 1, got %d", version)
+	}
+
+	// Updates with an outdated version are refused.
+	if version, err = testDB.SetQuota(ctx, 20, storage.ID, subscription.ID, WithExpectedVersion(version)); err != nil {
+		t.Fatalf("unable to update the quota: %s", err)
+	}
+	if version != 2 {
+		t.Errorf("expected the version to be incremented to 2, got %d", version)
+	}
+	if _, err = testDB.SetQuota(ctx, 30, storage.ID, subscription.ID, WithExpectedVersion(1)); !errors.Is(err, suberrors.ErrVersionConflict) {
+		t.Errorf("expected ErrVersionConflict for an outdated version, got %v", err)
+	}
+
+	quota, found, err := testDB.GetCurrentQuota(ctx, storage.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the quota: %s", err)
+	}
+	if !found || quota != 20 {
+		t.Errorf("expected a quota of 20, got %g (found: %t)", quota, found)
+	}
+}
+
+func TestUpsertQuota(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t, PlanQuotaDefault{ResourceType: storage, QuotaValue: 5})
+
+	if err := testDB.UpsertQuota(ctx, 12, storage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to update the quota: %s", err)
+	}
+	if quotas := subscriptionQuotaValues(t, subscription.ID); len(quotas) != 1 || quotas[storage.ID] != 12 {
+		t.Errorf("expected a single quota of 12, got %v", quotas)
+	}
+}
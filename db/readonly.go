@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// readOnlyQuery determines whether or not the database currently accepts
+// writes. A server that is in recovery (a standby, or a primary that is failing
+// over) or that defaults to read-only transactions can't be written to.
+const readOnlyQuery = "SELECT pg_is_in_recovery() OR current_setting('default_transaction_read_only') = 'on'"
+
+// ReadOnlyMonitor periodically checks whether the database is read-only so
+// that handlers that modify the database can be rejected up front during a
+// failover rather than failing with driver errors.
+type ReadOnlyMonitor struct {
+	db       *sqlx.DB
+	interval time.Duration
+	readOnly atomic.Bool
+}
+
+// NewReadOnlyMonitor returns a new *ReadOnlyMonitor that checks the database at
+// the given interval once it's started.
+func NewReadOnlyMonitor(dbconn *sqlx.DB, interval time.Duration) *ReadOnlyMonitor {
+	return &ReadOnlyMonitor{
+		db:       dbconn,
+		interval: interval,
+	}
+}
+
+// ReadOnly returns true if the most recent check found the database to be
+// read-only.
+func (m *ReadOnlyMonitor) ReadOnly() bool {
+	return m.readOnly.Load()
+}
+
+// Check queries the database to determine whether it's read-only and records
+// the result. The previous result is kept if the check fails, since a database
+// that can't be reached isn't necessarily read-only.
+func (m *ReadOnlyMonitor) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	var readOnly bool
+	if err := m.db.QueryRowContext(ctx, readOnlyQuery).Scan(&readOnly); err != nil {
+		return err
+	}
+
+	if m.readOnly.Swap(readOnly) != readOnly {
+		if readOnly {
+			log.Warn("the database is read-only; requests that modify data will be rejected")
+		} else {
+			log.Info("the database accepts writes again")
+		}
+	}
+
+	return nil
+}
+
+// Start checks the database at regular intervals until the context is done.
+func (m *ReadOnlyMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := m.Check(ctx); err != nil {
+				log.Errorf("unable to determine whether the database is read-only: %s", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
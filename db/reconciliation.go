@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// UserUsage is a user's usage of a resource type in their active subscription.
+type UserUsage struct {
+	Username string  `db:"username"`
+	Usage    float64 `db:"usage"`
+}
+
+// CurrentUsagesByResourceType returns the usage of a resource type in the
+// active subscription of each user who has one, in order by username. Users who
+// haven't used the resource type have a usage of zero. Accepts a variable number
+// of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) CurrentUsagesByResourceType(ctx context.Context, resourceTypeID string, opts ...QueryOption) ([]UserUsage, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	current := goqu.T("current")
+
+	ds := db.From(currentSubscriptionsDS(db, querySettings).As("current")).
+		Join(t.Users, goqu.On(current.Col("user_id").Eq(t.Users.Col("id")))).
+		LeftJoin(t.Usages, goqu.On(
+			t.Usages.Col("subscription_id").Eq(current.Col("id")),
+			t.Usages.Col("resource_type_id").Eq(resourceTypeID),
+		)).
+		Select(
+			t.Users.Col("username"),
+			goqu.COALESCE(t.Usages.Col("usage"), 0).As("usage"),
+		).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var usages []UserUsage
+	if err := ds.Executor().ScanStructsContext(ctx, &usages); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the current usages")
+	}
+
+	return usages, nil
+}
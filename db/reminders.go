@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// ExpiringSubscription is a subscription that's due an expiration reminder.
+type ExpiringSubscription struct {
+	SubscriptionID string    `db:"subscription_id"`
+	Username       string    `db:"username"`
+	PlanName       string    `db:"plan_name"`
+	EndsAt         time.Time `db:"ends_at"`
+}
+
+// SubscriptionsDueReminders returns the subscriptions that end after the first
+// time and no later than the second, for which no reminder has been sent for
+// the reminder window. Subscriptions that have been superseded by a newer
+// subscription for the same user, such as a renewal, are skipped. The subscriptions are locked for
+// the rest of the transaction, and subscriptions that are locked by another
+// transaction are skipped. Only WithTX is currently supported, and a
+// transaction is required for the locks to be useful.
+func (d *Database) SubscriptionsDueReminders(
+	ctx context.Context, windowDays int32, after, before time.Time, limit uint, opts ...QueryOption,
+) ([]ExpiringSubscription, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	newer := t.Subscriptions.As("newer")
+	superseded := db.From(newer).
+		Select(goqu.L("1")).
+		Where(
+			newer.Col("user_id").Eq(t.Subscriptions.Col("user_id")),
+			newer.Col("effective_start_date").Gt(t.Subscriptions.Col("effective_start_date")),
+		)
+
+	sent := db.From(t.Reminders).
+		Select(goqu.L("1")).
+		Where(
+			t.Reminders.Col("subscription_id").Eq(t.Subscriptions.Col("id")),
+			t.Reminders.Col("window_days").Eq(windowDays),
+		)
+
+	ds := db.From(t.Subscriptions).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			t.Subscriptions.Col("id").As("subscription_id"),
+			t.Users.Col("username"),
+			t.Plans.Col("name").As("plan_name"),
+			t.Subscriptions.Col("effective_end_date").As("ends_at"),
+		).
+		Where(
+			t.Subscriptions.Col("effective_end_date").Gt(after),
+			t.Subscriptions.Col("effective_end_date").Lte(before),
+			querySettings.tenantExp(t.Subscriptions),
+			goqu.L("NOT EXISTS ?", sent),
+			goqu.L("NOT EXISTS ?", superseded),
+		).
+		Order(t.Subscriptions.Col("effective_end_date").Asc()).
+		Limit(limit).
+		ForUpdate(exp.SkipLocked, t.Subscriptions)
+	d.LogSQL(ds)
+
+	var subscriptions []ExpiringSubscription
+	if err := ds.Executor().ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions due a %d day expiration reminder", windowDays)
+	}
+
+	return subscriptions, nil
+}
+
+// MarkRemindersSent records that reminders were sent for the reminder window.
+// Reminders that were already recorded are left alone. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) MarkRemindersSent(ctx context.Context, windowDays int32, subscriptionIDs []string, opts ...QueryOption) error {
+	if len(subscriptionIDs) == 0 {
+		return nil
+	}
+
+	querySettings, db := d.querySettings(opts...)
+
+	// The reminders are inserted from the subscriptions so that reminders can't
+	// be recorded for the subscriptions of other tenants.
+	subscriptions := db.From(t.Subscriptions).
+		Select(t.Subscriptions.Col("id"), goqu.V(windowDays)).
+		Where(t.Subscriptions.Col("id").In(subscriptionIDs), querySettings.tenantExp(t.Subscriptions))
+
+	ds := db.Insert(t.Reminders).
+		Cols("subscription_id", "window_days").
+		FromQuery(subscriptions).
+		OnConflict(goqu.DoNothing())
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to record the %d day expiration reminders", windowDays)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+func TestSubscriptionsDueReminders(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// The subscriptions end far enough in the future that the ones added by
+	// the other tests don't fall into the reminder window.
+	after := time.Now().AddDate(50, 0, 0)
+	before := after.Add(24 * time.Hour)
+	endingAt := func(d time.Duration) *SubscriptionOptions {
+		return &SubscriptionOptions{Periods: 1, EndDate: after.Add(d)}
+	}
+
+	plan := addTestPlan(t)
+	due := subscribeTestUser(t, addTestUser(t), plan, endingAt(time.Hour))
+	reminded := subscribeTestUser(t, addTestUser(t), plan, endingAt(2*time.Hour))
+	subscribeTestUser(t, addTestUser(t), plan, endingAt(48*time.Hour))
+
+	// Subscriptions that have been renewed don't need reminders.
+	renewedUser := addTestUser(t)
+	renewed := subscribeTestUser(t, renewedUser, plan, endingAt(3*time.Hour))
+	subscribeTestUser(t, renewedUser, plan, endingAt(100*24*time.Hour))
+
+	if err := testDB.MarkRemindersSent(ctx, 7, []string{reminded.ID}); err != nil {
+		t.Fatalf("unable to record the reminders: %s", err)
+	}
+
+	// Recording a reminder a second time has no effect.
+	if err := testDB.MarkRemindersSent(ctx, 7, []string{reminded.ID, due.ID}); err != nil {
+		t.Fatalf("unable to record the reminders again: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		windowDays int32
+		expected   []string
+	}{
+		{name: "reminders sent", windowDays: 7},
+		{name: "no reminders sent", windowDays: 30, expected: []string{due.ID, reminded.ID}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+				subscriptions, err := testDB.SubscriptionsDueReminders(ctx, tc.windowDays, after, before, 100, WithTX(tx))
+				if err != nil {
+					return err
+				}
+
+				var actual []string
+				for _, subscription := range subscriptions {
+					actual = append(actual, subscription.SubscriptionID)
+					if subscription.SubscriptionID == renewed.ID {
+						t.Error("expected the renewed subscription to be skipped")
+					}
+				}
+				if len(actual) != len(tc.expected) {
+					t.Errorf("expected %v, got %v", tc.expected, actual)
+					return nil
+				}
+				for i := range actual {
+					if actual[i] != tc.expected[i] {
+						t.Errorf("expected %v, got %v", tc.expected, actual)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unable to list the subscriptions due reminders: %s", err)
+			}
+		})
+	}
+}
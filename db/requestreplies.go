@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// LoadRequestReply returns the response recorded for a NATS request with a
+// message ID at or after the given time. The second return value is false if
+// there isn't one. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) LoadRequestReply(ctx context.Context, key string, since time.Time, opts ...QueryOption) ([]byte, bool, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.RequestReplies).
+		Select(t.RequestReplies.Col("response")).
+		Where(
+			t.RequestReplies.Col("key").Eq(key),
+			t.RequestReplies.Col("created_at").Gte(since),
+		)
+	d.LogSQL(ds)
+
+	var response []byte
+	found, err := ds.Executor().ScanValContext(ctx, &response)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "unable to look up the response for request %s", key)
+	}
+
+	return response, found, nil
+}
+
+// SaveRequestReply records the response to a NATS request with a message ID,
+// replacing any earlier response with the same key. Accepts a variable number
+// of QueryOptions, though only WithTX is currently supported.
+func (d *Database) SaveRequestReply(ctx context.Context, key string, response []byte, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.RequestReplies).
+		Rows(goqu.Record{"key": key, "response": response}).
+		OnConflict(goqu.DoUpdate("key", goqu.Record{
+			"response":   response,
+			"created_at": CurrentTimestamp,
+		}))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to record the response for request %s", key)
+	}
+
+	return nil
+}
+
+// PurgeRequestReplies removes the responses recorded before the given time and
+// returns the number of responses that were removed. Accepts a variable number
+// of QueryOptions, though only WithTX is currently supported.
+func (d *Database) PurgeRequestReplies(ctx context.Context, before time.Time, opts ...QueryOption) (int64, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.RequestReplies).Delete().
+		Where(t.RequestReplies.Col("created_at").Lt(before))
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to purge the recorded request responses")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return rowsAffected, nil
+}
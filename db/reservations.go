@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// The possible states of a reservation.
+const (
+	ReservationStatusActive   = "active"
+	ReservationStatusReleased = "released"
+	ReservationStatusExpired  = "expired"
+)
+
+// ReservationAmount is the amount of a resource type that's reserved.
+type ReservationAmount struct {
+	ReservationID string       `db:"reservation_id"`
+	ResourceType  ResourceType `db:"resource_types"`
+	Amount        float64      `db:"amount"`
+}
+
+// Reservation is planned consumption of one or more resources that counts
+// against the user's quotas until it's released or expires.
+type Reservation struct {
+	ID             string              `db:"id" goqu:"defaultifempty"`
+	SubscriptionID string              `db:"subscription_id"`
+	Username       string              `db:"username"`
+	Reference      sql.NullString      `db:"reference"`
+	Status         string              `db:"status"`
+	ExpiresAt      time.Time           `db:"expires_at"`
+	CreatedBy      string              `db:"created_by"`
+	CreatedAt      time.Time           `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedAt time.Time           `db:"last_modified_at" goqu:"defaultifempty"`
+	Amounts        []ReservationAmount `db:"-"`
+}
+
+// ToAPIType converts the reservation to the type used in responses.
+func (r *Reservation) ToAPIType() *api.Reservation {
+	result := &api.Reservation{
+		ID:             r.ID,
+		SubscriptionID: r.SubscriptionID,
+		Username:       r.Username,
+		Reference:      r.Reference.String,
+		Status:         r.Status,
+		ExpiresAt:      r.ExpiresAt,
+		CreatedBy:      r.CreatedBy,
+		CreatedAt:      r.CreatedAt,
+		LastModifiedAt: r.LastModifiedAt,
+		Resources:      make([]*api.ReservedResource, len(r.Amounts)),
+	}
+	for i, amount := range r.Amounts {
+		result.Resources[i] = &api.ReservedResource{
+			ResourceType: api.ResourceType{
+				ID:   amount.ResourceType.ID,
+				Name: amount.ResourceType.Name,
+				Unit: amount.ResourceType.Unit,
+			},
+			Amount: amount.Amount,
+		}
+	}
+	return result
+}
+
+// reservationDS returns the dataset used to look up reservations.
+func reservationDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Reservations).
+		Join(t.Subscriptions, goqu.On(t.Reservations.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.Reservations.Col("id"),
+			t.Reservations.Col("subscription_id"),
+			t.Users.Col("username"),
+			t.Reservations.Col("reference"),
+			t.Reservations.Col("status"),
+			t.Reservations.Col("expires_at"),
+			t.Reservations.Col("created_by"),
+			t.Reservations.Col("created_at"),
+			t.Reservations.Col("last_modified_at"),
+		)
+}
+
+// AddReservation inserts a reservation along with its amounts and returns its
+// ID. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported. A transaction should be used so that the reservation
+// isn't inserted without its amounts.
+func (d *Database) AddReservation(ctx context.Context, reservation *Reservation, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, reservation.SubscriptionID); err != nil {
+		return "", err
+	}
+
+	rec := goqu.Record{
+		"subscription_id": reservation.SubscriptionID,
+		"expires_at":      reservation.ExpiresAt,
+		"created_by":      reservation.CreatedBy,
+	}
+	if reservation.Reference.Valid {
+		rec["reference"] = reservation.Reference.String
+	}
+
+	ds := db.Insert(t.Reservations).Rows(rec).Returning(t.Reservations.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrap(err, "unable to add the reservation")
+	}
+
+	rows := make([]goqu.Record, len(reservation.Amounts))
+	for i, amount := range reservation.Amounts {
+		rows[i] = goqu.Record{
+			"reservation_id":   id,
+			"resource_type_id": amount.ResourceType.ID,
+			"amount":           amount.Amount,
+		}
+	}
+	if len(rows) > 0 {
+		amountsDS := db.Insert(t.ReservationAmounts).Rows(rows)
+		d.LogSQL(amountsDS)
+
+		if _, err := amountsDS.Executor().ExecContext(ctx); err != nil {
+			return "", errors.Wrapf(err, "unable to add the amounts for reservation %s", id)
+		}
+	}
+
+	return id, nil
+}
+
+// GetReservation returns the reservation with the given ID along with its
+// amounts, or nil if it doesn't exist. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) GetReservation(ctx context.Context, id string, opts ...QueryOption) (*Reservation, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := reservationDS(db).Where(t.Reservations.Col("id").Eq(id), querySettings.tenantExp(t.Subscriptions))
+	d.LogSQL(ds)
+
+	var reservation Reservation
+	found, err := ds.Executor().ScanStructContext(ctx, &reservation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up reservation %s", id)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	amountsDS := db.From(t.ReservationAmounts).
+		Join(t.RT, goqu.On(t.ReservationAmounts.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.ReservationAmounts.Col("reservation_id"),
+			t.ReservationAmounts.Col("amount"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+		).
+		Where(t.ReservationAmounts.Col("reservation_id").Eq(id)).
+		Order(t.RT.Col("name").Asc())
+	d.LogSQL(amountsDS)
+
+	if err = amountsDS.Executor().ScanStructsContext(ctx, &reservation.Amounts); err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the amounts for reservation %s", id)
+	}
+
+	return &reservation, nil
+}
+
+// ReservedAmount returns the total amount of a resource type that's reserved
+// for a subscription by reservations that are active and haven't expired yet.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ReservedAmount(
+	ctx context.Context, subscriptionID, resourceTypeID string, opts ...QueryOption,
+) (float64, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.ReservationAmounts).
+		Join(t.Reservations, goqu.On(t.ReservationAmounts.Col("reservation_id").Eq(t.Reservations.Col("id")))).
+		Select(goqu.COALESCE(goqu.SUM(t.ReservationAmounts.Col("amount")), 0)).
+		Where(
+			t.Reservations.Col("subscription_id").Eq(subscriptionID),
+			t.Reservations.Col("status").Eq(ReservationStatusActive),
+			t.Reservations.Col("expires_at").Gt(CurrentTimestamp),
+			t.ReservationAmounts.Col("resource_type_id").Eq(resourceTypeID),
+			querySettings.subscriptionTenantExp(db, t.Reservations.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	var amount float64
+	if _, err := ds.Executor().ScanValContext(ctx, &amount); err != nil {
+		return 0, errors.Wrapf(err, "unable to determine the reserved amount for subscription %s", subscriptionID)
+	}
+
+	return amount, nil
+}
+
+// ReleaseReservation marks a reservation as released if it's still active.
+// Returns false if the reservation isn't active. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) ReleaseReservation(ctx context.Context, id string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Reservations).
+		Set(goqu.Record{
+			"status":           ReservationStatusReleased,
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(
+			t.Reservations.Col("id").Eq(id),
+			t.Reservations.Col("status").Eq(ReservationStatusActive),
+			querySettings.subscriptionTenantExp(db, t.Reservations.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to release reservation %s", id)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// ExpireReservations marks the active reservations that have passed their
+// expiration times as expired and returns the number of reservations that were
+// marked. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) ExpireReservations(ctx context.Context, opts ...QueryOption) (int64, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Reservations).
+		Set(goqu.Record{
+			"status":           ReservationStatusExpired,
+			"last_modified_at": CurrentTimestamp,
+		}).
+		Where(
+			t.Reservations.Col("status").Eq(ReservationStatusActive),
+			t.Reservations.Col("expires_at").Lte(CurrentTimestamp),
+			querySettings.subscriptionTenantExp(db, t.Reservations.Col("subscription_id")),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to expire reservations")
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return rowsAffected, nil
+}
@@ -0,0 +1,126 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// addTestReservation reserves the amount of each resource type for the
+// subscription until the expiration time.
+func addTestReservation(t *testing.T, subscription *Subscription, expiresAt time.Time, amounts ...ReservationAmount) string {
+	t.Helper()
+
+	id, err := testDB.AddReservation(context.Background(), &Reservation{
+		SubscriptionID: subscription.ID,
+		Reference:      sql.NullString{String: uniqueName("job"), Valid: true},
+		ExpiresAt:      expiresAt,
+		CreatedBy:      "test",
+		Amounts:        amounts,
+	})
+	if err != nil {
+		t.Fatalf("unable to add the reservation: %s", err)
+	}
+	return id
+}
+
+func TestAddReservation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+	id := addTestReservation(
+		t, subscription, time.Now().Add(time.Hour),
+		ReservationAmount{ResourceType: storage, Amount: 5},
+		ReservationAmount{ResourceType: compute, Amount: 10},
+	)
+
+	reservation, err := testDB.GetReservation(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the reservation: %s", err)
+	}
+	if reservation == nil {
+		t.Fatal("the reservation wasn't found")
+	}
+	if reservation.Username != subscription.User.Username || reservation.Status != ReservationStatusActive ||
+		!reservation.Reference.Valid {
+		t.Errorf("the reservation wasn't stored correctly: %+v", reservation)
+	}
+
+	amounts := make(map[string]float64)
+	for _, amount := range reservation.Amounts {
+		amounts[amount.ResourceType.ID] = amount.Amount
+	}
+	if len(amounts) != 2 || amounts[storage.ID] != 5 || amounts[compute.ID] != 10 {
+		t.Errorf("expected the amounts to be stored, got %+v", reservation.Amounts)
+	}
+
+	missing, err := testDB.GetReservation(ctx, "00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		t.Fatalf("unable to look up a missing reservation: %s", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no reservation, got %s", missing.ID)
+	}
+}
+
+func TestReservedAmount(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+	later := time.Now().Add(time.Hour)
+
+	addTestReservation(t, subscription, later, ReservationAmount{ResourceType: compute, Amount: 1})
+	released := addTestReservation(t, subscription, later, ReservationAmount{ResourceType: compute, Amount: 2})
+	expired := addTestReservation(t, subscription, time.Now().Add(-time.Hour), ReservationAmount{ResourceType: compute, Amount: 4})
+	addTestReservation(t, addTestSubscription(t), later, ReservationAmount{ResourceType: compute, Amount: 8})
+
+	ok, err := testDB.ReleaseReservation(ctx, released)
+	if err != nil {
+		t.Fatalf("unable to release the reservation: %s", err)
+	}
+	if !ok {
+		t.Error("expected the active reservation to be released")
+	}
+	if ok, err = testDB.ReleaseReservation(ctx, released); err != nil || ok {
+		t.Errorf("expected releasing the reservation again to do nothing, got %t, %v", ok, err)
+	}
+
+	// Only active reservations that haven't expired count, even before the
+	// expired ones are marked.
+	amount, err := testDB.ReservedAmount(ctx, subscription.ID, compute.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the reserved amount: %s", err)
+	}
+	if amount != 1 {
+		t.Errorf("expected 1 to be reserved, got %f", amount)
+	}
+
+	count, err := testDB.ExpireReservations(ctx)
+	if err != nil {
+		t.Fatalf("unable to expire the reservations: %s", err)
+	}
+	if count < 1 {
+		t.Errorf("expected at least one reservation to expire, got %d", count)
+	}
+
+	reservation, err := testDB.GetReservation(ctx, expired)
+	if err != nil {
+		t.Fatalf("unable to look up the reservation: %s", err)
+	}
+	if reservation.Status != ReservationStatusExpired {
+		t.Errorf("expected the reservation to be expired, got %s", reservation.Status)
+	}
+
+	// Expired reservations can't be released.
+	if ok, err = testDB.ReleaseReservation(ctx, expired); err != nil || ok {
+		t.Errorf("expected releasing an expired reservation to do nothing, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// ResourceStatus is the quota and usage of a resource type in a subscription,
+// along with the amount of the quota that remains and the percentage of it
+// that's been used. The percentage is missing if the quota is zero.
+type ResourceStatus struct {
+	SubscriptionID string          `db:"subscription_id"`
+	ResourceType   ResourceType    `db:"resource_types"`
+	Quota          float64         `db:"quota"`
+	Usage          float64         `db:"usage"`
+	Remaining      float64         `db:"remaining"`
+	PercentUsed    sql.NullFloat64 `db:"percent_used"`
+}
+
+// ToAPIType converts the resource status to the type used in responses.
+func (s *ResourceStatus) ToAPIType() *api.ResourceStatus {
+	result := &api.ResourceStatus{
+		ResourceType: api.ResourceType{
+			ID:   s.ResourceType.ID,
+			Name: s.ResourceType.Name,
+			Unit: s.ResourceType.Unit,
+		},
+		Quota:     s.Quota,
+		Usage:     s.Usage,
+		Remaining: s.Remaining,
+	}
+	if s.PercentUsed.Valid {
+		percentUsed := s.PercentUsed.Float64
+		result.PercentUsed = &percentUsed
+	}
+	return result
+}
+
+// remainingExp computes the amount of a quota that remains, which is never
+// negative.
+func remainingExp(quota, usage any) exp.LiteralExpression {
+	return goqu.L("GREATEST(? - ?, 0)", quota, usage)
+}
+
+// percentUsedExp computes the percentage of a quota that's been used, or NULL
+// if the quota is zero.
+func percentUsedExp(quota, usage any) exp.LiteralExpression {
+	return goqu.L("CASE WHEN ? > 0 THEN ? / ? * 100 END", quota, usage, quota)
+}
+
+// ResourceStatuses returns the status of each resource type that the given
+// subscriptions have a quota or usage for, keyed by subscription ID and in
+// order by resource type name. The quotas take the scheduled quota changes that
+// have come due into account. Everything is computed in a single query.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ResourceStatuses(
+	ctx context.Context, subscriptionIDs []string, opts ...QueryOption,
+) (map[string][]ResourceStatus, error) {
+	result := make(map[string][]ResourceStatus)
+	if len(subscriptionIDs) == 0 {
+		return result, nil
+	}
+
+	_, db := d.querySettings(opts...)
+
+	// A scheduled quota change that has come due replaces the quota in the
+	// quotas table until it's applied. This is the same selection that
+	// dueQuotaChangeDS makes, limited to the columns needed for the join.
+	due := db.From(t.QuotaChanges).
+		Select(
+			t.QuotaChanges.Col("subscription_id"),
+			t.QuotaChanges.Col("resource_type_id"),
+			t.QuotaChanges.Col("quota"),
+		).
+		Distinct(t.QuotaChanges.Col("subscription_id"), t.QuotaChanges.Col("resource_type_id")).
+		Where(
+			t.QuotaChanges.Col("subscription_id").In(subscriptionIDs),
+			t.QuotaChanges.Col("applied_at").IsNull(),
+			t.QuotaChanges.Col("effective_date").Lte(CurrentTimestamp),
+		).
+		Order(
+			t.QuotaChanges.Col("subscription_id").Asc(),
+			t.QuotaChanges.Col("resource_type_id").Asc(),
+			t.QuotaChanges.Col("effective_date").Desc(),
+			t.QuotaChanges.Col("created_at").Desc(),
+		)
+
+	current := db.From(t.Quotas).
+		Select(
+			t.Quotas.Col("subscription_id"),
+			t.Quotas.Col("resource_type_id"),
+			t.Quotas.Col("quota"),
+		).
+		Where(t.Quotas.Col("subscription_id").In(subscriptionIDs))
+
+	quotas := db.From(current.As("current")).
+		FullJoin(due.As("due"), goqu.Using("subscription_id", "resource_type_id")).
+		Select(
+			goqu.C("subscription_id"),
+			goqu.C("resource_type_id"),
+			goqu.COALESCE(goqu.I("due.quota"), goqu.I("current.quota")).As("quota"),
+		)
+
+	usages := db.From(t.Usages).
+		Select(
+			t.Usages.Col("subscription_id"),
+			t.Usages.Col("resource_type_id"),
+			t.Usages.Col("usage"),
+		).
+		Where(t.Usages.Col("subscription_id").In(subscriptionIDs))
+
+	quota := goqu.COALESCE(goqu.I("q.quota"), 0)
+	usage := goqu.COALESCE(goqu.I("u.usage"), 0)
+
+	ds := db.From(quotas.As("q")).
+		FullJoin(usages.As("u"), goqu.Using("subscription_id", "resource_type_id")).
+		Join(t.RT, goqu.On(t.RT.Col("id").Eq(goqu.C("resource_type_id")))).
+		Select(
+			goqu.C("subscription_id"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			quota.As("quota"),
+			usage.As("usage"),
+			remainingExp(quota, usage).As("remaining"),
+			percentUsedExp(quota, usage).As("percent_used"),
+		).
+		Order(goqu.C("subscription_id").Asc(), t.RT.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var statuses []ResourceStatus
+	if err := ds.Executor().ScanStructsContext(ctx, &statuses); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the subscription resource statuses")
+	}
+
+	for _, status := range statuses {
+		result[status.SubscriptionID] = append(result[status.SubscriptionID], status)
+	}
+	return result, nil
+}
+
+// SubscriptionResourceStatuses returns the status of each resource type that
+// the subscription has a quota or usage for, in order by resource type name.
+// Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) SubscriptionResourceStatuses(
+	ctx context.Context, subscriptionID string, opts ...QueryOption,
+) ([]ResourceStatus, error) {
+	statuses, err := d.ResourceStatuses(ctx, []string{subscriptionID}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return statuses[subscriptionID], nil
+}
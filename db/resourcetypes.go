@@ -5,7 +5,10 @@ import (
 	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
 )
 
 // GetResourceTypeID returns the UUID associated with the name and unit passed in.
@@ -127,3 +130,109 @@ func (d *Database) LookupResoureType(
 		return nil, fmt.Errorf("either the resource type ID or name must be specified")
 	}
 }
+
+// ListResourceTypes returns all of the resource types in order by name. Accepts
+// a variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ListResourceTypes(ctx context.Context, opts ...QueryOption) ([]ResourceType, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.RT).
+		Select(
+			t.RT.Col("id"),
+			t.RT.Col("name"),
+			t.RT.Col("unit"),
+			t.RT.Col("consumable"),
+		).
+		Order(t.RT.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var resourceTypes []ResourceType
+	if err := ds.Executor().ScanStructsContext(ctx, &resourceTypes); err != nil {
+		return nil, errors.Wrap(err, "unable to list the resource types")
+	}
+
+	return resourceTypes, nil
+}
+
+// AddResourceType adds a resource type and returns its ID. Returns
+// ErrResourceTypeExists if a resource type with the same name already exists.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) AddResourceType(ctx context.Context, resourceType *ResourceType, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	existing, err := d.GetResourceTypeByName(ctx, resourceType.Name, opts...)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to look up resource type %s", resourceType.Name)
+	}
+	if existing.ID != "" {
+		return "", suberrors.ErrResourceTypeExists
+	}
+
+	ds := db.Insert(t.RT).
+		Rows(goqu.Record{
+			"name":       resourceType.Name,
+			"unit":       resourceType.Unit,
+			"consumable": resourceType.Consumable,
+		}).
+		Returning(t.RT.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err = ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrResourceTypeExists
+		}
+		return "", errors.Wrapf(err, "unable to add resource type %s", resourceType.Name)
+	}
+
+	return id, nil
+}
+
+// UpdateResourceType changes the unit and consumable flag of the resource type
+// with the given ID. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) UpdateResourceType(ctx context.Context, resourceType *ResourceType, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Update(t.RT).
+		Set(goqu.Record{
+			"unit":       resourceType.Unit,
+			"consumable": resourceType.Consumable,
+		}).
+		Where(t.RT.Col("id").Eq(resourceType.ID))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update resource type %s", resourceType.Name)
+	}
+
+	return nil
+}
+
+// ResourceTypeInUse returns true if any quotas, usages, updates, archived
+// updates, plan quota defaults or add-ons refer to the resource type with the
+// given ID. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) ResourceTypeInUse(ctx context.Context, id string, opts ...QueryOption) (bool, error) {
+	_, db := d.querySettings(opts...)
+
+	var references []exp.Expression
+	for _, table := range []exp.IdentifierExpression{t.Quotas, t.Usages, t.Updates, t.ArchivedUpdates, t.PQD, t.Addons} {
+		references = append(references, goqu.L("EXISTS ?", db.From(table).
+			Select(goqu.L("1")).
+			Where(table.Col("resource_type_id").Eq(id))))
+	}
+
+	ds := db.Select(goqu.Or(references...))
+	d.LogSQL(ds)
+
+	var inUse bool
+	if _, err := ds.Executor().ScanValContext(ctx, &inUse); err != nil {
+		return false, errors.Wrapf(err, "unable to determine whether resource type %s is in use", id)
+	}
+
+	return inUse, nil
+}
@@ -0,0 +1,138 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddResourceType(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	resourceType := addTestResourceType(t, true)
+
+	duplicate := ResourceType{Name: resourceType.Name, Unit: "hours"}
+	if _, err := testDB.AddResourceType(ctx, &duplicate); !errors.Is(err, suberrors.ErrResourceTypeExists) {
+		t.Errorf("expected ErrResourceTypeExists for a duplicate name, got %v", err)
+	}
+
+	id, err := testDB.GetResourceTypeID(ctx, resourceType.Name, resourceType.Unit)
+	if err != nil {
+		t.Fatalf("unable to look up the resource type ID: %s", err)
+	}
+	if id != resourceType.ID {
+		t.Errorf("expected ID %s, got %s", resourceType.ID, id)
+	}
+
+	// Each of the lookups returns the same resource type.
+	lookups := map[string]func() (*ResourceType, error){
+		"by ID": func() (*ResourceType, error) {
+			return testDB.GetResourceType(ctx, resourceType.ID)
+		},
+		"by name": func() (*ResourceType, error) {
+			return testDB.GetResourceTypeByName(ctx, resourceType.Name)
+		},
+		"lookup by ID": func() (*ResourceType, error) {
+			return testDB.LookupResoureType(ctx, &ResourceType{ID: resourceType.ID})
+		},
+		"lookup by name": func() (*ResourceType, error) {
+			return testDB.LookupResoureType(ctx, &ResourceType{Name: resourceType.Name})
+		},
+	}
+	for name, lookup := range lookups {
+		t.Run(name, func(t *testing.T) {
+			actual, err := lookup()
+			if err != nil {
+				t.Fatalf("unable to look up the resource type: %s", err)
+			}
+			if *actual != resourceType {
+				t.Errorf("expected %+v, got %+v", resourceType, *actual)
+			}
+		})
+	}
+
+	if _, err = testDB.LookupResoureType(ctx, &ResourceType{}); err == nil {
+		t.Error("expected a lookup without an ID or name to fail")
+	}
+}
+
+func TestUpdateResourceType(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	resourceType := addTestResourceType(t, false)
+	resourceType.Unit = "hours"
+	resourceType.Consumable = true
+	if err := testDB.UpdateResourceType(ctx, &resourceType); err != nil {
+		t.Fatalf("unable to update the resource type: %s", err)
+	}
+
+	actual, err := testDB.GetResourceType(ctx, resourceType.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the resource type: %s", err)
+	}
+	if *actual != resourceType {
+		t.Errorf("expected %+v, got %+v", resourceType, *actual)
+	}
+}
+
+func TestListResourceTypes(t *testing.T) {
+	t.Parallel()
+
+	resourceType := addTestResourceType(t, false)
+
+	resourceTypes, err := testDB.ListResourceTypes(context.Background())
+	if err != nil {
+		t.Fatalf("unable to list the resource types: %s", err)
+	}
+
+	var found bool
+	for _, actual := range resourceTypes {
+		found = found || actual == resourceType
+	}
+	if !found {
+		t.Errorf("expected %s to be listed", resourceType.Name)
+	}
+}
+
+func TestResourceTypeInUse(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	unused := addTestResourceType(t, false)
+	quota := addTestResourceType(t, false)
+	usage := addTestResourceType(t, true)
+	addTestPlan(t, PlanQuotaDefault{ResourceType: quota, QuotaValue: 1})
+
+	subscription := addTestSubscription(t)
+	if _, _, err := testDB.ApplyUsage(ctx, UpdateTypeAdd, 1, usage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to record the usage: %s", err)
+	}
+
+	tests := []struct {
+		name         string
+		resourceType ResourceType
+		expected     bool
+	}{
+		{name: "unused", resourceType: unused},
+		{name: "plan quota default", resourceType: quota, expected: true},
+		{name: "usage", resourceType: usage, expected: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			inUse, err := testDB.ResourceTypeInUse(ctx, tc.resourceType.ID)
+			if err != nil {
+				t.Fatalf("unable to check whether the resource type is in use: %s", err)
+			}
+			if inUse != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, inUse)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// archivableUpdates returns an expression that's true for updates that both took
+// effect and were recorded before the cutoff. Checking when the update was
+// recorded keeps backdated updates around until they've been added to the
+// usage rollups.
+func archivableUpdates(cutoff time.Time) exp.Expression {
+	return goqu.And(
+		t.Updates.Col("effective_date").Lt(cutoff),
+		t.Updates.Col("created_at").Lt(cutoff),
+	)
+}
+
+// CountArchivableUpdates returns the number of updates that would be archived
+// for the cutoff. Accepts a variable number of QueryOptions, though only WithTX
+// and WithReadReplica are currently supported.
+func (d *Database) CountArchivableUpdates(ctx context.Context, cutoff time.Time, opts ...QueryOption) (int64, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.Updates).
+		Select(goqu.COUNT(goqu.Star())).
+		Where(archivableUpdates(cutoff))
+	d.LogSQL(ds)
+
+	var count int64
+	if _, err := ds.Executor().ScanValContext(ctx, &count); err != nil {
+		return 0, errors.Wrap(err, "unable to count the updates to archive")
+	}
+
+	return count, nil
+}
+
+// ArchiveUpdates moves up to limit of the updates that took effect and were
+// recorded before the cutoff to the archived_updates table, oldest first, and
+// returns the number of updates that were moved. Updates that are locked by
+// another transaction are skipped. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) ArchiveUpdates(ctx context.Context, cutoff time.Time, limit uint, opts ...QueryOption) (int64, error) {
+	_, db := d.querySettings(opts...)
+
+	ids := db.From(t.Updates).
+		Select(t.Updates.Col("id")).
+		Where(archivableUpdates(cutoff)).
+		Order(t.Updates.Col("effective_date").Asc()).
+		Limit(limit).
+		ForUpdate(exp.SkipLocked)
+
+	moved := db.From(t.Updates).
+		Delete().
+		Where(t.Updates.Col("id").In(ids)).
+		Returning(goqu.Star())
+
+	// The archive has the same columns as the updates table, followed by the
+	// time the update was archived, which is filled in by default.
+	ds := db.Insert(t.ArchivedUpdates).With("moved", moved)
+	ds = ds.FromQuery(db.From("moved").SetDialect(ds.Dialect()))
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to archive updates")
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return count, nil
+}
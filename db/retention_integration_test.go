@@ -0,0 +1,75 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+func TestArchiveUpdates(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	user := addTestUser(t)
+
+	// The other tests record updates as they happen, so the updates here are
+	// moved back to a time that nothing else uses. The backdated update took
+	// effect before the cutoff but was recorded after it.
+	cutoff := time.Date(1971, time.January, 1, 0, 0, 0, 0, time.UTC)
+	longAgo := cutoff.AddDate(-1, 0, 0)
+	dates := map[string]goqu.Record{
+		"old":         {"effective_date": longAgo, "created_at": longAgo},
+		"backdated":   {"effective_date": longAgo},
+		"not yet due": {},
+	}
+	ids := make(map[string]string, len(dates))
+	for name, rec := range dates {
+		update := newTestUpdate(t, *user, storage, UsagesTrackedMetric, UpdateTypeAdd, 1)
+		if _, err := testDB.AddUserUpdate(ctx, update); err != nil {
+			t.Fatalf("unable to add the update: %s", err)
+		}
+		ids[name] = update.ID
+
+		if len(rec) == 0 {
+			continue
+		}
+		ds := testDB.fullDB.Update("updates").Set(rec).Where(goqu.Ex{"id": update.ID})
+		if _, err := ds.Executor().ExecContext(ctx); err != nil {
+			t.Fatalf("unable to backdate the update: %s", err)
+		}
+	}
+
+	count, err := testDB.CountArchivableUpdates(ctx, cutoff)
+	if err != nil {
+		t.Fatalf("unable to count the updates to archive: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 update to archive, got %d", count)
+	}
+
+	archived, err := testDB.ArchiveUpdates(ctx, cutoff, 10)
+	if err != nil {
+		t.Fatalf("unable to archive the updates: %s", err)
+	}
+	if archived != 1 {
+		t.Errorf("expected 1 update to be archived, got %d", archived)
+	}
+
+	for name, id := range ids {
+		expected := int64(0)
+		if name == "old" {
+			expected = 1
+		}
+		if count := countRows(t, "archived_updates", goqu.Ex{"id": id}); count != expected {
+			t.Errorf("expected %d archived rows for the %s update, got %d", expected, name, count)
+		}
+		if count := countRows(t, "updates", goqu.Ex{"id": id}); count != 1-expected {
+			t.Errorf("expected %d rows for the %s update, got %d", 1-expected, name, count)
+		}
+	}
+}
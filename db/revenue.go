@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// RevenueReportRow contains the revenue from the subscriptions to a plan that
+// are attributed to a month.
+type RevenueReportRow struct {
+	PlanName          string    `db:"plan_name"`
+	Month             time.Time `db:"month"`
+	Subscriptions     int64     `db:"subscriptions"`
+	PaidSubscriptions int64     `db:"paid_subscriptions"`
+	PlanRevenue       float64   `db:"plan_revenue"`
+	AddonRevenue      float64   `db:"addon_revenue"`
+}
+
+// RevenueReport returns the revenue from the subscriptions that were active at
+// any time from the start time up to the end time, grouped by plan and month
+// and in order by month and plan name. Each subscription is attributed to the
+// month in UTC in which it started, or the first month of the window if it
+// started earlier. The revenue is the rate of the plan at the time of
+// subscription plus the rates of the subscription's add-ons multiplied by their
+// quantities, and only paid subscriptions contribute to it. Test accounts are
+// left out. If planName isn't empty, only the subscriptions to that plan are
+// included. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) RevenueReport(
+	ctx context.Context, start, end time.Time, planName string, opts ...QueryOption,
+) ([]RevenueReportRow, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	addonRevenue := db.From(t.SubscriptionAddons).
+		Join(t.AddonRates, goqu.On(t.SubscriptionAddons.Col("addon_rate_id").Eq(t.AddonRates.Col("id")))).
+		Select(goqu.COALESCE(
+			goqu.SUM(goqu.L("? * ?", t.AddonRates.Col("rate"), t.SubscriptionAddons.Col("quantity"))), 0,
+		)).
+		Where(t.SubscriptionAddons.Col("subscription_id").Eq(t.Subscriptions.Col("id")))
+
+	where := []exp.Expression{
+		t.Subscriptions.Col("effective_start_date").Lt(end),
+		goqu.Or(
+			t.Subscriptions.Col("effective_end_date").Gte(start),
+			t.Subscriptions.Col("effective_end_date").IsNull(),
+		),
+		t.Users.Col("test").IsFalse(),
+		querySettings.tenantExp(t.Subscriptions),
+	}
+	if planName != "" {
+		where = append(where, t.Plans.Col("name").Eq(planName))
+	}
+
+	month := goqu.L(
+		"date_trunc('month', GREATEST(?, ?::timestamptz) AT TIME ZONE 'UTC')::date",
+		t.Subscriptions.Col("effective_start_date"), start,
+	)
+	subscriptions := db.From(t.Subscriptions).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Join(t.PlanRates, goqu.On(t.Subscriptions.Col("plan_rate_id").Eq(t.PlanRates.Col("id")))).
+		Select(
+			t.Plans.Col("name").As("plan_name"),
+			month.As("month"),
+			t.Subscriptions.Col("paid"),
+			t.PlanRates.Col("rate").As("plan_rate"),
+			addonRevenue.As("addon_rate"),
+		).
+		Where(where...)
+
+	ds := db.From(subscriptions.As("subscriptions")).
+		Select(
+			goqu.C("plan_name"),
+			goqu.C("month"),
+			goqu.COUNT(goqu.Star()).As("subscriptions"),
+			goqu.L("count(*) FILTER (WHERE paid)").As("paid_subscriptions"),
+			goqu.L("COALESCE(sum(plan_rate) FILTER (WHERE paid), 0)").As("plan_revenue"),
+			goqu.L("COALESCE(sum(addon_rate) FILTER (WHERE paid), 0)").As("addon_revenue"),
+		).
+		GroupBy(goqu.C("plan_name"), goqu.C("month")).
+		Order(goqu.C("month").Asc(), goqu.C("plan_name").Asc())
+	d.LogSQL(ds)
+
+	var rows []RevenueReportRow
+	if err := ds.Executor().ScanStructsContext(ctx, &rows); err != nil {
+		return nil, errors.Wrap(err, "unable to compute the revenue report")
+	}
+
+	return rows, nil
+}
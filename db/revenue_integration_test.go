@@ -0,0 +1,53 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRevenueReport(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	addon := addTestAddon(t, addTestResourceType(t, false), 1)
+	paid := subscribeTestUser(t, addTestUser(t), plan, &SubscriptionOptions{Paid: true, Periods: 1})
+	attachTestAddon(t, paid, addon, 2)
+	unpaid := subscribeTestUser(t, addTestUser(t), plan, nil)
+	attachTestAddon(t, unpaid, addon, 1)
+	test := subscribeTestUser(t, addTestUser(t), plan, &SubscriptionOptions{Paid: true, Periods: 1})
+	if err := testDB.SetTestUser(ctx, test.User.Username, true); err != nil {
+		t.Fatalf("unable to mark the user as a test user: %s", err)
+	}
+
+	start := time.Now().Add(-time.Hour)
+	rows, err := testDB.RevenueReport(ctx, start, time.Now().Add(time.Hour), plan.Name)
+	if err != nil {
+		t.Fatalf("unable to compute the revenue report: %s", err)
+	}
+
+	// Only the paid subscription contributes revenue: the plan rate of 100 and
+	// two units of an add-on with a rate of 10.
+	startedAt := paid.EffectiveStartDate.UTC()
+	month := time.Date(startedAt.Year(), startedAt.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if len(rows) != 1 {
+		t.Fatalf("expected a single row, got %+v", rows)
+	}
+	row := rows[0]
+	if row.PlanName != plan.Name || !row.Month.Equal(month) || row.Subscriptions != 2 || row.PaidSubscriptions != 1 ||
+		row.PlanRevenue != 100 || row.AddonRevenue != 20 {
+		t.Errorf("the revenue report wasn't computed correctly: %+v", row)
+	}
+
+	// Subscriptions that started after the window aren't included.
+	rows, err = testDB.RevenueReport(ctx, start.AddDate(-1, 0, 0), start.AddDate(0, 0, -1), plan.Name)
+	if err != nil {
+		t.Fatalf("unable to compute the revenue report: %s", err)
+	}
+	if len(rows) != 0 {
+		t.Errorf("expected no rows for an earlier window, got %+v", rows)
+	}
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// seedLockKey identifies the advisory lock held while the database is seeded,
+// so that replicas that start at the same time don't seed it concurrently.
+const seedLockKey = "subscriptions.seed"
+
+// SeedPlan describes a plan that the database is seeded with. The quota
+// defaults map resource type names to quota values.
+type SeedPlan struct {
+	Name          string
+	Description   string
+	Rate          float64
+	QuotaDefaults map[string]float64
+}
+
+// SeedSettings describes the reference data that the database is seeded with.
+type SeedSettings struct {
+	UpdateOperations []string
+	ResourceTypes    []ResourceType
+	Plans            []SeedPlan
+}
+
+// SeedResult counts the records that were added while seeding the database.
+type SeedResult struct {
+	UpdateOperations int
+	ResourceTypes    int
+	Plans            int
+	QuotaDefaults    int
+}
+
+// Seed adds the update operations, resource types and plans in the settings
+// that don't exist yet. Existing records are left alone so that changes made
+// by administrators aren't undone, with one exception: an existing plan gets a
+// quota default for each seeded resource type that it doesn't have a quota
+// default for yet. Plans that have been deleted aren't restored. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) Seed(ctx context.Context, settings *SeedSettings, opts ...QueryOption) (*SeedResult, error) {
+	result := &SeedResult{}
+
+	err := d.inTxWithOpts(ctx, func(tx *goqu.TxDatabase) error {
+		*result = SeedResult{}
+
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", seedLockKey); err != nil {
+			return errors.Wrap(err, "unable to lock the database for seeding")
+		}
+
+		for _, name := range settings.UpdateOperations {
+			added, err := d.ensureUpdateOperation(ctx, tx, name)
+			if err != nil {
+				return err
+			}
+			if added {
+				result.UpdateOperations++
+			}
+		}
+
+		for i := range settings.ResourceTypes {
+			existing, err := d.GetResourceTypeByName(ctx, settings.ResourceTypes[i].Name, WithTX(tx))
+			if err != nil {
+				return errors.Wrapf(err, "unable to look up resource type %s", settings.ResourceTypes[i].Name)
+			}
+			if existing.ID != "" {
+				continue
+			}
+			if _, err = d.AddResourceType(ctx, &settings.ResourceTypes[i], WithTX(tx)); err != nil {
+				return err
+			}
+			result.ResourceTypes++
+		}
+
+		now := time.Now()
+		for i := range settings.Plans {
+			planAdded, quotaDefaultsAdded, err := d.ensurePlan(ctx, tx, &settings.Plans[i], now)
+			if err != nil {
+				return err
+			}
+			if planAdded {
+				result.Plans++
+			}
+			result.QuotaDefaults += quotaDefaultsAdded
+		}
+
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ensureUpdateOperation adds the update operation if it doesn't exist yet, and
+// returns true if it was added.
+func (d *Database) ensureUpdateOperation(ctx context.Context, tx *goqu.TxDatabase, name string) (bool, error) {
+	id, err := d.GetOperationID(ctx, name, WithTX(tx))
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to look up update operation %s", name)
+	}
+	if id != "" {
+		return false, nil
+	}
+
+	ds := tx.Insert(t.UpdateOperations).Rows(goqu.Record{"name": name})
+	d.LogSQL(ds)
+
+	if _, err = ds.Executor().ExecContext(ctx); err != nil {
+		return false, errors.Wrapf(err, "unable to add update operation %s", name)
+	}
+
+	return true, nil
+}
+
+// ensurePlan adds the seeded plan if no plan with the same name exists, or adds
+// the quota defaults that an existing plan is missing. Returns whether the plan
+// was added and the number of quota defaults that were added to it.
+func (d *Database) ensurePlan(ctx context.Context, tx *goqu.TxDatabase, seed *SeedPlan, now time.Time) (bool, int, error) {
+	plan, err := d.GetPlanByName(ctx, seed.Name, WithTX(tx), WithIncludeDeleted())
+	if err != nil {
+		return false, 0, err
+	}
+	if plan != nil && plan.DeletedAt.Valid {
+		return false, 0, nil
+	}
+
+	// Only the quota defaults for resource types that the plan doesn't have yet
+	// are added.
+	existing := make(map[string]bool)
+	if plan != nil {
+		for _, pqd := range plan.QuotaDefaults {
+			existing[pqd.ResourceType.Name] = true
+		}
+	}
+
+	var quotaDefaults []PlanQuotaDefault
+	for name, value := range seed.QuotaDefaults {
+		if existing[name] {
+			continue
+		}
+
+		resourceType, err := d.GetResourceTypeByName(ctx, name, WithTX(tx))
+		if err != nil {
+			return false, 0, errors.Wrapf(err, "unable to look up resource type %s", name)
+		}
+		if resourceType.ID == "" {
+			return false, 0, errors.Errorf("the quota defaults for plan %s refer to unknown resource type %s", seed.Name, name)
+		}
+
+		quotaDefaults = append(quotaDefaults, PlanQuotaDefault{
+			QuotaValue:    value,
+			ResourceType:  *resourceType,
+			EffectiveDate: now,
+		})
+	}
+
+	if plan == nil {
+		_, err = d.AddPlan(ctx, &Plan{
+			Name:          seed.Name,
+			Description:   seed.Description,
+			QuotaDefaults: quotaDefaults,
+			Rates:         []PlanRate{{EffectiveDate: now, Rate: seed.Rate}},
+		}, WithTX(tx))
+		if err != nil {
+			return false, 0, err
+		}
+		return true, len(quotaDefaults), nil
+	}
+
+	for _, pqd := range quotaDefaults {
+		ds := tx.Insert(t.PQD).Rows(goqu.Record{
+			"plan_id":          plan.ID,
+			"resource_type_id": pqd.ResourceType.ID,
+			"quota_value":      pqd.QuotaValue,
+			"effective_date":   pqd.EffectiveDate,
+		})
+		d.LogSQL(ds)
+
+		if _, err = ds.Executor().ExecContext(ctx); err != nil {
+			return false, 0, errors.Wrapf(err, "unable to add a quota default to plan %s", seed.Name)
+		}
+	}
+
+	return false, len(quotaDefaults), nil
+}
@@ -0,0 +1,110 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := ResourceType{Name: uniqueName("resource"), Unit: "bytes"}
+	compute := ResourceType{Name: uniqueName("resource"), Unit: "cpu hours", Consumable: true}
+	settings := &SeedSettings{
+		UpdateOperations: []string{uniqueName("operation")},
+		ResourceTypes:    []ResourceType{storage, compute},
+		Plans: []SeedPlan{
+			{
+				Name:          uniqueName("plan"),
+				Description:   "A seeded plan",
+				Rate:          50,
+				QuotaDefaults: map[string]float64{storage.Name: 10},
+			},
+		},
+	}
+
+	result, err := testDB.Seed(ctx, settings)
+	if err != nil {
+		t.Fatalf("unable to seed the database: %s", err)
+	}
+	expected := SeedResult{UpdateOperations: 1, ResourceTypes: 2, Plans: 1, QuotaDefaults: 1}
+	if *result != expected {
+		t.Errorf("expected %+v, got %+v", expected, *result)
+	}
+
+	plan, err := testDB.GetPlanByName(ctx, settings.Plans[0].Name)
+	if err != nil {
+		t.Fatalf("unable to look up the seeded plan: %s", err)
+	}
+	if plan == nil || len(plan.QuotaDefaults) != 1 || plan.QuotaDefaults[0].QuotaValue != 10 {
+		t.Fatalf("the plan wasn't seeded correctly: %+v", plan)
+	}
+	if rate := plan.GetActiveRate(); rate == nil || rate.Rate != 50 {
+		t.Errorf("expected the plan to have a rate of 50, got %+v", rate)
+	}
+	operationID(t, settings.UpdateOperations[0])
+
+	// Seeding again adds nothing but the quota defaults that the plan is
+	// missing.
+	settings.Plans[0].QuotaDefaults[compute.Name] = 20
+	settings.Plans[0].QuotaDefaults[storage.Name] = 30
+	if result, err = testDB.Seed(ctx, settings); err != nil {
+		t.Fatalf("unable to seed the database again: %s", err)
+	}
+	expected = SeedResult{QuotaDefaults: 1}
+	if *result != expected {
+		t.Errorf("expected %+v, got %+v", expected, *result)
+	}
+
+	if plan, err = testDB.GetPlanByName(ctx, settings.Plans[0].Name); err != nil {
+		t.Fatalf("unable to look up the seeded plan: %s", err)
+	}
+	values := make(map[string]float64)
+	for _, pqd := range plan.QuotaDefaults {
+		values[pqd.ResourceType.Name] = pqd.QuotaValue
+	}
+	if len(values) != 2 || values[storage.Name] != 10 || values[compute.Name] != 20 {
+		t.Errorf("expected the existing quota default to be kept, got %v", values)
+	}
+
+	// Deleted plans aren't restored.
+	if err = testDB.DeletePlan(ctx, plan.ID); err != nil {
+		t.Fatalf("unable to delete the plan: %s", err)
+	}
+	if result, err = testDB.Seed(ctx, settings); err != nil {
+		t.Fatalf("unable to seed the database again: %s", err)
+	}
+	if *result != (SeedResult{}) {
+		t.Errorf("expected nothing to be added, got %+v", *result)
+	}
+}
+
+func TestSeedUnknownResourceType(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	settings := &SeedSettings{
+		Plans: []SeedPlan{
+			{
+				Name:          uniqueName("plan"),
+				Rate:          50,
+				QuotaDefaults: map[string]float64{uniqueName("missing"): 10},
+			},
+		},
+	}
+	if _, err := testDB.Seed(ctx, settings); err == nil {
+		t.Fatal("expected seeding a plan with an unknown resource type to fail")
+	}
+
+	// Nothing is added when seeding fails.
+	plan, err := testDB.GetPlanByName(ctx, settings.Plans[0].Name)
+	if err != nil {
+		t.Fatalf("unable to look up the plan: %s", err)
+	}
+	if plan != nil {
+		t.Errorf("expected the plan not to be added, got %+v", plan)
+	}
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// SubscriptionNote is a free-form note that an administrator attached to a
+// subscription.
+type SubscriptionNote struct {
+	ID             string    `db:"id" goqu:"defaultifempty"`
+	SubscriptionID string    `db:"subscription_id"`
+	Note           string    `db:"note"`
+	CreatedBy      string    `db:"created_by"`
+	CreatedAt      time.Time `db:"created_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the note to the type used in responses.
+func (n *SubscriptionNote) ToAPIType() *api.SubscriptionNote {
+	return &api.SubscriptionNote{
+		ID:        n.ID,
+		Note:      n.Note,
+		CreatedBy: n.CreatedBy,
+		CreatedAt: n.CreatedAt,
+	}
+}
+
+// SubscriptionTag is a key/value tag that an administrator attached to a
+// subscription.
+type SubscriptionTag struct {
+	SubscriptionID string    `db:"subscription_id"`
+	Key            string    `db:"key"`
+	Value          string    `db:"value"`
+	LastModifiedBy string    `db:"last_modified_by"`
+	LastModifiedAt time.Time `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the tag to the type used in responses.
+func (g *SubscriptionTag) ToAPIType() *api.SubscriptionTag {
+	return &api.SubscriptionTag{
+		Key:            g.Key,
+		Value:          g.Value,
+		LastModifiedBy: g.LastModifiedBy,
+		LastModifiedAt: g.LastModifiedAt,
+	}
+}
+
+// WithSubscriptionTag allows callers to limit the listings and reports that
+// support it to the subscriptions with a tag. If hasValue is false, every
+// subscription with the key matches, whatever its value.
+func WithSubscriptionTag(key, value string, hasValue bool) QueryOption {
+	return func(s *QuerySettings) {
+		s.tagKey = key
+		s.tagValue = value
+		s.hasTagValue = hasValue
+	}
+}
+
+// tagExp returns the condition that limits a query to the subscriptions with
+// the tag, or a condition that's always true if the query isn't limited to a
+// tag. The column must contain subscription IDs.
+func (s *QuerySettings) tagExp(db GoquDatabase, subscriptionID exp.IdentifierExpression) exp.Expression {
+	if s.tagKey == "" {
+		return goqu.L("TRUE")
+	}
+
+	where := []exp.Expression{
+		t.SubscriptionTags.Col("subscription_id").Eq(subscriptionID),
+		t.SubscriptionTags.Col("key").Eq(s.tagKey),
+	}
+	if s.hasTagValue {
+		where = append(where, t.SubscriptionTags.Col("value").Eq(s.tagValue))
+	}
+
+	return goqu.L("EXISTS ?", db.From(t.SubscriptionTags).Select(goqu.L("1")).Where(where...))
+}
+
+// AddSubscriptionNote attaches a note to a subscription and sets the ID and
+// creation time of the note. Accepts a variable number of QueryOptions, though
+// only WithTX is currently supported.
+func (d *Database) AddSubscriptionNote(ctx context.Context, note *SubscriptionNote, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, note.SubscriptionID); err != nil {
+		return err
+	}
+
+	ds := db.Insert(t.SubscriptionNotes).
+		Rows(goqu.Record{
+			"subscription_id": note.SubscriptionID,
+			"note":            note.Note,
+			"created_by":      note.CreatedBy,
+		}).
+		Returning(t.SubscriptionNotes.Col("id"), t.SubscriptionNotes.Col("created_at"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanStructContext(ctx, note); err != nil {
+		return errors.Wrapf(err, "unable to add a note to subscription %s", note.SubscriptionID)
+	}
+
+	return nil
+}
+
+// ListSubscriptionNotes returns the notes attached to a subscription, oldest
+// first. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListSubscriptionNotes(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]SubscriptionNote, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.SubscriptionNotes).
+		Select(
+			t.SubscriptionNotes.Col("id"),
+			t.SubscriptionNotes.Col("subscription_id"),
+			t.SubscriptionNotes.Col("note"),
+			t.SubscriptionNotes.Col("created_by"),
+			t.SubscriptionNotes.Col("created_at"),
+		).
+		Where(
+			t.SubscriptionNotes.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionNotes.Col("subscription_id")),
+		).
+		Order(t.SubscriptionNotes.Col("created_at").Asc(), t.SubscriptionNotes.Col("id").Asc())
+	d.LogSQL(ds)
+
+	var notes []SubscriptionNote
+	if err := ds.Executor().ScanStructsContext(ctx, &notes); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the notes for subscription %s", subscriptionID)
+	}
+
+	return notes, nil
+}
+
+// DeleteSubscriptionNote removes a note from a subscription. It returns false
+// if the subscription doesn't have the note. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) DeleteSubscriptionNote(ctx context.Context, subscriptionID, noteID string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	count, err := d.deleteRows(
+		ctx, db, t.SubscriptionNotes,
+		querySettings.subscriptionTenantExp(db, t.SubscriptionNotes.Col("subscription_id")),
+		t.SubscriptionNotes.Col("id").Eq(noteID),
+		t.SubscriptionNotes.Col("subscription_id").Eq(subscriptionID),
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to delete note %s", noteID)
+	}
+
+	return count > 0, nil
+}
+
+// SetSubscriptionTag attaches a tag to a subscription, replacing the value of
+// the tag if the subscription already has it. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetSubscriptionTag(ctx context.Context, tag *SubscriptionTag, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, tag.SubscriptionID); err != nil {
+		return err
+	}
+
+	ds := db.Insert(t.SubscriptionTags).
+		Rows(goqu.Record{
+			"subscription_id":  tag.SubscriptionID,
+			"key":              tag.Key,
+			"value":            tag.Value,
+			"last_modified_by": tag.LastModifiedBy,
+		}).
+		OnConflict(goqu.DoUpdate("subscription_id, key", goqu.Record{
+			"value":            tag.Value,
+			"last_modified_by": tag.LastModifiedBy,
+			"last_modified_at": CurrentTimestamp,
+		}))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to tag subscription %s with %s", tag.SubscriptionID, tag.Key)
+	}
+
+	return nil
+}
+
+// ListSubscriptionTags returns the tags attached to a subscription, in order by
+// key. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListSubscriptionTags(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]SubscriptionTag, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.SubscriptionTags).
+		Select(
+			t.SubscriptionTags.Col("subscription_id"),
+			t.SubscriptionTags.Col("key"),
+			t.SubscriptionTags.Col("value"),
+			t.SubscriptionTags.Col("last_modified_by"),
+			t.SubscriptionTags.Col("last_modified_at"),
+		).
+		Where(
+			t.SubscriptionTags.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.SubscriptionTags.Col("subscription_id")),
+		).
+		Order(t.SubscriptionTags.Col("key").Asc())
+	d.LogSQL(ds)
+
+	var tags []SubscriptionTag
+	if err := ds.Executor().ScanStructsContext(ctx, &tags); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the tags for subscription %s", subscriptionID)
+	}
+
+	return tags, nil
+}
+
+// DeleteSubscriptionTag removes a tag from a subscription. It returns false if
+// the subscription doesn't have the tag. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) DeleteSubscriptionTag(ctx context.Context, subscriptionID, key string, opts ...QueryOption) (bool, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	count, err := d.deleteRows(
+		ctx, db, t.SubscriptionTags,
+		querySettings.subscriptionTenantExp(db, t.SubscriptionTags.Col("subscription_id")),
+		t.SubscriptionTags.Col("subscription_id").Eq(subscriptionID),
+		t.SubscriptionTags.Col("key").Eq(key),
+	)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to delete tag %s", key)
+	}
+
+	return count > 0, nil
+}
@@ -19,4 +19,47 @@ var (
 	Addons             = goqu.T("addons")
 	PlanRates          = goqu.T("plan_rates")
 	AddonRates         = goqu.T("addon_rates")
+	BulkJobs           = goqu.T("bulk_jobs")
+	Webhooks           = goqu.T("webhooks")
+	FailedDeliveries   = goqu.T("failed_webhook_deliveries")
+	EventOutbox        = goqu.T("event_outbox")
+	PendingChanges     = goqu.T("pending_subscription_changes")
+	Trials             = goqu.T("trials")
+	UserMerges         = goqu.T("user_merges")
+	UserPurges         = goqu.T("user_purges")
+	MeteredRates       = goqu.T("metered_rates")
+	Reservations       = goqu.T("reservations")
+	ReservationAmounts = goqu.T("reservation_amounts")
+	Groups             = goqu.T("groups")
+	GroupMembers       = goqu.T("group_members")
+	AddonUsages        = goqu.T("subscription_addon_usages")
+	DiscountCodes      = goqu.T("discount_codes")
+	Redemptions        = goqu.T("discount_redemptions")
+	ExternalInvoices   = goqu.T("external_invoices")
+	Invoices           = goqu.T("invoices")
+	InvoiceLineItems   = goqu.T("invoice_line_items")
+	PaymentStatuses    = goqu.T("subscription_payment_statuses")
+	PaymentChanges     = goqu.T("payment_status_changes")
+	Reminders          = goqu.T("expiration_reminders")
+	QuotaPolicies      = goqu.T("quota_policies")
+	AddonBundles       = goqu.T("addon_bundles")
+	BundleAddons       = goqu.T("addon_bundle_addons")
+	Prerequisites      = goqu.T("addon_prerequisites")
+	Compatibility      = goqu.T("plan_addon_compatibility")
+	QuotaChanges       = goqu.T("scheduled_quota_changes")
+	DailyRollups       = goqu.T("daily_usage_rollups")
+	MonthlyRollups     = goqu.T("monthly_usage_rollups")
+	RollupState        = goqu.T("usage_rollup_state")
+	ArchivedUpdates    = goqu.T("archived_updates")
+	CreditBalances     = goqu.T("credit_balances")
+	CreditLedger       = goqu.T("credit_ledger")
+	UsageRules         = goqu.T("usage_rules")
+	HourlyDeltas       = goqu.T("usage_hourly_deltas")
+	FlaggedUpdates     = goqu.T("flagged_usage_updates")
+	QuarantinedUpdates = goqu.T("quarantined_usage_updates")
+	RequestReplies     = goqu.T("request_replies")
+	SubscriptionNotes  = goqu.T("subscription_notes")
+	SubscriptionTags   = goqu.T("subscription_tags")
+	PlanFeatures       = goqu.T("plan_features")
+	Purchases          = goqu.T("subscription_purchases")
 )
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// WithTenant allows callers to limit queries to the users, plans and
+// subscriptions of a single tenant, and to assign the records that they add to
+// that tenant. Plans that don't belong to a tenant are shared by every tenant.
+// An empty tenant ID leaves queries unscoped. The tenant columns require the
+// tenants migration.
+func WithTenant(tenantID string) QueryOption {
+	return func(s *QuerySettings) {
+		s.tenant = tenantID
+	}
+}
+
+// Scoped returns a *Database that adds the given options to every query it
+// runs, including the queries that its methods run on each other's behalf.
+// This is how a tenant is enforced for every query made on behalf of a request.
+func (d *Database) Scoped(opts ...QueryOption) *Database {
+	scoped := *d
+	scoped.defaults = append(append([]QueryOption{}, d.defaults...), opts...)
+	return &scoped
+}
+
+// tenantExp returns the condition that limits a query to the rows of a table
+// that belong to the tenant, or a condition that's always true if the query
+// isn't scoped to a tenant.
+func (s *QuerySettings) tenantExp(table exp.IdentifierExpression) exp.Expression {
+	if s.tenant == "" {
+		return goqu.L("TRUE")
+	}
+	return table.Col("tenant_id").Eq(s.tenant)
+}
+
+// sharedTenantExp is the same as tenantExp, except that it also matches the
+// rows that don't belong to any tenant.
+func (s *QuerySettings) sharedTenantExp(table exp.IdentifierExpression) exp.Expression {
+	if s.tenant == "" {
+		return goqu.L("TRUE")
+	}
+	return goqu.Or(table.Col("tenant_id").Eq(s.tenant), table.Col("tenant_id").IsNull())
+}
+
+// subscriptionTenantExp returns the condition that limits a query to the rows
+// whose subscription, referred to by the given column, belongs to the tenant.
+// It's used for the tables that don't have tenant columns of their own.
+func (s *QuerySettings) subscriptionTenantExp(db GoquDatabase, col exp.IdentifierExpression) exp.Expression {
+	if s.tenant == "" {
+		return goqu.L("TRUE")
+	}
+	return col.In(db.From(t.Subscriptions).Select(t.Subscriptions.Col("id")).Where(s.tenantExp(t.Subscriptions)))
+}
+
+// userTenantExp is the same as subscriptionTenantExp, except that the column
+// refers to a user.
+func (s *QuerySettings) userTenantExp(db GoquDatabase, col exp.IdentifierExpression) exp.Expression {
+	if s.tenant == "" {
+		return goqu.L("TRUE")
+	}
+	return col.In(db.From(t.Users).Select(t.Users.Col("id")).Where(s.tenantExp(t.Users)))
+}
+
+// planTenantExp is the same as subscriptionTenantExp, except that the column
+// refers to a plan, and plans that are shared by every tenant also match.
+func (s *QuerySettings) planTenantExp(db GoquDatabase, col exp.IdentifierExpression) exp.Expression {
+	if s.tenant == "" {
+		return goqu.L("TRUE")
+	}
+	return col.In(db.From(t.Plans).Select(t.Plans.Col("id")).Where(s.sharedTenantExp(t.Plans)))
+}
+
+// tenantRecord assigns a record that's about to be inserted to the tenant, if
+// the query is scoped to one.
+func (s *QuerySettings) tenantRecord(record goqu.Record) goqu.Record {
+	if s.tenant != "" {
+		record["tenant_id"] = s.tenant
+	}
+	return record
+}
+
+// checkSubscriptionTenant returns ErrSubscriptionNotFound if the query is
+// scoped to a tenant and the subscription doesn't belong to it. It's called
+// before rows that refer to a subscription are inserted into tables that don't
+// have tenant columns of their own.
+func (d *Database) checkSubscriptionTenant(
+	ctx context.Context, db GoquDatabase, querySettings *QuerySettings, subscriptionID string,
+) error {
+	if querySettings.tenant == "" {
+		return nil
+	}
+
+	ds := db.From(t.Subscriptions).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID), querySettings.tenantExp(t.Subscriptions))
+	d.LogSQL(ds)
+
+	count, err := ds.CountContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to look up subscription %s", subscriptionID)
+	}
+	if count == 0 {
+		return suberrors.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+// checkUserTenant is the same as checkSubscriptionTenant, except that it checks
+// a user and returns ErrUserNotFound.
+func (d *Database) checkUserTenant(ctx context.Context, db GoquDatabase, querySettings *QuerySettings, userID string) error {
+	if querySettings.tenant == "" {
+		return nil
+	}
+
+	ds := db.From(t.Users).Where(t.Users.Col("id").Eq(userID), querySettings.tenantExp(t.Users))
+	d.LogSQL(ds)
+
+	count, err := ds.CountContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to look up user %s", userID)
+	}
+	if count == 0 {
+		return suberrors.ErrUserNotFound
+	}
+
+	return nil
+}
+
+// checkPlanTenant is the same as checkSubscriptionTenant, except that it checks
+// a plan and returns ErrPlanNotFound. Plans that are shared by every tenant
+// don't match, because a tenant can't change them.
+func (d *Database) checkPlanTenant(ctx context.Context, db GoquDatabase, querySettings *QuerySettings, planID string) error {
+	if querySettings.tenant == "" {
+		return nil
+	}
+
+	ds := db.From(t.Plans).Where(t.Plans.Col("id").Eq(planID), querySettings.tenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	count, err := ds.CountContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to look up plan %s", planID)
+	}
+	if count == 0 {
+		return suberrors.ErrPlanNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,531 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// testTenant is a tenant with a user who's subscribed to a plan that belongs
+// to the tenant. The database is scoped to the tenant.
+type testTenant struct {
+	db           *Database
+	user         *User
+	plan         *Plan
+	subscription *Subscription
+}
+
+// addTestTenant adds a user, a plan with the quota defaults and a subscription
+// to a new tenant.
+func addTestTenant(t *testing.T, quotaDefaults ...PlanQuotaDefault) *testTenant {
+	t.Helper()
+	ctx := context.Background()
+
+	tenant := &testTenant{db: testDB.Scoped(WithTenant(uniqueName("tenant")))}
+
+	var err error
+	if tenant.user, err = tenant.db.EnsureUser(ctx, uniqueName("user")); err != nil {
+		t.Fatalf("unable to add a user: %s", err)
+	}
+
+	effectiveDate := time.Now().Add(-24 * time.Hour)
+	for i := range quotaDefaults {
+		quotaDefaults[i].EffectiveDate = effectiveDate
+	}
+	plan := &Plan{
+		Name:          uniqueName("plan"),
+		Description:   "A plan that belongs to a tenant.",
+		QuotaDefaults: quotaDefaults,
+		Rates:         []PlanRate{{EffectiveDate: effectiveDate, Rate: 100}},
+	}
+	if _, err = tenant.db.AddPlan(ctx, plan); err != nil {
+		t.Fatalf("unable to add a plan: %s", err)
+	}
+	if tenant.plan, err = tenant.db.GetPlanByName(ctx, plan.Name); err != nil || tenant.plan == nil {
+		t.Fatalf("unable to look up plan %s: %v", plan.Name, err)
+	}
+
+	subscriptionID, err := tenant.db.SetActiveSubscription(ctx, tenant.user.ID, tenant.plan, nil)
+	if err != nil {
+		t.Fatalf("unable to subscribe %s to %s: %s", tenant.user.Username, plan.Name, err)
+	}
+	if tenant.subscription, err = tenant.db.GetSubscriptionByID(ctx, subscriptionID); err != nil || tenant.subscription == nil {
+		t.Fatalf("unable to look up subscription %s: %v", subscriptionID, err)
+	}
+
+	return tenant
+}
+
+func TestTenantUsers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tenant, other := addTestTenant(t), addTestTenant(t)
+	shared := addTestUser(t)
+
+	for _, username := range []string{tenant.user.Username, shared.Username} {
+		found, err := other.db.GetUserByUsername(ctx, username)
+		if err != nil {
+			t.Fatalf("unable to look up %s: %s", username, err)
+		}
+		if found != nil {
+			t.Errorf("expected %s not to be visible to another tenant", username)
+		}
+
+		exists, err := other.db.UserExists(ctx, username)
+		if err != nil {
+			t.Fatalf("unable to check whether %s exists: %s", username, err)
+		}
+		if exists {
+			t.Errorf("expected %s not to exist in another tenant", username)
+		}
+	}
+
+	user, err := other.db.GetUser(ctx, tenant.user.ID)
+	if err != nil {
+		t.Fatalf("unable to look up user %s: %s", tenant.user.ID, err)
+	}
+	if user.ID != "" {
+		t.Errorf("expected user %s not to be visible to another tenant", tenant.user.ID)
+	}
+
+	// Usernames are unique across tenants, so the user can't be added again.
+	if _, err = other.db.EnsureUser(ctx, tenant.user.Username); !errors.Is(err, suberrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+
+	users, err := tenant.db.ListUsers(ctx, "")
+	if err != nil {
+		t.Fatalf("unable to list the users: %s", err)
+	}
+	if len(users) != 1 || users[0].ID != tenant.user.ID {
+		t.Errorf("expected only %s to be listed, got %+v", tenant.user.Username, users)
+	}
+
+	usernames, err := tenant.db.ListUsernames(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the usernames: %s", err)
+	}
+	if len(usernames) != 1 || usernames[0] != tenant.user.Username {
+		t.Errorf("expected only %s to be listed, got %v", tenant.user.Username, usernames)
+	}
+}
+
+func TestTenantPlans(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tenant, other := addTestTenant(t), addTestTenant(t)
+	shared := addTestPlan(t)
+
+	plan, err := other.db.GetPlanByID(ctx, tenant.plan.ID)
+	if err != nil {
+		t.Fatalf("unable to look up plan %s: %s", tenant.plan.ID, err)
+	}
+	if plan != nil {
+		t.Error("expected the plan not to be visible to another tenant")
+	}
+	if plan, err = other.db.GetPlanByName(ctx, tenant.plan.Name); err != nil || plan != nil {
+		t.Errorf("expected the plan not to be found by name in another tenant, got %+v, %v", plan, err)
+	}
+
+	// Plans without a tenant are shared by every tenant.
+	if plan, err = other.db.GetPlanByID(ctx, shared.ID); err != nil || plan == nil {
+		t.Errorf("expected the shared plan to be visible, got %+v, %v", plan, err)
+	}
+
+	plans, err := other.db.ListPlans(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the plans: %s", err)
+	}
+	listed := make(map[string]bool)
+	for _, plan := range plans {
+		listed[plan.ID] = true
+	}
+	if !listed[other.plan.ID] || !listed[shared.ID] || listed[tenant.plan.ID] {
+		t.Errorf("expected the tenant's plan and the shared plan to be listed, but not the other tenant's plan")
+	}
+
+	// Another tenant can't change the plan, and no tenant can change a shared plan.
+	for _, planID := range []string{tenant.plan.ID, shared.ID} {
+		if err = other.db.SetPlanPeriod(ctx, planID, &SubscriptionPeriod{Unit: PeriodUnitDays, Days: 7}); err != nil {
+			t.Fatalf("unable to set the plan period: %s", err)
+		}
+		period, err := testDB.GetPlanPeriod(ctx, planID)
+		if err != nil {
+			t.Fatalf("unable to look up the plan period: %s", err)
+		}
+		if period.Unit == PeriodUnitDays {
+			t.Errorf("expected the period of plan %s not to change", planID)
+		}
+	}
+
+	subscribers, err := other.db.PlanSubscriberUsernames(ctx, tenant.plan.ID)
+	if err != nil {
+		t.Fatalf("unable to list the subscribers: %s", err)
+	}
+	if len(subscribers) != 0 {
+		t.Errorf("expected no subscribers to be visible to another tenant, got %v", subscribers)
+	}
+}
+
+func TestTenantSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tenant, other := addTestTenant(t), addTestTenant(t)
+	username := tenant.user.Username
+
+	subscription, err := other.db.GetSubscriptionByID(ctx, tenant.subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription: %s", err)
+	}
+	if subscription != nil {
+		t.Error("expected the subscription not to be visible to another tenant")
+	}
+	if _, err = other.db.GetActiveSubscription(ctx, username); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound, got %v", err)
+	}
+
+	hasPlan, err := other.db.UserHasActivePlan(ctx, username)
+	if err != nil || hasPlan {
+		t.Errorf("expected no active plan in another tenant, got %t, %v", hasPlan, err)
+	}
+	onPlan, err := other.db.UserOnPlan(ctx, username, tenant.plan.Name)
+	if err != nil || onPlan {
+		t.Errorf("expected the user not to be on the plan in another tenant, got %t, %v", onPlan, err)
+	}
+
+	// Expirations and cohorts only include the subscriptions of the tenant.
+	before := tenant.subscription.EffectiveEndDate.Add(time.Hour)
+	expiring, err := other.db.ExpiringSubscriptions(ctx, tenant.plan.Name, before)
+	if err != nil || len(expiring) != 0 {
+		t.Errorf("expected no expiring subscriptions in another tenant, got %+v, %v", expiring, err)
+	}
+	active, err := other.db.ActiveSubscriptionsForUsers(ctx, []string{username})
+	if err != nil || len(active) != 0 {
+		t.Errorf("expected no active subscriptions in another tenant, got %+v, %v", active, err)
+	}
+
+	if _, err = other.db.SetActiveSubscription(ctx, tenant.user.ID, other.plan, nil); !errors.Is(err, suberrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound when subscribing another tenant's user, got %v", err)
+	}
+
+	if err = other.db.EndSubscription(ctx, tenant.subscription.ID, "test"); err != nil {
+		t.Fatalf("unable to end the subscription: %s", err)
+	}
+	if subscription, err = tenant.db.GetSubscriptionByID(ctx, tenant.subscription.ID); err != nil {
+		t.Fatalf("unable to look up the subscription: %s", err)
+	}
+	if !subscription.EffectiveEndDate.Equal(tenant.subscription.EffectiveEndDate) {
+		t.Error("expected another tenant not to be able to end the subscription")
+	}
+
+	var exported []string
+	err = tenant.db.ExportSubscriptions(ctx, 10, func(rows []SubscriptionExportRow) error {
+		for _, row := range rows {
+			exported = append(exported, row.SubscriptionID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to export the subscriptions: %s", err)
+	}
+	if len(exported) != 1 || exported[0] != tenant.subscription.ID {
+		t.Errorf("expected only the tenant's subscription to be exported, got %v", exported)
+	}
+}
+
+func TestTenantQuotasAndUsages(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	tenant := addTestTenant(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+	other := addTestTenant(t)
+	subscriptionID := tenant.subscription.ID
+
+	if _, _, err := tenant.db.ApplyUsage(ctx, UpdateTypeAdd, 12, compute.ID, subscriptionID); err != nil {
+		t.Fatalf("unable to record the usage: %s", err)
+	}
+
+	if _, _, err := other.db.ApplyUsage(ctx, UpdateTypeAdd, 1, compute.ID, subscriptionID); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when recording usage, got %v", err)
+	}
+	if _, err := other.db.SetQuota(ctx, 100, compute.ID, subscriptionID); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when setting the quota, got %v", err)
+	}
+	if usage := currentUsage(t, compute.ID, subscriptionID); usage != 12 {
+		t.Errorf("expected the usage to be left at 12, got %g", usage)
+	}
+	if quotas := subscriptionQuotaValues(t, subscriptionID); quotas[compute.ID] != 10 {
+		t.Errorf("expected the quota to be left at 10, got %g", quotas[compute.ID])
+	}
+
+	usages, err := other.db.SubscriptionUsages(ctx, subscriptionID)
+	if err != nil || len(usages) != 0 {
+		t.Errorf("expected no usages to be visible to another tenant, got %+v, %v", usages, err)
+	}
+	quotas, err := other.db.SubscriptionQuotas(ctx, subscriptionID)
+	if err != nil || len(quotas) != 0 {
+		t.Errorf("expected no quotas to be visible to another tenant, got %+v, %v", quotas, err)
+	}
+	_, found, err := other.db.GetCurrentUsage(ctx, compute.ID, subscriptionID)
+	if err != nil || found {
+		t.Errorf("expected the current usage not to be found in another tenant, got %t, %v", found, err)
+	}
+	_, found, err = other.db.GetCurrentQuota(ctx, compute.ID, subscriptionID)
+	if err != nil || found {
+		t.Errorf("expected the current quota not to be found in another tenant, got %t, %v", found, err)
+	}
+
+	overages, err := other.db.GetUserOverages(ctx, tenant.user.Username)
+	if err != nil || len(overages) != 0 {
+		t.Errorf("expected no overages to be visible to another tenant, got %+v, %v", overages, err)
+	}
+	if overages, err = tenant.db.GetUserOverages(ctx, tenant.user.Username); err != nil || len(overages) != 1 {
+		t.Errorf("expected the tenant's overage, got %+v, %v", overages, err)
+	}
+}
+
+func TestTenantAddons(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	tenant, other := addTestTenant(t), addTestTenant(t)
+	addon := addTestAddon(t, storage, 1)
+	subAddon := attachTestAddon(t, tenant.subscription, addon, 1)
+
+	if _, err := other.db.AddSubscriptionAddon(ctx, tenant.subscription.ID, addon.ID, 1); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when attaching an add-on, got %v", err)
+	}
+	if _, err := other.db.GetSubscriptionAddonByID(ctx, subAddon.ID); !errors.Is(err, suberrors.ErrSubAddonNotFound) {
+		t.Errorf("expected ErrSubAddonNotFound, got %v", err)
+	}
+	subAddons, err := other.db.ListSubscriptionAddons(ctx, tenant.subscription.ID)
+	if err != nil || len(subAddons) != 0 {
+		t.Errorf("expected no add-ons to be visible to another tenant, got %+v, %v", subAddons, err)
+	}
+
+	update := &UpdateSubscriptionAddon{ID: subAddon.ID, Amount: 50, UpdateAmount: true}
+	if _, err = other.db.UpdateSubscriptionAddon(ctx, update); !errors.Is(err, suberrors.ErrSubAddonNotFound) {
+		t.Errorf("expected ErrSubAddonNotFound when updating, got %v", err)
+	}
+	if err = other.db.DeleteSubscriptionAddon(ctx, subAddon.ID); err != nil {
+		t.Fatalf("unable to delete the add-on: %s", err)
+	}
+	if _, err = tenant.db.GetSubscriptionAddonByID(ctx, subAddon.ID); err != nil {
+		t.Errorf("expected another tenant not to be able to delete the add-on, got %v", err)
+	}
+
+	// Usage can't be attributed to another tenant's add-ons.
+	if err = other.db.ApplyAddonUsage(ctx, subAddon.ID, UpdateTypeAdd, 1); !errors.Is(err, suberrors.ErrSubAddonNotFound) {
+		t.Errorf("expected ErrSubAddonNotFound when recording add-on usage, got %v", err)
+	}
+	if err = tenant.db.ApplyAddonUsage(ctx, subAddon.ID, UpdateTypeAdd, 1); err != nil {
+		t.Fatalf("unable to record the add-on usage: %s", err)
+	}
+	addonUsages, err := other.db.SubscriptionAddonUsages(ctx, tenant.subscription.ID)
+	if err != nil || len(addonUsages) != 0 {
+		t.Errorf("expected no add-on usages to be visible to another tenant, got %+v, %v", addonUsages, err)
+	}
+}
+
+func TestTenantAddonRestrictions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	tenant, other := addTestTenant(t), addTestTenant(t)
+
+	// The add-ons are restricted to the tenant's plan, by compatibility and by
+	// prerequisite.
+	compatible := addTestAddon(t, storage, 1)
+	if err := testDB.SetAddonCompatibility(ctx, compatible.ID, []string{tenant.plan.ID}, "test"); err != nil {
+		t.Fatalf("unable to set the compatible plans: %s", err)
+	}
+	prerequisite := addTestAddon(t, storage, 1)
+	if err := testDB.SetAddonPrerequisites(ctx, prerequisite.ID, []string{tenant.plan.ID}, nil, "test"); err != nil {
+		t.Fatalf("unable to set the prerequisites: %s", err)
+	}
+
+	plans, err := other.db.ListCompatiblePlans(ctx, compatible.ID)
+	if err != nil || len(plans) != 0 {
+		t.Errorf("expected another tenant's plans not to be listed, got %+v, %v", plans, err)
+	}
+
+	tests := []struct {
+		name     string
+		tenant   *testTenant
+		expected bool
+	}{
+		{name: "same tenant", tenant: tenant, expected: true},
+		{name: "other tenant", tenant: other},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := tc.tenant.db.AddonCompatibleWithSubscription(ctx, tenant.subscription.ID, compatible.ID)
+			if err != nil {
+				t.Fatalf("unable to check the compatibility: %s", err)
+			}
+			if ok != tc.expected {
+				t.Errorf("expected the compatibility to be %t, got %t", tc.expected, ok)
+			}
+
+			if ok, err = tc.tenant.db.AddonPrerequisitesMet(ctx, tenant.subscription.ID, prerequisite.ID); err != nil {
+				t.Fatalf("unable to check the prerequisites: %s", err)
+			}
+			if ok != tc.expected {
+				t.Errorf("expected the prerequisites to be met to be %t, got %t", tc.expected, ok)
+			}
+		})
+	}
+}
+
+func TestTenantBillingRecords(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tenant, other := addTestTenant(t), addTestTenant(t)
+	subscriptionID := tenant.subscription.ID
+
+	periodStart := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	invoice := &Invoice{
+		SubscriptionID:    subscriptionID,
+		Username:          tenant.user.Username,
+		PlanName:          tenant.plan.Name,
+		PeriodStart:       periodStart,
+		PeriodEnd:         periodStart.AddDate(0, 1, 0),
+		ProrationFraction: 1,
+		Subtotal:          100,
+		Total:             100,
+		CreatedBy:         "test",
+		LineItems:         []InvoiceLineItem{{ItemType: InvoiceItemPlan, Description: "plan", Quantity: 1, UnitRate: 100, Amount: 100}},
+	}
+	if _, err := other.db.AddInvoice(ctx, invoice); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when adding an invoice, got %v", err)
+	}
+	invoiceID, err := tenant.db.AddInvoice(ctx, invoice)
+	if err != nil {
+		t.Fatalf("unable to add the invoice: %s", err)
+	}
+	if found, err := other.db.GetInvoice(ctx, invoiceID); err != nil || found != nil {
+		t.Errorf("expected the invoice not to be visible to another tenant, got %+v, %v", found, err)
+	}
+	if invoices, err := other.db.ListInvoices(ctx, subscriptionID); err != nil || len(invoices) != 0 {
+		t.Errorf("expected no invoices to be visible to another tenant, got %+v, %v", invoices, err)
+	}
+
+	code := addTestDiscountCode(t, DiscountCode{DiscountType: DiscountTypePercent, Amount: 10})
+	if _, err = other.db.RedeemDiscountCode(ctx, code.Code, subscriptionID, 100, "test"); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when redeeming a discount code, got %v", err)
+	}
+	if _, err = tenant.db.RedeemDiscountCode(ctx, code.Code, subscriptionID, 100, "test"); err != nil {
+		t.Fatalf("unable to redeem the discount code: %s", err)
+	}
+	if discount, err := other.db.GetSubscriptionDiscount(ctx, subscriptionID); err != nil || discount != nil {
+		t.Errorf("expected the discount not to be visible to another tenant, got %+v, %v", discount, err)
+	}
+
+	change := &PaymentStatusChange{SubscriptionID: subscriptionID, ToStatus: PaymentStatusPaid, ChangedBy: "test"}
+	if _, err = other.db.SetPaymentStatus(ctx, change); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when setting the payment status, got %v", err)
+	}
+	if status, err := other.db.GetPaymentStatus(ctx, subscriptionID); err != nil || status != nil {
+		t.Errorf("expected the payment status not to be visible to another tenant, got %+v, %v", status, err)
+	}
+
+	reservation := &Reservation{
+		SubscriptionID: subscriptionID,
+		Reference:      sql.NullString{String: uniqueName("job"), Valid: true},
+		ExpiresAt:      time.Now().Add(time.Hour),
+		CreatedBy:      "test",
+	}
+	if _, err = other.db.AddReservation(ctx, reservation); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when adding a reservation, got %v", err)
+	}
+	reservationID, err := tenant.db.AddReservation(ctx, reservation)
+	if err != nil {
+		t.Fatalf("unable to add the reservation: %s", err)
+	}
+	if found, err := other.db.GetReservation(ctx, reservationID); err != nil || found != nil {
+		t.Errorf("expected the reservation not to be visible to another tenant, got %+v, %v", found, err)
+	}
+	if released, err := other.db.ReleaseReservation(ctx, reservationID); err != nil || released {
+		t.Errorf("expected another tenant not to be able to release the reservation, got %t, %v", released, err)
+	}
+
+	planChange := &PlanChange{SubscriptionID: subscriptionID, PlanID: tenant.plan.ID, Periods: 1, CreatedBy: "test"}
+	if _, err = other.db.AddPlanChange(ctx, planChange); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound when scheduling a plan change, got %v", err)
+	}
+	planChangeID, err := tenant.db.AddPlanChange(ctx, planChange)
+	if err != nil {
+		t.Fatalf("unable to schedule the plan change: %s", err)
+	}
+	if _, err = other.db.GetPlanChange(ctx, planChangeID); !errors.Is(err, suberrors.ErrPlanChangeNotFound) {
+		t.Errorf("expected ErrPlanChangeNotFound, got %v", err)
+	}
+
+	// Reminders can't be recorded for another tenant's subscriptions.
+	if err = other.db.MarkRemindersSent(ctx, 7, []string{subscriptionID}); err != nil {
+		t.Fatalf("unable to mark the reminders as sent: %s", err)
+	}
+	if count := countRows(t, "expiration_reminders", goqu.Ex{"subscription_id": subscriptionID}); count != 0 {
+		t.Errorf("expected no reminders to be recorded, got %d", count)
+	}
+}
+
+func TestTenantTrialsMergesAndPurges(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tenant, other := addTestTenant(t), addTestTenant(t)
+
+	now := time.Now()
+	trial := &Trial{UserID: tenant.user.ID, PlanID: tenant.plan.ID, StartedAt: now, EndsAt: now.AddDate(0, 0, 7)}
+	if _, err := other.db.AddTrial(ctx, trial); !errors.Is(err, suberrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound when recording a trial, got %v", err)
+	}
+	if _, err := tenant.db.AddTrial(ctx, trial); err != nil {
+		t.Fatalf("unable to record the trial: %s", err)
+	}
+	trials, err := other.db.ExpiringTrials(ctx, now.AddDate(0, 0, 8), 100)
+	if err != nil {
+		t.Fatalf("unable to list the expiring trials: %s", err)
+	}
+	for _, trial := range trials {
+		if trial.UserID == tenant.user.ID {
+			t.Error("expected another tenant's trial not to be listed")
+		}
+	}
+
+	// Users can only be merged and purged within their own tenant.
+	merge := &UserMerge{
+		SourceUserID:   tenant.user.ID,
+		SourceUsername: tenant.user.Username,
+		TargetUserID:   other.user.ID,
+		TargetUsername: other.user.Username,
+		MergedBy:       "test",
+	}
+	if err = other.db.MergeUserRecords(ctx, merge); !errors.Is(err, suberrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound when merging users across tenants, got %v", err)
+	}
+
+	purge := &UserPurge{UserID: tenant.user.ID, UsernameSHA256: UsernameHash(tenant.user.Username), PurgedBy: "test"}
+	if err = other.db.PurgeUserRecords(ctx, purge, tenant.user.Username); !errors.Is(err, suberrors.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound when purging another tenant's user, got %v", err)
+	}
+	if user, err := tenant.db.GetUserByUsername(ctx, tenant.user.Username); err != nil || user == nil {
+		t.Errorf("expected the user to be left alone, got %+v, %v", user, err)
+	}
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/cyverse-de/subscriptions/db")
+
+// The attributes added to database spans in addition to the standard ones.
+var (
+	dbRowsAffectedKey = attribute.Key("db.rows_affected")
+	dbReplicaKey      = attribute.Key("db.replica")
+)
+
+// startSpan starts a child span for an SQL statement. The statement is
+// recorded with its literal values replaced by placeholders, since goqu
+// interpolates values such as usernames into the statements that it generates.
+func startSpan(ctx context.Context, query string, attrs []attribute.KeyValue) (context.Context, trace.Span) {
+	statement := sanitizeSQL(query)
+	operation := sqlOperation(statement)
+
+	return tracer.Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(operation),
+			semconv.DBStatementKey.String(statement),
+		),
+	)
+}
+
+// endSpan records the outcome of a statement and ends its span. Not finding any
+// rows isn't treated as an error.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endExecSpan records the number of rows affected by a statement along with its
+// outcome and ends its span.
+func endExecSpan(span trace.Span, result sql.Result, err error) {
+	if err == nil {
+		if rows, rowsErr := result.RowsAffected(); rowsErr == nil {
+			span.SetAttributes(dbRowsAffectedKey.Int64(rows))
+		}
+	}
+	endSpan(span, err)
+}
+
+// sqlOperation returns the first keyword of a statement, such as SELECT.
+func sqlOperation(statement string) string {
+	fields := strings.Fields(statement)
+	if len(fields) == 0 {
+		return "SQL"
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// sanitizeSQL replaces the string and numeric literals in a statement with
+// question marks. Quoted identifiers and numbered placeholders are left alone.
+func sanitizeSQL(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'':
+			// Skip to the closing quote. Quotes are escaped by doubling them.
+			for i++; i < len(runes); i++ {
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			b.WriteRune('?')
+		case r == '"':
+			// Quoted identifiers are copied as they are.
+			b.WriteRune(r)
+			for i++; i < len(runes); i++ {
+				b.WriteRune(runes[i])
+				if runes[i] == '"' {
+					break
+				}
+			}
+		case r == '$' && i+1 < len(runes) && unicode.IsDigit(runes[i+1]):
+			// Numbered placeholders are copied as they are.
+			b.WriteRune(r)
+			for i+1 < len(runes) && unicode.IsDigit(runes[i+1]) {
+				i++
+				b.WriteRune(runes[i])
+			}
+		case unicode.IsDigit(r) && (i == 0 || !isIdentifierRune(runes[i-1])):
+			for i+1 < len(runes) && (unicode.IsDigit(runes[i+1]) || runes[i+1] == '.') {
+				i++
+			}
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
+
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// tracedDB decorates a database connection so that every statement that goqu
+// executes through it gets its own span. Row counts are recorded for
+// statements that don't return rows, because the rows returned by queries are
+// read by goqu after the span has ended.
+type tracedDB struct {
+	db    *sqlx.DB
+	attrs []attribute.KeyValue
+}
+
+func (t *tracedDB) Begin() (*sql.Tx, error) {
+	return t.db.Begin()
+}
+
+func (t *tracedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return t.db.BeginTx(ctx, opts)
+}
+
+func (t *tracedDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	result, err := t.db.ExecContext(ctx, query, args...)
+	endExecSpan(span, result, err)
+	return result, err
+}
+
+func (t *tracedDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	stmt, err := t.db.PrepareContext(ctx, query)
+	endSpan(span, err)
+	return stmt, err
+}
+
+func (t *tracedDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	rows, err := t.db.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (t *tracedDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	row := t.db.QueryRowContext(ctx, query, args...)
+	endSpan(span, row.Err())
+	return row
+}
+
+// tracedTx decorates a transaction in the same way as tracedDB.
+type tracedTx struct {
+	tx    *sql.Tx
+	attrs []attribute.KeyValue
+}
+
+func (t *tracedTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	result, err := t.tx.ExecContext(ctx, query, args...)
+	endExecSpan(span, result, err)
+	return result, err
+}
+
+func (t *tracedTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	stmt, err := t.tx.PrepareContext(ctx, query)
+	endSpan(span, err)
+	return stmt, err
+}
+
+func (t *tracedTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	rows, err := t.tx.QueryContext(ctx, query, args...)
+	endSpan(span, err)
+	return rows, err
+}
+
+func (t *tracedTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, span := startSpan(ctx, query, t.attrs)
+	row := t.tx.QueryRowContext(ctx, query, args...)
+	endSpan(span, row.Err())
+	return row
+}
+
+func (t *tracedTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *tracedTx) Rollback() error {
+	return t.tx.Rollback()
+}
@@ -0,0 +1,257 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// TrialSettings contains the trial settings of a plan.
+type TrialSettings struct {
+	IsTrial   bool `db:"is_trial"`
+	TrialDays int  `db:"trial_days"`
+}
+
+// Trial records a user's trial subscription to a plan.
+type Trial struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	UserID         string         `db:"user_id"`
+	Username       string         `db:"username"`
+	PlanID         string         `db:"plan_id"`
+	PlanName       string         `db:"plan_name"`
+	SubscriptionID sql.NullString `db:"subscription_id"`
+	StartedAt      time.Time      `db:"started_at"`
+	EndsAt         time.Time      `db:"ends_at"`
+}
+
+// ToAPIType converts the trial to the type used in responses.
+func (t *Trial) ToAPIType() *api.Trial {
+	return &api.Trial{
+		ID:             t.ID,
+		SubscriptionID: t.SubscriptionID.String,
+		Username:       t.Username,
+		PlanName:       t.PlanName,
+		StartedAt:      t.StartedAt,
+		EndsAt:         t.EndsAt,
+	}
+}
+
+// GetPlanTrialSettings returns the trial settings of a plan. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) GetPlanTrialSettings(ctx context.Context, planID string, opts ...QueryOption) (*TrialSettings, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Plans).
+		Select(t.Plans.Col("is_trial"), t.Plans.Col("trial_days")).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.sharedTenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	var settings TrialSettings
+	found, err := ds.Executor().ScanStructContext(ctx, &settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the trial settings for plan %s", planID)
+	}
+	if !found {
+		return nil, suberrors.ErrPlanNotFound
+	}
+
+	return &settings, nil
+}
+
+// SetPlanTrialSettings changes the trial settings of a plan. Accepts a variable
+// number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetPlanTrialSettings(ctx context.Context, planID string, settings *TrialSettings, opts ...QueryOption) error {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Plans).
+		Set(goqu.Record{
+			"is_trial":   settings.IsTrial,
+			"trial_days": settings.TrialDays,
+		}).
+		Where(t.Plans.Col("id").Eq(planID), querySettings.tenantExp(t.Plans))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to update the trial settings for plan %s", planID)
+	}
+
+	return nil
+}
+
+// AddTrial records a trial subscription and returns the trial ID. Returns
+// ErrTrialAlreadyUsed if the user has already had a trial subscription to the
+// plan. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) AddTrial(ctx context.Context, trial *Trial, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkUserTenant(ctx, db, querySettings, trial.UserID); err != nil {
+		return "", err
+	}
+
+	ds := db.Insert(t.Trials).
+		Rows(goqu.Record{
+			"user_id":         trial.UserID,
+			"plan_id":         trial.PlanID,
+			"subscription_id": trial.SubscriptionID,
+			"started_at":      trial.StartedAt,
+			"ends_at":         trial.EndsAt,
+		}).
+		Returning(t.Trials.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrTrialAlreadyUsed
+		}
+		return "", errors.Wrap(err, "unable to record the trial")
+	}
+
+	return id, nil
+}
+
+// ExpiringTrials returns the trials whose subscriptions end before the given
+// time and haven't ended yet, for which no expiration notice has been sent. The
+// trials are locked for the rest of the transaction, and trials that are
+// locked by another transaction are skipped. Only WithTX is currently
+// supported, and a transaction is required for the locks to be useful.
+func (d *Database) ExpiringTrials(ctx context.Context, before time.Time, limit uint, opts ...QueryOption) ([]Trial, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Trials).
+		Join(t.Subscriptions, goqu.On(t.Trials.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Trials.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Trials.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Select(
+			t.Trials.Col("id"),
+			t.Trials.Col("user_id"),
+			t.Users.Col("username"),
+			t.Trials.Col("plan_id"),
+			t.Plans.Col("name").As("plan_name"),
+			t.Trials.Col("subscription_id"),
+			t.Trials.Col("started_at"),
+			t.Subscriptions.Col("effective_end_date").As("ends_at"),
+		).
+		Where(
+			t.Trials.Col("expiration_notified_at").IsNull(),
+			t.Subscriptions.Col("effective_end_date").Lte(before),
+			t.Subscriptions.Col("effective_end_date").Gt(CurrentTimestamp),
+			querySettings.tenantExp(t.Users),
+		).
+		Order(t.Subscriptions.Col("effective_end_date").Asc()).
+		Limit(limit).
+		ForUpdate(exp.SkipLocked, t.Trials)
+	d.LogSQL(ds)
+
+	var trials []Trial
+	if err := ds.Executor().ScanStructsContext(ctx, &trials); err != nil {
+		return nil, errors.Wrap(err, "unable to list the expiring trials")
+	}
+
+	return trials, nil
+}
+
+// MarkTrialExpirationsNotified records that expiration notices were sent for
+// trials. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) MarkTrialExpirationsNotified(ctx context.Context, ids []string, opts ...QueryOption) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.Trials).
+		Set(goqu.Record{"expiration_notified_at": CurrentTimestamp}).
+		Where(t.Trials.Col("id").In(ids), querySettings.userTenantExp(db, t.Trials.Col("user_id")))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to mark the trial expiration notices as sent")
+	}
+
+	return nil
+}
+
+// TrialConversionStats contains the number of trials of a plan that were
+// started in a reporting window, broken down by outcome.
+type TrialConversionStats struct {
+	PlanName  string `db:"plan_name"`
+	Started   int64  `db:"started"`
+	Converted int64  `db:"converted"`
+	Expired   int64  `db:"expired"`
+	Active    int64  `db:"active"`
+}
+
+// TrialConversions returns the conversion statistics for the trials that were
+// started at or after the start time and before the end time, grouped by plan
+// and in order by plan name. A trial is converted if the user had a paid
+// subscription to a plan that isn't a trial plan starting at or after the
+// start of the trial. Trials that weren't converted are expired once their
+// subscriptions end and active until then. If planName isn't empty, only the
+// trials of that plan are included. Accepts a variable number of QueryOptions,
+// though only WithTX and WithReadReplica are currently supported.
+func (d *Database) TrialConversions(
+	ctx context.Context, start, end time.Time, planName string, opts ...QueryOption,
+) ([]TrialConversionStats, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	paidPlans := t.Plans.As("paid_plans")
+	conversions := db.From(t.Subscriptions.As("paid")).
+		Join(paidPlans, goqu.On(goqu.T("paid").Col("plan_id").Eq(paidPlans.Col("id")))).
+		Select(goqu.L("1")).
+		Where(
+			goqu.T("paid").Col("user_id").Eq(t.Trials.Col("user_id")),
+			goqu.T("paid").Col("paid").IsTrue(),
+			goqu.T("paid").Col("effective_start_date").Gte(t.Trials.Col("started_at")),
+			paidPlans.Col("is_trial").IsFalse(),
+		)
+
+	where := []exp.Expression{
+		t.Trials.Col("started_at").Gte(start),
+		t.Trials.Col("started_at").Lt(end),
+		querySettings.userTenantExp(db, t.Trials.Col("user_id")),
+	}
+	if planName != "" {
+		where = append(where, t.Plans.Col("name").Eq(planName))
+	}
+
+	// The trial ends early if its subscription is replaced before it runs out.
+	trials := db.From(t.Trials).
+		Join(t.Plans, goqu.On(t.Trials.Col("plan_id").Eq(t.Plans.Col("id")))).
+		LeftJoin(t.Subscriptions, goqu.On(t.Trials.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Select(
+			t.Plans.Col("name").As("plan_name"),
+			goqu.COALESCE(t.Subscriptions.Col("effective_end_date"), t.Trials.Col("ends_at")).As("ends_at"),
+			goqu.L("EXISTS ?", conversions).As("converted"),
+		).
+		Where(where...)
+
+	ds := db.From(trials.As("trials")).
+		Select(
+			goqu.C("plan_name"),
+			goqu.COUNT(goqu.Star()).As("started"),
+			goqu.L("count(*) FILTER (WHERE converted)").As("converted"),
+			goqu.L("count(*) FILTER (WHERE NOT converted AND ends_at <= ?)", CurrentTimestamp).As("expired"),
+			goqu.L("count(*) FILTER (WHERE NOT converted AND ends_at > ?)", CurrentTimestamp).As("active"),
+		).
+		GroupBy(goqu.C("plan_name")).
+		Order(goqu.C("plan_name").Asc())
+	d.LogSQL(ds)
+
+	var stats []TrialConversionStats
+	if err := ds.Executor().ScanStructsContext(ctx, &stats); err != nil {
+		return nil, errors.Wrap(err, "unable to compute the trial conversion statistics")
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,160 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// addTestTrialPlan adds a plan with trials that last for the given number of
+// days.
+func addTestTrialPlan(t *testing.T, days int) *Plan {
+	t.Helper()
+
+	plan := addTestPlan(t)
+	if err := testDB.SetPlanTrialSettings(context.Background(), plan.ID, &TrialSettings{IsTrial: true, TrialDays: days}); err != nil {
+		t.Fatalf("unable to set the trial settings: %s", err)
+	}
+	return plan
+}
+
+// startTestTrial subscribes a new user to the trial plan and records the trial.
+func startTestTrial(t *testing.T, plan *Plan, endDate time.Time) (*Subscription, string) {
+	t.Helper()
+
+	subscription := subscribeTestUser(t, addTestUser(t), plan, &SubscriptionOptions{Periods: 1, EndDate: endDate})
+	id, err := testDB.AddTrial(context.Background(), &Trial{
+		UserID:         subscription.User.ID,
+		PlanID:         plan.ID,
+		SubscriptionID: sql.NullString{String: subscription.ID, Valid: true},
+		StartedAt:      subscription.EffectiveStartDate,
+		EndsAt:         subscription.EffectiveEndDate,
+	})
+	if err != nil {
+		t.Fatalf("unable to record the trial: %s", err)
+	}
+	return subscription, id
+}
+
+func TestPlanTrialSettings(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+	settings, err := testDB.GetPlanTrialSettings(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the trial settings: %s", err)
+	}
+	if settings.IsTrial {
+		t.Errorf("expected new plans not to be trial plans, got %+v", settings)
+	}
+
+	trialPlan := addTestTrialPlan(t, 14)
+	if settings, err = testDB.GetPlanTrialSettings(ctx, trialPlan.ID); err != nil {
+		t.Fatalf("unable to look up the trial settings: %s", err)
+	}
+	if *settings != (TrialSettings{IsTrial: true, TrialDays: 14}) {
+		t.Errorf("the trial settings weren't stored correctly: %+v", settings)
+	}
+
+	if _, err = testDB.GetPlanTrialSettings(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, suberrors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound, got %v", err)
+	}
+}
+
+func TestAddTrial(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestTrialPlan(t, 14)
+	subscription, _ := startTestTrial(t, plan, time.Now().AddDate(0, 0, 14))
+
+	// Users only get one trial of each plan.
+	_, err := testDB.AddTrial(ctx, &Trial{
+		UserID:    subscription.User.ID,
+		PlanID:    plan.ID,
+		StartedAt: time.Now(),
+		EndsAt:    time.Now().AddDate(0, 0, 14),
+	})
+	if !errors.Is(err, suberrors.ErrTrialAlreadyUsed) {
+		t.Errorf("expected ErrTrialAlreadyUsed for a second trial, got %v", err)
+	}
+}
+
+func TestExpiringTrials(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestTrialPlan(t, 14)
+	_, expiring := startTestTrial(t, plan, time.Now().Add(time.Hour))
+	_, later := startTestTrial(t, plan, time.Now().AddDate(0, 0, 14))
+
+	expiringIDs := func(t *testing.T) []string {
+		t.Helper()
+
+		var ids []string
+		err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+			trials, err := testDB.ExpiringTrials(ctx, time.Now().Add(24*time.Hour), 100000, WithTX(tx))
+			for _, trial := range trials {
+				ids = append(ids, trial.ID)
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unable to list the expiring trials: %s", err)
+		}
+		return ids
+	}
+
+	ids := expiringIDs(t)
+	if !slices.Contains(ids, expiring) {
+		t.Errorf("expected trial %s to be expiring", expiring)
+	}
+	if slices.Contains(ids, later) {
+		t.Errorf("expected trial %s not to be expiring yet", later)
+	}
+
+	// Trials are only listed until the expiration notice is sent.
+	if err := testDB.MarkTrialExpirationsNotified(ctx, []string{expiring}); err != nil {
+		t.Fatalf("unable to mark the expiration notice as sent: %s", err)
+	}
+	if slices.Contains(expiringIDs(t), expiring) {
+		t.Errorf("expected trial %s not to be listed after the notice was sent", expiring)
+	}
+}
+
+func TestTrialConversions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	trialPlan := addTestTrialPlan(t, 14)
+	paidPlan := addTestPlan(t)
+	ends := time.Now().AddDate(0, 0, 14)
+
+	converted, _ := startTestTrial(t, trialPlan, ends)
+	subscribeTestUser(t, &converted.User, paidPlan, &SubscriptionOptions{Paid: true, Periods: 1})
+
+	expired, _ := startTestTrial(t, trialPlan, ends)
+	if err := testDB.EndSubscription(ctx, expired.ID, "test"); err != nil {
+		t.Fatalf("unable to end the trial subscription: %s", err)
+	}
+
+	startTestTrial(t, trialPlan, ends)
+
+	stats, err := testDB.TrialConversions(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour), trialPlan.Name)
+	if err != nil {
+		t.Fatalf("unable to compute the trial conversions: %s", err)
+	}
+	expected := TrialConversionStats{PlanName: trialPlan.Name, Started: 3, Converted: 1, Expired: 1, Active: 1}
+	if len(stats) != 1 || stats[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
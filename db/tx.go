@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/doug-martin/goqu/v9"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	// txMaxAttempts is the maximum number of times InTx will run a transaction.
+	txMaxAttempts = 5
+
+	// txInitialBackoff is the amount of time InTx waits before the first retry.
+	// The wait time doubles for every retry after that.
+	txInitialBackoff = 25 * time.Millisecond
+)
+
+// PostgreSQL error codes indicating that a transaction can be retried.
+const (
+	pqSerializationFailure = pq.ErrorCode("40001")
+	pqDeadlockDetected     = pq.ErrorCode("40P01")
+)
+
+// pqUniqueViolation is the PostgreSQL error code returned when an insert or
+// update would violate a unique constraint.
+const pqUniqueViolation = pq.ErrorCode("23505")
+
+// isUniqueViolation returns true if the error was caused by a unique constraint
+// violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pqUniqueViolation
+}
+
+// isRetryableTxError returns true if the error indicates that the transaction
+// failed because of a serialization failure or a deadlock.
+func isRetryableTxError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	return pqErr.Code == pqSerializationFailure || pqErr.Code == pqDeadlockDetected
+}
+
+// txBackoff returns the amount of time to wait before the given retry attempt.
+// Some jitter is added so that competing transactions don't retry in lockstep.
+func txBackoff(retry int) time.Duration {
+	backoff := txInitialBackoff << (retry - 1)
+	return backoff + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// InTx runs fn inside of a new transaction. The transaction is committed if fn
+// returns nil and rolled back otherwise. If the transaction fails because of a
+// serialization failure or a deadlock, it's retried with exponential backoff,
+// so fn must be safe to call more than once.
+func (d *Database) InTx(ctx context.Context, fn func(tx *goqu.TxDatabase) error) error {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		err = d.runTx(ctx, fn)
+		if err == nil || !isRetryableTxError(err) || attempt >= txMaxAttempts {
+			return err
+		}
+
+		log.Warnf("retrying transaction after attempt %d failed: %s", attempt, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(txBackoff(attempt)):
+		}
+	}
+}
+
+// errDryRun is returned from the function run by InTx to roll back the
+// transaction in a dry run.
+var errDryRun = errors.New("dry run")
+
+// InDryRunTx runs fn inside of a new transaction in the same way as InTx. If
+// dryRun is true, the transaction is always rolled back, even if fn succeeds,
+// so that callers can validate a change and compute its results without
+// applying it.
+func (d *Database) InDryRunTx(ctx context.Context, dryRun bool, fn func(tx *goqu.TxDatabase) error) error {
+	if !dryRun {
+		return d.InTx(ctx, fn)
+	}
+
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		return nil
+	}
+	return err
+}
+
+// runTx runs fn inside of a single transaction.
+func (d *Database) runTx(ctx context.Context, fn func(tx *goqu.TxDatabase) error) error {
+	sqlTx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := goqu.NewTx(dialect, &tracedTx{tx: sqlTx})
+	return tx.Wrap(func() error {
+		return fn(tx)
+	})
+}
+
+// inTxWithOpts runs fn inside of the transaction passed in with the WithTX
+// option if there is one. Otherwise, fn is run in a new transaction using InTx.
+// Retries are only possible when a new transaction is created, since only the
+// caller can retry a transaction that it started.
+func (d *Database) inTxWithOpts(ctx context.Context, fn func(tx *goqu.TxDatabase) error, opts ...QueryOption) error {
+	querySettings, _ := d.querySettings(opts...)
+	if querySettings.tx != nil {
+		return fn(querySettings.tx)
+	}
+	return d.InTx(ctx, fn)
+}
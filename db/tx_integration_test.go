@@ -0,0 +1,107 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+func TestInTx(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	errRollback := errors.New("roll back")
+
+	tests := []struct {
+		name      string
+		run       func(fn func(tx *goqu.TxDatabase) error) error
+		fails     bool
+		committed bool
+	}{
+		{
+			name: "commit",
+			run: func(fn func(tx *goqu.TxDatabase) error) error {
+				return testDB.InTx(ctx, fn)
+			},
+			committed: true,
+		},
+		{
+			name: "rollback",
+			run: func(fn func(tx *goqu.TxDatabase) error) error {
+				return testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+					if err := fn(tx); err != nil {
+						return err
+					}
+					return errRollback
+				})
+			},
+			fails: true,
+		},
+		{
+			name: "dry run",
+			run: func(fn func(tx *goqu.TxDatabase) error) error {
+				return testDB.InDryRunTx(ctx, true, fn)
+			},
+		},
+		{
+			name: "not a dry run",
+			run: func(fn func(tx *goqu.TxDatabase) error) error {
+				return testDB.InDryRunTx(ctx, false, fn)
+			},
+			committed: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			username := uniqueName("user")
+			err := tc.run(func(tx *goqu.TxDatabase) error {
+				_, err := testDB.AddUser(ctx, username, WithTX(tx))
+				return err
+			})
+			if tc.fails != (err != nil) {
+				t.Fatalf("unexpected result from the transaction: %v", err)
+			}
+
+			exists, err := testDB.UserExists(ctx, username)
+			if err != nil {
+				t.Fatalf("unable to check whether %s exists: %s", username, err)
+			}
+			if exists != tc.committed {
+				t.Errorf("expected the user to be committed: %t", tc.committed)
+			}
+		})
+	}
+}
+
+func TestBegin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		t.Fatalf("unable to begin a transaction: %s", err)
+	}
+
+	username := uniqueName("user")
+	if _, err = testDB.AddUser(ctx, username, WithTX(tx)); err != nil {
+		t.Fatalf("unable to add %s: %s", username, err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatalf("unable to roll back the transaction: %s", err)
+	}
+
+	exists, err := testDB.UserExists(ctx, username)
+	if err != nil {
+		t.Fatalf("unable to check whether %s exists: %s", username, err)
+	}
+	if exists {
+		t.Errorf("expected %s to be rolled back", username)
+	}
+}
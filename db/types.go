@@ -4,9 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/units"
 	"github.com/doug-martin/goqu/v9"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -71,6 +75,14 @@ func (u User) ToQMSUser() *qms.QMSUser {
 	}
 }
 
+// ToAPIType converts the user to the type used in plain JSON responses.
+func (u User) ToAPIType() *api.User {
+	return &api.User{
+		ID:       u.ID,
+		Username: u.Username,
+	}
+}
+
 type ResourceType struct {
 	ID         string `db:"id" goqu:"defaultifempty"`
 	Name       string `db:"name"`
@@ -96,6 +108,28 @@ func NewResourceTypeFromQMS(q *qms.ResourceType) *ResourceType {
 	}
 }
 
+// ToAPIType converts the resource type to the type used in responses.
+func (rt ResourceType) ToAPIType() *api.ResourceTypeDefinition {
+	return &api.ResourceTypeDefinition{
+		ResourceType: api.ResourceType{
+			ID:   rt.ID,
+			Name: rt.Name,
+			Unit: rt.Unit,
+		},
+		Consumable: rt.Consumable,
+		Dimension:  rt.Dimension(),
+	}
+}
+
+// Dimension returns what the resource type's unit measures, or an empty string
+// if amounts in the unit can't be converted to other units.
+func (rt ResourceType) Dimension() string {
+	if unit, ok := units.Lookup(rt.Unit); ok {
+		return unit.Dimension
+	}
+	return ""
+}
+
 func (rt ResourceType) ValidateForPlan() error {
 
 	// We must have enough information to at least attempt to look up the resource type.
@@ -106,16 +140,6 @@ func (rt ResourceType) ValidateForPlan() error {
 	return nil
 }
 
-var ResourceTypeNames = []string{
-	"cpu.hours",
-	"data.size",
-}
-
-var ResourceTypeUnits = []string{
-	"cpu hours",
-	"bytes",
-}
-
 const (
 	UpdateTypeSet = "SET"
 	UpdateTypeAdd = "ADD"
@@ -133,6 +157,10 @@ type Update struct {
 	ResourceType    ResourceType    `db:"resource_types"`
 	User            User            `db:"users"`
 	UpdateOperation UpdateOperation `db:"update_operations"`
+
+	// SubscriptionAddonID is the subscription add-on that a usage update is
+	// attributed to, if any. It's only recorded when the update is added.
+	SubscriptionAddonID string `db:"-"`
 }
 
 type Subscription struct {
@@ -210,6 +238,7 @@ type Plan struct {
 	ID            string             `db:"id" goqu:"defaultifempty"`
 	Name          string             `db:"name"`
 	Description   string             `db:"description"`
+	DeletedAt     sql.NullTime       `db:"deleted_at" goqu:"skipinsert,skipupdate"`
 	QuotaDefaults []PlanQuotaDefault `db:"-"`
 	Rates         []PlanRate         `db:"-"`
 }
@@ -252,12 +281,19 @@ func (p Plan) ToQMSPlan() *qms.Plan {
 	}
 }
 
+// GetActiveRate returns the rate that's currently in effect for the plan, or
+// nil if the plan doesn't have one.
 func (p Plan) GetActiveRate() *PlanRate {
-	now := time.Now()
+	return p.RateAsOf(time.Now())
+}
 
+// RateAsOf returns the rate that was in effect for the plan at the given time,
+// or nil if the plan didn't have one yet. The rates must be sorted by effective
+// date.
+func (p Plan) RateAsOf(asOf time.Time) *PlanRate {
 	var effectiveRate *PlanRate
 	for _, pr := range p.Rates {
-		if pr.EffectiveDate.After(now) {
+		if pr.EffectiveDate.After(asOf) {
 			break
 		}
 		effectiveRate = &pr
@@ -266,12 +302,19 @@ func (p Plan) GetActiveRate() *PlanRate {
 	return effectiveRate
 }
 
+// GetActiveQuotaDefaults returns the quota defaults that are currently in
+// effect for the plan.
 func (p Plan) GetActiveQuotaDefaults() []*PlanQuotaDefault {
-	now := time.Now()
+	return p.QuotaDefaultsAsOf(time.Now())
+}
 
+// QuotaDefaultsAsOf returns the quota defaults that were in effect for the plan
+// at the given time, with at most one for each resource type, in order by
+// resource type name. The quota defaults must be sorted by effective date.
+func (p Plan) QuotaDefaultsAsOf(asOf time.Time) []*PlanQuotaDefault {
 	pqdMap := make(map[string]*PlanQuotaDefault)
 	for _, pqd := range p.QuotaDefaults {
-		if pqd.EffectiveDate.After(now) {
+		if pqd.EffectiveDate.After(asOf) {
 			break
 		}
 		pqdMap[pqd.ResourceType.Name] = &pqd
@@ -283,6 +326,9 @@ func (p Plan) GetActiveQuotaDefaults() []*PlanQuotaDefault {
 		pqds[index] = pqd
 		index++
 	}
+	sort.Slice(pqds, func(i, j int) bool {
+		return pqds[i].ResourceType.Name < pqds[j].ResourceType.Name
+	})
 
 	return pqds
 }
@@ -291,10 +337,10 @@ func (p Plan) Validate() error {
 
 	// The plan name and description are both required.
 	if p.Name == "" {
-		return fmt.Errorf("a plan name is required")
+		return suberrors.MissingField("name")
 	}
 	if p.Description == "" {
-		return fmt.Errorf("a plan description is required")
+		return suberrors.MissingField("description")
 	}
 
 	// Validate the quota defaults.
@@ -377,6 +423,19 @@ func (pqd PlanQuotaDefault) ToQMSQuotaDefault() *qms.QuotaDefault {
 	}
 }
 
+// ToAPIType converts the quota default to the type used in JSON responses.
+func (pqd PlanQuotaDefault) ToAPIType() *api.PlanQuotaDefault {
+	return &api.PlanQuotaDefault{
+		ResourceType: api.ResourceType{
+			ID:   pqd.ResourceType.ID,
+			Name: pqd.ResourceType.Name,
+			Unit: pqd.ResourceType.Unit,
+		},
+		QuotaValue:    pqd.QuotaValue,
+		EffectiveDate: pqd.EffectiveDate,
+	}
+}
+
 func (pqd PlanQuotaDefault) ValidateForPlan() error {
 
 	// The default quota value must be specified and greater than zero.
@@ -419,6 +478,14 @@ func NewPlanRateFromQMS(r *qms.PlanRate, planID string) *PlanRate {
 	}
 }
 
+// ToAPIType converts the plan rate to the type used in JSON responses.
+func (pr PlanRate) ToAPIType() *api.PlanRate {
+	return &api.PlanRate{
+		Rate:          pr.Rate,
+		EffectiveDate: pr.EffectiveDate,
+	}
+}
+
 func (pr PlanRate) ToQMSPlanRate() *qms.PlanRate {
 	return &qms.PlanRate{
 		Uuid:          pr.ID,
@@ -521,12 +588,14 @@ func (q Quota) ToQMSQuota() *qms.Quota {
 }
 
 type Overage struct {
-	SubscriptionID string       `db:"subscription_id"`
-	User           User         `db:"users"`
-	Plan           Plan         `db:"plans"`
-	ResourceType   ResourceType `db:"resource_types"`
-	QuotaValue     float64      `db:"quota_value"`
-	UsageValue     float64      `db:"usage_value"`
+	SubscriptionID string          `db:"subscription_id"`
+	User           User            `db:"users"`
+	Plan           Plan            `db:"plans"`
+	ResourceType   ResourceType    `db:"resource_types"`
+	QuotaValue     float64         `db:"quota_value"`
+	UsageValue     float64         `db:"usage_value"`
+	Remaining      float64         `db:"remaining"`
+	PercentUsed    sql.NullFloat64 `db:"percent_used"`
 }
 
 type Addon struct {
@@ -536,7 +605,13 @@ type Addon struct {
 	ResourceType  ResourceType `db:"resource_types"`
 	DefaultAmount float64      `db:"default_amount"`
 	DefaultPaid   bool         `db:"default_paid"`
+	DeletedAt     sql.NullTime `db:"deleted_at" goqu:"skipinsert,skipupdate"`
+	Version       int64        `db:"version" goqu:"skipinsert,skipupdate"`
 	AddonRates    []AddonRate  `db:"-"`
+
+	// MaxPerSubscription is the maximum number of units of the add-on that can
+	// be attached to a single subscription, if there is one.
+	MaxPerSubscription sql.NullInt64 `db:"max_per_subscription" goqu:"skipinsert,skipupdate"`
 }
 
 func NewAddonFromQMS(q *qms.Addon) *Addon {
@@ -578,10 +653,10 @@ func (a *Addon) Validate() error {
 
 	// The name and description are both required.
 	if a.Name == "" {
-		return fmt.Errorf("name must be set")
+		return suberrors.MissingField("name")
 	}
 	if a.Description == "" {
-		return fmt.Errorf("description must be set")
+		return suberrors.MissingField("description")
 	}
 
 	// The default amount must be positive.
@@ -710,7 +785,7 @@ func NewUpdateAddonFromQMS(u *qms.UpdateAddonRequest) *UpdateAddon {
 		update.DefaultPaid = u.Addon.DefaultPaid
 	}
 	if update.UpdateResourceType {
-		update.ResourceTypeID = u.Addon.ResourceType.Uuid
+		update.ResourceTypeID = u.Addon.GetResourceType().GetUuid()
 	}
 	if update.UpdateAddonRates {
 		addonRates := make([]AddonRate, len(u.Addon.AddonRates))
@@ -723,12 +798,21 @@ func NewUpdateAddonFromQMS(u *qms.UpdateAddonRequest) *UpdateAddon {
 }
 
 type SubscriptionAddon struct {
-	ID           string       `db:"id" goqu:"defaultifempty,skipupdate"`
-	Addon        Addon        `db:"addons"`
-	Subscription Subscription `db:"subscriptions"`
-	Amount       float64      `db:"amount"`
-	Paid         bool         `db:"paid"`
-	Rate         AddonRate    `db:"addon_rates"`
+	ID               string       `db:"id" goqu:"defaultifempty,skipupdate"`
+	Addon            Addon        `db:"addons"`
+	Subscription     Subscription `db:"subscriptions"`
+	Amount           float64      `db:"amount"`
+	Quantity         int64        `db:"quantity"`
+	Paid             bool         `db:"paid"`
+	Rate             AddonRate    `db:"addon_rates"`
+	EffectiveEndDate sql.NullTime `db:"effective_end_date"`
+	ExpiredAt        sql.NullTime `db:"expired_at"`
+}
+
+// Expired returns true if the subscription add-on has ended and its amount has
+// been removed from the quota.
+func (sa *SubscriptionAddon) Expired() bool {
+	return sa.ExpiredAt.Valid
 }
 
 func NewSubscriptionAddonFromQMS(sa *qms.SubscriptionAddon) *SubscriptionAddon {
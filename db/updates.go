@@ -3,24 +3,20 @@ package db
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/cyverse-de/subscriptions/api"
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// UserUpdates returns a list of updates associated with a user.
-// Accepts a variable number of QueryOptions, including WithTX, WithQueryLimit,
-// and WithQueryOffset.
-func (d *Database) UserUpdates(ctx context.Context, username string, opts ...QueryOption) ([]Update, error) {
-	var (
-		err error
-		db  GoquDatabase
-	)
-
-	querySettings, db := d.querySettings(opts...)
-
-	query := db.From(t.Updates).
+// updatesDS returns the dataset used to look up updates along with their users,
+// resource types and operations.
+func updatesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Updates).
 		Select(
 			t.Updates.Col("id"),
 			t.Updates.Col("value_type"),
@@ -43,7 +39,21 @@ func (d *Database) UserUpdates(ctx context.Context, username string, opts ...Que
 		).
 		Join(t.Users, goqu.On(goqu.I("updates.user_id").Eq(goqu.I("users.id")))).
 		Join(t.UOps, goqu.On(goqu.I("updates.update_operation_id").Eq(goqu.I("update_operations.id")))).
-		Join(t.RT, goqu.On(goqu.I("updates.resource_type_id").Eq(goqu.I("resource_types.id")))).
+		Join(t.RT, goqu.On(goqu.I("updates.resource_type_id").Eq(goqu.I("resource_types.id"))))
+}
+
+// UserUpdates returns a list of updates associated with a user.
+// Accepts a variable number of QueryOptions, including WithTX, WithQueryLimit,
+// and WithQueryOffset.
+func (d *Database) UserUpdates(ctx context.Context, username string, opts ...QueryOption) ([]Update, error) {
+	var (
+		err error
+		db  GoquDatabase
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	query := updatesDS(db).
 		Where(t.Users.Col("username").Eq(username))
 
 	if querySettings.hasLimit {
@@ -81,6 +91,33 @@ func (d *Database) UserUpdates(ctx context.Context, username string, opts ...Que
 	return results, nil
 }
 
+// UsageUpdates returns the usage updates for a user and resource type that took
+// effect at or after the given time, in order by effective date. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) UsageUpdates(
+	ctx context.Context, username, resourceTypeID string, since time.Time, opts ...QueryOption,
+) ([]Update, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := updatesDS(db).
+		Where(
+			t.Users.Col("username").Eq(username),
+			t.Updates.Col("resource_type_id").Eq(resourceTypeID),
+			t.Updates.Col("value_type").Eq(UsagesTrackedMetric),
+			t.Updates.Col("effective_date").Gte(since),
+		).
+		Order(t.Updates.Col("effective_date").Asc(), t.Updates.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var updates []Update
+	if err := ds.Executor().ScanStructsContext(ctx, &updates); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the usage updates for %s", username)
+	}
+
+	return updates, nil
+}
+
 // AddUserUpdate inserts the passed in update into the database. Returns the
 // Update with the UUID filled in. Accepts a variable number of QueryOptions,
 // though only WithTx is currently supported.
@@ -92,16 +129,19 @@ func (d *Database) AddUserUpdate(ctx context.Context, update *Update, opts ...Qu
 
 	_, db = d.querySettings(opts...)
 
-	ds := db.Insert("updates").Rows(
-		goqu.Record{
-			"value_type":          update.ValueType,
-			"value":               update.Value,
-			"effective_date":      update.EffectiveDate,
-			"update_operation_id": update.UpdateOperation.ID,
-			"resource_type_id":    update.ResourceType.ID,
-			"user_id":             update.User.ID,
-		},
-	).
+	rec := goqu.Record{
+		"value_type":          update.ValueType,
+		"value":               update.Value,
+		"effective_date":      update.EffectiveDate,
+		"update_operation_id": update.UpdateOperation.ID,
+		"resource_type_id":    update.ResourceType.ID,
+		"user_id":             update.User.ID,
+	}
+	if update.SubscriptionAddonID != "" {
+		rec["subscription_addon_id"] = update.SubscriptionAddonID
+	}
+
+	ds := db.Insert("updates").Rows(rec).
 		Returning(goqu.C("id")).
 		Executor()
 
@@ -116,13 +156,28 @@ func (d *Database) AddUserUpdate(ctx context.Context, update *Update, opts ...Qu
 	return update, nil
 }
 
-// ProcessUpdateForUsage accepts a new *Update, inserts it into the database,
-// then uses it to calculate new usage and upsert it into the database. Does not
-// accept any QueryOptions since it sets up the transaction and other options
-// itself.
-func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update) error {
+// ProcessUpdateForUsage accepts a new *Update, checks it against the validation
+// rule of its resource type, inserts it into the database if it hasn't been
+// inserted yet, then uses it to calculate new usage and upsert it into the
+// database. Usage that's added is drawn from the user's credits before it's
+// added to the usage. If the update is attributed to a subscription add-on, the
+// add-on's share of the usage is updated as well. Updates that break the
+// validation rule are flagged for review and applied, rejected with a
+// *errors.UsageRejectedError, or held for review with a
+// *errors.UsageQuarantinedError. Rejected updates are recorded for review, and
+// quarantined updates are committed to the quarantine, but neither is inserted
+// into the database or applied to the usage. ErrSubscriptionNotFound is
+// returned if the user doesn't have an active subscription, unless
+// WithDefaultSubscription is used, in which case the user is subscribed to the
+// default plan. Sets up the transaction itself, so the only QueryOptions that
+// are currently supported are WithGracePeriod, WithGroupSubscriptions,
+// WithDefaultPlan, WithDefaultSubscription and WithOutbox, which records
+// usage.updated and quota.exceeded events.
+func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update, opts ...QueryOption) error {
 	log = log.WithFields(logrus.Fields{"context": "usage update", "user": update.User.Username})
 
+	querySettings, _ := d.querySettings(opts...)
+
 	db := d.fullDB
 
 	log.Debug("beginning transaction")
@@ -132,86 +187,146 @@ func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update) er
 	}
 	log.Debug("after beginning transaction")
 
+	// Usage is drawn from a group's subscription if the user doesn't have one
+	// of their own.
+	subscriptionOpts := []QueryOption{WithGracePeriod(querySettings.gracePeriod)}
+	if querySettings.groups {
+		subscriptionOpts = append(subscriptionOpts, WithGroupSubscriptions())
+	}
+
+	// The usage that's checked against the validation rule is kept so that a
+	// rejection can be recorded once the transaction has been rolled back. A
+	// quarantined update is committed without being applied, and the
+	// quarantine is returned once the transaction has been committed.
+	var (
+		checked     *Usage
+		quarantined *suberrors.UsageQuarantinedError
+	)
+
 	if err = tx.Wrap(func() error {
 		log.Debug("before getting active user plan")
-		subscription, err := d.GetActiveSubscription(ctx, update.User.Username, WithTX(tx))
+		subscription, err := d.GetActiveSubscription(
+			ctx, update.User.Username, append(subscriptionOpts, WithTX(tx))...,
+		)
+		if err == suberrors.ErrSubscriptionNotFound && querySettings.defaultSubscription {
+			subscription, err = d.SubscribeToDefaultPlan(
+				ctx, update.User.Username, WithTX(tx), WithDefaultPlan(querySettings.defaultPlanName()),
+			)
+		}
 		if err != nil {
 			return err
 		}
 		log.Debugf("after getting active user plan %s", subscription.ID)
 
-		// create a subscription if there isn't one
-		if subscription.ID == "" {
-			user, err := d.EnsureUser(ctx, update.User.Username, WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to ensure that the user exists in the database: %s", err)
-				return err
-			}
-
-			plan, err := d.GetPlanByName(ctx, DefaultPlanName, WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the default plan: %s", err)
-				return err
-			}
+		checked = &Usage{
+			Usage:          update.Value,
+			SubscriptionID: subscription.ID,
+			ResourceType:   update.ResourceType,
+		}
+		err = d.checkUsageRule(ctx, update.UpdateOperation.Name, checked, WithTX(tx))
+		if held, ok := suberrors.UsageQuarantine(err); ok {
+			quarantined = held
+			return nil
+		}
+		if err != nil {
+			return err
+		}
 
-			opts := DefaultSubscriptionOptions()
-			subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, opts, WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to subscribe the user to the default plan: %s", err)
+		if update.ID == "" {
+			if _, err = d.AddUserUpdate(ctx, update, WithTX(tx)); err != nil {
 				return err
 			}
+		}
 
-			subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the new user plan: %s", err)
-				return err
-			}
-			if subscription == nil {
-				err = fmt.Errorf("the newly inserted user plan could not be found")
-				log.Error(err)
+		// The previous usage is only needed to tell whether this update pushed
+		// the usage past the quota. The usage is applied with a single statement
+		// so that concurrent updates can't lose each other's increments.
+		var previousUsage float64
+		if update.UpdateOperation.Name == UpdateTypeSet {
+			if previousUsage, _, err = d.GetCurrentUsage(ctx, update.ResourceType.ID, subscription.ID, WithTX(tx)); err != nil {
 				return err
 			}
 		}
 
-		log.Debug("getting current usage")
-		usageValue, usageFound, err := d.GetCurrentUsage(ctx, update.ResourceType.ID, subscription.ID, WithTX(tx))
+		log.Debugf("applying the %s update to the usage", update.UpdateOperation.Name)
+		usageValue, drawn, err := d.ApplyUsage(
+			ctx, update.UpdateOperation.Name, update.Value, update.ResourceType.ID, subscription.ID,
+			WithTX(tx), WithUpdateID(update.ID),
+		)
 		if err != nil {
 			return err
 		}
-		log.Debugf("done getting current usage of %f", usageValue)
 
-		log.Debugf("update operation name is %s", update.UpdateOperation.Name)
-		switch update.UpdateOperation.Name {
-		case UpdateTypeSet:
-			usageValue = update.Value
-		case UpdateTypeAdd:
-			usageValue = usageValue + update.Value
-		default:
-			return fmt.Errorf("invalid update type: %s", update.UpdateOperation.Name)
+		// Only the part of the value that wasn't drawn from credits counts
+		// against the quota.
+		value := update.Value - drawn
+		if update.UpdateOperation.Name == UpdateTypeAdd {
+			previousUsage = usageValue - value
 		}
 		log.Debugf("new usage value is %f", usageValue)
 
-		log.Debug("upserting new usage value")
-		if err = d.UpsertUsage(ctx, usageFound, usageValue, update.ResourceType.ID, subscription.ID, WithTX(tx)); err != nil {
+		if update.SubscriptionAddonID != "" {
+			if err = d.ApplyAddonUsage(
+				ctx, update.SubscriptionAddonID, update.UpdateOperation.Name, value, WithTX(tx),
+			); err != nil {
+				return err
+			}
+		}
+
+		if !querySettings.outbox {
+			return nil
+		}
+
+		if err = d.recordEvent(ctx, querySettings, api.EventUsageUpdated, &api.UsageEventData{
+			SubscriptionID: subscription.ID,
+			Username:       update.User.Username,
+			ResourceName:   update.ResourceType.Name,
+			Usage:          usageValue,
+		}, WithTX(tx)); err != nil {
+			return err
+		}
+
+		// Record a quota.exceeded event if this update pushed the usage past the quota.
+		quotaValue, quotaFound, err := d.GetCurrentQuota(ctx, update.ResourceType.ID, subscription.ID, WithTX(tx))
+		if err != nil {
 			return err
 		}
-		log.Debug("done upserting new value")
+		if quotaFound && previousUsage < quotaValue && usageValue >= quotaValue {
+			if err = d.recordEvent(ctx, querySettings, api.EventQuotaExceeded, &api.QuotaEventData{
+				SubscriptionID: subscription.ID,
+				Username:       update.User.Username,
+				ResourceName:   update.ResourceType.Name,
+				Quota:          quotaValue,
+				Usage:          usageValue,
+			}, WithTX(tx)); err != nil {
+				return err
+			}
+		}
 
 		return nil
 	}); err != nil {
+		if rejected, ok := suberrors.UsageRejection(err); ok {
+			d.RecordRejectedUsage(ctx, update.UpdateOperation.Name, checked, rejected)
+		}
 		return err
 	}
+	if quarantined != nil {
+		return quarantined
+	}
 
 	return nil
 }
 
 // ProcessUpdateForQuota accepts a new *Update, inserts it into the database,
-// then uses it to calculate a new usage value, which in turn is upserted into
-// the database. Does not accept an QueryOptions since it sets up the
-// transaction and other options itself.
+// then uses it to calculate a new quota value, which in turn is upserted into
+// the database. Sets up the transaction itself, so the only QueryOptions that are
+// currently supported are WithGracePeriod and WithOutbox, which records
+// quota.updated events.
 func (d *Database) ProcessUpdateForQuota(ctx context.Context, update *Update, opts ...QueryOption) error {
 	var err error
 
+	querySettings, _ := d.querySettings(opts...)
+
 	db := d.fullDB
 
 	tx, err := db.BeginTx(ctx, nil)
@@ -220,7 +335,9 @@ func (d *Database) ProcessUpdateForQuota(ctx context.Context, update *Update, op
 	}
 
 	if err = tx.Wrap(func() error {
-		subscription, err := d.GetActiveSubscription(ctx, update.User.Username, WithTX(tx))
+		subscription, err := d.GetActiveSubscription(
+			ctx, update.User.Username, WithTX(tx), WithGracePeriod(querySettings.gracePeriod),
+		)
 		if err != nil {
 			return err
 		}
@@ -249,7 +366,12 @@ func (d *Database) ProcessUpdateForQuota(ctx context.Context, update *Update, op
 			return err
 		}
 
-		return nil
+		return d.recordEvent(ctx, querySettings, api.EventQuotaUpdated, &api.QuotaEventData{
+			SubscriptionID: subscription.ID,
+			Username:       update.User.Username,
+			ResourceName:   update.ResourceType.Name,
+			Quota:          quotaValue,
+		}, WithTX(tx))
 	}); err != nil {
 		return err
 	}
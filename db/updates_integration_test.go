@@ -0,0 +1,215 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// newTestUpdate returns an update of the given type for the user and resource
+// type that takes effect now.
+func newTestUpdate(t *testing.T, user User, resourceType ResourceType, valueType, operation string, value float64) *Update {
+	t.Helper()
+
+	return &Update{
+		ValueType:       valueType,
+		Value:           value,
+		EffectiveDate:   time.Now(),
+		ResourceType:    resourceType,
+		User:            user,
+		UpdateOperation: UpdateOperation{ID: operationID(t, operation), Name: operation},
+	}
+}
+
+func TestGetOperation(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, name := range UpdateOperationNames {
+		t.Run(name, func(t *testing.T) {
+			operation, err := testDB.GetOperation(ctx, operationID(t, name))
+			if err != nil {
+				t.Fatalf("unable to look up the %s operation: %s", name, err)
+			}
+			if operation.Name != name {
+				t.Errorf("expected the %s operation, got %s", name, operation.Name)
+			}
+		})
+	}
+}
+
+func TestAddUserUpdate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	user := addTestUser(t)
+
+	since := time.Now().Add(-time.Minute)
+	for _, value := range []float64{1, 2} {
+		update := newTestUpdate(t, *user, storage, UsagesTrackedMetric, UpdateTypeAdd, value)
+		if _, err := testDB.AddUserUpdate(ctx, update); err != nil {
+			t.Fatalf("unable to add the update: %s", err)
+		}
+		if update.ID == "" {
+			t.Error("expected the ID of the new update to be set")
+		}
+	}
+	quota := newTestUpdate(t, *user, storage, QuotasTrackedMetric, UpdateTypeSet, 10)
+	if _, err := testDB.AddUserUpdate(ctx, quota); err != nil {
+		t.Fatalf("unable to add the update: %s", err)
+	}
+
+	updates, err := testDB.UserUpdates(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to list the updates: %s", err)
+	}
+	if len(updates) != 3 {
+		t.Errorf("expected 3 updates, got %d", len(updates))
+	}
+
+	updates, err = testDB.UserUpdates(ctx, user.Username, WithQueryLimit(1))
+	if err != nil {
+		t.Fatalf("unable to list the updates: %s", err)
+	}
+	if len(updates) != 1 {
+		t.Errorf("expected the limit to be applied, got %d updates", len(updates))
+	}
+
+	// Only the usage updates are included, in the order they took effect.
+	updates, err = testDB.UsageUpdates(ctx, user.Username, storage.ID, since)
+	if err != nil {
+		t.Fatalf("unable to list the usage updates: %s", err)
+	}
+	if len(updates) != 2 || updates[0].Value != 1 || updates[1].Value != 2 {
+		t.Errorf("expected usage updates of 1 and 2, got %+v", updates)
+	}
+
+	updates, err = testDB.UsageUpdates(ctx, user.Username, storage.ID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unable to list the usage updates: %s", err)
+	}
+	if len(updates) != 0 {
+		t.Errorf("expected no usage updates in the future, got %d", len(updates))
+	}
+}
+
+func TestProcessUpdateForUsage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+
+	for _, update := range []struct {
+		operation string
+		value     float64
+		expected  float64
+	}{
+		{operation: UpdateTypeAdd, value: 4, expected: 4},
+		{operation: UpdateTypeAdd, value: 3, expected: 7},
+		{operation: UpdateTypeSet, value: 2, expected: 2},
+	} {
+		err := testDB.ProcessUpdateForUsage(
+			ctx, newTestUpdate(t, subscription.User, compute, UsagesTrackedMetric, update.operation, update.value),
+		)
+		if err != nil {
+			t.Fatalf("unable to process the %s update: %s", update.operation, err)
+		}
+		if usage := currentUsage(t, compute.ID, subscription.ID); usage != update.expected {
+			t.Errorf("expected a usage of %g after the %s update, got %g", update.expected, update.operation, usage)
+		}
+	}
+}
+
+func TestProcessUpdateForUsageOutbox(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+
+	// The first update doesn't reach the quota, but the second one does.
+	for _, value := range []float64{5, 6} {
+		err := testDB.ProcessUpdateForUsage(
+			ctx, newTestUpdate(t, subscription.User, compute, UsagesTrackedMetric, UpdateTypeAdd, value), WithOutbox(),
+		)
+		if err != nil {
+			t.Fatalf("unable to process the update: %s", err)
+		}
+	}
+
+	events := outboxEventCounts(t, subscription.ID)
+	if events[api.EventUsageUpdated] != 2 || events[api.EventQuotaExceeded] != 1 {
+		t.Errorf("expected 2 usage.updated events and 1 quota.exceeded event, got %v", events)
+	}
+}
+
+func TestProcessUpdateForUsageWithoutSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	update := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 1)
+
+	if err := testDB.ProcessUpdateForUsage(ctx, update); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Fatalf("expected ErrSubscriptionNotFound, got %v", err)
+	}
+
+	// The user is subscribed to the default plan if that's requested.
+	plan := addTestPlan(t)
+	if err := testDB.ProcessUpdateForUsage(ctx, update, WithDefaultSubscription(), WithDefaultPlan(plan.Name)); err != nil {
+		t.Fatalf("unable to process the update: %s", err)
+	}
+
+	subscription, err := testDB.GetActiveSubscription(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to look up the new subscription: %s", err)
+	}
+	if subscription.Plan.ID != plan.ID {
+		t.Errorf("expected a subscription to %s, got one to %s", plan.Name, subscription.Plan.Name)
+	}
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != 1 {
+		t.Errorf("expected a usage of 1, got %g", usage)
+	}
+}
+
+func TestProcessUpdateForQuota(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t, PlanQuotaDefault{ResourceType: storage, QuotaValue: 5})
+
+	for _, update := range []struct {
+		operation string
+		value     float64
+		expected  float64
+	}{
+		{operation: UpdateTypeAdd, value: 3, expected: 8},
+		{operation: UpdateTypeSet, value: 20, expected: 20},
+	} {
+		err := testDB.ProcessUpdateForQuota(
+			ctx, newTestUpdate(t, subscription.User, storage, QuotasTrackedMetric, update.operation, update.value),
+		)
+		if err != nil {
+			t.Fatalf("unable to process the %s update: %s", update.operation, err)
+		}
+		if quotas := subscriptionQuotaValues(t, subscription.ID); quotas[storage.ID] != update.expected {
+			t.Errorf("expected a quota of %g after the %s update, got %g", update.expected, update.operation, quotas[storage.ID])
+		}
+	}
+
+	invalid := newTestUpdate(t, subscription.User, storage, QuotasTrackedMetric, UpdateTypeSet, 1)
+	invalid.UpdateOperation.Name = "MULTIPLY"
+	if err := testDB.ProcessUpdateForQuota(ctx, invalid); err == nil {
+		t.Error("expected an invalid update type to be refused")
+	}
+}
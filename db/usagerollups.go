@@ -0,0 +1,360 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// UsageRollup is the usage of a resource type consumed by a user during a
+// single day or month.
+type UsageRollup struct {
+	Username     string       `db:"username"`
+	ResourceType ResourceType `db:"resource_types"`
+	PeriodStart  time.Time    `db:"period_start"`
+	Consumed     float64      `db:"consumed"`
+	UpdateCount  int64        `db:"update_count"`
+}
+
+// ToAPIType converts the usage rollup to the type used in responses.
+func (r *UsageRollup) ToAPIType() *api.UsageRollup {
+	return &api.UsageRollup{
+		ResourceType: api.ResourceType{
+			ID:   r.ResourceType.ID,
+			Name: r.ResourceType.Name,
+			Unit: r.ResourceType.Unit,
+		},
+		PeriodStart: r.PeriodStart,
+		Consumed:    r.Consumed,
+		UpdateCount: r.UpdateCount,
+	}
+}
+
+// UsageTotal is the usage of a resource type consumed by a user over a range of
+// days.
+type UsageTotal struct {
+	Username    string  `db:"username"`
+	Consumed    float64 `db:"consumed"`
+	UpdateCount int64   `db:"update_count"`
+}
+
+// rollupTable returns the table containing the usage rollups with the given
+// granularity. Returns ErrInvalidGranularity for unknown granularities.
+func rollupTable(granularity string) (exp.IdentifierExpression, error) {
+	switch granularity {
+	case api.RollupDaily:
+		return t.DailyRollups, nil
+	case api.RollupMonthly:
+		return t.MonthlyRollups, nil
+	default:
+		return nil, suberrors.ErrInvalidGranularity
+	}
+}
+
+// rollupDay returns an expression for the day in UTC that an update took effect.
+func rollupDay() exp.LiteralExpression {
+	return goqu.L("(? AT TIME ZONE 'UTC')::date", t.Updates.Col("effective_date"))
+}
+
+// rollupMonth returns an expression for the first day of the month containing
+// the given date.
+func rollupMonth(day any) exp.LiteralExpression {
+	return goqu.L("date_trunc('month', ?)::date", day)
+}
+
+// dateValue formats a time as a date for comparisons with rollup periods.
+func dateValue(value time.Time) string {
+	return value.UTC().Format(time.DateOnly)
+}
+
+// insertRollups returns the dataset used to add or replace the rollups in a
+// table with the totals calculated by a query.
+func insertRollups(db GoquDatabase, table exp.IdentifierExpression, totals *goqu.SelectDataset) *goqu.InsertDataset {
+	ds := db.Insert(table).Cols("user_id", "resource_type_id", "period_start", "consumed", "update_count")
+
+	// The query has to use the same dialect as the insert statement.
+	return ds.FromQuery(totals.SetDialect(ds.Dialect())).
+		OnConflict(goqu.DoUpdate("user_id, resource_type_id, period_start", goqu.Record{
+			"consumed":         goqu.I("excluded.consumed"),
+			"update_count":     goqu.I("excluded.update_count"),
+			"last_modified_at": CurrentTimestamp,
+		}))
+}
+
+// refreshDailyRollups recalculates the daily rollups for the days of the usage
+// updates that satisfy the condition, and returns the number of rollups that
+// were refreshed. Archived updates are included, so the condition can refer to
+// the columns of the updates table whether or not an update was archived.
+func (d *Database) refreshDailyRollups(ctx context.Context, db GoquDatabase, cond exp.Expression) (int64, error) {
+	columns := []any{"user_id", "resource_type_id", "update_operation_id", "value_type", "value", "effective_date"}
+	allUpdates := db.From(t.Updates).
+		Select(columns...).
+		UnionAll(db.From(t.ArchivedUpdates).Select(columns...))
+
+	consumed := goqu.SUM(
+		goqu.Case().
+			When(t.UOps.Col("name").Eq(UpdateTypeAdd), t.Updates.Col("value")).
+			Else(0),
+	)
+
+	totals := db.From(allUpdates.As(t.Updates.GetTable())).
+		Join(t.UOps, goqu.On(t.Updates.Col("update_operation_id").Eq(t.UOps.Col("id")))).
+		Select(
+			t.Updates.Col("user_id"),
+			t.Updates.Col("resource_type_id"),
+			rollupDay(),
+			consumed,
+			goqu.COUNT(goqu.Star()),
+		).
+		Where(
+			t.Updates.Col("value_type").Eq(UsagesTrackedMetric),
+			cond,
+		).
+		GroupBy(t.Updates.Col("user_id"), t.Updates.Col("resource_type_id"), rollupDay())
+
+	ds := insertRollups(db, t.DailyRollups, totals)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to refresh the daily usage rollups")
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return count, nil
+}
+
+// refreshMonthlyRollups recalculates the monthly rollups from the daily rollups
+// that satisfy the condition.
+func (d *Database) refreshMonthlyRollups(ctx context.Context, db GoquDatabase, cond exp.Expression) error {
+	month := rollupMonth(t.DailyRollups.Col("period_start"))
+
+	totals := db.From(t.DailyRollups).
+		Select(
+			t.DailyRollups.Col("user_id"),
+			t.DailyRollups.Col("resource_type_id"),
+			month,
+			goqu.SUM(t.DailyRollups.Col("consumed")),
+			goqu.SUM(t.DailyRollups.Col("update_count")),
+		).
+		Where(cond).
+		GroupBy(t.DailyRollups.Col("user_id"), t.DailyRollups.Col("resource_type_id"), month)
+
+	ds := insertRollups(db, t.MonthlyRollups, totals)
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to refresh the monthly usage rollups")
+	}
+
+	return nil
+}
+
+// AggregateUsageRollups refreshes the rollups for the days and months of the
+// usage updates that were added since the last time the rollups were
+// aggregated, and returns the number of daily rollups that were refreshed.
+// Updates added within the overlap before the last aggregation are included
+// again, so that updates from transactions that committed late aren't missed.
+// Returns zero without doing anything if another aggregation is in progress.
+// Only WithTX is currently supported, and a transaction is required so that
+// concurrent aggregations don't overlap.
+func (d *Database) AggregateUsageRollups(ctx context.Context, overlap time.Duration, opts ...QueryOption) (int64, error) {
+	_, db := d.querySettings(opts...)
+
+	stateDS := db.From(t.RollupState).
+		Select(t.RollupState.Col("aggregated_through")).
+		ForUpdate(exp.SkipLocked)
+	d.LogSQL(stateDS)
+
+	var aggregatedThrough sql.NullTime
+	found, err := stateDS.Executor().ScanValContext(ctx, &aggregatedThrough)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to look up the usage rollup state")
+	}
+	if !found {
+		return 0, nil
+	}
+
+	// The first aggregation populates the rollups from every update.
+	touched := db.From(t.Updates).
+		Select(t.Updates.Col("user_id"), t.Updates.Col("resource_type_id"), rollupDay()).
+		Where(t.Updates.Col("value_type").Eq(UsagesTrackedMetric))
+	if aggregatedThrough.Valid {
+		touched = touched.Where(t.Updates.Col("created_at").Gte(aggregatedThrough.Time.Add(-overlap)))
+	}
+
+	count, err := d.refreshDailyRollups(ctx, db, goqu.L(
+		"(?, ?, ?) IN ?", t.Updates.Col("user_id"), t.Updates.Col("resource_type_id"), rollupDay(), touched,
+	))
+	if err != nil {
+		return 0, err
+	}
+
+	touchedMonths := touched.Select(
+		t.Updates.Col("user_id"), t.Updates.Col("resource_type_id"), rollupMonth(rollupDay()),
+	)
+
+	if err = d.refreshMonthlyRollups(ctx, db, goqu.L(
+		"(?, ?, ?) IN ?",
+		t.DailyRollups.Col("user_id"),
+		t.DailyRollups.Col("resource_type_id"),
+		rollupMonth(t.DailyRollups.Col("period_start")),
+		touchedMonths,
+	)); err != nil {
+		return 0, err
+	}
+
+	updateDS := db.Update(t.RollupState).Set(goqu.Record{"aggregated_through": CurrentTimestamp})
+	d.LogSQL(updateDS)
+
+	if _, err = updateDS.Executor().ExecContext(ctx); err != nil {
+		return 0, errors.Wrap(err, "unable to update the usage rollup state")
+	}
+
+	return count, nil
+}
+
+// RebuildUsageRollupsForUser replaces the rollups for a user with rollups
+// calculated from all of the user's usage updates. This is used when updates
+// are moved from one user to another. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) RebuildUsageRollupsForUser(ctx context.Context, userID string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	for _, table := range []exp.IdentifierExpression{t.DailyRollups, t.MonthlyRollups} {
+		if _, err := d.deleteRows(ctx, db, table, table.Col("user_id").Eq(userID)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := d.refreshDailyRollups(ctx, db, t.Updates.Col("user_id").Eq(userID)); err != nil {
+		return err
+	}
+
+	return d.refreshMonthlyRollups(ctx, db, t.DailyRollups.Col("user_id").Eq(userID))
+}
+
+// UsageTotalsByUser returns the total usage of a resource type consumed by each
+// user during the days from start up to end, in UTC, with the largest totals
+// first. Monthly rollups are used for the calendar months that are entirely
+// within the range, and daily rollups are used for the rest of the days. Only
+// users with rollups in the range are included. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) UsageTotalsByUser(
+	ctx context.Context, resourceTypeID string, start, end time.Time, opts ...QueryOption,
+) ([]UsageTotal, error) {
+	_, db := d.querySettings(opts...)
+
+	start, end = start.UTC(), end.UTC()
+
+	// The first month that starts within the range and the end of the last
+	// month that ends within it.
+	firstMonth := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if firstMonth.Before(start) {
+		firstMonth = firstMonth.AddDate(0, 1, 0)
+	}
+	lastMonth := time.Date(end.Year(), end.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if !firstMonth.Before(lastMonth) {
+		firstMonth, lastMonth = end, end
+	}
+
+	rollupDS := func(table exp.IdentifierExpression, ranges ...exp.Expression) *goqu.SelectDataset {
+		return db.From(table).
+			Select(table.Col("user_id"), table.Col("consumed"), table.Col("update_count")).
+			Where(table.Col("resource_type_id").Eq(resourceTypeID), goqu.Or(ranges...))
+	}
+
+	daily := rollupDS(t.DailyRollups,
+		goqu.And(
+			t.DailyRollups.Col("period_start").Gte(dateValue(start)),
+			t.DailyRollups.Col("period_start").Lt(dateValue(firstMonth)),
+		),
+		goqu.And(
+			t.DailyRollups.Col("period_start").Gte(dateValue(lastMonth)),
+			t.DailyRollups.Col("period_start").Lt(dateValue(end)),
+		),
+	)
+	monthly := rollupDS(t.MonthlyRollups,
+		goqu.And(
+			t.MonthlyRollups.Col("period_start").Gte(dateValue(firstMonth)),
+			t.MonthlyRollups.Col("period_start").Lt(dateValue(lastMonth)),
+		),
+	)
+
+	rollups := goqu.T("rollups")
+	ds := db.From(daily.UnionAll(monthly).As("rollups")).
+		Join(t.Users, goqu.On(rollups.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.Users.Col("username"),
+			goqu.SUM(rollups.Col("consumed")).As("consumed"),
+			goqu.SUM(rollups.Col("update_count")).As("update_count"),
+		).
+		GroupBy(t.Users.Col("username")).
+		Order(goqu.I("consumed").Desc(), t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var totals []UsageTotal
+	if err := ds.Executor().ScanStructsContext(ctx, &totals); err != nil {
+		return nil, errors.Wrap(err, "unable to total the usage rollups")
+	}
+
+	return totals, nil
+}
+
+// UserUsageRollups returns the daily or monthly rollups for a user with periods
+// that start during the days from start up to end, in UTC, in order by period.
+// If the resource type ID is empty, the rollups for every resource type are
+// included. Returns ErrInvalidGranularity for unknown granularities. Accepts a
+// variable number of QueryOptions, though only WithTX and WithReadReplica are
+// currently supported.
+func (d *Database) UserUsageRollups(
+	ctx context.Context, username, resourceTypeID, granularity string, start, end time.Time, opts ...QueryOption,
+) ([]UsageRollup, error) {
+	_, db := d.querySettings(opts...)
+
+	table, err := rollupTable(granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := db.From(table).
+		Join(t.Users, goqu.On(table.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(table.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.Users.Col("username"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			table.Col("period_start"),
+			table.Col("consumed"),
+			table.Col("update_count"),
+		).
+		Where(
+			t.Users.Col("username").Eq(username),
+			table.Col("period_start").Gte(dateValue(start)),
+			table.Col("period_start").Lt(dateValue(end)),
+		).
+		Order(table.Col("period_start").Asc(), t.RT.Col("name").Asc())
+	if resourceTypeID != "" {
+		ds = ds.Where(table.Col("resource_type_id").Eq(resourceTypeID))
+	}
+	d.LogSQL(ds)
+
+	var rollups []UsageRollup
+	if err = ds.Executor().ScanStructsContext(ctx, &rollups); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the usage rollups for %s", username)
+	}
+
+	return rollups, nil
+}
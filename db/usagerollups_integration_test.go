@@ -0,0 +1,176 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// addTestUsageUpdates records usage updates for the user that took effect at
+// the given times.
+func addTestUsageUpdates(t *testing.T, user *User, resourceType ResourceType, operation string, value float64, when ...time.Time) {
+	t.Helper()
+
+	for _, effectiveDate := range when {
+		update := newTestUpdate(t, *user, resourceType, UsagesTrackedMetric, operation, value)
+		update.EffectiveDate = effectiveDate
+		if _, err := testDB.AddUserUpdate(context.Background(), update); err != nil {
+			t.Fatalf("unable to add the update: %s", err)
+		}
+	}
+}
+
+func TestRebuildUsageRollupsForUser(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+
+	first := time.Date(2001, time.March, 10, 12, 0, 0, 0, time.UTC)
+	second := time.Date(2001, time.March, 11, 12, 0, 0, 0, time.UTC)
+	addTestUsageUpdates(t, user, compute, UpdateTypeAdd, 2, first)
+	addTestUsageUpdates(t, user, compute, UpdateTypeSet, 5, first)
+	addTestUsageUpdates(t, user, compute, UpdateTypeAdd, 3, second)
+
+	if err := testDB.RebuildUsageRollupsForUser(ctx, user.ID); err != nil {
+		t.Fatalf("unable to rebuild the rollups: %s", err)
+	}
+
+	start := time.Date(2001, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	// Only additions count toward the consumed amount.
+	tests := []struct {
+		granularity string
+		expected    []UsageRollup
+	}{
+		{
+			granularity: api.RollupDaily,
+			expected: []UsageRollup{
+				{PeriodStart: time.Date(2001, time.March, 10, 0, 0, 0, 0, time.UTC), Consumed: 2, UpdateCount: 2},
+				{PeriodStart: time.Date(2001, time.March, 11, 0, 0, 0, 0, time.UTC), Consumed: 3, UpdateCount: 1},
+			},
+		},
+		{
+			granularity: api.RollupMonthly,
+			expected:    []UsageRollup{{PeriodStart: start, Consumed: 5, UpdateCount: 3}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.granularity, func(t *testing.T) {
+			rollups, err := testDB.UserUsageRollups(ctx, user.Username, compute.ID, tc.granularity, start, end)
+			if err != nil {
+				t.Fatalf("unable to list the rollups: %s", err)
+			}
+			if len(rollups) != len(tc.expected) {
+				t.Fatalf("expected %d rollups, got %+v", len(tc.expected), rollups)
+			}
+			for i, expected := range tc.expected {
+				actual := rollups[i]
+				if !actual.PeriodStart.Equal(expected.PeriodStart) ||
+					actual.Consumed != expected.Consumed ||
+					actual.UpdateCount != expected.UpdateCount ||
+					actual.ResourceType != compute {
+					t.Errorf("expected rollup %d to be %+v, got %+v", i, expected, actual)
+				}
+			}
+		})
+	}
+
+	_, err := testDB.UserUsageRollups(ctx, user.Username, "", "weekly", start, end)
+	if !errors.Is(err, suberrors.ErrInvalidGranularity) {
+		t.Errorf("expected ErrInvalidGranularity, got %v", err)
+	}
+}
+
+func TestUsageTotalsByUser(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	light, heavy := addTestUser(t), addTestUser(t)
+
+	march := time.Date(2001, time.March, 10, 12, 0, 0, 0, time.UTC)
+	april := time.Date(2001, time.April, 2, 12, 0, 0, 0, time.UTC)
+	addTestUsageUpdates(t, light, compute, UpdateTypeAdd, 1, march, april)
+	addTestUsageUpdates(t, heavy, compute, UpdateTypeAdd, 5, march, april)
+	for _, user := range []*User{light, heavy} {
+		if err := testDB.RebuildUsageRollupsForUser(ctx, user.ID); err != nil {
+			t.Fatalf("unable to rebuild the rollups: %s", err)
+		}
+	}
+
+	// The range covers all of March from the monthly rollups and the first
+	// days of April from the daily rollups.
+	start := time.Date(2001, time.March, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2001, time.April, 5, 0, 0, 0, 0, time.UTC)
+
+	totals, err := testDB.UsageTotalsByUser(ctx, compute.ID, start, end)
+	if err != nil {
+		t.Fatalf("unable to total the usage: %s", err)
+	}
+	expected := []UsageTotal{
+		{Username: heavy.Username, Consumed: 10, UpdateCount: 2},
+		{Username: light.Username, Consumed: 2, UpdateCount: 2},
+	}
+	if len(totals) != len(expected) {
+		t.Fatalf("expected %+v, got %+v", expected, totals)
+	}
+	for i := range expected {
+		if totals[i] != expected[i] {
+			t.Errorf("expected total %d to be %+v, got %+v", i, expected[i], totals[i])
+		}
+	}
+
+	// Days outside of the range aren't included.
+	totals, err = testDB.UsageTotalsByUser(ctx, compute.ID, start.AddDate(0, 0, 15), end)
+	if err != nil {
+		t.Fatalf("unable to total the usage: %s", err)
+	}
+	if len(totals) != 2 || totals[0].Consumed != 5 || totals[1].Consumed != 1 {
+		t.Errorf("expected only the April usage, got %+v", totals)
+	}
+}
+
+// The aggregation refreshes the rollups for every user, so it doesn't run in
+// parallel with the other tests.
+func TestAggregateUsageRollups(t *testing.T) {
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	user := addTestUser(t)
+	effectiveDate := time.Date(2001, time.June, 1, 12, 0, 0, 0, time.UTC)
+	addTestUsageUpdates(t, user, compute, UpdateTypeAdd, 4, effectiveDate)
+
+	var count int64
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		var err error
+		count, err = testDB.AggregateUsageRollups(ctx, time.Minute, WithTX(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to aggregate the rollups: %s", err)
+	}
+	if count == 0 {
+		t.Fatal("expected the rollups for the new update to be refreshed")
+	}
+
+	rollups, err := testDB.UserUsageRollups(
+		ctx, user.Username, compute.ID, api.RollupDaily, effectiveDate.AddDate(0, 0, -1), effectiveDate.AddDate(0, 0, 1),
+	)
+	if err != nil {
+		t.Fatalf("unable to list the rollups: %s", err)
+	}
+	if len(rollups) != 1 || rollups[0].Consumed != 4 {
+		t.Errorf("expected a daily rollup of 4, got %+v", rollups)
+	}
+}
@@ -0,0 +1,478 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// hourAgo is the start of the window that the hourly delta limit applies to.
+var hourAgo = goqu.L("CURRENT_TIMESTAMP - interval '1 hour'")
+
+// UsageRule limits the usage updates that are accepted for a resource type.
+// Limits that are null aren't checked.
+type UsageRule struct {
+	ResourceType   ResourceType    `db:"resource_types"`
+	MinValue       sql.NullFloat64 `db:"min_value"`
+	MaxValue       sql.NullFloat64 `db:"max_value"`
+	MaxHourlyDelta sql.NullFloat64 `db:"max_hourly_delta"`
+	AllowNegative  bool            `db:"allow_negative"`
+	Action         string          `db:"action"`
+	LastModifiedBy string          `db:"last_modified_by"`
+	LastModifiedAt time.Time       `db:"last_modified_at"`
+}
+
+// nullFloatPtr returns a pointer to the value of a nullable float, or nil if
+// it's null.
+func nullFloatPtr(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
+
+// ToAPIType converts the usage rule to the type used in responses.
+func (r *UsageRule) ToAPIType() *api.UsageRule {
+	return &api.UsageRule{
+		ResourceType: api.ResourceType{
+			ID:   r.ResourceType.ID,
+			Name: r.ResourceType.Name,
+			Unit: r.ResourceType.Unit,
+		},
+		MinValue:       nullFloatPtr(r.MinValue),
+		MaxValue:       nullFloatPtr(r.MaxValue),
+		MaxHourlyDelta: nullFloatPtr(r.MaxHourlyDelta),
+		AllowNegative:  r.AllowNegative,
+		Action:         r.Action,
+		LastModifiedBy: r.LastModifiedBy,
+		LastModifiedAt: &r.LastModifiedAt,
+	}
+}
+
+// check returns the reasons that a usage update breaks the rule, if it does.
+// The delta is the change in usage that the update makes, and recentDelta is
+// the total change that's already been made during the current hour.
+func (r *UsageRule) check(value, delta, recentDelta float64) []string {
+	var reasons []string
+	unit := r.ResourceType.Unit
+
+	if value < 0 && !r.AllowNegative {
+		reasons = append(reasons, fmt.Sprintf("the value %g %s is negative", value, unit))
+	}
+	if r.MinValue.Valid && value < r.MinValue.Float64 {
+		reasons = append(reasons, fmt.Sprintf("the value %g %s is below the minimum of %g %s", value, unit, r.MinValue.Float64, unit))
+	}
+	if r.MaxValue.Valid && value > r.MaxValue.Float64 {
+		reasons = append(reasons, fmt.Sprintf("the value %g %s is above the maximum of %g %s", value, unit, r.MaxValue.Float64, unit))
+	}
+	if r.MaxHourlyDelta.Valid && recentDelta+math.Abs(delta) > r.MaxHourlyDelta.Float64 {
+		reasons = append(reasons, fmt.Sprintf(
+			"the usage would change by %g %s in an hour, which is more than the limit of %g %s",
+			recentDelta+math.Abs(delta), unit, r.MaxHourlyDelta.Float64, unit,
+		))
+	}
+
+	return reasons
+}
+
+// usageRulesDS returns the dataset for listing usage rules along with their
+// resource types.
+func usageRulesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.UsageRules).
+		Join(t.RT, goqu.On(t.UsageRules.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.UsageRules.Col("min_value"),
+			t.UsageRules.Col("max_value"),
+			t.UsageRules.Col("max_hourly_delta"),
+			t.UsageRules.Col("allow_negative"),
+			t.UsageRules.Col("action"),
+			t.UsageRules.Col("last_modified_by"),
+			t.UsageRules.Col("last_modified_at"),
+		)
+}
+
+// SetUsageRule adds or replaces the usage validation rule for a resource type.
+// The resource type must be set in the rule. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) SetUsageRule(ctx context.Context, rule *UsageRule, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.UsageRules).
+		Rows(goqu.Record{
+			"resource_type_id": rule.ResourceType.ID,
+			"min_value":        rule.MinValue,
+			"max_value":        rule.MaxValue,
+			"max_hourly_delta": rule.MaxHourlyDelta,
+			"allow_negative":   rule.AllowNegative,
+			"action":           rule.Action,
+			"last_modified_by": rule.LastModifiedBy,
+		}).
+		OnConflict(goqu.DoUpdate("resource_type_id", goqu.Record{
+			"min_value":        goqu.I("excluded.min_value"),
+			"max_value":        goqu.I("excluded.max_value"),
+			"max_hourly_delta": goqu.I("excluded.max_hourly_delta"),
+			"allow_negative":   goqu.I("excluded.allow_negative"),
+			"action":           goqu.I("excluded.action"),
+			"last_modified_by": goqu.I("excluded.last_modified_by"),
+			"last_modified_at": CurrentTimestamp,
+		})).
+		Returning(t.UsageRules.Col("last_modified_at"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanValContext(ctx, &rule.LastModifiedAt); err != nil {
+		return errors.Wrapf(err, "unable to set the usage rule for %s", rule.ResourceType.Name)
+	}
+
+	return nil
+}
+
+// GetUsageRule returns the usage validation rule for a resource type, or nil
+// if the resource type doesn't have one. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetUsageRule(ctx context.Context, resourceTypeID string, opts ...QueryOption) (*UsageRule, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := usageRulesDS(db).Where(t.UsageRules.Col("resource_type_id").Eq(resourceTypeID))
+	d.LogSQL(ds)
+
+	var rule UsageRule
+	found, err := ds.Executor().ScanStructContext(ctx, &rule)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the usage rule for resource type %s", resourceTypeID)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &rule, nil
+}
+
+// ListUsageRules returns the usage validation rules of the resource types that
+// have them, in order by resource type name. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListUsageRules(ctx context.Context, opts ...QueryOption) ([]UsageRule, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := usageRulesDS(db).Order(t.RT.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var rules []UsageRule
+	if err := ds.Executor().ScanStructsContext(ctx, &rules); err != nil {
+		return nil, errors.Wrap(err, "unable to list the usage rules")
+	}
+
+	return rules, nil
+}
+
+// recentUsageDelta returns the total change in a subscription's usage of a
+// resource type during the current hour. The row is locked so that concurrent
+// updates can't both squeeze in under the limit.
+func (d *Database) recentUsageDelta(ctx context.Context, db GoquDatabase, subscriptionID, resourceTypeID string) (float64, error) {
+	ds := db.From(t.HourlyDeltas).
+		Select(t.HourlyDeltas.Col("delta")).
+		Where(
+			t.HourlyDeltas.Col("subscription_id").Eq(subscriptionID),
+			t.HourlyDeltas.Col("resource_type_id").Eq(resourceTypeID),
+			t.HourlyDeltas.Col("window_start").Gt(hourAgo),
+		).
+		ForUpdate(exp.Wait)
+	d.LogSQL(ds)
+
+	var delta float64
+	if _, err := ds.Executor().ScanValContext(ctx, &delta); err != nil {
+		return 0, errors.Wrapf(err, "unable to look up the recent usage changes for subscription %s", subscriptionID)
+	}
+
+	return delta, nil
+}
+
+// recordUsageDelta adds a change in usage to the total for the current hour,
+// starting a new hour if the current one has ended.
+func (d *Database) recordUsageDelta(ctx context.Context, db GoquDatabase, subscriptionID, resourceTypeID string, delta float64) error {
+	expired := t.HourlyDeltas.Col("window_start").Lte(hourAgo)
+
+	ds := db.Insert(t.HourlyDeltas).
+		Rows(goqu.Record{
+			"subscription_id":  subscriptionID,
+			"resource_type_id": resourceTypeID,
+			"delta":            math.Abs(delta),
+		}).
+		OnConflict(goqu.DoUpdate("subscription_id, resource_type_id", goqu.Record{
+			"window_start": goqu.Case().When(expired, CurrentTimestamp).Else(t.HourlyDeltas.Col("window_start")),
+			"delta": goqu.Case().
+				When(expired, goqu.I("excluded.delta")).
+				Else(goqu.L("? + ?", t.HourlyDeltas.Col("delta"), goqu.I("excluded.delta"))),
+		}))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to record the usage change for subscription %s", subscriptionID)
+	}
+
+	return nil
+}
+
+// FlaggedUsageUpdate is a usage update that broke the validation rule of its
+// resource type.
+type FlaggedUsageUpdate struct {
+	ID             string         `db:"id" goqu:"defaultifempty"`
+	Username       string         `db:"username"`
+	SubscriptionID string         `db:"subscription_id"`
+	ResourceType   ResourceType   `db:"resource_types"`
+	UpdateType     string         `db:"update_type"`
+	Value          float64        `db:"value"`
+	Reason         string         `db:"reason"`
+	Rejected       bool           `db:"rejected"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+	ReviewedBy     sql.NullString `db:"reviewed_by"`
+	ReviewedAt     sql.NullTime   `db:"reviewed_at"`
+}
+
+// ToAPIType converts the flagged usage update to the type used in responses.
+func (f *FlaggedUsageUpdate) ToAPIType() *api.FlaggedUsageUpdate {
+	update := &api.FlaggedUsageUpdate{
+		ID:             f.ID,
+		Username:       f.Username,
+		SubscriptionID: f.SubscriptionID,
+		ResourceType: api.ResourceType{
+			ID:   f.ResourceType.ID,
+			Name: f.ResourceType.Name,
+			Unit: f.ResourceType.Unit,
+		},
+		UpdateType: f.UpdateType,
+		Value:      f.Value,
+		Reason:     f.Reason,
+		Rejected:   f.Rejected,
+		CreatedAt:  f.CreatedAt,
+		ReviewedBy: f.ReviewedBy.String,
+	}
+	if f.ReviewedAt.Valid {
+		update.ReviewedAt = &f.ReviewedAt.Time
+	}
+	return update
+}
+
+// flaggedUpdatesDS returns the dataset used to look up flagged usage updates.
+func flaggedUpdatesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.FlaggedUpdates).
+		Join(t.Subscriptions, goqu.On(t.FlaggedUpdates.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.RT, goqu.On(t.FlaggedUpdates.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Select(
+			t.FlaggedUpdates.Col("id"),
+			t.Users.Col("username"),
+			t.FlaggedUpdates.Col("subscription_id"),
+			t.RT.Col("id").As(goqu.C("resource_types.id")),
+			t.RT.Col("name").As(goqu.C("resource_types.name")),
+			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
+			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
+			t.FlaggedUpdates.Col("update_type"),
+			t.FlaggedUpdates.Col("value"),
+			t.FlaggedUpdates.Col("reason"),
+			t.FlaggedUpdates.Col("rejected"),
+			t.FlaggedUpdates.Col("created_at"),
+			t.FlaggedUpdates.Col("reviewed_by"),
+			t.FlaggedUpdates.Col("reviewed_at"),
+		)
+}
+
+// FlagUsageUpdate records a usage update that broke the validation rule of its
+// resource type. The subscription ID, resource type, update type, value,
+// reason and whether it was rejected must be set. Accepts a variable number
+// of QueryOptions, though only WithTX is currently supported.
+func (d *Database) FlagUsageUpdate(ctx context.Context, flagged *FlaggedUsageUpdate, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.FlaggedUpdates).
+		Rows(goqu.Record{
+			"subscription_id":  flagged.SubscriptionID,
+			"resource_type_id": flagged.ResourceType.ID,
+			"update_type":      flagged.UpdateType,
+			"value":            flagged.Value,
+			"reason":           flagged.Reason,
+			"rejected":         flagged.Rejected,
+		}).
+		Returning(t.FlaggedUpdates.Col("id"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanValContext(ctx, &flagged.ID); err != nil {
+		return errors.Wrapf(err, "unable to flag the usage update for subscription %s", flagged.SubscriptionID)
+	}
+
+	return nil
+}
+
+// ListFlaggedUsageUpdates returns the flagged usage updates, newest first.
+// Updates that have been reviewed are only included if includeReviewed is
+// true. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) ListFlaggedUsageUpdates(ctx context.Context, includeReviewed bool, opts ...QueryOption) ([]FlaggedUsageUpdate, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := flaggedUpdatesDS(db).
+		Where(querySettings.tenantExp(t.Users)).
+		Order(t.FlaggedUpdates.Col("created_at").Desc())
+	if !includeReviewed {
+		ds = ds.Where(t.FlaggedUpdates.Col("reviewed_at").IsNull())
+	}
+	d.LogSQL(ds)
+
+	var updates []FlaggedUsageUpdate
+	if err := ds.Executor().ScanStructsContext(ctx, &updates); err != nil {
+		return nil, errors.Wrap(err, "unable to list the flagged usage updates")
+	}
+
+	return updates, nil
+}
+
+// ReviewFlaggedUsageUpdate marks a flagged usage update as reviewed and returns
+// it, or returns nil if it doesn't exist. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) ReviewFlaggedUsageUpdate(ctx context.Context, id, reviewedBy string, opts ...QueryOption) (*FlaggedUsageUpdate, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Update(t.FlaggedUpdates).
+		Set(goqu.Record{
+			"reviewed_by": reviewedBy,
+			"reviewed_at": CurrentTimestamp,
+		}).
+		Where(
+			t.FlaggedUpdates.Col("id").Eq(id),
+			t.FlaggedUpdates.Col("subscription_id").In(
+				db.From(t.Subscriptions).
+					Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+					Select(t.Subscriptions.Col("id")).
+					Where(querySettings.tenantExp(t.Users)),
+			),
+		)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to review the flagged usage update %s", id)
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return nil, err
+	}
+
+	lookup := flaggedUpdatesDS(db).Where(t.FlaggedUpdates.Col("id").Eq(id))
+	d.LogSQL(lookup)
+
+	var update FlaggedUsageUpdate
+	if _, err = lookup.Executor().ScanStructContext(ctx, &update); err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the flagged usage update %s", id)
+	}
+
+	return &update, nil
+}
+
+// checkUsageRule checks a usage update against the validation rule of its
+// resource type, if it has one, and acts on the update if it breaks the rule.
+// Flagged updates are recorded and nil is returned so that they're applied.
+// Rejected updates return a *errors.UsageRejectedError; they aren't recorded
+// here since the transaction is about to be rolled back. Quarantined updates
+// are recorded and return a *errors.UsageQuarantinedError, which callers have
+// to handle without rolling back the transaction. The change that the update
+// makes is added to the hourly total if the rule limits it and the update is
+// applied.
+func (d *Database) checkUsageRule(ctx context.Context, updateType string, usage *Usage, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	rule, err := d.GetUsageRule(ctx, usage.ResourceType.ID, opts...)
+	if err != nil || rule == nil {
+		return err
+	}
+
+	delta := usage.Usage
+	if updateType == UpdateTypeSet {
+		current, _, err := d.GetCurrentUsage(ctx, usage.ResourceType.ID, usage.SubscriptionID, opts...)
+		if err != nil {
+			return err
+		}
+		delta = usage.Usage - current
+	}
+
+	var recentDelta float64
+	if rule.MaxHourlyDelta.Valid {
+		if recentDelta, err = d.recentUsageDelta(ctx, db, usage.SubscriptionID, usage.ResourceType.ID); err != nil {
+			return err
+		}
+	}
+
+	if reasons := rule.check(usage.Usage, delta, recentDelta); len(reasons) > 0 {
+		reason := strings.Join(reasons, "; ")
+
+		switch rule.Action {
+		case api.UsageRuleReject:
+			return &suberrors.UsageRejectedError{ResourceName: rule.ResourceType.Name, Reasons: reasons}
+
+		case api.UsageRuleQuarantine:
+			quarantined := &QuarantinedUsageUpdate{
+				SubscriptionID: usage.SubscriptionID,
+				ResourceType:   rule.ResourceType,
+				UpdateType:     updateType,
+				Value:          usage.Usage,
+				Reason:         reason,
+			}
+			if err = d.QuarantineUsageUpdate(ctx, quarantined, opts...); err != nil {
+				return err
+			}
+			return &suberrors.UsageQuarantinedError{
+				ID:           quarantined.ID,
+				ResourceName: rule.ResourceType.Name,
+				Reasons:      reasons,
+			}
+
+		default:
+			log.Warnf("flagging the usage update for subscription %s: %s", usage.SubscriptionID, reason)
+			flagged := &FlaggedUsageUpdate{
+				SubscriptionID: usage.SubscriptionID,
+				ResourceType:   rule.ResourceType,
+				UpdateType:     updateType,
+				Value:          usage.Usage,
+				Reason:         reason,
+			}
+			if err = d.FlagUsageUpdate(ctx, flagged, opts...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if rule.MaxHourlyDelta.Valid {
+		return d.recordUsageDelta(ctx, db, usage.SubscriptionID, usage.ResourceType.ID, delta)
+	}
+	return nil
+}
+
+// RecordRejectedUsage records a usage update that was rejected by the
+// validation rule of its resource type so that it can be reviewed. It's
+// recorded outside of the transaction that the update was attempted in, since
+// that transaction was rolled back. Failures are only logged, since the
+// rejection is returned to the caller either way.
+func (d *Database) RecordRejectedUsage(ctx context.Context, updateType string, usage *Usage, rejected *suberrors.UsageRejectedError) {
+	flagged := &FlaggedUsageUpdate{
+		SubscriptionID: usage.SubscriptionID,
+		ResourceType:   usage.ResourceType,
+		UpdateType:     updateType,
+		Value:          usage.Usage,
+		Reason:         strings.Join(rejected.Reasons, "; "),
+		Rejected:       true,
+	}
+	if err := d.FlagUsageUpdate(ctx, flagged); err != nil {
+		log.Errorf("unable to record the rejected usage update for subscription %s: %s", usage.SubscriptionID, err)
+	}
+}
@@ -0,0 +1,88 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// setTestUsageRule limits the usage updates for the resource type to the
+// maximum value, with the given action for the ones that break the limit.
+func setTestUsageRule(t *testing.T, resourceType ResourceType, action string, maxValue float64) {
+	t.Helper()
+
+	err := testDB.SetUsageRule(context.Background(), &UsageRule{
+		ResourceType:   resourceType,
+		MaxValue:       sql.NullFloat64{Float64: maxValue, Valid: true},
+		Action:         action,
+		LastModifiedBy: "test",
+	})
+	if err != nil {
+		t.Fatalf("unable to set the usage rule: %s", err)
+	}
+}
+
+func TestProcessUpdateForUsageRules(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		action   string
+		rejected bool
+	}{
+		{action: api.UsageRuleReject, rejected: true},
+		{action: api.UsageRuleFlag},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.action, func(t *testing.T) {
+			t.Parallel()
+
+			compute := addTestResourceType(t, true)
+			subscription := addTestSubscription(t)
+			user := &subscription.User
+			setTestUsageRule(t, compute, tc.action, 10)
+
+			// Updates within the limits are applied and recorded as usual.
+			allowed := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 5)
+			if err := testDB.ProcessUpdateForUsage(ctx, allowed); err != nil {
+				t.Fatalf("unable to process the update: %s", err)
+			}
+			if allowed.ID == "" {
+				t.Error("expected the update to be recorded")
+			}
+
+			err := testDB.ProcessUpdateForUsage(
+				ctx, newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 20),
+			)
+			if _, ok := suberrors.UsageRejection(err); ok != tc.rejected {
+				t.Fatalf("expected a rejection: %t, got %v", tc.rejected, err)
+			}
+			if !tc.rejected && err != nil {
+				t.Fatalf("unable to process the update: %s", err)
+			}
+
+			expectedUsage, expectedUpdates := 25.0, int64(2)
+			if tc.rejected {
+				expectedUsage, expectedUpdates = 5, 1
+			}
+			if usage := currentUsage(t, compute.ID, subscription.ID); usage != expectedUsage {
+				t.Errorf("expected a usage of %g, got %g", expectedUsage, usage)
+			}
+			if count := countRows(t, "updates", goqu.Ex{"user_id": user.ID}); count != expectedUpdates {
+				t.Errorf("expected %d recorded updates, got %d", expectedUpdates, count)
+			}
+
+			flagged := goqu.Ex{"subscription_id": subscription.ID, "value": 20, "rejected": tc.rejected}
+			if count := countRows(t, "flagged_usage_updates", flagged); count != 1 {
+				t.Errorf("expected the update to be recorded for review, got %d records", count)
+			}
+		})
+	}
+}
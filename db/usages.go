@@ -4,8 +4,9 @@ import (
 	"context"
 	"fmt"
 
+	t "github.com/cyverse-de/subscriptions/db/tables"
 	"github.com/doug-martin/goqu/v9"
-	"github.com/doug-martin/goqu/v9/exec"
+	"github.com/pkg/errors"
 )
 
 // GetCurrentUsage returns the current usage value for the resource type specifed
@@ -14,18 +15,16 @@ import (
 // was returned. Accepts a variable number of QueryOptions, though only WithTX
 // is currently supported.
 func (d *Database) GetCurrentUsage(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error) {
-	var (
-		err error
-		db  GoquDatabase
-	)
+	var err error
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	usagesE := db.From("usages").
 		Select(goqu.C("usage")).
 		Where(goqu.And(
 			goqu.I("resource_type_id").Eq(resourceTypeID),
 			goqu.I("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, goqu.I("subscription_id")),
 		)).
 		Limit(1).
 		Executor()
@@ -39,77 +38,98 @@ func (d *Database) GetCurrentUsage(ctx context.Context, resourceTypeID, subscrip
 	return usageValue, usageFound, nil
 }
 
-// UpsertUsage will insert or update a record usage in the database for the
-// resource type and user plan indicated. Accepts a variable number of
-// QueryOptions, though only WithTX is currently supported.
-func (d *Database) UpsertUsage(ctx context.Context, update bool, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
-	var (
-		err error
-		db  GoquDatabase
-	)
-
-	_, db = d.querySettings(opts...)
-
-	updateRecord := goqu.Record{
-		"usage":            value,
-		"resource_type_id": resourceTypeID,
-		"subscription_id":  subscriptionID,
-		"last_modified_by": "de",
-		"created_by":       "de",
+// ApplyUsage updates the usage of a resource type in a subscription with a
+// single upsert, so that concurrent updates can't overwrite each other: the
+// value either replaces the current usage or is added to it. Usage that's added
+// is drawn from the credits of the subscription's owner for the resource type
+// first, and only the rest of it counts against the quota. Returns the new
+// usage and the amount that was drawn from credits. Accepts a variable number
+// of QueryOptions, though only WithTX and WithUpdateID are currently supported.
+// A transaction should be used so that credits aren't drawn if the update is
+// rolled back.
+func (d *Database) ApplyUsage(
+	ctx context.Context, updateType string, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption,
+) (float64, float64, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkSubscriptionTenant(ctx, db, querySettings, subscriptionID); err != nil {
+		return 0, 0, err
 	}
 
-	var upsertE exec.QueryExecutor
-	if !update {
-		upsertE = db.Insert("usages").Rows(updateRecord).Executor()
-	} else {
-		upsertE = db.Update("usages").Set(updateRecord).Where(
-			goqu.And(
-				goqu.I("resource_type_id").Eq(resourceTypeID),
-				goqu.I("subscription_id").Eq(subscriptionID),
-			),
-		).Executor()
+	var (
+		usage any
+		drawn float64
+	)
+	switch updateType {
+	case UpdateTypeSet:
+		usage = goqu.I("excluded.usage")
+	case UpdateTypeAdd:
+		usage = goqu.L("? + ?", t.Usages.Col("usage"), goqu.I("excluded.usage"))
+
+		owner := db.From(t.Subscriptions).
+			Select(t.Subscriptions.Col("user_id")).
+			Where(t.Subscriptions.Col("id").Eq(subscriptionID))
+		d.LogSQL(owner)
+
+		var userID string
+		if _, err := owner.Executor().ScanValContext(ctx, &userID); err != nil {
+			return 0, 0, errors.Wrapf(err, "unable to look up the owner of subscription %s", subscriptionID)
+		}
+
+		var err error
+		drawn, err = d.DrawCredits(ctx, userID, resourceTypeID, value, querySettings.updateID, opts...)
+		if err != nil {
+			return 0, 0, err
+		}
+		value -= drawn
+	default:
+		return 0, 0, fmt.Errorf("invalid update type: %s", updateType)
 	}
 
-	log.Info(upsertE.ToSQL())
-
-	_, err = upsertE.ExecContext(ctx)
-	if err != nil {
-		return err
+	ds := db.Insert(t.Usages).
+		Rows(goqu.Record{
+			"usage":            value,
+			"resource_type_id": resourceTypeID,
+			"subscription_id":  subscriptionID,
+			"last_modified_by": "de",
+			"created_by":       "de",
+		}).
+		OnConflict(goqu.DoUpdate("resource_type_id, subscription_id", goqu.Record{
+			"usage":            usage,
+			"last_modified_by": "de",
+		})).
+		Returning(t.Usages.Col("usage"))
+	d.LogSQL(ds)
+
+	var newUsage float64
+	if _, err := ds.Executor().ScanValContext(ctx, &newUsage); err != nil {
+		return 0, 0, errors.Wrapf(err, "unable to update the usage for subscription %s", subscriptionID)
 	}
 
-	return nil
+	return newUsage, drawn, nil
 }
 
 // CalculateUsage upserts a new usage value, ignore the updates tables. Should only
 // be used to administratively update a usage value in the case where it gets
-// out of sync with the updates. Accepts a variable number of QueryOptions,
-// though only WithTX is currently supported.
+// out of sync with the updates. Updates that break the validation rule of their
+// resource type are flagged for review and applied, rejected with a
+// *errors.UsageRejectedError, which callers have to record themselves since the
+// transaction is rolled back, or held for review with a
+// *errors.UsageQuarantinedError, in which case the transaction should be
+// committed. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
 func (d *Database) CalculateUsage(ctx context.Context, updateType string, usage *Usage, opts ...QueryOption) error {
-	var (
-		err           error
-		newUsageValue float64
-	)
-
-	currentUsageValue, doUpdate, err := d.GetCurrentUsage(ctx, usage.ResourceType.ID, usage.SubscriptionID, opts...)
-	if err != nil {
+	if err := d.checkUsageRule(ctx, updateType, usage, opts...); err != nil {
 		return err
 	}
-	log.Debugf("the current usage value is %f", currentUsageValue)
 
-	switch updateType {
-	case UpdateTypeSet:
-		newUsageValue = usage.Usage
-	case UpdateTypeAdd:
-		newUsageValue = currentUsageValue + usage.Usage
-	default:
-		return fmt.Errorf("invalid update type: %s", updateType)
+	newUsageValue, _, err := d.ApplyUsage(ctx, updateType, usage.Usage, usage.ResourceType.ID, usage.SubscriptionID, opts...)
+	if err != nil {
+		return err
 	}
+	log.Debugf("the new usage value is %f", newUsageValue)
 
 	usage.Usage = newUsageValue
 
-	if err = d.UpsertUsage(ctx, doUpdate, newUsageValue, usage.ResourceType.ID, usage.SubscriptionID, opts...); err != nil {
-		return err
-	}
-
 	return nil
 }
@@ -0,0 +1,156 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/doug-martin/goqu/v9"
+)
+
+// concurrentUpdates is the number of usage updates applied at the same time.
+const concurrentUpdates = 25
+
+// applyConcurrently calls fn from concurrentUpdates goroutines at once and
+// fails the test if any of the calls fail.
+func applyConcurrently(t *testing.T, fn func(ctx context.Context) error) {
+	t.Helper()
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		errs  = make(chan error, concurrentUpdates)
+	)
+	for i := 0; i < concurrentUpdates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			errs <- fn(context.Background())
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unable to apply a usage update: %s", err)
+		}
+	}
+}
+
+// currentUsage returns the usage of the resource type in the subscription.
+func currentUsage(t *testing.T, resourceTypeID, subscriptionID string) float64 {
+	t.Helper()
+
+	usage, found, err := testDB.GetCurrentUsage(context.Background(), resourceTypeID, subscriptionID)
+	if err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	}
+	if !found {
+		t.Fatal("the usage wasn't recorded")
+	}
+	return usage
+}
+
+func TestApplyUsageConcurrentAdds(t *testing.T) {
+	t.Parallel()
+
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+
+	// None of the updates find an existing usage, so they all race to insert
+	// it. The upsert has to turn all but one of the inserts into additions.
+	applyConcurrently(t, func(ctx context.Context) error {
+		_, _, err := testDB.ApplyUsage(ctx, UpdateTypeAdd, 1.5, compute.ID, subscription.ID)
+		return err
+	})
+
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != concurrentUpdates*1.5 {
+		t.Errorf("expected a usage of %g, got %g", concurrentUpdates*1.5, usage)
+	}
+
+	// Updates that find the existing usage are added to it as well.
+	applyConcurrently(t, func(ctx context.Context) error {
+		_, _, err := testDB.ApplyUsage(ctx, UpdateTypeAdd, 2, compute.ID, subscription.ID)
+		return err
+	})
+
+	if usage := currentUsage(t, compute.ID, subscription.ID); usage != concurrentUpdates*3.5 {
+		t.Errorf("expected a usage of %g, got %g", concurrentUpdates*3.5, usage)
+	}
+}
+
+func TestApplyUsageSet(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+
+	for _, value := range []float64{10, 4} {
+		usage, _, err := testDB.ApplyUsage(ctx, UpdateTypeSet, value, storage.ID, subscription.ID)
+		if err != nil {
+			t.Fatalf("unable to set the usage: %s", err)
+		}
+		if usage != value {
+			t.Errorf("expected a usage of %g, got %g", value, usage)
+		}
+	}
+}
+
+func TestApplyUsageInvalidUpdateType(t *testing.T) {
+	t.Parallel()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+
+	if _, _, err := testDB.ApplyUsage(context.Background(), "MULTIPLY", 2, storage.ID, subscription.ID); err == nil {
+		t.Fatal("expected an invalid update type to be refused")
+	}
+	if count := countRows(t, "usages", goqu.Ex{"subscription_id": subscription.ID}); count != 0 {
+		t.Errorf("expected no usages to be recorded, found %d", count)
+	}
+}
+
+func TestGetCurrentUsageNotFound(t *testing.T) {
+	t.Parallel()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+
+	usage, found, err := testDB.GetCurrentUsage(context.Background(), storage.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	}
+	if found {
+		t.Errorf("expected no usage to be found, got %g", usage)
+	}
+}
+
+func TestCalculateUsage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t)
+
+	usage := &Usage{Usage: 7, SubscriptionID: subscription.ID, ResourceType: storage}
+	if err := testDB.CalculateUsage(ctx, UpdateTypeSet, usage); err != nil {
+		t.Fatalf("unable to set the usage: %s", err)
+	}
+
+	usage.Usage = 3
+	if err := testDB.CalculateUsage(ctx, UpdateTypeAdd, usage); err != nil {
+		t.Fatalf("unable to add to the usage: %s", err)
+	}
+	if usage.Usage != 10 {
+		t.Errorf("expected the new usage to be returned, got %g", usage.Usage)
+	}
+	if actual := currentUsage(t, storage.ID, subscription.ID); actual != 10 {
+		t.Errorf("expected a usage of 10, got %g", actual)
+	}
+}
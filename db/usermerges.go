@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// UserMerge records a merge of one user record into another.
+type UserMerge struct {
+	ID                  string         `db:"id" goqu:"defaultifempty"`
+	SourceUserID        string         `db:"source_user_id"`
+	SourceUsername      string         `db:"source_username"`
+	TargetUserID        string         `db:"target_user_id"`
+	TargetUsername      string         `db:"target_username"`
+	Policy              string         `db:"policy"`
+	EndedSubscriptionID sql.NullString `db:"ended_subscription_id"`
+	MovedSubscriptions  int            `db:"moved_subscriptions"`
+	MovedUpdates        int            `db:"moved_updates"`
+	MergedBy            string         `db:"merged_by"`
+	MergedAt            time.Time      `db:"merged_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the user merge to the type used in responses.
+func (m *UserMerge) ToAPIType() *api.UserMerge {
+	return &api.UserMerge{
+		ID:                  m.ID,
+		SourceUserID:        m.SourceUserID,
+		SourceUsername:      m.SourceUsername,
+		TargetUserID:        m.TargetUserID,
+		TargetUsername:      m.TargetUsername,
+		Policy:              m.Policy,
+		EndedSubscriptionID: m.EndedSubscriptionID.String,
+		MovedSubscriptions:  m.MovedSubscriptions,
+		MovedUpdates:        m.MovedUpdates,
+		MergedBy:            m.MergedBy,
+		MergedAt:            m.MergedAt,
+	}
+}
+
+// LockUser returns the user with the given username and locks the user's row
+// for the rest of the transaction. Returns nil if the user doesn't exist. Only
+// WithTX is currently supported, and a transaction is required for the lock to
+// be useful.
+func (d *Database) LockUser(ctx context.Context, username string, opts ...QueryOption) (*User, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.From(t.Users).
+		Select(t.Users.Col("id"), t.Users.Col("username")).
+		Where(t.Users.Col("username").Eq(username), querySettings.tenantExp(t.Users)).
+		ForUpdate(exp.Wait)
+	d.LogSQL(ds)
+
+	var user User
+	found, err := ds.Executor().ScanStructContext(ctx, &user)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to lock user %s", username)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &user, nil
+}
+
+// reassignUserID moves the rows in a table that refer to the source user to
+// the target user and returns the number of rows that were moved.
+func (d *Database) reassignUserID(
+	ctx context.Context, db GoquDatabase, table exp.IdentifierExpression, sourceID, targetID string, where ...exp.Expression,
+) (int, error) {
+	ds := db.Update(table).
+		Set(goqu.Record{"user_id": targetID}).
+		Where(append(where, table.Col("user_id").Eq(sourceID))...)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to reassign the %s of user %s", table.GetTable(), sourceID)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return int(rowsAffected), nil
+}
+
+// MergeUserRecords moves the subscriptions, updates and trials of the source
+// user to the target user, then deletes the source user. Archived updates are
+// moved and counted along with the others. Usages, quotas and add-ons belong to
+// subscriptions, so they move along with them. The usage rollups of the target
+// user are rebuilt to include the updates that moved. A trial of the source
+// user is dropped if the target user already had a trial of the same plan.
+// Credit balances are added to those of the target user. The number of
+// subscriptions and updates that were moved are recorded in the merge. Only
+// WithTX is currently supported, and a transaction is required to keep a
+// failure from leaving the users partially merged.
+func (d *Database) MergeUserRecords(ctx context.Context, merge *UserMerge, opts ...QueryOption) error {
+	var err error
+
+	querySettings, db := d.querySettings(opts...)
+
+	sourceID, targetID := merge.SourceUserID, merge.TargetUserID
+
+	// Users can only be merged within a tenant.
+	for _, userID := range []string{sourceID, targetID} {
+		if err = d.checkUserTenant(ctx, db, querySettings, userID); err != nil {
+			return err
+		}
+	}
+
+	if merge.MovedSubscriptions, err = d.reassignUserID(ctx, db, t.Subscriptions, sourceID, targetID); err != nil {
+		return err
+	}
+	if merge.MovedUpdates, err = d.reassignUserID(ctx, db, t.Updates, sourceID, targetID); err != nil {
+		return err
+	}
+	movedArchived, err := d.reassignUserID(ctx, db, t.ArchivedUpdates, sourceID, targetID)
+	if err != nil {
+		return err
+	}
+	merge.MovedUpdates += movedArchived
+
+	// The rollups of the source user are deleted along with the user.
+	if err = d.RebuildUsageRollupsForUser(ctx, targetID, opts...); err != nil {
+		return err
+	}
+
+	targetTrials := db.From(t.Trials.As("target")).
+		Select(goqu.L("1")).
+		Where(
+			goqu.T("target").Col("user_id").Eq(targetID),
+			goqu.T("target").Col("plan_id").Eq(t.Trials.Col("plan_id")),
+		)
+	if _, err = d.reassignUserID(ctx, db, t.Trials, sourceID, targetID, goqu.L("NOT EXISTS ?", targetTrials)); err != nil {
+		return err
+	}
+
+	if err = d.mergeCredits(ctx, db, sourceID, targetID); err != nil {
+		return err
+	}
+
+	ds := db.From(t.Users).Delete().Where(t.Users.Col("id").Eq(sourceID), querySettings.tenantExp(t.Users))
+	d.LogSQL(ds)
+
+	if _, err = ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to delete user %s", merge.SourceUsername)
+	}
+
+	return nil
+}
+
+// AddUserMerge records a user merge in the audit log and returns its ID.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) AddUserMerge(ctx context.Context, merge *UserMerge, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	if err := d.checkUserTenant(ctx, db, querySettings, merge.TargetUserID); err != nil {
+		return "", err
+	}
+
+	ds := db.Insert(t.UserMerges).
+		Rows(goqu.Record{
+			"source_user_id":        merge.SourceUserID,
+			"source_username":       merge.SourceUsername,
+			"target_user_id":        merge.TargetUserID,
+			"target_username":       merge.TargetUsername,
+			"policy":                merge.Policy,
+			"ended_subscription_id": merge.EndedSubscriptionID,
+			"moved_subscriptions":   merge.MovedSubscriptions,
+			"moved_updates":         merge.MovedUpdates,
+			"merged_by":             merge.MergedBy,
+		}).
+		Returning(t.UserMerges.Col("id"), t.UserMerges.Col("merged_at"))
+	d.LogSQL(ds)
+
+	var result struct {
+		ID       string    `db:"id"`
+		MergedAt time.Time `db:"merged_at"`
+	}
+	if _, err := ds.Executor().ScanStructContext(ctx, &result); err != nil {
+		return "", errors.Wrap(err, "unable to record the user merge")
+	}
+	merge.ID = result.ID
+	merge.MergedAt = result.MergedAt
+
+	return result.ID, nil
+}
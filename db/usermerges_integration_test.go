@@ -0,0 +1,129 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// addTestTrialRecord records a trial of the plan for the user without a
+// subscription.
+func addTestTrialRecord(t *testing.T, user *User, plan *Plan) {
+	t.Helper()
+
+	now := time.Now()
+	_, err := testDB.AddTrial(context.Background(), &Trial{
+		UserID:    user.ID,
+		PlanID:    plan.ID,
+		StartedAt: now,
+		EndsAt:    now.AddDate(0, 0, 7),
+	})
+	if err != nil {
+		t.Fatalf("unable to record the trial: %s", err)
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		locked, err := testDB.LockUser(ctx, user.Username, WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if locked == nil || locked.ID != user.ID {
+			t.Errorf("expected user %s to be locked, got %+v", user.ID, locked)
+		}
+
+		missing, err := testDB.LockUser(ctx, uniqueName("missing"), WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if missing != nil {
+			t.Errorf("expected no user, got %+v", missing)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to lock the user: %s", err)
+	}
+}
+
+func TestMergeUserRecords(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	shared, other := addTestPlan(t), addTestPlan(t)
+	source, target := addTestUser(t), addTestUser(t)
+
+	subscription := subscribeTestUser(t, source, shared, nil)
+	effectiveDate := time.Date(2001, time.May, 1, 12, 0, 0, 0, time.UTC)
+	addTestUsageUpdates(t, source, compute, UpdateTypeAdd, 2, effectiveDate, effectiveDate)
+
+	// The target already had a trial of the shared plan, so only the trial of
+	// the other plan moves.
+	addTestTrialRecord(t, source, shared)
+	addTestTrialRecord(t, source, other)
+	addTestTrialRecord(t, target, shared)
+
+	merge := &UserMerge{
+		SourceUserID:   source.ID,
+		SourceUsername: source.Username,
+		TargetUserID:   target.ID,
+		TargetUsername: target.Username,
+		Policy:         api.MergePolicyKeepTarget,
+		MergedBy:       "test",
+	}
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		if err := testDB.MergeUserRecords(ctx, merge, WithTX(tx)); err != nil {
+			return err
+		}
+		_, err := testDB.AddUserMerge(ctx, merge, WithTX(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to merge the users: %s", err)
+	}
+
+	if merge.MovedSubscriptions != 1 || merge.MovedUpdates != 2 {
+		t.Errorf("expected 1 subscription and 2 updates to move, got %+v", merge)
+	}
+	if merge.ID == "" || merge.MergedAt.IsZero() {
+		t.Errorf("expected the merge to be recorded, got %+v", merge)
+	}
+
+	user, err := testDB.GetUserByUsername(ctx, source.Username)
+	if err != nil {
+		t.Fatalf("unable to look up the source user: %s", err)
+	}
+	if user != nil {
+		t.Error("expected the source user to be deleted")
+	}
+
+	if count := countRows(t, "subscriptions", goqu.Ex{"id": subscription.ID, "user_id": target.ID}); count != 1 {
+		t.Error("expected the subscription to move to the target user")
+	}
+	if count := countRows(t, "trials", goqu.Ex{"user_id": target.ID}); count != 2 {
+		t.Errorf("expected the target user to have 2 trials, got %d", count)
+	}
+
+	// The rollups of the target user include the updates that moved.
+	rollups, err := testDB.UserUsageRollups(
+		ctx, target.Username, compute.ID, api.RollupDaily, effectiveDate.AddDate(0, 0, -1), effectiveDate.AddDate(0, 0, 1),
+	)
+	if err != nil {
+		t.Fatalf("unable to list the rollups: %s", err)
+	}
+	if len(rollups) != 1 || rollups[0].Consumed != 4 || rollups[0].UpdateCount != 2 {
+		t.Errorf("expected a daily rollup of 4 from 2 updates, got %+v", rollups)
+	}
+}
@@ -6,25 +6,46 @@ import (
 	"time"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
 )
 
-// SubscriptionOptions contains options for a new subscription.
+// SubscriptionOptions contains options for a new subscription. If the end date
+// is zero, the subscription ends after the given number of periods. The length
+// of each period is the plan's subscription period unless Period is set. A
+// perpetual subscription doesn't have an end date at all, which is meant for
+// service accounts that should never lose their subscriptions.
 type SubscriptionOptions struct {
-	Paid    bool
-	Periods int32
-	EndDate time.Time
+	Paid      bool
+	Periods   int32
+	EndDate   time.Time
+	Period    *SubscriptionPeriod
+	Perpetual bool
 }
 
-// DefaultSubscriptionOptions returns the default subscription options.
+// DefaultSubscriptionOptions returns the default subscription options, which
+// describe a subscription that lasts for a single period of the plan.
 func DefaultSubscriptionOptions() *SubscriptionOptions {
 	return &SubscriptionOptions{
 		Paid:    false,
 		Periods: 1,
-		EndDate: time.Now().AddDate(1, 0, 0),
 	}
 }
 
+// noEndDate is the end date reported for perpetual subscriptions, whose end
+// dates are NULL in the database. It's the zero time, which is what the code
+// that reads end dates already treats as a subscription that never ends.
+var noEndDate = goqu.L("'0001-01-01 00:00:00+00'::timestamptz")
+
+// endDateExp returns the effective end date of the subscriptions in a table,
+// or the zero time for perpetual subscriptions, so that it can be scanned into
+// a time.Time.
+func endDateExp(table exp.IdentifierExpression) exp.SQLFunctionExpression {
+	return goqu.COALESCE(table.Col("effective_end_date"), noEndDate)
+}
+
 // subscriptionDS returns the goqu.SelectDataset for getting user plan info, but with
 // out the goqu.Where() calls.
 func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
@@ -32,7 +53,7 @@ func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
 		Select(
 			t.Subscriptions.Col("id").As("id"),
 			t.Subscriptions.Col("effective_start_date").As("effective_start_date"),
-			t.Subscriptions.Col("effective_end_date").As("effective_end_date"),
+			endDateExp(t.Subscriptions).As("effective_end_date"),
 			t.Subscriptions.Col("created_by").As("created_by"),
 			t.Subscriptions.Col("created_at").As("created_at"),
 			t.Subscriptions.Col("last_modified_by").As("last_modified_by"),
@@ -55,13 +76,77 @@ func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
 		Join(t.PlanRates, goqu.On(t.Subscriptions.Col("plan_rate_id").Eq(t.PlanRates.Col("id"))))
 }
 
+// The states that a subscription can be in.
+const (
+	SubscriptionStateActive  = "active"
+	SubscriptionStateGrace   = "grace"
+	SubscriptionStateExpired = "expired"
+)
+
+// Perpetual returns true if the subscription doesn't have an end date.
+func (s *Subscription) Perpetual() bool {
+	return s.EffectiveEndDate.IsZero()
+}
+
+// StateAt returns the state of the subscription at the given time. A
+// subscription that has ended is in its grace period until the grace period has
+// passed, after which it's expired.
+func (s *Subscription) StateAt(asOf time.Time, gracePeriod time.Duration) string {
+	switch {
+	case s.EffectiveEndDate.IsZero() || !asOf.After(s.EffectiveEndDate):
+		return SubscriptionStateActive
+	case gracePeriod > 0 && !asOf.After(s.EffectiveEndDate.Add(gracePeriod)):
+		return SubscriptionStateGrace
+	default:
+		return SubscriptionStateExpired
+	}
+}
+
+// subscriptionPeriodExp returns the expression used to select subscriptions by
+// their effective dates. By default, this matches subscriptions that are active
+// right now. The WithEffectiveDate option changes the time that is checked, the
+// WithGracePeriod option extends the end of each subscription by the grace
+// period, and the WithIncludeExpired option also matches subscriptions that
+// ended before that time.
+func subscriptionPeriodExp(querySettings *QuerySettings) goqu.Expression {
+	asOf := CurrentTimestamp
+	if querySettings.hasEffectiveDate {
+		asOf = goqu.V(querySettings.effectiveDate)
+	}
+
+	effStartDate := t.Subscriptions.Col("effective_start_date")
+	effEndDate := t.Subscriptions.Col("effective_end_date")
+
+	if querySettings.includeExpired {
+		return effStartDate.Lte(asOf)
+	}
+
+	// A subscription is active if the end date is on or after the cutoff, which
+	// is the effective date minus the grace period.
+	cutoff := asOf
+	if querySettings.gracePeriod > 0 {
+		interval := fmt.Sprintf("%d seconds", int64(querySettings.gracePeriod.Seconds()))
+		cutoff = goqu.L("? - ?::interval", asOf, interval)
+	}
+
+	return goqu.Or(
+		goqu.And(effStartDate.Lte(asOf), effEndDate.Gte(cutoff)),
+		goqu.And(asOf.Gt(effStartDate), effEndDate.IsNull()),
+	)
+}
+
+// GetSubscriptionByID returns the subscription with the given ID, or nil if it
+// doesn't exist. Accepts a variable number of QueryOptions, though only WithTX,
+// WithReadReplica and WithForUpdate are currently supported.
 func (d *Database) GetSubscriptionByID(ctx context.Context, subscriptionID string, opts ...QueryOption) (*Subscription, error) {
-	_, db := d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ds := subscriptionDS(db).
 		Where(
 			t.Subscriptions.Col("id").Eq(subscriptionID),
+			querySettings.tenantExp(t.Subscriptions),
 		)
+	ds = querySettings.lockRows(ds, t.Subscriptions)
 	d.LogSQL(ds)
 
 	var result Subscription
@@ -77,49 +162,165 @@ func (d *Database) GetSubscriptionByID(ctx context.Context, subscriptionID strin
 }
 
 // GetActiveSubscription returns the active user plan for the username passed in.
-// Accepts a variable number of QueryOptions, but only WithTX is currently
-// supported.
+// Accepts a variable number of QueryOptions, but only WithTX, WithIncludeExpired,
+// WithEffectiveDate, WithGracePeriod, WithGroupSubscriptions and WithForUpdate
+// are currently supported. If WithIncludeExpired is used, the most recent subscription that
+// started on or before the effective date is returned, even if it has ended. If
+// WithGroupSubscriptions is used and the user doesn't have a subscription, the
+// subscription of a group that the user belongs to is returned instead.
+// ErrSubscriptionNotFound is returned if no subscription is found.
 func (d *Database) GetActiveSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
-	var (
-		err    error
-		result Subscription
-		db     GoquDatabase
-	)
-
-	_, db = d.querySettings(opts...)
+	var result Subscription
 
-	effStartDate := goqu.I("subscriptions.effective_start_date")
-	effEndDate := goqu.I("subscriptions.effective_end_date")
-	currTS := goqu.L("CURRENT_TIMESTAMP")
+	querySettings, db := d.querySettings(opts...)
 
 	query := subscriptionDS(db).
 		Where(
 			t.Users.Col("username").Eq(username),
-			goqu.Or(
-				currTS.Between(goqu.Range(effStartDate, effEndDate)),
-				goqu.And(currTS.Gt(effStartDate), effEndDate.Is(nil)),
-			),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
 		).
-		Order(effStartDate.Desc()).
+		Order(t.Subscriptions.Col("effective_start_date").Desc()).
 		Limit(1)
+	query = querySettings.lockRows(query, t.Subscriptions)
 	d.LogSQL(query)
 
-	if _, err = query.Executor().ScanStructContext(ctx, &result); err != nil {
+	found, err := query.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
 		return nil, err
 	}
 
+	if !found && querySettings.groups {
+		return d.groupSubscription(ctx, db, username, querySettings)
+	}
+	if !found {
+		return nil, suberrors.ErrSubscriptionNotFound
+	}
+
 	log.Debugf("%+v", result)
 
 	return &result, nil
 }
 
+// groupSubscription returns the active subscription of a group that the user
+// belongs to. If the user belongs to more than one group with an active
+// subscription, the most recent subscription is used. ErrSubscriptionNotFound
+// is returned if none of the user's groups has an active subscription.
+func (d *Database) groupSubscription(
+	ctx context.Context, db GoquDatabase, username string, querySettings *QuerySettings,
+) (*Subscription, error) {
+	members := t.Users.As("members")
+
+	query := subscriptionDS(db).
+		Join(t.Groups, goqu.On(t.Groups.Col("user_id").Eq(t.Subscriptions.Col("user_id")))).
+		Join(t.GroupMembers, goqu.On(t.GroupMembers.Col("group_id").Eq(t.Groups.Col("id")))).
+		Join(members, goqu.On(t.GroupMembers.Col("user_id").Eq(members.Col("id")))).
+		Where(
+			members.Col("username").Eq(username),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Desc(), t.Groups.Col("name").Asc()).
+		Limit(1)
+	query = querySettings.lockRows(query, t.Subscriptions)
+	d.LogSQL(query)
+
+	var result Subscription
+	found, err := query.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the group subscription for %s", username)
+	}
+	if !found {
+		return nil, suberrors.ErrSubscriptionNotFound
+	}
+
+	return &result, nil
+}
+
+// SubscribeToDefaultPlan subscribes the user to the default plan, adding the
+// user first if necessary, and returns the new subscription. Accepts a variable
+// number of QueryOptions, though only WithTX and WithDefaultPlan are currently
+// supported.
+func (d *Database) SubscribeToDefaultPlan(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
+	var subscription *Subscription
+
+	querySettings, _ := d.querySettings(opts...)
+	planName := querySettings.defaultPlanName()
+
+	err := d.inTxWithOpts(ctx, func(tx *goqu.TxDatabase) error {
+		user, err := d.EnsureUser(ctx, username, WithTX(tx))
+		if err != nil {
+			return errors.Wrapf(err, "unable to ensure that user %s exists", username)
+		}
+
+		plan, err := d.GetPlanByName(ctx, planName, WithTX(tx))
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up the default plan %s", planName)
+		}
+		if plan == nil {
+			log.Errorf("the default plan %s doesn't exist", planName)
+			return suberrors.ErrPlanNotFound
+		}
+
+		subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, DefaultSubscriptionOptions(), WithTX(tx))
+		if err != nil {
+			return errors.Wrapf(err, "unable to subscribe user %s to the default plan", username)
+		}
+
+		subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, WithTX(tx))
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up the new subscription for user %s", username)
+		}
+		if subscription == nil {
+			return fmt.Errorf("the new subscription for user %s could not be found", username)
+		}
+
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// subscriptionQuotaRecords returns the records to insert into the quotas table
+// for a new subscription, based on the plan's active quota defaults. The quotas
+// of consumable resource types are allowances for each period, so they're
+// multiplied by the number of periods. Other quotas are limits on what can be
+// used at any one time, so they aren't.
+func subscriptionQuotaRecords(subscriptionID string, plan *Plan, subscriptionOpts *SubscriptionOptions) []goqu.Record {
+	quotaDefaults := plan.GetActiveQuotaDefaults()
+	records := make([]goqu.Record, 0, len(quotaDefaults))
+	for _, quotaDefault := range quotaDefaults {
+		quotaValue := quotaDefault.QuotaValue
+		if quotaDefault.ResourceType.Consumable {
+			quotaValue *= float64(subscriptionOpts.Periods)
+		}
+		records = append(records, goqu.Record{
+			"resource_type_id": quotaDefault.ResourceType.ID,
+			"subscription_id":  subscriptionID,
+			"quota":            quotaValue,
+			"created_by":       "de",
+			"last_modified_by": "de",
+		})
+	}
+	return records
+}
+
+// SetActiveSubscription creates a new subscription to a plan for a user, along
+// with the quotas from the plan's active quota defaults. The subscription ends
+// after the number of periods in the subscription options unless they include
+// an end date. The subscription and its quotas are inserted atomically: if the
+// caller passes a transaction using WithTX, everything is inserted inside of
+// that transaction. Otherwise, a new transaction is created and retried if it
+// fails because of a serialization failure or a deadlock.
 func (d *Database) SetActiveSubscription(
 	ctx context.Context, userID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
 ) (string, error) {
-	_, db := d.querySettings(opts...)
-
-	n := time.Now()
-	e := subscriptionOpts.EndDate
+	if subscriptionOpts == nil {
+		subscriptionOpts = DefaultSubscriptionOptions()
+	}
 
 	// Get the active plan rate.
 	activePlanRate := plan.GetActiveRate()
@@ -127,77 +328,88 @@ func (d *Database) SetActiveSubscription(
 		return "", fmt.Errorf("the %s subscription plan has no effective rate", plan.Name)
 	}
 
-	query := db.Insert(t.Subscriptions).
-		Rows(
-			goqu.Record{
-				"effective_start_date": n,
-				"effective_end_date":   e,
-				"user_id":              userID,
-				"plan_id":              plan.ID,
-				"created_by":           "de",
-				"last_modified_by":     "de",
-				"paid":                 subscriptionOpts.Paid,
-				"plan_rate_id":         activePlanRate.ID,
-			},
-		).
-		Returning(t.Subscriptions.Col("id"))
-	d.LogSQL(query)
+	querySettings, _ := d.querySettings(opts...)
 
 	var subscriptionID string
-	if _, err := query.Executor().ScanValContext(ctx, &subscriptionID); err != nil {
-		return "", err
-	}
+	err := d.inTxWithOpts(ctx, func(tx *goqu.TxDatabase) error {
+		if err := d.checkUserTenant(ctx, tx, querySettings, userID); err != nil {
+			return err
+		}
 
-	// Add the quota defaults as the t.Quotas for the user plan.
-	for _, quotaDefault := range plan.GetActiveQuotaDefaults() {
-		quotaValue := quotaDefault.QuotaValue * float64(subscriptionOpts.Periods)
-		if quotaDefault.ResourceType.Consumable {
-			quotaValue *= float64(subscriptionOpts.Periods)
+		n := time.Now()
+		var e any
+		switch {
+		case subscriptionOpts.Perpetual:
+			// Perpetual subscriptions are stored without an end date.
+		case !subscriptionOpts.EndDate.IsZero():
+			e = subscriptionOpts.EndDate
+		default:
+			period := subscriptionOpts.Period
+			if period == nil {
+				var err error
+				if period, err = d.GetPlanPeriod(ctx, plan.ID, WithTX(tx)); err != nil {
+					return err
+				}
+			}
+			e = period.EndDate(n, subscriptionOpts.Periods)
 		}
-		ds := db.Insert(t.Quotas).
-			Cols(
-				"resource_type_id",
-				"subscription_id",
-				"quota",
-				"created_by",
-				"last_modified_by",
-			).Rows(
-			goqu.Record{
-				"resource_type_id": quotaDefault.ResourceType.ID,
-				"subscription_id":  subscriptionID,
-				"quota":            quotaValue,
-				"created_by":       goqu.V("de"),
-				"last_modified_by": goqu.V("de"),
-			},
-		)
+
+		query := tx.Insert(t.Subscriptions).
+			Rows(
+				querySettings.tenantRecord(goqu.Record{
+					"effective_start_date": n,
+					"effective_end_date":   e,
+					"user_id":              userID,
+					"plan_id":              plan.ID,
+					"created_by":           "de",
+					"last_modified_by":     "de",
+					"paid":                 subscriptionOpts.Paid,
+					"plan_rate_id":         activePlanRate.ID,
+				}),
+			).
+			Returning(t.Subscriptions.Col("id"))
+		d.LogSQL(query)
+
+		if _, err := query.Executor().ScanValContext(ctx, &subscriptionID); err != nil {
+			return errors.Wrapf(err, "unable to add a %s subscription for user ID %s", plan.Name, userID)
+		}
+
+		// Add the quota defaults as the quotas for the subscription. All of the
+		// quotas are inserted in a single statement so that the insert either
+		// succeeds or fails as a whole.
+		quotaRecords := subscriptionQuotaRecords(subscriptionID, plan, subscriptionOpts)
+		if len(quotaRecords) == 0 {
+			return nil
+		}
+		ds := tx.Insert(t.Quotas).Rows(quotaRecords)
 		d.LogSQL(ds)
-		if _, err := ds.Executor().Exec(); err != nil {
-			return subscriptionID, err
+		if _, err := ds.Executor().ExecContext(ctx); err != nil {
+			return errors.Wrapf(err, "unable to add the quotas for subscription %s", subscriptionID)
 		}
+
+		return nil
+	}, opts...)
+	if err != nil {
+		return "", err
 	}
 
 	return subscriptionID, nil
 }
 
+// UserHasActivePlan determines whether or not a user has an active subscription.
+// Accepts a variable number of QueryOptions, but only WithTX, WithIncludeExpired
+// and WithEffectiveDate are currently supported.
 func (d *Database) UserHasActivePlan(ctx context.Context, username string, opts ...QueryOption) (bool, error) {
-	var (
-		err error
-		db  GoquDatabase
-	)
-
-	_, db = d.querySettings(opts...)
+	var err error
 
-	effStartDate := goqu.I("subscriptions.effective_start_date")
-	effEndDate := goqu.I("subscriptions.effective_end_date")
+	querySettings, db := d.querySettings(opts...)
 
 	statement := db.From(t.Subscriptions).
 		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
 		Where(
 			t.Users.Col("username").Eq(username),
-			goqu.Or(
-				CurrentTimestamp.Between(goqu.Range(effStartDate, effEndDate)),
-				goqu.And(CurrentTimestamp.Gt(effStartDate), effEndDate.Is(nil)),
-			),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
 		)
 	d.LogSQL(statement)
 
@@ -209,13 +421,13 @@ func (d *Database) UserHasActivePlan(ctx context.Context, username string, opts
 	return numPlans > 0, nil
 }
 
+// UserOnPlan determines whether or not a user has an active subscription to the
+// named plan. Accepts a variable number of QueryOptions, but only WithTX,
+// WithIncludeExpired and WithEffectiveDate are currently supported.
 func (d *Database) UserOnPlan(ctx context.Context, username, planName string, opts ...QueryOption) (bool, error) {
 	var err error
 
-	_, db := d.querySettings(opts...)
-
-	effStartDate := goqu.I("subscriptions.effective_start_date")
-	effEndDate := goqu.I("subscriptions.effective_end_date")
+	querySettings, db := d.querySettings(opts...)
 
 	statement := db.From(t.Subscriptions).
 		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
@@ -223,10 +435,8 @@ func (d *Database) UserOnPlan(ctx context.Context, username, planName string, op
 		Where(
 			t.Users.Col("username").Eq(username),
 			t.Plans.Col("name").Eq(planName),
-			goqu.Or(
-				CurrentTimestamp.Between(goqu.Range(effStartDate, effEndDate)),
-				goqu.And(CurrentTimestamp.Gt(effStartDate), effEndDate.Is(nil)),
-			),
+			subscriptionPeriodExp(querySettings),
+			querySettings.tenantExp(t.Subscriptions),
 		)
 	d.LogSQL(statement)
 
@@ -238,19 +448,67 @@ func (d *Database) UserOnPlan(ctx context.Context, username, planName string, op
 	return numPlans > 0, nil
 }
 
-// SubscriptionUsages returns a list of Usages associated with a user plan specified
-// by the passed in UUID. Accepts a variable number of QueryOptions, though only
-// WithTX is currently supported.
-func (d *Database) SubscriptionUsages(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Usage, error) {
-	var (
-		err    error
-		db     GoquDatabase
-		usages []Usage
-	)
+// ExpiringSubscriptions returns the current subscriptions to the named plan
+// that end before the given time, in order by username. Subscriptions that have
+// been superseded by a newer subscription for the same user aren't included,
+// so users who have already been renewed aren't listed again. Accepts a
+// variable number of QueryOptions, though only WithTX, WithReadReplica and
+// WithEffectiveDate are currently supported.
+func (d *Database) ExpiringSubscriptions(
+	ctx context.Context, planName string, before time.Time, opts ...QueryOption,
+) ([]Subscription, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	newer := t.Subscriptions.As("newer")
+	superseded := db.From(newer).
+		Select(goqu.L("1")).
+		Where(
+			newer.Col("user_id").Eq(t.Subscriptions.Col("user_id")),
+			newer.Col("effective_start_date").Gt(t.Subscriptions.Col("effective_start_date")),
+		)
+
+	ds := subscriptionDS(db).
+		Where(
+			t.Plans.Col("name").Eq(planName),
+			subscriptionPeriodExp(querySettings),
+			t.Subscriptions.Col("effective_end_date").Lt(before),
+			querySettings.tenantExp(t.Subscriptions),
+			goqu.L("NOT EXISTS ?", superseded),
+		).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(ds)
+
+	var subscriptions []Subscription
+	if err := ds.Executor().ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrap(err, "unable to list the expiring subscriptions")
+	}
+
+	return subscriptions, nil
+}
+
+// ListUserSubscriptions returns all of a user's subscriptions, past, current
+// and future, in order by start date. Accepts a variable number of
+// QueryOptions, though only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListUserSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := subscriptionDS(db).
+		Where(t.Users.Col("username").Eq(username), querySettings.tenantExp(t.Subscriptions)).
+		Order(t.Subscriptions.Col("effective_start_date").Asc(), t.Subscriptions.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var subscriptions []Subscription
+	if err := ds.Executor().ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions for %s", username)
+	}
 
-	_, db = d.querySettings(opts...)
+	return subscriptions, nil
+}
 
-	usagesQuery := db.From(t.Usages).
+// usagesDS returns the dataset used to look up usages along with their resource
+// types.
+func usagesDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Usages).
 		Select(
 			t.Usages.Col("id").As("id"),
 			t.Usages.Col("usage").As("usage"),
@@ -264,8 +522,58 @@ func (d *Database) SubscriptionUsages(ctx context.Context, subscriptionID string
 			t.RT.Col("unit").As(goqu.C("resource_types.unit")),
 			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
 		).
-		Join(t.RT, goqu.On(goqu.I("usages.resource_type_id").Eq(goqu.I("resource_types.id")))).
-		Where(t.Usages.Col("subscription_id").Eq(subscriptionID))
+		Join(t.RT, goqu.On(goqu.I("usages.resource_type_id").Eq(goqu.I("resource_types.id"))))
+}
+
+// UsagesBySubscription returns the usages of each of the listed subscriptions,
+// keyed by subscription ID, in order by resource type name. Accepts a variable
+// number of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) UsagesBySubscription(
+	ctx context.Context, subscriptionIDs []string, opts ...QueryOption,
+) (map[string][]Usage, error) {
+	result := make(map[string][]Usage)
+	if len(subscriptionIDs) == 0 {
+		return result, nil
+	}
+
+	querySettings, db := d.querySettings(opts...)
+
+	ds := usagesDS(db).
+		Where(
+			t.Usages.Col("subscription_id").In(subscriptionIDs),
+			querySettings.subscriptionTenantExp(db, t.Usages.Col("subscription_id")),
+		).
+		Order(t.RT.Col("name").Asc())
+	d.LogSQL(ds)
+
+	var usages []Usage
+	if err := ds.Executor().ScanStructsContext(ctx, &usages); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the subscription usages")
+	}
+
+	for _, usage := range usages {
+		result[usage.SubscriptionID] = append(result[usage.SubscriptionID], usage)
+	}
+	return result, nil
+}
+
+// SubscriptionUsages returns a list of Usages associated with a user plan specified
+// by the passed in UUID. Accepts a variable number of QueryOptions, though only
+// WithTX is currently supported.
+func (d *Database) SubscriptionUsages(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Usage, error) {
+	var (
+		err    error
+		usages []Usage
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usagesQuery := usagesDS(db).
+		Where(
+			t.Usages.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.Usages.Col("subscription_id")),
+		)
 	d.LogSQL(usagesQuery)
 
 	if err = usagesQuery.Executor().ScanStructsContext(ctx, &usages); err != nil {
@@ -275,16 +583,42 @@ func (d *Database) SubscriptionUsages(ctx context.Context, subscriptionID string
 	return usages, nil
 }
 
+// GetUsage returns the usage record for the resource type and subscription, or
+// nil if there isn't one. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) GetUsage(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (*Usage, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	query := usagesDS(db).
+		Where(
+			t.Usages.Col("subscription_id").Eq(subscriptionID),
+			t.Usages.Col("resource_type_id").Eq(resourceTypeID),
+			querySettings.subscriptionTenantExp(db, t.Usages.Col("subscription_id")),
+		).
+		Limit(1)
+	d.LogSQL(query)
+
+	var usage Usage
+	found, err := query.Executor().ScanStructContext(ctx, &usage)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to look up the usage")
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &usage, nil
+}
+
 // SubscriptionPlanRates returns a list of rates assocaited with a user plan specified by the passed in UUID. Accepts a
 // variable number of QueryOptions, though only WithTX is currently supported.
 func (d *Database) SubscriptionPlanRates(ctx context.Context, planID string, opts ...QueryOption) ([]PlanRate, error) {
 	var (
 		err   error
-		db    GoquDatabase
 		rates []PlanRate
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ratesQuery := db.From(t.PlanRates).
 		Select(
@@ -293,7 +627,7 @@ func (d *Database) SubscriptionPlanRates(ctx context.Context, planID string, opt
 			t.PlanRates.Col("effective_date").As("effective_date"),
 			t.PlanRates.Col("rate").As("rate"),
 		).
-		Where(t.PlanRates.Col("plan_id").Eq(planID))
+		Where(t.PlanRates.Col("plan_id").Eq(planID), querySettings.planTenantExp(db, t.PlanRates.Col("plan_id")))
 	d.LogSQL(ratesQuery)
 
 	if err = ratesQuery.Executor().ScanStructsContext(ctx, &rates); err != nil {
@@ -303,16 +637,16 @@ func (d *Database) SubscriptionPlanRates(ctx context.Context, planID string, opt
 }
 
 // SubscriptionQuotas returns a list of t.Quotas associated with the user plan specified
-// by the UUID passed in. Accepts a variable number of QueryOptions, though only
-// WithTX is currently supported.
+// by the UUID passed in. Scheduled quota changes that have come due take
+// precedence over the values in the quotas table. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
 func (d *Database) SubscriptionQuotas(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Quota, error) {
 	var (
 		err    error
-		db     GoquDatabase
 		quotas []Quota
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	quotasQuery := db.From(t.Quotas).
 		Select(
@@ -328,13 +662,45 @@ func (d *Database) SubscriptionQuotas(ctx context.Context, subscriptionID string
 			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
 		).
 		Join(t.RT, goqu.On(goqu.I("quotas.resource_type_id").Eq(goqu.I("resource_types.id")))).
-		Where(t.Quotas.Col("subscription_id").Eq(subscriptionID))
+		Where(
+			t.Quotas.Col("subscription_id").Eq(subscriptionID),
+			querySettings.subscriptionTenantExp(db, t.Quotas.Col("subscription_id")),
+		)
 	d.LogSQL(quotasQuery)
 
 	if err = quotasQuery.Executor().ScanStructsContext(ctx, &quotas); err != nil {
 		return nil, err
 	}
 
+	changes, err := d.effectiveQuotaChanges(ctx, subscriptionID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, quota := range quotas {
+		change, ok := changes[quota.ResourceType.ID]
+		if !ok {
+			continue
+		}
+		quotas[i].Quota = change.Quota
+		quotas[i].LastModifiedBy = change.CreatedBy
+		quotas[i].LastModifiedAt = change.EffectiveDate
+		delete(changes, quota.ResourceType.ID)
+	}
+
+	// A quota change can also set the quota for a resource type that the
+	// subscription didn't have a quota for.
+	for _, change := range changes {
+		quotas = append(quotas, Quota{
+			Quota:          change.Quota,
+			ResourceType:   change.ResourceType,
+			CreatedBy:      change.CreatedBy,
+			CreatedAt:      change.CreatedAt,
+			LastModifiedBy: change.CreatedBy,
+			LastModifiedAt: change.EffectiveDate,
+		})
+	}
+
 	return quotas, nil
 }
 
@@ -344,11 +710,10 @@ func (d *Database) SubscriptionQuotas(ctx context.Context, subscriptionID string
 func (d *Database) SubscriptionQuotaDefaults(ctx context.Context, planID string, opts ...QueryOption) ([]PlanQuotaDefault, error) {
 	var (
 		err      error
-		db       GoquDatabase
 		defaults []PlanQuotaDefault
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	pqdQuery := db.From(t.PQD).
 		Select(
@@ -362,7 +727,7 @@ func (d *Database) SubscriptionQuotaDefaults(ctx context.Context, planID string,
 			t.RT.Col("consumable").As(goqu.C("resource_types.consumable")),
 		).
 		Join(t.RT, goqu.On(goqu.I("plan_quota_defaults.resource_type_id").Eq(goqu.I("resource_types.id")))).
-		Where(t.PQD.Col("plan_id").Eq(planID))
+		Where(t.PQD.Col("plan_id").Eq(planID), querySettings.planTenantExp(db, t.PQD.Col("plan_id")))
 	d.LogSQL(pqdQuery)
 
 	if err = pqdQuery.Executor().ScanStructsContext(ctx, &defaults); err != nil {
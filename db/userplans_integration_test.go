@@ -0,0 +1,471 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+)
+
+// subscriptionQuotaValues returns the quotas of the subscription by resource
+// type ID.
+func subscriptionQuotaValues(t *testing.T, subscriptionID string) map[string]float64 {
+	t.Helper()
+
+	quotas, err := testDB.SubscriptionQuotas(context.Background(), subscriptionID)
+	if err != nil {
+		t.Fatalf("unable to list the quotas for subscription %s: %s", subscriptionID, err)
+	}
+
+	values := make(map[string]float64, len(quotas))
+	for _, quota := range quotas {
+		values[quota.ResourceType.ID] = quota.Quota
+	}
+	return values
+}
+
+func TestSetActiveSubscriptionQuotas(t *testing.T) {
+	t.Parallel()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	plan := addTestPlan(t,
+		PlanQuotaDefault{ResourceType: storage, QuotaValue: 5},
+		PlanQuotaDefault{ResourceType: compute, QuotaValue: 100},
+	)
+
+	// The quotas of consumable resource types are multiplied by the number of
+	// periods, but the other quotas aren't.
+	tests := []struct {
+		name     string
+		periods  int32
+		expected map[string]float64
+	}{
+		{name: "one period", periods: 1, expected: map[string]float64{storage.ID: 5, compute.ID: 100}},
+		{name: "three periods", periods: 3, expected: map[string]float64{storage.ID: 5, compute.ID: 300}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := DefaultSubscriptionOptions()
+			opts.Periods = tc.periods
+			subscription := subscribeTestUser(t, addTestUser(t), plan, opts)
+
+			actual := subscriptionQuotaValues(t, subscription.ID)
+			if len(actual) != len(tc.expected) {
+				t.Fatalf("expected %d quotas, got %d", len(tc.expected), len(actual))
+			}
+			for resourceTypeID, expected := range tc.expected {
+				if actual[resourceTypeID] != expected {
+					t.Errorf("expected a quota of %g for %s, got %g", expected, resourceTypeID, actual[resourceTypeID])
+				}
+			}
+		})
+	}
+}
+
+func TestSetActiveSubscriptionRollback(t *testing.T) {
+	t.Parallel()
+
+	// The quota default refers to a resource type that doesn't exist, so the
+	// quotas can't be inserted after the subscription has been.
+	storage := addTestResourceType(t, false)
+	plan := addTestPlan(t, PlanQuotaDefault{ResourceType: storage, QuotaValue: 5})
+	plan.QuotaDefaults = append(plan.QuotaDefaults, PlanQuotaDefault{
+		PlanID:        plan.ID,
+		QuotaValue:    1,
+		ResourceType:  ResourceType{ID: uuid.NewString(), Name: uniqueName("missing")},
+		EffectiveDate: time.Now().Add(-time.Hour),
+	})
+
+	tests := []struct {
+		name      string
+		subscribe func(ctx context.Context, userID string) error
+	}{
+		{
+			name: "own transaction",
+			subscribe: func(ctx context.Context, userID string) error {
+				_, err := testDB.SetActiveSubscription(ctx, userID, plan, nil)
+				return err
+			},
+		},
+		{
+			name: "caller's transaction",
+			subscribe: func(ctx context.Context, userID string) error {
+				return testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+					_, err := testDB.SetActiveSubscription(ctx, userID, plan, nil, WithTX(tx))
+					return err
+				})
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			user := addTestUser(t)
+			if err := tc.subscribe(ctx, user.ID); err == nil {
+				t.Fatal("expected the subscription to fail")
+			}
+
+			if count := countRows(t, "subscriptions", goqu.Ex{"user_id": user.ID}); count != 0 {
+				t.Errorf("expected the subscription to be rolled back, found %d", count)
+			}
+		})
+	}
+}
+
+func TestSetActiveSubscriptionMissingRate(t *testing.T) {
+	t.Parallel()
+
+	plan := addTestPlan(t)
+	plan.Rates = nil
+
+	_, err := testDB.SetActiveSubscription(context.Background(), addTestUser(t).ID, plan, nil)
+	if err == nil {
+		t.Fatal("expected a plan without a rate to be refused")
+	}
+}
+
+func TestSubscriptionEffectiveDates(t *testing.T) {
+	t.Parallel()
+
+	plan := addTestPlan(t)
+
+	user := addTestUser(t)
+	opts := DefaultSubscriptionOptions()
+	opts.EndDate = time.Now().Add(time.Hour)
+	subscription := subscribeTestUser(t, user, plan, opts)
+
+	start := subscription.EffectiveStartDate
+	end := subscription.EffectiveEndDate
+
+	tests := []struct {
+		name     string
+		opts     []QueryOption
+		expected bool
+	}{
+		{name: "before the start", opts: []QueryOption{WithEffectiveDate(start.Add(-time.Microsecond))}},
+		{name: "at the start", opts: []QueryOption{WithEffectiveDate(start)}, expected: true},
+		{name: "at the end", opts: []QueryOption{WithEffectiveDate(end)}, expected: true},
+		{name: "after the end", opts: []QueryOption{WithEffectiveDate(end.Add(time.Microsecond))}},
+		{
+			name:     "within the grace period",
+			opts:     []QueryOption{WithEffectiveDate(end.Add(time.Minute)), WithGracePeriod(time.Hour)},
+			expected: true,
+		},
+		{
+			name: "after the grace period",
+			opts: []QueryOption{WithEffectiveDate(end.Add(2 * time.Hour)), WithGracePeriod(time.Hour)},
+		},
+		{
+			name:     "expired subscriptions included",
+			opts:     []QueryOption{WithEffectiveDate(end.Add(24 * time.Hour)), WithIncludeExpired()},
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			active, err := testDB.UserHasActivePlan(context.Background(), user.Username, tc.opts...)
+			if err != nil {
+				t.Fatalf("unable to check for an active subscription: %s", err)
+			}
+			if active != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, active)
+			}
+		})
+	}
+}
+
+func TestPerpetualSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+
+	user := addTestUser(t)
+	opts := DefaultSubscriptionOptions()
+	opts.Perpetual = true
+	subscription := subscribeTestUser(t, user, plan, opts)
+
+	if !subscription.Perpetual() {
+		t.Fatalf("expected a perpetual subscription, got an end date of %s", subscription.EffectiveEndDate)
+	}
+
+	active, err := testDB.UserHasActivePlan(ctx, user.Username, WithEffectiveDate(time.Now().AddDate(100, 0, 0)))
+	if err != nil {
+		t.Fatalf("unable to check for an active subscription: %s", err)
+	}
+	if !active {
+		t.Error("expected the perpetual subscription to be active a century from now")
+	}
+
+	active, err = testDB.UserHasActivePlan(ctx, user.Username, WithEffectiveDate(subscription.EffectiveStartDate.Add(-time.Microsecond)))
+	if err != nil {
+		t.Fatalf("unable to check for an active subscription: %s", err)
+	}
+	if active {
+		t.Error("expected the perpetual subscription to be inactive before it starts")
+	}
+}
+
+func TestGetSubscriptionByIDNotFound(t *testing.T) {
+	t.Parallel()
+
+	subscription, err := testDB.GetSubscriptionByID(context.Background(), uuid.NewString())
+	if err != nil {
+		t.Fatalf("unable to look up the subscription: %s", err)
+	}
+	if subscription != nil {
+		t.Errorf("expected no subscription, got %s", subscription.ID)
+	}
+}
+
+func TestGetActiveSubscription(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+	if _, err := testDB.GetActiveSubscription(ctx, user.Username); !errors.Is(err, suberrors.ErrSubscriptionNotFound) {
+		t.Fatalf("expected ErrSubscriptionNotFound for a user without a subscription, got %v", err)
+	}
+
+	// The most recent subscription is the active one.
+	plan := addTestPlan(t)
+	subscribeTestUser(t, user, plan, nil)
+	latest := subscribeTestUser(t, user, plan, nil)
+
+	active, err := testDB.GetActiveSubscription(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to look up the active subscription: %s", err)
+	}
+	if active.ID != latest.ID {
+		t.Errorf("expected subscription %s, got %s", latest.ID, active.ID)
+	}
+	if active.User.Username != user.Username || active.Plan.Name != plan.Name {
+		t.Errorf("expected %s on %s, got %s on %s", user.Username, plan.Name, active.User.Username, active.Plan.Name)
+	}
+	if active.Rate.Rate != 100 {
+		t.Errorf("expected a rate of 100, got %g", active.Rate.Rate)
+	}
+}
+
+func TestGetActiveSubscriptionForUpdate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		active, err := testDB.GetActiveSubscription(ctx, subscription.User.Username, WithTX(tx), WithForUpdate())
+		if err != nil {
+			return err
+		}
+		if active.ID != subscription.ID {
+			t.Errorf("expected subscription %s, got %s", subscription.ID, active.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unable to lock the active subscription: %s", err)
+	}
+}
+
+func TestSubscribeToDefaultPlan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	plan := addTestPlan(t, PlanQuotaDefault{ResourceType: storage, QuotaValue: 8})
+	username := uniqueName("user")
+
+	subscription, err := testDB.SubscribeToDefaultPlan(ctx, username, WithDefaultPlan(plan.Name))
+	if err != nil {
+		t.Fatalf("unable to subscribe %s to the default plan: %s", username, err)
+	}
+	if subscription.User.Username != username {
+		t.Errorf("expected a subscription for %s, got one for %s", username, subscription.User.Username)
+	}
+	if subscription.Plan.ID != plan.ID {
+		t.Errorf("expected a subscription to %s, got one to %s", plan.Name, subscription.Plan.Name)
+	}
+	if quotas := subscriptionQuotaValues(t, subscription.ID); quotas[storage.ID] != 8 {
+		t.Errorf("expected a quota of 8, got %g", quotas[storage.ID])
+	}
+
+	_, err = testDB.SubscribeToDefaultPlan(ctx, uniqueName("user"), WithDefaultPlan(uniqueName("missing")))
+	if !errors.Is(err, suberrors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound for a missing default plan, got %v", err)
+	}
+}
+
+func TestUserOnPlan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	subscription := addTestSubscription(t)
+	other := addTestPlan(t)
+
+	tests := []struct {
+		name     string
+		planName string
+		expected bool
+	}{
+		{name: "subscribed plan", planName: subscription.Plan.Name, expected: true},
+		{name: "other plan", planName: other.Name},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			onPlan, err := testDB.UserOnPlan(ctx, subscription.User.Username, tc.planName)
+			if err != nil {
+				t.Fatalf("unable to check the plan: %s", err)
+			}
+			if onPlan != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, onPlan)
+			}
+		})
+	}
+}
+
+func TestExpiringSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	plan := addTestPlan(t)
+
+	opts := DefaultSubscriptionOptions()
+	opts.EndDate = time.Now().Add(24 * time.Hour)
+	expiring := subscribeTestUser(t, addTestUser(t), plan, opts)
+
+	// Subscriptions that end later and users who have already been renewed
+	// aren't included.
+	opts.EndDate = time.Now().Add(30 * 24 * time.Hour)
+	subscribeTestUser(t, addTestUser(t), plan, opts)
+
+	renewed := addTestUser(t)
+	opts.EndDate = time.Now().Add(time.Hour)
+	subscribeTestUser(t, renewed, plan, opts)
+	subscribeTestUser(t, renewed, plan, nil)
+
+	subscriptions, err := testDB.ExpiringSubscriptions(ctx, plan.Name, time.Now().Add(7*24*time.Hour))
+	if err != nil {
+		t.Fatalf("unable to list the expiring subscriptions: %s", err)
+	}
+	if len(subscriptions) != 1 || subscriptions[0].ID != expiring.ID {
+		t.Errorf("expected only subscription %s, got %+v", expiring.ID, subscriptions)
+	}
+}
+
+func TestListUserSubscriptions(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+	plan := addTestPlan(t)
+	first := subscribeTestUser(t, user, plan, nil)
+	second := subscribeTestUser(t, user, plan, nil)
+
+	subscriptions, err := testDB.ListUserSubscriptions(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to list the subscriptions: %s", err)
+	}
+	if len(subscriptions) != 2 || subscriptions[0].ID != first.ID || subscriptions[1].ID != second.ID {
+		t.Errorf("expected subscriptions %s and %s in order, got %+v", first.ID, second.ID, subscriptions)
+	}
+}
+
+func TestSubscriptionUsages(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	compute := addTestResourceType(t, true)
+	subscription := addTestSubscription(t)
+	other := addTestSubscription(t)
+
+	for _, usage := range []struct {
+		resourceType   ResourceType
+		subscriptionID string
+		value          float64
+	}{
+		{resourceType: storage, subscriptionID: subscription.ID, value: 2},
+		{resourceType: compute, subscriptionID: subscription.ID, value: 3},
+		{resourceType: storage, subscriptionID: other.ID, value: 4},
+	} {
+		if _, _, err := testDB.ApplyUsage(ctx, UpdateTypeSet, usage.value, usage.resourceType.ID, usage.subscriptionID); err != nil {
+			t.Fatalf("unable to record the usage: %s", err)
+		}
+	}
+
+	usages, err := testDB.SubscriptionUsages(ctx, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to list the usages: %s", err)
+	}
+	if len(usages) != 2 {
+		t.Errorf("expected 2 usages, got %d", len(usages))
+	}
+
+	bySubscription, err := testDB.UsagesBySubscription(ctx, []string{subscription.ID, other.ID})
+	if err != nil {
+		t.Fatalf("unable to list the usages by subscription: %s", err)
+	}
+	if len(bySubscription[subscription.ID]) != 2 || len(bySubscription[other.ID]) != 1 {
+		t.Errorf("expected 2 and 1 usages, got %d and %d", len(bySubscription[subscription.ID]), len(bySubscription[other.ID]))
+	}
+
+	usage, err := testDB.GetUsage(ctx, compute.ID, subscription.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	}
+	if usage == nil || usage.Usage != 3 || !usage.ResourceType.Consumable {
+		t.Errorf("expected a consumable usage of 3, got %+v", usage)
+	}
+
+	usage, err = testDB.GetUsage(ctx, compute.ID, other.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the usage: %s", err)
+	}
+	if usage != nil {
+		t.Errorf("expected no usage, got %g", usage.Usage)
+	}
+}
+
+func TestLoadSubscriptionDetails(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := addTestResourceType(t, false)
+	subscription := addTestSubscription(t, PlanQuotaDefault{ResourceType: storage, QuotaValue: 5})
+	if _, _, err := testDB.ApplyUsage(ctx, UpdateTypeSet, 2, storage.ID, subscription.ID); err != nil {
+		t.Fatalf("unable to record the usage: %s", err)
+	}
+
+	if err := testDB.LoadSubscriptionDetails(ctx, subscription); err != nil {
+		t.Fatalf("unable to load the subscription details: %s", err)
+	}
+	if len(subscription.Plan.QuotaDefaults) != 1 || subscription.Plan.QuotaDefaults[0].QuotaValue != 5 {
+		t.Errorf("expected a single quota default of 5, got %+v", subscription.Plan.QuotaDefaults)
+	}
+	if len(subscription.Plan.Rates) != 1 || subscription.Plan.Rates[0].Rate != 100 {
+		t.Errorf("expected a single rate of 100, got %+v", subscription.Plan.Rates)
+	}
+	if len(subscription.Quotas) != 1 || subscription.Quotas[0].Quota != 5 {
+		t.Errorf("expected a single quota of 5, got %+v", subscription.Quotas)
+	}
+	if len(subscription.Usages) != 1 || subscription.Usages[0].Usage != 2 {
+		t.Errorf("expected a single usage of 2, got %+v", subscription.Usages)
+	}
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/jmoiron/sqlx"
+)
+
+// errQuotaInsert is the error returned by the mocked quota insert.
+var errQuotaInsert = errors.New("quota insert failed")
+
+// The statements that SetActiveSubscription runs.
+var (
+	insertSubscriptionSQL = regexp.QuoteMeta(`INSERT INTO "subscriptions"`)
+	insertQuotasSQL       = regexp.QuoteMeta(`INSERT INTO "quotas"`)
+)
+
+// newMockDatabase returns a *Database that runs its statements against a mock.
+func newMockDatabase(t *testing.T) (*Database, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("unable to create the mock database: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return New(sqlx.NewDb(conn, "postgres")), mock
+}
+
+// testSubscriptionPlan returns a plan with a rate and quota defaults for two
+// resource types, so that a failure can happen after some of the quotas for a
+// new subscription have been prepared.
+func testSubscriptionPlan() *Plan {
+	effectiveDate := time.Now().Add(-24 * time.Hour)
+	return &Plan{
+		ID:   "plan-id",
+		Name: "Basic",
+		QuotaDefaults: []PlanQuotaDefault{
+			{
+				QuotaValue:    5,
+				ResourceType:  ResourceType{ID: "storage-id", Name: "data.size"},
+				EffectiveDate: effectiveDate,
+			},
+			{
+				QuotaValue:    100,
+				ResourceType:  ResourceType{ID: "compute-id", Name: "cpu.hours", Consumable: true},
+				EffectiveDate: effectiveDate,
+			},
+		},
+		Rates: []PlanRate{{ID: "rate-id", PlanID: "plan-id", EffectiveDate: effectiveDate, Rate: 0}},
+	}
+}
+
+// testSubscriptionOptions returns the options for a subscription that lasts for
+// a year.
+func testSubscriptionOptions() *SubscriptionOptions {
+	opts := DefaultSubscriptionOptions()
+	opts.EndDate = time.Now().AddDate(1, 0, 0)
+	return opts
+}
+
+func TestSetActiveSubscription(t *testing.T) {
+	d, mock := newMockDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertSubscriptionSQL).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("subscription-id"))
+	mock.ExpectExec(insertQuotasSQL).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	subscriptionID, err := d.SetActiveSubscription(context.Background(), "user-id", testSubscriptionPlan(), testSubscriptionOptions())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if subscriptionID != "subscription-id" {
+		t.Errorf("expected subscription-id, got %s", subscriptionID)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetActiveSubscriptionQuotaFailure(t *testing.T) {
+	d, mock := newMockDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertSubscriptionSQL).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("subscription-id"))
+	mock.ExpectExec(insertQuotasSQL).WillReturnError(errQuotaInsert)
+	mock.ExpectRollback()
+
+	_, err := d.SetActiveSubscription(context.Background(), "user-id", testSubscriptionPlan(), testSubscriptionOptions())
+	if !errors.Is(err, errQuotaInsert) {
+		t.Errorf("expected the quota insert error, got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetActiveSubscriptionQuotaFailureInCallerTx(t *testing.T) {
+	d, mock := newMockDatabase(t)
+
+	// The caller's transaction is used rather than a new one, and it's the
+	// caller that rolls it back.
+	mock.ExpectBegin()
+	mock.ExpectQuery(insertSubscriptionSQL).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("subscription-id"))
+	mock.ExpectExec(insertQuotasSQL).WillReturnError(errQuotaInsert)
+	mock.ExpectRollback()
+
+	ctx := context.Background()
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		_, err := d.SetActiveSubscription(ctx, "user-id", testSubscriptionPlan(), testSubscriptionOptions(), WithTX(tx))
+		return err
+	})
+	if !errors.Is(err, errQuotaInsert) {
+		t.Errorf("expected the quota insert error, got %v", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSubscriptionQuotaRecords(t *testing.T) {
+	opts := DefaultSubscriptionOptions()
+	opts.Periods = 3
+
+	records := subscriptionQuotaRecords("subscription-id", testSubscriptionPlan(), opts)
+	if len(records) != 2 {
+		t.Fatalf("expected 2 quota records, got %d", len(records))
+	}
+
+	// Only the quotas of consumable resource types are multiplied by the number
+	// of periods.
+	expected := map[string]float64{"compute-id": 300, "storage-id": 5}
+	for _, record := range records {
+		resourceTypeID := record["resource_type_id"].(string)
+		if record["quota"] != expected[resourceTypeID] {
+			t.Errorf("expected a quota of %g for %s, got %v", expected[resourceTypeID], resourceTypeID, record["quota"])
+		}
+		if record["subscription_id"] != "subscription-id" {
+			t.Errorf("expected the quota to belong to subscription-id, got %v", record["subscription_id"])
+		}
+	}
+}
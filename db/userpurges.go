@@ -0,0 +1,176 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// PurgedUsername is the value that replaces the username of a purged user in
+// the records that are kept for auditing.
+const PurgedUsername = "purged"
+
+// UsernameHash returns the hex-encoded SHA-256 hash of a username, which is
+// kept in place of the username when a user is purged.
+func UsernameHash(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return hex.EncodeToString(sum[:])
+}
+
+// UserPurge is the tombstone that's recorded when a user is purged.
+type UserPurge struct {
+	ID                 string    `db:"id" goqu:"defaultifempty"`
+	UserID             string    `db:"user_id"`
+	UsernameSHA256     string    `db:"username_sha256"`
+	Subscriptions      int       `db:"subscriptions"`
+	SubscriptionAddons int       `db:"subscription_addons"`
+	Quotas             int       `db:"quotas"`
+	Usages             int       `db:"usages"`
+	Updates            int       `db:"updates"`
+	Trials             int       `db:"trials"`
+	PurgedBy           string    `db:"purged_by"`
+	PurgedAt           time.Time `db:"purged_at" goqu:"defaultifempty"`
+}
+
+// ToAPIType converts the user purge to the type used in responses.
+func (p *UserPurge) ToAPIType() *api.UserPurge {
+	return &api.UserPurge{
+		ID:                 p.ID,
+		UserID:             p.UserID,
+		UsernameSHA256:     p.UsernameSHA256,
+		Subscriptions:      p.Subscriptions,
+		SubscriptionAddons: p.SubscriptionAddons,
+		Quotas:             p.Quotas,
+		Usages:             p.Usages,
+		Updates:            p.Updates,
+		Trials:             p.Trials,
+		PurgedBy:           p.PurgedBy,
+		PurgedAt:           p.PurgedAt,
+	}
+}
+
+// deleteRows deletes the rows of a table that match the conditions and returns
+// the number of rows that were deleted.
+func (d *Database) deleteRows(ctx context.Context, db GoquDatabase, table exp.IdentifierExpression, where ...exp.Expression) (int, error) {
+	ds := db.From(table).Delete().Where(where...)
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to delete from %s", table.GetTable())
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+
+	return int(rowsAffected), nil
+}
+
+// PurgeUserRecords deletes every record that belongs to a user, then the user
+// itself, and records the number of rows that were deleted from each table in
+// the purge. The user's username is also removed from the audit log of user
+// merges. Only WithTX is currently supported, and a transaction is required to
+// keep a failure from leaving the user partially purged.
+func (d *Database) PurgeUserRecords(ctx context.Context, purge *UserPurge, username string, opts ...QueryOption) error {
+	var err error
+
+	querySettings, db := d.querySettings(opts...)
+
+	userID := purge.UserID
+	if err = d.checkUserTenant(ctx, db, querySettings, userID); err != nil {
+		return err
+	}
+
+	subscriptionIDs := db.From(t.Subscriptions).
+		Select(t.Subscriptions.Col("id")).
+		Where(t.Subscriptions.Col("user_id").Eq(userID))
+
+	if purge.SubscriptionAddons, err = d.deleteRows(
+		ctx, db, t.SubscriptionAddons, t.SubscriptionAddons.Col("subscription_id").In(subscriptionIDs),
+	); err != nil {
+		return err
+	}
+	if purge.Quotas, err = d.deleteRows(ctx, db, t.Quotas, t.Quotas.Col("subscription_id").In(subscriptionIDs)); err != nil {
+		return err
+	}
+	if purge.Usages, err = d.deleteRows(ctx, db, t.Usages, t.Usages.Col("subscription_id").In(subscriptionIDs)); err != nil {
+		return err
+	}
+	if purge.Trials, err = d.deleteRows(ctx, db, t.Trials, t.Trials.Col("user_id").Eq(userID)); err != nil {
+		return err
+	}
+	if purge.Subscriptions, err = d.deleteRows(ctx, db, t.Subscriptions, t.Subscriptions.Col("user_id").Eq(userID)); err != nil {
+		return err
+	}
+	if purge.Updates, err = d.deleteRows(ctx, db, t.Updates, t.Updates.Col("user_id").Eq(userID)); err != nil {
+		return err
+	}
+	archived, err := d.deleteRows(ctx, db, t.ArchivedUpdates, t.ArchivedUpdates.Col("user_id").Eq(userID))
+	if err != nil {
+		return err
+	}
+	purge.Updates += archived
+
+	// Merges into the user are deleted along with the user, but merges of a
+	// user with the same username into other users still contain it.
+	ds := db.Update(t.UserMerges).
+		Set(goqu.Record{"source_username": PurgedUsername}).
+		Where(
+			t.UserMerges.Col("source_username").Eq(username),
+			querySettings.userTenantExp(db, t.UserMerges.Col("target_user_id")),
+		)
+	d.LogSQL(ds)
+
+	if _, err = ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to remove the username from the user merges")
+	}
+
+	// Credit balances and ledger entries are deleted along with the user.
+	if _, err = d.deleteRows(ctx, db, t.Users, t.Users.Col("id").Eq(userID)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddUserPurge records the tombstone for a purged user and returns its ID. The
+// tombstone is assigned to the tenant if the query is scoped to one. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddUserPurge(ctx context.Context, purge *UserPurge, opts ...QueryOption) (string, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.UserPurges).
+		Rows(querySettings.tenantRecord(goqu.Record{
+			"user_id":             purge.UserID,
+			"username_sha256":     purge.UsernameSHA256,
+			"subscriptions":       purge.Subscriptions,
+			"subscription_addons": purge.SubscriptionAddons,
+			"quotas":              purge.Quotas,
+			"usages":              purge.Usages,
+			"updates":             purge.Updates,
+			"trials":              purge.Trials,
+			"purged_by":           purge.PurgedBy,
+		})).
+		Returning(t.UserPurges.Col("id"), t.UserPurges.Col("purged_at"))
+	d.LogSQL(ds)
+
+	var result struct {
+		ID       string    `db:"id"`
+		PurgedAt time.Time `db:"purged_at"`
+	}
+	if _, err := ds.Executor().ScanStructContext(ctx, &result); err != nil {
+		return "", errors.Wrap(err, "unable to record the user purge")
+	}
+	purge.ID = result.ID
+	purge.PurgedAt = result.PurgedAt
+
+	return result.ID, nil
+}
@@ -0,0 +1,83 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/doug-martin/goqu/v9"
+)
+
+func TestPurgeUserRecords(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	compute := addTestResourceType(t, true)
+	plan := addTestPlan(t, PlanQuotaDefault{ResourceType: compute, QuotaValue: 10})
+	user := addTestUser(t)
+	subscription := subscribeTestUser(t, user, plan, nil)
+	attachTestAddon(t, subscription, addTestAddon(t, compute, 1), 1)
+	addTestTrialRecord(t, user, plan)
+
+	update := newTestUpdate(t, *user, compute, UsagesTrackedMetric, UpdateTypeAdd, 1)
+	if err := testDB.ProcessUpdateForUsage(ctx, update); err != nil {
+		t.Fatalf("unable to process the update: %s", err)
+	}
+
+	// An earlier merge of another user with the same username into a different
+	// user keeps the merge record, but not the username.
+	target := addTestUser(t)
+	merge := &UserMerge{
+		SourceUserID:   user.ID,
+		SourceUsername: user.Username,
+		TargetUserID:   target.ID,
+		TargetUsername: target.Username,
+		Policy:         api.MergePolicyKeepTarget,
+		MergedBy:       "test",
+	}
+	if _, err := testDB.AddUserMerge(ctx, merge); err != nil {
+		t.Fatalf("unable to record the merge: %s", err)
+	}
+
+	purge := &UserPurge{UserID: user.ID, UsernameSHA256: UsernameHash(user.Username), PurgedBy: "test"}
+	err := testDB.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		if err := testDB.PurgeUserRecords(ctx, purge, user.Username, WithTX(tx)); err != nil {
+			return err
+		}
+		_, err := testDB.AddUserPurge(ctx, purge, WithTX(tx))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("unable to purge the user: %s", err)
+	}
+
+	expected := UserPurge{Subscriptions: 1, SubscriptionAddons: 1, Quotas: 1, Usages: 1, Updates: 1, Trials: 1}
+	actual := UserPurge{
+		Subscriptions:      purge.Subscriptions,
+		SubscriptionAddons: purge.SubscriptionAddons,
+		Quotas:             purge.Quotas,
+		Usages:             purge.Usages,
+		Updates:            purge.Updates,
+		Trials:             purge.Trials,
+	}
+	if actual != expected {
+		t.Errorf("expected the deleted rows to be counted as %+v, got %+v", expected, actual)
+	}
+
+	exists, err := testDB.UserExists(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to check whether the user exists: %s", err)
+	}
+	if exists {
+		t.Error("expected the user to be deleted")
+	}
+
+	if count := countRows(t, "user_merges", goqu.Ex{"id": merge.ID, "source_username": PurgedUsername}); count != 1 {
+		t.Error("expected the username to be removed from the merge")
+	}
+	if count := countRows(t, "user_purges", goqu.Ex{"username_sha256": UsernameHash(user.Username)}); count != 1 {
+		t.Errorf("expected 1 tombstone for the user, got %d", count)
+	}
+}
@@ -2,8 +2,11 @@ package db
 
 import (
 	"context"
+	"strings"
 
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
 	"github.com/pkg/errors"
 )
 
@@ -16,14 +19,15 @@ func (d *Database) GetUserID(ctx context.Context, username string, opts ...Query
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	usersT := goqu.T("users")
 	query := db.From(usersT).
 		Select("id").
-		Where(goqu.Ex{
-			"username": username,
-		})
+		Where(
+			goqu.Ex{"username": username},
+			querySettings.tenantExp(usersT),
+		)
 	qs, _, err := query.ToSQL()
 	if err != nil {
 		return "", err
@@ -45,14 +49,15 @@ func (d *Database) GetUser(ctx context.Context, id string, opts ...QueryOption)
 		result User
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	usersT := goqu.T("users")
 	query := db.From(usersT).
 		Select("id", "username").
-		Where(goqu.Ex{
-			"id": id,
-		}).
+		Where(
+			goqu.Ex{"id": id},
+			querySettings.tenantExp(usersT),
+		).
 		Executor()
 
 	if _, err = query.ScanStructContext(ctx, &result); err != nil {
@@ -67,10 +72,10 @@ func (d *Database) UserExists(ctx context.Context, username string, opts ...Quer
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	users := goqu.T("users")
-	count, err := db.From(users).Where(users.Col("username").Eq(username)).Count()
+	count, err := db.From(users).Where(users.Col("username").Eq(username), querySettings.tenantExp(users)).Count()
 	if err != nil {
 		return false, err
 	}
@@ -84,12 +89,12 @@ func (d *Database) AddUser(ctx context.Context, username string, opts ...QueryOp
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	ds := db.Insert("users").Rows(
-		goqu.Record{
+		querySettings.tenantRecord(goqu.Record{
 			"username": username,
-		},
+		}),
 	).
 		Returning(goqu.C("id")).
 		Executor()
@@ -97,6 +102,9 @@ func (d *Database) AddUser(ctx context.Context, username string, opts ...QueryOp
 	var id string
 
 	if _, err = ds.ScanValContext(ctx, &id); err != nil {
+		if isUniqueViolation(err) {
+			return "", suberrors.ErrUserExists
+		}
 		return "", err
 	}
 
@@ -114,7 +122,7 @@ func (d *Database) EnsureUser(ctx context.Context, username string, opts ...Quer
 	)
 
 	// Prepare to execute the statement.
-	_, db = d.querySettings(opts...)
+	querySettings, db := d.querySettings(opts...)
 
 	// Build the statement.
 	usersT := goqu.T("users")
@@ -122,12 +130,12 @@ func (d *Database) EnsureUser(ctx context.Context, username string, opts ...Quer
 		With("ins",
 			db.Insert(usersT).
 				Returning("id", "username").
-				Rows(goqu.Record{"username": username}).
+				Rows(querySettings.tenantRecord(goqu.Record{"username": username})).
 				OnConflict(goqu.DoNothing())).
 		UnionAll(
 			db.From(usersT).
 				Select("id", "username").
-				Where(goqu.Ex{"username": username}))
+				Where(goqu.Ex{"username": username}, querySettings.tenantExp(usersT)))
 
 	// Log the SQL statement if we're debugging database calls.
 	d.LogSQL(statement)
@@ -137,9 +145,180 @@ func (d *Database) EnsureUser(ctx context.Context, username string, opts ...Quer
 	if err != nil {
 		return nil, errors.Wrap(err, wrapMsg)
 	}
+
+	// A user who belongs to another tenant can't be seen from this one.
+	if !found && querySettings.tenant != "" {
+		return nil, suberrors.ErrUserNotFound
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &result, nil
+}
+
+// IsTestUser returns true if the user's account is a test account. Users that
+// don't exist yet aren't test users.
+func (d *Database) IsTestUser(ctx context.Context, username string, opts ...QueryOption) (bool, error) {
+	var (
+		err    error
+		db     GoquDatabase
+		result bool
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	query := db.From(usersT).
+		Select(usersT.Col("test")).
+		Where(usersT.Col("username").Eq(username), querySettings.tenantExp(usersT))
+	d.LogSQL(query)
+
+	if _, err = query.ScanValContext(ctx, &result); err != nil {
+		return false, errors.Wrap(err, "unable to determine whether the user is a test user")
+	}
+
+	return result, nil
+}
+
+// SetTestUser marks or unmarks a user's account as a test account, adding the
+// user to the database if necessary.
+func (d *Database) SetTestUser(ctx context.Context, username string, test bool, opts ...QueryOption) error {
+	var (
+		err error
+		db  GoquDatabase
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	statement := db.Insert(usersT).
+		Rows(querySettings.tenantRecord(goqu.Record{"username": username, "test": test})).
+		OnConflict(goqu.DoUpdate("username", goqu.Record{"test": test}).Where(querySettings.tenantExp(usersT)))
+	d.LogSQL(statement)
+
+	if _, err = statement.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to update the test flag for the user")
+	}
+
+	return nil
+}
+
+// ListUsernames returns the usernames of all of the users in the database, in
+// sorted order. Accepts a variable number of QueryOptions, though only WithTX
+// and WithReadReplica are currently supported.
+func (d *Database) ListUsernames(ctx context.Context, opts ...QueryOption) ([]string, error) {
+	var (
+		err    error
+		db     GoquDatabase
+		result []string
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	query := db.From(usersT).
+		Select(usersT.Col("username")).
+		Where(querySettings.tenantExp(usersT)).
+		Order(usersT.Col("username").Asc())
+	d.LogSQL(query)
+
+	if err = query.ScanValsContext(ctx, &result); err != nil {
+		return nil, errors.Wrap(err, "unable to list the usernames")
+	}
+
+	return result, nil
+}
+
+// GetUserByUsername returns the user with the given username, or nil if the
+// user doesn't exist. Accepts a variable number of QueryOptions, though only
+// WithTX and WithReadReplica are currently supported.
+func (d *Database) GetUserByUsername(ctx context.Context, username string, opts ...QueryOption) (*User, error) {
+	var (
+		err    error
+		db     GoquDatabase
+		result User
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	query := db.From(usersT).
+		Select(usersT.Col("id"), usersT.Col("username")).
+		Where(usersT.Col("username").Eq(username), querySettings.tenantExp(usersT))
+	d.LogSQL(query)
+
+	found, err := query.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up user %s", username)
+	}
 	if !found {
 		return nil, nil
 	}
 
 	return &result, nil
 }
+
+// likeEscaper escapes the characters that have a special meaning in LIKE
+// patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// userSearchExpression returns the condition used to find users whose usernames
+// contain the search string. Every user matches an empty search string.
+func userSearchExpression(usersT exp.IdentifierExpression, search string) exp.Expression {
+	if search == "" {
+		return goqu.L("TRUE")
+	}
+	return usersT.Col("username").ILike("%" + likeEscaper.Replace(search) + "%")
+}
+
+// ListUsers returns the users whose usernames contain the search string, in
+// order by username. Accepts a variable number of QueryOptions, including
+// WithTX, WithReadReplica, WithQueryLimit and WithQueryOffset.
+func (d *Database) ListUsers(ctx context.Context, search string, opts ...QueryOption) ([]User, error) {
+	var (
+		err    error
+		db     GoquDatabase
+		result []User
+	)
+
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	query := db.From(usersT).
+		Select(usersT.Col("id"), usersT.Col("username")).
+		Where(userSearchExpression(usersT, search), querySettings.tenantExp(usersT)).
+		Order(usersT.Col("username").Asc())
+
+	if querySettings.hasLimit {
+		query = query.Limit(querySettings.limit)
+	}
+
+	if querySettings.hasOffset {
+		query = query.Offset(querySettings.offset)
+	}
+	d.LogSQL(query)
+
+	if err = query.Executor().ScanStructsContext(ctx, &result); err != nil {
+		return nil, errors.Wrap(err, "unable to list the users")
+	}
+
+	return result, nil
+}
+
+// CountUsers returns the number of users whose usernames contain the search
+// string. Accepts a variable number of QueryOptions, though only WithTX and
+// WithReadReplica are currently supported.
+func (d *Database) CountUsers(ctx context.Context, search string, opts ...QueryOption) (int64, error) {
+	querySettings, db := d.querySettings(opts...)
+
+	usersT := goqu.T("users")
+	count, err := db.From(usersT).
+		Where(userSearchExpression(usersT, search), querySettings.tenantExp(usersT)).
+		CountContext(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count the users")
+	}
+
+	return count, nil
+}
@@ -0,0 +1,176 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddUser(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	username := uniqueName("user")
+	id, err := testDB.AddUser(ctx, username)
+	if err != nil {
+		t.Fatalf("unable to add %s: %s", username, err)
+	}
+
+	if _, err = testDB.AddUser(ctx, username); !errors.Is(err, suberrors.ErrUserExists) {
+		t.Errorf("expected ErrUserExists when adding %s again, got %v", username, err)
+	}
+
+	exists, err := testDB.UserExists(ctx, username)
+	if err != nil {
+		t.Fatalf("unable to check whether %s exists: %s", username, err)
+	}
+	if !exists {
+		t.Errorf("expected %s to exist", username)
+	}
+
+	userID, err := testDB.GetUserID(ctx, username)
+	if err != nil {
+		t.Fatalf("unable to look up the ID of %s: %s", username, err)
+	}
+	if userID != id {
+		t.Errorf("expected ID %s, got %s", id, userID)
+	}
+
+	user, err := testDB.GetUser(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up user %s: %s", id, err)
+	}
+	if user.Username != username {
+		t.Errorf("expected username %s, got %s", username, user.Username)
+	}
+}
+
+func TestEnsureUserIsIdempotent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+	again, err := testDB.EnsureUser(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to ensure that %s exists: %s", user.Username, err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("expected the existing user %s, got %s", user.ID, again.ID)
+	}
+}
+
+func TestGetUserByUsername(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	user := addTestUser(t)
+	found, err := testDB.GetUserByUsername(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("unable to look up %s: %s", user.Username, err)
+	}
+	if found == nil || found.ID != user.ID {
+		t.Errorf("expected user %s, got %+v", user.ID, found)
+	}
+
+	missing, err := testDB.GetUserByUsername(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up a missing user: %s", err)
+	}
+	if missing != nil {
+		t.Errorf("expected no user, got %s", missing.ID)
+	}
+}
+
+func TestTestUsers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// Users are added when they're marked as test users.
+	username := uniqueName("user")
+	for _, test := range []bool{true, false} {
+		if err := testDB.SetTestUser(ctx, username, test); err != nil {
+			t.Fatalf("unable to set the test flag for %s: %s", username, err)
+		}
+
+		isTest, err := testDB.IsTestUser(ctx, username)
+		if err != nil {
+			t.Fatalf("unable to look up the test flag for %s: %s", username, err)
+		}
+		if isTest != test {
+			t.Errorf("expected the test flag to be %t, got %t", test, isTest)
+		}
+	}
+
+	isTest, err := testDB.IsTestUser(ctx, uniqueName("missing"))
+	if err != nil {
+		t.Fatalf("unable to look up the test flag for a missing user: %s", err)
+	}
+	if isTest {
+		t.Error("expected a missing user not to be a test user")
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	prefix := uniqueName("search")
+	usernames := []string{prefix + "-a", prefix + "-b", prefix + "-c"}
+	for _, username := range usernames {
+		if _, err := testDB.EnsureUser(ctx, username); err != nil {
+			t.Fatalf("unable to add %s: %s", username, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		search   string
+		opts     []QueryOption
+		expected []string
+	}{
+		{name: "all matches", search: prefix, expected: usernames},
+		{name: "case insensitive", search: "SEARCH" + prefix[len("search"):], expected: usernames},
+		{name: "limit and offset", search: prefix, opts: []QueryOption{WithQueryLimit(1), WithQueryOffset(1)}, expected: usernames[1:2]},
+		{name: "wildcards are escaped", search: prefix + "%"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			users, err := testDB.ListUsers(ctx, tc.search, tc.opts...)
+			if err != nil {
+				t.Fatalf("unable to list the users: %s", err)
+			}
+
+			var actual []string
+			for _, user := range users {
+				actual = append(actual, user.Username)
+			}
+			if !slices.Equal(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+
+	count, err := testDB.CountUsers(ctx, prefix)
+	if err != nil {
+		t.Fatalf("unable to count the users: %s", err)
+	}
+	if count != int64(len(usernames)) {
+		t.Errorf("expected %d users, got %d", len(usernames), count)
+	}
+
+	all, err := testDB.ListUsernames(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the usernames: %s", err)
+	}
+	for _, username := range usernames {
+		if !slices.Contains(all, username) {
+			t.Errorf("expected %s to be listed", username)
+		}
+	}
+}
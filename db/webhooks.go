@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+)
+
+// Webhook is a URL that is notified when subscription lifecycle events occur.
+type Webhook struct {
+	ID             string         `db:"id" goqu:"defaultifempty,skipupdate"`
+	URL            string         `db:"url"`
+	Secret         string         `db:"secret"`
+	EventTypes     pq.StringArray `db:"event_types"`
+	Enabled        bool           `db:"enabled"`
+	CreatedBy      string         `db:"created_by"`
+	CreatedAt      time.Time      `db:"created_at" goqu:"defaultifempty"`
+	LastModifiedBy string         `db:"last_modified_by"`
+	LastModifiedAt time.Time      `db:"last_modified_at" goqu:"defaultifempty"`
+}
+
+// NewWebhookFromAPI converts a webhook from a request to a *Webhook.
+func NewWebhookFromAPI(w *api.Webhook) *Webhook {
+	return &Webhook{
+		ID:         w.ID,
+		URL:        w.URL,
+		Secret:     w.Secret,
+		EventTypes: pq.StringArray(w.EventTypes),
+		Enabled:    w.Enabled,
+	}
+}
+
+// ToAPIType converts the webhook to the type used in responses. The secret is
+// never included.
+func (w *Webhook) ToAPIType() *api.Webhook {
+	return &api.Webhook{
+		ID:             w.ID,
+		URL:            w.URL,
+		EventTypes:     []string(w.EventTypes),
+		Enabled:        w.Enabled,
+		CreatedBy:      w.CreatedBy,
+		CreatedAt:      w.CreatedAt,
+		LastModifiedBy: w.LastModifiedBy,
+		LastModifiedAt: w.LastModifiedAt,
+	}
+}
+
+// Validate returns an error if the webhook doesn't have an absolute HTTP(S) URL
+// or refers to an unknown event type. The secret is only required when
+// requireSecret is true, so that updates can leave the existing secret alone.
+func (w *Webhook) Validate(requireSecret bool) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Wrap(suberrors.ErrInvalidWebhook, "the URL must be an absolute HTTP or HTTPS URL")
+	}
+	if requireSecret && w.Secret == "" {
+		return errors.Wrap(suberrors.ErrInvalidWebhook, "a secret must be provided")
+	}
+	if len(w.EventTypes) == 0 {
+		return errors.Wrap(suberrors.ErrInvalidWebhook, "at least one event type must be provided")
+	}
+	for _, eventType := range w.EventTypes {
+		if !lo.Contains(api.EventTypes, eventType) {
+			return errors.Wrapf(suberrors.ErrInvalidWebhook, "unknown event type: %s", eventType)
+		}
+	}
+	return nil
+}
+
+// FailedDelivery records a webhook delivery that failed after every retry.
+type FailedDelivery struct {
+	ID        string    `db:"id" goqu:"defaultifempty"`
+	WebhookID string    `db:"webhook_id"`
+	EventID   string    `db:"event_id"`
+	EventType string    `db:"event_type"`
+	Payload   string    `db:"payload"`
+	Attempts  int       `db:"attempts"`
+	LastError string    `db:"last_error"`
+	CreatedAt time.Time `db:"created_at" goqu:"defaultifempty"`
+}
+
+// webhookDS returns the dataset used to look up webhooks.
+func webhookDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Webhooks).
+		Select(
+			t.Webhooks.Col("id"),
+			t.Webhooks.Col("url"),
+			t.Webhooks.Col("secret"),
+			t.Webhooks.Col("event_types"),
+			t.Webhooks.Col("enabled"),
+			t.Webhooks.Col("created_by"),
+			t.Webhooks.Col("created_at"),
+			t.Webhooks.Col("last_modified_by"),
+			t.Webhooks.Col("last_modified_at"),
+		)
+}
+
+// AddWebhook adds a new webhook and returns its ID. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) AddWebhook(ctx context.Context, webhook *Webhook, createdBy string, opts ...QueryOption) (string, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.Webhooks).
+		Rows(goqu.Record{
+			"url":              webhook.URL,
+			"secret":           webhook.Secret,
+			"event_types":      webhook.EventTypes,
+			"enabled":          webhook.Enabled,
+			"created_by":       createdBy,
+			"last_modified_by": createdBy,
+		}).
+		Returning(t.Webhooks.Col("id"))
+	d.LogSQL(ds)
+
+	var id string
+	if _, err := ds.Executor().ScanValContext(ctx, &id); err != nil {
+		return "", errors.Wrap(err, "unable to add the webhook")
+	}
+
+	return id, nil
+}
+
+// GetWebhook returns the webhook with the given ID. Accepts a variable number of
+// QueryOptions, though only WithTX is currently supported.
+func (d *Database) GetWebhook(ctx context.Context, id string, opts ...QueryOption) (*Webhook, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := webhookDS(db).Where(t.Webhooks.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	var webhook Webhook
+	found, err := ds.Executor().ScanStructContext(ctx, &webhook)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up webhook %s", id)
+	}
+	if !found {
+		return nil, suberrors.ErrWebhookNotFound
+	}
+
+	return &webhook, nil
+}
+
+// ListWebhooks returns all of the registered webhooks. Accepts a variable number
+// of QueryOptions, though only WithTX and WithReadReplica are currently
+// supported.
+func (d *Database) ListWebhooks(ctx context.Context, opts ...QueryOption) ([]Webhook, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := webhookDS(db).Order(t.Webhooks.Col("created_at").Asc())
+	d.LogSQL(ds)
+
+	var webhooks []Webhook
+	if err := ds.Executor().ScanStructsContext(ctx, &webhooks); err != nil {
+		return nil, errors.Wrap(err, "unable to list the webhooks")
+	}
+
+	return webhooks, nil
+}
+
+// ListWebhooksForEvent returns the enabled webhooks that should be notified of
+// events of the given type. Accepts a variable number of QueryOptions, though
+// only WithTX and WithReadReplica are currently supported.
+func (d *Database) ListWebhooksForEvent(ctx context.Context, eventType string, opts ...QueryOption) ([]Webhook, error) {
+	_, db := d.querySettings(opts...)
+
+	ds := webhookDS(db).
+		Where(
+			t.Webhooks.Col("enabled").IsTrue(),
+			goqu.L("? = ANY(?)", eventType, t.Webhooks.Col("event_types")),
+		)
+	d.LogSQL(ds)
+
+	var webhooks []Webhook
+	if err := ds.Executor().ScanStructsContext(ctx, &webhooks); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the webhooks for %s events", eventType)
+	}
+
+	return webhooks, nil
+}
+
+// UpdateWebhook updates a webhook. The secret is only changed if a new one is
+// provided. Accepts a variable number of QueryOptions, though only WithTX is
+// currently supported.
+func (d *Database) UpdateWebhook(ctx context.Context, webhook *Webhook, modifiedBy string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	rec := goqu.Record{
+		"url":              webhook.URL,
+		"event_types":      webhook.EventTypes,
+		"enabled":          webhook.Enabled,
+		"last_modified_by": modifiedBy,
+		"last_modified_at": CurrentTimestamp,
+	}
+	if webhook.Secret != "" {
+		rec["secret"] = webhook.Secret
+	}
+
+	ds := db.Update(t.Webhooks).
+		Set(rec).
+		Where(t.Webhooks.Col("id").Eq(webhook.ID))
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to update webhook %s", webhook.ID)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+	if rowsAffected == 0 {
+		return suberrors.ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// DeleteWebhook removes a webhook along with its failed deliveries. Accepts a
+// variable number of QueryOptions, though only WithTX is currently supported.
+func (d *Database) DeleteWebhook(ctx context.Context, id string, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.From(t.Webhooks).Delete().Where(t.Webhooks.Col("id").Eq(id))
+	d.LogSQL(ds)
+
+	result, err := ds.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to delete webhook %s", id)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine how many rows were affected")
+	}
+	if rowsAffected == 0 {
+		return suberrors.ErrWebhookNotFound
+	}
+
+	return nil
+}
+
+// AddFailedDelivery records a webhook delivery that failed after every retry.
+// Accepts a variable number of QueryOptions, though only WithTX is currently
+// supported.
+func (d *Database) AddFailedDelivery(ctx context.Context, delivery *FailedDelivery, opts ...QueryOption) error {
+	_, db := d.querySettings(opts...)
+
+	ds := db.Insert(t.FailedDeliveries).
+		Rows(goqu.Record{
+			"webhook_id": delivery.WebhookID,
+			"event_id":   delivery.EventID,
+			"event_type": delivery.EventType,
+			"payload":    delivery.Payload,
+			"attempts":   delivery.Attempts,
+			"last_error": delivery.LastError,
+		})
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to record the failed delivery of event %s", delivery.EventID)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+//go:build integration
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// addTestWebhook adds an enabled webhook with a unique URL for the event types.
+func addTestWebhook(t *testing.T, eventTypes ...string) *Webhook {
+	t.Helper()
+	ctx := context.Background()
+
+	webhook := &Webhook{
+		URL:        "https://example.org/" + uniqueName("hook"),
+		Secret:     "secret",
+		EventTypes: pq.StringArray(eventTypes),
+		Enabled:    true,
+	}
+	id, err := testDB.AddWebhook(ctx, webhook, "test")
+	if err != nil {
+		t.Fatalf("unable to add the webhook: %s", err)
+	}
+
+	loaded, err := testDB.GetWebhook(ctx, id)
+	if err != nil {
+		t.Fatalf("unable to look up the webhook: %s", err)
+	}
+	return loaded
+}
+
+// webhookIDs returns the set of IDs of the webhooks.
+func webhookIDs(webhooks []Webhook) map[string]bool {
+	ids := make(map[string]bool)
+	for _, webhook := range webhooks {
+		ids[webhook.ID] = true
+	}
+	return ids
+}
+
+func TestAddWebhook(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	webhook := addTestWebhook(t, api.EventSubscriptionCreated)
+	if webhook.Secret != "secret" || !webhook.Enabled || webhook.CreatedBy != "test" || webhook.LastModifiedBy != "test" {
+		t.Errorf("the webhook wasn't stored correctly: %+v", webhook)
+	}
+
+	webhooks, err := testDB.ListWebhooks(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the webhooks: %s", err)
+	}
+	if !webhookIDs(webhooks)[webhook.ID] {
+		t.Errorf("expected webhook %s to be listed", webhook.ID)
+	}
+
+	if _, err = testDB.GetWebhook(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, suberrors.ErrWebhookNotFound) {
+		t.Errorf("expected ErrWebhookNotFound, got %v", err)
+	}
+}
+
+func TestListWebhooksForEvent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	created := addTestWebhook(t, api.EventSubscriptionCreated, api.EventQuotaExceeded)
+	expired := addTestWebhook(t, api.EventSubscriptionExpired)
+	disabled := addTestWebhook(t, api.EventSubscriptionCreated)
+	disabled.Enabled = false
+	if err := testDB.UpdateWebhook(ctx, disabled, "test"); err != nil {
+		t.Fatalf("unable to disable the webhook: %s", err)
+	}
+
+	webhooks, err := testDB.ListWebhooksForEvent(ctx, api.EventSubscriptionCreated)
+	if err != nil {
+		t.Fatalf("unable to list the webhooks: %s", err)
+	}
+	ids := webhookIDs(webhooks)
+	if !ids[created.ID] {
+		t.Error("expected the webhook for the event to be listed")
+	}
+	if ids[expired.ID] {
+		t.Error("expected the webhook for another event not to be listed")
+	}
+	if ids[disabled.ID] {
+		t.Error("expected the disabled webhook not to be listed")
+	}
+}
+
+func TestUpdateWebhook(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	webhook := addTestWebhook(t, api.EventSubscriptionCreated)
+
+	// The secret is left alone if a new one isn't provided.
+	webhook.URL = "https://example.org/" + uniqueName("updated")
+	webhook.EventTypes = pq.StringArray{api.EventTrialExpiring}
+	webhook.Secret = ""
+	if err := testDB.UpdateWebhook(ctx, webhook, "updater"); err != nil {
+		t.Fatalf("unable to update the webhook: %s", err)
+	}
+
+	updated, err := testDB.GetWebhook(ctx, webhook.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the webhook: %s", err)
+	}
+	if updated.URL != webhook.URL || len(updated.EventTypes) != 1 || updated.EventTypes[0] != api.EventTrialExpiring {
+		t.Errorf("the webhook wasn't updated: %+v", updated)
+	}
+	if updated.Secret != "secret" || updated.LastModifiedBy != "updater" {
+		t.Errorf("expected the secret to be kept and the modifier to be recorded, got %+v", updated)
+	}
+
+	missing := &Webhook{ID: "00000000-0000-0000-0000-000000000000", URL: webhook.URL}
+	if err = testDB.UpdateWebhook(ctx, missing, "test"); !errors.Is(err, suberrors.ErrWebhookNotFound) {
+		t.Errorf("expected ErrWebhookNotFound, got %v", err)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	webhook := addTestWebhook(t, api.EventSubscriptionCreated)
+	err := testDB.AddFailedDelivery(ctx, &FailedDelivery{
+		WebhookID: webhook.ID,
+		EventID:   uuid.NewString(),
+		EventType: api.EventSubscriptionCreated,
+		Payload:   "{}",
+		Attempts:  3,
+		LastError: "connection refused",
+	})
+	if err != nil {
+		t.Fatalf("unable to record the failed delivery: %s", err)
+	}
+	if count := countRows(t, "failed_webhook_deliveries", goqu.Ex{"webhook_id": webhook.ID}); count != 1 {
+		t.Fatalf("expected 1 failed delivery, got %d", count)
+	}
+
+	if err = testDB.DeleteWebhook(ctx, webhook.ID); err != nil {
+		t.Fatalf("unable to delete the webhook: %s", err)
+	}
+	if count := countRows(t, "failed_webhook_deliveries", goqu.Ex{"webhook_id": webhook.ID}); count != 0 {
+		t.Errorf("expected the failed deliveries to be deleted, got %d", count)
+	}
+	if err = testDB.DeleteWebhook(ctx, webhook.ID); !errors.Is(err, suberrors.ErrWebhookNotFound) {
+		t.Errorf("expected ErrWebhookNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package errors
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DowngradeError is returned when a plan change would give a user less of a
+// non-consumable resource, such as data storage, than they're already using.
+type DowngradeError struct {
+	// PlanName is the name of the plan that the user would be moved to.
+	PlanName string
+
+	// Resources lists the names of the resource types whose usage exceeds the
+	// plan's quotas.
+	Resources []string
+}
+
+func (e *DowngradeError) Error() string {
+	return fmt.Sprintf(
+		"the usage of %s exceeds the quotas of the %s plan; set force to change plans anyway",
+		strings.Join(e.Resources, ", "), e.PlanName,
+	)
+}
+
+// downgradeError returns the downgrade error that caused err, if there is one.
+func downgradeError(err error) (*DowngradeError, bool) {
+	var downgradeErr *DowngradeError
+	ok := errors.As(err, &downgradeErr)
+	return downgradeErr, ok
+}
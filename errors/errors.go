@@ -6,26 +6,134 @@ import (
 
 	"github.com/cyverse-de/go-mod/gotelnats"
 	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
 var (
-	ErrUserNotFound            = errors.New("user name not found")
-	ErrInvalidUsername         = errors.New("invalid username")
-	ErrInvalidResourceName     = errors.New("invalid resource name")
-	ErrInvalidUsageValue       = errors.New("invalid usage value")
-	ErrInvalidUpdateType       = errors.New("invalid update type")
-	ErrInvalidResourceUnit     = errors.New("invalid resource unit")
-	ErrInvalidOperationName    = errors.New("invalid operation name")
-	ErrInvalidValueType        = errors.New("invalid value type")
-	ErrInvalidValue            = errors.New("invalid value")
-	ErrInvalidEffectiveDate    = errors.New("invalid effective date")
-	ErrAddonNotFound           = errors.New("add-on not found")
-	ErrSubAddonNotFound        = errors.New("subscription add-on not found")
-	ErrSubscriptionAddonsExist = errors.New("subscription add-ons exist")
+	ErrUserNotFound                 = errors.New("user name not found")
+	ErrInvalidUsername              = errors.New("invalid username")
+	ErrInvalidResourceName          = errors.New("invalid resource name")
+	ErrInvalidUsageValue            = errors.New("invalid usage value")
+	ErrInvalidUpdateType            = errors.New("invalid update type")
+	ErrInvalidResourceUnit          = errors.New("invalid resource unit")
+	ErrInvalidOperationName         = errors.New("invalid operation name")
+	ErrInvalidValueType             = errors.New("invalid value type")
+	ErrInvalidValue                 = errors.New("invalid value")
+	ErrInvalidEffectiveDate         = errors.New("invalid effective date")
+	ErrAddonNotFound                = errors.New("add-on not found")
+	ErrSubAddonNotFound             = errors.New("subscription add-on not found")
+	ErrSubscriptionAddonsExist      = errors.New("subscription add-ons exist")
+	ErrBulkJobNotFound              = errors.New("bulk job not found")
+	ErrEmptyCohort                  = errors.New("no usernames provided for the cohort")
+	ErrNoCohortAction               = errors.New("no cohort action requested")
+	ErrWebhookNotFound              = errors.New("webhook not found")
+	ErrInvalidWebhook               = errors.New("invalid webhook")
+	ErrDatabaseReadOnly             = errors.New("the database is temporarily read-only; please retry the request later")
+	ErrDeadlineExceeded             = errors.New("the request could not be completed within its time budget")
+	ErrPlanNotFound                 = errors.New("plan not found")
+	ErrPlanChangeNotFound           = errors.New("pending plan change not found")
+	ErrPlanChangeExists             = errors.New("a plan change is already pending for the subscription")
+	ErrUnknownEventType             = errors.New("unknown event type")
+	ErrInvalidExternalID            = errors.New("an external ID requires an external source")
+	ErrExternalIDExists             = errors.New("the external ID is already in use")
+	ErrExternalIDNotFound           = errors.New("external ID not found")
+	ErrNotTrialPlan                 = errors.New("the plan is not a trial plan")
+	ErrTrialAlreadyUsed             = errors.New("the user has already had a trial subscription to the plan")
+	ErrInvalidTrialLength           = errors.New("the trial length must be at least one day")
+	ErrUserExists                   = errors.New("the user already exists")
+	ErrInvalidMerge                 = errors.New("a user can't be merged into itself")
+	ErrInvalidMergePolicy           = errors.New("unknown subscription merge policy")
+	ErrInvalidReportWindow          = errors.New("the report window is invalid")
+	ErrInvalidRate                  = errors.New("the rate must not be negative")
+	ErrResourceTypeExists           = errors.New("the resource type already exists")
+	ErrResourceTypeNotFound         = errors.New("resource type not found")
+	ErrResourceTypeInUse            = errors.New("the unit of a resource type that's in use can't be changed")
+	ErrDefaultPlanDeletion          = errors.New("the default plan can't be deleted")
+	ErrInvalidIncludeDeleted        = errors.New("include_deleted must be true or false")
+	ErrVersionConflict              = errors.New("the record was changed by another request")
+	ErrInvalidVersion               = errors.New("the expected version must be a positive integer")
+	ErrUnsupportedExportFormat      = errors.New("unsupported export format; use csv or parquet")
+	ErrObjectStorageDisabled        = errors.New("object storage isn't configured")
+	ErrServiceBusy                  = errors.New("the service is too busy to handle the request; please retry the request later")
+	ErrRequestInProgress            = errors.New("an earlier request with the same message ID is still being handled; please retry the request later")
+	ErrInvalidUpdateMask            = errors.New("the update mask names a field that can't be updated")
+	ErrInvalidForecastModel         = errors.New("invalid forecast model")
+	ErrReservationNotFound          = errors.New("reservation not found")
+	ErrInsufficientQuota            = errors.New("not enough quota remains for the reservation")
+	ErrInvalidReservation           = errors.New("a reservation requires at least one resource with a positive amount")
+	ErrInvalidDuration              = errors.New("invalid duration")
+	ErrInvalidPeriod                = errors.New("the subscription period must be monthly, quarterly, yearly or a positive number of days")
+	ErrGroupNotFound                = errors.New("group not found")
+	ErrGroupExists                  = errors.New("a group with the same name already exists")
+	ErrInvalidGroupName             = errors.New("a group name is required")
+	ErrInvalidAddonAttribution      = errors.New("usage can only be attributed to an add-on of the current subscription for the same resource type")
+	ErrDiscountCodeNotFound         = errors.New("discount code not found")
+	ErrDiscountCodeExists           = errors.New("the discount code already exists")
+	ErrDiscountCodeUnavailable      = errors.New("the discount code has expired or has been redeemed the maximum number of times")
+	ErrInvalidDiscount              = errors.New("a discount must be a percentage between 0 and 100 or a positive fixed amount")
+	ErrInvalidDiscountCode          = errors.New("a discount code is required")
+	ErrSubscriptionNotFound         = errors.New("subscription not found")
+	ErrInvoiceExists                = errors.New("an invoice has already been generated for the subscription period")
+	ErrInvoiceNotFound              = errors.New("invoice not found")
+	ErrInvalidInvoicePeriod         = errors.New("the invoice period must end after it starts and overlap the subscription")
+	ErrInvalidPaymentStatus         = errors.New("the payment status must be pending, paid, failed, refunded or waived")
+	ErrInvalidPaymentTransition     = errors.New("the subscription's payment status can't be changed to the requested status")
+	ErrPlanExists                   = errors.New("a plan with the same name already exists")
+	ErrInvalidQuotaPolicy           = errors.New("the quota policy mode must be hard or soft")
+	ErrInvalidAmount                = errors.New("the requested amount must not be negative")
+	ErrBundleNotFound               = errors.New("add-on bundle not found")
+	ErrBundleExists                 = errors.New("an add-on bundle with the same name already exists")
+	ErrAddonPrerequisitesNotMet     = errors.New("the subscription doesn't meet the prerequisites of the add-on")
+	ErrEmptyBundle                  = errors.New("an add-on bundle must contain at least one add-on")
+	ErrSelfPrerequisite             = errors.New("an add-on can't be a prerequisite of itself")
+	ErrAddonNotCompatible           = errors.New("the add-on can't be attached to a subscription to this plan")
+	ErrAddonLimitReached            = errors.New("the subscription already has the maximum number of units of the add-on")
+	ErrInvalidQuantity              = errors.New("the quantity must be a positive integer")
+	ErrQuotaChangeNotFound          = errors.New("pending quota change not found")
+	ErrInvalidQuota                 = errors.New("the quota must not be negative")
+	ErrInvalidGranularity           = errors.New("the granularity must be daily or monthly")
+	ErrRetentionDisabled            = errors.New("the retention period for updates isn't configured")
+	ErrInvalidQuotaAdjustment       = errors.New("the quota adjustment operation must be add or set")
+	ErrNoAdjustmentTargets          = errors.New("either a list of usernames or a plan name is required, but not both")
+	ErrInvalidDryRun                = errors.New("dry_run must be true or false")
+	ErrInvalidAddonEndDate          = errors.New("the add-on end date must be an RFC 3339 timestamp in the future")
+	ErrInvalidCreditAmount          = errors.New("the credit amount must be greater than zero")
+	ErrCreditsNotConsumable         = errors.New("credits can only be deposited for consumable resource types")
+	ErrInvalidUsageRule             = errors.New("the usage rule action must be reject, flag or quarantine and its minimum can't exceed its maximum")
+	ErrFlaggedUpdateNotFound        = errors.New("flagged usage update not found")
+	ErrQuarantineNotFound           = errors.New("quarantined usage update not found")
+	ErrQuarantineResolved           = errors.New("the quarantined usage update has already been approved or rejected")
+	ErrInvalidQuarantineStatus      = errors.New("the quarantine status must be pending, approved or rejected")
+	ErrPerpetualSubscription        = errors.New("perpetual subscriptions don't end, so changes can't be scheduled for their end")
+	ErrPerpetualEndDate             = errors.New("a perpetual subscription can't have an end date")
+	ErrInvalidPerpetual             = errors.New("perpetual must be true or false")
+	ErrInvalidDefaultPaid           = errors.New("default_paid must be true or false")
+	ErrInvalidAddonSort             = errors.New("add-ons can only be sorted by name, resource_type, default_amount or default_paid")
+	ErrNoteNotFound                 = errors.New("subscription note not found")
+	ErrTagNotFound                  = errors.New("subscription tag not found")
+	ErrInvalidTagKey                = errors.New("tag keys can't be blank or contain '='")
+	ErrPlanFeatureNotFound          = errors.New("plan feature not found")
+	ErrInvalidAsOf                  = errors.New("the as-of time must be a valid timestamp")
+	ErrReconciliationDisabled       = errors.New("usage reconciliation sources aren't configured")
+	ErrReconciliationSourceNotFound = errors.New("no usage reconciliation source is configured for the resource type")
+	ErrPurchaseNotFound             = errors.New("subscription purchase not found")
+	ErrPurchasePending              = errors.New("a subscription purchase is already pending for the user")
+	ErrPurchaseNotPending           = errors.New("the subscription purchase is no longer pending")
+	ErrPurchaseExpired              = errors.New("the subscription purchase has expired")
 )
 
 func HTTPStatusCode(err error) int {
+	if _, ok := validationError(err); ok {
+		return http.StatusBadRequest
+	}
+	if _, ok := downgradeError(err); ok {
+		return http.StatusConflict
+	}
+	if _, ok := UsageRejection(err); ok {
+		return http.StatusBadRequest
+	}
+
 	switch err {
 	case ErrUserNotFound:
 		return http.StatusNotFound
@@ -53,12 +161,219 @@ func HTTPStatusCode(err error) int {
 		return http.StatusNotFound
 	case ErrSubscriptionAddonsExist:
 		return http.StatusConflict
+	case ErrBulkJobNotFound:
+		return http.StatusNotFound
+	case ErrEmptyCohort:
+		return http.StatusBadRequest
+	case ErrNoCohortAction:
+		return http.StatusBadRequest
+	case ErrWebhookNotFound:
+		return http.StatusNotFound
+	case ErrInvalidWebhook:
+		return http.StatusBadRequest
+	case ErrDatabaseReadOnly:
+		return http.StatusServiceUnavailable
+	case ErrDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case ErrPlanNotFound:
+		return http.StatusNotFound
+	case ErrPlanChangeNotFound:
+		return http.StatusNotFound
+	case ErrPlanChangeExists:
+		return http.StatusConflict
+	case ErrUnknownEventType:
+		return http.StatusNotFound
+	case ErrInvalidExternalID:
+		return http.StatusBadRequest
+	case ErrExternalIDExists:
+		return http.StatusConflict
+	case ErrExternalIDNotFound:
+		return http.StatusNotFound
+	case ErrNotTrialPlan:
+		return http.StatusBadRequest
+	case ErrTrialAlreadyUsed:
+		return http.StatusConflict
+	case ErrInvalidTrialLength:
+		return http.StatusBadRequest
+	case ErrUserExists:
+		return http.StatusConflict
+	case ErrInvalidMerge:
+		return http.StatusBadRequest
+	case ErrInvalidMergePolicy:
+		return http.StatusBadRequest
+	case ErrInvalidReportWindow:
+		return http.StatusBadRequest
+	case ErrInvalidRate:
+		return http.StatusBadRequest
+	case ErrResourceTypeExists:
+		return http.StatusConflict
+	case ErrResourceTypeNotFound:
+		return http.StatusNotFound
+	case ErrResourceTypeInUse:
+		return http.StatusConflict
+	case ErrDefaultPlanDeletion:
+		return http.StatusBadRequest
+	case ErrInvalidIncludeDeleted:
+		return http.StatusBadRequest
+	case ErrVersionConflict:
+		return http.StatusConflict
+	case ErrInvalidVersion:
+		return http.StatusBadRequest
+	case ErrUnsupportedExportFormat:
+		return http.StatusBadRequest
+	case ErrObjectStorageDisabled:
+		return http.StatusServiceUnavailable
+	case ErrServiceBusy:
+		return http.StatusTooManyRequests
+	case ErrRequestInProgress:
+		return http.StatusConflict
+	case ErrInvalidUpdateMask:
+		return http.StatusBadRequest
+	case ErrInvalidForecastModel:
+		return http.StatusBadRequest
+	case ErrReservationNotFound:
+		return http.StatusNotFound
+	case ErrInsufficientQuota:
+		return http.StatusForbidden
+	case ErrInvalidReservation:
+		return http.StatusBadRequest
+	case ErrInvalidDuration:
+		return http.StatusBadRequest
+	case ErrInvalidPeriod:
+		return http.StatusBadRequest
+	case ErrGroupNotFound:
+		return http.StatusNotFound
+	case ErrGroupExists:
+		return http.StatusConflict
+	case ErrInvalidGroupName:
+		return http.StatusBadRequest
+	case ErrInvalidAddonAttribution:
+		return http.StatusBadRequest
+	case ErrDiscountCodeNotFound:
+		return http.StatusNotFound
+	case ErrDiscountCodeExists:
+		return http.StatusConflict
+	case ErrDiscountCodeUnavailable:
+		return http.StatusConflict
+	case ErrInvalidDiscount:
+		return http.StatusBadRequest
+	case ErrInvalidDiscountCode:
+		return http.StatusBadRequest
+	case ErrSubscriptionNotFound:
+		return http.StatusNotFound
+	case ErrInvoiceExists:
+		return http.StatusConflict
+	case ErrInvoiceNotFound:
+		return http.StatusNotFound
+	case ErrInvalidInvoicePeriod:
+		return http.StatusBadRequest
+	case ErrInvalidPaymentStatus:
+		return http.StatusBadRequest
+	case ErrInvalidPaymentTransition:
+		return http.StatusConflict
+	case ErrPlanExists:
+		return http.StatusConflict
+	case ErrInvalidQuotaPolicy:
+		return http.StatusBadRequest
+	case ErrInvalidAmount:
+		return http.StatusBadRequest
+	case ErrBundleNotFound:
+		return http.StatusNotFound
+	case ErrBundleExists:
+		return http.StatusConflict
+	case ErrAddonPrerequisitesNotMet:
+		return http.StatusConflict
+	case ErrEmptyBundle:
+		return http.StatusBadRequest
+	case ErrSelfPrerequisite:
+		return http.StatusBadRequest
+	case ErrAddonNotCompatible:
+		return http.StatusConflict
+	case ErrAddonLimitReached:
+		return http.StatusConflict
+	case ErrInvalidQuantity:
+		return http.StatusBadRequest
+	case ErrQuotaChangeNotFound:
+		return http.StatusNotFound
+	case ErrInvalidQuota:
+		return http.StatusBadRequest
+	case ErrInvalidGranularity:
+		return http.StatusBadRequest
+	case ErrRetentionDisabled:
+		return http.StatusConflict
+	case ErrInvalidQuotaAdjustment:
+		return http.StatusBadRequest
+	case ErrNoAdjustmentTargets:
+		return http.StatusBadRequest
+	case ErrInvalidDryRun:
+		return http.StatusBadRequest
+	case ErrInvalidAddonEndDate:
+		return http.StatusBadRequest
+	case ErrInvalidCreditAmount:
+		return http.StatusBadRequest
+	case ErrCreditsNotConsumable:
+		return http.StatusBadRequest
+	case ErrInvalidUsageRule:
+		return http.StatusBadRequest
+	case ErrFlaggedUpdateNotFound:
+		return http.StatusNotFound
+	case ErrQuarantineNotFound:
+		return http.StatusNotFound
+	case ErrQuarantineResolved:
+		return http.StatusConflict
+	case ErrInvalidQuarantineStatus:
+		return http.StatusBadRequest
+	case ErrPerpetualSubscription:
+		return http.StatusConflict
+	case ErrPerpetualEndDate:
+		return http.StatusBadRequest
+	case ErrInvalidPerpetual:
+		return http.StatusBadRequest
+	case ErrInvalidDefaultPaid:
+		return http.StatusBadRequest
+	case ErrInvalidAddonSort:
+		return http.StatusBadRequest
+	case ErrNoteNotFound:
+		return http.StatusNotFound
+	case ErrTagNotFound:
+		return http.StatusNotFound
+	case ErrInvalidTagKey:
+		return http.StatusBadRequest
+	case ErrPlanFeatureNotFound:
+		return http.StatusNotFound
+	case ErrInvalidAsOf:
+		return http.StatusBadRequest
+	case ErrReconciliationDisabled:
+		return http.StatusConflict
+	case ErrReconciliationSourceNotFound:
+		return http.StatusNotFound
+	case ErrPurchaseNotFound:
+		return http.StatusNotFound
+	case ErrPurchasePending:
+		return http.StatusConflict
+	case ErrPurchaseNotPending:
+		return http.StatusConflict
+	case ErrPurchaseExpired:
+		return http.StatusConflict
 	default:
 		return http.StatusInternalServerError
 	}
 }
 
 func NatsStatusCode(err error) svcerror.ErrorCode {
+	if validationErr, ok := validationError(err); ok {
+		if validationErr.Type == TypeInvalidUUID {
+			return svcerror.ErrorCode_PARAMETER_INVALID
+		}
+		return svcerror.ErrorCode_PARAMETER_MISSING
+	}
+	if _, ok := downgradeError(err); ok {
+		return svcerror.ErrorCode_BAD_REQUEST
+	}
+	if _, ok := UsageRejection(err); ok {
+		return svcerror.ErrorCode_BAD_REQUEST
+	}
+
 	switch err {
 	case ErrUserNotFound:
 		return svcerror.ErrorCode_NOT_FOUND
@@ -66,6 +381,8 @@ func NatsStatusCode(err error) svcerror.ErrorCode {
 		return svcerror.ErrorCode_NOT_FOUND
 	case ErrSubAddonNotFound:
 		return svcerror.ErrorCode_NOT_FOUND
+	case ErrBulkJobNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
 	case ErrInvalidUsername:
 		return svcerror.ErrorCode_BAD_REQUEST
 	case ErrInvalidResourceName:
@@ -86,15 +403,238 @@ func NatsStatusCode(err error) svcerror.ErrorCode {
 		return svcerror.ErrorCode_BAD_REQUEST
 	case ErrSubscriptionAddonsExist:
 		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrEmptyCohort:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrNoCohortAction:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrWebhookNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidWebhook:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrDatabaseReadOnly:
+		return svcerror.ErrorCode_UNSUPPORTED
+	case ErrDeadlineExceeded:
+		return svcerror.ErrorCode_TIMEOUT
+	case ErrPlanNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrPlanChangeNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrPlanChangeExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrUnknownEventType:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidExternalID:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrExternalIDExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrExternalIDNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrNotTrialPlan:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrTrialAlreadyUsed:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidTrialLength:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrUserExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidMerge:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidMergePolicy:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidReportWindow:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidRate:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrResourceTypeExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrResourceTypeNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrResourceTypeInUse:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrDefaultPlanDeletion:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidIncludeDeleted:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrVersionConflict:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidVersion:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrUnsupportedExportFormat:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrObjectStorageDisabled:
+		return svcerror.ErrorCode_UNSUPPORTED
+	case ErrServiceBusy:
+		return svcerror.ErrorCode_UNSUPPORTED
+	case ErrRequestInProgress:
+		return svcerror.ErrorCode_UNSUPPORTED
+	case ErrInvalidUpdateMask:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidForecastModel:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrReservationNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInsufficientQuota:
+		return svcerror.ErrorCode_FORBIDDEN
+	case ErrInvalidReservation:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidDuration:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidPeriod:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrGroupNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrGroupExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidGroupName:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidAddonAttribution:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrDiscountCodeNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrDiscountCodeExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrDiscountCodeUnavailable:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidDiscount:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidDiscountCode:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrSubscriptionNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvoiceExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvoiceNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidInvoicePeriod:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidPaymentStatus:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidPaymentTransition:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPlanExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidQuotaPolicy:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidAmount:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrBundleNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrBundleExists:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrAddonPrerequisitesNotMet:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrEmptyBundle:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrSelfPrerequisite:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrAddonNotCompatible:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrAddonLimitReached:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidQuantity:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrQuotaChangeNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidQuota:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidGranularity:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrRetentionDisabled:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidQuotaAdjustment:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrNoAdjustmentTargets:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidDryRun:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidAddonEndDate:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidCreditAmount:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrCreditsNotConsumable:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidUsageRule:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrFlaggedUpdateNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrQuarantineNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrQuarantineResolved:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidQuarantineStatus:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPerpetualSubscription:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPerpetualEndDate:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidPerpetual:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidDefaultPaid:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrInvalidAddonSort:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrNoteNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrTagNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidTagKey:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPlanFeatureNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrInvalidAsOf:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrReconciliationDisabled:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrReconciliationSourceNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrPurchaseNotFound:
+		return svcerror.ErrorCode_NOT_FOUND
+	case ErrPurchasePending:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPurchaseNotPending:
+		return svcerror.ErrorCode_BAD_REQUEST
+	case ErrPurchaseExpired:
+		return svcerror.ErrorCode_BAD_REQUEST
 	default:
 		return svcerror.ErrorCode_INTERNAL
 	}
 }
 
+// readOnlyTransaction is the PostgreSQL error code returned when a statement
+// that modifies data is executed against a database that is read-only.
+const readOnlyTransaction = pq.ErrorCode("25006")
+
+// IsReadOnlyError returns true if the error was caused by an attempt to modify
+// a read-only database.
+func IsReadOnlyError(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == readOnlyTransaction
+}
+
 func NatsError(ctx context.Context, err error) *svcerror.ServiceError {
+	// Don't pass raw driver errors along to callers when the database is in
+	// read-only mode, such as during a failover.
+	if IsReadOnlyError(err) {
+		err = ErrDatabaseReadOnly
+	}
+
+	// Requests that were turned away because too many requests for the same
+	// subject were already in progress are reported as such, whatever error
+	// the cancelled context caused.
+	if errors.Is(context.Cause(ctx), ErrServiceBusy) {
+		err = ErrServiceBusy
+	}
+
+	// Report requests that ran out of time consistently, regardless of where
+	// the deadline was noticed.
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = ErrDeadlineExceeded
+	}
+
 	return gotelnats.InitServiceError(
 		ctx, err, &gotelnats.ErrorOptions{
-			ErrorCode: NatsStatusCode(err),
+			ErrorCode:  NatsStatusCode(err),
+			StatusCode: int32(HTTPStatusCode(err)),
 		},
 	)
 }
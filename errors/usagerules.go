@@ -0,0 +1,63 @@
+package errors
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UsageRejectedError is returned when a usage update breaks the validation
+// rules of its resource type and the rules say that such updates are rejected.
+type UsageRejectedError struct {
+	// ResourceName is the name of the resource type that the update is for.
+	ResourceName string
+
+	// Reasons lists the rules that the update breaks.
+	Reasons []string
+}
+
+func (e *UsageRejectedError) Error() string {
+	return fmt.Sprintf(
+		"the usage update for %s was rejected: %s",
+		e.ResourceName, strings.Join(e.Reasons, "; "),
+	)
+}
+
+// UsageRejection returns the rejected usage error that caused err, if there is
+// one.
+func UsageRejection(err error) (*UsageRejectedError, bool) {
+	var rejectedErr *UsageRejectedError
+	ok := errors.As(err, &rejectedErr)
+	return rejectedErr, ok
+}
+
+// UsageQuarantinedError is returned when a usage update breaks the validation
+// rules of its resource type and the rules say that such updates are held for
+// review. The update has been quarantined rather than applied, so callers that
+// can hold updates treat it as a result rather than as a failure.
+type UsageQuarantinedError struct {
+	// ID is the identifier of the quarantined update.
+	ID string
+
+	// ResourceName is the name of the resource type that the update is for.
+	ResourceName string
+
+	// Reasons lists the rules that the update breaks.
+	Reasons []string
+}
+
+func (e *UsageQuarantinedError) Error() string {
+	return fmt.Sprintf(
+		"the usage update for %s was quarantined for review: %s",
+		e.ResourceName, strings.Join(e.Reasons, "; "),
+	)
+}
+
+// UsageQuarantine returns the quarantined usage error that caused err, if
+// there is one.
+func UsageQuarantine(err error) (*UsageQuarantinedError, bool) {
+	var quarantinedErr *UsageQuarantinedError
+	ok := errors.As(err, &quarantinedErr)
+	return quarantinedErr, ok
+}
@@ -0,0 +1,84 @@
+package errors
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/pkg/errors"
+)
+
+// The types of errors that clients can branch on. Service errors don't have a
+// field for the type, so each type is identified by its error code or status
+// code instead; ErrorType recovers the type from a service error.
+const (
+	// TypeMissingField means that a required field wasn't set. The error code
+	// is PARAMETER_MISSING.
+	TypeMissingField = "MISSING_FIELD"
+
+	// TypeInvalidUUID means that a field that has to contain a UUID doesn't.
+	// The error code is PARAMETER_INVALID.
+	TypeInvalidUUID = "INVALID_UUID"
+
+	// TypeNotFound means that the requested object doesn't exist. The error
+	// code is NOT_FOUND.
+	TypeNotFound = "NOT_FOUND"
+
+	// TypeConflict means that the request conflicts with the current state of
+	// the object, such as an object with the same name. The status code is 409.
+	TypeConflict = "CONFLICT"
+)
+
+// ValidationError is returned when a field in a request is missing or invalid.
+type ValidationError struct {
+	// Type is either TypeMissingField or TypeInvalidUUID.
+	Type string
+
+	// Field is the name of the field in the request.
+	Field string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Type == TypeInvalidUUID {
+		return fmt.Sprintf("%s must be a valid UUID", e.Field)
+	}
+	return fmt.Sprintf("%s must be set", e.Field)
+}
+
+// MissingField returns the error for a required field that isn't set.
+func MissingField(field string) error {
+	return &ValidationError{Type: TypeMissingField, Field: field}
+}
+
+// InvalidUUID returns the error for a field that doesn't contain a UUID.
+func InvalidUUID(field string) error {
+	return &ValidationError{Type: TypeInvalidUUID, Field: field}
+}
+
+// validationError returns the validation error that caused err, if there is
+// one.
+func validationError(err error) (*ValidationError, bool) {
+	var validationErr *ValidationError
+	ok := errors.As(err, &validationErr)
+	return validationErr, ok
+}
+
+// ErrorType returns the type of a service error: one of the Type constants, or
+// the name of the error code for errors that don't have a more specific type.
+// Returns an empty string if there's no error.
+func ErrorType(serviceErr *svcerror.ServiceError) string {
+	switch {
+	case serviceErr == nil:
+		return ""
+	case serviceErr.StatusCode == http.StatusConflict:
+		return TypeConflict
+	case serviceErr.ErrorCode == svcerror.ErrorCode_PARAMETER_MISSING:
+		return TypeMissingField
+	case serviceErr.ErrorCode == svcerror.ErrorCode_PARAMETER_INVALID:
+		return TypeInvalidUUID
+	case serviceErr.ErrorCode == svcerror.ErrorCode_NOT_FOUND:
+		return TypeNotFound
+	default:
+		return serviceErr.ErrorCode.String()
+	}
+}
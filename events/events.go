@@ -0,0 +1,206 @@
+// Package events publishes the domain events recorded in the outbox table to a
+// NATS JetStream stream. Events are recorded in the same transactions as the
+// changes that they describe, so an event is published if and only if its
+// changes were committed. Each event is published with its ID as the JetStream
+// message ID, which allows the server to discard duplicates if an event is
+// published more than once, for example when the service restarts after
+// publishing an event but before marking it as published.
+package events
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "events"})
+
+// SchemaVersionHeader is the name of the message header that contains the
+// schema version of the event payload.
+const SchemaVersionHeader = "QMS-Schema-Version"
+
+// EventTypeHeader is the name of the message header that contains the event type.
+const EventTypeHeader = "QMS-Event-Type"
+
+// EventTypes lists the types of events that are published.
+var EventTypes = []string{
+	api.EventSubscriptionCreated,
+	api.EventSubscriptionRenewed,
+	api.EventSubscriptionExpired,
+	api.EventSubscriptionExpiring,
+	api.EventAddonAttached,
+	api.EventUsageUpdated,
+	api.EventQuotaUpdated,
+	api.EventQuotaExceeded,
+}
+
+// Settings controls how events are published.
+type Settings struct {
+	// StreamName is the name of the JetStream stream that events are published to.
+	StreamName string
+
+	// SubjectPrefix is prepended to the event type to get the subject that an
+	// event is published on.
+	SubjectPrefix string
+
+	// Interval is the amount of time to wait between checks of the outbox.
+	Interval time.Duration
+
+	// BatchSize is the maximum number of events to publish at a time.
+	BatchSize uint
+
+	// MaxAge is the amount of time that events are retained in the stream.
+	MaxAge time.Duration
+}
+
+// DefaultSettings returns the default settings for publishing events.
+func DefaultSettings() Settings {
+	return Settings{
+		StreamName:    "QMS_EVENTS",
+		SubjectPrefix: "cyverse.qms",
+		Interval:      time.Second,
+		BatchSize:     100,
+		MaxAge:        7 * 24 * time.Hour,
+	}
+}
+
+// Publisher publishes the events in the outbox to JetStream.
+type Publisher struct {
+	db       *db.Database
+	js       nats.JetStreamContext
+	settings Settings
+}
+
+// NewPublisher returns a new *Publisher.
+func NewPublisher(d *db.Database, js nats.JetStreamContext, settings Settings) *Publisher {
+	return &Publisher{
+		db:       d,
+		js:       js,
+		settings: settings,
+	}
+}
+
+// Subject returns the subject that events of the given type are published on.
+func (p *Publisher) Subject(eventType string) string {
+	return fmt.Sprintf("%s.%s", p.settings.SubjectPrefix, eventType)
+}
+
+// subjects returns the subjects that the stream captures.
+func (p *Publisher) subjects() []string {
+	subjects := make([]string, len(EventTypes))
+	for i, eventType := range EventTypes {
+		subjects[i] = p.Subject(eventType)
+	}
+	return subjects
+}
+
+// EnsureStream creates the stream that events are published to if it doesn't
+// exist already, and updates its subjects and retention settings if it does.
+func (p *Publisher) EnsureStream() error {
+	config := &nats.StreamConfig{
+		Name:       p.settings.StreamName,
+		Subjects:   p.subjects(),
+		Storage:    nats.FileStorage,
+		MaxAge:     p.settings.MaxAge,
+		Duplicates: 2 * time.Minute,
+	}
+
+	_, err := p.js.StreamInfo(p.settings.StreamName)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = p.js.AddStream(config)
+	case err == nil:
+		_, err = p.js.UpdateStream(config)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to configure the %s stream", p.settings.StreamName)
+	}
+
+	return nil
+}
+
+// Start publishes events from the outbox at regular intervals until the context
+// is done.
+func (p *Publisher) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.settings.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Keep publishing until the outbox is drained.
+			for {
+				count, err := p.PublishPending(ctx)
+				if err != nil {
+					log.Errorf("unable to publish events: %s", err)
+				}
+				if err != nil || count < int(p.settings.BatchSize) {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// PublishPending publishes a single batch of events from the outbox and returns
+// the number of events that were published.
+func (p *Publisher) PublishPending(ctx context.Context) (int, error) {
+	var (
+		published  []string
+		publishErr error
+	)
+
+	err := p.db.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		published, publishErr = nil, nil
+
+		pending, err := p.db.UnpublishedOutboxEvents(ctx, p.settings.BatchSize, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		// Stop at the first failure, but still mark the events that were
+		// published before it so that they aren't published again.
+		for _, event := range pending {
+			if publishErr = p.publish(ctx, &event); publishErr != nil {
+				break
+			}
+			published = append(published, event.ID)
+		}
+
+		return p.db.MarkOutboxEventsPublished(ctx, published, db.WithTX(tx))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(published), publishErr
+}
+
+// publish publishes a single event.
+func (p *Publisher) publish(ctx context.Context, event *db.OutboxEvent) error {
+	msg := nats.NewMsg(p.Subject(event.EventType))
+	msg.Data = []byte(event.Payload)
+	msg.Header.Set(nats.MsgIdHdr, event.ID)
+	msg.Header.Set(EventTypeHeader, event.EventType)
+	msg.Header.Set(SchemaVersionHeader, strconv.Itoa(event.SchemaVersion))
+
+	if _, err := p.js.PublishMsg(msg, nats.Context(ctx)); err != nil {
+		return errors.Wrapf(err, "unable to publish event %s", event.ID)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// CSVWriter writes an export as CSV with a header row. Missing values are
+// written as empty fields and timestamps are written in RFC 3339 format.
+type CSVWriter struct {
+	columns []Column
+	w       *csv.Writer
+	record  []string
+}
+
+// NewCSVWriter returns a writer that writes CSV to w, starting with the header.
+func NewCSVWriter(w io.Writer, columns []Column) (*CSVWriter, error) {
+	cw := &CSVWriter{
+		columns: columns,
+		w:       csv.NewWriter(w),
+		record:  make([]string, len(columns)),
+	}
+
+	for i, column := range columns {
+		cw.record[i] = column.Name
+	}
+	if err := cw.w.Write(cw.record); err != nil {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (cw *CSVWriter) Write(values []any) error {
+	if len(values) != len(cw.columns) {
+		return fmt.Errorf("expected %d values but got %d", len(cw.columns), len(values))
+	}
+
+	for i, value := range values {
+		if err := checkValue(cw.columns[i], value); err != nil {
+			return err
+		}
+
+		switch v := value.(type) {
+		case nil:
+			cw.record[i] = ""
+		case string:
+			cw.record[i] = v
+		case float64:
+			cw.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			cw.record[i] = strconv.FormatBool(v)
+		case time.Time:
+			cw.record[i] = v.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return cw.w.Write(cw.record)
+}
+
+func (cw *CSVWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
@@ -0,0 +1,94 @@
+// Package export writes tabular data, such as subscriptions along with their
+// quotas and usages, in formats that are convenient for offline analysis.
+// Rows are written as they're produced, so exports of large tables don't have
+// to be held in memory.
+package export
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// The supported export formats.
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// ColumnType is the type of the values in a column.
+type ColumnType int
+
+// The supported column types. The values written to a column must be a string,
+// float64, bool or time.Time respectively, or nil if the value is missing.
+const (
+	String ColumnType = iota
+	Double
+	Bool
+	Timestamp
+)
+
+// Column describes a column of an export.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Writer writes the rows of an export. Close must be called once every row has
+// been written; the export is incomplete until then.
+type Writer interface {
+	// Write writes a row, which must contain a value for each column.
+	Write(values []any) error
+
+	// Close writes any buffered rows along with the trailing metadata, if the
+	// format has any. It doesn't close the underlying writer.
+	Close() error
+}
+
+// ValidFormat returns true if the export format is supported.
+func ValidFormat(format string) bool {
+	return format == FormatCSV || format == FormatParquet
+}
+
+// ContentType returns the media type of the export format.
+func ContentType(format string) string {
+	if format == FormatParquet {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv"
+}
+
+// NewWriter returns a writer for the export format that writes to w.
+func NewWriter(format string, w io.Writer, columns []Column) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVWriter(w, columns)
+	case FormatParquet:
+		return NewParquetWriter(w, columns), nil
+	default:
+		return nil, fmt.Errorf("unsupported export format: %q", format)
+	}
+}
+
+// checkValue returns an error if the value can't be written to the column.
+func checkValue(column Column, value any) error {
+	if value == nil {
+		return nil
+	}
+
+	var ok bool
+	switch column.Type {
+	case String:
+		_, ok = value.(string)
+	case Double:
+		_, ok = value.(float64)
+	case Bool:
+		_, ok = value.(bool)
+	case Timestamp:
+		_, ok = value.(time.Time)
+	}
+	if !ok {
+		return fmt.Errorf("invalid value for column %s: %v", column.Name, value)
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// DefaultRowGroupSize is the number of rows buffered before they're written to
+// a Parquet file as a row group.
+const DefaultRowGroupSize = 10000
+
+// The Parquet constants used by the writer.
+const (
+	parquetBoolean   int32 = 0
+	parquetInt64     int32 = 2
+	parquetDouble    int32 = 5
+	parquetByteArray int32 = 6
+
+	parquetOptional int32 = 1
+
+	parquetUTF8            int32 = 0
+	parquetTimestampMillis int32 = 9
+
+	parquetPlain int32 = 0
+	parquetRLE   int32 = 3
+
+	parquetDataPage int32 = 0
+)
+
+var parquetMagic = []byte("PAR1")
+
+// parquetColumn buffers the values of a column for the current row group.
+type parquetColumn struct {
+	Column
+	defined []bool
+	bools   []bool
+	values  bytes.Buffer
+}
+
+// columnChunk records where a column chunk was written.
+type columnChunk struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+// rowGroup records where a row group was written.
+type rowGroup struct {
+	columns []columnChunk
+	size    int64
+	numRows int64
+}
+
+// ParquetWriter writes an export as a Parquet file. Every column is optional,
+// values are PLAIN-encoded and nothing is compressed, which keeps the writer
+// simple while remaining readable by any Parquet implementation. Rows are
+// buffered until a row group is full, so memory use is bounded by the row group
+// size rather than by the size of the export.
+type ParquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []*parquetColumn
+	rowGroupSize int
+	numRows      int
+	rowGroups    []rowGroup
+	err          error
+}
+
+// NewParquetWriter returns a writer that writes a Parquet file to w.
+func NewParquetWriter(w io.Writer, columns []Column) *ParquetWriter {
+	pw := &ParquetWriter{w: w, rowGroupSize: DefaultRowGroupSize}
+	for _, column := range columns {
+		pw.columns = append(pw.columns, &parquetColumn{Column: column})
+	}
+	pw.write(parquetMagic)
+	return pw
+}
+
+// write writes to the underlying writer unless an earlier write failed, and
+// keeps track of the offset of the next write.
+func (pw *ParquetWriter) write(p []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(p)
+	pw.offset += int64(n)
+	pw.err = err
+}
+
+func (pw *ParquetWriter) Write(values []any) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(values) != len(pw.columns) {
+		return fmt.Errorf("expected %d values but got %d", len(pw.columns), len(values))
+	}
+	for i, value := range values {
+		if err := checkValue(pw.columns[i].Column, value); err != nil {
+			return err
+		}
+	}
+
+	for i, value := range values {
+		column := pw.columns[i]
+		column.defined = append(column.defined, value != nil)
+
+		switch v := value.(type) {
+		case string:
+			column.values.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(v))))
+			column.values.WriteString(v)
+		case float64:
+			column.values.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(v)))
+		case bool:
+			column.bools = append(column.bools, v)
+		case time.Time:
+			column.values.Write(binary.LittleEndian.AppendUint64(nil, uint64(v.UnixMilli())))
+		}
+	}
+
+	pw.numRows++
+	if pw.numRows >= pw.rowGroupSize {
+		pw.flush()
+	}
+	return pw.err
+}
+
+// flush writes the buffered rows as a row group containing a single data page
+// per column.
+func (pw *ParquetWriter) flush() {
+	if pw.numRows == 0 {
+		return
+	}
+
+	group := rowGroup{numRows: int64(pw.numRows)}
+	for _, column := range pw.columns {
+		page := column.page()
+
+		var header thriftWriter
+		header.beginStruct()
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(page)))
+		header.structField(5)
+		header.i32Field(1, int32(pw.numRows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := columnChunk{
+			offset:    pw.offset,
+			size:      int64(header.buf.Len() + len(page)),
+			numValues: int64(pw.numRows),
+		}
+		pw.write(header.buf.Bytes())
+		pw.write(page)
+
+		group.columns = append(group.columns, chunk)
+		group.size += chunk.size
+
+		column.defined = column.defined[:0]
+		column.bools = column.bools[:0]
+		column.values.Reset()
+	}
+
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.numRows = 0
+}
+
+// page returns the contents of a data page for the buffered values: the
+// length-prefixed definition levels followed by the values.
+func (c *parquetColumn) page() []byte {
+	levels := rleBooleans(c.defined)
+
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+	if c.Type == Bool {
+		// Booleans are bit-packed, least significant bit first.
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, v := range c.bools {
+			if v {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append(page, packed...)
+	}
+	return append(page, c.values.Bytes()...)
+}
+
+// rleBooleans encodes values with a bit width of one using runs of the RLE and
+// bit-packing hybrid encoding.
+func rleBooleans(values []bool) []byte {
+	var result []byte
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && values[j] == values[i] {
+			j++
+		}
+		result = binary.AppendUvarint(result, uint64(j-i)<<1)
+		if values[i] {
+			result = append(result, 1)
+		} else {
+			result = append(result, 0)
+		}
+		i = j
+	}
+	return result
+}
+
+// physicalType returns the Parquet physical type and converted type of the
+// column. The converted type is negative if there isn't one.
+func (c *Column) physicalType() (int32, int32) {
+	switch c.Type {
+	case Double:
+		return parquetDouble, -1
+	case Bool:
+		return parquetBoolean, -1
+	case Timestamp:
+		return parquetInt64, parquetTimestampMillis
+	default:
+		return parquetByteArray, parquetUTF8
+	}
+}
+
+// Close writes the remaining rows along with the file metadata.
+func (pw *ParquetWriter) Close() error {
+	pw.flush()
+
+	var numRows int64
+	for _, group := range pw.rowGroups {
+		numRows += group.numRows
+	}
+
+	var meta thriftWriter
+	meta.beginStruct()
+	meta.i32Field(1, 1)
+
+	meta.listField(2, thriftStruct, len(pw.columns)+1)
+	meta.beginStruct()
+	meta.stringField(4, "schema")
+	meta.i32Field(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, column := range pw.columns {
+		physical, converted := column.physicalType()
+		meta.beginStruct()
+		meta.i32Field(1, physical)
+		meta.i32Field(3, parquetOptional)
+		meta.stringField(4, column.Name)
+		if converted >= 0 {
+			meta.i32Field(6, converted)
+		}
+		meta.endStruct()
+	}
+
+	meta.i64Field(3, numRows)
+
+	meta.listField(4, thriftStruct, len(pw.rowGroups))
+	for _, group := range pw.rowGroups {
+		meta.beginStruct()
+		meta.listField(1, thriftStruct, len(group.columns))
+		for i, chunk := range group.columns {
+			physical, _ := pw.columns[i].physicalType()
+			meta.beginStruct()
+			meta.i64Field(2, chunk.offset)
+			meta.structField(3)
+			meta.i32Field(1, physical)
+			meta.listField(2, thriftI32, 2)
+			meta.zigzag(int64(parquetPlain))
+			meta.zigzag(int64(parquetRLE))
+			meta.listField(3, thriftBinary, 1)
+			meta.str(pw.columns[i].Name)
+			meta.i32Field(4, 0)
+			meta.i64Field(5, chunk.numValues)
+			meta.i64Field(6, chunk.size)
+			meta.i64Field(7, chunk.size)
+			meta.i64Field(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.i64Field(2, group.size)
+		meta.i64Field(3, group.numRows)
+		meta.endStruct()
+	}
+
+	meta.stringField(6, "cyverse-de/subscriptions")
+	meta.endStruct()
+
+	pw.write(meta.buf.Bytes())
+	pw.write(binary.LittleEndian.AppendUint32(nil, uint32(meta.buf.Len())))
+	pw.write(parquetMagic)
+	return pw.err
+}
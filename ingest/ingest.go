@@ -0,0 +1,309 @@
+// Package ingest consumes usage updates from a NATS JetStream stream, as an
+// alternative to the request/reply subject for producers that report usage in
+// bursts, such as telemetry collectors. Producers publish AddUsage messages to
+// the stream and don't wait for a response, so a burst is absorbed by the
+// stream instead of piling up in front of the service. The service pulls the
+// messages in batches, so it only takes on as much work as it can handle, and
+// acknowledges each batch once it's been processed. Messages that fail because
+// of the request itself are discarded; messages that fail for any other reason
+// are redelivered later, up to a limit.
+//
+// The messages in a batch are grouped by normalized username. Each user's messages are
+// applied one at a time in the order that they were published, while the
+// messages of different users are applied concurrently. If one of a user's
+// messages fails, the user's later messages in the batch are redelivered along
+// with it so that they aren't applied ahead of it. Ordering is only kept within
+// a single consumer, so only one instance of the service should consume the
+// stream if the order of SET updates matters.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/service"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "ingest"})
+
+// Handler applies a single usage update. It has the same signature as the
+// AddUsage method of service.QMS.
+type Handler func(context.Context, *qms.AddUsage) (*qms.UsageResponse, error)
+
+// Normalizer returns the form of a username that the handler stores, such as
+// the one without the user domain, so that the messages for the same user are
+// grouped together however their usernames are written.
+type Normalizer func(string) (string, error)
+
+// Settings controls how usage updates are consumed.
+type Settings struct {
+	// StreamName is the name of the JetStream stream that usage updates are
+	// published to.
+	StreamName string
+
+	// Subject is the subject that producers publish usage updates on.
+	Subject string
+
+	// Durable is the name of the durable pull consumer. Instances of the service
+	// that use the same name share the messages.
+	Durable string
+
+	// BatchSize is the maximum number of messages to fetch at a time.
+	BatchSize int
+
+	// MaxWait is the longest amount of time to wait for a batch to fill up.
+	MaxWait time.Duration
+
+	// Workers is the maximum number of users whose updates are applied at once.
+	Workers int
+
+	// AckWait is the amount of time that the server waits for a message to be
+	// acknowledged before delivering it again. Each batch has to be processed
+	// within it.
+	AckWait time.Duration
+
+	// MaxDeliver is the number of times that a message is delivered before the
+	// server gives up on it.
+	MaxDeliver int
+
+	// RetryDelay is the amount of time to wait before a message that failed is
+	// delivered again.
+	RetryDelay time.Duration
+
+	// MaxAge is the amount of time that messages are kept in the stream if they
+	// aren't consumed.
+	MaxAge time.Duration
+}
+
+// DefaultSettings returns the default settings for consuming usage updates.
+func DefaultSettings() Settings {
+	return Settings{
+		StreamName: "QMS_USAGES",
+		Subject:    "qms.usages.ingest",
+		Durable:    "subscriptions",
+		BatchSize:  100,
+		MaxWait:    5 * time.Second,
+		Workers:    8,
+		AckWait:    time.Minute,
+		MaxDeliver: 5,
+		RetryDelay: 10 * time.Second,
+		MaxAge:     7 * 24 * time.Hour,
+	}
+}
+
+// permanentCodes lists the error codes of responses that mean the update itself
+// was at fault, so delivering it again wouldn't help.
+var permanentCodes = map[svcerror.ErrorCode]bool{
+	svcerror.ErrorCode_BAD_REQUEST:       true,
+	svcerror.ErrorCode_NOT_FOUND:         true,
+	svcerror.ErrorCode_UNMARSHAL_FAILURE: true,
+	svcerror.ErrorCode_PARAMETER_MISSING: true,
+	svcerror.ErrorCode_PARAMETER_INVALID: true,
+}
+
+// permanent returns true if an error returned by the handler means that the
+// update should be discarded rather than delivered again.
+func permanent(err error) bool {
+	var serviceErr *service.Error
+	return errors.As(err, &serviceErr) && permanentCodes[serviceErr.GetErrorCode()]
+}
+
+// Consumer pulls usage updates from the stream and applies them.
+type Consumer struct {
+	js        nats.JetStreamContext
+	handler   Handler
+	normalize Normalizer
+	settings  Settings
+}
+
+// NewConsumer returns a new *Consumer.
+func NewConsumer(js nats.JetStreamContext, handler Handler, normalize Normalizer, settings Settings) *Consumer {
+	return &Consumer{
+		js:        js,
+		handler:   handler,
+		normalize: normalize,
+		settings:  settings,
+	}
+}
+
+// username returns the normalized username that a usage update is for. If the
+// username can't be normalized, it's returned as is and the handler rejects the
+// update.
+func (c *Consumer) username(request *qms.AddUsage) string {
+	if c.normalize == nil {
+		return request.Username
+	}
+	username, err := c.normalize(request.Username)
+	if err != nil {
+		return request.Username
+	}
+	return username
+}
+
+// EnsureStream creates the stream that usage updates are published to if it
+// doesn't exist already, and updates its subject and retention settings if it
+// does. Messages are removed from the stream once they've been acknowledged.
+func (c *Consumer) EnsureStream() error {
+	config := &nats.StreamConfig{
+		Name:      c.settings.StreamName,
+		Subjects:  []string{c.settings.Subject},
+		Retention: nats.WorkQueuePolicy,
+		Storage:   nats.FileStorage,
+		MaxAge:    c.settings.MaxAge,
+	}
+
+	_, err := c.js.StreamInfo(c.settings.StreamName)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = c.js.AddStream(config)
+	case err == nil:
+		_, err = c.js.UpdateStream(config)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to configure the %s stream: %w", c.settings.StreamName, err)
+	}
+
+	return nil
+}
+
+// Start subscribes to the stream and applies batches of usage updates until the
+// context is done. The next batch isn't fetched until the current one has been
+// processed, and the server doesn't hand out more than two batches' worth of
+// unacknowledged messages, which keeps bursts from overloading the service.
+func (c *Consumer) Start(ctx context.Context) error {
+	sub, err := c.js.PullSubscribe(
+		c.settings.Subject,
+		c.settings.Durable,
+		nats.BindStream(c.settings.StreamName),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.AckWait(c.settings.AckWait),
+		nats.MaxDeliver(c.settings.MaxDeliver),
+		nats.MaxAckPending(2*c.settings.BatchSize),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to create the %s consumer: %w", c.settings.Durable, err)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			msgs, err := sub.Fetch(c.settings.BatchSize, nats.MaxWait(c.settings.MaxWait))
+			if err != nil && !errors.Is(err, nats.ErrTimeout) {
+				log.Errorf("unable to fetch usage updates: %s", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(c.settings.RetryDelay):
+				}
+				continue
+			}
+			if len(msgs) > 0 {
+				c.ProcessBatch(ctx, msgs)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// ProcessBatch applies a batch of usage updates and then acknowledges the ones
+// that were applied or discarded, and asks for the rest to be delivered again.
+func (c *Consumer) ProcessBatch(ctx context.Context, msgs []*nats.Msg) {
+	ctx, cancel := context.WithTimeout(ctx, c.settings.AckWait)
+	defer cancel()
+
+	// Group the messages by user, keeping each user's messages in order, and
+	// spread the users over the workers.
+	workers := max(c.settings.Workers, 1)
+	shards := make([][]*nats.Msg, workers)
+	requests := make(map[*nats.Msg]*qms.AddUsage, len(msgs))
+	usernames := make(map[*nats.Msg]string, len(msgs))
+	outcomes := make(map[*nats.Msg]error, len(msgs))
+	for _, msg := range msgs {
+		request := &qms.AddUsage{}
+		if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(msg.Data, request); err != nil {
+			outcomes[msg] = service.ResponseError(&svcerror.ServiceError{
+				ErrorCode: svcerror.ErrorCode_UNMARSHAL_FAILURE,
+				Message:   err.Error(),
+			})
+			continue
+		}
+		requests[msg] = request
+		usernames[msg] = c.username(request)
+
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(usernames[msg]))
+		shard := int(hash.Sum32() % uint32(workers))
+		shards[shard] = append(shards[shard], msg)
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shard []*nats.Msg) {
+			defer wg.Done()
+			failed := make(map[string]bool)
+			for _, msg := range shard {
+				username := usernames[msg]
+				var err error
+				if failed[username] {
+					err = fmt.Errorf("an earlier update for %s failed", username)
+				} else {
+					_, err = c.handler(ctx, requests[msg])
+				}
+				if err != nil && !permanent(err) {
+					failed[username] = true
+				}
+				mu.Lock()
+				outcomes[msg] = err
+				mu.Unlock()
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	// Acknowledge the batch in the order that it was delivered.
+	var applied, discarded, retried int
+	for _, msg := range msgs {
+		err := outcomes[msg]
+		switch {
+		case err == nil:
+			applied++
+			err = msg.Ack()
+		case permanent(err):
+			discarded++
+			log.Errorf("discarding a usage update for %q: %s", requests[msg].GetUsername(), err)
+			err = msg.Term()
+		default:
+			retried++
+			err = msg.NakWithDelay(c.settings.RetryDelay)
+		}
+		if err != nil {
+			log.Errorf("unable to acknowledge a usage update: %s", err)
+		}
+	}
+
+	log.Debugf("processed %d usage updates: %d applied, %d discarded, %d retried", len(msgs), applied, discarded, retried)
+}
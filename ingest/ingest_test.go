@@ -0,0 +1,61 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func usageMsg(t *testing.T, username string, value float64) *nats.Msg {
+	t.Helper()
+	data, err := protojson.Marshal(&qms.AddUsage{Username: username, ResourceName: "cpu.hours", UsageValue: value})
+	if err != nil {
+		t.Fatalf("unable to marshal the usage update: %s", err)
+	}
+	return &nats.Msg{Subject: "qms.usages.ingest", Data: data}
+}
+
+func TestProcessBatchGroupsMixedCaseUsernames(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		applied []float64
+	)
+	handler := func(_ context.Context, request *qms.AddUsage) (*qms.UsageResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// The first update fails with an error that's worth retrying, so the
+		// user's later updates have to be held back however they're written.
+		if request.UsageValue == 1 {
+			return nil, errors.New("the database is unavailable")
+		}
+		applied = append(applied, request.UsageValue)
+		return &qms.UsageResponse{}, nil
+	}
+	normalize := func(username string) (string, error) {
+		return strings.ToLower(username), nil
+	}
+
+	settings := DefaultSettings()
+	settings.Workers = 16
+	settings.AckWait = 5 * time.Second
+	consumer := NewConsumer(nil, handler, normalize, settings)
+
+	consumer.ProcessBatch(context.Background(), []*nats.Msg{
+		usageMsg(t, "Alice", 1),
+		usageMsg(t, "alice", 2),
+		usageMsg(t, "ALICE", 3),
+		usageMsg(t, "bob", 4),
+	})
+
+	if len(applied) != 1 || applied[0] != 4 {
+		t.Errorf("expected only the update for another user to be applied; got %v", applied)
+	}
+}
@@ -0,0 +1,518 @@
+// Package legacy imports the users, plans, subscriptions, quotas and usages
+// dumped from the old QMS service. The legacy identifiers are mapped to the
+// records in this service: users are matched by username, plans and resource
+// types by name, and each imported subscription records its legacy ID as an
+// external reference, so importing the same dump again skips the
+// subscriptions that were already imported. The dump is checked for
+// referential integrity before anything is loaded, and everything is loaded
+// in a single transaction, so a failed import leaves the database untouched.
+package legacy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/doug-martin/goqu/v9"
+)
+
+// ExternalSource is the external source recorded for imported subscriptions.
+const ExternalSource = "legacy-qms"
+
+// User is a user in the dump.
+type User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// Plan is a plan in the dump.
+type Plan struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Rate        float64 `json:"rate"`
+}
+
+// Subscription is a subscription in the dump. A subscription without an end
+// date is perpetual.
+type Subscription struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	PlanID    string `json:"plan_id"`
+	StartDate string `json:"start_date"`
+	EndDate   string `json:"end_date"`
+	Paid      bool   `json:"paid"`
+}
+
+// Quota is a subscription's quota for a resource type in the dump.
+type Quota struct {
+	SubscriptionID string  `json:"subscription_id"`
+	ResourceType   string  `json:"resource_type"`
+	Value          float64 `json:"value"`
+}
+
+// Usage is a subscription's usage of a resource type in the dump.
+type Usage struct {
+	SubscriptionID string  `json:"subscription_id"`
+	ResourceType   string  `json:"resource_type"`
+	Value          float64 `json:"value"`
+}
+
+// Dump is the data dumped from the old QMS service.
+type Dump struct {
+	Users         []User         `json:"users"`
+	Plans         []Plan         `json:"plans"`
+	Subscriptions []Subscription `json:"subscriptions"`
+	Quotas        []Quota        `json:"quotas"`
+	Usages        []Usage        `json:"usages"`
+}
+
+// ValidationError lists the problems found in a dump.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("the dump has %d problems, starting with: %s", len(e.Problems), e.Problems[0])
+}
+
+// Validate checks that every record in the dump has the fields it needs, that
+// the legacy IDs are unique and that every reference to another record can be
+// resolved. Returns a ValidationError listing every problem, or nil if there
+// aren't any.
+func (d *Dump) Validate() error {
+	var problems []string
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	users := make(map[string]bool, len(d.Users))
+	usernames := make(map[string]bool, len(d.Users))
+	for i, u := range d.Users {
+		switch {
+		case u.ID == "":
+			problem("user %d: missing ID", i+1)
+		case users[u.ID]:
+			problem("user %s: duplicate ID", u.ID)
+		}
+		users[u.ID] = true
+
+		username := strings.TrimSpace(u.Username)
+		switch {
+		case username == "":
+			problem("user %s: missing username", u.ID)
+		case usernames[username]:
+			problem("user %s: duplicate username %s", u.ID, username)
+		}
+		usernames[username] = true
+	}
+
+	plans := make(map[string]bool, len(d.Plans))
+	planNames := make(map[string]bool, len(d.Plans))
+	for i, p := range d.Plans {
+		switch {
+		case p.ID == "":
+			problem("plan %d: missing ID", i+1)
+		case plans[p.ID]:
+			problem("plan %s: duplicate ID", p.ID)
+		}
+		plans[p.ID] = true
+
+		name := strings.TrimSpace(p.Name)
+		switch {
+		case name == "":
+			problem("plan %s: missing name", p.ID)
+		case planNames[name]:
+			problem("plan %s: duplicate name %s", p.ID, name)
+		}
+		planNames[name] = true
+
+		if p.Rate < 0 {
+			problem("plan %s: negative rate %g", p.ID, p.Rate)
+		}
+	}
+
+	subscriptions := make(map[string]bool, len(d.Subscriptions))
+	for i, s := range d.Subscriptions {
+		switch {
+		case s.ID == "":
+			problem("subscription %d: missing ID", i+1)
+		case subscriptions[s.ID]:
+			problem("subscription %s: duplicate ID", s.ID)
+		}
+		subscriptions[s.ID] = true
+
+		if !users[s.UserID] {
+			problem("subscription %s: unknown user %s", s.ID, s.UserID)
+		}
+		if !plans[s.PlanID] {
+			problem("subscription %s: unknown plan %s", s.ID, s.PlanID)
+		}
+
+		start, end, err := s.period()
+		if err != nil {
+			problem("subscription %s: %s", s.ID, err)
+		} else if end.Valid && !end.Time.After(start) {
+			problem("subscription %s: ends before it starts", s.ID)
+		}
+	}
+
+	quotas := make(map[string]bool, len(d.Quotas))
+	for _, q := range d.Quotas {
+		checkValue(problem, "quota", q.SubscriptionID, q.ResourceType, q.Value, subscriptions, quotas)
+	}
+
+	usages := make(map[string]bool, len(d.Usages))
+	for _, u := range d.Usages {
+		checkValue(problem, "usage", u.SubscriptionID, u.ResourceType, u.Value, subscriptions, usages)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// checkValue checks a quota or usage in the dump. Each subscription may only
+// have one value of each kind per resource type.
+func checkValue(
+	problem func(string, ...any), kind, subscriptionID, resourceType string, value float64,
+	subscriptions, seen map[string]bool,
+) {
+	if !subscriptions[subscriptionID] {
+		problem("%s for %s: unknown subscription %s", kind, resourceType, subscriptionID)
+	}
+	if resourceType == "" {
+		problem("%s for subscription %s: missing resource type", kind, subscriptionID)
+	}
+	if value < 0 {
+		problem("%s for %s in subscription %s: negative value %g", kind, resourceType, subscriptionID, value)
+	}
+
+	key := subscriptionID + "\x00" + resourceType
+	if seen[key] {
+		problem("%s for %s in subscription %s: duplicate", kind, resourceType, subscriptionID)
+	}
+	seen[key] = true
+}
+
+// period parses the start and end dates of the subscription.
+func (s *Subscription) period() (time.Time, sql.NullTime, error) {
+	var end sql.NullTime
+
+	start, err := utils.ParseTimestamp(s.StartDate)
+	if err != nil {
+		return start, end, fmt.Errorf("invalid start date %q", s.StartDate)
+	}
+
+	if s.EndDate != "" {
+		if end.Time, err = utils.ParseTimestamp(s.EndDate); err != nil {
+			return start, end, fmt.Errorf("invalid end date %q", s.EndDate)
+		}
+		end.Valid = true
+	}
+
+	return start, end, nil
+}
+
+// Settings controls how a dump is imported.
+type Settings struct {
+	// CreatedBy is recorded as the creator of the imported records.
+	CreatedBy string
+
+	// NormalizeUsername converts the usernames in the dump to the form that the
+	// service uses. The usernames are used as they are if it's nil.
+	NormalizeUsername func(string) (string, error)
+
+	// PlanNames maps the names of legacy plans to the names of the plans that
+	// they correspond to, for plans that have been renamed.
+	PlanNames map[string]string
+
+	// ResourceTypes maps the names of legacy resource types to the names of the
+	// resource types that they correspond to, for resource types that have been
+	// renamed.
+	ResourceTypes map[string]string
+
+	// DryRun rolls the import back once it's done, so that the report can be
+	// reviewed without changing anything.
+	DryRun bool
+}
+
+// ImportedSubscription describes what happened to a subscription in the dump.
+type ImportedSubscription struct {
+	LegacyID       string
+	Username       string
+	PlanName       string
+	SubscriptionID string
+	Skipped        bool
+}
+
+// Report describes the outcome of an import.
+type Report struct {
+	UsersAdded           int
+	UsersMatched         int
+	PlansAdded           int
+	PlansMatched         int
+	SubscriptionsAdded   int
+	SubscriptionsSkipped int
+	Quotas               int
+	Usages               int
+	Subscriptions        []ImportedSubscription
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// importer keeps track of an import in progress.
+type importer struct {
+	d             *db.Database
+	tx            *goqu.TxDatabase
+	settings      *Settings
+	report        *Report
+	resourceTypes map[string]string
+}
+
+// Import validates the dump and loads it into the database in a single
+// transaction. Subscriptions that were imported before are skipped along with
+// their quotas and usages. Plans that don't exist yet are added with the rate
+// from the dump, effective from the start of their earliest subscription.
+// Resource types have to exist already.
+func Import(ctx context.Context, d *db.Database, dump *Dump, settings *Settings) (*Report, error) {
+	if err := dump.Validate(); err != nil {
+		return nil, err
+	}
+
+	var report *Report
+	err := d.InTx(ctx, func(tx *goqu.TxDatabase) error {
+		report = &Report{}
+		imp := &importer{
+			d:             d,
+			tx:            tx,
+			settings:      settings,
+			report:        report,
+			resourceTypes: make(map[string]string),
+		}
+		if err := imp.run(ctx, dump); err != nil {
+			return err
+		}
+		if settings.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// run loads the dump.
+func (imp *importer) run(ctx context.Context, dump *Dump) error {
+	userIDs, usernames, err := imp.users(ctx, dump)
+	if err != nil {
+		return err
+	}
+
+	plans, err := imp.plans(ctx, dump)
+	if err != nil {
+		return err
+	}
+
+	quotas := make(map[string][]Quota)
+	for _, q := range dump.Quotas {
+		quotas[q.SubscriptionID] = append(quotas[q.SubscriptionID], q)
+	}
+	usages := make(map[string][]Usage)
+	for _, u := range dump.Usages {
+		usages[u.SubscriptionID] = append(usages[u.SubscriptionID], u)
+	}
+
+	for i := range dump.Subscriptions {
+		s := &dump.Subscriptions[i]
+		plan := plans[s.PlanID]
+		imported := ImportedSubscription{
+			LegacyID: s.ID,
+			Username: usernames[s.UserID],
+			PlanName: plan.Name,
+		}
+
+		ref := &db.ExternalRef{Source: ExternalSource, ID: s.ID}
+		existing, err := imp.d.SubscriptionIDForExternalRef(ctx, ref, db.WithTX(imp.tx))
+		if err != nil {
+			return err
+		}
+		if existing != "" {
+			imported.SubscriptionID = existing
+			imported.Skipped = true
+			imp.report.SubscriptionsSkipped++
+			imp.report.Subscriptions = append(imp.report.Subscriptions, imported)
+			continue
+		}
+
+		start, end, err := s.period()
+		if err != nil {
+			return err
+		}
+		imported.SubscriptionID, err = imp.d.AddImportedSubscription(ctx, &db.ImportedSubscription{
+			UserID:             userIDs[s.UserID],
+			Plan:               plan,
+			EffectiveStartDate: start,
+			EffectiveEndDate:   end,
+			Paid:               s.Paid,
+			CreatedBy:          imp.settings.CreatedBy,
+			ExternalRef:        ref,
+		}, db.WithTX(imp.tx))
+		if err != nil {
+			return fmt.Errorf("unable to import subscription %s: %w", s.ID, err)
+		}
+		imp.report.SubscriptionsAdded++
+		imp.report.Subscriptions = append(imp.report.Subscriptions, imported)
+
+		for _, q := range quotas[s.ID] {
+			resourceTypeID, err := imp.resourceTypeID(ctx, q.ResourceType)
+			if err != nil {
+				return err
+			}
+			if err = imp.d.UpsertQuota(ctx, q.Value, resourceTypeID, imported.SubscriptionID, db.WithTX(imp.tx)); err != nil {
+				return fmt.Errorf("unable to import the %s quota for subscription %s: %w", q.ResourceType, s.ID, err)
+			}
+			imp.report.Quotas++
+		}
+
+		for _, u := range usages[s.ID] {
+			resourceTypeID, err := imp.resourceTypeID(ctx, u.ResourceType)
+			if err != nil {
+				return err
+			}
+			_, _, err = imp.d.ApplyUsage(ctx, db.UpdateTypeSet, u.Value, resourceTypeID, imported.SubscriptionID, db.WithTX(imp.tx))
+			if err != nil {
+				return fmt.Errorf("unable to import the %s usage for subscription %s: %w", u.ResourceType, s.ID, err)
+			}
+			imp.report.Usages++
+		}
+	}
+
+	return nil
+}
+
+// users adds the users in the dump that don't exist yet. Returns the IDs and
+// usernames of the users, keyed by their legacy IDs.
+func (imp *importer) users(ctx context.Context, dump *Dump) (map[string]string, map[string]string, error) {
+	userIDs := make(map[string]string, len(dump.Users))
+	usernames := make(map[string]string, len(dump.Users))
+
+	for _, u := range dump.Users {
+		username := strings.TrimSpace(u.Username)
+		if imp.settings.NormalizeUsername != nil {
+			var err error
+			if username, err = imp.settings.NormalizeUsername(username); err != nil {
+				return nil, nil, fmt.Errorf("user %s: %w", u.ID, err)
+			}
+		}
+
+		exists, err := imp.d.UserExists(ctx, username, db.WithTX(imp.tx))
+		if err != nil {
+			return nil, nil, err
+		}
+		user, err := imp.d.EnsureUser(ctx, username, db.WithTX(imp.tx))
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			imp.report.UsersMatched++
+		} else {
+			imp.report.UsersAdded++
+		}
+
+		userIDs[u.ID] = user.ID
+		usernames[u.ID] = username
+	}
+
+	return userIDs, usernames, nil
+}
+
+// plans adds the plans in the dump that don't exist yet. Returns the plans
+// keyed by their legacy IDs.
+func (imp *importer) plans(ctx context.Context, dump *Dump) (map[string]*db.Plan, error) {
+	// New plans get their rate from the start of their earliest subscription,
+	// so that every imported subscription has a rate to refer to.
+	earliest := make(map[string]time.Time)
+	for i := range dump.Subscriptions {
+		s := &dump.Subscriptions[i]
+		start, _, err := s.period()
+		if err != nil {
+			return nil, err
+		}
+		if e, ok := earliest[s.PlanID]; !ok || start.Before(e) {
+			earliest[s.PlanID] = start
+		}
+	}
+
+	plans := make(map[string]*db.Plan, len(dump.Plans))
+	for _, p := range dump.Plans {
+		name := strings.TrimSpace(p.Name)
+		if mapped, ok := imp.settings.PlanNames[name]; ok {
+			name = mapped
+		}
+
+		plan, err := imp.d.GetPlanByName(ctx, name, db.WithTX(imp.tx))
+		if err != nil {
+			return nil, err
+		}
+
+		if plan == nil {
+			effectiveDate, ok := earliest[p.ID]
+			if !ok {
+				effectiveDate = time.Now()
+			}
+			_, err = imp.d.AddPlan(ctx, &db.Plan{
+				Name:        name,
+				Description: p.Description,
+				Rates:       []db.PlanRate{{EffectiveDate: effectiveDate, Rate: p.Rate}},
+			}, db.WithTX(imp.tx))
+			if err != nil {
+				return nil, fmt.Errorf("unable to add plan %s: %w", name, err)
+			}
+			if plan, err = imp.d.GetPlanByName(ctx, name, db.WithTX(imp.tx)); err != nil {
+				return nil, err
+			}
+			imp.report.PlansAdded++
+		} else {
+			imp.report.PlansMatched++
+		}
+
+		plans[p.ID] = plan
+	}
+
+	return plans, nil
+}
+
+// resourceTypeID returns the ID of the resource type that corresponds to the
+// legacy resource type.
+func (imp *importer) resourceTypeID(ctx context.Context, legacyName string) (string, error) {
+	if id, ok := imp.resourceTypes[legacyName]; ok {
+		return id, nil
+	}
+
+	name := legacyName
+	if mapped, ok := imp.settings.ResourceTypes[name]; ok {
+		name = mapped
+	}
+
+	resourceType, err := imp.d.GetResourceTypeByName(ctx, name, db.WithTX(imp.tx))
+	if err != nil {
+		return "", err
+	}
+	if resourceType.ID == "" {
+		return "", fmt.Errorf("resource type not found: %s", name)
+	}
+
+	imp.resourceTypes[legacyName] = resourceType.ID
+	return resourceType.ID, nil
+}
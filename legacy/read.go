@@ -0,0 +1,216 @@
+package legacy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// The supported dump formats.
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Read reads a dump in the given format. A JSON dump is a single file with a
+// list of records for each kind of record. A CSV dump is a directory
+// containing users.csv, plans.csv, subscriptions.csv, quotas.csv and
+// usages.csv, each with a header row naming the same fields as the JSON
+// dump; files that are missing are treated as empty.
+func Read(path, format string) (*Dump, error) {
+	switch format {
+	case FormatJSON:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close() // nolint:errcheck
+		return ReadJSON(f)
+	case FormatCSV:
+		return ReadCSV(path)
+	default:
+		return nil, fmt.Errorf("unsupported dump format: %s", format)
+	}
+}
+
+// ReadJSON reads a JSON dump.
+func ReadJSON(r io.Reader) (*Dump, error) {
+	var dump Dump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return nil, fmt.Errorf("invalid JSON dump: %w", err)
+	}
+	return &dump, nil
+}
+
+// ReadCSV reads a CSV dump from the directory.
+func ReadCSV(dir string) (*Dump, error) {
+	dump := &Dump{}
+
+	err := readCSVFile(dir, "users.csv", func(row csvRow) error {
+		dump.Users = append(dump.Users, User{ID: row.get("id"), Username: row.get("username")})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCSVFile(dir, "plans.csv", func(row csvRow) error {
+		rate, err := row.float("rate")
+		if err != nil {
+			return err
+		}
+		dump.Plans = append(dump.Plans, Plan{
+			ID:          row.get("id"),
+			Name:        row.get("name"),
+			Description: row.get("description"),
+			Rate:        rate,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCSVFile(dir, "subscriptions.csv", func(row csvRow) error {
+		paid, err := row.bool("paid")
+		if err != nil {
+			return err
+		}
+		dump.Subscriptions = append(dump.Subscriptions, Subscription{
+			ID:        row.get("id"),
+			UserID:    row.get("user_id"),
+			PlanID:    row.get("plan_id"),
+			StartDate: row.get("start_date"),
+			EndDate:   row.get("end_date"),
+			Paid:      paid,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCSVFile(dir, "quotas.csv", func(row csvRow) error {
+		value, err := row.float("value")
+		if err != nil {
+			return err
+		}
+		dump.Quotas = append(dump.Quotas, Quota{
+			SubscriptionID: row.get("subscription_id"),
+			ResourceType:   row.get("resource_type"),
+			Value:          value,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readCSVFile(dir, "usages.csv", func(row csvRow) error {
+		value, err := row.float("value")
+		if err != nil {
+			return err
+		}
+		dump.Usages = append(dump.Usages, Usage{
+			SubscriptionID: row.get("subscription_id"),
+			ResourceType:   row.get("resource_type"),
+			Value:          value,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dump, nil
+}
+
+// csvRow is a row of a CSV file along with the columns named in its header.
+type csvRow struct {
+	columns map[string]int
+	record  []string
+}
+
+// get returns the value of the named column, or an empty string if the file
+// doesn't have the column.
+func (r csvRow) get(name string) string {
+	i, ok := r.columns[name]
+	if !ok || i >= len(r.record) {
+		return ""
+	}
+	return r.record[i]
+}
+
+// float returns the value of the named column as a number. Empty values are
+// treated as zero.
+func (r csvRow) float(name string) (float64, error) {
+	value := r.get(name)
+	if value == "" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return f, nil
+}
+
+// bool returns the value of the named column as a boolean. Empty values are
+// treated as false.
+func (r csvRow) bool(name string) (bool, error) {
+	value := r.get(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return b, nil
+}
+
+// readCSVFile calls fn for each row after the header of the named file in the
+// directory. Nothing is read if the file doesn't exist.
+func readCSVFile(dir, name string, fn func(csvRow) error) error {
+	path := filepath.Join(dir, name)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint:errcheck
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	row := csvRow{columns: make(map[string]int, len(header))}
+	for i, column := range header {
+		row.columns[column] = i
+	}
+
+	for line := 2; ; line++ {
+		if row.record, err = r.Read(); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err = fn(row); err != nil {
+			return fmt.Errorf("%s, line %d: %w", path, line, err)
+		}
+	}
+}
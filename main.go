@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cyverse-de/go-mod/cfg"
@@ -17,12 +20,25 @@ import (
 	"github.com/cyverse-de/go-mod/protobufjson"
 	qmssubs "github.com/cyverse-de/go-mod/subjects/qms"
 	"github.com/cyverse-de/subscriptions/app"
+	"github.com/cyverse-de/subscriptions/billing"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/events"
+	"github.com/cyverse-de/subscriptions/ingest"
+	"github.com/cyverse-de/subscriptions/migrations"
 	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/cyverse-de/subscriptions/overagekv"
+	"github.com/cyverse-de/subscriptions/storage"
+	"github.com/cyverse-de/subscriptions/subcache"
+	"github.com/cyverse-de/subscriptions/subjects"
+	"github.com/cyverse-de/subscriptions/usernames"
+	"github.com/cyverse-de/subscriptions/webhooks"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/uptrace/opentelemetry-go-extra/otelsql"
 	"github.com/uptrace/opentelemetry-go-extra/otelsqlx"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
@@ -35,35 +51,435 @@ import (
 
 const serviceName = "subscriptions"
 
+// DefaultGRPCPort is the port that the gRPC API is served on when it's enabled,
+// unless the configuration says otherwise.
+const DefaultGRPCPort = 60002
+
 var log = logging.Log.WithFields(logrus.Fields{"package": "main"})
 
+// subjectSettings extracts the NATS subject and queue group settings from the
+// configuration.
+func subjectSettings(config *koanf.Koanf) natscl.SubjectSettings {
+	prefix := strings.Trim(config.String("nats.subject.prefix"), ".")
+	if prefix == "" {
+		prefix = natscl.DefaultSubjectPrefix
+	}
+
+	queueSuffix := config.String("nats.queue.suffix")
+	if queueSuffix == "" {
+		queueSuffix = serviceName
+	}
+
+	var disabled []string
+	for _, d := range config.Strings("nats.subjects.disabled") {
+		for _, subject := range strings.Split(d, ",") {
+			if subject = strings.TrimSpace(subject); subject != "" {
+				disabled = append(disabled, subject)
+			}
+		}
+	}
+
+	var versions []string
+	for _, v := range config.Strings("nats.versions") {
+		for _, version := range strings.Split(v, ",") {
+			version = strings.TrimSpace(version)
+			switch {
+			case version == "":
+			case !natscl.IsSupportedAPIVersion(version):
+				log.Warnf("ignoring unsupported NATS API version %s", version)
+			default:
+				versions = append(versions, version)
+			}
+		}
+	}
+
+	return natscl.SubjectSettings{
+		Prefix:      prefix,
+		QueueSuffix: queueSuffix,
+		QueueGroups: config.StringMap("nats.queue.groups"),
+		Disabled:    disabled,
+		Versions:    versions,
+	}
+}
+
+// timeoutSettings extracts the time budgets for handling NATS requests from the
+// configuration. Budgets listed in the configuration replace the defaults for
+// the same subjects.
+func timeoutSettings(config *koanf.Koanf) app.TimeoutSettings {
+	settings := app.DefaultTimeoutSettings()
+
+	if timeout := config.Duration("nats.timeouts.default"); timeout > 0 {
+		settings.Default = timeout
+	}
+
+	// Subject names contain dots, so they're split into nested keys when the
+	// configuration is loaded. Cutting the map out and listing its keys puts
+	// them back together.
+	budgets := config.Cut("nats.timeouts.subjects")
+	for _, subject := range budgets.Keys() {
+		if timeout := budgets.Duration(subject); timeout > 0 {
+			settings.Subjects[subject] = timeout
+		} else {
+			log.Warnf("ignoring invalid time budget for subject %s", subject)
+		}
+	}
+
+	return settings
+}
+
+// concurrencySettings extracts the limits on the number of NATS requests handled
+// at once from the configuration. Limits listed in the configuration replace the
+// defaults for the same subjects.
+func concurrencySettings(config *koanf.Koanf) app.ConcurrencySettings {
+	settings := app.DefaultConcurrencySettings()
+
+	if limit := config.Int("nats.concurrency.default"); limit > 0 {
+		settings.Default = limit
+	}
+	if maxQueued := config.Int("nats.concurrency.queue"); maxQueued > 0 {
+		settings.MaxQueued = maxQueued
+	}
+	if wait := config.Duration("nats.concurrency.wait"); wait > 0 {
+		settings.Wait = wait
+	}
+
+	limits := config.Cut("nats.concurrency.subjects")
+	for _, subject := range limits.Keys() {
+		if limit := limits.Int(subject); limit > 0 {
+			settings.Subjects[subject] = limit
+		} else {
+			log.Warnf("ignoring invalid concurrency limit for subject %s", subject)
+		}
+	}
+
+	return settings
+}
+
+// reminderWindows returns the number of days before the end of a subscription
+// that expiration reminders are sent, which are given as a comma-separated
+// list. Windows that aren't positive numbers are ignored.
+func reminderWindows(config *koanf.Koanf) []int32 {
+	var windows []int32
+	for _, d := range config.Strings("reminders.windows") {
+		for _, value := range strings.Split(d, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			days, err := strconv.ParseInt(value, 10, 32)
+			if err != nil || days <= 0 {
+				log.Warnf("ignoring the expiration reminder window %q", value)
+				continue
+			}
+			windows = append(windows, int32(days))
+		}
+	}
+
+	if len(windows) == 0 {
+		return app.DefaultReminderWindows()
+	}
+	return windows
+}
+
+// deadLetterSettings extracts the settings for forwarding messages that can't be
+// handled from the configuration.
+func deadLetterSettings(config *koanf.Koanf) natscl.DeadLetterSettings {
+	settings := natscl.DefaultDeadLetterSettings()
+	settings.Enabled = config.Bool("nats.dlq.enabled")
+
+	if subject := config.String("nats.dlq.subject"); subject != "" {
+		settings.Subject = subject
+	}
+	if stream := config.String("nats.dlq.stream"); stream != "" {
+		settings.StreamName = stream
+	}
+	if retention := config.Duration("nats.dlq.retention"); retention > 0 {
+		settings.MaxAge = retention
+	}
+
+	return settings
+}
+
+// dedupeSettings extracts the settings for deduplicating NATS requests that
+// carry message IDs from the configuration.
+func dedupeSettings(config *koanf.Koanf) natscl.DedupeSettings {
+	settings := natscl.DefaultDedupeSettings()
+
+	if config.Exists("nats.dedupe.window") {
+		settings.Window = config.Duration("nats.dedupe.window")
+	}
+	if size := config.Int("nats.dedupe.size"); size > 0 {
+		settings.Size = size
+	}
+
+	return settings
+}
+
+// ingestSettings extracts the settings for consuming usage updates from the
+// JetStream stream from the configuration.
+func ingestSettings(config *koanf.Koanf) ingest.Settings {
+	settings := ingest.DefaultSettings()
+
+	if stream := config.String("nats.usages.ingest.stream"); stream != "" {
+		settings.StreamName = stream
+	}
+	if subject := config.String("nats.usages.ingest.subject"); subject != "" {
+		settings.Subject = subject
+	}
+	if durable := config.String("nats.usages.ingest.durable"); durable != "" {
+		settings.Durable = durable
+	}
+	if batch := config.Int("nats.usages.ingest.batch"); batch > 0 {
+		settings.BatchSize = batch
+	}
+	if workers := config.Int("nats.usages.ingest.workers"); workers > 0 {
+		settings.Workers = workers
+	}
+
+	return settings
+}
+
+// reconciliationSource is a source system in the usage reconciliation section
+// of the configuration.
+type reconciliationSource struct {
+	Resource string `koanf:"resource"`
+	Subject  string `koanf:"subject"`
+}
+
+// reconciliationSettings extracts the settings for reconciling usages against
+// the source systems from the configuration.
+func reconciliationSettings(config *koanf.Koanf) (app.ReconciliationSettings, error) {
+	settings := app.ReconciliationSettings{
+		Tolerance: config.Float64("usage.reconciliation.tolerance"),
+		Correct:   config.Bool("usage.reconciliation.correct"),
+		Timeout:   config.Duration("usage.reconciliation.timeout"),
+	}
+	if settings.Tolerance < 0 {
+		return settings, fmt.Errorf("the usage reconciliation tolerance must not be negative")
+	}
+
+	var sources []reconciliationSource
+	if err := config.Unmarshal("usage.reconciliation.sources", &sources); err != nil {
+		return settings, fmt.Errorf("invalid usage reconciliation sources: %w", err)
+	}
+	for _, source := range sources {
+		if source.Resource == "" || source.Subject == "" {
+			return settings, fmt.Errorf("usage reconciliation sources must have a resource and a subject")
+		}
+		settings.Sources = append(settings.Sources, app.ReconciliationSource{
+			ResourceType: source.Resource,
+			Subject:      source.Subject,
+		})
+	}
+
+	return settings, nil
+}
+
+// globalOptions contains the settings shared by every command.
+type globalOptions struct {
+	configPath string
+	dotEnvPath string
+	envPrefix  string
+	logLevel   string
+}
+
+// configSettings returns the settings used to load the configuration.
+func (o *globalOptions) configSettings() *cfg.Settings {
+	return &cfg.Settings{
+		EnvPrefix:   o.envPrefix,
+		ConfigPath:  o.configPath,
+		DotEnvPath:  o.dotEnvPath,
+		StrictMerge: false,
+		FileType:    cfg.YAML,
+	}
+}
+
+// natsOptions contains the settings for connecting to NATS.
+type natsOptions struct {
+	tlsCert          string
+	tlsKey           string
+	noTLS            bool
+	caCert           string
+	credsPath        string
+	noCreds          bool
+	maxReconnects    int
+	reconnectWait    int
+	maxReconnectWait int
+}
+
+// addNATSFlags adds the flags for the NATS connection settings to a flag set.
+func addNATSFlags(flags *pflag.FlagSet, opts *natsOptions) {
+	flags.StringVar(&opts.tlsCert, "tlscert", gotelnats.DefaultTLSCertPath, "Path to the NATS TLS cert file")
+	flags.StringVar(&opts.tlsKey, "tlskey", gotelnats.DefaultTLSKeyPath, "Path to the NATS TLS key file")
+	flags.BoolVar(&opts.noTLS, "no-tls", false, "Used to disable TLS for the connection to NATS")
+	flags.StringVar(&opts.caCert, "tlsca", gotelnats.DefaultTLSCAPath, "Path to the NATS TLS CA file")
+	flags.StringVar(&opts.credsPath, "creds", gotelnats.DefaultCredsPath, "Path to the NATS creds file")
+	flags.BoolVar(&opts.noCreds, "no-creds", false, "Used to disable client credentials for NATS")
+	flags.IntVar(&opts.maxReconnects, "max-reconnects", gotelnats.DefaultMaxReconnects, "Maximum number of reconnection attempts to NATS")
+	flags.IntVar(&opts.reconnectWait, "reconnect-wait", gotelnats.DefaultReconnectWait, "Seconds to wait between reconnection attempts to NATS")
+	flags.IntVar(&opts.maxReconnectWait, "max-reconnect-wait", natscl.DefaultMaxReconnectWait, "Most seconds to wait between reconnection attempts to NATS")
+}
+
+// connectionSettings returns the settings for connecting to the NATS cluster.
+func (o *natsOptions) connectionSettings(cluster string) natscl.ConnectionSettings {
+	return natscl.ConnectionSettings{
+		ClusterURLS:      cluster,
+		CredsPath:        o.credsPath,
+		CredsEnabled:     !o.noCreds,
+		TLSCACertPath:    o.caCert,
+		TLSCertPath:      o.tlsCert,
+		TLSKeyPath:       o.tlsKey,
+		TLSEnabled:       !o.noTLS,
+		MaxReconnects:    o.maxReconnects,
+		ReconnectWait:    o.reconnectWait,
+		MaxReconnectWait: o.maxReconnectWait,
+	}
+}
+
+// serveOptions contains the settings that only apply to the service itself.
+type serveOptions struct {
+	natsOptions
+	natsSubject    string
+	natsQueue      string
+	reportOverages bool
+	listenPort     int
+	adminPort      int
+	seed           bool
+	migrate        bool
+}
+
+// addServeFlags adds the flags for the service's settings to a flag set.
+func addServeFlags(flags *pflag.FlagSet, opts *serveOptions) {
+	addNATSFlags(flags, &opts.natsOptions)
+	flags.StringVar(&opts.natsSubject, "subject", "cyverse.qms.>", "NATS subject to subscribe to")
+	flags.StringVar(&opts.natsQueue, "queue", "cyverse.qms", "Name of the NATS queue to use")
+	flags.BoolVar(&opts.reportOverages, "report-overages", true, "Allows the overages feature to effectively be shut down")
+	flags.IntVar(&opts.listenPort, "port", 60000, "The port the service listens on for requests")
+	flags.IntVar(&opts.adminPort, "admin-port", 60001, "The port the health checks are served on; 0 disables them")
+	flags.BoolVar(&opts.seed, "seed", false, "Seeds the database with the reference data in the configuration, then exits")
+	flags.BoolVar(&opts.migrate, "migrate", false, "Applies the embedded database migrations before starting")
+}
+
+// newRootCommand returns the command that runs the service, along with the
+// subcommands for common administrative tasks. The service is also run when no
+// subcommand is given so that existing deployments keep working.
+func newRootCommand() *cobra.Command {
+	global := &globalOptions{}
+	opts := &serveOptions{}
+
+	root := &cobra.Command{
+		Use:          serviceName,
+		Short:        "Manages subscriptions, quotas and usages for the Discovery Environment",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			// Administrative commands log SQL statements at the debug level, so
+			// they only log warnings unless asked to do otherwise.
+			logLevel := global.logLevel
+			if !cmd.Flags().Changed("log-level") && cmd.Annotations[adminAnnotation] != "" {
+				logLevel = "warn"
+			}
+			logging.SetupLogging(logLevel)
+		},
+		Run: func(_ *cobra.Command, _ []string) {
+			serve(global, opts)
+		},
+	}
+
+	flags := root.PersistentFlags()
+	flags.StringVar(&global.configPath, "config", cfg.DefaultConfigPath, "Path to the config file")
+	flags.StringVar(&global.dotEnvPath, "dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
+	flags.StringVar(&global.envPrefix, "env-prefix", "QMS_", "The prefix for environment variables")
+	flags.StringVar(&global.logLevel, "log-level", "debug", "One of trace, debug, info, warn, error, fatal, or panic.")
+	addServeFlags(root.Flags(), opts)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Runs the service",
+		Args:  cobra.NoArgs,
+		Run: func(_ *cobra.Command, _ []string) {
+			serve(global, opts)
+		},
+	}
+	addServeFlags(serveCmd.Flags(), opts)
+
+	root.AddCommand(
+		serveCmd,
+		newSubscribeUserCommand(global),
+		newListOveragesCommand(global),
+		newRenewCommand(global),
+		newReplayDeadLettersCommand(global),
+		newImportLegacyCommand(global),
+	)
+
+	return root
+}
+
 func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// loadConfig loads the configuration and makes sure that the database URIs can
+// be parsed.
+func loadConfig(global *globalOptions) (*koanf.Koanf, error) {
+	config, err := cfg.Init(global.configSettings())
+	if err != nil {
+		return nil, err
+	}
+
+	dbURI := config.String("database.uri")
+	if dbURI == "" {
+		return nil, fmt.Errorf("database.uri must be set in the configuration file")
+	}
+
+	// Make sure the db.uri URL is parseable
+	if _, err = url.Parse(dbURI); err != nil {
+		return nil, errors.Wrap(err, "Can't parse database.uri in the config file")
+	}
+
+	// The read replica is optional.
+	if replicaURI := config.String("database.replica.uri"); replicaURI != "" {
+		if _, err = url.Parse(replicaURI); err != nil {
+			return nil, errors.Wrap(err, "Can't parse database.replica.uri in the config file")
+		}
+	}
+
+	return config, nil
+}
+
+// usernameNormalizer returns the username normalization rules from the
+// configuration. Usernames are only stripped of their domains unless the
+// configuration says otherwise.
+func usernameNormalizer(config *koanf.Koanf) (*usernames.Rules, usernames.Settings, error) {
+	usernameSettings := usernames.DefaultSettings()
+	if config.Exists("users.normalize.strip.domain") {
+		usernameSettings.StripDomain = config.Bool("users.normalize.strip.domain")
+	}
+	usernameSettings.Lowercase = config.Bool("users.normalize.lowercase")
+	usernameSettings.Reject = config.String("users.normalize.reject")
+	usernameSettings.Suffix = config.String("users.normalize.suffix")
+
+	rules, err := usernames.NewRules(usernameSettings)
+	if err != nil {
+		return nil, usernameSettings, fmt.Errorf("invalid users.normalize.reject pattern: %w", err)
+	}
+	return rules, usernameSettings, nil
+}
+
+// gracePeriod returns the subscription grace period from the configuration.
+func gracePeriod(config *koanf.Koanf) time.Duration {
+	return time.Duration(config.Int("subscriptions.grace.days")) * 24 * time.Hour
+}
+
+// serve runs the service until it's stopped.
+func serve(global *globalOptions, opts *serveOptions) {
 	var (
 		err    error
 		config *koanf.Koanf
 		dbconn *sqlx.DB
-
-		configPath     = flag.String("config", cfg.DefaultConfigPath, "Path to the config file")
-		dotEnvPath     = flag.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
-		tlsCert        = flag.String("tlscert", gotelnats.DefaultTLSCertPath, "Path to the NATS TLS cert file")
-		tlsKey         = flag.String("tlskey", gotelnats.DefaultTLSKeyPath, "Path to the NATS TLS key file")
-		noTLS          = flag.Bool("no-tls", false, "Used to disable TLS for the connection to NATS")
-		caCert         = flag.String("tlsca", gotelnats.DefaultTLSCAPath, "Path to the NATS TLS CA file")
-		credsPath      = flag.String("creds", gotelnats.DefaultCredsPath, "Path to the NATS creds file")
-		noCreds        = flag.Bool("no-creds", false, "Used to disable client credentials for NATS")
-		maxReconnects  = flag.Int("max-reconnects", gotelnats.DefaultMaxReconnects, "Maximum number of reconnection attempts to NATS")
-		reconnectWait  = flag.Int("reconnect-wait", gotelnats.DefaultReconnectWait, "Seconds to wait between reconnection attempts to NATS")
-		natsSubject    = flag.String("subject", "cyverse.qms.>", "NATS subject to subscribe to")
-		natsQueue      = flag.String("queue", "cyverse.qms", "Name of the NATS queue to use")
-		envPrefix      = flag.String("env-prefix", "QMS_", "The prefix for environment variables")
-		reportOverages = flag.Bool("report-overages", true, "Allows the overages feature to effectively be shut down")
-		logLevel       = flag.String("log-level", "debug", "One of trace, debug, info, warn, error, fatal, or panic.")
-		listenPort     = flag.Int("port", 60000, "The port the service listens on for requests")
 	)
 
-	flag.Parse()
-	logging.SetupLogging(*logLevel)
-
 	log := log.WithFields(logrus.Fields{"context": "main"})
 
 	var tracerCtx, cancel = context.WithCancel(context.Background())
@@ -74,27 +490,15 @@ func main() {
 	//nolint:staticcheck
 	nats.RegisterEncoder("protojson", protobufjson.NewCodec(protobufjson.WithEmitUnpopulated()))
 
-	config, err = cfg.Init(&cfg.Settings{
-		EnvPrefix:   *envPrefix,
-		ConfigPath:  *configPath,
-		DotEnvPath:  *dotEnvPath,
-		StrictMerge: false,
-		FileType:    cfg.YAML,
-	})
+	configSettings := global.configSettings()
+	config, err = loadConfig(global)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Infof("Done reading config from %s", *configPath)
+	log.Infof("Done reading config from %s", global.configPath)
 
 	dbURI := config.String("database.uri")
-	if dbURI == "" {
-		log.Fatal("database.uri must be set in the configuration file")
-	}
-
-	// Make sure the db.uri URL is parseable
-	if _, err = url.Parse(dbURI); err != nil {
-		log.Fatal(errors.Wrap(err, "Can't parse database.uri in the config file"))
-	}
+	replicaURI := config.String("database.replica.uri")
 
 	userSuffix := strings.Trim(config.String("users.domain"), "@")
 	if userSuffix == "" {
@@ -103,9 +507,11 @@ func main() {
 
 	log.Infof("username suffix is configured as %s", userSuffix)
 
-	natsCluster := config.String("nats.cluster")
-	if natsCluster == "" {
-		log.Fatalf("The %sNATS_CLUSTER environment variable or nats.cluster configuration value must be set", *envPrefix)
+	// New users are subscribed to the default plan, which can be changed so
+	// that deployments aren't tied to the name of the plan.
+	defaultPlan := config.String("plans.default")
+	if defaultPlan == "" {
+		defaultPlan = db.DefaultPlanName
 	}
 
 	dbconn = otelsqlx.MustConnect("postgres", dbURI,
@@ -114,18 +520,47 @@ func main() {
 	dbconn.SetMaxOpenConns(10)
 	dbconn.SetConnMaxIdleTime(time.Minute)
 
-	natsSettings := natscl.ConnectionSettings{
-		ClusterURLS:   natsCluster,
-		CredsPath:     *credsPath,
-		CredsEnabled:  !*noCreds,
-		TLSCACertPath: *caCert,
-		TLSCertPath:   *tlsCert,
-		TLSKeyPath:    *tlsKey,
-		TLSEnabled:    !*noTLS,
-		MaxReconnects: *maxReconnects,
-		ReconnectWait: *reconnectWait,
+	// The service refuses to start if the database schema is behind the
+	// migrations it was built with, unless it's asked to apply them itself.
+	var schema migrations.Status
+	migrationsTable := config.String("database.migrations.table")
+	if opts.migrate || config.Bool("database.migrations.startup") {
+		if schema, err = migrations.Apply(context.Background(), dbconn.DB, migrationsTable); err != nil {
+			log.Fatal(errors.Wrap(err, "unable to apply the database migrations"))
+		}
+	} else if schema, err = migrations.Check(context.Background(), dbconn.DB, migrationsTable); err != nil {
+		log.Fatal(errors.Wrap(err, "unable to use the database; run the service with --migrate to apply the migrations"))
+	}
+	log.Infof("the database schema is at version %d", schema.Current)
+
+	// The reference data that the service needs is only added to the database
+	// when it's requested, so that deployments that manage it themselves are
+	// left alone.
+	if opts.seed || config.Bool("seed.startup") {
+		if err = seedDatabase(context.Background(), db.New(dbconn), config, defaultPlan); err != nil {
+			log.Fatal(err)
+		}
+		if opts.seed {
+			return
+		}
+	}
+
+	natsCluster := config.String("nats.cluster")
+	if natsCluster == "" {
+		log.Fatalf("The %sNATS_CLUSTER environment variable or nats.cluster configuration value must be set", global.envPrefix)
 	}
 
+	var replicaConn *sqlx.DB
+	if replicaURI != "" {
+		replicaConn = otelsqlx.MustConnect("postgres", replicaURI,
+			otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+		log.Info("done connecting to the read replica")
+		replicaConn.SetMaxOpenConns(10)
+		replicaConn.SetConnMaxIdleTime(time.Minute)
+	}
+
+	natsSettings := opts.connectionSettings(natsCluster)
+
 	natsConn, err := natscl.NewConnection(&natsSettings)
 	if err != nil {
 		log.Fatal(err)
@@ -138,13 +573,447 @@ func main() {
 	log.Infof("NATS TLS key file is %s", natsSettings.TLSKeyPath)
 	log.Infof("NATS CA cert file is %s", natsSettings.TLSCACertPath)
 	log.Infof("NATS creds file is %s", natsSettings.CredsPath)
-	log.Infof("NATS subject is %s", *natsSubject)
-	log.Infof("NATS queue is %s", *natsQueue)
-	log.Infof("--report-overages is %t", *reportOverages)
+	log.Infof("NATS subject is %s", opts.natsSubject)
+	log.Infof("NATS queue is %s", opts.natsQueue)
+	log.Infof("--report-overages is %t", opts.reportOverages)
 
 	natsClient := natscl.NewClient(natsConn, serviceName)
 
 	a := app.New(natsClient, dbconn, userSuffix)
+	a.SetReadReplica(replicaConn)
+	a.SetDefaultPlan(defaultPlan)
+	log.Infof("the default plan is %s", defaultPlan)
+	a.SetAutoSubscribe(config.Bool("plans.autosubscribe"))
+
+	usernameRules, usernameSettings, err := usernameNormalizer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.SetUsernameNormalizer(usernameRules)
+	log.Infof("username normalization settings: %+v", usernameSettings)
+
+	// Only callers that present the admin token are treated as administrators.
+	// Everyone else is treated as a user unless the configuration says
+	// otherwise.
+	adminToken := config.String("rbac.admin.token")
+	a.SetAdminToken(adminToken)
+	if defaultRole := config.String("rbac.default.role"); defaultRole != "" {
+		role, ok := app.ParseCallerRole(defaultRole)
+		if !ok {
+			log.Fatalf("unrecognized rbac.default.role: %s", defaultRole)
+		}
+		a.DefaultCallerRole = role
+	}
+	log.Infof("the default caller role is %s", a.DefaultCallerRole)
+	if a.DefaultCallerRole == app.RoleAdmin {
+		log.Warn("every caller is treated as an administrator; only use this on a trusted network")
+	}
+	if adminToken == "" {
+		log.Warn("rbac.admin.token isn't set, so no caller can authenticate as an administrator")
+	}
+
+	timeouts := timeoutSettings(config)
+	a.SetTimeouts(timeouts)
+	log.Infof("the default NATS request time budget is %s", timeouts.Default)
+
+	// Requests for the same subject are handled concurrently, up to a limit.
+	concurrency := concurrencySettings(config)
+	a.SetConcurrencyLimits(concurrency)
+	log.Infof(
+		"handling up to %d NATS requests per subject at once, with up to %d waiting for %s",
+		concurrency.Default, concurrency.MaxQueued, concurrency.Wait,
+	)
+
+	// The number of NATS messages handled at once across every subject is
+	// bounded so that a flood of messages can't start an unbounded number of
+	// goroutines.
+	handlerLimit := config.Int("nats.concurrency.handlers")
+	if handlerLimit <= 0 {
+		handlerLimit = natscl.DefaultHandlerLimit
+	}
+	natsClient.SetHandlerLimit(handlerLimit)
+	log.Infof("handling up to %d NATS messages at once", handlerLimit)
+
+	// Changes to the same user are made one at a time.
+	userShards := config.Int("users.shards")
+	if userShards <= 0 {
+		userShards = app.DefaultUserShards
+	}
+	a.SetUserShards(userShards)
+	log.Infof("serializing changes to users over %d shards", userShards)
+
+	// Responses that can't be sent are only retried if the configuration says
+	// so.
+	respondSettings := natscl.RespondSettings{
+		Retries: config.Int("nats.respond.retries"),
+		Backoff: config.Duration("nats.respond.backoff"),
+	}
+	natsClient.SetRespondSettings(respondSettings)
+	log.Infof("failed NATS responses are retried %d times", respondSettings.Retries)
+
+	// Messages that can't be decoded or that fail validation are only forwarded
+	// to the dead letter stream if the configuration says so.
+	if deadLetters := deadLetterSettings(config); deadLetters.Enabled {
+		js, err := natsConn.Conn.JetStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = natscl.EnsureDeadLetterStream(js, deadLetters); err != nil {
+			log.Fatal(err)
+		}
+		natsClient.SetDeadLetterSettings(deadLetters)
+		log.Infof("forwarding dead letters to %s in the %s stream", deadLetters.Subject, deadLetters.StreamName)
+	}
+
+	// Requests that carry message IDs are deduplicated within a window, which is
+	// turned off by setting it to zero. The responses are only shared with the
+	// other instances of the service through the database if the configuration
+	// says so.
+	dedupe := dedupeSettings(config)
+	dedupe.MaxWait = timeouts.BudgetFor
+	if dedupe.Window > 0 && config.Bool("nats.dedupe.database") {
+		dedupe.Store = a.ReplyStore()
+	}
+	natsClient.SetDedupeSettings(dedupe)
+	if dedupe.Window > 0 {
+		log.Infof("deduplicating NATS requests with message IDs for %s", dedupe.Window)
+	}
+
+	// Subscriptions can remain in effect for a number of days after they end.
+	if grace := gracePeriod(config); grace > 0 {
+		a.GracePeriod = grace
+		log.Infof("the subscription grace period is %d days", config.Int("subscriptions.grace.days"))
+	}
+
+	// The background workers run until the service shuts down.
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	// Check whether the database is read-only at regular intervals so that
+	// requests that modify data can be rejected cleanly during failovers.
+	readOnlyInterval := config.Duration("database.readonly.interval")
+	if readOnlyInterval <= 0 {
+		readOnlyInterval = 10 * time.Second
+	}
+	readOnlyMonitor := db.NewReadOnlyMonitor(dbconn, readOnlyInterval)
+	readOnlyMonitor.Start(workerCtx)
+	a.SetReadOnlyMonitor(readOnlyMonitor)
+	log.Infof("checking whether the database is read-only every %s", readOnlyInterval)
+
+	// Scheduled plan changes require the pending_subscription_changes table, so
+	// they're only applied if the configuration turns them on.
+	if config.Bool("plan.changes.enabled") {
+		planChangeInterval := config.Duration("plan.changes.interval")
+		if planChangeInterval <= 0 {
+			planChangeInterval = time.Minute
+		}
+		a.StartPlanChangeWorker(workerCtx, planChangeInterval)
+		log.Infof("applying scheduled plan changes every %s", planChangeInterval)
+	}
+
+	// Scheduled quota changes are taken into account when quotas are looked up,
+	// but copying them into the quotas table keeps everything else up to date.
+	quotaChangeInterval := config.Duration("quota.changes.interval")
+	if quotaChangeInterval <= 0 {
+		quotaChangeInterval = time.Minute
+	}
+	a.StartQuotaChangeWorker(workerCtx, quotaChangeInterval)
+	log.Infof("applying scheduled quota changes every %s", quotaChangeInterval)
+
+	usageRollupInterval := config.Duration("usage.rollups.interval")
+	if usageRollupInterval <= 0 {
+		usageRollupInterval = 5 * time.Minute
+	}
+	a.StartUsageRollupAggregator(workerCtx, usageRollupInterval)
+	log.Infof("aggregating usage rollups every %s", usageRollupInterval)
+
+	addonExpirationInterval := config.Duration("addons.expiration.interval")
+	if addonExpirationInterval <= 0 {
+		addonExpirationInterval = time.Hour
+	}
+	a.StartAddonExpirationWorker(workerCtx, addonExpirationInterval)
+	log.Infof("expiring subscription add-ons every %s", addonExpirationInterval)
+
+	// Old updates are only archived if a retention period is configured.
+	retention := app.RetentionSettings{
+		UpdateMonths: config.Int("retention.updates.months"),
+		DryRun:       config.Bool("retention.dry_run"),
+	}
+	a.SetRetention(retention)
+	if retention.UpdateMonths > 0 {
+		retentionInterval := config.Duration("retention.interval")
+		if retentionInterval <= 0 {
+			retentionInterval = 24 * time.Hour
+		}
+		a.StartRetentionWorker(workerCtx, retentionInterval)
+		log.Infof("archiving updates older than %d months every %s", retention.UpdateMonths, retentionInterval)
+	}
+
+	// Usages can be reconciled on demand as long as the source systems are
+	// listed, but they're only reconciled periodically if the configuration
+	// turns it on.
+	reconciliation, err := reconciliationSettings(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.SetReconciliation(reconciliation)
+	if config.Bool("usage.reconciliation.enabled") && len(reconciliation.Sources) > 0 {
+		reconciliationInterval := config.Duration("usage.reconciliation.interval")
+		if reconciliationInterval <= 0 {
+			reconciliationInterval = 24 * time.Hour
+		}
+		a.StartReconciliationWorker(workerCtx, reconciliationInterval)
+		log.Infof(
+			"reconciling the usages of %d resource types every %s",
+			len(reconciliation.Sources), reconciliationInterval,
+		)
+	}
+
+	// Reservations require the reservations table, so they're only counted
+	// against quotas and reaped if the configuration turns them on.
+	if config.Bool("reservations.enabled") {
+		reservationInterval := config.Duration("reservations.interval")
+		if reservationInterval <= 0 {
+			reservationInterval = time.Minute
+		}
+		a.EnableReservations()
+		a.StartReservationReaper(workerCtx, reservationInterval)
+		log.Infof("expiring reservations every %s", reservationInterval)
+	}
+
+	// Pending purchases that a checkout never committed or aborted are marked as
+	// expired so that they don't linger.
+	purchaseInterval := config.Duration("purchases.interval")
+	if purchaseInterval <= 0 {
+		purchaseInterval = time.Minute
+	}
+	a.StartPurchaseReaper(workerCtx, purchaseInterval)
+
+	// Recorded responses are only needed for the length of the deduplication
+	// window.
+	if dedupe.Store != nil {
+		a.StartRequestReplyPurger(workerCtx, dedupe.Window, dedupe.Window)
+		log.Infof("purging recorded NATS responses older than %s", dedupe.Window)
+	}
+
+	// Group subscriptions require the groups table, so users only draw on the
+	// subscriptions of their groups if the configuration turns them on.
+	if config.Bool("groups.enabled") {
+		a.EnableGroupSubscriptions()
+		log.Info("group subscriptions are enabled")
+	}
+
+	// Trial expiration notices require the trials table, so they're only sent
+	// if the configuration turns them on.
+	if config.Bool("trials.enabled") {
+		trialInterval := config.Duration("trials.interval")
+		if trialInterval <= 0 {
+			trialInterval = time.Hour
+		}
+		trialNotice := config.Duration("trials.expiration.notice")
+		if trialNotice <= 0 {
+			trialNotice = 72 * time.Hour
+		}
+		a.StartTrialExpirationWorker(workerCtx, trialInterval, trialNotice)
+		log.Infof("sending trial expiration notices %s in advance every %s", trialNotice, trialInterval)
+	}
+
+	// Expiration reminders require the expiration_reminders table, so they're
+	// only sent if the configuration turns them on.
+	if config.Bool("reminders.enabled") {
+		reminderInterval := config.Duration("reminders.interval")
+		if reminderInterval <= 0 {
+			reminderInterval = time.Hour
+		}
+		windows := reminderWindows(config)
+		a.StartExpirationReminderWorker(workerCtx, reminderInterval, windows)
+		log.Infof("sending expiration reminders %v days in advance every %s", windows, reminderInterval)
+	}
+
+	// Exports and archives are stored in whichever object storage backend the
+	// configuration selects, if any.
+	if backend := config.String("storage.backend"); backend != "" {
+		store, err := storage.New(storage.Settings{
+			Backend: backend,
+			Local: storage.LocalSettings{
+				Path: config.String("storage.local.path"),
+			},
+			S3: storage.S3Settings{
+				Endpoint:     config.String("storage.s3.endpoint"),
+				Region:       config.String("storage.s3.region"),
+				Bucket:       config.String("storage.s3.bucket"),
+				Prefix:       config.String("storage.s3.prefix"),
+				AccessKey:    config.String("storage.s3.access.key"),
+				SecretKey:    config.String("storage.s3.secret.key"),
+				SessionToken: config.String("storage.s3.session.token"),
+			},
+			IRODS: storage.IRODSSettings{
+				URL:        config.String("storage.irods.url"),
+				Collection: config.String("storage.irods.collection"),
+				Username:   config.String("storage.irods.username"),
+				Password:   config.String("storage.irods.password"),
+				ChunkSize:  config.Int("storage.irods.chunk.size"),
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.SetObjectStore(store)
+		log.Infof("storing objects using the %s storage backend", backend)
+	}
+
+	// Active subscription lookups on hot paths are only cached if the
+	// configuration turns the cache on.
+	if config.Bool("subscriptions.cache.enabled") {
+		cacheBackend := config.String("subscriptions.cache.backend")
+		if cacheBackend == "" {
+			cacheBackend = subcache.BackendMemory
+		}
+		cacheSettings := subcache.Settings{
+			Backend:    cacheBackend,
+			TTL:        config.Duration("subscriptions.cache.ttl"),
+			MaxEntries: config.Int("subscriptions.cache.size"),
+			Redis: subcache.RedisSettings{
+				Address:  config.String("subscriptions.cache.redis.address"),
+				Password: config.String("subscriptions.cache.redis.password"),
+				DB:       config.Int("subscriptions.cache.redis.db"),
+				Prefix:   config.String("subscriptions.cache.redis.prefix"),
+				Timeout:  config.Duration("subscriptions.cache.redis.timeout"),
+			},
+		}
+		cache, err := subcache.New(cacheSettings)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Instances that keep their own caches can relay invalidations to each
+		// other over NATS so that they don't serve stale subscriptions.
+		if config.Bool("subscriptions.cache.relay.enabled") {
+			relaySubject := config.String("subscriptions.cache.relay.subject")
+			if relaySubject == "" {
+				relaySubject = subcache.RelaySubject(subjectSettings(config).Prefix)
+			}
+			relayed, err := subcache.NewRelayedCache(cache, natsConn.Conn, relaySubject)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer relayed.Close() // nolint:errcheck
+			cache = relayed
+			log.Infof("relaying subscription cache invalidations over NATS on %s", relaySubject)
+		}
+
+		a.SetSubscriptionCache(cache)
+		log.Infof("caching active subscriptions using the %s backend", cacheBackend)
+	}
+
+	// Webhook notifications require the webhooks table, so they're disabled
+	// unless the configuration turns them on.
+	if config.Bool("webhooks.enabled") {
+		webhookSettings := webhooks.DefaultSettings()
+		if maxAttempts := config.Int("webhooks.max.attempts"); maxAttempts > 0 {
+			webhookSettings.MaxAttempts = maxAttempts
+		}
+		if timeout := config.Duration("webhooks.timeout"); timeout > 0 {
+			webhookSettings.Timeout = timeout
+		}
+		a.SetWebhookDispatcher(webhooks.NewDispatcher(db.New(dbconn), webhookSettings))
+	}
+	log.Infof("webhook notifications enabled: %t", config.Bool("webhooks.enabled"))
+
+	// Billing requires the external_invoices table, so subscriptions are only
+	// handed to a billing provider if the configuration chooses one.
+	if provider := config.String("billing.provider"); provider != "" {
+		billingProvider, err := billing.New(billing.Settings{
+			Provider: provider,
+			Stripe: billing.StripeSettings{
+				APIKey:     config.String("billing.stripe.api.key"),
+				Endpoint:   config.String("billing.stripe.endpoint"),
+				Currency:   config.String("billing.stripe.currency"),
+				SuccessURL: config.String("billing.stripe.success.url"),
+				CancelURL:  config.String("billing.stripe.cancel.url"),
+				Timeout:    config.Duration("billing.stripe.timeout"),
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.SetBillingProvider(billingProvider)
+		log.Infof("billing subscriptions through the %s provider", provider)
+	}
+
+	// Domain events require the event_outbox table, so they're disabled unless
+	// the configuration turns them on.
+	if config.Bool("nats.events.enabled") {
+		eventSettings := events.DefaultSettings()
+		if stream := config.String("nats.events.stream"); stream != "" {
+			eventSettings.StreamName = stream
+		}
+		if prefix := strings.Trim(config.String("nats.events.prefix"), "."); prefix != "" {
+			eventSettings.SubjectPrefix = prefix
+		}
+		if interval := config.Duration("nats.events.interval"); interval > 0 {
+			eventSettings.Interval = interval
+		}
+
+		js, err := natsConn.Conn.JetStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		publisher := events.NewPublisher(db.New(dbconn), js, eventSettings)
+		if err = publisher.EnsureStream(); err != nil {
+			log.Fatal(err)
+		}
+		publisher.Start(workerCtx)
+		a.EnableEventOutbox()
+		log.Infof("publishing domain events to the %s stream", eventSettings.StreamName)
+	}
+
+	// The overage projection requires JetStream, so it's disabled unless the
+	// configuration turns it on.
+	if config.Bool("nats.overages.kv.enabled") {
+		kvSettings := overagekv.DefaultSettings()
+		if bucket := config.String("nats.overages.kv.bucket"); bucket != "" {
+			kvSettings.Bucket = bucket
+		}
+		if interval := config.Duration("nats.overages.kv.interval"); interval > 0 {
+			kvSettings.Interval = interval
+		}
+
+		js, err := natsConn.Conn.JetStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		store, err := overagekv.NewStore(js, kvSettings)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.SetOverageStore(store)
+		a.StartOverageProjectionWorker(workerCtx)
+		log.Infof("maintaining the overage projection in the %s bucket", kvSettings.Bucket)
+	}
+
+	// Usage updates can also be published to a JetStream stream, which absorbs
+	// bursts that would overload the request/reply subject. Consuming the stream
+	// is disabled unless the configuration turns it on.
+	if config.Bool("nats.usages.ingest.enabled") {
+		settings := ingestSettings(config)
+
+		js, err := natsConn.Conn.JetStream()
+		if err != nil {
+			log.Fatal(err)
+		}
+		consumer := ingest.NewConsumer(js, a.Service().AddUsage, a.FixUsername, settings)
+		if err = consumer.EnsureStream(); err != nil {
+			log.Fatal(err)
+		}
+		if err = consumer.Start(workerCtx); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof(
+			"consuming usage updates from %s in the %s stream, %d at a time",
+			settings.Subject, settings.StreamName, settings.BatchSize,
+		)
+	}
 
 	//nolint:staticcheck
 	natsHandlers := map[string]nats.Handler{
@@ -177,14 +1046,210 @@ func main() {
 		qmssubs.DeleteSubscriptionAddon: a.DeleteSubscriptionAddonHandler,
 		qmssubs.UpdateSubscriptionAddon: a.UpdateSubscriptionAddonHandler,
 		qmssubs.GetSubscriptionAddon:    a.GetSubscriptionAddonHandler,
+
+		// These use plain JSON messages rather than protocol buffers.
+		subjects.Ping:                         natscl.JSONHandler{Handler: a.PingHandler},
+		subjects.GetAPIVersion:                natscl.JSONHandler{Handler: a.GetAPIVersionHandler},
+		subjects.SummarizeSubscriptionAddons:  natscl.JSONHandler{Handler: a.SummarizeSubscriptionAddonsHandler},
+		subjects.GetSubscriptionSummary:       natscl.JSONHandler{Handler: a.GetSubscriptionSummaryHandler},
+		subjects.ListUserSubscriptions:        natscl.JSONHandler{Handler: a.ListUserSubscriptionsHandler},
+		subjects.ForecastUsage:                natscl.JSONHandler{Handler: a.ForecastUsageHandler},
+		subjects.ReserveResource:              natscl.JSONHandler{Handler: a.ReserveResourceHandler},
+		subjects.ReleaseReservation:           natscl.JSONHandler{Handler: a.ReleaseReservationHandler},
+		subjects.BeginPurchase:                natscl.JSONHandler{Handler: a.BeginPurchaseHandler},
+		subjects.CommitPurchase:               natscl.JSONHandler{Handler: a.CommitPurchaseHandler},
+		subjects.AbortPurchase:                natscl.JSONHandler{Handler: a.AbortPurchaseHandler},
+		subjects.ExpireCohort:                 natscl.JSONHandler{Handler: a.ExpireCohortHandler},
+		subjects.GetBulkJob:                   natscl.JSONHandler{Handler: a.GetBulkJobHandler},
+		subjects.RespondFailures:              natscl.JSONHandler{Handler: a.RespondFailuresHandler},
+		subjects.AddWebhook:                   natscl.JSONHandler{Handler: a.AddWebhookHandler},
+		subjects.ListWebhooks:                 natscl.JSONHandler{Handler: a.ListWebhooksHandler},
+		subjects.GetWebhook:                   natscl.JSONHandler{Handler: a.GetWebhookHandler},
+		subjects.UpdateWebhook:                natscl.JSONHandler{Handler: a.UpdateWebhookHandler},
+		subjects.DeleteWebhook:                natscl.JSONHandler{Handler: a.DeleteWebhookHandler},
+		subjects.GetTestAccount:               natscl.JSONHandler{Handler: a.GetTestAccountHandler},
+		subjects.SetTestAccount:               natscl.JSONHandler{Handler: a.SetTestAccountHandler},
+		subjects.MergeUsers:                   natscl.JSONHandler{Handler: a.MergeUsersHandler},
+		subjects.PurgeUser:                    natscl.JSONHandler{Handler: a.PurgeUserHandler},
+		subjects.SchedulePlanChange:           natscl.JSONHandler{Handler: a.SchedulePlanChangeHandler},
+		subjects.ListPlanChanges:              natscl.JSONHandler{Handler: a.ListPlanChangesHandler},
+		subjects.CancelPlanChange:             natscl.JSONHandler{Handler: a.CancelPlanChangeHandler},
+		subjects.GetEventSchemas:              natscl.JSONHandler{Handler: a.GetEventSchemasHandler},
+		subjects.ChangeSubscriptionPlan:       natscl.JSONHandler{Handler: a.ChangeSubscriptionPlanHandler},
+		subjects.ComparePlans:                 natscl.JSONHandler{Handler: a.ComparePlansHandler},
+		subjects.SetTrialPlan:                 natscl.JSONHandler{Handler: a.SetTrialPlanHandler},
+		subjects.SetQuotaExemptPlan:           natscl.JSONHandler{Handler: a.SetQuotaExemptPlanHandler},
+		subjects.SetPlanPeriod:                natscl.JSONHandler{Handler: a.SetPlanPeriodHandler},
+		subjects.AddGroup:                     natscl.JSONHandler{Handler: a.AddGroupHandler},
+		subjects.GetGroup:                     natscl.JSONHandler{Handler: a.GetGroupHandler},
+		subjects.AddGroupMember:               natscl.JSONHandler{Handler: a.AddGroupMemberHandler},
+		subjects.RemoveGroupMember:            natscl.JSONHandler{Handler: a.RemoveGroupMemberHandler},
+		subjects.GetUsageBreakdown:            natscl.JSONHandler{Handler: a.GetUsageBreakdownHandler},
+		subjects.GetUsageRollups:              natscl.JSONHandler{Handler: a.UsageRollupsHandler},
+		subjects.GetUsageTotals:               natscl.JSONHandler{Handler: a.UsageTotalsHandler},
+		subjects.RunRetention:                 natscl.JSONHandler{Handler: a.RunRetentionHandler},
+		subjects.RunReconciliation:            natscl.JSONHandler{Handler: a.RunReconciliationHandler},
+		subjects.AddDiscountCode:              natscl.JSONHandler{Handler: a.AddDiscountCodeHandler},
+		subjects.GetDiscountCode:              natscl.JSONHandler{Handler: a.GetDiscountCodeHandler},
+		subjects.ListDiscountCodes:            natscl.JSONHandler{Handler: a.ListDiscountCodesHandler},
+		subjects.GetSubscriptionDiscount:      natscl.JSONHandler{Handler: a.GetSubscriptionDiscountHandler},
+		subjects.GetSubscriptionInvoices:      natscl.JSONHandler{Handler: a.GetSubscriptionInvoicesHandler},
+		subjects.GenerateInvoice:              natscl.JSONHandler{Handler: a.GenerateInvoiceHandler},
+		subjects.GetInvoice:                   natscl.JSONHandler{Handler: a.GetInvoiceHandler},
+		subjects.ListInvoices:                 natscl.JSONHandler{Handler: a.ListInvoicesHandler},
+		subjects.GetSubscriptionPaymentStatus: natscl.JSONHandler{Handler: a.GetSubscriptionPaymentStatusHandler},
+		subjects.SetSubscriptionPaymentStatus: natscl.JSONHandler{Handler: a.SetSubscriptionPaymentStatusHandler},
+		subjects.GetSubscriptionAnnotations:   natscl.JSONHandler{Handler: a.GetSubscriptionAnnotationsHandler},
+		subjects.AddSubscriptionNote:          natscl.JSONHandler{Handler: a.AddSubscriptionNoteHandler},
+		subjects.DeleteSubscriptionNote:       natscl.JSONHandler{Handler: a.DeleteSubscriptionNoteHandler},
+		subjects.SetSubscriptionTag:           natscl.JSONHandler{Handler: a.SetSubscriptionTagHandler},
+		subjects.DeleteSubscriptionTag:        natscl.JSONHandler{Handler: a.DeleteSubscriptionTagHandler},
+		subjects.SubscribeGroup:               natscl.JSONHandler{Handler: a.SubscribeGroupHandler},
+		subjects.StartTrial:                   natscl.JSONHandler{Handler: a.StartTrialHandler},
+		subjects.TrialConversions:             natscl.JSONHandler{Handler: a.TrialConversionsHandler},
+		subjects.SubscriptionsByPlan:          natscl.JSONHandler{Handler: a.SubscriptionsByPlanHandler},
+		subjects.AddPlanFeature:               natscl.JSONHandler{Handler: a.AddPlanFeatureHandler},
+		subjects.RemovePlanFeature:            natscl.JSONHandler{Handler: a.RemovePlanFeatureHandler},
+		subjects.ListPlanFeatures:             natscl.JSONHandler{Handler: a.ListPlanFeaturesHandler},
+		subjects.UserHasFeature:               natscl.JSONHandler{Handler: a.UserHasFeatureHandler},
+		subjects.DeletePlan:                   natscl.JSONHandler{Handler: a.DeletePlanHandler},
+		subjects.ClonePlan:                    natscl.JSONHandler{Handler: a.ClonePlanHandler},
+		subjects.GetPlanSnapshot:              natscl.JSONHandler{Handler: a.GetPlanSnapshotHandler},
+		subjects.GetOverageReport:             natscl.JSONHandler{Handler: a.GetOverageReportHandler},
+		subjects.GetRevenueReport:             natscl.JSONHandler{Handler: a.GetRevenueReportHandler},
+		subjects.ExportSubscriptions:          natscl.JSONHandler{Handler: a.ExportSubscriptionsHandler},
+		subjects.AddResourceType:              natscl.JSONHandler{Handler: a.AddResourceTypeHandler},
+		subjects.UpdateResourceType:           natscl.JSONHandler{Handler: a.UpdateResourceTypeHandler},
+		subjects.ListResourceTypes:            natscl.JSONHandler{Handler: a.ListResourceTypesHandler},
+		subjects.SetQuotaPolicy:               natscl.JSONHandler{Handler: a.SetQuotaPolicyHandler},
+		subjects.ListQuotaPolicies:            natscl.JSONHandler{Handler: a.ListQuotaPoliciesHandler},
+		subjects.ScheduleQuotaChange:          natscl.JSONHandler{Handler: a.ScheduleQuotaChangeHandler},
+		subjects.ListQuotaChanges:             natscl.JSONHandler{Handler: a.ListQuotaChangesHandler},
+		subjects.CancelQuotaChange:            natscl.JSONHandler{Handler: a.CancelQuotaChangeHandler},
+		subjects.AdjustQuotasBatch:            natscl.JSONHandler{Handler: a.AdjustQuotasBatchHandler},
+		subjects.DepositCredits:               natscl.JSONHandler{Handler: a.DepositCreditsHandler},
+		subjects.GetCreditBalance:             natscl.JSONHandler{Handler: a.GetCreditBalanceHandler},
+		subjects.ListCreditLedger:             natscl.JSONHandler{Handler: a.ListCreditLedgerHandler},
+		subjects.SetUsageRule:                 natscl.JSONHandler{Handler: a.SetUsageRuleHandler},
+		subjects.ListUsageRules:               natscl.JSONHandler{Handler: a.ListUsageRulesHandler},
+		subjects.ListFlaggedUsageUpdates:      natscl.JSONHandler{Handler: a.ListFlaggedUsageUpdatesHandler},
+		subjects.ReviewFlaggedUsageUpdate:     natscl.JSONHandler{Handler: a.ReviewFlaggedUsageUpdateHandler},
+		subjects.ListQuarantinedUpdates:       natscl.JSONHandler{Handler: a.ListQuarantinedUpdatesHandler},
+		subjects.ApproveQuarantinedUpdate:     natscl.JSONHandler{Handler: a.ApproveQuarantinedUpdateHandler},
+		subjects.RejectQuarantinedUpdate:      natscl.JSONHandler{Handler: a.RejectQuarantinedUpdateHandler},
+		subjects.EnforceQuota:                 natscl.JSONHandler{Handler: a.EnforceQuotaHandler},
+		subjects.AddAddonBundle:               natscl.JSONHandler{Handler: a.AddAddonBundleHandler},
+		subjects.ListAddonBundles:             natscl.JSONHandler{Handler: a.ListAddonBundlesHandler},
+		subjects.AttachAddonBundle:            natscl.JSONHandler{Handler: a.AttachAddonBundleHandler},
+		subjects.SetAddonPrerequisites:        natscl.JSONHandler{Handler: a.SetAddonPrerequisitesHandler},
+		subjects.GetAddonPrerequisites:        natscl.JSONHandler{Handler: a.GetAddonPrerequisitesHandler},
+		subjects.SetAddonCompatibility:        natscl.JSONHandler{Handler: a.SetAddonCompatibilityHandler},
+		subjects.GetAddonCompatibility:        natscl.JSONHandler{Handler: a.GetAddonCompatibilityHandler},
+		subjects.ListAddonsForPlan:            natscl.JSONHandler{Handler: a.ListAddonsForPlanHandler},
+		subjects.SetAddonLimit:                natscl.JSONHandler{Handler: a.SetAddonLimitHandler},
+		subjects.SetMeteredRate:               natscl.JSONHandler{Handler: a.SetMeteredRateHandler},
+		subjects.PreviewOverageBilling:        natscl.JSONHandler{Handler: a.PreviewOverageBillingHandler},
+		subjects.CreateUser:                   natscl.JSONHandler{Handler: a.CreateUserHandler},
+		subjects.EnsureUser:                   natscl.JSONHandler{Handler: a.EnsureUserHandler},
+		subjects.GetUser:                      natscl.JSONHandler{Handler: a.GetUserHandler},
+		subjects.ListUsers:                    natscl.JSONHandler{Handler: a.ListUsersHandler},
+		subjects.NormalizeUsername:            natscl.JSONHandler{Handler: a.NormalizeUsernameHandler},
+
+		subjects.GetSubscriptionByExternalID:      natscl.JSONHandler{Handler: a.GetSubscriptionByExternalIDHandler},
+		subjects.GetSubscriptionAddonByExternalID: natscl.JSONHandler{Handler: a.GetSubscriptionAddonByExternalIDHandler},
 	}
 
-	for subject, handler := range natsHandlers {
-		if err = natsClient.Subscribe(subject, handler); err != nil {
+	settings := subjectSettings(config)
+	log.Infof("NATS subject prefix is %s", settings.Prefix)
+	log.Infof("NATS queue suffix is %s", settings.QueueSuffix)
+	log.Infof("disabled NATS subjects: %s", strings.Join(settings.Disabled, " "))
+	log.Infof("NATS API versions: %s", strings.Join(settings.EnabledVersions(), " "))
+
+	if err = natsClient.Apply(settings, natsHandlers); err != nil {
+		log.Fatal(err)
+	}
+
+	// Reload the subject settings on SIGHUP so that subjects can be drained,
+	// re-enabled or moved to different queue groups without a restart.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("received SIGHUP, reloading the NATS subject configuration")
+			newConfig, err := cfg.Init(configSettings)
+			if err != nil {
+				log.Errorf("unable to reload the configuration: %s", err)
+				continue
+			}
+			if err = natsClient.Apply(subjectSettings(newConfig), natsHandlers); err != nil {
+				log.Errorf("unable to apply the NATS subject configuration: %s", err)
+			}
+		}
+	}()
+
+	shutdownTimeout := config.Duration("shutdown.timeout")
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	stopping := &shutdownPlan{
+		timeout:     shutdownTimeout,
+		natsClient:  natsClient,
+		stopWorkers: stopWorkers,
+		databases:   []*sqlx.DB{dbconn},
+	}
+	if replicaConn != nil {
+		stopping.databases = append(stopping.databases, replicaConn)
+	}
+
+	// The health checks are served on their own port so that probes keep
+	// working even if the main port is saturated.
+	if opts.adminPort > 0 {
+		adminSrv := &http.Server{Addr: fmt.Sprintf(":%s", strconv.Itoa(opts.adminPort)), Handler: a.AdminRouter}
+		stopping.servers = append(stopping.servers, adminSrv)
+		log.Infof("serving health checks on %s", adminSrv.Addr)
+		go func() {
+			if err := adminSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// The gRPC server serves the same protocol buffer API as the NATS subjects,
+	// for internal services that prefer gRPC.
+	if config.Bool("grpc.enabled") {
+		grpcPort := config.Int("grpc.port")
+		if grpcPort <= 0 {
+			grpcPort = DefaultGRPCPort
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
 			log.Fatal(err)
 		}
+		grpcSrv := a.NewGRPCServer()
+		stopping.grpcServers = append(stopping.grpcServers, grpcSrv)
+		log.Infof("serving the gRPC API on %s", listener.Addr())
+		go func() {
+			if err := grpcSrv.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 
-	srv := fmt.Sprintf(":%s", strconv.Itoa(*listenPort))
-	log.Fatal(http.ListenAndServe(srv, a.Router))
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", strconv.Itoa(opts.listenPort)), Handler: a.Router}
+	stopping.servers = append(stopping.servers, srv)
+
+	// Stop taking new work when the service is asked to stop, and give the work
+	// in progress a chance to finish.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		stopping.run(<-term)
+		close(done)
+	}()
+
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -0,0 +1,22 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Tracks the progress of long-running operations that are processed in batches.
+--
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    kind text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    total integer NOT NULL DEFAULT 0,
+    processed integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    error_message text,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS failed_webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+
+COMMIT;
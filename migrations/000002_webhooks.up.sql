@@ -0,0 +1,39 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- URLs that are notified when subscription lifecycle events occur.
+--
+CREATE TABLE IF NOT EXISTS webhooks (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    url text NOT NULL,
+    secret text NOT NULL,
+    event_types text[] NOT NULL,
+    enabled boolean NOT NULL DEFAULT true,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- Webhook deliveries that still failed after every retry.
+--
+CREATE TABLE IF NOT EXISTS failed_webhook_deliveries (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    webhook_id uuid NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_id uuid NOT NULL,
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    attempts integer NOT NULL,
+    last_error text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS failed_webhook_deliveries_webhook_id_index
+    ON failed_webhook_deliveries(webhook_id);
+
+COMMIT;
@@ -0,0 +1,24 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Domain events waiting to be published to NATS JetStream. Events are inserted
+-- in the same transaction as the changes they describe, then published and
+-- marked as published by a background process.
+--
+CREATE TABLE IF NOT EXISTS event_outbox (
+    id uuid NOT NULL,
+    event_type text NOT NULL,
+    schema_version integer NOT NULL,
+    payload jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    published_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS event_outbox_unpublished_index
+    ON event_outbox(created_at)
+    WHERE published_at IS NULL;
+
+COMMIT;
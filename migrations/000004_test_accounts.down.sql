@@ -0,0 +1,7 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE users DROP COLUMN IF EXISTS test;
+
+COMMIT;
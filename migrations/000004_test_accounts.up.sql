@@ -0,0 +1,11 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Test accounts are used for QA and demonstrations. They go through the same
+-- operations as any other account, but are excluded from reporting.
+--
+ALTER TABLE users ADD COLUMN IF NOT EXISTS test boolean NOT NULL DEFAULT false;
+
+COMMIT;
@@ -0,0 +1,31 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Plan changes that take effect when the current subscription ends.
+--
+CREATE TABLE IF NOT EXISTS pending_subscription_changes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans(id),
+    paid boolean NOT NULL DEFAULT false,
+    periods integer NOT NULL DEFAULT 1,
+    end_date timestamp with time zone,
+    status text NOT NULL DEFAULT 'pending',
+    new_subscription_id uuid REFERENCES subscriptions(id) ON DELETE SET NULL,
+    error_message text,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- Only one change can be pending for a subscription at a time.
+--
+CREATE UNIQUE INDEX IF NOT EXISTS pending_subscription_changes_pending_index
+    ON pending_subscription_changes(subscription_id)
+    WHERE status = 'pending';
+
+COMMIT;
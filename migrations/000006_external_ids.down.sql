@@ -0,0 +1,13 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP INDEX IF EXISTS subscription_addons_external_id_index;
+ALTER TABLE subscription_addons DROP COLUMN IF EXISTS external_id;
+ALTER TABLE subscription_addons DROP COLUMN IF EXISTS external_source;
+
+DROP INDEX IF EXISTS subscriptions_external_id_index;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS external_id;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS external_source;
+
+COMMIT;
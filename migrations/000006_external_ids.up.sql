@@ -0,0 +1,24 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Identifiers assigned to subscriptions and subscription add-ons by external
+-- systems, such as order numbers from a storefront. Each identifier is unique
+-- within the system that assigned it.
+--
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS external_source text;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS external_id text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS subscriptions_external_id_index
+    ON subscriptions(external_source, external_id)
+    WHERE external_id IS NOT NULL;
+
+ALTER TABLE subscription_addons ADD COLUMN IF NOT EXISTS external_source text;
+ALTER TABLE subscription_addons ADD COLUMN IF NOT EXISTS external_id text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS subscription_addons_external_id_index
+    ON subscription_addons(external_source, external_id)
+    WHERE external_id IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS trials;
+ALTER TABLE plans DROP COLUMN IF EXISTS trial_days;
+ALTER TABLE plans DROP COLUMN IF EXISTS is_trial;
+
+COMMIT;
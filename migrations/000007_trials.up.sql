@@ -0,0 +1,24 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Trial plans give users a limited amount of time on a plan. Each user can only
+-- have one trial subscription to each trial plan.
+--
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS is_trial boolean NOT NULL DEFAULT false;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS trial_days integer NOT NULL DEFAULT 14;
+
+CREATE TABLE IF NOT EXISTS trials (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    subscription_id uuid REFERENCES subscriptions(id) ON DELETE SET NULL,
+    started_at timestamp with time zone NOT NULL,
+    ends_at timestamp with time zone NOT NULL,
+    expiration_notified_at timestamp with time zone,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, plan_id)
+);
+
+COMMIT;
@@ -0,0 +1,27 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The audit log of user records that have been merged into other user records.
+-- The source user is deleted by the merge, so it's identified by its former ID
+-- and username rather than by a foreign key.
+--
+CREATE TABLE IF NOT EXISTS user_merges (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    source_user_id uuid NOT NULL,
+    source_username text NOT NULL,
+    target_user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    target_username text NOT NULL,
+    policy text NOT NULL,
+    ended_subscription_id uuid REFERENCES subscriptions(id) ON DELETE SET NULL,
+    moved_subscriptions integer NOT NULL DEFAULT 0,
+    moved_updates integer NOT NULL DEFAULT 0,
+    merged_by text NOT NULL,
+    merged_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS user_merges_target_user_id_index ON user_merges(target_user_id);
+
+COMMIT;
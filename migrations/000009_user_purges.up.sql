@@ -0,0 +1,27 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Tombstones for users whose data was purged in response to a data-deletion
+-- request. The username isn't kept; only its SHA-256 hash is, so that a purge
+-- can be confirmed for a known username later.
+--
+CREATE TABLE IF NOT EXISTS user_purges (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    user_id uuid NOT NULL,
+    username_sha256 text NOT NULL,
+    subscriptions integer NOT NULL DEFAULT 0,
+    subscription_addons integer NOT NULL DEFAULT 0,
+    quotas integer NOT NULL DEFAULT 0,
+    usages integer NOT NULL DEFAULT 0,
+    updates integer NOT NULL DEFAULT 0,
+    trials integer NOT NULL DEFAULT 0,
+    purged_by text NOT NULL,
+    purged_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS user_purges_username_sha256_index ON user_purges(username_sha256);
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Metered rates are the prices charged for each unit of a resource that's used
+-- beyond the user's quota. The rate in effect for a resource type is the one
+-- with the latest effective date that isn't in the future.
+--
+CREATE TABLE IF NOT EXISTS metered_rates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    effective_date timestamp with time zone NOT NULL DEFAULT now(),
+    rate numeric NOT NULL CHECK (rate >= 0),
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (resource_type_id, effective_date)
+);
+
+COMMIT;
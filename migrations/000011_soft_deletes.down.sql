@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE plans DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE addons DROP COLUMN IF EXISTS deleted_at;
+
+COMMIT;
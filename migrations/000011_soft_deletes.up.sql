@@ -0,0 +1,14 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Add-ons and plans are marked as deleted instead of being removed so that the
+-- subscriptions and subscription add-ons that refer to them remain valid.
+-- Deleted add-ons and plans are omitted from listings and can't be applied to
+-- new subscriptions.
+--
+ALTER TABLE addons ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE quotas DROP COLUMN IF EXISTS version;
+ALTER TABLE addons DROP COLUMN IF EXISTS version;
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Add-ons and quotas carry a version number that's incremented every time
+-- they're updated. Callers can supply the version they last saw with an update
+-- so that concurrent updates can't silently overwrite each other.
+--
+ALTER TABLE addons ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+ALTER TABLE quotas ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 1;
+
+COMMIT;
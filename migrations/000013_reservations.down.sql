@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS reservation_amounts;
+DROP TABLE IF EXISTS reservations;
+
+COMMIT;
@@ -0,0 +1,39 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Planned consumption of resources that counts against the user's quotas until
+-- it's released or expires.
+--
+CREATE TABLE IF NOT EXISTS reservations (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    reference text,
+    status text NOT NULL DEFAULT 'active',
+    expires_at timestamp with time zone NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS reservations_active_subscription_index
+    ON reservations(subscription_id)
+    WHERE status = 'active';
+
+CREATE INDEX IF NOT EXISTS reservations_active_expires_at_index
+    ON reservations(expires_at)
+    WHERE status = 'active';
+
+--
+-- The amount of each resource type that's reserved.
+--
+CREATE TABLE IF NOT EXISTS reservation_amounts (
+    reservation_id uuid NOT NULL REFERENCES reservations(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id),
+    amount numeric NOT NULL CHECK (amount > 0),
+    PRIMARY KEY (reservation_id, resource_type_id)
+);
+
+COMMIT;
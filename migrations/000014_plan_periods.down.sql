@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE plans DROP COLUMN IF EXISTS period_days;
+ALTER TABLE plans DROP COLUMN IF EXISTS period_unit;
+
+COMMIT;
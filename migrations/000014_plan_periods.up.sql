@@ -0,0 +1,13 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The natural billing cadence of each plan, which determines when new
+-- subscriptions to the plan end if no end date is given. The number of days is
+-- only used for plans with custom periods.
+--
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS period_unit text NOT NULL DEFAULT 'yearly';
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS period_days integer NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,34 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Groups own subscriptions whose quotas are shared by their members. Each group
+-- has an account in the users table that its subscriptions belong to, so that
+-- group subscriptions have quotas, usages and add-ons like any other.
+--
+CREATE TABLE IF NOT EXISTS groups (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    name text NOT NULL UNIQUE,
+    description text,
+    user_id uuid NOT NULL UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- The users who draw on the quotas of a group's subscription.
+--
+CREATE TABLE IF NOT EXISTS group_members (
+    group_id uuid NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    added_by text NOT NULL,
+    added_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS group_members_user_id_index ON group_members(user_id);
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS subscription_addon_usages;
+DROP INDEX IF EXISTS updates_subscription_addon_id_index;
+ALTER TABLE updates DROP COLUMN IF EXISTS subscription_addon_id;
+
+COMMIT;
@@ -0,0 +1,27 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The subscription add-on that a usage update is attributed to, if any.
+--
+ALTER TABLE updates ADD COLUMN IF NOT EXISTS subscription_addon_id uuid
+    REFERENCES subscription_addons(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS updates_subscription_addon_id_index
+    ON updates(subscription_addon_id)
+    WHERE subscription_addon_id IS NOT NULL;
+
+--
+-- The portion of a subscription's usage of a resource type that's attributed to
+-- each of its add-ons. The usages table still holds the total usage.
+--
+CREATE TABLE IF NOT EXISTS subscription_addon_usages (
+    subscription_addon_id uuid NOT NULL REFERENCES subscription_addons(id) ON DELETE CASCADE,
+    usage numeric NOT NULL DEFAULT 0,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_addon_id)
+);
+
+COMMIT;
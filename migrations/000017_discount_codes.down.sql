@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS discount_redemptions;
+DROP TABLE IF EXISTS discount_codes;
+
+COMMIT;
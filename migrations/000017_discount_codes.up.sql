@@ -0,0 +1,43 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Discount codes that can be redeemed when a subscription is created or
+-- renewed. The amount is either a percentage of the plan rate or a fixed amount
+-- subtracted from it.
+--
+CREATE TABLE IF NOT EXISTS discount_codes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    code text NOT NULL UNIQUE,
+    description text,
+    discount_type text NOT NULL CHECK (discount_type IN ('percent', 'fixed')),
+    amount numeric NOT NULL CHECK (amount > 0),
+    expires_at timestamp with time zone,
+    max_redemptions integer CHECK (max_redemptions > 0),
+    redemption_count integer NOT NULL DEFAULT 0,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- The discount applied to each subscription, along with the rates before and
+-- after the discount. A subscription can only have one discount.
+--
+CREATE TABLE IF NOT EXISTS discount_redemptions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    discount_code_id uuid NOT NULL REFERENCES discount_codes(id) ON DELETE CASCADE,
+    subscription_id uuid NOT NULL UNIQUE REFERENCES subscriptions(id) ON DELETE CASCADE,
+    original_rate numeric NOT NULL,
+    discounted_rate numeric NOT NULL,
+    redeemed_by text NOT NULL,
+    redeemed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS discount_redemptions_discount_code_id_index
+    ON discount_redemptions(discount_code_id);
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The invoices or checkout sessions created by the billing provider for each
+-- subscription, identified by the IDs that the provider assigned to them.
+--
+CREATE TABLE IF NOT EXISTS external_invoices (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    provider text NOT NULL,
+    external_id text NOT NULL,
+    event_type text NOT NULL,
+    status text,
+    url text,
+    amount numeric NOT NULL DEFAULT 0,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (provider, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS external_invoices_subscription_id_index ON external_invoices(subscription_id);
+
+COMMIT;
@@ -0,0 +1,46 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Invoices generated for subscription periods. The plan, rates, discounts and
+-- proration are copied into each invoice when it's generated, so invoices are
+-- never updated and don't change when rates do.
+--
+CREATE TABLE IF NOT EXISTS invoices (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    username text NOT NULL,
+    plan_name text NOT NULL,
+    period_start timestamp with time zone NOT NULL,
+    period_end timestamp with time zone NOT NULL,
+    proration_fraction numeric NOT NULL,
+    subtotal numeric NOT NULL,
+    discount_total numeric NOT NULL DEFAULT 0,
+    total numeric NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    UNIQUE (subscription_id, period_start, period_end),
+    CHECK (period_end > period_start)
+);
+
+--
+-- The line items of each invoice: one for the plan, one for each add-on and
+-- one for the discount, if there is one.
+--
+CREATE TABLE IF NOT EXISTS invoice_line_items (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    invoice_id uuid NOT NULL REFERENCES invoices(id) ON DELETE CASCADE,
+    position integer NOT NULL,
+    item_type text NOT NULL,
+    description text NOT NULL,
+    subscription_addon_id uuid,
+    quantity numeric NOT NULL DEFAULT 1,
+    unit_rate numeric NOT NULL,
+    amount numeric NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE (invoice_id, position)
+);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS payment_status_changes;
+DROP TABLE IF EXISTS subscription_payment_statuses;
+
+COMMIT;
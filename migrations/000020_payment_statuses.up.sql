@@ -0,0 +1,36 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The payment status of each subscription. Subscriptions without a row here
+-- are treated as paid if their paid flag is set and as pending otherwise. The
+-- paid flag is kept in sync with the status so that existing consumers of the
+-- flag keep working.
+--
+CREATE TABLE IF NOT EXISTS subscription_payment_statuses (
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    status text NOT NULL CHECK (status IN ('pending', 'paid', 'failed', 'refunded', 'waived')),
+    updated_by text NOT NULL,
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id)
+);
+
+--
+-- The history of payment status changes for each subscription.
+--
+CREATE TABLE IF NOT EXISTS payment_status_changes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    from_status text NOT NULL,
+    to_status text NOT NULL,
+    reason text,
+    changed_by text NOT NULL,
+    changed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS payment_status_changes_subscription_id_index
+    ON payment_status_changes(subscription_id);
+
+COMMIT;
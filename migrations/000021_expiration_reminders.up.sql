@@ -0,0 +1,17 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The expiration reminders that have been sent for each subscription. Each
+-- reminder window, which is the number of days before the subscription ends,
+-- only gets one reminder per subscription.
+--
+CREATE TABLE IF NOT EXISTS expiration_reminders (
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    window_days integer NOT NULL,
+    sent_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id, window_days)
+);
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Quota policies determine what happens when consuming a resource would take a
+-- user beyond the quota. Hard policies deny the consumption and soft policies
+-- allow it with a warning. Resource types without a policy use a hard policy.
+-- Consumption is allowed during a subscription's grace period unless the
+-- policy is enforced during the grace period too.
+--
+CREATE TABLE IF NOT EXISTS quota_policies (
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    mode text NOT NULL CHECK (mode IN ('hard', 'soft')),
+    enforce_in_grace boolean NOT NULL DEFAULT false,
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (resource_type_id)
+);
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS addon_prerequisites;
+DROP TABLE IF EXISTS addon_bundle_addons;
+DROP TABLE IF EXISTS addon_bundles;
+
+COMMIT;
@@ -0,0 +1,46 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Add-on bundles group add-ons that are attached to a subscription together.
+--
+CREATE TABLE IF NOT EXISTS addon_bundles (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- The add-ons in each bundle.
+--
+CREATE TABLE IF NOT EXISTS addon_bundle_addons (
+    bundle_id uuid NOT NULL REFERENCES addon_bundles(id) ON DELETE CASCADE,
+    addon_id uuid NOT NULL REFERENCES addons(id) ON DELETE CASCADE,
+    PRIMARY KEY (bundle_id, addon_id)
+);
+
+--
+-- The prerequisites of add-ons. An add-on with prerequisites can only be
+-- attached to a subscription to one of the required plans or a subscription
+-- that already has one of the required add-ons. Each prerequisite names either
+-- a plan or an add-on.
+--
+CREATE TABLE IF NOT EXISTS addon_prerequisites (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    addon_id uuid NOT NULL REFERENCES addons(id) ON DELETE CASCADE,
+    required_plan_id uuid REFERENCES plans(id) ON DELETE CASCADE,
+    required_addon_id uuid REFERENCES addons(id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    CHECK ((required_plan_id IS NULL) <> (required_addon_id IS NULL)),
+    CHECK (required_addon_id IS DISTINCT FROM addon_id),
+    UNIQUE (addon_id, required_plan_id),
+    UNIQUE (addon_id, required_addon_id)
+);
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The plans that add-ons can be attached to. An add-on without any rows in this
+-- table can be attached to subscriptions to any plan; an add-on with rows can
+-- only be attached to subscriptions to the listed plans.
+--
+CREATE TABLE IF NOT EXISTS plan_addon_compatibility (
+    addon_id uuid NOT NULL REFERENCES addons(id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (addon_id, plan_id)
+);
+
+CREATE INDEX IF NOT EXISTS plan_addon_compatibility_plan_id_index
+    ON plan_addon_compatibility(plan_id);
+
+COMMIT;
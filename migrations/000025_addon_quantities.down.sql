@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE subscription_addons DROP COLUMN IF EXISTS quantity;
+ALTER TABLE addons DROP COLUMN IF EXISTS max_per_subscription;
+
+COMMIT;
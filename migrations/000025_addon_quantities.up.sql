@@ -0,0 +1,20 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The maximum number of units of an add-on that can be attached to a single
+-- subscription. Add-ons without a maximum can be attached any number of times.
+--
+ALTER TABLE addons ADD COLUMN IF NOT EXISTS max_per_subscription integer
+    CHECK (max_per_subscription IS NULL OR max_per_subscription > 0);
+
+--
+-- The number of units of an add-on that were attached to a subscription at
+-- once. The amount of a subscription add-on is the total amount that it adds to
+-- the quota, which is the add-on's default amount multiplied by the quantity.
+--
+ALTER TABLE subscription_addons ADD COLUMN IF NOT EXISTS quantity integer NOT NULL DEFAULT 1
+    CHECK (quantity > 0);
+
+COMMIT;
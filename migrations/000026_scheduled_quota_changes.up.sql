@@ -0,0 +1,30 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Quota changes that take effect on a future date. A change that has come due
+-- replaces the subscription's quota for the resource type until the quota is
+-- changed again. The applied_at column records when the change was copied into
+-- the quotas table.
+--
+CREATE TABLE IF NOT EXISTS scheduled_quota_changes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    quota numeric NOT NULL CHECK (quota >= 0),
+    effective_date timestamp with time zone NOT NULL,
+    applied_at timestamp with time zone,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- Quota lookups only need the changes that haven't been applied yet.
+--
+CREATE INDEX IF NOT EXISTS scheduled_quota_changes_pending_index
+    ON scheduled_quota_changes(subscription_id, resource_type_id, effective_date)
+    WHERE applied_at IS NULL;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS usage_rollup_state;
+DROP TABLE IF EXISTS monthly_usage_rollups;
+DROP TABLE IF EXISTS daily_usage_rollups;
+
+COMMIT;
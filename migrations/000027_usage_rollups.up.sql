@@ -0,0 +1,52 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The usage consumed by each user for each resource type on each day, in UTC.
+-- The consumed amount is the total of the usage updates that added to the
+-- usage, and the update count includes updates that set the usage.
+--
+CREATE TABLE IF NOT EXISTS daily_usage_rollups (
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    period_start date NOT NULL,
+    consumed numeric NOT NULL DEFAULT 0,
+    update_count integer NOT NULL DEFAULT 0,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, resource_type_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS daily_usage_rollups_resource_type_index
+    ON daily_usage_rollups(resource_type_id, period_start);
+
+--
+-- The same totals as daily_usage_rollups for each calendar month, in UTC.
+--
+CREATE TABLE IF NOT EXISTS monthly_usage_rollups (
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    period_start date NOT NULL,
+    consumed numeric NOT NULL DEFAULT 0,
+    update_count integer NOT NULL DEFAULT 0,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, resource_type_id, period_start)
+);
+
+CREATE INDEX IF NOT EXISTS monthly_usage_rollups_resource_type_index
+    ON monthly_usage_rollups(resource_type_id, period_start);
+
+--
+-- Records how far the aggregator has gotten through the updates table. There's
+-- only ever one row. A null aggregated_through means that the rollups haven't
+-- been populated yet.
+--
+CREATE TABLE IF NOT EXISTS usage_rollup_state (
+    id boolean NOT NULL DEFAULT true CHECK (id),
+    aggregated_through timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+INSERT INTO usage_rollup_state (id) VALUES (true) ON CONFLICT DO NOTHING;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP INDEX IF EXISTS updates_effective_date_index;
+DROP TABLE IF EXISTS archived_updates;
+
+COMMIT;
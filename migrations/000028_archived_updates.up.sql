@@ -0,0 +1,29 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Updates that were moved out of the updates table by the retention job. The
+-- columns match the updates table, followed by the time the update was
+-- archived. Archived updates are removed along with their users.
+--
+CREATE TABLE IF NOT EXISTS archived_updates (
+    LIKE updates INCLUDING DEFAULTS,
+    archived_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS archived_updates_user_id_index
+    ON archived_updates(user_id);
+
+CREATE INDEX IF NOT EXISTS archived_updates_resource_type_id_index
+    ON archived_updates(resource_type_id);
+
+--
+-- The retention job looks for updates that took effect before a cutoff.
+--
+CREATE INDEX IF NOT EXISTS updates_effective_date_index
+    ON updates(effective_date);
+
+COMMIT;
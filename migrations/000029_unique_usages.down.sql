@@ -0,0 +1,7 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP INDEX IF EXISTS usages_resource_type_id_subscription_id_unique;
+
+COMMIT;
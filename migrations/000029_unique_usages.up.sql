@@ -0,0 +1,37 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Usages can't be changed while the duplicates are removed and the index is
+-- built, so that a new duplicate can't sneak in between the two.
+--
+LOCK TABLE usages IN SHARE ROW EXCLUSIVE MODE;
+
+--
+-- Earlier versions of the service read the usage before writing it, so updates
+-- that raced could record more than one usage for the same subscription and
+-- resource type. Later updates set every one of the duplicates to the same
+-- value, so only the usage that was modified most recently is kept.
+--
+DELETE FROM usages
+WHERE id IN (
+    SELECT id
+    FROM (
+        SELECT id, row_number() OVER (
+            PARTITION BY resource_type_id, subscription_id
+            ORDER BY last_modified_at DESC, usage DESC, id
+        ) AS position
+        FROM usages
+    ) AS ranked
+    WHERE position > 1
+);
+
+--
+-- Usage updates are applied with a single upsert, which needs a unique index to
+-- detect the existing usage for a subscription and resource type.
+--
+CREATE UNIQUE INDEX IF NOT EXISTS usages_resource_type_id_subscription_id_unique
+    ON usages(resource_type_id, subscription_id);
+
+COMMIT;
@@ -0,0 +1,15 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP INDEX IF EXISTS user_purges_tenant_id_index;
+DROP INDEX IF EXISTS subscriptions_tenant_id_index;
+DROP INDEX IF EXISTS plans_tenant_id_index;
+DROP INDEX IF EXISTS users_tenant_id_index;
+
+ALTER TABLE user_purges DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE plans DROP COLUMN IF EXISTS tenant_id;
+ALTER TABLE users DROP COLUMN IF EXISTS tenant_id;
+
+COMMIT;
@@ -0,0 +1,25 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Deployments that share a single QMS database are kept apart by tenant. Rows
+-- without a tenant belong to deployments that don't use tenants. Plans without
+-- a tenant are shared by every tenant.
+--
+ALTER TABLE users ADD COLUMN IF NOT EXISTS tenant_id text;
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS tenant_id text;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS tenant_id text;
+
+--
+-- The tombstones of purged users keep the tenant that the user belonged to,
+-- since the user record is gone by the time the tombstone is recorded.
+--
+ALTER TABLE user_purges ADD COLUMN IF NOT EXISTS tenant_id text;
+
+CREATE INDEX IF NOT EXISTS users_tenant_id_index ON users(tenant_id);
+CREATE INDEX IF NOT EXISTS plans_tenant_id_index ON plans(tenant_id);
+CREATE INDEX IF NOT EXISTS subscriptions_tenant_id_index ON subscriptions(tenant_id);
+CREATE INDEX IF NOT EXISTS user_purges_tenant_id_index ON user_purges(tenant_id);
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP INDEX IF EXISTS subscription_addons_effective_end_date_index;
+
+ALTER TABLE subscription_addons DROP COLUMN IF EXISTS expired_at;
+ALTER TABLE subscription_addons DROP COLUMN IF EXISTS effective_end_date;
+
+COMMIT;
@@ -0,0 +1,17 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Subscription add-ons can end before the subscription does. Once an add-on
+-- has ended, its amount is removed from the quota and the time that happened
+-- is recorded so that it's only removed once.
+--
+ALTER TABLE subscription_addons ADD COLUMN IF NOT EXISTS effective_end_date timestamp with time zone;
+ALTER TABLE subscription_addons ADD COLUMN IF NOT EXISTS expired_at timestamp with time zone;
+
+CREATE INDEX IF NOT EXISTS subscription_addons_effective_end_date_index
+    ON subscription_addons(effective_end_date)
+    WHERE effective_end_date IS NOT NULL AND expired_at IS NULL;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS credit_ledger;
+DROP TABLE IF EXISTS credit_balances;
+
+COMMIT;
@@ -0,0 +1,39 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Credits for consumable resources that administrators deposit for a user.
+-- Usage is drawn from the credits before it counts against the quota. The
+-- balances table holds the current balance for each resource type so that it
+-- can be locked while credits are drawn.
+--
+CREATE TABLE IF NOT EXISTS credit_balances (
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    balance numeric NOT NULL DEFAULT 0 CHECK (balance >= 0),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, resource_type_id)
+);
+
+--
+-- Every deposit and draw of credits. Draws record the usage update that they
+-- were made for.
+--
+CREATE TABLE IF NOT EXISTS credit_ledger (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    kind text NOT NULL CHECK (kind IN ('deposit', 'draw')),
+    amount numeric NOT NULL CHECK (amount > 0),
+    update_id uuid,
+    description text,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS credit_ledger_user_index
+    ON credit_ledger(user_id, resource_type_id, created_at);
+
+COMMIT;
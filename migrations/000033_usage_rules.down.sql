@@ -0,0 +1,9 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS flagged_usage_updates;
+DROP TABLE IF EXISTS usage_hourly_deltas;
+DROP TABLE IF EXISTS usage_rules;
+
+COMMIT;
@@ -0,0 +1,57 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Validation rules for the usage updates of a resource type. Limits that are
+-- null aren't checked. Updates that break a rule are either rejected or
+-- applied and flagged for review, depending on the action.
+--
+CREATE TABLE IF NOT EXISTS usage_rules (
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    min_value numeric,
+    max_value numeric,
+    max_hourly_delta numeric CHECK (max_hourly_delta >= 0),
+    allow_negative boolean NOT NULL DEFAULT false,
+    action text NOT NULL DEFAULT 'reject' CHECK (action IN ('reject', 'flag')),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (resource_type_id)
+);
+
+--
+-- The total change in usage during the current hour for each subscription and
+-- resource type that has a limit on it. The window starts over once it's more
+-- than an hour old.
+--
+CREATE TABLE IF NOT EXISTS usage_hourly_deltas (
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    window_start timestamp with time zone NOT NULL DEFAULT now(),
+    delta numeric NOT NULL DEFAULT 0,
+    PRIMARY KEY (subscription_id, resource_type_id)
+);
+
+--
+-- Usage updates that broke a validation rule, whether they were rejected or
+-- applied, so that administrators can review them.
+--
+CREATE TABLE IF NOT EXISTS flagged_usage_updates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    update_type text NOT NULL,
+    value numeric NOT NULL,
+    reason text NOT NULL,
+    rejected boolean NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    reviewed_by text,
+    reviewed_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS flagged_usage_updates_unreviewed_index
+    ON flagged_usage_updates(created_at)
+    WHERE reviewed_at IS NULL;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS quarantined_usage_updates;
+
+DELETE FROM usage_rules WHERE action = 'quarantine';
+ALTER TABLE usage_rules DROP CONSTRAINT IF EXISTS usage_rules_action_check;
+ALTER TABLE usage_rules ADD CONSTRAINT usage_rules_action_check
+    CHECK (action IN ('reject', 'flag'));
+
+COMMIT;
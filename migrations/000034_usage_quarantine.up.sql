@@ -0,0 +1,35 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Usage rules can hold the updates that break them for review instead of
+-- rejecting or applying them.
+--
+ALTER TABLE usage_rules DROP CONSTRAINT IF EXISTS usage_rules_action_check;
+ALTER TABLE usage_rules ADD CONSTRAINT usage_rules_action_check
+    CHECK (action IN ('reject', 'flag', 'quarantine'));
+
+--
+-- Usage updates that are held until an administrator approves or rejects them.
+-- Approved updates are applied to the usage when they're approved.
+--
+CREATE TABLE IF NOT EXISTS quarantined_usage_updates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types(id) ON DELETE CASCADE,
+    update_type text NOT NULL,
+    value numeric NOT NULL,
+    reason text NOT NULL,
+    status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    resolved_by text,
+    resolved_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS quarantined_usage_updates_pending_index
+    ON quarantined_usage_updates(created_at)
+    WHERE status = 'pending';
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+ALTER TABLE plans DROP COLUMN IF EXISTS quota_exempt;
+
+COMMIT;
@@ -0,0 +1,12 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Quota-exempt plans are meant for service accounts and other internal users.
+-- Their subscriptions are never in overage, so they're left out of overage
+-- checks and reports.
+--
+ALTER TABLE plans ADD COLUMN IF NOT EXISTS quota_exempt boolean NOT NULL DEFAULT false;
+
+COMMIT;
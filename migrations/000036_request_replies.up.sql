@@ -0,0 +1,20 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The responses to NATS requests that carried message IDs, so that a retry of a
+-- request that was already handled by any instance of the service is answered
+-- with the original response instead of being handled again. The rows are only
+-- needed for the length of the deduplication window, after which they're
+-- purged.
+--
+CREATE TABLE IF NOT EXISTS request_replies (
+    key text NOT NULL PRIMARY KEY,
+    response bytea NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS request_replies_created_at_index ON request_replies (created_at);
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DROP TABLE IF EXISTS subscription_tags;
+DROP TABLE IF EXISTS subscription_notes;
+
+COMMIT;
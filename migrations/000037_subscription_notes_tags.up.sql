@@ -0,0 +1,39 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Free-form notes that administrators attach to subscriptions, such as the
+-- reason that a subscription was given away.
+--
+CREATE TABLE IF NOT EXISTS subscription_notes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    note text NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS subscription_notes_subscription_id_index
+    ON subscription_notes(subscription_id, created_at);
+
+--
+-- Key/value tags that administrators attach to subscriptions, such as the
+-- cohort that a subscription belongs to. Each subscription has at most one
+-- value for each key. Listings and reports can be limited to the subscriptions
+-- with a tag.
+--
+CREATE TABLE IF NOT EXISTS subscription_tags (
+    subscription_id uuid NOT NULL REFERENCES subscriptions(id) ON DELETE CASCADE,
+    key text NOT NULL,
+    value text NOT NULL DEFAULT '',
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (subscription_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS subscription_tags_key_value_index
+    ON subscription_tags(key, value);
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- The features that a plan gives its subscribers access to, beyond their
+-- quotas, such as interactive analyses or a priority queue. Other services look
+-- up whether a user's plan has a feature when they make authorization
+-- decisions.
+--
+CREATE TABLE IF NOT EXISTS plan_features (
+    plan_id uuid NOT NULL REFERENCES plans(id) ON DELETE CASCADE,
+    feature text NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (plan_id, feature)
+);
+
+COMMIT;
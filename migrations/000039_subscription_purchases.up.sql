@@ -0,0 +1,37 @@
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+--
+-- Subscription purchases that have been reserved by a checkout but haven't been
+-- paid for yet. The subscription is only changed once the purchase is committed.
+--
+CREATE TABLE IF NOT EXISTS subscription_purchases (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans(id),
+    periods integer NOT NULL DEFAULT 1,
+    amount numeric NOT NULL DEFAULT 0,
+    reference text,
+    payment_reference text,
+    status text NOT NULL DEFAULT 'pending',
+    expires_at timestamp with time zone NOT NULL,
+    new_subscription_id uuid REFERENCES subscriptions(id) ON DELETE SET NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+--
+-- Only one purchase can be pending for a user at a time.
+--
+CREATE UNIQUE INDEX IF NOT EXISTS subscription_purchases_pending_index
+    ON subscription_purchases(user_id)
+    WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS subscription_purchases_pending_expires_at_index
+    ON subscription_purchases(expires_at)
+    WHERE status = 'pending';
+
+COMMIT;
@@ -0,0 +1,170 @@
+// Package migrations embeds the database migrations for the tables and columns
+// that only the subscriptions service uses, so that the service can apply them
+// itself and check that the database is up to date before it starts serving.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// DefaultTable is the name of the table that the schema version is recorded in.
+// It isn't golang-migrate's default so that it doesn't collide with the table
+// that the QMS migrations are recorded in.
+const DefaultTable = "subscriptions_schema_migrations"
+
+//go:embed *.sql
+var files embed.FS
+
+// ErrSchemaBehind is returned by Check when migrations haven't been applied.
+var ErrSchemaBehind = errors.New("the database schema is behind")
+
+// ErrSchemaDirty is returned by Check and Apply when a migration failed part of
+// the way through and the database has to be fixed by hand.
+var ErrSchemaDirty = errors.New("the database schema is dirty")
+
+// Status describes the schema version of a database.
+type Status struct {
+	// Current is the version of the last migration applied to the database, or 0
+	// if none have been applied.
+	Current uint
+
+	// Latest is the version of the last embedded migration.
+	Latest uint
+
+	// Dirty is set if the last migration failed part of the way through.
+	Dirty bool
+}
+
+// Behind reports whether the database is missing any of the embedded
+// migrations.
+func (s Status) Behind() bool {
+	return s.Current < s.Latest
+}
+
+// Latest returns the version of the last embedded migration.
+func Latest() (uint, error) {
+	src, err := iofs.New(files, ".")
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	version, err := src.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := src.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// withMigrate calls a function with a migrate instance that uses a connection
+// from the pool. Only that connection is closed afterwards.
+func withMigrate(ctx context.Context, db *sql.DB, table string, fn func(*migrate.Migrate) error) error {
+	if table == "" {
+		table = DefaultTable
+	}
+
+	src, err := iofs.New(files, ".")
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		_ = src.Close()
+		return err
+	}
+
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{MigrationsTable: table})
+	if err != nil {
+		_ = src.Close()
+		_ = conn.Close()
+		return err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", src, "postgres", driver)
+	if err != nil {
+		_ = src.Close()
+		_ = driver.Close()
+		return err
+	}
+	defer m.Close()
+
+	return fn(m)
+}
+
+// status returns the schema version of the database that a migrate instance
+// is connected to.
+func status(m *migrate.Migrate) (Status, error) {
+	latest, err := Latest()
+	if err != nil {
+		return Status{}, err
+	}
+
+	current, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return Status{Latest: latest}, nil
+	}
+	if err != nil {
+		return Status{}, err
+	}
+	return Status{Current: current, Latest: latest, Dirty: dirty}, nil
+}
+
+// Check returns the schema version of the database, along with ErrSchemaDirty
+// or ErrSchemaBehind if the service shouldn't use it.
+func Check(ctx context.Context, db *sql.DB, table string) (Status, error) {
+	var result Status
+	err := withMigrate(ctx, db, table, func(m *migrate.Migrate) error {
+		var err error
+		if result, err = status(m); err != nil {
+			return err
+		}
+		switch {
+		case result.Dirty:
+			return fmt.Errorf("%w at version %d", ErrSchemaDirty, result.Current)
+		case result.Behind():
+			return fmt.Errorf("%w: it's at version %d but version %d is required", ErrSchemaBehind, result.Current, result.Latest)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Apply applies the embedded migrations that haven't been applied to the
+// database yet and returns the resulting schema version. The migrations are
+// applied while holding an advisory lock, so replicas that start at the same
+// time don't apply them twice.
+func Apply(ctx context.Context, db *sql.DB, table string) (Status, error) {
+	var result Status
+	err := withMigrate(ctx, db, table, func(m *migrate.Migrate) error {
+		err := m.Up()
+		if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+			var dirtyErr migrate.ErrDirty
+			if errors.As(err, &dirtyErr) {
+				return fmt.Errorf("%w at version %d", ErrSchemaDirty, dirtyErr.Version)
+			}
+			return err
+		}
+		result, err = status(m)
+		return err
+	})
+	return result, err
+}
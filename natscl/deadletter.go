@@ -0,0 +1,257 @@
+package natscl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// The headers added to dead letters. The payload and the rest of the headers
+// are those of the original message, so a dead letter can be replayed by
+// publishing it to the subject in DeadLetterSubjectHeader.
+const (
+	DeadLetterSubjectHeader    = "QMS-DLQ-Subject"
+	DeadLetterErrorHeader      = "QMS-DLQ-Error"
+	DeadLetterErrorCodeHeader  = "QMS-DLQ-Error-Code"
+	DeadLetterReceivedAtHeader = "QMS-DLQ-Received-At"
+)
+
+// The default dead letter settings.
+const (
+	DefaultDeadLetterSubject = "qms.dlq"
+	DefaultDeadLetterStream  = "QMS_DLQ"
+	DefaultDeadLetterMaxAge  = 14 * 24 * time.Hour
+)
+
+// DeadLetterSettings controls the forwarding of messages that couldn't be
+// handled because they couldn't be decoded or failed validation.
+type DeadLetterSettings struct {
+	// Enabled turns on forwarding.
+	Enabled bool
+
+	// Subject is the subject that dead letters are published on.
+	Subject string
+
+	// StreamName is the name of the JetStream stream that keeps the dead letters
+	// so that they can be inspected and replayed.
+	StreamName string
+
+	// MaxAge is the amount of time that dead letters are kept in the stream.
+	MaxAge time.Duration
+}
+
+// DefaultDeadLetterSettings returns the default settings for dead letters.
+func DefaultDeadLetterSettings() DeadLetterSettings {
+	return DeadLetterSettings{
+		Subject:    DefaultDeadLetterSubject,
+		StreamName: DefaultDeadLetterStream,
+		MaxAge:     DefaultDeadLetterMaxAge,
+	}
+}
+
+// deadLetterCodes lists the error codes of responses that mean the request
+// itself was at fault, as opposed to the service.
+var deadLetterCodes = map[svcerror.ErrorCode]bool{
+	svcerror.ErrorCode_BAD_REQUEST:       true,
+	svcerror.ErrorCode_UNMARSHAL_FAILURE: true,
+	svcerror.ErrorCode_PARAMETER_MISSING: true,
+	svcerror.ErrorCode_PARAMETER_INVALID: true,
+}
+
+// EnsureDeadLetterStream creates the stream that keeps the dead letters if it
+// doesn't exist already, and updates its subject and retention settings if it
+// does.
+func EnsureDeadLetterStream(js nats.JetStreamContext, settings DeadLetterSettings) error {
+	config := &nats.StreamConfig{
+		Name:     settings.StreamName,
+		Subjects: []string{settings.Subject},
+		Storage:  nats.FileStorage,
+		MaxAge:   settings.MaxAge,
+	}
+
+	_, err := js.StreamInfo(settings.StreamName)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = js.AddStream(config)
+	case err == nil:
+		_, err = js.UpdateStream(config)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to configure the %s stream: %w", settings.StreamName, err)
+	}
+
+	return nil
+}
+
+// SetDeadLetterSettings sets how messages that can't be handled are forwarded.
+func (c *Client) SetDeadLetterSettings(settings DeadLetterSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadLetters = settings
+}
+
+// deadLetterCounter counts the messages that were forwarded as dead letters.
+var deadLetterCounter metric.Int64Counter
+
+func init() {
+	var err error
+	deadLetterCounter, err = otel.Meter("github.com/cyverse-de/subscriptions/natscl").Int64Counter(
+		"qms.requests.dead_letters",
+		metric.WithDescription("The number of NATS messages forwarded as dead letters."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the dead letter counter: %s", err)
+	}
+}
+
+// deadLetter forwards a message that couldn't be handled, along with the reason
+// why, if forwarding is enabled. Failures are only logged, since there's no one
+// to report them to.
+func (c *Client) deadLetter(msg *nats.Msg, code svcerror.ErrorCode, reason string) {
+	c.mu.Lock()
+	settings := c.deadLetters
+	base := c.settings.baseFor(msg.Subject)
+	c.mu.Unlock()
+
+	if !settings.Enabled {
+		return
+	}
+
+	header := nats.Header{}
+	for key, values := range msg.Header {
+		header[key] = append([]string(nil), values...)
+	}
+	header.Set(DeadLetterSubjectHeader, msg.Subject)
+	header.Set(DeadLetterErrorHeader, reason)
+	header.Set(DeadLetterErrorCodeHeader, code.String())
+	header.Set(DeadLetterReceivedAtHeader, time.Now().UTC().Format(time.RFC3339Nano))
+
+	letter := &nats.Msg{Subject: settings.Subject, Header: header, Data: msg.Data}
+	if err := c.conn.Conn.PublishMsg(letter); err != nil {
+		log.WithFields(logrus.Fields{"subject": msg.Subject}).Errorf("unable to forward a dead letter: %s", err)
+		return
+	}
+
+	if deadLetterCounter != nil {
+		deadLetterCounter.Add(context.Background(), 1, metric.WithAttributes(attribute.String("subject", base)))
+	}
+}
+
+// deadLetterRejected forwards the request being answered by an error response
+// if the error says that the request was at fault. Only requests with reply
+// subjects can be matched up with their responses.
+func (c *Client) deadLetterRejected(replySubject string, serviceErr *svcerror.ServiceError) {
+	if serviceErr == nil || !deadLetterCodes[serviceErr.ErrorCode] {
+		return
+	}
+	if msg, ok := c.inProgress.Load(replySubject); ok {
+		c.deadLetter(msg.(*nats.Msg), serviceErr.ErrorCode, serviceErr.Message)
+	}
+}
+
+// DefaultHandlerLimit is the default number of messages that are handled at
+// once across every subject.
+const DefaultHandlerLimit = 1024
+
+// SetHandlerLimit sets the number of messages that are handled at once across
+// every subject. Messages that are already being handled keep their slots.
+func (c *Client) SetHandlerLimit(limit int) {
+	if limit <= 0 {
+		limit = DefaultHandlerLimit
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlerSlots = make(chan struct{}, limit)
+}
+
+// msgHandler returns a handler that decodes each message for the given handler
+// in the same way that an encoded connection would, and then calls the handler
+// in a goroutine of its own. NATS delivers the messages for a subscription one
+// at a time, so a single slow request would otherwise hold up every request
+// behind it. The number of goroutines is bounded by the handler limit: once
+// every slot is taken, the delivery of further messages waits for one to be
+// freed, which leaves them to the pending limits of their subscriptions. The
+// per-subject concurrency limits are left to the handlers. Messages that can't
+// be decoded are forwarded as dead letters, and messages that repeat an earlier
+// request are deduplicated.
+//
+//nolint:staticcheck
+func (c *Client) msgHandler(enc nats.Encoder, handler nats.Handler) (nats.MsgHandler, error) {
+	fn := reflect.ValueOf(handler)
+	if fn.Kind() != reflect.Func {
+		return nil, errors.New("the handler must be a function")
+	}
+
+	fnType := fn.Type()
+	numArgs := fnType.NumIn()
+	if numArgs < 1 || numArgs > 3 || fnType.NumOut() != 0 {
+		return nil, fmt.Errorf("unsupported handler type: %s", fnType)
+	}
+	argType := fnType.In(numArgs - 1)
+
+	return func(msg *nats.Msg) {
+		var arg reflect.Value
+		if argType.Kind() == reflect.Pointer {
+			arg = reflect.New(argType.Elem())
+		} else {
+			arg = reflect.New(argType)
+		}
+
+		if err := enc.Decode(msg.Subject, msg.Data, arg.Interface()); err != nil {
+			log.WithFields(logrus.Fields{"subject": msg.Subject}).Errorf("unable to decode the message: %s", err)
+			c.deadLetter(msg, svcerror.ErrorCode_UNMARSHAL_FAILURE, err.Error())
+			return
+		}
+		if argType.Kind() != reflect.Pointer {
+			arg = arg.Elem()
+		}
+
+		var args []reflect.Value
+		switch numArgs {
+		case 1:
+			args = []reflect.Value{arg}
+		case 2:
+			args = []reflect.Value{reflect.ValueOf(msg.Subject), arg}
+		case 3:
+			args = []reflect.Value{reflect.ValueOf(msg.Subject), reflect.ValueOf(msg.Reply), arg}
+		}
+
+		// Keep track of the message until it's been handled so that it can be
+		// forwarded if the handler rejects it.
+		if msg.Reply != "" {
+			c.inProgress.Store(msg.Reply, msg)
+		}
+		c.mu.Lock()
+		slots := c.handlerSlots
+		c.mu.Unlock()
+
+		slots <- struct{}{}
+		c.inFlight.Add(1)
+		go func() {
+			defer c.inFlight.Add(-1)
+			defer func() { <-slots }()
+			if msg.Reply != "" {
+				defer c.inProgress.Delete(msg.Reply)
+			}
+
+			// Retries of requests that have already been handled are answered
+			// with the earlier response instead.
+			if c.replay(msg) {
+				return
+			}
+			defer c.finishReply(msg.Reply)
+
+			fn.Call(args)
+		}()
+	}, nil
+}
@@ -0,0 +1,85 @@
+package natscl
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/encoders/builtin"
+)
+
+type testRequest struct {
+	ID int `json:"id"`
+}
+
+func TestMsgHandlerHonoursHandlerLimit(t *testing.T) {
+	const limit = 3
+	const messages = 20
+
+	c := &Client{handlerSlots: make(chan struct{}, DefaultHandlerLimit)}
+	c.SetHandlerLimit(limit)
+
+	var running, maxRunning atomic.Int64
+	release := make(chan struct{})
+	var handled sync.WaitGroup
+	handled.Add(messages)
+
+	handler := func(subject, reply string, request *testRequest) {
+		defer handled.Done()
+		n := running.Add(1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+	}
+
+	msgHandler, err := c.msgHandler(&builtin.JsonEncoder{}, handler)
+	if err != nil {
+		t.Fatalf("unable to create the message handler: %s", err)
+	}
+
+	// Deliver the messages one at a time, as a NATS subscription would.
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for i := 0; i < messages; i++ {
+			msgHandler(&nats.Msg{Subject: "qms.test", Data: []byte(`{"id": 1}`)})
+		}
+	}()
+
+	// Delivery has to block once every slot is taken.
+	deadline := time.Now().Add(5 * time.Second)
+	for running.Load() < limit && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-delivered:
+		t.Fatal("every message was delivered while the handlers were still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := running.Load(); got != limit {
+		t.Errorf("expected %d handlers to be running; got %d", limit, got)
+	}
+
+	close(release)
+	handled.Wait()
+	<-delivered
+
+	if got := maxRunning.Load(); got > limit {
+		t.Errorf("expected at most %d handlers to run at once; got %d", limit, got)
+	}
+}
+
+func TestSetHandlerLimitDefault(t *testing.T) {
+	c := &Client{}
+	c.SetHandlerLimit(0)
+	if got := cap(c.handlerSlots); got != DefaultHandlerLimit {
+		t.Errorf("expected the default handler limit of %d; got %d", DefaultHandlerLimit, got)
+	}
+}
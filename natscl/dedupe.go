@@ -0,0 +1,300 @@
+package natscl
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/api"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/nats-io/nats.go"
+)
+
+// MsgIDHeader is the header that callers set to a unique ID for each request
+// that they might send more than once. It's the same header that JetStream
+// uses to deduplicate published messages.
+const MsgIDHeader = nats.MsgIdHdr
+
+// The default deduplication settings.
+const (
+	DefaultDedupeWindow = 5 * time.Minute
+	DefaultDedupeSize   = 10000
+	DefaultDedupeWait   = 10 * time.Second
+)
+
+// ReplyStore keeps the responses to requests with message IDs somewhere that
+// every instance of the service can see, so that a retry that's handled by a
+// different instance is still recognized.
+type ReplyStore interface {
+	// LoadReply returns the response recorded for the key at or after the
+	// given time, if there is one.
+	LoadReply(ctx context.Context, key string, since time.Time) ([]byte, bool, error)
+
+	// SaveReply records the response for the key.
+	SaveReply(ctx context.Context, key string, data []byte) error
+}
+
+// DedupeSettings controls how requests that carry a message ID are
+// deduplicated. A request that arrives with the same subject and message ID as
+// one that was answered successfully within the window isn't handled again;
+// the earlier response is sent instead. A request that arrives while the first
+// one is still being handled waits for its response, but only for as long as
+// the first one can take; if the response still isn't ready, the request is
+// answered with ErrRequestInProgress. Failed requests aren't remembered, so they
+// can be retried.
+type DedupeSettings struct {
+	// Window is how long responses are remembered. Zero turns deduplication
+	// off.
+	Window time.Duration
+
+	// Size is the maximum number of responses kept in memory. The least
+	// recently used responses are forgotten first.
+	Size int
+
+	// Store also keeps the responses outside of memory if it's set.
+	Store ReplyStore
+
+	// MaxWait returns the longest amount of time that a request waits for the
+	// response to the first request with the same message ID, given the base
+	// subject. It should match the time budget for the subject. If it isn't
+	// set, requests wait for up to DefaultDedupeWait.
+	MaxWait func(subject string) time.Duration
+}
+
+// maxWait returns the longest amount of time that a request for the base
+// subject waits for the response to an earlier request.
+func (s *DedupeSettings) maxWait(subject string) time.Duration {
+	if s.MaxWait != nil {
+		if wait := s.MaxWait(subject); wait > 0 {
+			return wait
+		}
+	}
+	return DefaultDedupeWait
+}
+
+// DefaultDedupeSettings returns the default deduplication settings, which keep
+// the responses in memory only.
+func DefaultDedupeSettings() DedupeSettings {
+	return DedupeSettings{
+		Window: DefaultDedupeWindow,
+		Size:   DefaultDedupeSize,
+	}
+}
+
+// reply is the response to a request with a message ID. The response is kept
+// while the request is being handled. The done channel is closed once the
+// request has been handled, after which data holds the response, or nil if the
+// request failed.
+type reply struct {
+	key        string
+	receivedAt time.Time
+	response   []byte
+	done       chan struct{}
+	data       []byte
+}
+
+// replies remembers the responses to requests with message IDs.
+type replies struct {
+	mu       sync.Mutex
+	settings DedupeSettings
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newReplies(settings DedupeSettings) *replies {
+	if settings.Size <= 0 {
+		settings.Size = DefaultDedupeSize
+	}
+	return &replies{
+		settings: settings,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// begin returns the reply for the key. The second value is true if this is the
+// first request with the key within the window, in which case the caller must
+// call finish once the request has been handled.
+func (r *replies) begin(key string) (*reply, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if elem, ok := r.entries[key]; ok {
+		existing := elem.Value.(*reply)
+		if now.Sub(existing.receivedAt) < r.settings.Window {
+			r.order.MoveToFront(elem)
+			return existing, false
+		}
+		r.order.Remove(elem)
+		delete(r.entries, key)
+	}
+
+	created := &reply{key: key, receivedAt: now, done: make(chan struct{})}
+	r.entries[key] = r.order.PushFront(created)
+	for r.order.Len() > r.settings.Size {
+		oldest := r.order.Back()
+		r.order.Remove(oldest)
+		delete(r.entries, oldest.Value.(*reply).key)
+	}
+	return created, true
+}
+
+// finish records the response to the first request with the key and wakes up
+// the requests that are waiting for it. A nil response means that the request
+// failed, so the key is forgotten and the next request with it is handled.
+func (r *replies) finish(entry *reply, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry.data = data
+	close(entry.done)
+	if data == nil {
+		if elem, ok := r.entries[entry.key]; ok && elem.Value == entry {
+			r.order.Remove(elem)
+			delete(r.entries, entry.key)
+		}
+	}
+}
+
+// SetDedupeSettings sets how requests that carry a message ID are
+// deduplicated. It must be called before any handlers are subscribed.
+func (c *Client) SetDedupeSettings(settings DedupeSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if settings.Window <= 0 {
+		c.replies = nil
+		return
+	}
+	c.replies = newReplies(settings)
+}
+
+// dedupeKey returns the key that the response to a message is remembered by,
+// or an empty string if the message isn't deduplicated.
+func dedupeKey(msg *nats.Msg) string {
+	if msg.Reply == "" || msg.Header == nil {
+		return ""
+	}
+	id := msg.Header.Get(MsgIDHeader)
+	if id == "" {
+		return ""
+	}
+	return msg.Subject + ":" + id
+}
+
+// replay answers a message with the response to an earlier request with the
+// same message ID if there is one, waiting for the earlier request to be
+// handled if it's still in progress. If the earlier request still hasn't been
+// handled once the wait is over, the message is answered with an error asking
+// the caller to retry later rather than being handled a second time. It returns
+// true if the message was answered. Otherwise, the message has to be handled, and the response is
+// recorded once it's been sent.
+func (c *Client) replay(msg *nats.Msg) bool {
+	c.mu.Lock()
+	r := c.replies
+	base := c.settings.baseFor(msg.Subject)
+	c.mu.Unlock()
+
+	key := dedupeKey(msg)
+	if r == nil || key == "" {
+		return false
+	}
+
+	for {
+		entry, first := r.begin(key)
+		if first {
+			if r.settings.Store != nil {
+				since := time.Now().Add(-r.settings.Window)
+				data, found, err := r.settings.Store.LoadReply(context.Background(), key, since)
+				if err != nil {
+					log.Errorf("unable to look up the response for %s: %s", key, err)
+				}
+				if found {
+					r.finish(entry, data)
+					c.sendReplay(msg, data)
+					return true
+				}
+			}
+			c.pendingReplies.Store(msg.Reply, entry)
+			return false
+		}
+
+		// Wait for the first request to be handled, but not for longer than it
+		// can take.
+		timer := time.NewTimer(r.settings.maxWait(base))
+		select {
+		case <-entry.done:
+			timer.Stop()
+		case <-timer.C:
+			c.sendInProgress(msg)
+			return true
+		}
+		if entry.data != nil {
+			c.sendReplay(msg, entry.data)
+			return true
+		}
+
+		// The first request failed, so this one gets another try.
+	}
+}
+
+// sendInProgress tells the caller that an earlier request with the same message
+// ID is still being handled.
+func (c *Client) sendInProgress(msg *nats.Msg) {
+	log.Warnf("message %s on %s is still being handled", msg.Header.Get(MsgIDHeader), msg.Subject)
+	response := &api.Response{Error: suberrors.NatsError(context.Background(), suberrors.ErrRequestInProgress)}
+	if err := c.jsonConn.Publish(msg.Reply, response); err != nil {
+		log.Errorf("unable to respond to %s: %s", msg.Subject, err)
+	}
+}
+
+// sendReplay sends a response that was recorded for an earlier request.
+func (c *Client) sendReplay(msg *nats.Msg, data []byte) {
+	log.Infof("replaying the response to message %s on %s", msg.Header.Get(MsgIDHeader), msg.Subject)
+	if err := c.conn.Conn.Publish(msg.Reply, data); err != nil {
+		log.Errorf("unable to replay the response to %s: %s", msg.Subject, err)
+	}
+}
+
+// rememberResponse keeps the response sent on the reply subject if the request
+// carried a message ID and was successful, so that it can be replayed. The
+// response is only encoded if it needs to be kept.
+func (c *Client) rememberResponse(replySubject string, failed bool, encode func() ([]byte, error)) {
+	value, ok := c.pendingReplies.Load(replySubject)
+	if !ok || failed {
+		return
+	}
+	entry := value.(*reply)
+
+	data, err := encode()
+	if err != nil {
+		log.Errorf("unable to record the response for %s: %s", entry.key, err)
+		return
+	}
+	entry.response = data
+}
+
+// finishReply records the response to a request with a message ID once the
+// request has been handled, and wakes up any retries that are waiting for it.
+func (c *Client) finishReply(replySubject string) {
+	value, ok := c.pendingReplies.LoadAndDelete(replySubject)
+	if !ok {
+		return
+	}
+	entry := value.(*reply)
+
+	c.mu.Lock()
+	r := c.replies
+	c.mu.Unlock()
+	if r == nil {
+		return
+	}
+
+	if entry.response != nil && r.settings.Store != nil {
+		if err := r.settings.Store.SaveReply(context.Background(), entry.key, entry.response); err != nil {
+			log.Errorf("unable to store the response for %s: %s", entry.key, err)
+		}
+	}
+	r.finish(entry, entry.response)
+}
@@ -0,0 +1,158 @@
+package natscl
+
+import (
+	"context"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DefaultMaxReconnectWait is the longest time, in seconds, to wait between
+// attempts to reconnect to NATS by default.
+const DefaultMaxReconnectWait = 30
+
+// The counters describing the state of the NATS connection, so that operators
+// can see when the connection is flapping.
+var (
+	disconnectCounter  metric.Int64Counter
+	reconnectCounter   metric.Int64Counter
+	resubscribeCounter metric.Int64Counter
+)
+
+func init() {
+	var err error
+	meter := otel.Meter("github.com/cyverse-de/subscriptions/natscl")
+
+	disconnectCounter, err = meter.Int64Counter(
+		"qms.nats.disconnects",
+		metric.WithDescription("The number of times the connection to NATS was lost."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the NATS disconnect counter: %s", err)
+	}
+
+	reconnectCounter, err = meter.Int64Counter(
+		"qms.nats.reconnects",
+		metric.WithDescription("The number of times the connection to NATS was restored."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the NATS reconnect counter: %s", err)
+	}
+
+	resubscribeCounter, err = meter.Int64Counter(
+		"qms.nats.resubscriptions",
+		metric.WithDescription("The number of handler subscriptions that were re-established after reconnecting."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the NATS resubscription counter: %s", err)
+	}
+}
+
+// reconnectDelay returns a function that waits twice as long after each failed
+// attempt to reconnect, starting with the initial wait and going no higher than
+// the maximum. Some jitter is added so that the instances of the service don't
+// all reconnect at once when a NATS server comes back.
+func reconnectDelay(initial, maximum time.Duration) nats.ReconnectDelayHandler {
+	if initial <= 0 {
+		initial = time.Second
+	}
+	if maximum < initial {
+		maximum = initial
+	}
+
+	return func(attempts int) time.Duration {
+		delay := maximum
+		if attempts < 32 {
+			if backoff := initial << max(attempts-1, 0); backoff > 0 && backoff < maximum {
+				delay = backoff
+			}
+		}
+		return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+	}
+}
+
+// resubscribe re-establishes the handler subscriptions that are no longer
+// valid. The NATS client restores its subscriptions when it reconnects, but a
+// subscription can still be lost, for example if the server rejected it while
+// the connection was being restored.
+func (c *Client) resubscribe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Subscriptions are expected to go away while the client drains.
+	if c.draining {
+		return
+	}
+
+	for base, existing := range c.subscriptions {
+		if existing.sub.IsValid() {
+			continue
+		}
+
+		delete(c.subscriptions, base)
+		if err := c.subscribe(base, existing.handler); err != nil {
+			log.Errorf("unable to re-establish the handler for subject %s: %s", existing.subject, err)
+			c.subscriptions[base] = existing
+			continue
+		}
+		resubscribeCounter.Add(context.Background(), 1)
+		log.Infof("re-established the handler for subject %s", existing.subject)
+	}
+}
+
+// InFlight returns the number of messages that are being handled.
+func (c *Client) InFlight() int64 {
+	return c.inFlight.Load()
+}
+
+// Drain stops the client from receiving new messages, waits for the messages
+// that have already been received to be handled and then closes the
+// connection once the responses have been sent. Returns the number of
+// messages that were still being handled when the timeout was reached, along
+// with context.DeadlineExceeded, if the client couldn't be drained in time.
+func (c *Client) Drain(timeout time.Duration) (int64, error) {
+	deadline := time.Now().Add(timeout)
+
+	// Stop taking new messages. The messages that have already been delivered
+	// to the subscriptions are still handled.
+	c.mu.Lock()
+	c.draining = true
+	subs := make([]*nats.Subscription, 0, len(c.subscriptions))
+	for _, existing := range c.subscriptions {
+		if err := existing.sub.Drain(); err != nil {
+			log.Errorf("unable to drain the subscription for %s: %s", existing.subject, err)
+			continue
+		}
+		subs = append(subs, existing.sub)
+	}
+	c.mu.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	// Handlers run in goroutines of their own, so the subscriptions can finish
+	// draining before the handlers do.
+	for c.InFlight() > 0 || slices.ContainsFunc(subs, (*nats.Subscription).IsValid) {
+		if time.Now().After(deadline) {
+			return c.InFlight(), context.DeadlineExceeded
+		}
+		<-ticker.C
+	}
+
+	// Closing the connection flushes the responses that are still buffered.
+	if err := c.conn.Conn.Drain(); err != nil {
+		return 0, err
+	}
+	for !c.conn.Conn.IsClosed() {
+		if time.Now().After(deadline) {
+			return 0, context.DeadlineExceeded
+		}
+		<-ticker.C
+	}
+
+	return 0, nil
+}
@@ -4,10 +4,14 @@ import (
 	"context"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cyverse-de/go-mod/gotelnats"
 	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/api"
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 )
@@ -24,6 +28,11 @@ type ConnectionSettings struct {
 	TLSEnabled    bool
 	MaxReconnects int
 	ReconnectWait int
+
+	// MaxReconnectWait is the longest time, in seconds, to wait between
+	// attempts to reconnect. The wait starts at ReconnectWait and doubles after
+	// each failed attempt. It defaults to DefaultMaxReconnectWait.
+	MaxReconnectWait int
 }
 
 func fileExists(path string) bool {
@@ -56,9 +65,18 @@ func (s *ConnectionSettings) toConnectOptions() []nats.Option {
 	options = append(options, nats.MaxReconnects(s.MaxReconnects))
 	options = append(options, nats.ReconnectWait(time.Duration(s.ReconnectWait)*time.Second))
 
+	maxReconnectWait := s.MaxReconnectWait
+	if maxReconnectWait <= 0 {
+		maxReconnectWait = DefaultMaxReconnectWait
+	}
+	options = append(options, nats.CustomReconnectDelay(
+		reconnectDelay(time.Duration(s.ReconnectWait)*time.Second, time.Duration(maxReconnectWait)*time.Second),
+	))
+
 	// A handler funciton to log error messages when the NATS connection is dropped.
 	options = append(options, nats.DisconnectErrHandler(
 		func(nc *nats.Conn, err error) {
+			disconnectCounter.Add(context.Background(), 1)
 			if err != nil {
 				log.Errorf("disconnected from nats: %s", err.Error())
 			}
@@ -68,6 +86,7 @@ func (s *ConnectionSettings) toConnectOptions() []nats.Option {
 	// A handler function to log an informational message when the NATS connection is restored.
 	options = append(options, nats.ReconnectHandler(
 		func(nc *nats.Conn) {
+			reconnectCounter.Add(context.Background(), 1)
 			log.Infof("reconnected to %s", nc.ConnectedUrl())
 		},
 	))
@@ -101,42 +120,429 @@ func NewConnection(settings *ConnectionSettings) (*nats.EncodedConn, error) {
 	return encConn, nil
 }
 
+// DefaultSubjectPrefix is the prefix used by all of the QMS subjects defined in
+// the go-mod/subjects/qms package.
+const DefaultSubjectPrefix = "cyverse.qms"
+
+// SubjectSettings controls how the subjects that handlers are registered for
+// are mapped to the subjects and queue groups that are actually subscribed to.
+// This allows multiple instances of the service (for example, a canary
+// deployment) to share a NATS cluster without stealing each other's messages,
+// and allows individual endpoints to be drained or dark-launched.
+type SubjectSettings struct {
+	// Prefix replaces DefaultSubjectPrefix at the start of each subject.
+	Prefix string
+
+	// QueueSuffix is appended to the subject to form the default queue group.
+	QueueSuffix string
+
+	// QueueGroups maps base subjects to queue group names, overriding the
+	// default queue group for that subject.
+	QueueGroups map[string]string
+
+	// Disabled lists the base subjects that should not be subscribed to. An
+	// entry that ends with the NATS ">" wildcard, such as
+	// "cyverse.qms.admin.>", disables every subject that starts with it.
+	Disabled []string
+
+	// Versions lists the versions of the API to serve. Every supported version
+	// is served if the list is empty.
+	Versions []string
+}
+
+// versionEnabled returns true if the API version should be served.
+func (s *SubjectSettings) versionEnabled(version string) bool {
+	if len(s.Versions) == 0 {
+		return IsSupportedAPIVersion(version)
+	}
+	for _, v := range s.Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// EnabledVersions returns the versions of the API that are served, oldest
+// first.
+func (s *SubjectSettings) EnabledVersions() []string {
+	var result []string
+	for _, version := range SupportedAPIVersions {
+		if s.versionEnabled(version) {
+			result = append(result, version)
+		}
+	}
+	return result
+}
+
+// subjectFor returns the subject to subscribe to for the base subject.
+func (s *SubjectSettings) subjectFor(base string) string {
+	if s.Prefix == "" || s.Prefix == DefaultSubjectPrefix {
+		return base
+	}
+	if base == DefaultSubjectPrefix || strings.HasPrefix(base, DefaultSubjectPrefix+".") {
+		return s.Prefix + strings.TrimPrefix(base, DefaultSubjectPrefix)
+	}
+	return base
+}
+
+// baseFor returns the base subject for a subject that was subscribed to. This
+// reverses subjectFor.
+func (s *SubjectSettings) baseFor(subject string) string {
+	if s.Prefix == "" || s.Prefix == DefaultSubjectPrefix {
+		return subject
+	}
+	if subject == s.Prefix || strings.HasPrefix(subject, s.Prefix+".") {
+		return DefaultSubjectPrefix + strings.TrimPrefix(subject, s.Prefix)
+	}
+	return subject
+}
+
+// queueFor returns the name of the queue group to use for the base subject.
+// Queue groups configured for an unversioned subject are used for every version
+// of the subject.
+func (s *SubjectSettings) queueFor(base string) string {
+	unversioned, _ := SplitVersionedSubject(base)
+	for _, key := range []string{base, unversioned} {
+		if queue, ok := s.QueueGroups[key]; ok && queue != "" {
+			return queue
+		}
+	}
+	return strings.Join([]string{s.subjectFor(base), s.QueueSuffix}, ".")
+}
+
+// isDisabled returns true if handling of the base subject is turned off.
+// Disabling an unversioned subject disables every version of it.
+func (s *SubjectSettings) isDisabled(base string) bool {
+	unversioned, version := SplitVersionedSubject(base)
+	if !s.versionEnabled(version) {
+		return true
+	}
+	names := []string{base, unversioned, s.subjectFor(base), s.subjectFor(unversioned)}
+	for _, d := range s.Disabled {
+		prefix, wildcard := strings.CutSuffix(d, ">")
+		for _, name := range names {
+			if d == name || (wildcard && strings.HasSuffix(prefix, ".") && strings.HasPrefix(name, prefix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// subscription tracks an active subscription along with the subject and queue
+// group it was created for, so that configuration changes can be detected, and
+// the handler it was created with, so that it can be re-established.
+//
+//nolint:staticcheck
+type subscription struct {
+	sub     *nats.Subscription
+	subject string
+	queue   string
+	handler nats.Handler
+}
+
+// JSONHandler wraps a handler for messages that are encoded as plain JSON rather
+// than protocol buffer JSON. The request types defined in the api package use
+// this encoding.
+//
+//nolint:staticcheck
+type JSONHandler struct {
+	Handler nats.Handler
+}
+
 //nolint:staticcheck
 type Client struct {
+	mu            sync.Mutex
 	conn          *nats.EncodedConn
-	subscriptions []*nats.Subscription
-	queueSuffix   string
+	jsonConn      *nats.EncodedConn
+	settings      SubjectSettings
+	subscriptions map[string]*subscription
+	respond       RespondSettings
+
+	failuresMu sync.Mutex
+	failures   map[string]*RespondFailures
+
+	deadLetters DeadLetterSettings
+
+	// replies remembers the responses to requests with message IDs. It's nil
+	// if deduplication is turned off.
+	replies *replies
+
+	// pendingReplies maps the reply subjects of the requests with message IDs
+	// that are being handled to the replies that their responses are recorded
+	// in.
+	pendingReplies sync.Map
+
+	// inProgress maps the reply subjects of the requests being handled to the
+	// messages that they arrived in.
+	inProgress sync.Map
+
+	// inFlight is the number of messages being handled, including the ones
+	// that don't expect a reply.
+	inFlight atomic.Int64
+
+	// draining is set once the client has started to drain, after which lost
+	// subscriptions aren't re-established.
+	draining bool
+
+	// handlerSlots limits the number of messages that are handled at once
+	// across every subject. Each message holds a slot until it's been handled.
+	handlerSlots chan struct{}
+}
+
+// Connected returns true if the client is currently connected to NATS.
+func (c *Client) Connected() bool {
+	return c.conn.Conn.IsConnected()
 }
 
 //nolint:staticcheck
 func NewClient(conn *nats.EncodedConn, queueSuffix string) *Client {
-	return &Client{
+	// This can only fail if the connection is nil or the encoder isn't
+	// registered, and the JSON encoder is always registered.
+	jsonConn, err := nats.NewEncodedConn(conn.Conn, nats.JSON_ENCODER)
+	if err != nil {
+		log.Errorf("unable to create the JSON encoded connection: %s", err)
+	}
+
+	c := &Client{
 		conn:          conn,
-		queueSuffix:   queueSuffix,
-		subscriptions: make([]*nats.Subscription, 0),
+		jsonConn:      jsonConn,
+		settings:      SubjectSettings{Prefix: DefaultSubjectPrefix, QueueSuffix: queueSuffix},
+		subscriptions: make(map[string]*subscription),
+		failures:      make(map[string]*RespondFailures),
+		handlerSlots:  make(chan struct{}, DefaultHandlerLimit),
 	}
+
+	// Make sure that every handler is still subscribed once the connection has
+	// been restored.
+	reconnected := conn.Conn.Opts.ReconnectedCB
+	conn.Conn.SetReconnectHandler(func(nc *nats.Conn) {
+		if reconnected != nil {
+			reconnected(nc)
+		}
+		c.resubscribe()
+	})
+
+	return c
+}
+
+// SetSubjectSettings replaces the subject settings used for subscriptions made
+// after the call. Use Apply to update existing subscriptions as well.
+func (c *Client) SetSubjectSettings(settings SubjectSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings = settings
+}
+
+// BaseSubject returns the subject that a handler was registered for given the
+// subject that a message was received on, which may use a different prefix or
+// a version of the API.
+func (c *Client) BaseSubject(subject string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	base, _ := SplitVersionedSubject(c.settings.baseFor(subject))
+	return base
+}
+
+// SubjectVersion returns the version of the API that the subject that a
+// message was received on belongs to.
+func (c *Client) SubjectVersion(subject string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, version := SplitVersionedSubject(c.settings.baseFor(subject))
+	return version
 }
 
-func (c *Client) queueName(base string) string {
-	return strings.Join([]string{base, c.queueSuffix}, ".")
+// EnabledVersions returns the versions of the API that are served.
+func (c *Client) EnabledVersions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings.EnabledVersions()
 }
 
+// Subscribe adds a queue subscription for the base subject passed in, subject
+// to the current SubjectSettings. Disabled subjects are skipped.
+//
 //nolint:staticcheck
 func (c *Client) Subscribe(subject string, handler nats.Handler) error {
-	queue := c.queueName(subject)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscribe(subject, handler)
+}
+
+//nolint:staticcheck
+func (c *Client) subscribe(base string, handler nats.Handler) error {
+	if c.settings.isDisabled(base) {
+		log.Infof("handler for subject %s is disabled", base)
+		return nil
+	}
+
+	subject := c.settings.subjectFor(base)
+	queue := c.settings.queueFor(base)
 
-	s, err := c.conn.QueueSubscribe(subject, queue, handler)
+	original := handler
+	conn, enc := c.conn, c.conn.Enc
+	if h, ok := handler.(JSONHandler); ok {
+		conn, enc = c.jsonConn, c.jsonConn.Enc
+		handler = h.Handler
+	} else if _, version := SplitVersionedSubject(base); version != APIVersion1 {
+		enc = lenientCodec
+	}
+
+	msgHandler, err := c.msgHandler(enc, handler)
 	if err != nil {
 		return err
 	}
 
-	c.subscriptions = append(c.subscriptions, s)
+	s, err := conn.Conn.QueueSubscribe(subject, queue, msgHandler)
+	if err != nil {
+		return err
+	}
+
+	c.subscriptions[base] = &subscription{sub: s, subject: subject, queue: queue, handler: original}
 
 	log.Infof("added handler for subject %s on queue %s", subject, queue)
 
 	return nil
 }
 
+// Apply updates the subject settings and brings the active subscriptions in
+// line with them without interrupting service: new or changed subscriptions
+// are created before the subscriptions they replace are drained, so there's no
+// window in which a subject has no subscribers. Each handler is subscribed to
+// the subjects for every enabled version of the API.
+//
+//nolint:staticcheck
+func (c *Client) Apply(settings SubjectSettings, handlers map[string]nats.Handler) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The subscriptions are on their way out if the client is draining.
+	if c.draining {
+		return nil
+	}
+
+	c.settings = settings
+
+	for base, handler := range versionedHandlers(handlers) {
+		existing, found := c.subscriptions[base]
+
+		// Leave the subscription alone if nothing changed.
+		if found && !settings.isDisabled(base) &&
+			existing.subject == settings.subjectFor(base) &&
+			existing.queue == settings.queueFor(base) {
+			continue
+		}
+
+		// Subscribe using the new settings before removing the old subscription.
+		delete(c.subscriptions, base)
+		if err := c.subscribe(base, handler); err != nil {
+			if found {
+				c.subscriptions[base] = existing
+			}
+			return err
+		}
+
+		if found {
+			if err := existing.sub.Drain(); err != nil {
+				log.Errorf("unable to drain the subscription for %s: %s", existing.subject, err)
+			}
+			log.Infof("drained handler for subject %s on queue %s", existing.subject, existing.queue)
+		}
+	}
+
+	return nil
+}
+
+// Respond sends a response message to the reply subject. Responses that can't
+// be sent are retried according to the RespondSettings. Requests that are
+// rejected as invalid are forwarded as dead letters, and successful responses
+// to requests with message IDs are kept so that they can be replayed.
 func (c *Client) Respond(ctx context.Context, replySubject string, response gotelnats.DEResponse) error {
-	return gotelnats.PublishResponse(ctx, c.conn, replySubject, response)
+	c.deadLetterRejected(replySubject, response.GetError())
+	if version := c.requestVersion(replySubject); needsDowngrade(version) {
+		err := c.publish(ctx, replySubject, func() error {
+			return c.publishDowngraded(ctx, replySubject, response, version)
+		})
+		c.rememberResponse(replySubject, response.GetError() != nil, func() ([]byte, error) {
+			data, err := c.conn.Enc.Encode(replySubject, response)
+			if err != nil {
+				return nil, err
+			}
+			return downgradeJSON(data, response.ProtoReflect().Descriptor(), version)
+		})
+		return err
+	}
+	err := c.publish(ctx, replySubject, func() error {
+		return gotelnats.PublishResponse(ctx, c.conn, replySubject, response)
+	})
+	c.rememberResponse(replySubject, response.GetError() != nil, func() ([]byte, error) {
+		return c.conn.Enc.Encode(replySubject, response)
+	})
+	return err
+}
+
+// RespondJSON sends a response message defined in the api package to the
+// reply subject, adding tracing information to the response header.
+func (c *Client) RespondJSON(ctx context.Context, replySubject string, response api.DEResponse) error {
+	c.deadLetterRejected(replySubject, response.GetError())
+
+	_, span := gotelnats.InjectSpan(ctx, response.Carrier(), replySubject, gotelnats.Send)
+	defer span.End()
+
+	err := c.publish(ctx, replySubject, func() error {
+		return c.jsonConn.Publish(replySubject, response)
+	})
+	c.rememberResponse(replySubject, response.GetError() != nil, func() ([]byte, error) {
+		return c.jsonConn.Enc.Encode(replySubject, response)
+	})
+	return err
+}
+
+// RequestJSON sends a request message defined in the api package to another
+// service, adding tracing information to the request header, and decodes the
+// response, waiting until the context is done. An error included in the
+// response is returned as a *gotelnats.DEServiceError.
+func (c *Client) RequestJSON(ctx context.Context, subject string, request api.DERequest, response api.DEResponse) error {
+	ctx, span := gotelnats.InjectSpan(ctx, request.Carrier(), subject, gotelnats.Send)
+	defer span.End()
+
+	if err := c.jsonConn.RequestWithContext(ctx, subject, request, response); err != nil {
+		return err
+	}
+
+	if respErr := response.GetError(); respErr != nil && respErr.ErrorCode != svcerror.ErrorCode_UNSET {
+		return gotelnats.NewDEServiceError(respErr.ErrorCode, respErr.Message, respErr.StatusCode)
+	}
+
+	return nil
+}
+
+// requestVersion returns the version of the API used to send the request being
+// answered on the reply subject.
+func (c *Client) requestVersion(replySubject string) string {
+	msg, ok := c.inProgress.Load(replySubject)
+	if !ok {
+		return CurrentAPIVersion
+	}
+	return c.SubjectVersion(msg.(*nats.Msg).Subject)
+}
+
+// publishDowngraded sends a response to a request made using an earlier version
+// of the API, leaving out the fields that were added after that version.
+func (c *Client) publishDowngraded(ctx context.Context, replySubject string, response gotelnats.DEResponse, version string) error {
+	carrier := gotelnats.PBTextMapCarrier{Header: response.GetHeader()}
+	_, span := gotelnats.InjectSpan(ctx, &carrier, replySubject, gotelnats.Send)
+	defer span.End()
+
+	data, err := c.conn.Enc.Encode(replySubject, response)
+	if err != nil {
+		return err
+	}
+	if data, err = downgradeJSON(data, response.ProtoReflect().Descriptor(), version); err != nil {
+		return err
+	}
+
+	return c.conn.Conn.Publish(replySubject, data)
 }
@@ -0,0 +1,62 @@
+package natscl
+
+import "testing"
+
+func TestIsDisabled(t *testing.T) {
+	const (
+		admin = "cyverse.qms.admin.users.merge"
+		user  = "cyverse.qms.user.summary.get"
+	)
+
+	tests := []struct {
+		name     string
+		settings SubjectSettings
+		subject  string
+		expected bool
+	}{
+		{name: "not disabled", settings: SubjectSettings{Disabled: []string{user}}, subject: admin},
+		{name: "exact", settings: SubjectSettings{Disabled: []string{admin}}, subject: admin, expected: true},
+		{
+			name:     "exact, later version",
+			settings: SubjectSettings{Disabled: []string{admin}},
+			subject:  VersionedSubject(admin, APIVersion2),
+			expected: true,
+		},
+		{
+			name:     "wildcard",
+			settings: SubjectSettings{Disabled: []string{"cyverse.qms.admin.>"}},
+			subject:  admin,
+			expected: true,
+		},
+		{
+			name:     "wildcard, later version",
+			settings: SubjectSettings{Disabled: []string{"cyverse.qms.admin.>"}},
+			subject:  VersionedSubject(admin, APIVersion2),
+			expected: true,
+		},
+		{
+			name:     "wildcard, other subject",
+			settings: SubjectSettings{Disabled: []string{"cyverse.qms.admin.>"}},
+			subject:  user,
+		},
+		{
+			name:     "wildcard, prefixed",
+			settings: SubjectSettings{Prefix: "canary.qms", Disabled: []string{"canary.qms.admin.>"}},
+			subject:  VersionedSubject(admin, APIVersion2),
+			expected: true,
+		},
+		{
+			name:     "partial token",
+			settings: SubjectSettings{Disabled: []string{"cyverse.qms.adm>"}},
+			subject:  admin,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if disabled := tc.settings.isDisabled(tc.subject); disabled != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, disabled)
+			}
+		})
+	}
+}
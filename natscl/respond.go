@@ -0,0 +1,182 @@
+package natscl
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// RespondSettings controls what happens when a response can't be sent. A
+// failed response usually means that the request was processed but the caller
+// timed out waiting for the answer, so the caller may retry a change that has
+// already been applied.
+type RespondSettings struct {
+	// Retries is the number of times a failed response is sent again. Zero
+	// disables retries.
+	Retries int
+
+	// Backoff is the delay before the first retry. The delay doubles after each
+	// attempt.
+	Backoff time.Duration
+}
+
+// DefaultRespondBackoff is the delay before the first retry of a failed
+// response when no delay is configured.
+const DefaultRespondBackoff = 50 * time.Millisecond
+
+// RespondFailures summarizes the responses for a subject that couldn't be sent
+// on the first attempt.
+type RespondFailures struct {
+	// Subject is the base subject of the requests.
+	Subject string
+
+	// Failures is the number of responses that were never sent.
+	Failures int64
+
+	// Recovered is the number of responses that were sent by a retry.
+	Recovered int64
+
+	// LastError is the most recent error returned by NATS.
+	LastError string
+
+	// LastFailedAt is when the most recent error occurred.
+	LastFailedAt time.Time
+}
+
+// The counters for responses that couldn't be sent.
+var (
+	respondFailureCounter metric.Int64Counter
+	respondRetryCounter   metric.Int64Counter
+)
+
+func init() {
+	var err error
+	meter := otel.Meter("github.com/cyverse-de/subscriptions/natscl")
+
+	respondFailureCounter, err = meter.Int64Counter(
+		"qms.responses.failures",
+		metric.WithDescription("The number of NATS responses that couldn't be sent after the request was handled."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the response failure counter: %s", err)
+	}
+
+	respondRetryCounter, err = meter.Int64Counter(
+		"qms.responses.recovered",
+		metric.WithDescription("The number of NATS responses that were sent after being retried."),
+	)
+	if err != nil {
+		log.Errorf("unable to create the response retry counter: %s", err)
+	}
+}
+
+type requestSubjectKey struct{}
+
+// WithRequestSubject returns a context that records the base subject of the
+// request being handled, so that failures to respond to it can be attributed to
+// the subject rather than to the reply inbox.
+func WithRequestSubject(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, requestSubjectKey{}, subject)
+}
+
+// requestSubject returns the base subject recorded in the context, or unknown
+// if there isn't one.
+func requestSubject(ctx context.Context) string {
+	if subject, ok := ctx.Value(requestSubjectKey{}).(string); ok && subject != "" {
+		return subject
+	}
+	return "unknown"
+}
+
+// SetRespondSettings sets how failed responses are retried.
+func (c *Client) SetRespondSettings(settings RespondSettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.respond = settings
+}
+
+// RespondFailures returns the response failures recorded for each subject
+// since the service started, ordered by subject.
+func (c *Client) RespondFailures() []RespondFailures {
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+
+	result := make([]RespondFailures, 0, len(c.failures))
+	for _, f := range c.failures {
+		result = append(result, *f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Subject < result[j].Subject })
+	return result
+}
+
+// recordFailure updates the failure statistics for a subject.
+func (c *Client) recordFailure(subject string, err error, recovered bool) {
+	c.failuresMu.Lock()
+	defer c.failuresMu.Unlock()
+
+	f, ok := c.failures[subject]
+	if !ok {
+		f = &RespondFailures{Subject: subject}
+		c.failures[subject] = f
+	}
+	if recovered {
+		f.Recovered++
+	} else {
+		f.Failures++
+	}
+	f.LastError = err.Error()
+	f.LastFailedAt = time.Now()
+}
+
+// publish sends a response, retrying with exponential backoff if that's
+// enabled. Failures are logged, counted and recorded for the request subject.
+// The request context isn't used to cut the retries short because it has often
+// expired by the time a response fails, and the caller may still be waiting.
+func (c *Client) publish(ctx context.Context, replySubject string, send func() error) error {
+	c.mu.Lock()
+	settings := c.respond
+	c.mu.Unlock()
+
+	err := send()
+	if err == nil {
+		return nil
+	}
+
+	subject := requestSubject(ctx)
+	log := log.WithFields(logrus.Fields{"subject": subject, "reply": replySubject})
+	attrs := metric.WithAttributes(attribute.String("subject", subject))
+
+	backoff := settings.Backoff
+	if backoff <= 0 {
+		backoff = DefaultRespondBackoff
+	}
+	for attempt := 1; attempt <= settings.Retries; attempt++ {
+		log.Warnf("unable to send the response, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		if retryErr := send(); retryErr != nil {
+			err = retryErr
+			continue
+		}
+
+		c.recordFailure(subject, err, true)
+		if respondRetryCounter != nil {
+			respondRetryCounter.Add(context.Background(), 1, attrs)
+		}
+		log.Infof("the response was sent after %d retries", attempt)
+		return nil
+	}
+
+	c.recordFailure(subject, err, false)
+	if respondFailureCounter != nil {
+		respondFailureCounter.Add(context.Background(), 1, attrs)
+	}
+	log.Errorf("the request was handled, but the response couldn't be sent: %s", err)
+	return err
+}
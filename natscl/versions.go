@@ -0,0 +1,199 @@
+package natscl
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cyverse-de/go-mod/protobufjson"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// The versions of the NATS API. Version 1 is served on the original subjects,
+// such as cyverse.qms.user.summary.get, and every later version is served on
+// subjects that have the version inserted after the prefix, such as
+// cyverse.qms.v2.user.summary.get.
+const (
+	APIVersion1 = "v1"
+	APIVersion2 = "v2"
+
+	// CurrentAPIVersion is the latest version of the NATS API.
+	CurrentAPIVersion = APIVersion2
+)
+
+// SupportedAPIVersions lists every version of the NATS API that the service can
+// serve, oldest first.
+var SupportedAPIVersions = []string{APIVersion1, APIVersion2}
+
+// versionNumber returns the number of an API version, or zero if the version
+// isn't valid.
+func versionNumber(version string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(version, "v"))
+	if err != nil || !strings.HasPrefix(version, "v") || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// IsSupportedAPIVersion returns true if the service can serve the API version.
+func IsSupportedAPIVersion(version string) bool {
+	for _, v := range SupportedAPIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// VersionedSubject returns the subject for a version of the API given the
+// original, unversioned subject. Subjects that don't use DefaultSubjectPrefix
+// aren't versioned.
+func VersionedSubject(base, version string) string {
+	if version == APIVersion1 || !strings.HasPrefix(base, DefaultSubjectPrefix+".") {
+		return base
+	}
+	return DefaultSubjectPrefix + "." + version + strings.TrimPrefix(base, DefaultSubjectPrefix)
+}
+
+// SplitVersionedSubject returns the original, unversioned subject and the API
+// version for a subject returned by VersionedSubject. This reverses
+// VersionedSubject.
+func SplitVersionedSubject(subject string) (string, string) {
+	rest, found := strings.CutPrefix(subject, DefaultSubjectPrefix+".")
+	if !found {
+		return subject, APIVersion1
+	}
+
+	version, rest, found := strings.Cut(rest, ".")
+	if !found || version == APIVersion1 || versionNumber(version) == 0 {
+		return subject, APIVersion1
+	}
+
+	return DefaultSubjectPrefix + "." + rest, version
+}
+
+// versionedHandlers returns the handlers keyed by the subjects for every
+// supported version of the API. Subjects for versions that aren't enabled are
+// treated as disabled, so that changing the enabled versions drains them.
+//
+//nolint:staticcheck
+func versionedHandlers(handlers map[string]nats.Handler) map[string]nats.Handler {
+	result := make(map[string]nats.Handler, len(handlers)*len(SupportedAPIVersions))
+	for base, handler := range handlers {
+		for _, version := range SupportedAPIVersions {
+			result[VersionedSubject(base, version)] = handler
+		}
+	}
+	return result
+}
+
+// lenientCodec decodes the protocol buffer messages received on versioned
+// subjects. Fields that the service doesn't know about are ignored rather than
+// rejected, so that clients built against newer message definitions can still
+// talk to the service.
+var lenientCodec = protobufjson.NewCodec(protobufjson.WithEmitUnpopulated(), protobufjson.WithDiscardUnknown())
+
+// addedFields maps the fields of protocol buffer messages to the API versions
+// that they were added in, and latestAddition is the latest of those versions.
+var (
+	addedFieldsMu  sync.RWMutex
+	addedFields    = make(map[protoreflect.FullName]map[protoreflect.Name]int)
+	latestAddition int
+)
+
+// RegisterAddedField records that a field was added to a protocol buffer
+// message in a version of the API. The field is removed from responses to
+// requests made using earlier versions, so clients that reject unknown fields
+// continue to work after the message definitions change. For example,
+// registering the new_field field of qms.SubscriptionOptions for v3 hides it
+// from v1 and v2 clients.
+func RegisterAddedField(version string, message protoreflect.FullName, field protoreflect.Name) {
+	addedFieldsMu.Lock()
+	defer addedFieldsMu.Unlock()
+
+	n := versionNumber(version)
+	if addedFields[message] == nil {
+		addedFields[message] = make(map[protoreflect.Name]int)
+	}
+	addedFields[message][field] = n
+	latestAddition = max(latestAddition, n)
+}
+
+// needsDowngrade returns true if responses for the API version have to have
+// fields removed from them.
+func needsDowngrade(version string) bool {
+	addedFieldsMu.RLock()
+	defer addedFieldsMu.RUnlock()
+	return versionNumber(version) < latestAddition
+}
+
+// downgradeJSON removes the fields that were added after the API version from
+// an encoded protocol buffer message. The codec emits unpopulated fields, so
+// the fields have to be removed from the encoded message rather than cleared.
+func downgradeJSON(data []byte, md protoreflect.MessageDescriptor, version string) ([]byte, error) {
+	var obj map[string]any
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+
+	addedFieldsMu.RLock()
+	removeAddedFields(obj, md, versionNumber(version))
+	addedFieldsMu.RUnlock()
+
+	return json.Marshal(obj)
+}
+
+// removeAddedFields removes the fields that were added after the API version
+// from a decoded message and from every message nested within it.
+func removeAddedFields(obj map[string]any, md protoreflect.MessageDescriptor, version int) {
+	added := addedFields[md.FullName()]
+
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		key := fd.JSONName()
+		value, ok := obj[key]
+		if !ok {
+			key = string(fd.Name())
+			if value, ok = obj[key]; !ok {
+				continue
+			}
+		}
+
+		if since, ok := added[fd.Name()]; ok && since > version {
+			delete(obj, key)
+			continue
+		}
+
+		switch {
+		case fd.IsMap():
+			if vd := fd.MapValue().Message(); vd != nil {
+				entries, _ := value.(map[string]any)
+				for _, entry := range entries {
+					if nested, ok := entry.(map[string]any); ok {
+						removeAddedFields(nested, vd, version)
+					}
+				}
+			}
+		case fd.Message() == nil:
+		case fd.IsList():
+			elements, _ := value.([]any)
+			for _, element := range elements {
+				if nested, ok := element.(map[string]any); ok {
+					removeAddedFields(nested, fd.Message(), version)
+				}
+			}
+		default:
+			if nested, ok := value.(map[string]any); ok {
+				removeAddedFields(nested, fd.Message(), version)
+			}
+		}
+	}
+}
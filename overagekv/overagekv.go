@@ -0,0 +1,121 @@
+// Package overagekv maintains a projection of each user's overage status in a
+// NATS JetStream key-value bucket. Consumers that check for overages
+// frequently, such as the app launcher, can watch the bucket and keep a local
+// copy instead of sending a request for every check. The service updates a
+// user's entry after every change that can affect it and rebuilds the whole
+// projection at regular intervals, which picks up changes that happen with the
+// passage of time, such as subscriptions ending.
+package overagekv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "overagekv"})
+
+// Settings controls how the projection is stored.
+type Settings struct {
+	// Bucket is the name of the key-value bucket.
+	Bucket string
+
+	// Interval is the amount of time to wait between rebuilds of the whole
+	// projection.
+	Interval time.Duration
+}
+
+// DefaultSettings returns the default projection settings.
+func DefaultSettings() Settings {
+	return Settings{
+		Bucket:   "QMS_OVERAGES",
+		Interval: 15 * time.Minute,
+	}
+}
+
+// Store writes overage statuses to the key-value bucket.
+type Store struct {
+	kv       nats.KeyValue
+	settings Settings
+}
+
+// NewStore returns a new *Store, creating the key-value bucket if it doesn't
+// exist already.
+func NewStore(js nats.JetStreamContext, settings Settings) (*Store, error) {
+	kv, err := js.KeyValue(settings.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      settings.Bucket,
+			Description: "The overage status of each QMS user.",
+			History:     1,
+			Storage:     nats.FileStorage,
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to configure the %s key-value bucket", settings.Bucket)
+	}
+
+	return &Store{kv: kv, settings: settings}, nil
+}
+
+// Settings returns the settings that the store was created with.
+func (s *Store) Settings() Settings {
+	return s.settings
+}
+
+// isKeyChar returns true if a character can appear in a key without being
+// escaped. Equals signs are allowed in keys, but they're used for escaping.
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		c == '-' || c == '_'
+}
+
+// Key returns the key of a user's entry in the bucket. Characters that aren't
+// letters, digits, hyphens or underscores are replaced with an equals sign
+// followed by their hex-encoded value, so "first.last" becomes "first=2elast".
+func Key(username string) string {
+	var b strings.Builder
+	for i := 0; i < len(username); i++ {
+		c := username[i]
+		if isKeyChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "=%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// Put stores a user's overage status.
+func (s *Store) Put(status *api.OverageStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrapf(err, "unable to encode the overage status for %s", status.Username)
+	}
+
+	if _, err = s.kv.Put(Key(status.Username), data); err != nil {
+		return errors.Wrapf(err, "unable to store the overage status for %s", status.Username)
+	}
+
+	log.Debugf("stored the overage status for %s", status.Username)
+	return nil
+}
+
+// Delete removes a user's entry, which is used when the user no longer exists.
+func (s *Store) Delete(username string) error {
+	if err := s.kv.Delete(Key(username)); err != nil {
+		return errors.Wrapf(err, "unable to remove the overage status for %s", username)
+	}
+
+	log.Debugf("removed the overage status for %s", username)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/knadh/koanf"
+)
+
+// seedResourceType is a resource type in the seed section of the
+// configuration.
+type seedResourceType struct {
+	Name       string `koanf:"name"`
+	Unit       string `koanf:"unit"`
+	Consumable bool   `koanf:"consumable"`
+}
+
+// seedQuota is a plan quota default in the seed section of the configuration.
+type seedQuota struct {
+	Resource string  `koanf:"resource"`
+	Value    float64 `koanf:"value"`
+}
+
+// seedPlan is a plan in the seed section of the configuration.
+type seedPlan struct {
+	Name        string      `koanf:"name"`
+	Description string      `koanf:"description"`
+	Rate        float64     `koanf:"rate"`
+	Quotas      []seedQuota `koanf:"quotas"`
+}
+
+// seedConfig is the seed section of the configuration.
+type seedConfig struct {
+	Operations []string           `koanf:"operations"`
+	Resources  []seedResourceType `koanf:"resources"`
+	Plans      []seedPlan         `koanf:"plans"`
+}
+
+// seedSettings returns the reference data that the database is seeded with
+// from the configuration. The update operations that the service relies on are
+// always seeded, even if the configuration doesn't list them.
+func seedSettings(config *koanf.Koanf) (*db.SeedSettings, error) {
+	var section seedConfig
+	if err := config.Unmarshal("seed", &section); err != nil {
+		return nil, fmt.Errorf("invalid seed configuration: %w", err)
+	}
+
+	settings := &db.SeedSettings{UpdateOperations: slices.Clone(db.UpdateOperationNames)}
+	for _, name := range section.Operations {
+		if !slices.Contains(settings.UpdateOperations, name) {
+			settings.UpdateOperations = append(settings.UpdateOperations, name)
+		}
+	}
+
+	for _, resource := range section.Resources {
+		if resource.Name == "" || resource.Unit == "" {
+			return nil, fmt.Errorf("seeded resource types must have a name and a unit")
+		}
+		settings.ResourceTypes = append(settings.ResourceTypes, db.ResourceType{
+			Name:       resource.Name,
+			Unit:       resource.Unit,
+			Consumable: resource.Consumable,
+		})
+	}
+
+	for _, plan := range section.Plans {
+		if plan.Name == "" {
+			return nil, fmt.Errorf("seeded plans must have a name")
+		}
+		quotaDefaults := make(map[string]float64, len(plan.Quotas))
+		for _, quota := range plan.Quotas {
+			quotaDefaults[quota.Resource] = quota.Value
+		}
+		settings.Plans = append(settings.Plans, db.SeedPlan{
+			Name:          plan.Name,
+			Description:   plan.Description,
+			Rate:          plan.Rate,
+			QuotaDefaults: quotaDefaults,
+		})
+	}
+
+	return settings, nil
+}
+
+// seedDatabase seeds the database with the reference data in the configuration
+// and makes sure that the default plan exists afterwards, since new users
+// can't be subscribed to it otherwise.
+func seedDatabase(ctx context.Context, d *db.Database, config *koanf.Koanf, defaultPlan string) error {
+	settings, err := seedSettings(config)
+	if err != nil {
+		return err
+	}
+
+	result, err := d.Seed(ctx, settings)
+	if err != nil {
+		return fmt.Errorf("unable to seed the database: %w", err)
+	}
+	log.Infof(
+		"seeding added %d update operations, %d resource types, %d plans and %d plan quota defaults",
+		result.UpdateOperations, result.ResourceTypes, result.Plans, result.QuotaDefaults,
+	)
+
+	plan, err := d.GetPlanByName(ctx, defaultPlan)
+	if err != nil {
+		return err
+	}
+	if plan == nil {
+		return fmt.Errorf("the default plan %s doesn't exist", defaultPlan)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+// Package service defines the protocol buffer API of the service independently
+// of the transports that serve it. The NATS handlers and the gRPC server are
+// thin adapters around an implementation of QMS, so the operations themselves
+// can be exercised without a NATS connection or a gRPC server, and the
+// transports can be exercised with a fake implementation.
+package service
+
+import (
+	"context"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/requests"
+	"github.com/cyverse-de/p/go/svcerror"
+)
+
+// QMS is implemented by the service layer. Options that aren't part of the
+// request messages, such as the expected version or the dry run flag, are read
+// from the request headers, and every response is redacted for the role of the
+// caller. A response is always returned, even when the operation fails, in
+// which case its Error field is set and the same error is returned as an
+// *Error, so transports that send errors in the response body can send the
+// response as is.
+type QMS interface {
+	GetUserUpdates(context.Context, *qms.UpdateListRequest) (*qms.UpdateListResponse, error)
+	AddUserUpdate(context.Context, *qms.AddUpdateRequest) (*qms.AddUpdateResponse, error)
+	GetUsages(context.Context, *qms.GetUsages) (*qms.UsageList, error)
+	AddUsage(context.Context, *qms.AddUsage) (*qms.UsageResponse, error)
+	GetUserOverages(context.Context, *qms.AllUserOveragesRequest) (*qms.OverageList, error)
+	CheckUserOverages(context.Context, *qms.IsOverageRequest) (*qms.IsOverage, error)
+	GetUserSummary(context.Context, *qms.RequestByUsername) (*qms.SubscriptionResponse, error)
+	AddUser(context.Context, *qms.AddUserRequest) (*qms.AddUserResponse, error)
+	AddQuota(context.Context, *qms.AddQuotaRequest) (*qms.QuotaResponse, error)
+	ListPlans(context.Context, *qms.NoParamsRequest) (*qms.PlanList, error)
+	AddPlan(context.Context, *qms.AddPlanRequest) (*qms.PlanResponse, error)
+	GetPlan(context.Context, *qms.PlanRequest) (*qms.PlanResponse, error)
+	UpsertQuotaDefaults(context.Context, *qms.AddPlanQuotaDefaultRequest) (*qms.QuotaDefaultResponse, error)
+	AddAddon(context.Context, *qms.AddAddonRequest) (*qms.AddonResponse, error)
+	ListAddons(context.Context, *qms.NoParamsRequest) (*qms.AddonListResponse, error)
+	UpdateAddon(context.Context, *qms.UpdateAddonRequest) (*qms.AddonResponse, error)
+	DeleteAddon(context.Context, *requests.ByUUID) (*qms.AddonResponse, error)
+	ListSubscriptionAddons(context.Context, *requests.ByUUID) (*qms.SubscriptionAddonListResponse, error)
+	AddSubscriptionAddon(context.Context, *requests.AssociateByUUIDs) (*qms.SubscriptionAddonResponse, error)
+	DeleteSubscriptionAddon(context.Context, *requests.ByUUID) (*qms.SubscriptionAddonResponse, error)
+	UpdateSubscriptionAddon(context.Context, *qms.UpdateSubscriptionAddonRequest) (*qms.SubscriptionAddonResponse, error)
+	GetSubscriptionAddon(context.Context, *requests.ByUUID) (*qms.SubscriptionAddonResponse, error)
+}
+
+// Error is the error returned by the service layer when an operation fails. It
+// carries the same service error that's set in the response.
+type Error struct {
+	*svcerror.ServiceError
+}
+
+func (e *Error) Error() string {
+	return e.GetMessage()
+}
+
+// ResponseError returns the error to return alongside a response with the
+// service error set, or nil if the service error isn't set.
+func ResponseError(serviceErr *svcerror.ServiceError) error {
+	if serviceErr == nil {
+		return nil
+	}
+	return &Error{ServiceError: serviceErr}
+}
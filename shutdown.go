@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/natscl"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/grpc"
+)
+
+// DefaultShutdownTimeout is how long the service waits for the work in progress
+// to finish when it's asked to stop, unless the configuration says otherwise.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownPlan lists what has to be stopped when the service is asked to stop,
+// in the order that it's stopped in.
+type shutdownPlan struct {
+	timeout     time.Duration
+	natsClient  *natscl.Client
+	servers     []*http.Server
+	grpcServers []*grpc.Server
+	stopWorkers context.CancelFunc
+	databases   []*sqlx.DB
+}
+
+// run stops the HTTP and gRPC servers once the requests in progress have been
+// handled and stops the background workers, then drains the NATS connection,
+// and finally closes the database connection pools, which waits for the
+// queries in progress to finish. The NATS connection is drained after the
+// servers and workers so that the messages they publish while finishing up are
+// still sent, and the databases are closed last because the NATS handlers use
+// them. The whole shutdown is bounded by the timeout, after which whatever is
+// left is abandoned. Nothing is committed halfway, since every change is made
+// in a transaction that's rolled back if the service exits first.
+func (p *shutdownPlan) run(sig os.Signal) {
+	started := time.Now()
+	deadline := started.Add(p.timeout)
+	log.Infof("received %s, shutting down within %s", sig, p.timeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	stoppedServers := 0
+	for _, server := range p.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Errorf("unable to stop the HTTP server on %s: %s", server.Addr, err)
+			continue
+		}
+		stoppedServers++
+	}
+
+	for _, server := range p.grpcServers {
+		stopGRPCServer(ctx, server)
+	}
+
+	p.stopWorkers()
+
+	inFlight := p.natsClient.InFlight()
+	unfinished, err := p.natsClient.Drain(time.Until(deadline))
+	if err != nil {
+		log.Errorf("unable to drain the NATS connection: %s", err)
+	}
+
+	closedDatabases := 0
+	for _, database := range p.databases {
+		if err = database.Close(); err != nil {
+			log.Errorf("unable to close a database connection pool: %s", err)
+			continue
+		}
+		closedDatabases++
+	}
+
+	log.Infof(
+		"shutdown took %s: %d NATS messages were being handled and %d were left unfinished, %d of %d HTTP "+
+			"servers stopped cleanly and %d of %d database connection pools were closed",
+		time.Since(started).Round(time.Millisecond), inFlight, unfinished,
+		stoppedServers, len(p.servers), closedDatabases, len(p.databases),
+	)
+}
+
+// stopGRPCServer stops a gRPC server once the RPCs in progress have been
+// handled, or at once if they haven't been handled by the time the context is
+// done.
+func stopGRPCServer(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Error("the gRPC server didn't stop in time, abandoning the RPCs in progress")
+		server.Stop()
+	}
+}
@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IRODSSettings configures storage in iRODS through the iRODS HTTP API.
+type IRODSSettings struct {
+	// URL is the base URL of the iRODS HTTP API, such as
+	// https://irods.example.org/irods-http-api/0.3.0.
+	URL string
+
+	// Collection is the absolute path of the collection that contains the
+	// stored objects.
+	Collection string
+
+	Username string
+	Password string
+
+	// ChunkSize is the maximum number of bytes sent in a single write request.
+	// It defaults to 8 MiB.
+	ChunkSize int
+}
+
+// IRODSStore stores objects as data objects in an iRODS collection.
+type IRODSStore struct {
+	settings IRODSSettings
+	client   *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// The status codes that the iRODS HTTP API reports when a data object or
+// collection doesn't exist and when a collection already exists.
+const (
+	irodsNoRowsFound    = -808000
+	irodsAlreadyHasItem = -809000
+)
+
+// errIRODSAlreadyExists is returned when a collection already exists.
+var errIRODSAlreadyExists = errors.New("the collection already exists")
+
+// NewIRODSStore returns a store for the configured collection.
+func NewIRODSStore(settings IRODSSettings) (*IRODSStore, error) {
+	if settings.URL == "" || settings.Collection == "" {
+		return nil, fmt.Errorf("the iRODS HTTP API URL and collection are required")
+	}
+	if settings.Username == "" {
+		return nil, fmt.Errorf("the iRODS username is required")
+	}
+	if settings.ChunkSize <= 0 {
+		settings.ChunkSize = 8 * 1024 * 1024
+	}
+	settings.URL = strings.TrimSuffix(settings.URL, "/")
+
+	return &IRODSStore{settings: settings, client: &http.Client{}}, nil
+}
+
+// irodsResponse is the status information included in every response from the
+// iRODS HTTP API.
+type irodsResponse struct {
+	IRODSResponse struct {
+		StatusCode    int    `json:"status_code"`
+		StatusMessage string `json:"status_message"`
+	} `json:"irods_response"`
+}
+
+// authenticate returns a bearer token for the configured user, logging in if
+// necessary.
+func (s *IRODSStore) authenticate(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.URL+"/authenticate", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(s.settings.Username, s.settings.Password)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("iRODS authentication failed with status %d: %s", resp.StatusCode, body)
+	}
+
+	s.token = strings.TrimSpace(string(body))
+	return s.token, nil
+}
+
+// resetToken discards the bearer token so that the next request logs in again.
+func (s *IRODSStore) resetToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// send sends an authenticated request, logging in again once if the token has
+// expired. The request is built by newRequest so that it can be rebuilt for the
+// retry.
+func (s *IRODSStore) send(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := s.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			s.resetToken()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// checkIRODSResponse returns ErrNotFound if the response indicates that the
+// data object or collection doesn't exist, or an error if the request failed
+// for any other reason.
+func checkIRODSResponse(op, lpath string, resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var status irodsResponse
+	_ = json.Unmarshal(body, &status)
+	code := status.IRODSResponse.StatusCode
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || code == irodsNoRowsFound:
+		return ErrNotFound
+	case code == irodsAlreadyHasItem:
+		return errIRODSAlreadyExists
+	case resp.StatusCode != http.StatusOK || code < 0:
+		return fmt.Errorf("iRODS %s of %s failed with status %d: %s", op, lpath, resp.StatusCode, body)
+	default:
+		return nil
+	}
+}
+
+// post sends a form to one of the iRODS HTTP API endpoints.
+func (s *IRODSStore) post(ctx context.Context, endpoint string, form url.Values) error {
+	resp, err := s.send(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(
+			ctx, http.MethodPost, s.settings.URL+endpoint, strings.NewReader(form.Encode()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkIRODSResponse(form.Get("op"), form.Get("lpath"), resp)
+}
+
+// logicalPath returns the absolute iRODS path of the data object with the key.
+func (s *IRODSStore) logicalPath(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.settings.Collection, key), nil
+}
+
+// writeChunk writes a chunk of a data object at the given offset. The data
+// object is truncated by the first write.
+func (s *IRODSStore) writeChunk(ctx context.Context, lpath string, offset int64, chunk []byte) error {
+	resp, err := s.send(ctx, func() (*http.Request, error) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+
+		fields := map[string]string{
+			"op":       "write",
+			"lpath":    lpath,
+			"offset":   strconv.FormatInt(offset, 10),
+			"truncate": "0",
+		}
+		if offset == 0 {
+			fields["truncate"] = "1"
+		}
+		for name, value := range fields {
+			if err := w.WriteField(name, value); err != nil {
+				return nil, err
+			}
+		}
+		part, err := w.CreateFormFile("bytes", path.Base(lpath))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(chunk); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.settings.URL+"/data-objects", &body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkIRODSResponse("write", lpath, resp)
+}
+
+// Put creates the collection that will contain the data object if necessary,
+// then writes the object in chunks.
+func (s *IRODSStore) Put(ctx context.Context, key string, r io.Reader) error {
+	lpath, err := s.logicalPath(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.post(ctx, "/collections", url.Values{
+		"op":                   {"create"},
+		"lpath":                {path.Dir(lpath)},
+		"create-intermediates": {"1"},
+	})
+	if err != nil && err != errIRODSAlreadyExists {
+		return err
+	}
+
+	chunk := make([]byte, s.settings.ChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 || offset == 0 {
+			if werr := s.writeChunk(ctx, lpath, offset, chunk[:n]); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *IRODSStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	lpath, err := s.logicalPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"op": {"read"}, "lpath": {lpath}}
+	resp, err := s.send(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(
+			ctx, http.MethodGet, s.settings.URL+"/data-objects?"+query.Encode(), nil,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Successful reads return the contents of the data object rather than a
+	// status document.
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+
+	if err = checkIRODSResponse("read", lpath, resp); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("iRODS read of %s failed with status %d", lpath, resp.StatusCode)
+}
+
+func (s *IRODSStore) Delete(ctx context.Context, key string) error {
+	lpath, err := s.logicalPath(key)
+	if err != nil {
+		return err
+	}
+
+	err = s.post(ctx, "/data-objects", url.Values{
+		"op":           {"remove"},
+		"lpath":        {lpath},
+		"catalog-only": {"0"},
+		"no-trash":     {"1"},
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
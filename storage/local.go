@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalSettings configures storage on the local file system.
+type LocalSettings struct {
+	// Path is the directory that contains the stored objects.
+	Path string
+}
+
+// LocalStore stores objects as files in a directory.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore returns a store for the configured directory, which is created
+// if it doesn't exist.
+func NewLocalStore(settings LocalSettings) (*LocalStore, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("the local storage path is required")
+	}
+	if err := os.MkdirAll(settings.Path, 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: settings.Path}, nil
+}
+
+// filename returns the path to the file that holds the object with the key.
+func (s *LocalStore) filename(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object to a temporary file and then moves it into place, so
+// that readers never see a partially written object.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0o750); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint:errcheck
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close() // nolint:errcheck
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
+func (s *LocalStore) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (s *LocalStore) Delete(_ context.Context, key string) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Settings configures storage in an S3-compatible object store. Requests
+// use path-style addressing, which every S3-compatible store supports.
+type S3Settings struct {
+	// Endpoint is the base URL of the object store, such as
+	// https://s3.us-west-2.amazonaws.com.
+	Endpoint string
+
+	// Region is the region used to sign requests.
+	Region string
+
+	// Bucket is the name of the bucket that contains the stored objects.
+	Bucket string
+
+	// Prefix is prepended to every key. It's optional.
+	Prefix string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// S3Store stores objects in an S3 bucket.
+type S3Store struct {
+	settings S3Settings
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// unsignedPayload is used in place of the payload hash so that uploads don't
+// have to be read twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// NewS3Store returns a store for the configured bucket.
+func NewS3Store(settings S3Settings) (*S3Store, error) {
+	if settings.Endpoint == "" || settings.Bucket == "" {
+		return nil, fmt.Errorf("the S3 endpoint and bucket are required")
+	}
+	if settings.AccessKey == "" || settings.SecretKey == "" {
+		return nil, fmt.Errorf("the S3 access key and secret key are required")
+	}
+	if settings.Region == "" {
+		settings.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(settings.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3Store{
+		settings: settings,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+// objectURL returns the URL of the object with the key.
+func (s *S3Store) objectURL(key string) (*url.URL, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := strings.Trim(s.settings.Prefix, "/"); prefix != "" {
+		key = prefix + "/" + key
+	}
+
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.settings.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path)
+	return &u, nil
+}
+
+// s3Escape percent-encodes everything in a path except for the characters that
+// S3 leaves unencoded when it calculates signatures.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 authorization header to the request.
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	if s.settings.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.settings.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{date, s.settings.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.settings.SecretKey), date)
+	key = hmacSHA256(key, s.settings.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.settings.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// do signs and sends a request for the object with the key.
+func (s *S3Store) do(ctx context.Context, method, key string, body io.Reader, length int64) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = length
+	s.sign(req, time.Now())
+
+	return s.client.Do(req)
+}
+
+// s3Error returns an error describing an unsuccessful response.
+func s3Error(method, key string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s of %s failed with status %d: %s", method, key, resp.StatusCode, msg)
+}
+
+// Put spools the object to a temporary file first because S3 requires the
+// length of an upload to be known in advance.
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	tmp, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // nolint:errcheck
+	defer tmp.Close()           // nolint:errcheck
+
+	length, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, key, tmp, length)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(http.MethodPut, key, resp)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, s3Error(http.MethodGet, key, resp)
+	}
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return s3Error(http.MethodDelete, key, resp)
+	}
+}
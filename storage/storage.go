@@ -0,0 +1,73 @@
+// Package storage stores the objects produced by the service, such as exports
+// and archives, in whichever object storage is available to a deployment. The
+// local file system, S3-compatible object storage and iRODS are supported.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// The supported storage backends.
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+	BackendIRODS = "irods"
+)
+
+// ErrNotFound is returned when an object doesn't exist.
+var ErrNotFound = errors.New("object not found")
+
+// Store stores objects by key. Keys are slash-separated paths relative to the
+// root of the store, such as exports/2024-07-01/usages.csv.
+type Store interface {
+	// Put stores the contents of the reader under the key, replacing any
+	// object that's already stored under it.
+	Put(ctx context.Context, key string, r io.Reader) error
+
+	// Get returns the contents of the object stored under the key. The caller
+	// must close the reader. Returns ErrNotFound if there's no such object.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the object stored under the key. Deleting an object that
+	// doesn't exist isn't an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Settings selects and configures the storage backend.
+type Settings struct {
+	// Backend is the name of the storage backend to use.
+	Backend string
+
+	Local LocalSettings
+	S3    S3Settings
+	IRODS IRODSSettings
+}
+
+// New returns a store for the configured backend.
+func New(settings Settings) (Store, error) {
+	switch settings.Backend {
+	case BackendLocal:
+		return NewLocalStore(settings.Local)
+	case BackendS3:
+		return NewS3Store(settings.S3)
+	case BackendIRODS:
+		return NewIRODSStore(settings.IRODS)
+	default:
+		return nil, fmt.Errorf("unsupported storage backend: %q", settings.Backend)
+	}
+}
+
+// cleanKey returns the canonical form of a key, or an error if the key is
+// empty or refers to something outside of the store.
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)
+	if cleaned == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return strings.TrimPrefix(cleaned, "/"), nil
+}
@@ -0,0 +1,87 @@
+package subcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+)
+
+type memoryEntry struct {
+	subscription *db.Subscription
+	expiresAt    time.Time
+}
+
+// MemoryCache keeps subscriptions in process. Each instance of the service has
+// its own cache, so changes made by other instances are only picked up once
+// the entries expire unless invalidations are relayed with RelayedCache.
+type MemoryCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemoryCache returns an in-process cache that keeps entries for the TTL and
+// holds at most maxEntries entries.
+func NewMemoryCache(ttl time.Duration, maxEntries int) *MemoryCache {
+	return &MemoryCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]memoryEntry),
+	}
+}
+
+func (c *MemoryCache) Get(_ context.Context, username string) (*db.Subscription, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[username]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, username)
+		return nil, false
+	}
+
+	// Return a copy so that callers can't modify the cached subscription.
+	subscription := *entry.subscription
+	return &subscription, true
+}
+
+// Set removes the expired entries when the cache is full, and then an
+// arbitrary entry if that didn't free up any space.
+func (c *MemoryCache) Set(_ context.Context, username string, subscription *db.Subscription) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[username]; !ok && len(c.entries) >= c.maxEntries {
+		for key, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, key)
+			}
+		}
+		for key := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, key)
+		}
+	}
+
+	cached := *subscription
+	c.entries[username] = memoryEntry{subscription: &cached, expiresAt: now.Add(c.ttl)}
+}
+
+func (c *MemoryCache) Invalidate(_ context.Context, usernames ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, username := range usernames {
+		delete(c.entries, username)
+	}
+}
@@ -0,0 +1,257 @@
+package subcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+)
+
+// RedisSettings configures a cache that's shared between instances of the
+// service through Redis.
+type RedisSettings struct {
+	// Address is the host and port of the Redis server.
+	Address string
+
+	Password string
+
+	// DB is the number of the Redis database to use.
+	DB int
+
+	// Prefix is prepended to every key. It defaults to qms:subscriptions:.
+	Prefix string
+
+	// Timeout limits how long each command can take. It defaults to 100
+	// milliseconds, since a slow cache is worse than no cache.
+	Timeout time.Duration
+}
+
+// The default Redis settings.
+const (
+	DefaultRedisPrefix  = "qms:subscriptions:"
+	DefaultRedisTimeout = 100 * time.Millisecond
+)
+
+// maxIdleRedisConns is the number of idle connections kept for reuse.
+const maxIdleRedisConns = 8
+
+// errRedisNil is returned when a key doesn't exist.
+var errRedisNil = errors.New("redis: nil")
+
+// RedisCache stores subscriptions in Redis. It speaks just enough of the Redis
+// protocol to get, set and delete keys.
+type RedisCache struct {
+	settings RedisSettings
+	ttl      time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisCache returns a cache stored in the configured Redis database. The
+// server is contacted so that configuration errors are caught at startup.
+func NewRedisCache(settings RedisSettings, ttl time.Duration) (*RedisCache, error) {
+	if settings.Address == "" {
+		return nil, fmt.Errorf("the Redis address is required")
+	}
+	if settings.Prefix == "" {
+		settings.Prefix = DefaultRedisPrefix
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = DefaultRedisTimeout
+	}
+
+	c := &RedisCache{
+		settings: settings,
+		ttl:      ttl,
+		idle:     make(chan *redisConn, maxIdleRedisConns),
+	}
+
+	if _, err := c.do(context.Background(), "PING"); err != nil {
+		return nil, fmt.Errorf("unable to connect to Redis at %s: %w", settings.Address, err)
+	}
+	return c, nil
+}
+
+// dial opens a new connection, authenticating and selecting the database if
+// necessary.
+func (c *RedisCache) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: c.settings.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", c.settings.Address)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if c.settings.Password != "" {
+		setup = append(setup, []string{"AUTH", c.settings.Password})
+	}
+	if c.settings.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.settings.DB)})
+	}
+	for _, args := range setup {
+		if _, err = rc.command(c.settings.Timeout, args...); err != nil {
+			conn.Close() // nolint:errcheck
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// do sends a command on an idle connection, or a new one if none are idle.
+// Connections are only reused if the command succeeded or failed with an error
+// reported by the server.
+func (c *RedisCache) do(ctx context.Context, args ...string) (any, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.command(c.settings.Timeout, args...)
+	var serverErr redisError
+	if err != nil && !errors.Is(err, errRedisNil) && !errors.As(err, &serverErr) {
+		rc.conn.Close() // nolint:errcheck
+		return nil, err
+	}
+
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close() // nolint:errcheck
+	}
+	return reply, err
+}
+
+// redisError is an error reported by the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// command writes a command to the connection and reads the reply.
+func (rc *redisConn) command(timeout time.Duration, args ...string) (any, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return rc.reply()
+}
+
+// reply reads a single reply. Only the reply types returned by the commands
+// that the cache uses are supported.
+func (rc *redisConn) reply() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, length+2)
+		if _, err = io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply: %q", line)
+	}
+}
+
+func (c *RedisCache) key(username string) string {
+	return c.settings.Prefix + username
+}
+
+func (c *RedisCache) Get(ctx context.Context, username string) (*db.Subscription, bool) {
+	reply, err := c.do(ctx, "GET", c.key(username))
+	if errors.Is(err, errRedisNil) {
+		return nil, false
+	}
+	if err != nil {
+		log.Errorf("unable to get the cached subscription for %s: %s", username, err)
+		return nil, false
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+
+	var subscription db.Subscription
+	if err = json.Unmarshal([]byte(value), &subscription); err != nil {
+		log.Errorf("unable to decode the cached subscription for %s: %s", username, err)
+		return nil, false
+	}
+	return &subscription, true
+}
+
+func (c *RedisCache) Set(ctx context.Context, username string, subscription *db.Subscription) {
+	value, err := json.Marshal(subscription)
+	if err != nil {
+		log.Errorf("unable to encode the subscription for %s: %s", username, err)
+		return
+	}
+
+	ttl := strconv.FormatInt(c.ttl.Milliseconds(), 10)
+	if _, err = c.do(ctx, "SET", c.key(username), string(value), "PX", ttl); err != nil {
+		log.Errorf("unable to cache the subscription for %s: %s", username, err)
+	}
+}
+
+func (c *RedisCache) Invalidate(ctx context.Context, usernames ...string) {
+	if len(usernames) == 0 {
+		return
+	}
+
+	args := []string{"DEL"}
+	for _, username := range usernames {
+		args = append(args, c.key(username))
+	}
+	if _, err := c.do(ctx, args...); err != nil {
+		log.Errorf("unable to invalidate the cached subscriptions for %v: %s", usernames, err)
+	}
+}
@@ -0,0 +1,102 @@
+package subcache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// relaySubjectSuffix is appended to the NATS subject prefix to form the subject
+// that invalidations are relayed on by default. None of the service's request
+// subjects end with it, so every instance receives each invalidation rather
+// than one member of a queue group.
+const relaySubjectSuffix = "cache.invalidate"
+
+// RelaySubject returns the default subject that invalidations are relayed on
+// for the NATS subject prefix, such as cyverse.qms.cache.invalidate.
+func RelaySubject(prefix string) string {
+	return prefix + "." + relaySubjectSuffix
+}
+
+// invalidation is the message relayed when cached subscriptions are removed.
+type invalidation struct {
+	Origin    string   `json:"origin"`
+	Usernames []string `json:"usernames"`
+}
+
+// RelayedCache wraps a cache that each instance of the service keeps for
+// itself, so that the instances stay consistent without relying on short TTLs.
+// Invalidations are published over NATS, and the invalidations published by
+// the other instances are applied to the wrapped cache as they arrive. Entries
+// that are set aren't relayed, since each instance reads them from the
+// database when it needs them.
+type RelayedCache struct {
+	Cache
+
+	conn    *nats.Conn
+	subject string
+	origin  string
+	sub     *nats.Subscription
+}
+
+// NewRelayedCache wraps the cache and starts applying the invalidations
+// published by the other instances of the service on the subject.
+func NewRelayedCache(cache Cache, conn *nats.Conn, subject string) (*RelayedCache, error) {
+	c := &RelayedCache{
+		Cache:   cache,
+		conn:    conn,
+		subject: subject,
+		origin:  uuid.NewString(),
+	}
+
+	sub, err := conn.Subscribe(subject, c.receive)
+	if err != nil {
+		return nil, fmt.Errorf("unable to subscribe to cache invalidations on %s: %w", subject, err)
+	}
+	c.sub = sub
+
+	return c, nil
+}
+
+// Invalidate removes the cached subscriptions for the users and tells the
+// other instances to do the same. Failures to publish are logged, and the
+// other instances pick up the change once their entries expire.
+func (c *RelayedCache) Invalidate(ctx context.Context, usernames ...string) {
+	c.Cache.Invalidate(ctx, usernames...)
+	if len(usernames) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(&invalidation{Origin: c.origin, Usernames: usernames})
+	if err != nil {
+		log.Errorf("unable to encode a cache invalidation: %s", err)
+		return
+	}
+	if err = c.conn.Publish(c.subject, data); err != nil {
+		log.Errorf("unable to relay a cache invalidation on %s: %s", c.subject, err)
+	}
+}
+
+// receive applies an invalidation published by another instance.
+func (c *RelayedCache) receive(msg *nats.Msg) {
+	var message invalidation
+	if err := json.Unmarshal(msg.Data, &message); err != nil {
+		log.Errorf("unable to decode a cache invalidation: %s", err)
+		return
+	}
+
+	// This instance has already applied its own invalidations.
+	if message.Origin == c.origin {
+		return
+	}
+
+	c.Cache.Invalidate(context.Background(), message.Usernames...)
+}
+
+// Close stops applying the invalidations published by other instances.
+func (c *RelayedCache) Close() error {
+	return c.sub.Unsubscribe()
+}
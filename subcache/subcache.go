@@ -0,0 +1,80 @@
+// Package subcache caches each user's active subscription so that hot paths,
+// such as recording usages and checking for overages, don't have to join the
+// subscriptions, users, plans and plan rates tables for every request. Entries
+// expire after a short time and are invalidated explicitly whenever a user's
+// subscriptions change. The cache can be kept in process or shared between
+// instances of the service in Redis, and invalidations can be relayed between
+// instances that keep their own caches over NATS.
+package subcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "subcache"})
+
+// The supported cache backends.
+const (
+	BackendMemory = "memory"
+	BackendRedis  = "redis"
+)
+
+// Cache stores active subscriptions by username. Failures to reach a shared
+// cache are logged and treated as cache misses, so the cache can never cause a
+// request to fail.
+type Cache interface {
+	// Get returns the cached subscription for the user, if there is one.
+	Get(ctx context.Context, username string) (*db.Subscription, bool)
+
+	// Set caches the subscription for the user.
+	Set(ctx context.Context, username string, subscription *db.Subscription)
+
+	// Invalidate removes the cached subscriptions for the users.
+	Invalidate(ctx context.Context, usernames ...string)
+}
+
+// Settings selects and configures the cache backend.
+type Settings struct {
+	// Backend is the name of the cache backend to use.
+	Backend string
+
+	// TTL is how long an entry is kept. It defaults to 30 seconds.
+	TTL time.Duration
+
+	// MaxEntries is the maximum number of entries kept in process. It defaults
+	// to 10000 and isn't used by the Redis backend.
+	MaxEntries int
+
+	Redis RedisSettings
+}
+
+// The default cache settings.
+const (
+	DefaultTTL        = 30 * time.Second
+	DefaultMaxEntries = 10000
+)
+
+// New returns a cache for the configured backend.
+func New(settings Settings) (Cache, error) {
+	if settings.TTL <= 0 {
+		settings.TTL = DefaultTTL
+	}
+	if settings.MaxEntries <= 0 {
+		settings.MaxEntries = DefaultMaxEntries
+	}
+
+	switch settings.Backend {
+	case "", BackendMemory:
+		return NewMemoryCache(settings.TTL, settings.MaxEntries), nil
+	case BackendRedis:
+		return NewRedisCache(settings.Redis, settings.TTL)
+	default:
+		return nil, fmt.Errorf("unsupported subscription cache backend: %q", settings.Backend)
+	}
+}
@@ -0,0 +1,161 @@
+// Package subjects defines the NATS subjects for operations that are specific
+// to this service and aren't included in the go-mod/subjects/qms package. The
+// subjects use the same prefix as the shared QMS subjects so that they're
+// affected by the subject prefix configuration in the same way.
+package subjects
+
+import "fmt"
+
+const (
+	qmsAdmin    = "cyverse.qms.admin"
+	qmsPlan     = "cyverse.qms.plan"
+	qmsSubAddon = "cyverse.qms.user.plan.addons"
+	qmsEvents   = "cyverse.qms.events"
+	qmsUser     = "cyverse.qms.user"
+	qmsUserPlan = "cyverse.qms.user.plan"
+	qmsExternal = "cyverse.qms.external"
+	qmsUsers    = "cyverse.qms.users"
+	qmsOverages = "cyverse.qms.user.overages"
+)
+
+var (
+	Ping          = "cyverse.qms.ping"
+	GetAPIVersion = "cyverse.qms.api.version"
+
+	ExpireCohort = fmt.Sprintf("%s.cohort.expire", qmsAdmin)
+	GetBulkJob   = fmt.Sprintf("%s.jobs.get", qmsAdmin)
+
+	RespondFailures = fmt.Sprintf("%s.responses.failures", qmsAdmin)
+
+	AddWebhook    = fmt.Sprintf("%s.webhooks.add", qmsAdmin)
+	ListWebhooks  = fmt.Sprintf("%s.webhooks.list", qmsAdmin)
+	GetWebhook    = fmt.Sprintf("%s.webhooks.get", qmsAdmin)
+	UpdateWebhook = fmt.Sprintf("%s.webhooks.update", qmsAdmin)
+	DeleteWebhook = fmt.Sprintf("%s.webhooks.delete", qmsAdmin)
+
+	GetTestAccount = fmt.Sprintf("%s.users.test.get", qmsAdmin)
+	SetTestAccount = fmt.Sprintf("%s.users.test.set", qmsAdmin)
+	MergeUsers     = fmt.Sprintf("%s.users.merge", qmsAdmin)
+	PurgeUser      = fmt.Sprintf("%s.users.purge", qmsAdmin)
+
+	SchedulePlanChange = fmt.Sprintf("%s.plan.changes.add", qmsAdmin)
+	ListPlanChanges    = fmt.Sprintf("%s.plan.changes.list", qmsAdmin)
+	CancelPlanChange   = fmt.Sprintf("%s.plan.changes.cancel", qmsAdmin)
+
+	SetTrialPlan        = fmt.Sprintf("%s.plans.trial.set", qmsAdmin)
+	SetQuotaExemptPlan  = fmt.Sprintf("%s.plans.exempt.set", qmsAdmin)
+	SetPlanPeriod       = fmt.Sprintf("%s.plans.period.set", qmsAdmin)
+	TrialConversions    = fmt.Sprintf("%s.plans.trial.conversions", qmsAdmin)
+	DeletePlan          = fmt.Sprintf("%s.plans.delete", qmsAdmin)
+	ClonePlan           = fmt.Sprintf("%s.plans.clone", qmsAdmin)
+	GetPlanSnapshot     = fmt.Sprintf("%s.plans.snapshot", qmsAdmin)
+	SubscriptionsByPlan = fmt.Sprintf("%s.plans.subscriptions", qmsAdmin)
+
+	AddPlanFeature    = fmt.Sprintf("%s.plans.features.add", qmsAdmin)
+	RemovePlanFeature = fmt.Sprintf("%s.plans.features.remove", qmsAdmin)
+	ListPlanFeatures  = fmt.Sprintf("%s.plans.features.list", qmsAdmin)
+	UserHasFeature    = fmt.Sprintf("%s.features.check", qmsUser)
+
+	GetOverageReport    = fmt.Sprintf("%s.reports.overages", qmsAdmin)
+	GetRevenueReport    = fmt.Sprintf("%s.reports.revenue", qmsAdmin)
+	ExportSubscriptions = fmt.Sprintf("%s.exports.subscriptions", qmsAdmin)
+
+	AddResourceType    = fmt.Sprintf("%s.resource-types.add", qmsAdmin)
+	UpdateResourceType = fmt.Sprintf("%s.resource-types.update", qmsAdmin)
+	ListResourceTypes  = fmt.Sprintf("%s.resource-types.list", qmsAdmin)
+
+	SetQuotaPolicy    = fmt.Sprintf("%s.quotas.policies.set", qmsAdmin)
+	ListQuotaPolicies = fmt.Sprintf("%s.quotas.policies.list", qmsAdmin)
+	EnforceQuota      = fmt.Sprintf("%s.quotas.enforce", qmsUser)
+
+	ScheduleQuotaChange = fmt.Sprintf("%s.quotas.changes.add", qmsAdmin)
+	ListQuotaChanges    = fmt.Sprintf("%s.quotas.changes.list", qmsAdmin)
+	CancelQuotaChange   = fmt.Sprintf("%s.quotas.changes.cancel", qmsAdmin)
+	AdjustQuotasBatch   = fmt.Sprintf("%s.quotas.adjust", qmsAdmin)
+
+	DepositCredits   = fmt.Sprintf("%s.credits.deposit", qmsAdmin)
+	GetCreditBalance = fmt.Sprintf("%s.credits.balance", qmsUser)
+	ListCreditLedger = fmt.Sprintf("%s.credits.ledger", qmsUser)
+
+	SetUsageRule             = fmt.Sprintf("%s.usages.rules.set", qmsAdmin)
+	ListUsageRules           = fmt.Sprintf("%s.usages.rules.list", qmsAdmin)
+	ListFlaggedUsageUpdates  = fmt.Sprintf("%s.usages.flagged.list", qmsAdmin)
+	ReviewFlaggedUsageUpdate = fmt.Sprintf("%s.usages.flagged.review", qmsAdmin)
+	ListQuarantinedUpdates   = fmt.Sprintf("%s.usages.quarantine.list", qmsAdmin)
+	ApproveQuarantinedUpdate = fmt.Sprintf("%s.usages.quarantine.approve", qmsAdmin)
+	RejectQuarantinedUpdate  = fmt.Sprintf("%s.usages.quarantine.reject", qmsAdmin)
+
+	SetMeteredRate        = fmt.Sprintf("%s.rates.metered.set", qmsAdmin)
+	PreviewOverageBilling = fmt.Sprintf("%s.billing.preview", qmsOverages)
+
+	ChangeSubscriptionPlan  = fmt.Sprintf("%s.change", qmsUserPlan)
+	StartTrial              = fmt.Sprintf("%s.trial.start", qmsUserPlan)
+	GetSubscriptionSummary  = fmt.Sprintf("%s.summary", qmsUserPlan)
+	ListUserSubscriptions   = fmt.Sprintf("%s.list", qmsUserPlan)
+	GetSubscriptionDiscount = fmt.Sprintf("%s.discount.get", qmsUserPlan)
+	GetSubscriptionInvoices = fmt.Sprintf("%s.invoices.get", qmsUserPlan)
+	ComparePlans            = fmt.Sprintf("%s.compare", qmsUserPlan)
+
+	GetSubscriptionPaymentStatus = fmt.Sprintf("%s.payment.get", qmsUserPlan)
+	SetSubscriptionPaymentStatus = fmt.Sprintf("%s.subscriptions.payment.set", qmsAdmin)
+
+	GetSubscriptionAnnotations = fmt.Sprintf("%s.subscriptions.annotations.get", qmsAdmin)
+	AddSubscriptionNote        = fmt.Sprintf("%s.subscriptions.notes.add", qmsAdmin)
+	DeleteSubscriptionNote     = fmt.Sprintf("%s.subscriptions.notes.delete", qmsAdmin)
+	SetSubscriptionTag         = fmt.Sprintf("%s.subscriptions.tags.set", qmsAdmin)
+	DeleteSubscriptionTag      = fmt.Sprintf("%s.subscriptions.tags.delete", qmsAdmin)
+
+	SummarizeSubscriptionAddons = fmt.Sprintf("%s.summary", qmsSubAddon)
+	AttachAddonBundle           = fmt.Sprintf("%s.bundles.attach", qmsSubAddon)
+
+	AddAddonBundle        = fmt.Sprintf("%s.addons.bundles.add", qmsAdmin)
+	ListAddonBundles      = fmt.Sprintf("%s.addons.bundles.list", qmsAdmin)
+	SetAddonPrerequisites = fmt.Sprintf("%s.addons.prerequisites.set", qmsAdmin)
+	GetAddonPrerequisites = fmt.Sprintf("%s.addons.prerequisites.get", qmsAdmin)
+	SetAddonCompatibility = fmt.Sprintf("%s.addons.compatibility.set", qmsAdmin)
+	GetAddonCompatibility = fmt.Sprintf("%s.addons.compatibility.get", qmsAdmin)
+	SetAddonLimit         = fmt.Sprintf("%s.addons.limits.set", qmsAdmin)
+	ListAddonsForPlan     = fmt.Sprintf("%s.addons.list", qmsPlan)
+
+	ForecastUsage     = fmt.Sprintf("%s.usages.forecast", qmsUser)
+	GetUsageBreakdown = fmt.Sprintf("%s.usages.addons", qmsUser)
+	GetUsageRollups   = fmt.Sprintf("%s.usages.rollups", qmsUser)
+	GetUsageTotals    = fmt.Sprintf("%s.usages.totals", qmsAdmin)
+
+	RunRetention = fmt.Sprintf("%s.retention.run", qmsAdmin)
+
+	RunReconciliation = fmt.Sprintf("%s.reconciliation.run", qmsAdmin)
+
+	ReserveResource    = fmt.Sprintf("%s.reservations.add", qmsUser)
+	ReleaseReservation = fmt.Sprintf("%s.reservations.release", qmsUser)
+
+	BeginPurchase  = fmt.Sprintf("%s.purchases.begin", qmsUser)
+	CommitPurchase = fmt.Sprintf("%s.purchases.commit", qmsUser)
+	AbortPurchase  = fmt.Sprintf("%s.purchases.abort", qmsUser)
+
+	AddDiscountCode   = fmt.Sprintf("%s.discounts.add", qmsAdmin)
+	GetDiscountCode   = fmt.Sprintf("%s.discounts.get", qmsAdmin)
+	ListDiscountCodes = fmt.Sprintf("%s.discounts.list", qmsAdmin)
+
+	GenerateInvoice = fmt.Sprintf("%s.invoices.generate", qmsAdmin)
+	GetInvoice      = fmt.Sprintf("%s.invoices.get", qmsAdmin)
+	ListInvoices    = fmt.Sprintf("%s.invoices.list", qmsAdmin)
+
+	AddGroup          = fmt.Sprintf("%s.groups.add", qmsAdmin)
+	GetGroup          = fmt.Sprintf("%s.groups.get", qmsAdmin)
+	AddGroupMember    = fmt.Sprintf("%s.groups.members.add", qmsAdmin)
+	RemoveGroupMember = fmt.Sprintf("%s.groups.members.remove", qmsAdmin)
+	SubscribeGroup    = fmt.Sprintf("%s.groups.subscribe", qmsAdmin)
+
+	GetEventSchemas = fmt.Sprintf("%s.schemas.get", qmsEvents)
+
+	CreateUser = fmt.Sprintf("%s.add", qmsUsers)
+	EnsureUser = fmt.Sprintf("%s.ensure", qmsUsers)
+	GetUser    = fmt.Sprintf("%s.get", qmsUsers)
+	ListUsers  = fmt.Sprintf("%s.list", qmsUsers)
+
+	NormalizeUsername = fmt.Sprintf("%s.normalize", qmsUsers)
+
+	GetSubscriptionByExternalID      = fmt.Sprintf("%s.subscriptions.get", qmsExternal)
+	GetSubscriptionAddonByExternalID = fmt.Sprintf("%s.addons.get", qmsExternal)
+)
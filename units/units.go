@@ -0,0 +1,155 @@
+// Package units converts resource amounts between units of the same dimension,
+// so that producers can report usage in whichever unit is convenient for them
+// and responses can present amounts in a unit that's easy to read. Resource
+// types are stored in their canonical unit, such as bytes, and units that this
+// package doesn't know about can't be converted at all.
+package units
+
+import (
+	"math"
+	"strings"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// The dimensions that units measure. Only units of the same dimension can be
+// converted to each other.
+const (
+	DimensionData    = "data"
+	DimensionTime    = "time"
+	DimensionCPUTime = "cpu time"
+	DimensionGPUTime = "gpu time"
+)
+
+// Unit describes a unit that amounts can be converted to and from.
+type Unit struct {
+	// Name is the canonical name of the unit, which is the name that resource
+	// types are stored with.
+	Name string
+
+	// Symbol is the short name of the unit that's used when amounts are
+	// displayed.
+	Symbol string
+
+	// Dimension is what the unit measures.
+	Dimension string
+
+	// Factor is the size of the unit in the base unit of its dimension, such as
+	// bytes or seconds.
+	Factor float64
+
+	// Display is set for the units that amounts are displayed in.
+	Display bool
+}
+
+const (
+	kb  = 1e3
+	kib = 1 << 10
+	hr  = 60 * 60
+)
+
+// known lists the units that can be converted, along with their aliases. Data
+// sizes are displayed in decimal units because that's what most people expect
+// to see, but producers can report them in binary units as well.
+var known = []struct {
+	unit    Unit
+	aliases []string
+}{
+	{Unit{"bytes", "B", DimensionData, 1, true}, []string{"byte", "b"}},
+	{Unit{"kilobytes", "KB", DimensionData, kb, true}, []string{"kilobyte", "kb"}},
+	{Unit{"megabytes", "MB", DimensionData, kb * kb, true}, []string{"megabyte", "mb"}},
+	{Unit{"gigabytes", "GB", DimensionData, kb * kb * kb, true}, []string{"gigabyte", "gb"}},
+	{Unit{"terabytes", "TB", DimensionData, kb * kb * kb * kb, true}, []string{"terabyte", "tb"}},
+	{Unit{"petabytes", "PB", DimensionData, kb * kb * kb * kb * kb, true}, []string{"petabyte", "pb"}},
+	{Unit{"kibibytes", "KiB", DimensionData, kib, false}, []string{"kibibyte", "kib"}},
+	{Unit{"mebibytes", "MiB", DimensionData, kib * kib, false}, []string{"mebibyte", "mib"}},
+	{Unit{"gibibytes", "GiB", DimensionData, kib * kib * kib, false}, []string{"gibibyte", "gib"}},
+	{Unit{"tebibytes", "TiB", DimensionData, kib * kib * kib * kib, false}, []string{"tebibyte", "tib"}},
+	{Unit{"pebibytes", "PiB", DimensionData, kib * kib * kib * kib * kib, false}, []string{"pebibyte", "pib"}},
+	{Unit{"seconds", "seconds", DimensionTime, 1, true}, []string{"second", "s"}},
+	{Unit{"minutes", "minutes", DimensionTime, 60, true}, []string{"minute", "min"}},
+	{Unit{"hours", "hours", DimensionTime, hr, true}, []string{"hour", "h"}},
+	{Unit{"days", "days", DimensionTime, 24 * hr, true}, []string{"day", "d"}},
+	{Unit{"cpu seconds", "CPU seconds", DimensionCPUTime, 1, true}, []string{"cpu second"}},
+	{Unit{"cpu minutes", "CPU minutes", DimensionCPUTime, 60, true}, []string{"cpu minute"}},
+	{Unit{"cpu hours", "CPU hours", DimensionCPUTime, hr, true}, []string{"cpu hour"}},
+	{Unit{"gpu seconds", "GPU seconds", DimensionGPUTime, 1, true}, []string{"gpu second"}},
+	{Unit{"gpu minutes", "GPU minutes", DimensionGPUTime, 60, true}, []string{"gpu minute"}},
+	{Unit{"gpu hours", "GPU hours", DimensionGPUTime, hr, true}, []string{"gpu hour"}},
+}
+
+// byName maps the canonical names and aliases of the known units to the units.
+var byName = func() map[string]Unit {
+	result := make(map[string]Unit)
+	for _, entry := range known {
+		result[entry.unit.Name] = entry.unit
+		for _, alias := range entry.aliases {
+			result[alias] = entry.unit
+		}
+	}
+	return result
+}()
+
+// Normalize returns a unit name in lower case with single spaces between
+// words, which is the form that resource type units are stored in.
+func Normalize(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// Lookup returns the unit with a name or alias, ignoring case and spacing.
+func Lookup(name string) (Unit, bool) {
+	unit, ok := byName[Normalize(name)]
+	return unit, ok
+}
+
+// Convert converts an amount from one unit to another. Units that are the same
+// once they're normalized don't need to be known. Returns
+// ErrInvalidResourceUnit if either unit is unknown or if they measure
+// different dimensions.
+func Convert(value float64, from, to string) (float64, error) {
+	if Normalize(from) == Normalize(to) {
+		return value, nil
+	}
+
+	fromUnit, ok := Lookup(from)
+	if !ok {
+		return 0, suberrors.ErrInvalidResourceUnit
+	}
+	toUnit, ok := Lookup(to)
+	if !ok || fromUnit.Dimension != toUnit.Dimension {
+		return 0, suberrors.ErrInvalidResourceUnit
+	}
+
+	return value * fromUnit.Factor / toUnit.Factor, nil
+}
+
+// displayPrecision is used to round displayed amounts to three decimal places.
+const displayPrecision = 1e3
+
+// Humanize converts an amount to the largest display unit of the same
+// dimension that it's at least one of, and returns the converted amount,
+// rounded to three decimal places, along with the unit's symbol. Amounts in
+// units that aren't known are returned unchanged.
+func Humanize(value float64, unit string) (float64, string) {
+	from, ok := Lookup(unit)
+	if !ok {
+		return value, unit
+	}
+
+	base := value * from.Factor
+	best := from
+	for _, entry := range known {
+		candidate := entry.unit
+		if !candidate.Display || candidate.Dimension != from.Dimension {
+			continue
+		}
+		if math.Abs(base) >= candidate.Factor && (!best.Display || candidate.Factor > best.Factor) {
+			best = candidate
+		}
+	}
+	if !best.Display {
+		return math.Round(value*displayPrecision) / displayPrecision, from.Symbol
+	}
+
+	return math.Round(base/best.Factor*displayPrecision) / displayPrecision, best.Symbol
+}
@@ -0,0 +1,95 @@
+// Package usernames canonicalizes the usernames in requests so that every
+// spelling of a username that the service accepts refers to the same user.
+package usernames
+
+import (
+	"regexp"
+	"strings"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+)
+
+// Normalizer converts usernames to their canonical form.
+type Normalizer interface {
+	// Normalize returns the canonical form of a username. Empty usernames are
+	// returned unchanged so that callers can decide how to handle them.
+	// Returns ErrInvalidUsername if the username isn't acceptable.
+	Normalize(username string) (string, error)
+}
+
+// Settings controls how usernames are normalized.
+type Settings struct {
+	// StripDomain removes everything from the first @ onward.
+	StripDomain bool
+
+	// Lowercase converts usernames to lower case.
+	Lowercase bool
+
+	// Reject is a regular expression that matches usernames that aren't
+	// acceptable. It's applied before the suffix is appended. Nothing is
+	// rejected if it's empty.
+	Reject string
+
+	// Suffix is appended to usernames that don't already end with it.
+	Suffix string
+}
+
+// DefaultSettings returns the default normalization settings, which only strip
+// the domain from usernames.
+func DefaultSettings() Settings {
+	return Settings{
+		StripDomain: true,
+	}
+}
+
+// Rules normalizes usernames according to its settings.
+type Rules struct {
+	settings Settings
+	reject   *regexp.Regexp
+}
+
+// NewRules returns rules that normalize usernames according to the given
+// settings. Returns an error if the rejection pattern can't be compiled.
+func NewRules(settings Settings) (*Rules, error) {
+	rules := &Rules{settings: settings}
+
+	if settings.Reject != "" {
+		re, err := regexp.Compile(settings.Reject)
+		if err != nil {
+			return nil, err
+		}
+		rules.reject = re
+	}
+
+	return rules, nil
+}
+
+// Default returns the rules for the default settings.
+func Default() *Rules {
+	return &Rules{settings: DefaultSettings()}
+}
+
+// Settings returns the settings that the rules were created with.
+func (r *Rules) Settings() Settings {
+	return r.settings
+}
+
+// Normalize returns the canonical form of a username.
+func (r *Rules) Normalize(username string) (string, error) {
+	if r.settings.StripDomain {
+		username, _, _ = strings.Cut(username, "@")
+	}
+	if r.settings.Lowercase {
+		username = strings.ToLower(username)
+	}
+	if username == "" {
+		return "", nil
+	}
+	if r.reject != nil && r.reject.MatchString(username) {
+		return "", suberrors.ErrInvalidUsername
+	}
+	if r.settings.Suffix != "" && !strings.HasSuffix(username, r.settings.Suffix) {
+		username += r.settings.Suffix
+	}
+	return username, nil
+}
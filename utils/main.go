@@ -56,14 +56,14 @@ func ParseTimestamp(value string) (time.Time, error) {
 }
 
 // EndTimeForValue returns the time to use for the given date value. If the given date value is empty then the
-// resulting timestamp will be one year from the current time. Otherwise, the timestamp will be parsed using
-// ParseTimestamp.
+// zero time is returned, so that the subscription ends after the plan's subscription period. Otherwise, the timestamp
+// will be parsed using ParseTimestamp.
 func EndTimeForValue(value string) (time.Time, error) {
 	var t time.Time
 
-	// Use the default end time if the value is empty.
+	// Leave the end time to the plan's subscription period if the value is empty.
 	if value == "" {
-		return time.Now().AddDate(1, 0, 0), nil
+		return t, nil
 	}
 
 	// Parse the timestamp.
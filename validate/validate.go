@@ -0,0 +1,65 @@
+// Package validate checks the fields of requests before they're handled. The
+// problems it finds are reported as typed errors from the errors package so
+// that clients can tell a missing field from an invalid one without parsing
+// error messages.
+package validate
+
+import (
+	"strings"
+
+	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/google/uuid"
+)
+
+// Validator is implemented by requests that can check their own fields.
+type Validator interface {
+	Validate() error
+}
+
+// Request validates the request if it implements Validator.
+func Request(request any) error {
+	if v, ok := request.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// Required returns a MISSING_FIELD error if the value is blank.
+func Required(field, value string) error {
+	if strings.TrimSpace(value) == "" {
+		return serrors.MissingField(field)
+	}
+	return nil
+}
+
+// UUID returns a MISSING_FIELD error if the value is blank and an INVALID_UUID
+// error if it isn't a UUID.
+func UUID(field, value string) error {
+	if err := Required(field, value); err != nil {
+		return err
+	}
+	return OptionalUUID(field, value)
+}
+
+// OptionalUUID returns an INVALID_UUID error if the value is set but isn't a
+// UUID in its standard form, which is the only form that every caller accepts.
+func OptionalUUID(field, value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := uuid.Parse(value); err != nil || len(value) != 36 {
+		return serrors.InvalidUUID(field)
+	}
+	return nil
+}
+
+// First returns the first of the errors that isn't nil, so that a request's
+// checks can be listed in the order that they're reported in.
+func First(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Package webhooks delivers subscription lifecycle events to the URLs that have
+// been registered to receive them. Payloads are signed with the secret of each
+// webhook so that receivers can verify where they came from. Deliveries that
+// fail are retried with exponential backoff, and deliveries that fail on every
+// attempt are recorded in the database.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/subscriptions/api"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "webhooks"})
+
+// The headers included in every webhook delivery.
+const (
+	EventTypeHeader = "X-QMS-Event"
+	EventIDHeader   = "X-QMS-Event-ID"
+	TimestampHeader = "X-QMS-Timestamp"
+	SignatureHeader = "X-QMS-Signature"
+)
+
+// Settings controls how webhooks are delivered.
+type Settings struct {
+	// MaxAttempts is the number of times a delivery is attempted before it's
+	// recorded as a failed delivery.
+	MaxAttempts int
+
+	// InitialBackoff is the amount of time to wait before the first retry. The
+	// wait time doubles for every retry after that.
+	InitialBackoff time.Duration
+
+	// Timeout is the maximum amount of time a single delivery attempt may take.
+	Timeout time.Duration
+}
+
+// DefaultSettings returns the default delivery settings.
+func DefaultSettings() Settings {
+	return Settings{
+		MaxAttempts:    5,
+		InitialBackoff: time.Second,
+		Timeout:        10 * time.Second,
+	}
+}
+
+// Dispatcher sends events to registered webhooks.
+type Dispatcher struct {
+	db       *db.Database
+	client   *http.Client
+	settings Settings
+}
+
+// NewDispatcher returns a new *Dispatcher that looks up webhooks in the given
+// database.
+func NewDispatcher(d *db.Database, settings Settings) *Dispatcher {
+	if settings.MaxAttempts < 1 {
+		settings.MaxAttempts = 1
+	}
+	return &Dispatcher{
+		db:       d,
+		client:   &http.Client{Timeout: settings.Timeout},
+		settings: settings,
+	}
+}
+
+// Sign returns the signature of a webhook payload, which is the hex-encoded
+// HMAC-SHA256 of the timestamp, a period and the payload, keyed by the secret.
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatch sends an event to every enabled webhook that is registered for the
+// event type. The deliveries happen in the background, so Dispatch doesn't
+// block the caller or report delivery errors.
+func (d *Dispatcher) Dispatch(ctx context.Context, eventType string, data any) {
+	go d.dispatch(context.WithoutCancel(ctx), api.NewEvent(eventType, data))
+}
+
+// dispatch looks up the webhooks for an event and delivers it to each of them.
+func (d *Dispatcher) dispatch(ctx context.Context, event *api.Event) {
+	log := log.WithFields(logrus.Fields{"event": event.ID, "type": event.Type})
+
+	webhooks, err := d.db.ListWebhooksForEvent(ctx, event.Type)
+	if err != nil {
+		log.Errorf("unable to look up the webhooks for the event: %s", err)
+		return
+	}
+	if len(webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("unable to encode the event: %s", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		go d.deliver(ctx, webhook, event, payload)
+	}
+}
+
+// deliver sends the payload to a single webhook, retrying failed attempts. If
+// every attempt fails, the delivery is recorded as a failed delivery.
+func (d *Dispatcher) deliver(ctx context.Context, webhook db.Webhook, event *api.Event, payload []byte) {
+	log := log.WithFields(logrus.Fields{"event": event.ID, "type": event.Type, "webhook": webhook.ID})
+
+	var err error
+	backoff := d.settings.InitialBackoff
+	for attempt := 1; attempt <= d.settings.MaxAttempts; attempt++ {
+		if err = d.post(ctx, webhook, event, payload); err == nil {
+			return
+		}
+		log.Warnf("delivery attempt %d failed: %s", attempt, err)
+
+		if attempt < d.settings.MaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	delivery := &db.FailedDelivery{
+		WebhookID: webhook.ID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		Payload:   string(payload),
+		Attempts:  d.settings.MaxAttempts,
+		LastError: err.Error(),
+	}
+	if err = d.db.AddFailedDelivery(ctx, delivery); err != nil {
+		log.Errorf("unable to record the failed delivery: %s", err)
+	}
+}
+
+// post makes a single delivery attempt.
+func (d *Dispatcher) post(ctx context.Context, webhook db.Webhook, event *api.Event, payload []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventTypeHeader, event.Type)
+	req.Header.Set(EventIDHeader, event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, timestamp, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}